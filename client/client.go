@@ -0,0 +1,113 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client implements a Go client for the administration endpoints of
+// prom-label-proxy, served on the internal listen address.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// Error is returned when the proxy responds with an unexpected status code.
+type Error struct {
+	StatusCode int
+	// Message is the error message returned by the proxy, if any.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.Message)
+}
+
+// Client queries the administration endpoints of prom-label-proxy.
+type Client struct {
+	url    *url.URL
+	client *http.Client
+}
+
+// New returns a client for the proxy at the given URL (e.g. the internal
+// listen address http://localhost:8081).
+func New(u *url.URL, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Client{
+		url:    u,
+		client: client,
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, expCode int, v interface{}) error {
+	u := c.url.JoinPath(path)
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expCode {
+		var res struct {
+			Error string `json:"error"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = json.Unmarshal(b, &res)
+		return &Error{StatusCode: resp.StatusCode, Message: res.Error}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	return nil
+}
+
+// ActiveQueries returns the in-flight queries, the oldest first. It requires
+// the proxy to run with -enable-active-queries.
+func (c *Client) ActiveQueries(ctx context.Context) ([]injectproxy.ActiveQuery, error) {
+	var queries []injectproxy.ActiveQuery
+	if err := c.do(ctx, http.MethodGet, injectproxy.ActiveQueriesPath, nil, http.StatusOK, &queries); err != nil {
+		return nil, err
+	}
+
+	return queries, nil
+}
+
+// CancelQuery cancels the in-flight query with the given ID. The error is an
+// *Error with the http.StatusNotFound status code if the query isn't found
+// (e.g. it completed in the meantime).
+func (c *Client) CancelQuery(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, injectproxy.ActiveQueriesPath, url.Values{"id": []string{id}}, http.StatusNoContent, nil)
+}
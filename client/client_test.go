@@ -0,0 +1,99 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+func TestActiveQueries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/prefix"+injectproxy.ActiveQueriesPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			w.Write([]byte(`[{"id":"1","fingerprint":"0123456789abcdef","handler":"/api/v1/query","tenants":["ns1"],"query":"up","upstream":"prometheus:9090","startedAt":"2024-01-01T00:00:00Z","elapsedSeconds":1.5}]`))
+		case http.MethodDelete:
+			if req.URL.Query().Get("id") != "1" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status":"error","errorType":"prom-label-proxy","error":"query not found"}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/prefix")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := New(u, nil)
+	ctx := context.Background()
+
+	queries, err := c.ActiveQueries(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(queries) != 1 || queries[0].ID != "1" || queries[0].Query != "up" || queries[0].ElapsedSeconds != 1.5 {
+		t.Fatalf("unexpected active queries: %+v", queries)
+	}
+
+	if err := c.CancelQuery(ctx, "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = c.CancelQuery(ctx, "2")
+	var cerr *Error
+	if !errors.As(err, &cerr) || cerr.StatusCode != http.StatusNotFound || cerr.Message != "query not found" {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestActiveQueriesTracker(t *testing.T) {
+	tracker := injectproxy.NewActiveQueryTracker()
+	mux := http.NewServeMux()
+	mux.Handle(injectproxy.ActiveQueriesPath, tracker)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := New(u, nil)
+
+	queries, err := c.ActiveQueries(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(queries) != 0 {
+		t.Fatalf("expected no active query, got %+v", queries)
+	}
+
+	var cerr *Error
+	if err := c.CancelQuery(context.Background(), "1"); !errors.As(err, &cerr) || cerr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package e2etest provides a fake Prometheus upstream and helpers running the
+// whole proxy (routes and middlewares) in-process, so that the programs
+// embedding the injectproxy package can write realistic integration tests.
+//
+// For example:
+//
+//	up := e2etest.NewUpstream(t)
+//	up.SetLatency(100 * time.Millisecond)
+//	p := e2etest.NewProxy(t, up, "namespace", injectproxy.HTTPFormEnforcer{ParameterName: "namespace"})
+//
+//	resp := p.Get("/api/v1/query", url.Values{"query": {"up"}, "namespace": {"ns1"}})
+//	// up.Requests()[0].Form.Get("query") == `up{namespace="ns1"}`
+package e2etest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// defaultResponses are the responses of the fake upstream per path when no
+// canned response is set.
+var defaultResponses = map[string]Response{
+	"/api/v1/query":            {Body: `{"status":"success","data":{"resultType":"vector","result":[]}}`},
+	"/api/v1/query_range":      {Body: `{"status":"success","data":{"resultType":"matrix","result":[]}}`},
+	"/api/v1/query_exemplars":  {Body: `{"status":"success","data":[]}`},
+	"/api/v1/series":           {Body: `{"status":"success","data":[]}`},
+	"/api/v1/labels":           {Body: `{"status":"success","data":[]}`},
+	"/api/v1/label/":           {Body: `{"status":"success","data":[]}`},
+	"/api/v1/rules":            {Body: `{"status":"success","data":{"groups":[]}}`},
+	"/api/v1/alerts":           {Body: `{"status":"success","data":{"alerts":[]}}`},
+	"/api/v1/status/buildinfo": {Body: `{"status":"success","data":{"version":"2.53.0"}}`},
+	"/api/v1/status/flags":     {Body: `{"status":"success","data":{"storage.tsdb.path":"data/"}}`},
+	"/federate":                {Header: http.Header{"Content-Type": []string{"text/plain; version=0.0.4"}}},
+}
+
+// Request is a request received by the fake upstream.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	// Form holds the parameters from both the URL query string and the
+	// body.
+	Form url.Values
+}
+
+// Response is a canned response of the fake upstream.
+type Response struct {
+	// StatusCode defaults to 200.
+	StatusCode int
+	Header     http.Header
+	Body       string
+	// Latency delays the response, in addition to the latency of the
+	// upstream.
+	Latency time.Duration
+}
+
+// Upstream is a fake Prometheus API. By default, it returns successful empty
+// results for the query, series, labels, rules and alerts APIs and "404 Not
+// Found" for the other paths.
+type Upstream struct {
+	srv *httptest.Server
+	// URL is the URL of the upstream.
+	URL *url.URL
+
+	mtx       sync.Mutex
+	latency   time.Duration
+	responses map[string]Response
+	failures  []Response
+	requests  []Request
+}
+
+// NewUpstream starts a fake upstream which is stopped at the end of the test.
+func NewUpstream(t testing.TB) *Upstream {
+	t.Helper()
+
+	u := &Upstream{responses: map[string]Response{}}
+	u.srv = httptest.NewServer(u)
+	t.Cleanup(u.srv.Close)
+
+	var err error
+	u.URL, err = url.Parse(u.srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse the upstream URL: %v", err)
+	}
+
+	return u
+}
+
+// SetLatency delays all the responses.
+func (u *Upstream) SetLatency(d time.Duration) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	u.latency = d
+}
+
+// SetResponse sets the canned response for the path (e.g. "/api/v1/query").
+// The responses of the label values APIs are set with the "/api/v1/label/"
+// path.
+func (u *Upstream) SetResponse(path string, resp Response) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	u.responses[path] = resp
+}
+
+// FailNext returns the given response to the next n requests, whatever the
+// path, before resuming the normal responses.
+func (u *Upstream) FailNext(n int, resp Response) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	for i := 0; i < n; i++ {
+		u.failures = append(u.failures, resp)
+	}
+}
+
+// Requests returns the requests received so far, the oldest first.
+func (u *Upstream) Requests() []Request {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	return append([]Request(nil), u.requests...)
+}
+
+// Reset forgets the received requests, the canned responses, the pending
+// failures and the latency.
+func (u *Upstream) Reset() {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	u.latency = 0
+	u.responses = map[string]Response{}
+	u.failures = nil
+	u.requests = nil
+}
+
+// response returns the response for the request and records it.
+func (u *Upstream) response(req *http.Request) (Response, time.Duration, bool) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	u.requests = append(u.requests, Request{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Header: req.Header.Clone(),
+		Form:   req.Form,
+	})
+
+	if len(u.failures) > 0 {
+		resp := u.failures[0]
+		u.failures = u.failures[1:]
+		return resp, u.latency, true
+	}
+
+	path := req.URL.Path
+	if strings.HasPrefix(path, "/api/v1/label/") {
+		path = "/api/v1/label/"
+	}
+
+	if resp, found := u.responses[path]; found {
+		return resp, u.latency, true
+	}
+
+	if resp, found := defaultResponses[path]; found {
+		return resp, u.latency, true
+	}
+
+	return Response{}, u.latency, false
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+
+	resp, latency, found := u.response(req)
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+
+	select {
+	case <-time.After(latency + resp.Latency):
+	case <-req.Context().Done():
+		return
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.WriteString(w, resp.Body)
+}
+
+// Proxy is the proxy running in-process in front of a fake upstream.
+type Proxy struct {
+	t   testing.TB
+	srv *httptest.Server
+	// URL is the URL of the proxy.
+	URL *url.URL
+	// Handler is the proxy's handler as returned by injectproxy.NewRoutes.
+	Handler http.Handler
+}
+
+// NewProxy starts the proxy with the given options in front of the upstream.
+// It is stopped at the end of the test.
+func NewProxy(t testing.TB, u *Upstream, label string, el injectproxy.ExtractLabeler, opts ...injectproxy.Option) *Proxy {
+	t.Helper()
+
+	routes, err := injectproxy.NewRoutes(u.URL, label, el, opts...)
+	if err != nil {
+		t.Fatalf("failed to create the proxy: %v", err)
+	}
+
+	p := &Proxy{t: t, Handler: routes}
+	p.srv = httptest.NewServer(routes)
+	t.Cleanup(p.srv.Close)
+
+	p.URL, err = url.Parse(p.srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse the proxy URL: %v", err)
+	}
+
+	return p
+}
+
+// Do sends the request to the proxy. The request URL is relative to the
+// proxy (e.g. "/api/v1/query").
+func (p *Proxy) Do(req *http.Request) *Response {
+	p.t.Helper()
+
+	req.URL = p.URL.ResolveReference(req.URL)
+	req.RequestURI = ""
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		p.t.Fatalf("request to the proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.t.Fatalf("failed to read the response of the proxy: %v", err)
+	}
+
+	return &Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       string(b),
+		Latency:    time.Since(start),
+	}
+}
+
+// Get sends a GET request with the parameters in the URL query string.
+func (p *Proxy) Get(path string, params url.Values) *Response {
+	p.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+	if err != nil {
+		p.t.Fatalf("invalid request: %v", err)
+	}
+
+	return p.Do(req)
+}
+
+// Post sends a POST request with the parameters in the body.
+func (p *Proxy) Post(path string, params url.Values) *Response {
+	p.t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, path, bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		p.t.Fatalf("invalid request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return p.Do(req)
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2etest
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+func now(offset time.Duration) string {
+	return strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+}
+
+func TestProxy(t *testing.T) {
+	up := NewUpstream(t)
+	p := NewProxy(t, up, "namespace", injectproxy.HTTPFormEnforcer{ParameterName: "namespace"},
+		injectproxy.WithMaxLookback(injectproxy.MaxLookback{Duration: time.Hour, Mode: injectproxy.LookbackReject}),
+	)
+
+	for _, tc := range []struct {
+		name     string
+		setup    func()
+		post     bool
+		path     string
+		params   url.Values
+		upstream bool
+
+		expCode     int
+		expQuery    string
+		expMatchers string
+		expBody     string
+		minLatency  time.Duration
+	}{
+		{
+			name:     "instant query",
+			path:     "/api/v1/query",
+			params:   url.Values{"query": []string{"up"}, "namespace": []string{"ns1"}},
+			upstream: true,
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="ns1"}`,
+		},
+		{
+			name:     "range query in the body",
+			post:     true,
+			path:     "/api/v1/query_range",
+			params:   url.Values{"query": []string{"rate(http_requests_total[5m])"}, "namespace": []string{"ns1"}, "start": []string{now(-10 * time.Minute)}, "end": []string{now(0)}, "step": []string{"60"}},
+			upstream: true,
+			expCode:  http.StatusOK,
+			expQuery: `rate(http_requests_total{namespace="ns1"}[5m])`,
+		},
+		{
+			name:        "series",
+			path:        "/api/v1/series",
+			params:      url.Values{"match[]": []string{"up"}, "namespace": []string{"ns1"}},
+			upstream:    true,
+			expCode:     http.StatusOK,
+			expMatchers: `{__name__="up",namespace="ns1"}`,
+		},
+		{
+			name:    "rejected by the proxy",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up[1d]"}, "namespace": []string{"ns1"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name: "canned response",
+			setup: func() {
+				up.SetResponse("/api/v1/query", Response{Body: `{"status":"success","data":{"resultType":"scalar","result":[0,"1"]}}`})
+			},
+			path:     "/api/v1/query",
+			params:   url.Values{"query": []string{"1"}, "namespace": []string{"ns1"}},
+			upstream: true,
+			expCode:  http.StatusOK,
+			expQuery: `1`,
+			expBody:  `{"status":"success","data":{"resultType":"scalar","result":[0,"1"]}}`,
+		},
+		{
+			name: "upstream error",
+			setup: func() {
+				up.FailNext(1, Response{StatusCode: http.StatusServiceUnavailable, Body: `{"status":"error","errorType":"unavailable","error":"overloaded"}`})
+			},
+			path:     "/api/v1/query",
+			params:   url.Values{"query": []string{"up"}, "namespace": []string{"ns1"}},
+			upstream: true,
+			expCode:  http.StatusServiceUnavailable,
+			expQuery: `up{namespace="ns1"}`,
+		},
+		{
+			name: "latency",
+			setup: func() {
+				up.SetLatency(50 * time.Millisecond)
+			},
+			path:       "/api/v1/query",
+			params:     url.Values{"query": []string{"up"}, "namespace": []string{"ns1"}},
+			upstream:   true,
+			expCode:    http.StatusOK,
+			expQuery:   `up{namespace="ns1"}`,
+			minLatency: 50 * time.Millisecond,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up.Reset()
+			if tc.setup != nil {
+				tc.setup()
+			}
+
+			var resp *Response
+			if tc.post {
+				resp = p.Post(tc.path, tc.params)
+			} else {
+				resp = p.Get(tc.path, tc.params)
+			}
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, resp.Body)
+			}
+
+			if tc.expBody != "" && resp.Body != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, resp.Body)
+			}
+
+			if resp.Latency < tc.minLatency {
+				t.Fatalf("expected a latency of at least %s, got %s", tc.minLatency, resp.Latency)
+			}
+
+			reqs := up.Requests()
+			if !tc.upstream {
+				if len(reqs) != 0 {
+					t.Fatalf("expected no upstream request, got %d", len(reqs))
+				}
+				return
+			}
+
+			if len(reqs) != 1 {
+				t.Fatalf("expected 1 upstream request, got %d", len(reqs))
+			}
+			if reqs[0].Path != tc.path {
+				t.Fatalf("expected upstream path %q, got %q", tc.path, reqs[0].Path)
+			}
+			if got := reqs[0].Form.Get("query"); got != tc.expQuery {
+				t.Fatalf("expected upstream query %q, got %q", tc.expQuery, got)
+			}
+			if got := reqs[0].Form.Get("match[]"); got != tc.expMatchers {
+				t.Fatalf("expected upstream matchers %q, got %q", tc.expMatchers, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActiveQueriesPath is the path of the active queries endpoint.
+const ActiveQueriesPath = "/-/active-queries"
+
+var errQueryCanceled = errors.New("query canceled by an administrator")
+
+// ActiveQuery describes an in-flight query.
+type ActiveQuery struct {
+	ID string `json:"id"`
+	// Fingerprint identifies the identical queries (same tenants,
+	// expression, time range and step).
+	Fingerprint    string    `json:"fingerprint"`
+	Handler        string    `json:"handler"`
+	Tenants        []string  `json:"tenants"`
+	Query          string    `json:"query"`
+	Upstream       string    `json:"upstream"`
+	StartedAt      time.Time `json:"startedAt"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+}
+
+type activeQuery struct {
+	ActiveQuery
+	seq    uint64
+	cancel context.CancelCauseFunc
+}
+
+// ActiveQueryTracker tracks the in-flight instant and range queries. It
+// implements http.Handler to serve the ActiveQueriesPath endpoint:
+//
+//   - GET returns the in-flight queries as a JSON array, the oldest first.
+//   - DELETE with the "id" parameter cancels the given query.
+//
+// The endpoint isn't protected, it should be exposed to the administrators
+// only (e.g. on the internal listen address).
+type ActiveQueryTracker struct {
+	mtx     sync.Mutex
+	nextID  uint64
+	queries map[string]*activeQuery
+
+	now func() time.Time
+}
+
+// NewActiveQueryTracker returns a new ActiveQueryTracker.
+func NewActiveQueryTracker() *ActiveQueryTracker {
+	return &ActiveQueryTracker{
+		queries: map[string]*activeQuery{},
+		now:     time.Now,
+	}
+}
+
+// WithActiveQueryTracker registers the in-flight queries with the given
+// tracker.
+func WithActiveQueryTracker(t *ActiveQueryTracker) Option {
+	return optionFunc(func(o *options) {
+		o.activeQueries = t
+	})
+}
+
+// start registers a query and returns the function to call once it
+// completes.
+func (t *ActiveQueryTracker) start(q ActiveQuery, cancel context.CancelCauseFunc) func() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.nextID++
+	q.ID = strconv.FormatUint(t.nextID, 10)
+	q.StartedAt = t.now()
+	t.queries[q.ID] = &activeQuery{ActiveQuery: q, seq: t.nextID, cancel: cancel}
+
+	return func() {
+		t.mtx.Lock()
+		delete(t.queries, q.ID)
+		t.mtx.Unlock()
+	}
+}
+
+// Active returns the in-flight queries, the oldest first.
+func (t *ActiveQueryTracker) Active() []ActiveQuery {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	active := make([]*activeQuery, 0, len(t.queries))
+	for _, q := range t.queries {
+		active = append(active, q)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].seq < active[j].seq })
+
+	now := t.now()
+	queries := make([]ActiveQuery, len(active))
+	for i, q := range active {
+		queries[i] = q.ActiveQuery
+		queries[i].ElapsedSeconds = now.Sub(q.StartedAt).Seconds()
+	}
+
+	return queries
+}
+
+// Cancel cancels the in-flight query with the given ID. It returns false if
+// the query isn't found.
+func (t *ActiveQueryTracker) Cancel(id string) bool {
+	t.mtx.Lock()
+	q, found := t.queries[id]
+	t.mtx.Unlock()
+
+	if !found {
+		return false
+	}
+
+	q.cancel(errQueryCanceled)
+	return true
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (t *ActiveQueryTracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(t.Active())
+	case http.MethodDelete:
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			prometheusAPIError(w, `the "id" parameter must be provided`, http.StatusBadRequest)
+			return
+		}
+		if !t.Cancel(id) {
+			prometheusAPIError(w, "query not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		prometheusAPIError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// trackQueries registers the instant and range queries with the active
+// query tracker while they are served.
+func (r *routes) trackQueries(next http.HandlerFunc) http.HandlerFunc {
+	if r.activeQueries == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		handler := handlerName(req.Context())
+		switch handler {
+		case "/api/v1/query", "/api/v1/query_range":
+		default:
+			next(w, req)
+			return
+		}
+
+		body, ok := r.bufferRequestBody(w, req)
+		if !ok {
+			return
+		}
+		if body != nil {
+			defer body.Close()
+		}
+
+		tenants := MustLabelValues(req.Context())
+		q := ActiveQuery{
+			Handler:  handler,
+			Tenants:  tenants,
+			Upstream: r.upstream.Host,
+		}
+
+		h := sha256.New()
+		for _, s := range []string{handler, strings.Join(tenants, ",")} {
+			_, _ = io.WriteString(h, s)
+			_, _ = h.Write([]byte{0})
+		}
+		if params, ok := normalizedQueryParams(req, body); ok {
+			q.Query = params.Get(queryParam)
+			_, _ = io.WriteString(h, params.Encode())
+		}
+		q.Fingerprint = hex.EncodeToString(h.Sum(nil))[:16]
+		RequestContextFrom(req.Context()).setFingerprint(q.Fingerprint)
+
+		ctx, cancel := context.WithCancelCause(req.Context())
+		defer cancel(nil)
+
+		done := r.activeQueries.start(q, cancel)
+		defer done()
+
+		next(w, req.WithContext(ctx))
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActiveQueryTracker(t *testing.T) {
+	release := make(chan struct{})
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+	defer close(release)
+
+	tracker := NewActiveQueryTracker()
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithActiveQueryTracker(tracker),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range", strings.NewReader("query=up&start=0&end=60&step=15s&namespace=ns1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ServeHTTP(w, req)
+		done <- w
+	}()
+
+	var active []ActiveQuery
+	deadline := time.Now().Add(time.Second)
+	for len(active) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected an active query")
+		}
+		time.Sleep(time.Millisecond)
+
+		w := httptest.NewRecorder()
+		tracker.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy.example.com"+ActiveQueriesPath, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&active); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	q := active[0]
+	if q.ID != "1" || q.Handler != "/api/v1/query_range" || !reflect.DeepEqual(q.Tenants, []string{"ns1"}) || q.Query != "up" || q.Upstream != m.url.Host || len(q.Fingerprint) != 16 {
+		t.Fatalf("unexpected active query: %+v", q)
+	}
+
+	for _, tc := range []struct {
+		method  string
+		id      string
+		expCode int
+	}{
+		{method: http.MethodDelete, expCode: http.StatusBadRequest},
+		{method: http.MethodDelete, id: "2", expCode: http.StatusNotFound},
+		{method: http.MethodPost, id: "1", expCode: http.StatusMethodNotAllowed},
+		{method: http.MethodDelete, id: "1", expCode: http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		tracker.ServeHTTP(w, httptest.NewRequest(tc.method, "http://proxy.example.com"+ActiveQueriesPath+"?id="+tc.id, nil))
+		if w.Code != tc.expCode {
+			t.Fatalf("%s %q: expected status code %d, got %d", tc.method, tc.id, tc.expCode, w.Code)
+		}
+	}
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the query to be canceled")
+	}
+
+	if active := tracker.Active(); len(active) != 0 {
+		t.Fatalf("expected no active query, got %+v", active)
+	}
+}
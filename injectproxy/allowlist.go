@@ -0,0 +1,226 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// QueryAllowlist is the configuration of the query allowlist. A query is
+// allowed if it matches any of the lists.
+type QueryAllowlist struct {
+	// Exprs are the allowed expressions. They are compared once formatted
+	// so the spacing and the order of the label matchers don't matter.
+	Exprs []string `yaml:"exprs"`
+	// Metrics are regular expressions matched against the metric names of
+	// the query selectors. They are anchored. A query is allowed if every
+	// selector selects an allowed metric by name or with an equality
+	// matcher.
+	Metrics []string `yaml:"metrics"`
+	// Fingerprints are the fingerprints of the allowed expressions, as
+	// returned by QueryFingerprint and in the error message of the
+	// rejected queries.
+	Fingerprints []string `yaml:"fingerprints"`
+}
+
+// LoadQueryAllowlist reads the query allowlist from a YAML file. For example:
+//
+//	exprs:
+//	  - 'sum by (job) (rate(http_requests_total[5m]))'
+//	metrics:
+//	  - 'node_.+'
+//	fingerprints:
+//	  - 'c0ffee0123456789'
+func LoadQueryAllowlist(path string) (QueryAllowlist, error) {
+	var a QueryAllowlist
+
+	f, err := os.Open(path)
+	if err != nil {
+		return a, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&a); err != nil && !errors.Is(err, io.EOF) {
+		return a, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if _, err := newQueryAllowlist(a, prometheus.NewRegistry()); err != nil {
+		return a, fmt.Errorf("invalid allowlist in %s: %w", path, err)
+	}
+
+	return a, nil
+}
+
+// WithQueryAllowlist rejects the instant and range queries which don't match
+// the allowlist with a 403 status code. The allowlist applies to the
+// expression sent by the client, before any rewrite.
+func WithQueryAllowlist(a QueryAllowlist) Option {
+	return optionFunc(func(o *options) {
+		o.allowlist = &a
+	})
+}
+
+// QueryFingerprint returns the fingerprint of a query expression. The
+// fingerprint doesn't depend on the formatting of the expression.
+func QueryFingerprint(q string) (string, error) {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
+	}
+
+	return exprFingerprint(expr), nil
+}
+
+func exprFingerprint(expr parser.Expr) string {
+	h := sha256.Sum256([]byte(expr.String()))
+	return hex.EncodeToString(h[:])[:16]
+}
+
+type queryAllowlist struct {
+	exprs        map[string]struct{}
+	metrics      []*regexp.Regexp
+	fingerprints map[string]struct{}
+
+	requests *prometheus.CounterVec
+}
+
+func newQueryAllowlist(a QueryAllowlist, reg prometheus.Registerer) (*queryAllowlist, error) {
+	l := &queryAllowlist{
+		exprs:        make(map[string]struct{}, len(a.Exprs)),
+		fingerprints: make(map[string]struct{}, len(a.Fingerprints)),
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_allowlist_requests_total",
+			Help: "Total number of queries checked against the allowlist, partitioned by result (expr, metric or fingerprint when allowed, rejected otherwise).",
+		}, []string{"result"}),
+	}
+
+	for _, e := range a.Exprs {
+		expr, err := parser.ParseExpr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %w", e, err)
+		}
+		l.exprs[expr.String()] = struct{}{}
+	}
+
+	for _, m := range a.Metrics {
+		re, err := regexp.Compile("^(?:" + m + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric pattern %q: %w", m, err)
+		}
+		l.metrics = append(l.metrics, re)
+	}
+
+	for _, f := range a.Fingerprints {
+		l.fingerprints[f] = struct{}{}
+	}
+
+	return l, nil
+}
+
+// allowedMetrics returns whether every selector of the expression selects an
+// allowed metric.
+func (l *queryAllowlist) allowedMetrics(expr parser.Expr) bool {
+	if len(l.metrics) == 0 {
+		return false
+	}
+
+	selectors := parser.ExtractSelectors(expr)
+	if len(selectors) == 0 {
+		return false
+	}
+
+	for _, ms := range selectors {
+		allowed := false
+		for _, m := range ms {
+			if m.Name != labels.MetricName || m.Type != labels.MatchEqual {
+				continue
+			}
+			for _, re := range l.metrics {
+				if re.MatchString(m.Value) {
+					allowed = true
+					break
+				}
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// check returns the reason why the expression is allowed or an empty string
+// if it isn't.
+func (l *queryAllowlist) check(expr parser.Expr) string {
+	if _, found := l.exprs[expr.String()]; found {
+		return "expr"
+	}
+
+	if _, found := l.fingerprints[exprFingerprint(expr)]; found {
+		return "fingerprint"
+	}
+
+	if l.allowedMetrics(expr) {
+		return "metric"
+	}
+
+	return ""
+}
+
+// allowQueries rejects the queries which don't match the allowlist.
+func (r *routes) allowQueries(next http.HandlerFunc) http.HandlerFunc {
+	if r.allowlist == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		expr, err := parser.ParseExpr(req.Form.Get(queryParam))
+		if err != nil {
+			// Let the enforcer reject the invalid queries.
+			next(w, req)
+			return
+		}
+
+		result := r.allowlist.check(expr)
+		if result == "" {
+			r.allowlist.requests.WithLabelValues("rejected").Inc()
+			rejectRequest(w, ReasonQueryNotAllowed, fmt.Sprintf("query not allowed (fingerprint %s)", exprFingerprint(expr)), http.StatusForbidden)
+			return
+		}
+
+		r.allowlist.requests.WithLabelValues(result).Inc()
+		next(w, req)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadQueryAllowlist(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		expErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "allowlist",
+			content: `
+exprs: ['sum(rate(http_requests_total[5m]))']
+metrics: ['node_.+']
+fingerprints: ['0123456789abcdef']
+`,
+		},
+		{
+			name:    "invalid expression",
+			content: "exprs: ['sum(']",
+			expErr:  true,
+		},
+		{
+			name:    "invalid metric",
+			content: "metrics: ['(']",
+			expErr:  true,
+		},
+		{
+			name:    "unknown field",
+			content: "queries: [up]",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "allowlist.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := LoadQueryAllowlist(path)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryFingerprint(t *testing.T) {
+	f1, err := QueryFingerprint(`sum by (job) (rate(up{b="2",a="1"}[5m]))`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f2, err := QueryFingerprint(`sum(rate(up{b="2", a="1"}[5m])) by (job)`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if f1 != f2 || len(f1) != 16 {
+		t.Fatalf("expected identical fingerprints, got %q and %q", f1, f2)
+	}
+
+	if _, err := QueryFingerprint("sum("); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestAllowQueries(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	fingerprint, err := QueryFingerprint("count(up)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryAllowlist(QueryAllowlist{
+			Exprs:        []string{"sum by (job) (rate(http_requests_total[5m]))"},
+			Metrics:      []string{"node_.+"},
+			Fingerprints: []string{fingerprint},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+
+		expCode   int
+		expResult string
+	}{
+		{
+			query:     "sum(rate(http_requests_total[5m])) by (job)",
+			expCode:   http.StatusOK,
+			expResult: "expr",
+		},
+		{
+			query:     `rate(node_cpu_seconds_total[5m]) / on(instance) group_left node_uname_info`,
+			expCode:   http.StatusOK,
+			expResult: "metric",
+		},
+		{
+			query:     "count (up)",
+			expCode:   http.StatusOK,
+			expResult: "fingerprint",
+		},
+		{
+			query:     "node_load1 + up",
+			expCode:   http.StatusForbidden,
+			expResult: "rejected",
+		},
+		{
+			query:     `{__name__=~"node_.+"}`,
+			expCode:   http.StatusForbidden,
+			expResult: "rejected",
+		},
+		{
+			query:   "sum(",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			var before float64
+			if tc.expResult != "" {
+				before = testutil.ToFloat64(r.allowlist.requests.WithLabelValues(tc.expResult))
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{"query": []string{tc.query}, proxyLabel: []string{"ns1"}}.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode == http.StatusForbidden && !strings.Contains(w.Body.String(), "query not allowed (fingerprint ") {
+				t.Fatalf("expected the fingerprint in the error, got %s", w.Body.String())
+			}
+
+			if tc.expResult != "" {
+				if got := testutil.ToFloat64(r.allowlist.requests.WithLabelValues(tc.expResult)) - before; got != 1 {
+					t.Fatalf("expected the %q result to be counted once, got %v", tc.expResult, got)
+				}
+			}
+		})
+	}
+}
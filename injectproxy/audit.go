@@ -0,0 +1,311 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditDecision is the outcome of a request.
+type AuditDecision string
+
+const (
+	// AuditAllowed means that the request was forwarded to the upstream
+	// or answered by the proxy (e.g. from the cache).
+	AuditAllowed AuditDecision = "allowed"
+	// AuditBlocked means that the request was rejected by the proxy (4xx
+	// status code other than 429).
+	AuditBlocked AuditDecision = "blocked"
+	// AuditShed means that the request was rejected to protect the
+	// upstream or the proxy (429 and 503 status codes).
+	AuditShed AuditDecision = "shed"
+	// AuditFailed means that the request failed (5xx status code other
+	// than 503).
+	AuditFailed AuditDecision = "failed"
+)
+
+func auditDecision(status int) AuditDecision {
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		return AuditShed
+	case status >= 500:
+		return AuditFailed
+	case status >= 400:
+		return AuditBlocked
+	default:
+		return AuditAllowed
+	}
+}
+
+// AuditEntry records a request served by the proxy.
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	SourceIP     string    `json:"sourceIP"`
+	ForwardedFor string    `json:"forwardedFor,omitempty"`
+	Handler      string    `json:"handler"`
+	// Tenants is empty if the request was rejected before the tenants
+	// were extracted.
+	Tenants  []string      `json:"tenants"`
+	Query    string        `json:"query,omitempty"`
+	Matchers []string      `json:"matchers,omitempty"`
+	Start    string        `json:"start,omitempty"`
+	End      string        `json:"end,omitempty"`
+	Decision AuditDecision `json:"decision"`
+	Status   int           `json:"status"`
+	// Exemption is the ID of the exemption token of the request, if any.
+	Exemption string `json:"exemption,omitempty"`
+}
+
+// AuditSink receives the audit entries. Record is called synchronously on
+// the request path.
+type AuditSink interface {
+	Record(AuditEntry)
+}
+
+// WithAuditSink records every request of the enforced endpoints to the given
+// sink, including the requests rejected by the proxy.
+func WithAuditSink(s AuditSink) Option {
+	return optionFunc(func(o *options) {
+		o.auditSink = s
+	})
+}
+
+// FileAuditSink appends the audit entries as JSON lines to a file.
+type FileAuditSink struct {
+	mtx    sync.Mutex
+	f      *os.File
+	logger *log.Logger
+}
+
+// NewFileAuditSink opens the file in append mode, creating it if needed.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log: %w", err)
+	}
+
+	return &FileAuditSink{f: f, logger: log.Default()}, nil
+}
+
+// Record implements the AuditSink interface.
+func (s *FileAuditSink) Record(e AuditEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, err := s.f.Write(b); err != nil {
+		s.logger.Printf("failed to write the audit log: %v", err)
+	}
+}
+
+// Close closes the file.
+func (s *FileAuditSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.f.Close()
+}
+
+// defaultAuditQueueSize is the maximum number of audit entries waiting to be
+// sent to the webhook.
+const defaultAuditQueueSize = 10000
+
+// WebhookAuditSink sends the audit entries in batches to a webhook. Entries
+// are dropped (and logged) when the queue is full.
+type WebhookAuditSink struct {
+	url    *url.URL
+	client *http.Client
+	logger *log.Logger
+	queue  chan AuditEntry
+}
+
+// NewWebhookAuditSink returns a sink POSTing the audit entries as a JSON
+// array to the URL. The entries are only sent after Run has been called.
+func NewWebhookAuditSink(u *url.URL, client *http.Client) *WebhookAuditSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &WebhookAuditSink{
+		url:    u,
+		client: client,
+		logger: log.Default(),
+		queue:  make(chan AuditEntry, defaultAuditQueueSize),
+	}
+}
+
+// Record implements the AuditSink interface.
+func (s *WebhookAuditSink) Record(e AuditEntry) {
+	select {
+	case s.queue <- e:
+	default:
+		b, _ := json.Marshal(e)
+		s.logger.Printf("audit queue full, dropping entry: %s", b)
+	}
+}
+
+// Run sends the queued entries every interval until the context is
+// cancelled. The remaining entries are sent before returning.
+func (s *WebhookAuditSink) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), interval)
+			defer cancel()
+			if err := s.Flush(fctx); err != nil {
+				s.logger.Printf("failed to send audit entries: %v", err)
+			}
+			return nil
+		case <-t.C:
+			if err := s.Flush(ctx); err != nil {
+				s.logger.Printf("failed to send audit entries: %v", err)
+			}
+		}
+	}
+}
+
+// Flush sends the queued entries. The entries are put back in the queue if
+// they can't be sent.
+func (s *WebhookAuditSink) Flush(ctx context.Context) error {
+	var entries []AuditEntry
+	for len(entries) < defaultAuditQueueSize {
+		select {
+		case e := <-s.queue:
+			entries = append(entries, e)
+			continue
+		default:
+		}
+		break
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if err := s.send(ctx, entries); err != nil {
+		for _, e := range entries {
+			s.Record(e)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *WebhookAuditSink) send(ctx context.Context, entries []AuditEntry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// auditRequests records the requests to the audit sink once they are
+// served. It must run before any middleware which can reject the request.
+func (r *routes) auditRequests(next http.Handler) http.Handler {
+	if r.auditSink == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e := &AuditEntry{
+			Time:         time.Now(),
+			SourceIP:     req.RemoteAddr,
+			ForwardedFor: req.Header.Get("X-Forwarded-For"),
+			Handler:      handlerName(req.Context()),
+		}
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			e.SourceIP = host
+		}
+
+		// The downstream handlers may modify the query string.
+		rawQuery := req.URL.RawQuery
+		rec := newStatusRecorder(w)
+		defer func() {
+			e.Status = rec.status
+			e.Decision = auditDecision(rec.status)
+			r.auditSink.Record(*e)
+		}()
+
+		body, ok := r.bufferRequestBody(rec, req)
+		if !ok {
+			return
+		}
+		if body != nil {
+			defer body.Close()
+		}
+
+		RequestContextFrom(req.Context()).setAuditEntry(e)
+		next.ServeHTTP(rec, req)
+
+		if form, ok := originalForm(req, rawQuery, body); ok {
+			e.Query = form.Get(queryParam)
+			e.Matchers = form[matchersParam]
+			e.Start = form.Get(startParam)
+			e.End = form.Get(endParam)
+		}
+	})
+}
+
+// auditTenants adds the tenants to the audit entry of the request.
+func (r *routes) auditTenants(next http.HandlerFunc) http.HandlerFunc {
+	if r.auditSink == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if e := RequestContextFrom(req.Context()).auditEntry(); e != nil {
+			e.Tenants = MustLabelValues(req.Context())
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingAuditSink struct {
+	entries []AuditEntry
+}
+
+func (s *recordingAuditSink) Record(e AuditEntry) {
+	e.Time = time.Time{}
+	s.entries = append(s.entries, e)
+}
+
+func TestAuditRequests(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer m.Close()
+
+	sink := &recordingAuditSink{}
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithAuditSink(sink),
+		WithDisabledTenants(NewDisabledTenants(DisabledTenantsConfig{Tenants: map[string]string{"ns2": ""}}, &recordingSink{})),
+		WithTenantRateLimits(TenantRateLimits{
+			Header:  "X-Scope-OrgID",
+			Default: RateLimit{RequestsPerSecond: 0.001, Burst: 1},
+			Tenants: map[string]RateLimit{"unlimited": {}},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		params url.Values
+		tenant string
+
+		exp AuditEntry
+	}{
+		{
+			name:   "allowed query",
+			path:   "/api/v1/query",
+			params: url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}},
+			tenant: "unlimited",
+			exp: AuditEntry{
+				SourceIP: "192.0.2.1",
+				Handler:  "/api/v1/query",
+				Tenants:  []string{"ns1"},
+				Query:    "up",
+				Decision: AuditAllowed,
+				Status:   http.StatusOK,
+			},
+		},
+		{
+			name:   "allowed range query",
+			method: http.MethodPost,
+			path:   "/api/v1/query_range",
+			params: url.Values{"query": []string{"sum(up)"}, "start": []string{"0"}, "end": []string{"60"}, "step": []string{"15"}, proxyLabel: []string{"ns1"}},
+			tenant: "unlimited",
+			exp: AuditEntry{
+				SourceIP: "192.0.2.1",
+				Handler:  "/api/v1/query_range",
+				Tenants:  []string{"ns1"},
+				Query:    "sum(up)",
+				Start:    "0",
+				End:      "60",
+				Decision: AuditAllowed,
+				Status:   http.StatusOK,
+			},
+		},
+		{
+			name:   "series",
+			path:   "/api/v1/series",
+			params: url.Values{"match[]": []string{"up", "process_start_time_seconds"}, proxyLabel: []string{"ns1"}},
+			tenant: "unlimited",
+			exp: AuditEntry{
+				SourceIP: "192.0.2.1",
+				Handler:  "/api/v1/series",
+				Tenants:  []string{"ns1"},
+				Matchers: []string{"up", "process_start_time_seconds"},
+				Decision: AuditAllowed,
+				Status:   http.StatusOK,
+			},
+		},
+		{
+			name:   "disabled tenant",
+			path:   "/api/v1/query",
+			params: url.Values{"query": []string{"up"}, proxyLabel: []string{"ns2"}},
+			tenant: "unlimited",
+			exp: AuditEntry{
+				SourceIP: "192.0.2.1",
+				Handler:  "/api/v1/query",
+				Tenants:  []string{"ns2"},
+				Query:    "up",
+				Decision: AuditBlocked,
+				Status:   http.StatusForbidden,
+			},
+		},
+		{
+			name:   "missing label",
+			path:   "/api/v1/query",
+			params: url.Values{"query": []string{"up"}},
+			tenant: "unlimited",
+			exp: AuditEntry{
+				SourceIP: "192.0.2.1",
+				Handler:  "/api/v1/query",
+				Query:    "up",
+				Decision: AuditBlocked,
+				Status:   http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "first request of the limited tenant",
+			path:   "/api/v1/query",
+			params: url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}},
+			tenant: "limited",
+			exp: AuditEntry{
+				SourceIP: "192.0.2.1",
+				Handler:  "/api/v1/query",
+				Tenants:  []string{"ns1"},
+				Query:    "up",
+				Decision: AuditAllowed,
+				Status:   http.StatusOK,
+			},
+		},
+		{
+			name:   "rate limited",
+			path:   "/api/v1/query",
+			params: url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}},
+			tenant: "limited",
+			exp: AuditEntry{
+				SourceIP: "192.0.2.1",
+				Handler:  "/api/v1/query",
+				Query:    "up",
+				Decision: AuditShed,
+				Status:   http.StatusTooManyRequests,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sink.entries = nil
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+tc.path, strings.NewReader(tc.params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil)
+			}
+			req.Header.Set("X-Scope-OrgID", tc.tenant)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.exp.Status {
+				t.Fatalf("expected status code %d, got %d: %s", tc.exp.Status, w.Code, w.Body.String())
+			}
+
+			if len(sink.entries) != 1 {
+				t.Fatalf("expected 1 audit entry, got %d", len(sink.entries))
+			}
+			if !reflect.DeepEqual(tc.exp, sink.entries[0]) {
+				t.Fatalf("expected %+v, got %+v", tc.exp, sink.entries[0])
+			}
+		})
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// The entries are appended across reopenings.
+	for _, tenant := range []string{"ns1", "ns2"} {
+		s, err := NewFileAuditSink(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		s.Record(AuditEntry{Time: time.Unix(0, 0).UTC(), SourceIP: "192.0.2.1", Handler: "/api/v1/query", Tenants: []string{tenant}, Query: "up", Decision: AuditAllowed, Status: http.StatusOK})
+		if err := s.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := `{"time":"1970-01-01T00:00:00Z","sourceIP":"192.0.2.1","handler":"/api/v1/query","tenants":["ns1"],"query":"up","decision":"allowed","status":200}
+{"time":"1970-01-01T00:00:00Z","sourceIP":"192.0.2.1","handler":"/api/v1/query","tenants":["ns2"],"query":"up","decision":"allowed","status":200}
+`
+	if string(b) != exp {
+		t.Fatalf("expected %q, got %q", exp, string(b))
+	}
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	var (
+		got  [][]AuditEntry
+		fail = true
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var entries []AuditEntry
+		if err := json.NewDecoder(req.Body).Decode(&entries); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, entries)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := NewWebhookAuditSink(u, nil)
+
+	s.Record(AuditEntry{Handler: "/api/v1/query", Tenants: []string{"ns1"}, Decision: AuditAllowed, Status: http.StatusOK})
+	s.Record(AuditEntry{Handler: "/api/v1/query", Tenants: []string{"ns2"}, Decision: AuditBlocked, Status: http.StatusForbidden})
+
+	// The entries are kept when the webhook fails.
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	fail = false
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(got) != 1 || len(got[0]) != 2 {
+		t.Fatalf("expected 1 batch of 2 entries, got %+v", got)
+	}
+
+	// Nothing is sent when the queue is empty.
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(got))
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// AuthorizationInput holds the attributes of a request which are submitted
+// to an Authorizer.
+type AuthorizationInput struct {
+	// Tenants are the label values extracted from the request.
+	Tenants []string `json:"tenants"`
+	// Subject identifies the requester (see WithAuthorizationSubjectHeader).
+	Subject string `json:"subject,omitempty"`
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	// Query is the PromQL expression (if any) before label enforcement.
+	Query string `json:"query,omitempty"`
+	// Selectors are the series selectors found in the PromQL expression
+	// and/or in the match[] parameters.
+	Selectors []string `json:"selectors,omitempty"`
+	Start     string   `json:"start,omitempty"`
+	End       string   `json:"end,omitempty"`
+	Time      string   `json:"time,omitempty"`
+}
+
+// AuthorizationDecision is the result of an authorization request.
+type AuthorizationDecision struct {
+	Allow bool `json:"allow"`
+	// Reason is returned to the client when the request is denied.
+	Reason string `json:"reason,omitempty"`
+	// Annotations are added as HTTP headers to the response when the
+	// request is allowed.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Authorizer decides whether a request is allowed to reach the upstream.
+type Authorizer interface {
+	Authorize(context.Context, *AuthorizationInput) (*AuthorizationDecision, error)
+}
+
+// WithAuthorizer adds an authorizer which is consulted before proxying the
+// requests. When several authorizers are configured, all of them need to
+// allow the request.
+func WithAuthorizer(a Authorizer) Option {
+	return optionFunc(func(o *options) {
+		o.authorizers = append(o.authorizers, a)
+	})
+}
+
+// WithAuthorizationSubjectHeader configures the HTTP header which identifies
+// the requester in the authorization requests (e.g. X-Forwarded-User).
+func WithAuthorizationSubjectHeader(name string) Option {
+	return optionFunc(func(o *options) {
+		o.subjectHeader = http.CanonicalHeaderKey(name)
+	})
+}
+
+// authorize checks that all the configured authorizers allow the request
+// before calling the next handler.
+func (r *routes) authorize(next http.HandlerFunc) http.HandlerFunc {
+	if len(r.authorizers) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		in, err := newAuthorizationInput(req, r.classifier)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.subjectHeader != "" {
+			in.Subject = req.Header.Get(r.subjectHeader)
+		}
+
+		for _, a := range r.authorizers {
+			d, err := a.Authorize(req.Context(), in)
+			if err != nil {
+				r.logger.Printf("authorization error: %v", err)
+				prometheusAPIError(w, "authorization failed", http.StatusInternalServerError)
+				return
+			}
+
+			if !d.Allow {
+				msg := "forbidden"
+				if d.Reason != "" {
+					msg = d.Reason
+				}
+				rejectRequest(w, ReasonAccessDenied, msg, http.StatusForbidden)
+				return
+			}
+
+			for k, v := range d.Annotations {
+				w.Header().Set(k, v)
+			}
+		}
+
+		next(w, req)
+	}
+}
+
+func newAuthorizationInput(req *http.Request, c *queryClassifier) (*AuthorizationInput, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, fmt.Errorf("the form data can not be parsed: %w", err)
+	}
+
+	in := &AuthorizationInput{
+		Tenants: MustLabelValues(req.Context()),
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.Form.Get(queryParam),
+		Start:   req.Form.Get("start"),
+		End:     req.Form.Get("end"),
+		Time:    req.Form.Get("time"),
+	}
+
+	if in.Query != "" {
+		qc := c.classify(in.Query)
+		if qc.err != nil {
+			return nil, qc.err
+		}
+
+		in.Selectors = append(in.Selectors, qc.selectors...)
+	}
+
+	in.Selectors = append(in.Selectors, req.Form[matchersParam]...)
+
+	return in, nil
+}
+
+// OPAAuthorizer delegates the authorization decisions to an Open Policy
+// Agent server.
+//
+// The request attributes are sent as the "input" document to the OPA Data
+// API and the policy's result can be either a boolean or an object matching
+// the AuthorizationDecision type.
+type OPAAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+// defaultOPATimeout is the timeout of the OPA requests when no client is
+// provided.
+const defaultOPATimeout = 5 * time.Second
+
+// NewOPAAuthorizer returns an Authorizer querying the given OPA Data API URL
+// (e.g. http://localhost:8181/v1/data/prometheus/authz). If the client is
+// nil, a client with a 5s timeout is used so that an unresponsive OPA server
+// doesn't hold the requests.
+func NewOPAAuthorizer(u *url.URL, client *http.Client) *OPAAuthorizer {
+	if client == nil {
+		client = &http.Client{Timeout: defaultOPATimeout}
+	}
+
+	return &OPAAuthorizer{
+		url:    u.String(),
+		client: client,
+	}
+}
+
+// Authorize implements the Authorizer interface.
+func (o *OPAAuthorizer) Authorize(ctx context.Context, in *AuthorizationInput) (*AuthorizationDecision, error) {
+	b, err := json.Marshal(struct {
+		Input *AuthorizationInput `json:"input"`
+	}{Input: in})
+	if err != nil {
+		return nil, fmt.Errorf("can't encode the OPA input: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OPA request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from OPA: %d", resp.StatusCode)
+	}
+
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("can't decode the OPA response: %w", err)
+	}
+
+	// An undefined result means that the policy didn't match the input.
+	if len(res.Result) == 0 {
+		return &AuthorizationDecision{}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(res.Result, &allow); err == nil {
+		return &AuthorizationDecision{Allow: allow}, nil
+	}
+
+	var d AuthorizationDecision
+	if err := json.Unmarshal(res.Result, &d); err != nil {
+		return nil, fmt.Errorf("can't decode the OPA result: %w", err)
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOPAAuthorizer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		url  string
+		// OPA result returned by the mock server.
+		result string
+
+		expCode      int
+		expInput     *AuthorizationInput
+		expHeaderKey string
+		expHeaderVal string
+	}{
+		{
+			name:    "boolean result allowing the request",
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			result:  `{"result": true}`,
+			expCode: http.StatusOK,
+			expInput: &AuthorizationInput{
+				Tenants:   []string{"ns1"},
+				Method:    http.MethodGet,
+				Path:      "/api/v1/query",
+				Query:     "up",
+				Selectors: []string{`{__name__="up"}`},
+			},
+		},
+		{
+			name:    "boolean result denying the request",
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			result:  `{"result": false}`,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "undefined result",
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			result:  `{}`,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:         "object result with annotations",
+			url:          "http://prometheus.example.com/api/v1/query_range?query=sum(rate(foo[5m]))/sum(rate(bar[5m]))&start=0&end=60&step=15&namespace=ns1",
+			result:       `{"result": {"allow": true, "annotations": {"X-Policy": "audited"}}}`,
+			expCode:      http.StatusOK,
+			expHeaderKey: "X-Policy",
+			expHeaderVal: "audited",
+			expInput: &AuthorizationInput{
+				Tenants:   []string{"ns1"},
+				Method:    http.MethodGet,
+				Path:      "/api/v1/query_range",
+				Query:     "sum(rate(foo[5m]))/sum(rate(bar[5m]))",
+				Selectors: []string{`{__name__="foo"}`, `{__name__="bar"}`},
+				Start:     "0",
+				End:       "60",
+			},
+		},
+		{
+			name:    "object result denying the request",
+			url:     "http://prometheus.example.com/api/v1/series?match[]=up&namespace=ns1",
+			result:  `{"result": {"allow": false, "reason": "not allowed"}}`,
+			expCode: http.StatusForbidden,
+			expInput: &AuthorizationInput{
+				Tenants:   []string{"ns1"},
+				Method:    http.MethodGet,
+				Path:      "/api/v1/series",
+				Selectors: []string{"up"},
+			},
+		},
+		{
+			name:    "invalid OPA response",
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			result:  `{"result": "yes"}`,
+			expCode: http.StatusInternalServerError,
+		},
+		{
+			name:    "invalid query",
+			url:     "http://prometheus.example.com/api/v1/query?query=up{&namespace=ns1",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *AuthorizationInput
+			opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var body struct {
+					Input *AuthorizationInput `json:"input"`
+				}
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				got = body.Input
+				io.WriteString(w, tc.result)
+			}))
+			defer opa.Close()
+
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+			defer m.Close()
+
+			u, err := url.Parse(opa.URL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithAuthorizer(NewOPAAuthorizer(u, nil)),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+
+			if tc.expInput != nil && !reflect.DeepEqual(tc.expInput, got) {
+				t.Fatalf("expected input %+v, got %+v", tc.expInput, got)
+			}
+
+			if tc.expHeaderKey != "" && resp.Header.Get(tc.expHeaderKey) != tc.expHeaderVal {
+				t.Fatalf("expected header %q to be %q, got %q", tc.expHeaderKey, tc.expHeaderVal, resp.Header.Get(tc.expHeaderKey))
+			}
+		})
+	}
+}
+
+func TestOPAAuthorizerTimeout(t *testing.T) {
+	done := make(chan struct{})
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The OPA server hangs.
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer opa.Close()
+	defer close(done)
+
+	u, err := url.Parse(opa.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c := NewOPAAuthorizer(u, nil).client; c.Timeout != defaultOPATimeout {
+		t.Fatalf("expected the default client timeout %s, got %s", defaultOPATimeout, c.Timeout)
+	}
+
+	start := time.Now()
+	_, err = NewOPAAuthorizer(u, &http.Client{Timeout: 50 * time.Millisecond}).Authorize(context.Background(), &AuthorizationInput{Tenants: []string{"ns1"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected the request to time out, took %s", d)
+	}
+}
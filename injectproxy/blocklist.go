@@ -0,0 +1,225 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// QueryBlocklistRule rejects the queries matching both its expression and
+// metric patterns. At least one of them must be set.
+type QueryBlocklistRule struct {
+	// Name identifies the rule in the error message and the metrics.
+	Name string `yaml:"name"`
+	// Expr is a regular expression matched against the raw query
+	// expression. It isn't anchored.
+	Expr string `yaml:"expr"`
+	// Metric is a regular expression matched against the metric names of
+	// the query selectors. It is anchored. Only the metric names selected
+	// by name or with an equality matcher are matched.
+	Metric string `yaml:"metric"`
+	// Message explains why the query is blocked.
+	Message string `yaml:"message"`
+}
+
+// QueryBlocklist is the configuration of the query blocklist.
+type QueryBlocklist struct {
+	Rules []QueryBlocklistRule `yaml:"rules"`
+}
+
+// LoadQueryBlocklist reads the query blocklist from a YAML file. For example:
+//
+//	rules:
+//	  - name: pod-cardinality
+//	    metric: 'kube_pod_.+'
+//	    expr: 'count\s*\('
+//	    message: 'counting the pods is too expensive, use the namespace:pods:count recording rule'
+func LoadQueryBlocklist(path string) (QueryBlocklist, error) {
+	var b QueryBlocklist
+
+	f, err := os.Open(path)
+	if err != nil {
+		return b, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&b); err != nil && !errors.Is(err, io.EOF) {
+		return b, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if _, err := compileBlocklistRules(b); err != nil {
+		return b, fmt.Errorf("invalid blocklist in %s: %w", path, err)
+	}
+
+	return b, nil
+}
+
+// WithQueryBlocklist rejects the instant and range queries matching one of
+// the blocklist rules with a 422 status code. The rules apply to the
+// expression sent by the client, before any rewrite.
+func WithQueryBlocklist(b QueryBlocklist) Option {
+	return optionFunc(func(o *options) {
+		o.blocklist = &b
+	})
+}
+
+type blocklistRule struct {
+	name    string
+	expr    *regexp.Regexp
+	metric  *regexp.Regexp
+	message string
+}
+
+func compileBlocklistRules(b QueryBlocklist) ([]blocklistRule, error) {
+	compiled := make([]blocklistRule, 0, len(b.Rules))
+	for i, r := range b.Rules {
+		rule := blocklistRule{name: r.Name, message: r.Message}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule %d", i)
+		}
+
+		if r.Expr == "" && r.Metric == "" {
+			return nil, fmt.Errorf("%s: at least one of expr and metric must be set", rule.name)
+		}
+
+		var err error
+		if r.Expr != "" {
+			if rule.expr, err = regexp.Compile(r.Expr); err != nil {
+				return nil, fmt.Errorf("%s: invalid expr: %w", rule.name, err)
+			}
+		}
+		if r.Metric != "" {
+			if rule.metric, err = regexp.Compile("^(?:" + r.Metric + ")$"); err != nil {
+				return nil, fmt.Errorf("%s: invalid metric: %w", rule.name, err)
+			}
+		}
+
+		compiled = append(compiled, rule)
+	}
+
+	return compiled, nil
+}
+
+type queryBlocklist struct {
+	rules      []blocklistRule
+	rejections *prometheus.CounterVec
+}
+
+func newQueryBlocklist(b QueryBlocklist, reg prometheus.Registerer) (*queryBlocklist, error) {
+	rules, err := compileBlocklistRules(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queryBlocklist{
+		rules: rules,
+		rejections: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_blocklist_rejections_total",
+			Help: "Total number of queries rejected by the blocklist, partitioned by rule.",
+		}, []string{"rule"}),
+	}, nil
+}
+
+// metricNames returns the metric names selected by the expression.
+func metricNames(expr parser.Expr) []string {
+	var names []string
+	for _, ms := range parser.ExtractSelectors(expr) {
+		for _, m := range ms {
+			if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+				names = append(names, m.Value)
+			}
+		}
+	}
+
+	return names
+}
+
+// match returns the first rule matching the query or nil.
+func (b *queryBlocklist) match(q string, expr parser.Expr) *blocklistRule {
+	var names []string
+	if expr != nil {
+		names = metricNames(expr)
+	}
+
+	for i, rule := range b.rules {
+		if rule.expr != nil && !rule.expr.MatchString(q) {
+			continue
+		}
+
+		if rule.metric != nil {
+			matched := false
+			for _, name := range names {
+				if rule.metric.MatchString(name) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		return &b.rules[i]
+	}
+
+	return nil
+}
+
+// blockQueries rejects the queries matching a blocklist rule.
+func (r *routes) blockQueries(next http.HandlerFunc) http.HandlerFunc {
+	if r.blocklist == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q := req.Form.Get(queryParam)
+		// The invalid queries can still match the expression patterns. The
+		// enforcer rejects them otherwise.
+		expr, err := parser.ParseExpr(q)
+		if err != nil {
+			expr = nil
+		}
+
+		rule := r.blocklist.match(q, expr)
+		if rule == nil {
+			next(w, req)
+			return
+		}
+
+		r.blocklist.rejections.WithLabelValues(rule.name).Inc()
+		msg := fmt.Sprintf("query blocked by rule %q", rule.name)
+		if rule.message != "" {
+			msg += ": " + rule.message
+		}
+		rejectRequest(w, ReasonBlockedPattern, msg, http.StatusUnprocessableEntity)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadQueryBlocklist(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		expRules int
+		expErr   bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "rules",
+			content: `
+rules:
+  - name: pods
+    metric: 'kube_pod_.+'
+    message: 'too expensive'
+  - expr: 'count\s*\('
+`,
+			expRules: 2,
+		},
+		{
+			name:    "no pattern",
+			content: "rules: [{name: a, message: b}]",
+			expErr:  true,
+		},
+		{
+			name:    "invalid metric",
+			content: "rules: [{name: a, metric: '('}]",
+			expErr:  true,
+		},
+		{
+			name:    "unknown field",
+			content: "rules: [{name: a, regex: b}]",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "blocklist.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := LoadQueryBlocklist(path)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(b.Rules) != tc.expRules {
+				t.Fatalf("expected %d rules, got %d", tc.expRules, len(b.Rules))
+			}
+		})
+	}
+}
+
+func TestBlockQueries(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryBlocklist(QueryBlocklist{Rules: []QueryBlocklistRule{
+			{Name: "pods", Metric: "kube_pod_.+", Message: "use the namespace:pods:count recording rule"},
+			{Name: "count-series", Expr: `count\s*\(\s*\{`},
+			{Name: "regex-over-all", Expr: `=~"\.\*"`},
+		}}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+
+		expCode  int
+		expError string
+	}{
+		{
+			query:   "up",
+			expCode: http.StatusOK,
+		},
+		{
+			query:    `sum(kube_pod_info{namespace="a"})`,
+			expCode:  http.StatusUnprocessableEntity,
+			expError: `query blocked by rule \"pods\": use the namespace:pods:count recording rule`,
+		},
+		{
+			query:   `sum({__name__="kube_pod_labels"})`,
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			query:   "kube_pod", // the metric pattern is anchored
+			expCode: http.StatusOK,
+		},
+		{
+			query:    `count({job=~".+"})`,
+			expCode:  http.StatusUnprocessableEntity,
+			expError: `query blocked by rule \"count-series\"`,
+		},
+		{
+			// Invalid queries can match the expression patterns.
+			query:   `up{job=~".*"`,
+			expCode: http.StatusUnprocessableEntity,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{"query": []string{tc.query}, proxyLabel: []string{"ns1"}}.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expError != "" && !strings.Contains(w.Body.String(), tc.expError) {
+				t.Fatalf("expected error %q, got %s", tc.expError, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.blocklist.rejections.WithLabelValues("pods")); got != 2 {
+		t.Fatalf("expected 2 rejections, got %v", got)
+	}
+}
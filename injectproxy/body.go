@@ -0,0 +1,170 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// defaultBodyMemoryLimit is the size above which the buffered request bodies
+// are written to disk.
+const defaultBodyMemoryLimit = 1 << 20
+
+// errBodyTooLarge is returned when a request body exceeds the maximum size.
+var errBodyTooLarge = errors.New("request body too large")
+
+// BodyBufferLimits configures how the request bodies are buffered by the
+// features which need to read them more than once (e.g. caching and
+// retries).
+type BodyBufferLimits struct {
+	// Memory is the size above which the body is written to a temporary
+	// file. If zero, a default of 1MiB is used.
+	Memory int64
+	// Max is the maximum size of a buffered body. Larger requests are
+	// rejected with "413 Request Entity Too Large". Zero means no limit.
+	Max int64
+	// Dir is the directory of the temporary files. If empty, the default
+	// directory for temporary files is used.
+	Dir string
+}
+
+// WithBodyBufferLimits configures the buffering of the request bodies.
+func WithBodyBufferLimits(l BodyBufferLimits) Option {
+	return optionFunc(func(o *options) {
+		o.bodyLimits = l
+	})
+}
+
+// bufferedBody is a request body which can be read several times.
+type bufferedBody struct {
+	mem  []byte
+	path string
+	size int64
+}
+
+// bufferBody reads r until EOF. The first bytes are kept in memory and the
+// rest is written to a temporary file.
+func (l BodyBufferLimits) bufferBody(r io.Reader) (*bufferedBody, error) {
+	memLimit := l.Memory
+	if memLimit <= 0 {
+		memLimit = defaultBodyMemoryLimit
+	}
+
+	if l.Max > 0 {
+		// Read one extra byte to detect the bodies exceeding the limit.
+		r = io.LimitReader(r, l.Max+1)
+	}
+
+	var (
+		b   = &bufferedBody{}
+		buf bytes.Buffer
+	)
+	n, err := io.Copy(&buf, io.LimitReader(r, memLimit))
+	if err != nil {
+		return nil, err
+	}
+	b.mem, b.size = buf.Bytes(), n
+
+	if n == memLimit {
+		f, err := os.CreateTemp(l.Dir, "prom-label-proxy-body-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		b.path = f.Name()
+
+		n, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.size += n
+	}
+
+	if l.Max > 0 && b.size > l.Max {
+		b.Close()
+		return nil, errBodyTooLarge
+	}
+
+	return b, nil
+}
+
+// Size returns the size of the body.
+func (b *bufferedBody) Size() int64 {
+	return b.size
+}
+
+// Open returns a new reader of the whole body.
+func (b *bufferedBody) Open() (io.ReadCloser, error) {
+	if b.path == "" {
+		return io.NopCloser(bytes.NewReader(b.mem)), nil
+	}
+
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b.mem), f), f}, nil
+}
+
+// Close removes the temporary file, if any.
+func (b *bufferedBody) Close() error {
+	if b.path == "" {
+		return nil
+	}
+
+	err := os.Remove(b.path)
+	b.path = ""
+	return err
+}
+
+// bufferRequestBody buffers the body of the request and replaces it with a
+// reader of the buffered copy. The caller must close the returned body once
+// the request has been served. The returned boolean is false if an error
+// response has been written.
+func (r *routes) bufferRequestBody(w http.ResponseWriter, req *http.Request) (*bufferedBody, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	body, err := r.bodyLimits.bufferBody(req.Body)
+	if err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			prometheusAPIError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	_ = req.Body.Close()
+
+	if req.Body, err = body.Open(); err != nil {
+		body.Close()
+		prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return body, true
+}
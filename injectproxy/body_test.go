@@ -0,0 +1,148 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferBody(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		body   string
+		limits BodyBufferLimits
+
+		expErr  error
+		expFile bool
+	}{
+		{
+			name:   "in memory",
+			body:   "query=up",
+			limits: BodyBufferLimits{Memory: 16},
+		},
+		{
+			name:    "spilled to disk",
+			body:    strings.Repeat("a", 64),
+			limits:  BodyBufferLimits{Memory: 16},
+			expFile: true,
+		},
+		{
+			name:    "at the maximum size",
+			body:    strings.Repeat("a", 64),
+			limits:  BodyBufferLimits{Memory: 16, Max: 64},
+			expFile: true,
+		},
+		{
+			name:   "too large",
+			body:   strings.Repeat("a", 65),
+			limits: BodyBufferLimits{Memory: 16, Max: 64},
+			expErr: errBodyTooLarge,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.limits.Dir = t.TempDir()
+
+			b, err := tc.limits.bufferBody(strings.NewReader(tc.body))
+			if !errors.Is(err, tc.expErr) {
+				t.Fatalf("expected error %v, got %v", tc.expErr, err)
+			}
+
+			// No temporary file should be left behind on error.
+			if err != nil {
+				entries, _ := os.ReadDir(tc.limits.Dir)
+				if len(entries) != 0 {
+					t.Fatalf("expected no temporary file, got %d", len(entries))
+				}
+				return
+			}
+
+			if (b.path != "") != tc.expFile {
+				t.Fatalf("expected file %v, got path %q", tc.expFile, b.path)
+			}
+
+			if b.Size() != int64(len(tc.body)) {
+				t.Fatalf("expected size %d, got %d", len(tc.body), b.Size())
+			}
+
+			// The body can be read several times.
+			for i := 0; i < 2; i++ {
+				rc, err := b.Open()
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				got, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(got) != tc.body {
+					t.Fatalf("expected body %q, got %q", tc.body, got)
+				}
+			}
+
+			path := b.path
+			if err := b.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if path != "" {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Fatalf("expected temporary file to be removed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyBufferLimitsRoutes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithEnabledLabelsAPI(),
+		WithLabelsCache(time.Minute, 0),
+		WithBodyBufferLimits(BodyBufferLimits{Memory: 8, Max: 32, Dir: t.TempDir()}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		body    string
+		expCode int
+	}{
+		{body: "namespace=ns1&match[]=up", expCode: http.StatusOK},
+		{body: "namespace=ns1&match[]=" + strings.Repeat("a", 32), expCode: http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/labels", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.expCode {
+			t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+		}
+	}
+}
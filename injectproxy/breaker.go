@@ -0,0 +1,231 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errCircuitOpen is returned when the circuit breaker rejects a request.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerConfig configures the upstream circuit breaker.
+type CircuitBreakerConfig struct {
+	// ErrorRatio is the ratio of failed requests (between 0 and 1) over
+	// the window which opens the circuit.
+	ErrorRatio float64
+	// MinRequests is the minimum number of requests in the window before
+	// the circuit can open.
+	MinRequests int
+	// Window is the duration over which the failed requests are counted.
+	Window time.Duration
+	// OpenDuration is the duration for which the requests are rejected
+	// before probing the upstream again.
+	OpenDuration time.Duration
+	// Probes is the number of requests let through to probe the upstream
+	// when the circuit is half-open. All of them must succeed to close the
+	// circuit.
+	Probes int
+}
+
+// WithCircuitBreaker stops sending requests to the upstream when too many of
+// them fail (5xx status code or transport error). While the circuit is
+// open, the requests are rejected immediately with "503 Service
+// Unavailable". After OpenDuration, a few probe requests are let through
+// and the circuit closes again if they succeed.
+func WithCircuitBreaker(c CircuitBreakerConfig) Option {
+	return optionFunc(func(o *options) {
+		o.circuitBreaker = &c
+	})
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker is an http.RoundTripper implementing the circuit breaker
+// pattern.
+type circuitBreaker struct {
+	next   http.RoundTripper
+	config CircuitBreakerConfig
+	events EventSink
+	now    func() time.Time
+	// onClose, if not nil, is called in a new goroutine when the circuit
+	// closes after an outage.
+	onClose func()
+
+	mtx         sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+
+	stateGauge prometheus.Gauge
+	rejected   prometheus.Counter
+}
+
+func newCircuitBreaker(next http.RoundTripper, c CircuitBreakerConfig, events EventSink, reg prometheus.Registerer) *circuitBreaker {
+	return &circuitBreaker{
+		next:   next,
+		config: c,
+		events: events,
+		now:    time.Now,
+		stateGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "upstream_circuit_breaker_state",
+			Help: "State of the upstream circuit breaker (0: closed, 1: open, 2: half-open).",
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "upstream_circuit_breaker_rejected_requests_total",
+			Help: "Total number of requests rejected because the upstream circuit breaker was open.",
+		}),
+	}
+}
+
+// setState must be called with the lock held. It returns the event to emit,
+// if any.
+func (cb *circuitBreaker) setState(s circuitState) *Event {
+	cb.state = s
+	cb.stateGauge.Set(float64(s))
+
+	now := cb.now()
+	switch s {
+	case circuitOpen:
+		cb.openedAt = now
+		return cb.event(EventCircuitOpened)
+	case circuitHalfOpen:
+		cb.probes, cb.successes = 0, 0
+	case circuitClosed:
+		cb.windowStart, cb.requests, cb.failures = now, 0, 0
+		if cb.onClose != nil {
+			go cb.onClose()
+		}
+		return cb.event(EventCircuitClosed)
+	}
+
+	return nil
+}
+
+func (cb *circuitBreaker) event(t EventType) *Event {
+	if cb.events == nil {
+		return nil
+	}
+
+	return &Event{Time: cb.now(), Type: t}
+}
+
+// allow returns whether the request can be sent to the upstream.
+func (cb *circuitBreaker) allow() (bool, *Event) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	var ev *Event
+	if cb.state == circuitOpen {
+		if cb.now().Sub(cb.openedAt) < cb.config.OpenDuration {
+			return false, nil
+		}
+		ev = cb.setState(circuitHalfOpen)
+	}
+
+	if cb.state == circuitHalfOpen {
+		if cb.probes >= cb.config.Probes {
+			return false, ev
+		}
+		cb.probes++
+	}
+
+	return true, ev
+}
+
+// record accounts for the result of a request sent to the upstream.
+func (cb *circuitBreaker) record(failed bool) *Event {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	switch cb.state {
+	case circuitHalfOpen:
+		if failed {
+			return cb.setState(circuitOpen)
+		}
+		cb.successes++
+		if cb.successes >= cb.config.Probes {
+			return cb.setState(circuitClosed)
+		}
+	case circuitClosed:
+		now := cb.now()
+		if now.Sub(cb.windowStart) >= cb.config.Window {
+			cb.windowStart, cb.requests, cb.failures = now, 0, 0
+		}
+
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+
+		if cb.requests >= cb.config.MinRequests && float64(cb.failures)/float64(cb.requests) >= cb.config.ErrorRatio {
+			return cb.setState(circuitOpen)
+		}
+	}
+
+	return nil
+}
+
+// cancel gives back the probe slot of a request cancelled by the client.
+func (cb *circuitBreaker) cancel() {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.state == circuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+func (cb *circuitBreaker) emit(ev *Event) {
+	if ev != nil {
+		cb.events.Emit(*ev)
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (cb *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	ok, ev := cb.allow()
+	cb.emit(ev)
+	if !ok {
+		cb.rejected.Inc()
+		return nil, errCircuitOpen
+	}
+
+	resp, err := cb.next.RoundTrip(req)
+	// Requests cancelled by the client don't say anything about the
+	// upstream's health.
+	if req.Context().Err() != nil {
+		cb.cancel()
+		return resp, err
+	}
+	cb.emit(cb.record(err != nil || resp.StatusCode >= 500))
+
+	return resp, err
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var status int
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	sink := &recordingSink{}
+	cb := newCircuitBreaker(next, CircuitBreakerConfig{
+		ErrorRatio:   0.5,
+		MinRequests:  4,
+		Window:       time.Minute,
+		OpenDuration: 10 * time.Second,
+		Probes:       2,
+	}, sink, prometheus.NewRegistry())
+	now := time.Unix(0, 0)
+	cb.now = func() time.Time { return now }
+
+	do := func(expErr error) {
+		t.Helper()
+		_, err := cb.RoundTrip(httptest.NewRequest(http.MethodGet, "http://upstream/api/v1/query", nil))
+		if !errors.Is(err, expErr) {
+			t.Fatalf("expected error %v, got %v", expErr, err)
+		}
+	}
+
+	// Not enough requests to open the circuit.
+	status = http.StatusServiceUnavailable
+	for i := 0; i < 3; i++ {
+		do(nil)
+	}
+
+	// The window expired.
+	now = now.Add(time.Minute)
+	do(nil)
+	status = http.StatusOK
+	do(nil)
+	do(nil)
+
+	// 2 failures out of 4 requests open the circuit.
+	status = http.StatusInternalServerError
+	do(nil)
+	do(errCircuitOpen)
+
+	// The circuit is half-open after the open duration and fails again.
+	now = now.Add(10 * time.Second)
+	do(nil)
+	do(errCircuitOpen)
+
+	// Successful probes close the circuit.
+	now = now.Add(10 * time.Second)
+	status = http.StatusOK
+	do(nil)
+	do(nil)
+	do(nil)
+
+	var types []EventType
+	for _, e := range sink.events {
+		types = append(types, e.Type)
+	}
+	exp := []EventType{EventCircuitOpened, EventCircuitOpened, EventCircuitClosed}
+	if len(types) != len(exp) {
+		t.Fatalf("expected events %v, got %v", exp, types)
+	}
+	for i := range exp {
+		if types[i] != exp[i] {
+			t.Fatalf("expected events %v, got %v", exp, types)
+		}
+	}
+}
+
+func TestCircuitBreakerRoutes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithCircuitBreaker(CircuitBreakerConfig{ErrorRatio: 1, MinRequests: 1, Window: time.Minute, OpenDuration: time.Minute, Probes: 1}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, expCode := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+		if w.Code != expCode {
+			t.Fatalf("expected status code %d, got %d", expCode, w.Code)
+		}
+	}
+}
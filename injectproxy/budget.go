@@ -0,0 +1,752 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BackpressureAlgorithm is the algorithm adjusting the concurrency limits.
+type BackpressureAlgorithm string
+
+const (
+	// BackpressureAIMD decreases the limit multiplicatively when the p99
+	// latency exceeds the budget and increases it additively otherwise.
+	BackpressureAIMD BackpressureAlgorithm = "aimd"
+	// BackpressureGradient adjusts the limit based on the ratio between
+	// the long-term and short-term average latencies (similar to
+	// Netflix's Gradient2), without any latency budget.
+	BackpressureGradient BackpressureAlgorithm = "gradient"
+)
+
+// LatencyBudgets configures the per-tenant latency budgets.
+type LatencyBudgets struct {
+	// Default is the budget of the tenants without override.
+	Default time.Duration
+	// Tenants overrides the budget for specific tenants.
+	Tenants map[string]time.Duration
+	// MaxConcurrency is the maximum number of concurrent requests per
+	// tenant and handler.
+	MaxConcurrency int
+	// MinConcurrency is the lower bound of the concurrency limit per
+	// tenant and handler. It defaults to 1.
+	MinConcurrency int
+	// Handlers overrides the bounds of the concurrency limit per handler
+	// (e.g. "/api/v1/query_range"), so that the cheap instant queries
+	// aren't starved when the limit of the expensive range queries is
+	// reduced. The zero bounds default to MinConcurrency and
+	// MaxConcurrency.
+	Handlers map[string]ConcurrencyBounds
+	// MaxQueueLength is the maximum number of requests per tenant and
+	// handler waiting for a slot when the limit is reached. Zero rejects
+	// the requests immediately.
+	MaxQueueLength int
+	// MaxQueueWait is how long a queued request waits for a slot before
+	// being rejected.
+	MaxQueueWait time.Duration
+	// IncreaseStep is added to the limit while the latency stays within
+	// the budget. It defaults to 1.
+	IncreaseStep int
+	// DecreaseFactor multiplies the limit when the latency exceeds the
+	// budget. It must be between 0 and 1 (exclusive) and defaults to 0.5.
+	DecreaseFactor float64
+	// Algorithm adjusts the concurrency limits. It defaults to
+	// BackpressureAIMD. The budgets, IncreaseStep and DecreaseFactor are
+	// ignored by BackpressureGradient.
+	Algorithm BackpressureAlgorithm
+	// Controller, if not nil, creates the controllers adjusting the
+	// concurrency limits instead of the built-in Algorithm. The
+	// budgets, IncreaseStep and MaxErrorRatio are ignored then while the
+	// bounds, queue, slow start, cooldown and upstream throttling still
+	// apply.
+	Controller CongestionControllerFactory
+	// MaxErrorRatio, if positive, decreases the limit when the ratio of
+	// the tenant's requests for which the upstream was overloaded (429,
+	// 503 and 504 status codes, timeouts and connection errors) exceeds
+	// it over the rolling window, whatever the latency.
+	MaxErrorRatio float64
+	// SlowStart starts the limits at their minimum instead of their
+	// maximum and doubles them at each adjustment until the first
+	// backpressure signal (or the maximum), after which the algorithm
+	// takes over. The inherited limits (see WithLimitHandoff) skip the slow
+	// start.
+	SlowStart bool
+	// SlowStartIdle, if positive, restarts the slow start of a tenant and
+	// handler which received no request during this period.
+	SlowStartIdle time.Duration
+	// DecreaseCooldown, if positive, is the period following a decrease
+	// of the limit during which the further decreases are suppressed, so
+	// that a sustained signal doesn't collapse the limit to its minimum
+	// before the effect of the first decrease can be observed.
+	DecreaseCooldown time.Duration
+	// UpstreamThrottling decreases the limit as soon as the upstream
+	// throttles a request (429 or 503 status code with a Retry-After or
+	// rate limit reset header) instead of waiting for the next
+	// adjustment. The throttled responses received before the end of the
+	// period requested by the upstream count as a single signal.
+	UpstreamThrottling bool
+}
+
+// ConcurrencyBounds are the bounds of the concurrency limit of a handler.
+type ConcurrencyBounds struct {
+	Min int
+	Max int
+}
+
+// WithLatencyBudgets enables the per-tenant latency budgets. When the rolling
+// p99 latency of a tenant's requests for a given handler exceeds its budget,
+// the concurrency limit for this tenant and handler is decreased
+// multiplicatively (halved by default). The limit increases again additively
+// (by one by default) while the latency stays within the budget.
+// Requests exceeding the limit are queued in FIFO order if the queue is
+// enabled and rejected with "429 Too Many Requests" otherwise or when they
+// don't get a slot within the maximum wait.
+//
+// With the gradient algorithm, the limit decreases when the recent average
+// latency grows above the long-term average instead, which requires no
+// knowledge of the upstream's expected latency. With both algorithms, the
+// limit can also be decreased when the upstream reports errors showing that
+// it is overloaded (see MaxErrorRatio). A cooldown period after each
+// decrease can prevent consecutive decreases (see DecreaseCooldown) and the
+// throttled upstream responses can decrease the limit immediately (see
+// UpstreamThrottling). Other algorithms can be plugged in by implementing the
+// CongestionController interface (see Controller).
+//
+// The current and maximum limits, the in-flight requests and the result of
+// the last evaluation are exposed as tenant_concurrency_* gauges. The state
+// of the least recently seen tenants is dropped, with their metrics, beyond
+// 10000 tenant and handler pairs.
+func WithLatencyBudgets(b LatencyBudgets) Option {
+	return optionFunc(func(o *options) {
+		o.latencyBudgets = &b
+	})
+}
+
+// maxBudgetStates is the maximum number of tenant and handler states. The
+// least recently used idle state is evicted beyond: the limit of a tenant
+// which hasn't sent requests for a while is most likely stale.
+const maxBudgetStates = 10000
+
+type budgetKey struct {
+	tenant  string
+	handler string
+}
+
+// budgetState tracks the latency and concurrency of a tenant for a handler.
+type budgetState struct {
+	key      budgetKey
+	elem     *list.Element
+	limit    int
+	inflight int
+	// limited is true while the requests are rejected.
+	limited bool
+	// slowStart is true until the first backpressure signal.
+	slowStart bool
+	// lastSeen is the time of the last request.
+	lastSeen time.Time
+	// lastDecrease is the time of the last decrease of the limit.
+	lastDecrease time.Time
+	// throttledUntil is the end of the period requested by the upstream
+	// after the last throttled response.
+	throttledUntil time.Time
+	// queue holds the requests waiting for a slot, the oldest first. The
+	// channel is closed when the slot is granted.
+	queue []chan struct{}
+	ctrl  CongestionController
+}
+
+type latencyBudgeter struct {
+	budgets LatencyBudgets
+	now     func() time.Time
+	events  EventSink
+
+	mtx       sync.Mutex
+	maxStates int
+	states    map[budgetKey]*budgetState
+	// ll orders the states from the most to the least recently used.
+	ll *list.List
+	// inherited holds the limits handed off by another replica which
+	// apply until the tenant sends its first request.
+	inherited map[budgetKey]int
+
+	limit     *prometheus.GaugeVec
+	maxLimit  *prometheus.GaugeVec
+	inflight  *prometheus.GaugeVec
+	signal    *prometheus.GaugeVec
+	limited   *prometheus.CounterVec
+	cooldowns *prometheus.CounterVec
+	throttled *prometheus.CounterVec
+	queued    *prometheus.GaugeVec
+	queueWait *prometheus.HistogramVec
+}
+
+func newLatencyBudgeter(b LatencyBudgets, events EventSink, reg prometheus.Registerer) (*latencyBudgeter, error) {
+	if b.IncreaseStep == 0 {
+		b.IncreaseStep = 1
+	}
+	if b.DecreaseFactor == 0 {
+		b.DecreaseFactor = 0.5
+	}
+
+	if b.IncreaseStep < 0 {
+		return nil, fmt.Errorf("the limit increase step must be positive, got %d", b.IncreaseStep)
+	}
+
+	switch b.Algorithm {
+	case "":
+		b.Algorithm = BackpressureAIMD
+	case BackpressureAIMD, BackpressureGradient:
+	default:
+		return nil, fmt.Errorf("invalid backpressure algorithm %q", b.Algorithm)
+	}
+
+	if b.SlowStartIdle < 0 {
+		return nil, fmt.Errorf("the slow start idle period must be positive, got %s", b.SlowStartIdle)
+	}
+
+	if b.DecreaseCooldown < 0 {
+		return nil, fmt.Errorf("the decrease cooldown must be positive, got %s", b.DecreaseCooldown)
+	}
+
+	if b.MaxErrorRatio < 0 || b.MaxErrorRatio >= 1 {
+		return nil, fmt.Errorf("the maximum error ratio must be between 0 and 1, got %v", b.MaxErrorRatio)
+	}
+
+	if b.DecreaseFactor <= 0 || b.DecreaseFactor >= 1 {
+		return nil, fmt.Errorf("the limit decrease factor must be between 0 and 1 (exclusive), got %v", b.DecreaseFactor)
+	}
+
+	if b.MinConcurrency == 0 {
+		b.MinConcurrency = 1
+	}
+
+	if b.MinConcurrency < 1 || b.MaxConcurrency < b.MinConcurrency {
+		return nil, fmt.Errorf("invalid concurrency bounds [%d, %d]", b.MinConcurrency, b.MaxConcurrency)
+	}
+
+	handlers := make(map[string]ConcurrencyBounds, len(b.Handlers))
+	for h, cb := range b.Handlers {
+		if cb.Min == 0 {
+			cb.Min = b.MinConcurrency
+		}
+		if cb.Max == 0 {
+			cb.Max = b.MaxConcurrency
+		}
+		if cb.Min < 1 || cb.Max < cb.Min {
+			return nil, fmt.Errorf("invalid concurrency bounds [%d, %d] for %q", cb.Min, cb.Max, h)
+		}
+		handlers[h] = cb
+	}
+	b.Handlers = handlers
+
+	return &latencyBudgeter{
+		budgets:   b,
+		now:       time.Now,
+		events:    events,
+		maxStates: maxBudgetStates,
+		states:    map[budgetKey]*budgetState{},
+		ll:        list.New(),
+		limit: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_concurrency_limit",
+			Help: "Current concurrency limit derived from the tenant's latency budget.",
+		}, []string{"tenant", "handler"}),
+		maxLimit: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_concurrency_max_limit",
+			Help: "Upper bound of the tenant's concurrency limit.",
+		}, []string{"tenant", "handler"}),
+		inflight: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_concurrency_in_flight_requests",
+			Help: "Current number of in-flight requests counted against the tenant's concurrency limit.",
+		}, []string{"tenant", "handler"}),
+		signal: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_concurrency_last_signal",
+			Help: "Result of the last evaluation of the tenant's concurrency limit: -1 if the upstream was overloaded and the limit decreased, 1 if the limit increased and 0 if it didn't change.",
+		}, []string{"tenant", "handler"}),
+		limited: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "tenant_concurrency_limited_requests_total",
+			Help: "Total number of requests rejected because the tenant's concurrency limit was reached.",
+		}, []string{"tenant", "handler"}),
+		cooldowns: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "tenant_concurrency_suppressed_decreases_total",
+			Help: "Total number of decreases of the tenant's concurrency limit suppressed because the previous decrease was within the cooldown period.",
+		}, []string{"tenant", "handler"}),
+		throttled: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "tenant_concurrency_throttling_signals_total",
+			Help: "Total number of throttled upstream responses which decreased the tenant's concurrency limit immediately.",
+		}, []string{"tenant", "handler"}),
+		queued: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tenant_concurrency_queue_length",
+			Help: "Current number of requests waiting for a slot of the tenant's concurrency limit.",
+		}, []string{"tenant", "handler"}),
+		queueWait: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tenant_concurrency_queue_wait_duration_seconds",
+			Help:    "Time spent by the queued requests waiting for a slot of the tenant's concurrency limit, partitioned by handler and result (acquired or rejected).",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler", "result"}),
+	}, nil
+}
+
+// bounds returns the bounds of the concurrency limit for the handler.
+func (b *latencyBudgeter) bounds(handler string) ConcurrencyBounds {
+	if cb, found := b.budgets.Handlers[handler]; found {
+		return cb
+	}
+
+	return ConcurrencyBounds{Min: b.budgets.MinConcurrency, Max: b.budgets.MaxConcurrency}
+}
+
+// controller returns a new controller for the tenant and handler.
+func (b *latencyBudgeter) controller(k budgetKey) CongestionController {
+	cb := b.bounds(k.handler)
+	switch {
+	case b.budgets.Controller != nil:
+		return b.budgets.Controller(k.tenant, k.handler, cb)
+	case b.budgets.Algorithm == BackpressureGradient:
+		return &gradientController{
+			bounds:         cb,
+			decreaseFactor: b.budgets.DecreaseFactor,
+			maxErrorRatio:  b.budgets.MaxErrorRatio,
+		}
+	default:
+		return &aimdController{
+			budget:         b.budget(k.tenant),
+			bounds:         cb,
+			increaseStep:   b.budgets.IncreaseStep,
+			decreaseFactor: b.budgets.DecreaseFactor,
+			maxErrorRatio:  b.budgets.MaxErrorRatio,
+		}
+	}
+}
+
+func (b *latencyBudgeter) budget(tenant string) time.Duration {
+	if d, found := b.budgets.Tenants[tenant]; found {
+		return d
+	}
+	return b.budgets.Default
+}
+
+// acquire reserves a slot for the tenant and handler. When the concurrency
+// limit is reached, the request waits in the queue (if enabled) until a slot
+// is released. It returns false if no slot could be reserved.
+func (b *latencyBudgeter) acquire(ctx context.Context, k budgetKey) bool {
+	ready, ok := b.reserve(k)
+	if ready == nil {
+		return ok
+	}
+
+	start := b.now()
+	t := time.NewTimer(b.budgets.MaxQueueWait)
+	defer t.Stop()
+
+	select {
+	case <-ready:
+		b.queueWait.WithLabelValues(k.handler, "acquired").Observe(b.now().Sub(start).Seconds())
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	select {
+	case <-ready:
+		// The slot was granted concurrently.
+		b.queueWait.WithLabelValues(k.handler, "acquired").Observe(b.now().Sub(start).Seconds())
+		return true
+	default:
+	}
+
+	s := b.states[k]
+	for i, c := range s.queue {
+		if c == ready {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	b.queued.WithLabelValues(k.tenant, k.handler).Set(float64(len(s.queue)))
+	b.limited.WithLabelValues(k.tenant, k.handler).Inc()
+	b.queueWait.WithLabelValues(k.handler, "rejected").Observe(b.now().Sub(start).Seconds())
+
+	return false
+}
+
+// reserve reserves a slot if available. Otherwise it queues the request and
+// returns the channel closed when the slot is granted, or it returns false
+// if the queue is disabled or full.
+func (b *latencyBudgeter) reserve(k budgetKey) (chan struct{}, bool) {
+	var ev *Event
+	b.mtx.Lock()
+	defer func() {
+		b.mtx.Unlock()
+		b.emit(ev)
+	}()
+
+	s, found := b.states[k]
+	if !found {
+		cb := b.bounds(k.handler)
+		if len(b.states) >= b.maxStates {
+			b.evict()
+		}
+
+		s = &budgetState{key: k, limit: cb.Max, ctrl: b.controller(k)}
+		if b.budgets.SlowStart {
+			s.limit = cb.Min
+			s.slowStart = true
+		}
+		if limit, found := b.inherited[k]; found {
+			s.limit = max(cb.Min, min(cb.Max, limit))
+			s.slowStart = false
+			delete(b.inherited, k)
+		}
+		s.elem = b.ll.PushFront(s)
+		b.states[k] = s
+		b.limit.WithLabelValues(k.tenant, k.handler).Set(float64(s.limit))
+		b.maxLimit.WithLabelValues(k.tenant, k.handler).Set(float64(cb.Max))
+	} else {
+		b.ll.MoveToFront(s.elem)
+		if b.idle(s) {
+			// The upstream may have cooled down in the meantime.
+			s.limit = b.bounds(k.handler).Min
+			s.slowStart = true
+			s.ctrl = b.controller(k)
+			b.limit.WithLabelValues(k.tenant, k.handler).Set(float64(s.limit))
+		}
+	}
+	s.lastSeen = b.now()
+
+	if s.inflight < s.limit && len(s.queue) == 0 {
+		s.limited = false
+		s.inflight++
+		s.ctrl.Acquire(s.inflight)
+		b.inflight.WithLabelValues(k.tenant, k.handler).Set(float64(s.inflight))
+		return nil, true
+	}
+
+	if !s.limited {
+		s.limited = true
+		ev = b.event(EventLimitReached, k, s.limit, 0)
+	}
+
+	if len(s.queue) >= b.budgets.MaxQueueLength || b.budgets.MaxQueueWait <= 0 {
+		b.limited.WithLabelValues(k.tenant, k.handler).Inc()
+		return nil, false
+	}
+
+	ready := make(chan struct{})
+	s.queue = append(s.queue, ready)
+	b.queued.WithLabelValues(k.tenant, k.handler).Set(float64(len(s.queue)))
+
+	return ready, false
+}
+
+// evict removes the least recently used state without in-flight nor queued
+// requests and its metrics. The states in use are never evicted.
+func (b *latencyBudgeter) evict() {
+	for e := b.ll.Back(); e != nil; e = e.Prev() {
+		s := e.Value.(*budgetState)
+		if s.inflight > 0 || len(s.queue) > 0 {
+			continue
+		}
+
+		b.ll.Remove(e)
+		delete(b.states, s.key)
+		for _, vec := range []*prometheus.MetricVec{
+			b.limit.MetricVec,
+			b.maxLimit.MetricVec,
+			b.inflight.MetricVec,
+			b.signal.MetricVec,
+			b.limited.MetricVec,
+			b.cooldowns.MetricVec,
+			b.throttled.MetricVec,
+			b.queued.MetricVec,
+		} {
+			vec.DeleteLabelValues(s.key.tenant, s.key.handler)
+		}
+		return
+	}
+}
+
+// idle returns true if the slow start must restart after an idle period.
+func (b *latencyBudgeter) idle(s *budgetState) bool {
+	return b.budgets.SlowStart &&
+		b.budgets.SlowStartIdle > 0 &&
+		s.inflight == 0 &&
+		len(s.queue) == 0 &&
+		b.now().Sub(s.lastSeen) > b.budgets.SlowStartIdle
+}
+
+// headroom returns the number of slots available for the tenant and handler.
+// It returns false if the tenant has no concurrency limit yet.
+func (b *latencyBudgeter) headroom(k budgetKey) (int, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	s, found := b.states[k]
+	if !found {
+		return 0, false
+	}
+
+	return s.limit - s.inflight - len(s.queue), true
+}
+
+// dequeue grants the available slots to the queued requests.
+func (b *latencyBudgeter) dequeue(k budgetKey, s *budgetState) {
+	if len(s.queue) == 0 {
+		return
+	}
+
+	for s.inflight < s.limit && len(s.queue) > 0 {
+		close(s.queue[0])
+		s.queue = s.queue[1:]
+		s.inflight++
+		s.ctrl.Acquire(s.inflight)
+	}
+	b.queued.WithLabelValues(k.tenant, k.handler).Set(float64(len(s.queue)))
+	b.inflight.WithLabelValues(k.tenant, k.handler).Set(float64(s.inflight))
+}
+
+// release frees the slot and lets the controller adjust the concurrency limit
+// based on the observed latency and whether the upstream was overloaded.
+func (b *latencyBudgeter) release(k budgetKey, d time.Duration, failed bool) {
+	var ev *Event
+	b.mtx.Lock()
+	defer func() {
+		b.mtx.Unlock()
+		b.emit(ev)
+	}()
+
+	s := b.states[k]
+	s.inflight--
+	s.ctrl.Release(s.inflight)
+	b.inflight.WithLabelValues(k.tenant, k.handler).Set(float64(s.inflight))
+	defer b.dequeue(k, s)
+
+	var adj LimitAdjustment
+	if failed {
+		adj = s.ctrl.OnFailure(d, s.limit)
+	} else {
+		adj = s.ctrl.OnSuccess(d, s.limit)
+	}
+	if !adj.Adjusted {
+		return
+	}
+
+	prev := s.limit
+	cb := b.bounds(k.handler)
+	s.limit = max(cb.Min, min(cb.Max, adj.Limit))
+
+	if s.limit < prev {
+		if b.coolingDown(s) {
+			s.limit = prev
+			b.cooldowns.WithLabelValues(k.tenant, k.handler).Inc()
+		} else {
+			s.lastDecrease = b.now()
+		}
+	}
+
+	if s.slowStart {
+		b.slowStart(s, prev, cb, adj.Overloaded || s.limit < prev)
+	}
+
+	var signal float64
+	switch {
+	case s.limit < prev:
+		signal = -1
+		ev = b.event(EventLimitDecreased, k, s.limit, prev)
+	case s.limit > prev:
+		signal = 1
+		ev = b.event(EventLimitIncreased, k, s.limit, prev)
+	}
+
+	b.limit.WithLabelValues(k.tenant, k.handler).Set(float64(s.limit))
+	b.signal.WithLabelValues(k.tenant, k.handler).Set(signal)
+}
+
+// throttle decreases the limit immediately after the upstream throttled a
+// request, unless the previous throttled response asked to wait longer.
+func (b *latencyBudgeter) throttle(k budgetKey, retryAfter time.Duration) {
+	var ev *Event
+	b.mtx.Lock()
+	defer func() {
+		b.mtx.Unlock()
+		b.emit(ev)
+	}()
+
+	s := b.states[k]
+	now := b.now()
+	if now.Before(s.throttledUntil) {
+		return
+	}
+	s.throttledUntil = now.Add(retryAfter)
+	s.slowStart = false
+
+	if b.coolingDown(s) {
+		b.cooldowns.WithLabelValues(k.tenant, k.handler).Inc()
+		return
+	}
+
+	prev := s.limit
+	s.limit = max(b.bounds(k.handler).Min, int(float64(s.limit)*b.budgets.DecreaseFactor))
+	b.throttled.WithLabelValues(k.tenant, k.handler).Inc()
+
+	if s.limit < prev {
+		s.lastDecrease = now
+		ev = b.event(EventLimitDecreased, k, s.limit, prev)
+	}
+	b.limit.WithLabelValues(k.tenant, k.handler).Set(float64(s.limit))
+	b.signal.WithLabelValues(k.tenant, k.handler).Set(-1)
+}
+
+// coolingDown returns true if the limit was decreased within the cooldown
+// period.
+func (b *latencyBudgeter) coolingDown(s *budgetState) bool {
+	return b.budgets.DecreaseCooldown > 0 &&
+		!s.lastDecrease.IsZero() &&
+		b.now().Sub(s.lastDecrease) < b.budgets.DecreaseCooldown
+}
+
+// slowStart doubles the limit until the first backpressure signal. The slow
+// start ends with the signal or when the limit reaches the maximum.
+func (b *latencyBudgeter) slowStart(s *budgetState, prev int, cb ConcurrencyBounds, backpressure bool) {
+	if backpressure {
+		s.slowStart = false
+		return
+	}
+
+	s.limit = min(cb.Max, prev*2)
+	if s.limit == cb.Max {
+		s.slowStart = false
+	}
+}
+
+func (b *latencyBudgeter) event(t EventType, k budgetKey, limit, prev int) *Event {
+	if b.events == nil {
+		return nil
+	}
+
+	return &Event{
+		Time:          b.now(),
+		Type:          t,
+		Tenant:        k.tenant,
+		Handler:       k.handler,
+		Limit:         limit,
+		PreviousLimit: prev,
+	}
+}
+
+// emit sends the event to the sink outside of the lock.
+func (b *latencyBudgeter) emit(ev *Event) {
+	if ev != nil {
+		b.events.Emit(*ev)
+	}
+}
+
+// inherit sets the initial concurrency limits of the tenants. The limits
+// override the ones inherited previously.
+func (b *latencyBudgeter) inherit(limits map[budgetKey]int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.inherited == nil {
+		b.inherited = make(map[budgetKey]int, len(limits))
+	}
+	for k, limit := range limits {
+		b.inherited[k] = limit
+	}
+}
+
+// snapshot returns the current concurrency limits, including the inherited
+// limits not used yet.
+func (b *latencyBudgeter) snapshot() []handedOffLimit {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var limits []handedOffLimit
+	for k, s := range b.states {
+		limits = append(limits, handedOffLimit{Tenant: k.tenant, Handler: k.handler, Limit: s.limit})
+	}
+	for k, limit := range b.inherited {
+		limits = append(limits, handedOffLimit{Tenant: k.tenant, Handler: k.handler, Limit: limit})
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].Tenant != limits[j].Tenant {
+			return limits[i].Tenant < limits[j].Tenant
+		}
+		return limits[i].Handler < limits[j].Handler
+	})
+
+	return limits
+}
+
+// enforceLatencyBudget applies the tenant's concurrency limit before calling
+// the next handler.
+func (r *routes) enforceLatencyBudget(next http.HandlerFunc) http.HandlerFunc {
+	if r.budgeter == nil {
+		return next
+	}
+
+	return r.rollOut(RuleLatencyBudget, func(w http.ResponseWriter, req *http.Request) {
+		k := budgetKey{
+			tenant:  strings.Join(MustLabelValues(req.Context()), ","),
+			handler: handlerName(req.Context()),
+		}
+
+		if !r.budgeter.acquire(req.Context(), k) {
+			rejectRequest(w, ReasonWindowFull, "tenant concurrency limit reached", http.StatusTooManyRequests)
+			return
+		}
+
+		start := r.budgeter.now()
+		rec := newStatusRecorder(w)
+		defer func() {
+			if retryAfter, throttled := upstreamThrottled(req.Context()); throttled && r.budgeter.budgets.UpstreamThrottling {
+				r.budgeter.throttle(k, retryAfter)
+			}
+			r.budgeter.release(k, r.budgeter.now().Sub(start), upstreamOverloaded(req.Context(), rec.status))
+		}()
+
+		next(rec, req)
+	}, next)
+}
+
+// upstreamOverloaded returns true if the upstream couldn't serve the request
+// because it is overloaded.
+func upstreamOverloaded(ctx context.Context, status int) bool {
+	o := outcomeFrom(ctx)
+	if o == nil {
+		return false
+	}
+
+	if o.upstreamFailed.Load() {
+		return true
+	}
+
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return o.upstream.Load()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,733 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLatencyBudgeter(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		Tenants:        map[string]time.Duration{"slow": 10 * time.Second},
+		MaxConcurrency: 8,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	run := func(k budgetKey, d time.Duration, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if !b.acquire(context.Background(), k) {
+				t.Fatalf("unexpected rejection of %v", k)
+			}
+			b.release(k, d, false)
+		}
+	}
+
+	limit := func(k budgetKey) int {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		return b.states[k].limit
+	}
+
+	fast := budgetKey{tenant: "fast", handler: "/api/v1/query"}
+	slow := budgetKey{tenant: "slow", handler: "/api/v1/query"}
+
+	// Latency above the default budget halves the limit.
+	run(fast, 2*time.Second, budgetEvalEvery)
+	if got := limit(fast); got != 4 {
+		t.Fatalf("expected limit 4, got %d", got)
+	}
+
+	run(fast, 2*time.Second, budgetEvalEvery)
+	if got := limit(fast); got != 2 {
+		t.Fatalf("expected limit 2, got %d", got)
+	}
+
+	// The tenant override allows a higher latency.
+	run(slow, 2*time.Second, budgetEvalEvery)
+	if got := limit(slow); got != 8 {
+		t.Fatalf("expected limit 8, got %d", got)
+	}
+
+	// Healthy latency increases the limit step by step.
+	run(fast, 100*time.Millisecond, budgetEvalEvery)
+	if got := limit(fast); got != 3 {
+		t.Fatalf("expected limit 3, got %d", got)
+	}
+
+	// Requests beyond the limit are rejected.
+	for i := 0; i < 3; i++ {
+		if !b.acquire(context.Background(), fast) {
+			t.Fatalf("unexpected rejection")
+		}
+	}
+	if b.acquire(context.Background(), fast) {
+		t.Fatalf("expected rejection")
+	}
+}
+
+func TestLatencyBudgeterFactors(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		MaxConcurrency: 10,
+		IncreaseStep:   4,
+		DecreaseFactor: 0.75,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	for _, tc := range []struct {
+		latency time.Duration
+
+		exp int
+	}{
+		{latency: 2 * time.Second, exp: 7},
+		{latency: 2 * time.Second, exp: 5},
+		{latency: 100 * time.Millisecond, exp: 9},
+		// The limit doesn't exceed the maximum concurrency.
+		{latency: 100 * time.Millisecond, exp: 10},
+	} {
+		for i := 0; i < budgetEvalEvery; i++ {
+			if !b.acquire(context.Background(), k) {
+				t.Fatalf("unexpected rejection")
+			}
+			b.release(k, tc.latency, false)
+		}
+
+		if got := b.states[k].limit; got != tc.exp {
+			t.Fatalf("expected limit %d, got %d", tc.exp, got)
+		}
+	}
+
+	for _, lb := range []LatencyBudgets{
+		{Default: time.Second, MaxConcurrency: 1, IncreaseStep: -1},
+		{Default: time.Second, MaxConcurrency: 1, DecreaseFactor: 1},
+		{Default: time.Second, MaxConcurrency: 1, DecreaseFactor: -0.5},
+	} {
+		if _, err := newLatencyBudgeter(lb, nil, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", lb)
+		}
+	}
+}
+
+func TestLatencyBudgeterBounds(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		MaxConcurrency: 10,
+		MinConcurrency: 2,
+		Handlers: map[string]ConcurrencyBounds{
+			"/api/v1/query_range": {Min: 1, Max: 4},
+		},
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		handler string
+		latency time.Duration
+
+		exp []int
+	}{
+		{
+			handler: "/api/v1/query",
+			latency: 2 * time.Second,
+			exp:     []int{5, 2, 2},
+		},
+		{
+			handler: "/api/v1/query_range",
+			latency: 2 * time.Second,
+			exp:     []int{2, 1, 1},
+		},
+		{
+			handler: "/api/v1/query_range",
+			latency: 100 * time.Millisecond,
+			exp:     []int{2, 3, 4, 4},
+		},
+	} {
+		k := budgetKey{tenant: "ns1", handler: tc.handler}
+		for _, exp := range tc.exp {
+			for i := 0; i < budgetEvalEvery; i++ {
+				if !b.acquire(context.Background(), k) {
+					t.Fatalf("unexpected rejection")
+				}
+				b.release(k, tc.latency, false)
+			}
+
+			if got := b.states[k].limit; got != exp {
+				t.Fatalf("%s: expected limit %d, got %d", tc.handler, exp, got)
+			}
+		}
+	}
+
+	for _, lb := range []LatencyBudgets{
+		{Default: time.Second, MaxConcurrency: 1, MinConcurrency: 2},
+		{Default: time.Second, MaxConcurrency: 10, Handlers: map[string]ConcurrencyBounds{"/api/v1/query_range": {Min: 4, Max: 2}}},
+		{Default: time.Second, MaxConcurrency: 10, Handlers: map[string]ConcurrencyBounds{"/api/v1/query_range": {Min: 20}}},
+	} {
+		if _, err := newLatencyBudgeter(lb, nil, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", lb)
+		}
+	}
+}
+
+func TestLatencyBudgeterGradient(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		MaxConcurrency: 20,
+		Algorithm:      BackpressureGradient,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	adjust := func(latency time.Duration, n int) int {
+		for j := 0; j < n; j++ {
+			for i := 0; i < budgetEvalEvery; i++ {
+				if !b.acquire(context.Background(), k) {
+					t.Fatalf("unexpected rejection")
+				}
+				b.release(k, latency, false)
+			}
+		}
+		return b.states[k].limit
+	}
+
+	// The limit stays at the maximum while the latency is stable.
+	if got := adjust(100*time.Millisecond, 10); got != 20 {
+		t.Fatalf("expected limit 20, got %d", got)
+	}
+
+	// The limit decreases when the latency grows.
+	slow := adjust(time.Second, 10)
+	if slow >= 20 {
+		t.Fatalf("expected the limit to decrease, got %d", slow)
+	}
+
+	// The limit increases again when the latency recovers.
+	if got := adjust(100*time.Millisecond, 50); got != 20 {
+		t.Fatalf("expected limit 20, got %d", got)
+	}
+
+	if _, err := newLatencyBudgeter(LatencyBudgets{MaxConcurrency: 1, Algorithm: "vegas"}, nil, prometheus.NewRegistry()); err == nil {
+		t.Fatal("expected an error for an unknown algorithm")
+	}
+}
+
+func TestLatencyBudgeterQueue(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		MaxConcurrency: 1,
+		MaxQueueLength: 2,
+		MaxQueueWait:   time.Minute,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	queued := func(n int) {
+		t.Helper()
+		for testutil.ToFloat64(b.queued.WithLabelValues(k.tenant, k.handler)) != float64(n) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if !b.acquire(context.Background(), k) {
+		t.Fatalf("unexpected rejection")
+	}
+
+	// The queued requests get the released slots in FIFO order.
+	acquired := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if b.acquire(context.Background(), k) {
+			acquired <- "first"
+		}
+	}()
+	queued(1)
+	go func() {
+		if b.acquire(ctx, k) {
+			acquired <- "second"
+		}
+	}()
+	queued(2)
+
+	// The queue is full.
+	if b.acquire(context.Background(), k) {
+		t.Fatalf("expected rejection")
+	}
+
+	b.release(k, time.Millisecond, false)
+	if got := <-acquired; got != "first" {
+		t.Fatalf("expected the first queued request to acquire the slot, got %q", got)
+	}
+	queued(1)
+
+	// The canceled request leaves the queue.
+	cancel()
+	queued(0)
+	select {
+	case got := <-acquired:
+		t.Fatalf("unexpected slot acquired by the %s request", got)
+	default:
+	}
+
+	// The slot isn't lost.
+	b.release(k, time.Millisecond, false)
+	if !b.acquire(context.Background(), k) {
+		t.Fatalf("unexpected rejection")
+	}
+
+	if got := testutil.ToFloat64(b.limited.WithLabelValues(k.tenant, k.handler)); got != 2 {
+		t.Fatalf("expected 2 rejected requests, got %v", got)
+	}
+
+	// The requests are rejected after the maximum wait.
+	b.budgets.MaxQueueWait = 10 * time.Millisecond
+	if b.acquire(context.Background(), k) {
+		t.Fatalf("expected rejection")
+	}
+	queued(0)
+}
+
+func TestLatencyBudgetRoutes(t *testing.T) {
+	r, err := NewRoutes(
+		&url.URL{Scheme: "http", Host: "upstream"},
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithLatencyBudgets(LatencyBudgets{Default: time.Second, MaxConcurrency: 1}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Hold one slot for the ns1 tenant.
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	if !r.budgeter.acquire(context.Background(), k) {
+		t.Fatalf("unexpected rejection")
+	}
+
+	r.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	for _, tc := range []struct {
+		url     string
+		expCode int
+	}{
+		{
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			expCode: http.StatusTooManyRequests,
+		},
+		{
+			url:     "http://prometheus.example.com/api/v1/query_range?query=up&namespace=ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns2",
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestLatencyBudgeterErrors(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		MaxConcurrency: 10,
+		MaxErrorRatio:  0.2,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	for _, tc := range []struct {
+		failures int
+
+		exp int
+	}{
+		{failures: 1, exp: 10},
+		// 6 errors out of 20 requests.
+		{failures: 5, exp: 5},
+		// The window starts over after a decrease.
+		{failures: 0, exp: 6},
+	} {
+		for i := 0; i < budgetEvalEvery; i++ {
+			if !b.acquire(context.Background(), k) {
+				t.Fatalf("unexpected rejection")
+			}
+			b.release(k, time.Millisecond, i < tc.failures)
+		}
+
+		if got := b.states[k].limit; got != tc.exp {
+			t.Fatalf("expected limit %d, got %d", tc.exp, got)
+		}
+	}
+
+	if _, err := newLatencyBudgeter(LatencyBudgets{Default: time.Second, MaxConcurrency: 1, MaxErrorRatio: 1}, nil, prometheus.NewRegistry()); err == nil {
+		t.Fatal("expected an error for an invalid error ratio")
+	}
+}
+
+func TestUpstreamOverloaded(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("query") == `overloaded{namespace="ns1"}` {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithLatencyBudgets(LatencyBudgets{Default: time.Hour, MaxConcurrency: 10, MaxErrorRatio: 0.4}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	for _, tc := range []struct {
+		query string
+
+		expLimit int
+	}{
+		// The client errors don't decrease the limit.
+		{query: "invalid", expLimit: 10},
+		{query: "overloaded", expLimit: 5},
+	} {
+		for i := 0; i < budgetEvalEvery; i++ {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?namespace=ns1&query="+tc.query, nil))
+		}
+
+		if got := r.budgeter.states[k].limit; got != tc.expLimit {
+			t.Fatalf("%s: expected limit %d, got %d", tc.query, tc.expLimit, got)
+		}
+	}
+}
+
+func TestLatencyBudgeterMetrics(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		MaxConcurrency: 4,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	gauge := func(g *prometheus.GaugeVec) float64 {
+		return testutil.ToFloat64(g.WithLabelValues(k.tenant, k.handler))
+	}
+
+	for i := 0; i < 2; i++ {
+		if !b.acquire(context.Background(), k) {
+			t.Fatalf("unexpected rejection")
+		}
+	}
+	if got := gauge(b.inflight); got != 2 {
+		t.Fatalf("expected 2 in-flight requests, got %v", got)
+	}
+	if got := gauge(b.maxLimit); got != 4 {
+		t.Fatalf("expected max limit 4, got %v", got)
+	}
+
+	for _, tc := range []struct {
+		latency time.Duration
+
+		expLimit  float64
+		expSignal float64
+	}{
+		{latency: 2 * time.Second, expLimit: 2, expSignal: -1},
+		{latency: time.Millisecond, expLimit: 3, expSignal: 1},
+		{latency: time.Millisecond, expLimit: 4, expSignal: 1},
+		// The limit is already at its maximum.
+		{latency: time.Millisecond, expLimit: 4, expSignal: 0},
+	} {
+		for i := 0; i < budgetEvalEvery; i++ {
+			b.release(k, tc.latency, false)
+			if !b.acquire(context.Background(), k) {
+				t.Fatalf("unexpected rejection")
+			}
+		}
+
+		if got := gauge(b.limit); got != tc.expLimit {
+			t.Fatalf("expected limit %v, got %v", tc.expLimit, got)
+		}
+		if got := gauge(b.signal); got != tc.expSignal {
+			t.Fatalf("expected signal %v, got %v", tc.expSignal, got)
+		}
+	}
+
+	b.release(k, time.Millisecond, false)
+	if got := gauge(b.inflight); got != 1 {
+		t.Fatalf("expected 1 in-flight request, got %v", got)
+	}
+}
+
+func TestLatencyBudgeterSlowStart(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		MaxConcurrency: 20,
+		MinConcurrency: 2,
+		SlowStart:      true,
+		SlowStartIdle:  time.Minute,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	b.inherit(map[budgetKey]int{{tenant: "warm", handler: "/api/v1/query"}: 8})
+
+	run := func(k budgetKey, d time.Duration) int {
+		t.Helper()
+		for i := 0; i < budgetEvalEvery; i++ {
+			if !b.acquire(context.Background(), k) {
+				t.Fatalf("unexpected rejection")
+			}
+			b.release(k, d, false)
+		}
+
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		return b.states[k].limit
+	}
+
+	for i, tc := range []struct {
+		latency time.Duration
+		idle    time.Duration
+
+		exp int
+	}{
+		// The limit doubles from the minimum.
+		{latency: time.Millisecond, exp: 4},
+		{latency: time.Millisecond, exp: 8},
+		// The first backpressure signal ends the slow start.
+		{latency: 2 * time.Second, exp: 4},
+		{latency: time.Millisecond, exp: 5},
+		{latency: time.Millisecond, exp: 6},
+		// A long idle period starts over.
+		{latency: time.Millisecond, idle: 2 * time.Minute, exp: 4},
+		{latency: time.Millisecond, exp: 8},
+		{latency: time.Millisecond, exp: 16},
+		// The slow start ends at the maximum.
+		{latency: time.Millisecond, exp: 20},
+	} {
+		now = now.Add(tc.idle)
+		if got := run(k, tc.latency); got != tc.exp {
+			t.Fatalf("%d: expected limit %d, got %d", i, tc.exp, got)
+		}
+	}
+
+	// The inherited limits skip the slow start.
+	if got := run(budgetKey{tenant: "warm", handler: "/api/v1/query"}, time.Millisecond); got != 9 {
+		t.Fatalf("expected limit 9, got %d", got)
+	}
+}
+
+func TestLatencyBudgeterCooldown(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:          time.Second,
+		MaxConcurrency:   16,
+		DecreaseCooldown: time.Minute,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	for i, tc := range []struct {
+		latency time.Duration
+		wait    time.Duration
+
+		exp           int
+		expSuppressed float64
+	}{
+		{latency: 2 * time.Second, exp: 8},
+		// The signal persists within the cooldown period.
+		{latency: 2 * time.Second, wait: 10 * time.Second, exp: 8, expSuppressed: 1},
+		{latency: 2 * time.Second, wait: 10 * time.Second, exp: 8, expSuppressed: 2},
+		// The limit can still increase.
+		{latency: time.Millisecond, wait: 10 * time.Second, exp: 9, expSuppressed: 2},
+		// The cooldown period has elapsed.
+		{latency: 2 * time.Second, wait: time.Minute, exp: 4, expSuppressed: 2},
+		{latency: 2 * time.Second, exp: 4, expSuppressed: 3},
+	} {
+		now = now.Add(tc.wait)
+		for j := 0; j < budgetEvalEvery; j++ {
+			if !b.acquire(context.Background(), k) {
+				t.Fatalf("%d: unexpected rejection", i)
+			}
+			b.release(k, tc.latency, false)
+		}
+
+		b.mtx.Lock()
+		got := b.states[k].limit
+		b.mtx.Unlock()
+		if got != tc.exp {
+			t.Fatalf("%d: expected limit %d, got %d", i, tc.exp, got)
+		}
+
+		if got := testutil.ToFloat64(b.cooldowns.WithLabelValues(k.tenant, k.handler)); got != tc.expSuppressed {
+			t.Fatalf("%d: expected %v suppressed decreases, got %v", i, tc.expSuppressed, got)
+		}
+	}
+
+	if _, err := newLatencyBudgeter(LatencyBudgets{MaxConcurrency: 1, DecreaseCooldown: -time.Second}, nil, prometheus.NewRegistry()); err == nil {
+		t.Fatalf("expected an error for a negative cooldown")
+	}
+}
+
+func TestLatencyBudgeterThrottling(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		throttle bool
+
+		exp []int
+	}{
+		{
+			name:     "throttled responses decrease the limit",
+			throttle: true,
+			// The second response is within the period requested by
+			// the upstream.
+			exp: []int{4, 4, 2},
+		},
+		{
+			name: "disabled",
+			exp:  []int{8, 8, 8},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithLatencyBudgets(LatencyBudgets{Default: time.Second, MaxConcurrency: 8, UpstreamThrottling: tc.throttle}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			now := time.Now()
+			r.budgeter.now = func() time.Time { return now }
+
+			k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+			for i, exp := range tc.exp {
+				now = now.Add(40 * time.Second)
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+				if w.Code != http.StatusTooManyRequests {
+					t.Fatalf("%d: expected status code %d, got %d", i, http.StatusTooManyRequests, w.Code)
+				}
+
+				r.budgeter.mtx.Lock()
+				got := r.budgeter.states[k].limit
+				r.budgeter.mtx.Unlock()
+				if got != exp {
+					t.Fatalf("%d: expected limit %d, got %d", i, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyBudgeterEviction(t *testing.T) {
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		Default:        time.Second,
+		MaxConcurrency: 8,
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.maxStates = 2
+
+	busy := budgetKey{tenant: "busy", handler: "/api/v1/query"}
+	idle := budgetKey{tenant: "idle", handler: "/api/v1/query"}
+
+	// The busy state is the least recently used one but it has an in-flight
+	// request.
+	if !b.acquire(context.Background(), busy) {
+		t.Fatal("unexpected rejection")
+	}
+	if !b.acquire(context.Background(), idle) {
+		t.Fatal("unexpected rejection")
+	}
+	b.release(idle, time.Millisecond, false)
+
+	// Rotating the tenants doesn't grow the states beyond the maximum and
+	// never evicts the state in use.
+	for i := 0; i < 100; i++ {
+		k := budgetKey{tenant: fmt.Sprintf("rotated-%d", i), handler: "/api/v1/query"}
+		if !b.acquire(context.Background(), k) {
+			t.Fatalf("unexpected rejection of %v", k)
+		}
+		b.release(k, time.Millisecond, false)
+
+		if n := len(b.states); n > 2 || b.ll.Len() != n {
+			t.Fatalf("expected at most 2 states, got %d", n)
+		}
+	}
+
+	if _, found := b.states[busy]; !found {
+		t.Fatal("expected the state with an in-flight request to be kept")
+	}
+	if _, found := b.states[idle]; found {
+		t.Fatal("expected the idle state to be evicted")
+	}
+	b.release(busy, time.Millisecond, false)
+
+	// The metrics of the evicted states are deleted.
+	if n := testutil.CollectAndCount(b.limit); n != 2 {
+		t.Fatalf("expected the limits of 2 states, got %d", n)
+	}
+	if n := testutil.CollectAndCount(b.inflight); n != 2 {
+		t.Fatalf("expected the in-flight requests of 2 states, got %d", n)
+	}
+}
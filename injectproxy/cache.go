@@ -0,0 +1,479 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// defaultCacheMaxEntries is the maximum number of responses kept in the
+// cache.
+const defaultCacheMaxEntries = 10000
+
+// WithLabelsCache caches the successful responses of the /api/v1/labels and
+// /api/v1/label/<name>/values endpoints for the given durations. A zero
+// duration disables the cache for the endpoint.
+//
+// Clients like Grafana request them on every dashboard load while they
+// rarely change within seconds.
+func WithLabelsCache(labelsTTL, labelValuesTTL time.Duration) Option {
+	return optionFunc(func(o *options) {
+		if o.cacheTTLs == nil {
+			o.cacheTTLs = map[string]time.Duration{}
+		}
+		o.cacheTTLs["/api/v1/labels"] = labelsTTL
+		o.cacheTTLs["/api/v1/label"] = labelValuesTTL
+	})
+}
+
+// QueryCache configures the cache of the query results.
+type QueryCache struct {
+	// TTL is the duration for which the results are cached.
+	TTL time.Duration
+	// MaxBytes bounds the total size of the cached responses, including
+	// the ones of the labels cache. Zero means no limit.
+	MaxBytes int64
+}
+
+// WithQueryCache caches the successful responses of the instant and range
+// queries. The cache key uses the normalized expression and time
+// parameters so that equivalent requests (e.g. different whitespace or
+// timestamp formats) share the same entry.
+//
+// Dashboards refreshing identical queries are then served without hitting
+// the upstream. Note that an instant query without the "time" parameter is
+// evaluated at the current time: its result may be up to one TTL old.
+func WithQueryCache(c QueryCache) Option {
+	return optionFunc(func(o *options) {
+		if o.cacheTTLs == nil {
+			o.cacheTTLs = map[string]time.Duration{}
+		}
+		o.cacheTTLs["/api/v1/query"] = c.TTL
+		o.cacheTTLs["/api/v1/query_range"] = c.TTL
+		o.cacheMaxBytes = c.MaxBytes
+	})
+}
+
+// WithCacheStore keeps the responses of the labels and query caches in the
+// given store instead of the proxy's memory. With a remote store (e.g.
+// Redis or memcached), the replicas of the proxy share the same cache.
+func WithCacheStore(s StateStore) Option {
+	return optionFunc(func(o *options) {
+		o.cacheStore = s
+	})
+}
+
+// cachedResponse is a response stored in the cache.
+type cachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+type cacheEntry struct {
+	key     string
+	resp    *cachedResponse
+	expires time.Time
+}
+
+// responseCache is an in-memory LRU cache of HTTP responses with
+// expiration.
+type responseCache struct {
+	maxEntries int
+	// maxBytes bounds the total size of the cached bodies. Zero means no
+	// limit.
+	maxBytes int64
+	now      func() time.Time
+
+	mtx     sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+func newResponseCache(maxEntries int) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		now:        time.Now,
+		ll:         list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	ce := e.Value.(*cacheEntry)
+	if !c.now().Before(ce.expires) {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return ce.resp, true
+}
+
+func (c *responseCache) set(key string, resp *cachedResponse, ttl time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.maxBytes > 0 && int64(len(resp.Body)) > c.maxBytes {
+		return
+	}
+
+	expires := c.now().Add(ttl)
+	if e, found := c.entries[key]; found {
+		ce := e.Value.(*cacheEntry)
+		c.size += int64(len(resp.Body) - len(ce.resp.Body))
+		ce.resp, ce.expires = resp, expires
+		c.ll.MoveToFront(e)
+	} else {
+		c.entries[key] = c.ll.PushFront(&cacheEntry{key: key, resp: resp, expires: expires})
+		c.size += int64(len(resp.Body))
+	}
+
+	for c.ll.Len() > c.maxEntries || (c.maxBytes > 0 && c.size > c.maxBytes) {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *responseCache) remove(e *list.Element) {
+	ce := e.Value.(*cacheEntry)
+	c.ll.Remove(e)
+	delete(c.entries, ce.key)
+	c.size -= int64(len(ce.resp.Body))
+}
+
+// storeCache is a response cache backed by a StateStore.
+type storeCache struct {
+	store   StateStore
+	backend string
+	codec   cacheCodec
+	logger  *log.Logger
+
+	requests *prometheus.CounterVec
+}
+
+func newStoreCache(s StateStore, codec cacheCodec, reg prometheus.Registerer) *storeCache {
+	return &storeCache{
+		store:   s,
+		backend: storeBackend(s),
+		codec:   codec,
+		logger:  log.Default(),
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cache_store_requests_total",
+			Help: "Total number of requests to the response cache store, partitioned by backend and result (hit, miss or error).",
+		}, []string{"backend", "result"}),
+	}
+}
+
+// storeBackend returns the name of the StateStore implementation.
+func storeBackend(s StateStore) string {
+	switch s.(type) {
+	case *MemoryStateStore:
+		return "memory"
+	case *FileStateStore:
+		return "file"
+	case *RedisStateStore:
+		return "redis"
+	case *MemcachedStateStore:
+		return "memcached"
+	default:
+		return "custom"
+	}
+}
+
+// get returns the cached response. Errors of the store are logged and
+// handled as misses.
+func (c *storeCache) get(ctx context.Context, key string) (*cachedResponse, bool) {
+	b, found, err := c.store.Get(ctx, c.codec.keyPrefix()+key)
+	if err != nil {
+		c.requests.WithLabelValues(c.backend, "error").Inc()
+		c.logger.Printf("failed to read the response cache: %v", err)
+		return nil, false
+	}
+
+	if !found {
+		c.requests.WithLabelValues(c.backend, "miss").Inc()
+		return nil, false
+	}
+
+	resp, err := c.codec.decode(b)
+	if err != nil {
+		c.requests.WithLabelValues(c.backend, "error").Inc()
+		c.logger.Printf("failed to decode the cached response: %v", err)
+		return nil, false
+	}
+
+	c.requests.WithLabelValues(c.backend, "hit").Inc()
+	return resp, true
+}
+
+func (c *storeCache) set(ctx context.Context, key string, resp *cachedResponse, ttl time.Duration) {
+	b, err := c.codec.encode(resp)
+	if err != nil {
+		return
+	}
+
+	if err := c.store.Set(ctx, c.codec.keyPrefix()+key, b, ttl); err != nil {
+		c.requests.WithLabelValues(c.backend, "error").Inc()
+		c.logger.Printf("failed to write the response cache: %v", err)
+	}
+}
+
+// cachedResponse returns the response from the cache store, if configured,
+// or else from the in-memory cache.
+func (r *routes) cachedResponse(ctx context.Context, key string) (*cachedResponse, bool) {
+	if r.cacheStore != nil {
+		return r.cacheStore.get(ctx, key)
+	}
+
+	return r.cache.get(key)
+}
+
+func (r *routes) storeResponse(ctx context.Context, key string, resp *cachedResponse, ttl time.Duration) {
+	if r.cacheStore != nil {
+		r.cacheStore.set(ctx, key, resp, ttl)
+		return
+	}
+
+	r.cache.set(key, resp, ttl)
+}
+
+type cacheMetrics struct {
+	requests *prometheus.CounterVec
+}
+
+func newCacheMetrics(reg prometheus.Registerer) *cacheMetrics {
+	return &cacheMetrics{
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cache_requests_total",
+			Help: "Total number of requests looked up in the response cache, partitioned by handler and result (hit or miss).",
+		}, []string{"handler", "result"}),
+	}
+}
+
+// writeTenants writes the tenant values to the hash. The values are
+// length-prefixed so that e.g. the tenant "a,b" and the tenants "a" and "b"
+// don't collide.
+func writeTenants(h hash.Hash, tenants []string) {
+	var b [binary.MaxVarintLen64]byte
+	_, _ = h.Write(b[:binary.PutUvarint(b[:], uint64(len(tenants)))])
+	for _, t := range tenants {
+		_, _ = h.Write(b[:binary.PutUvarint(b[:], uint64(len(t)))])
+		_, _ = io.WriteString(h, t)
+	}
+}
+
+// cacheKey returns the cache key of the request. The key depends on the
+// tenant values, the request parameters and the accepted encoding because
+// the upstream response may be compressed. The parameters of the queries are
+// normalized.
+func cacheKey(req *http.Request, body *bufferedBody) (string, error) {
+	h := sha256.New()
+	for _, s := range []string{
+		handlerName(req.Context()),
+		req.URL.Path,
+		req.Header.Get("Accept-Encoding"),
+	} {
+		_, _ = io.WriteString(h, s)
+		_, _ = h.Write([]byte{0})
+	}
+	writeTenants(h, MustLabelValues(req.Context()))
+
+	// The exempted requests bypass the limits and don't share the entries
+	// of the other requests.
+	if exempted(req.Context()) {
+		_, _ = h.Write([]byte("exempted\x00"))
+	}
+
+	// GET and POST queries with the same parameters share the same entry.
+	if params, ok := normalizedQueryParams(req, body); ok {
+		_, _ = io.WriteString(h, params.Encode())
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	for _, s := range []string{req.Method, req.URL.RawQuery} {
+		_, _ = io.WriteString(h, s)
+		_, _ = h.Write([]byte{0})
+	}
+
+	if body != nil {
+		rc, err := body.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		if _, err := io.Copy(h, rc); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// normalizedQueryParams returns the parameters of an instant or range query
+// with the expression and the time parameters in canonical form. It returns
+// false for the other requests and the invalid queries.
+func normalizedQueryParams(req *http.Request, body *bufferedBody) (url.Values, bool) {
+	switch handlerName(req.Context()) {
+	case "/api/v1/query", "/api/v1/query_range":
+	default:
+		return nil, false
+	}
+
+	form := req.Form
+	if form == nil {
+		// Parse a copy of the request to leave the body untouched.
+		preq := req.Clone(req.Context())
+		preq.Body = http.NoBody
+		if body != nil {
+			rc, err := body.Open()
+			if err != nil {
+				return nil, false
+			}
+			defer rc.Close()
+			preq.Body = rc
+		}
+
+		if err := preq.ParseForm(); err != nil {
+			return nil, false
+		}
+		form = preq.Form
+	}
+
+	params := make(url.Values, len(form))
+	for k, v := range form {
+		if len(v) != 1 {
+			params[k] = v
+			continue
+		}
+
+		switch k {
+		case queryParam:
+			expr, err := parser.ParseExpr(v[0])
+			if err != nil {
+				return nil, false
+			}
+			params.Set(k, expr.String())
+		case timeParam, startParam, endParam:
+			t, err := parseTime(v[0])
+			if err != nil {
+				return nil, false
+			}
+			params.Set(k, strconv.FormatInt(t.UnixMilli(), 10))
+		case stepParam:
+			d, err := parseDuration(v[0])
+			if err != nil {
+				return nil, false
+			}
+			params.Set(k, formatDuration(d))
+		default:
+			params[k] = v
+		}
+	}
+
+	return params, true
+}
+
+// cacheRecorder copies the response written to the client.
+type cacheRecorder struct {
+	*statusRecorder
+	buf bytes.Buffer
+}
+
+func (c *cacheRecorder) Write(b []byte) (int, error) {
+	c.buf.Write(b)
+	return c.statusRecorder.Write(b)
+}
+
+// cacheResponses serves the responses from the cache for the handlers with a
+// TTL.
+func (r *routes) cacheResponses(next http.HandlerFunc) http.HandlerFunc {
+	if r.cache == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		handler := handlerName(req.Context())
+		ttl := r.cacheTTLs[handler]
+		if ttl <= 0 {
+			next(w, req)
+			return
+		}
+
+		body, ok := r.bufferRequestBody(w, req)
+		if !ok {
+			return
+		}
+		if body != nil {
+			defer body.Close()
+		}
+
+		key, err := cacheKey(req, body)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if resp, found := r.cachedResponse(req.Context(), key); found {
+			r.cacheMetrics.requests.WithLabelValues(handler, "hit").Inc()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			r.annotateCache(w, "hit")
+			w.WriteHeader(resp.Status)
+			_, _ = w.Write(resp.Body)
+			return
+		}
+		r.cacheMetrics.requests.WithLabelValues(handler, "miss").Inc()
+		r.annotateCache(w, "miss")
+
+		rec := &cacheRecorder{statusRecorder: newStatusRecorder(w)}
+		next(rec, req)
+
+		if rec.status != http.StatusOK {
+			return
+		}
+
+		r.storeResponse(req.Context(), key, &cachedResponse{
+			Status: rec.status,
+			Header: w.Header().Clone(),
+			Body:   rec.buf.Bytes(),
+		}, ttl)
+	}
+}
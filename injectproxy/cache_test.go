@@ -0,0 +1,405 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(2)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.set("a", &cachedResponse{Body: []byte("a")}, time.Minute)
+	c.set("b", &cachedResponse{Body: []byte("b")}, time.Minute)
+
+	// Make "a" the most recently used entry.
+	if _, found := c.get("a"); !found {
+		t.Fatal("expected a to be found")
+	}
+
+	c.set("c", &cachedResponse{Body: []byte("c")}, time.Second)
+	if _, found := c.get("b"); found {
+		t.Fatal("expected b to be evicted")
+	}
+
+	for _, k := range []string{"a", "c"} {
+		if _, found := c.get(k); !found {
+			t.Fatalf("expected %s to be found", k)
+		}
+	}
+
+	now = now.Add(2 * time.Second)
+	if _, found := c.get("c"); found {
+		t.Fatal("expected c to be expired")
+	}
+	if _, found := c.get("a"); !found {
+		t.Fatal("expected a to be found")
+	}
+}
+
+func TestLabelsCache(t *testing.T) {
+	var calls int
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":[%q]}`, req.URL.Query().Get(matchersParam))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithEnabledLabelsAPI(),
+		WithLabelsCache(time.Minute, 0),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	r.cache.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		advance time.Duration
+
+		expCalls int
+		expBody  string
+	}{
+		{
+			name:     "miss",
+			url:      "http://prometheus.example.com/api/v1/labels?namespace=ns1",
+			expCalls: 1,
+			expBody:  `{namespace=\"ns1\"}`,
+		},
+		{
+			name:     "hit",
+			url:      "http://prometheus.example.com/api/v1/labels?namespace=ns1",
+			expCalls: 1,
+			expBody:  `{namespace=\"ns1\"}`,
+		},
+		{
+			name:     "other tenant",
+			url:      "http://prometheus.example.com/api/v1/labels?namespace=ns2",
+			expCalls: 2,
+			expBody:  `{namespace=\"ns2\"}`,
+		},
+		{
+			name:     "other parameters",
+			url:      "http://prometheus.example.com/api/v1/labels?namespace=ns1&start=0",
+			expCalls: 3,
+			expBody:  `{namespace=\"ns1\"}`,
+		},
+		{
+			name:     "POST request",
+			method:   http.MethodPost,
+			url:      "http://prometheus.example.com/api/v1/labels",
+			body:     "namespace=ns1&match[]=up",
+			expCalls: 4,
+		},
+		{
+			name:     "cached POST request",
+			method:   http.MethodPost,
+			url:      "http://prometheus.example.com/api/v1/labels",
+			body:     "namespace=ns1&match[]=up",
+			expCalls: 4,
+		},
+		{
+			name:     "label values aren't cached",
+			url:      "http://prometheus.example.com/api/v1/label/job/values?namespace=ns1",
+			expCalls: 5,
+		},
+		{
+			name:     "label values aren't cached",
+			url:      "http://prometheus.example.com/api/v1/label/job/values?namespace=ns1",
+			expCalls: 6,
+		},
+		{
+			name:     "expired",
+			url:      "http://prometheus.example.com/api/v1/labels?namespace=ns1",
+			advance:  2 * time.Minute,
+			expCalls: 7,
+			expBody:  `{namespace=\"ns1\"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tc.url, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if calls != tc.expCalls {
+				t.Fatalf("expected %d upstream calls, got %d", tc.expCalls, calls)
+			}
+
+			if tc.expBody != "" && !strings.Contains(w.Body.String(), tc.expBody) {
+				t.Fatalf("expected body to contain %q, got %q", tc.expBody, w.Body.String())
+			}
+
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("expected JSON content type, got %q", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestResponseCacheMaxBytes(t *testing.T) {
+	c := newResponseCache(10)
+	c.maxBytes = 4
+
+	c.set("a", &cachedResponse{Body: []byte("aa")}, time.Minute)
+	c.set("b", &cachedResponse{Body: []byte("bb")}, time.Minute)
+	c.set("c", &cachedResponse{Body: []byte("c")}, time.Minute)
+	if _, found := c.get("a"); found {
+		t.Fatal("expected a to be evicted")
+	}
+
+	// Responses larger than the cache aren't stored.
+	c.set("d", &cachedResponse{Body: []byte("ddddd")}, time.Minute)
+	if _, found := c.get("d"); found {
+		t.Fatal("expected d not to be cached")
+	}
+
+	// Replacing an entry updates the size.
+	c.set("b", &cachedResponse{Body: []byte("bbb")}, time.Minute)
+	for k, exp := range map[string]bool{"b": true, "c": true} {
+		if _, found := c.get(k); found != exp {
+			t.Fatalf("expected %s found=%v", k, exp)
+		}
+	}
+	if c.size != 4 {
+		t.Fatalf("expected size 4, got %d", c.size)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	var calls int
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":[%q]}`, req.Form.Get(queryParam))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryCache(QueryCache{TTL: time.Minute}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		body   string
+
+		expCode  int
+		expCalls int
+	}{
+		{
+			name:     "miss",
+			url:      "http://prometheus.example.com/api/v1/query?namespace=ns1&query=sum(up)&time=1700000000",
+			expCalls: 1,
+		},
+		{
+			name:     "hit with a different formatting",
+			url:      "http://prometheus.example.com/api/v1/query?namespace=ns1&query=sum+(+up+)&time=2023-11-14T22:13:20Z",
+			expCalls: 1,
+		},
+		{
+			name:     "hit with a POST request",
+			method:   http.MethodPost,
+			url:      "http://prometheus.example.com/api/v1/query",
+			body:     "namespace=ns1&query=sum(up)&time=1700000000.000",
+			expCalls: 1,
+		},
+		{
+			name:     "other time",
+			url:      "http://prometheus.example.com/api/v1/query?namespace=ns1&query=sum(up)&time=1700000001",
+			expCalls: 2,
+		},
+		{
+			name:     "other tenant",
+			url:      "http://prometheus.example.com/api/v1/query?namespace=ns2&query=sum(up)&time=1700000000",
+			expCalls: 3,
+		},
+		{
+			name:     "range query miss",
+			url:      "http://prometheus.example.com/api/v1/query_range?namespace=ns1&query=up&start=0&end=60&step=15",
+			expCalls: 4,
+		},
+		{
+			name:     "range query hit",
+			url:      "http://prometheus.example.com/api/v1/query_range?namespace=ns1&query=up&start=0&end=1970-01-01T00:01:00Z&step=15s",
+			expCalls: 4,
+		},
+		{
+			name:     "invalid query",
+			url:      "http://prometheus.example.com/api/v1/query?namespace=ns1&query=sum(",
+			expCode:  http.StatusBadRequest,
+			expCalls: 4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tc.url, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			expCode := tc.expCode
+			if expCode == 0 {
+				expCode = http.StatusOK
+			}
+			if w.Code != expCode {
+				t.Fatalf("expected status code %d, got %d: %s", expCode, w.Code, w.Body.String())
+			}
+
+			if calls != tc.expCalls {
+				t.Fatalf("expected %d upstream calls, got %d", tc.expCalls, calls)
+			}
+		})
+	}
+}
+
+type failingStateStore struct{}
+
+func (failingStateStore) Get(context.Context, string) ([]byte, bool, error) {
+	return nil, false, errors.New("unavailable")
+}
+
+func (failingStateStore) Set(context.Context, string, []byte, time.Duration) error {
+	return errors.New("unavailable")
+}
+
+func TestCacheStore(t *testing.T) {
+	var calls int
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	newRoutes := func(s StateStore) *routes {
+		t.Helper()
+		r, err := NewRoutes(
+			m.url,
+			proxyLabel,
+			HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithQueryCache(QueryCache{TTL: time.Minute}),
+			WithCacheStore(s),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return r
+	}
+
+	do := func(r *routes, expCalls int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1&time=0", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("expected JSON content type, got %q", w.Header().Get("Content-Type"))
+		}
+		if calls != expCalls {
+			t.Fatalf("expected %d upstream calls, got %d", expCalls, calls)
+		}
+	}
+
+	// 2 replicas share the same store.
+	store := NewMemoryStateStore()
+	r1, r2 := newRoutes(store), newRoutes(store)
+	do(r1, 1)
+	do(r2, 1)
+	do(r1, 1)
+
+	// Errors of the store are handled as misses.
+	r := newRoutes(failingStateStore{})
+	do(r, 2)
+	do(r, 3)
+	if got := testutil.ToFloat64(r.cacheStore.requests.WithLabelValues("custom", "error")); got != 4 {
+		t.Fatalf("expected 4 errors, got %v", got)
+	}
+}
+
+func TestCacheKeyTenants(t *testing.T) {
+	key := func(tenants ...string) string {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil)
+		req = req.WithContext(WithLabelValues(req.Context(), tenants))
+		k, err := cacheKey(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return k
+	}
+
+	for _, tc := range [][2][]string{
+		{{"a,b"}, {"a", "b"}},
+		{{"a"}, {"a", ""}},
+		{{"ab"}, {"a", "b"}},
+	} {
+		if key(tc[0]...) == key(tc[1]...) {
+			t.Fatalf("expected different keys for the tenants %q and %q", tc[0], tc[1])
+		}
+	}
+
+	if key("a", "b") != key("a", "b") {
+		t.Fatal("expected the same key for the same tenants")
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// CacheEncoding is the serialization of the responses in the cache store.
+type CacheEncoding string
+
+const (
+	// CacheEncodingJSON stores the responses as JSON documents.
+	CacheEncodingJSON CacheEncoding = "json"
+	// CacheEncodingProtobuf stores the responses as protobuf messages.
+	CacheEncodingProtobuf CacheEncoding = "protobuf"
+	// CacheEncodingSnappy stores the responses as snappy-compressed
+	// protobuf messages.
+	CacheEncodingSnappy CacheEncoding = "snappy"
+)
+
+// WithCacheEncoding sets the serialization of the responses in the cache
+// store (see WithCacheStore). It defaults to JSON.
+//
+// The keys depend on the encoding so that replicas using different encodings
+// (e.g. during a rollout) don't read each other's entries.
+func WithCacheEncoding(e CacheEncoding) Option {
+	return optionFunc(func(o *options) {
+		o.cacheEncoding = e
+	})
+}
+
+// cacheCodec serializes the cached responses.
+type cacheCodec interface {
+	// keyPrefix is prepended to the keys of the entries.
+	keyPrefix() string
+	encode(*cachedResponse) ([]byte, error)
+	decode([]byte) (*cachedResponse, error)
+}
+
+func newCacheCodec(e CacheEncoding) (cacheCodec, error) {
+	switch e {
+	case "", CacheEncodingJSON:
+		return jsonCacheCodec{}, nil
+	case CacheEncodingProtobuf:
+		return protobufCacheCodec{}, nil
+	case CacheEncodingSnappy:
+		return snappyCacheCodec{}, nil
+	default:
+		return nil, fmt.Errorf("invalid cache encoding %q", e)
+	}
+}
+
+type jsonCacheCodec struct{}
+
+// keyPrefix implements the cacheCodec interface. It is the prefix of the
+// entries written before the encoding was configurable.
+func (jsonCacheCodec) keyPrefix() string {
+	return "cache:"
+}
+
+func (jsonCacheCodec) encode(resp *cachedResponse) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+func (jsonCacheCodec) decode(b []byte) (*cachedResponse, error) {
+	var resp cachedResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// protobufCacheCodec encodes the responses as the following message:
+//
+//	message CachedResponse {
+//	  message Header {
+//	    string name = 1;
+//	    repeated string values = 2;
+//	  }
+//	  int64 status = 1;
+//	  repeated Header headers = 2;
+//	  bytes body = 3;
+//	}
+type protobufCacheCodec struct{}
+
+const (
+	cachedResponseStatusField protowire.Number = 1
+	cachedResponseHeaderField protowire.Number = 2
+	cachedResponseBodyField   protowire.Number = 3
+	cachedHeaderNameField     protowire.Number = 1
+	cachedHeaderValuesField   protowire.Number = 2
+)
+
+// cachedResponseVersion is part of the keys of the protobuf entries. It must
+// be bumped on incompatible changes of the message.
+const cachedResponseVersion = "v1"
+
+func (protobufCacheCodec) keyPrefix() string {
+	return "cache:protobuf:" + cachedResponseVersion + ":"
+}
+
+func (protobufCacheCodec) encode(resp *cachedResponse) ([]byte, error) {
+	size := len(resp.Body) + 16
+	for name, values := range resp.Header {
+		size += len(name) + 8
+		for _, v := range values {
+			size += len(v) + 4
+		}
+	}
+
+	b := make([]byte, 0, size)
+	b = protowire.AppendTag(b, cachedResponseStatusField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(resp.Status))
+
+	for name, values := range resp.Header {
+		var h []byte
+		h = protowire.AppendTag(h, cachedHeaderNameField, protowire.BytesType)
+		h = protowire.AppendString(h, name)
+		for _, v := range values {
+			h = protowire.AppendTag(h, cachedHeaderValuesField, protowire.BytesType)
+			h = protowire.AppendString(h, v)
+		}
+
+		b = protowire.AppendTag(b, cachedResponseHeaderField, protowire.BytesType)
+		b = protowire.AppendBytes(b, h)
+	}
+
+	b = protowire.AppendTag(b, cachedResponseBodyField, protowire.BytesType)
+	b = protowire.AppendBytes(b, resp.Body)
+
+	return b, nil
+}
+
+var errInvalidCachedResponse = errors.New("invalid cached response")
+
+func (protobufCacheCodec) decode(b []byte) (*cachedResponse, error) {
+	resp := &cachedResponse{Header: http.Header{}}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case num == cachedResponseStatusField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+			}
+			resp.Status = int(v)
+			b = b[n:]
+		case num == cachedResponseHeaderField && typ == protowire.BytesType:
+			h, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+			}
+			if err := decodeCachedHeader(h, resp.Header); err != nil {
+				return nil, err
+			}
+			b = b[n:]
+		case num == cachedResponseBodyField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+			}
+			resp.Body = append([]byte(nil), v...)
+			b = b[n:]
+		default:
+			// Skip the unknown fields.
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+
+	return resp, nil
+}
+
+func decodeCachedHeader(b []byte, header http.Header) error {
+	var (
+		name   string
+		values []string
+	)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType || (num != cachedHeaderNameField && num != cachedHeaderValuesField) {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %w", errInvalidCachedResponse, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if num == cachedHeaderNameField {
+			name = v
+		} else {
+			values = append(values, v)
+		}
+	}
+
+	if name == "" {
+		return fmt.Errorf("%w: header without name", errInvalidCachedResponse)
+	}
+	header[name] = values
+
+	return nil
+}
+
+// snappyCacheCodec compresses the protobuf messages with snappy.
+type snappyCacheCodec struct{}
+
+func (snappyCacheCodec) keyPrefix() string {
+	return "cache:snappy:" + cachedResponseVersion + ":"
+}
+
+func (snappyCacheCodec) encode(resp *cachedResponse) ([]byte, error) {
+	b, err := protobufCacheCodec{}.encode(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyCacheCodec) decode(b []byte) (*cachedResponse, error) {
+	b, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidCachedResponse, err)
+	}
+
+	return protobufCacheCodec{}.decode(b)
+}
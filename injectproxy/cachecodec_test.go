@@ -0,0 +1,187 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCachedResponse() *cachedResponse {
+	var b strings.Builder
+	b.WriteString(`{"status":"success","data":{"resultType":"matrix","result":[`)
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"metric":{"__name__":"http_requests_total","job":"api","instance":"10.0.0.%d:8080"},"values":[[1700000000,"%d"],[1700000060,"%d"],[1700000120,"%d"]]}`, i, i, i+1, i+2)
+	}
+	b.WriteString(`]}}`)
+
+	return &cachedResponse{
+		Status: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Vary":         []string{"Accept-Encoding", "Origin"},
+		},
+		Body: []byte(b.String()),
+	}
+}
+
+func TestCacheCodecs(t *testing.T) {
+	for _, e := range []CacheEncoding{CacheEncodingJSON, CacheEncodingProtobuf, CacheEncodingSnappy} {
+		t.Run(string(e), func(t *testing.T) {
+			c, err := newCacheCodec(e)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, resp := range []*cachedResponse{
+				testCachedResponse(),
+				{Status: http.StatusNoContent, Header: http.Header{}},
+			} {
+				b, err := c.encode(resp)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				got, err := c.decode(b)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if got.Status != resp.Status || !reflect.DeepEqual(got.Header, resp.Header) || !bytes.Equal(got.Body, resp.Body) {
+					t.Fatalf("expected %+v, got %+v", resp, got)
+				}
+			}
+
+			if _, err := c.decode([]byte("\xff\xff\xff")); err == nil {
+				t.Fatal("expected an error for a corrupted entry")
+			}
+		})
+	}
+
+	if _, err := newCacheCodec("xml"); err == nil {
+		t.Fatal("expected an error for an invalid encoding")
+	}
+}
+
+func TestCacheEncodingKeys(t *testing.T) {
+	var calls int
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	store := NewMemoryStateStore()
+	newRoutes := func(e CacheEncoding) *routes {
+		t.Helper()
+		r, err := NewRoutes(
+			m.url,
+			proxyLabel,
+			HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithQueryCache(QueryCache{TTL: time.Minute}),
+			WithCacheStore(store),
+			WithCacheEncoding(e),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return r
+	}
+
+	for _, tc := range []struct {
+		encoding CacheEncoding
+		expCalls int
+	}{
+		{encoding: CacheEncodingJSON, expCalls: 1},
+		{encoding: CacheEncodingJSON, expCalls: 1},
+		// The entries of the other encodings are ignored.
+		{encoding: CacheEncodingSnappy, expCalls: 2},
+		{encoding: CacheEncodingSnappy, expCalls: 2},
+		{encoding: CacheEncodingProtobuf, expCalls: 3},
+		{encoding: CacheEncodingJSON, expCalls: 3},
+	} {
+		r := newRoutes(tc.encoding)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1&time=0", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code %d, got %d", tc.encoding, http.StatusOK, w.Code)
+		}
+		if w.Body.String() != string(okResponse) {
+			t.Fatalf("%s: expected %q, got %q", tc.encoding, okResponse, w.Body.String())
+		}
+		if calls != tc.expCalls {
+			t.Fatalf("%s: expected %d upstream calls, got %d", tc.encoding, tc.expCalls, calls)
+		}
+	}
+
+	// Entries written by a different encoding under the same key are
+	// handled as errors.
+	r := newRoutes(CacheEncodingSnappy)
+	if err := store.Set(context.Background(), r.cacheStore.codec.keyPrefix()+"corrupted", []byte(`{"Status":200}`), time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found := r.cacheStore.get(context.Background(), "corrupted"); found {
+		t.Fatal("expected a miss for a corrupted entry")
+	}
+
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryCache(QueryCache{TTL: time.Minute}), WithCacheStore(store), WithCacheEncoding("xml")); err == nil {
+		t.Fatal("expected an error for an invalid encoding")
+	}
+}
+
+func BenchmarkCacheCodecs(b *testing.B) {
+	resp := testCachedResponse()
+
+	for _, e := range []CacheEncoding{CacheEncodingJSON, CacheEncodingProtobuf, CacheEncodingSnappy} {
+		c, err := newCacheCodec(e)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		enc, err := c.encode(resp)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(string(e)+"/encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.encode(resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(enc)), "bytes/entry")
+		})
+
+		b.Run(string(e)+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.decode(enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
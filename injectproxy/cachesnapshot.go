@@ -0,0 +1,166 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheSnapshotVersion must be bumped on incompatible changes of the
+// snapshot format.
+const cacheSnapshotVersion = 1
+
+var errCacheSnapshotWithoutCache = errors.New("the cache snapshot requires the in-memory labels or query cache")
+
+// WithCacheSnapshot exports the in-memory response cache (see
+// WithLabelsCache and WithQueryCache) to the given file with
+// SaveCacheSnapshot and imports it when the proxy starts, so that a planned
+// restart doesn't send all the cached requests again to the upstream.
+//
+// The imported entries keep their expiration time: the expired ones are
+// dropped and the others can't outlive the longest configured TTL.
+func WithCacheSnapshot(path string) Option {
+	return optionFunc(func(o *options) {
+		o.cacheSnapshotPath = path
+	})
+}
+
+// cacheSnapshot is the file format of the exported cache.
+type cacheSnapshot struct {
+	Version int                  `json:"version"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+type cacheSnapshotEntry struct {
+	Key      string          `json:"key"`
+	Expires  time.Time       `json:"expires"`
+	Response *cachedResponse `json:"response"`
+}
+
+// export returns the unexpired entries from the least to the most recently
+// used.
+func (c *responseCache) export() []cacheSnapshotEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.now()
+	entries := make([]cacheSnapshotEntry, 0, c.ll.Len())
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		ce := e.Value.(*cacheEntry)
+		if !now.Before(ce.expires) {
+			continue
+		}
+		entries = append(entries, cacheSnapshotEntry{Key: ce.key, Expires: ce.expires, Response: ce.resp})
+	}
+
+	return entries
+}
+
+// restore adds the entries which haven't expired yet to the cache. Their
+// remaining lifetime is bounded by maxTTL. It returns the number of
+// restored entries.
+func (c *responseCache) restore(entries []cacheSnapshotEntry, maxTTL time.Duration) int {
+	var n int
+	for _, e := range entries {
+		ttl := min(e.Expires.Sub(c.now()), maxTTL)
+		if ttl <= 0 || e.Response == nil {
+			continue
+		}
+
+		c.set(e.Key, e.Response, ttl)
+		n++
+	}
+
+	return n
+}
+
+// loadCacheSnapshot imports the cache snapshot. A missing file isn't an
+// error.
+func (r *routes) loadCacheSnapshot() error {
+	b, err := os.ReadFile(r.cacheSnapshotPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read the cache snapshot: %w", err)
+	}
+
+	var s cacheSnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("failed to parse the cache snapshot: %w", err)
+	}
+
+	if s.Version != cacheSnapshotVersion {
+		return fmt.Errorf("unsupported cache snapshot version %d", s.Version)
+	}
+
+	var maxTTL time.Duration
+	for _, ttl := range r.cacheTTLs {
+		maxTTL = max(maxTTL, ttl)
+	}
+
+	n := r.cache.restore(s.Entries, maxTTL)
+	r.logger.Printf("restored %d/%d cached responses from %s", n, len(s.Entries), r.cacheSnapshotPath)
+
+	return nil
+}
+
+// SaveCacheSnapshot exports the in-memory response cache to the file
+// configured with WithCacheSnapshot. It does nothing otherwise. It is meant
+// to be called on shutdown, once the in-flight requests have completed.
+func (r *routes) SaveCacheSnapshot() error {
+	if r.cacheSnapshotPath == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(cacheSnapshot{
+		Version: cacheSnapshotVersion,
+		Entries: r.cache.export(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(r.cacheSnapshotPath, b); err != nil {
+		return fmt.Errorf("failed to write the cache snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomically writes to a temporary file first and renames it, to
+// never leave a partial file.
+func writeFileAtomically(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
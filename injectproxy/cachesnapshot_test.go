@@ -0,0 +1,125 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshotRestore(t *testing.T) {
+	now := time.Now()
+	c := newResponseCache(10)
+	c.now = func() time.Time { return now }
+
+	n := c.restore([]cacheSnapshotEntry{
+		{Key: "expired", Expires: now.Add(-time.Second), Response: &cachedResponse{Body: []byte("a")}},
+		{Key: "long", Expires: now.Add(time.Hour), Response: &cachedResponse{Body: []byte("b")}},
+		{Key: "short", Expires: now.Add(10 * time.Second), Response: &cachedResponse{Body: []byte("c")}},
+	}, time.Minute)
+	if n != 2 {
+		t.Fatalf("expected 2 restored entries, got %d", n)
+	}
+
+	if _, found := c.get("expired"); found {
+		t.Fatal("expected the expired entry to be dropped")
+	}
+
+	for _, tc := range []struct {
+		after time.Duration
+
+		expFound map[string]bool
+	}{
+		{after: 5 * time.Second, expFound: map[string]bool{"long": true, "short": true}},
+		{after: 30 * time.Second, expFound: map[string]bool{"long": true, "short": false}},
+		// The lifetime of the entries is bounded by the maximum TTL.
+		{after: 2 * time.Minute, expFound: map[string]bool{"long": false, "short": false}},
+	} {
+		now := now.Add(tc.after)
+		c.now = func() time.Time { return now }
+		for k, exp := range tc.expFound {
+			if _, found := c.get(k); found != exp {
+				t.Fatalf("after %s: expected %s found %v, got %v", tc.after, k, exp, found)
+			}
+		}
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	var upstreamRequests atomic.Int64
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamRequests.Add(1)
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	newRoutes := func() *routes {
+		r, err := NewRoutes(
+			m.url,
+			proxyLabel,
+			HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithQueryCache(QueryCache{TTL: time.Minute}),
+			WithCacheSnapshot(path),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return r
+	}
+
+	query := func(r *routes) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	// No snapshot exists on the first start.
+	r := newRoutes()
+	query(r)
+	if err := r.SaveCacheSnapshot(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The restarted proxy serves the query from the snapshot.
+	r = newRoutes()
+	query(r)
+	if got := upstreamRequests.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+
+	// A corrupted snapshot is ignored.
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r = newRoutes()
+	query(r)
+	if got := upstreamRequests.Load(); got != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", got)
+	}
+
+	// The snapshot requires the in-memory cache.
+	_, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithCacheSnapshot(path))
+	if !errors.Is(err, errCacheSnapshotWithoutCache) {
+		t.Fatalf("expected %v, got %v", errCacheSnapshotWithoutCache, err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	calendarDay  = 24 * time.Hour
+	calendarWeek = 7 * calendarDay
+)
+
+// CalendarSnapping configures the time zones used to snap the range queries
+// with daily or weekly steps.
+type CalendarSnapping struct {
+	// Default is the time zone of the tenants without override. It
+	// defaults to UTC.
+	Default *time.Location
+	// Tenants overrides the time zone per tenant.
+	Tenants map[string]*time.Location
+	// WeekStart is the first day of the weeks (Sunday by default).
+	WeekStart time.Weekday
+}
+
+// WithCalendarSnapping moves the start of the range queries with a step
+// multiple of 1 day (resp. 1 week) back to the midnight of the day (resp.
+// the first day of the week) in the tenant's time zone, and the end back to
+// the last evaluation timestamp. Reporting dashboards then get buckets
+// matching the calendar of the tenant and the same (cacheable) queries
+// whatever the time they're refreshed.
+//
+// The time zone of a request is the tenant's one only when a single label
+// value is enforced. Because the step is a fixed duration, the buckets
+// following a daylight saving time change are shifted by the difference.
+func WithCalendarSnapping(c CalendarSnapping) Option {
+	return optionFunc(func(o *options) {
+		o.calendarSnapping = &c
+	})
+}
+
+type calendarSnapper struct {
+	CalendarSnapping
+	snapped *prometheus.CounterVec
+}
+
+func newCalendarSnapper(c CalendarSnapping, reg prometheus.Registerer) *calendarSnapper {
+	if c.Default == nil {
+		c.Default = time.UTC
+	}
+
+	return &calendarSnapper{
+		CalendarSnapping: c,
+		snapped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_range_calendar_snaps_total",
+			Help: "Total number of range queries snapped to the calendar of the tenant, partitioned by unit (day or week).",
+		}, []string{"unit"}),
+	}
+}
+
+// location returns the time zone of the tenants.
+func (c *calendarSnapper) location(tenants []string) *time.Location {
+	if len(tenants) == 1 {
+		if loc, found := c.Tenants[tenants[0]]; found {
+			return loc
+		}
+	}
+
+	return c.Default
+}
+
+// snap returns the start of the day or week containing t in the given time
+// zone.
+func (c *calendarSnapper) snap(t time.Time, loc *time.Location, unit time.Duration) time.Time {
+	lt := t.In(loc)
+	d := lt.Day()
+	if unit == calendarWeek {
+		d -= (int(lt.Weekday()) - int(c.WeekStart) + 7) % 7
+	}
+
+	return time.Date(lt.Year(), lt.Month(), d, 0, 0, 0, 0, loc)
+}
+
+// snapToCalendar snaps the range queries with daily or weekly steps before
+// calling the next handler.
+func (r *routes) snapToCalendar(next http.HandlerFunc) http.HandlerFunc {
+	if r.calendar == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		qr, err := rangeFromRequest(req)
+		if err != nil || qr.step%calendarDay != 0 {
+			next(w, req)
+			return
+		}
+
+		unit, name := calendarDay, "day"
+		if qr.step%calendarWeek == 0 {
+			unit, name = calendarWeek, "week"
+		}
+
+		start := r.calendar.snap(qr.start, r.calendar.location(MustLabelValues(req.Context())), unit)
+		end := start.Add(qr.end.Sub(start) / qr.step * qr.step)
+		if !start.Equal(qr.start) || !end.Equal(qr.end) {
+			setParam(req, startParam, formatTime(start))
+			setParam(req, endParam, formatTime(end))
+			updateCost(req)
+			r.calendar.snapped.WithLabelValues(name).Inc()
+		}
+
+		next(w, req)
+	}
+}
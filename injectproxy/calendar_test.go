@@ -0,0 +1,109 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapToCalendar(t *testing.T) {
+	var got url.Values
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = url.Values{}
+		for _, k := range []string{"start", "end", "step"} {
+			got[k] = req.Form[k]
+		}
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithCalendarSnapping(CalendarSnapping{
+			Tenants:   map[string]*time.Location{"ns1": time.FixedZone("UTC+2", 2*60*60)},
+			WeekStart: time.Monday,
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		tenants []string
+		params  url.Values
+
+		expParams url.Values
+	}{
+		{
+			name:      "days in the tenant's time zone",
+			tenants:   []string{"ns1"},
+			params:    url.Values{"start": []string{"2024-01-10T12:00:00Z"}, "end": []string{"2024-01-15T12:00:00Z"}, "step": []string{"1d"}},
+			expParams: url.Values{"start": []string{"1704837600"}, "end": []string{"1705269600"}, "step": []string{"1d"}},
+		},
+		{
+			name:      "weeks in the default time zone",
+			tenants:   []string{"ns2"},
+			params:    url.Values{"start": []string{"2024-01-10T12:00:00Z"}, "end": []string{"2024-02-01T00:00:00Z"}, "step": []string{"1w"}},
+			expParams: url.Values{"start": []string{"1704672000"}, "end": []string{"1706486400"}, "step": []string{"1w"}},
+		},
+		{
+			name:      "several tenants",
+			tenants:   []string{"ns1", "ns2"},
+			params:    url.Values{"start": []string{"2024-01-10T12:00:00Z"}, "end": []string{"2024-01-15T12:00:00Z"}, "step": []string{"86400"}},
+			expParams: url.Values{"start": []string{"1704844800"}, "end": []string{"1705276800"}, "step": []string{"86400"}},
+		},
+		{
+			name:      "already snapped",
+			tenants:   []string{"ns2"},
+			params:    url.Values{"start": []string{"1704844800"}, "end": []string{"1705017600"}, "step": []string{"1d"}},
+			expParams: url.Values{"start": []string{"1704844800"}, "end": []string{"1705017600"}, "step": []string{"1d"}},
+		},
+		{
+			name:      "hourly step",
+			tenants:   []string{"ns1"},
+			params:    url.Values{"start": []string{"2024-01-10T12:30:00Z"}, "end": []string{"2024-01-15T12:00:00Z"}, "step": []string{"1h"}},
+			expParams: url.Values{"start": []string{"2024-01-10T12:30:00Z"}, "end": []string{"2024-01-15T12:00:00Z"}, "step": []string{"1h"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := url.Values{"query": []string{"up"}, proxyLabel: tc.tenants}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if !reflect.DeepEqual(got, tc.expParams) {
+				t.Fatalf("expected parameters %v, got %v", tc.expParams, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// UpstreamFlavor is the implementation of the upstream API.
+type UpstreamFlavor string
+
+const (
+	FlavorUnknown         UpstreamFlavor = "unknown"
+	FlavorPrometheus      UpstreamFlavor = "prometheus"
+	FlavorThanos          UpstreamFlavor = "thanos"
+	FlavorMimir           UpstreamFlavor = "mimir"
+	FlavorVictoriaMetrics UpstreamFlavor = "victoriametrics"
+)
+
+// UpstreamCapabilities are the APIs and query options supported by the
+// upstream.
+type UpstreamCapabilities struct {
+	Flavor  UpstreamFlavor
+	Version string
+	// Exemplars is true if the /api/v1/query_exemplars API is supported.
+	Exemplars bool
+	// Federation is true if the /federate endpoint is supported.
+	Federation bool
+	// ThanosParams is true if the Thanos query options (e.g. dedup,
+	// partial_response and max_source_resolution) are supported.
+	ThanosParams bool
+}
+
+// flavorCapabilities are the capabilities of the known flavors. Everything
+// is assumed to be supported by an unknown upstream.
+var flavorCapabilities = map[UpstreamFlavor]UpstreamCapabilities{
+	FlavorUnknown:         {Exemplars: true, Federation: true, ThanosParams: true},
+	FlavorPrometheus:      {Exemplars: true, Federation: true},
+	FlavorThanos:          {Exemplars: true, ThanosParams: true},
+	FlavorMimir:           {Exemplars: true},
+	FlavorVictoriaMetrics: {Federation: true},
+}
+
+// unsupportedThanosParams are the parameters removed from the requests when
+// the upstream doesn't support the Thanos query options.
+var unsupportedThanosParams = append([]string{"storeMatch[]"}, thanosParams...)
+
+// UpstreamDetector detects the flavor of the upstream from its
+// /api/v1/status/buildinfo and /api/v1/status/flags endpoints:
+//   - Mimir reports its name as the application of the build information.
+//   - VictoriaMetrics mentions its name in the version or the application.
+//   - Thanos exposes the query.replica-label flag or a 0.x version.
+//   - Prometheus exposes the storage.tsdb.path or storage.agent.path flag.
+//
+// The detection runs at startup and periodically with Run(). Until the
+// first successful detection, the upstream is assumed to support all the
+// APIs and options.
+type UpstreamDetector struct {
+	upstream *url.URL
+	client   *http.Client
+	logger   *log.Logger
+
+	mtx  sync.RWMutex
+	caps UpstreamCapabilities
+
+	info    *prometheus.GaugeVec
+	dropped *prometheus.CounterVec
+}
+
+// NewUpstreamDetector returns a new UpstreamDetector for the given upstream.
+func NewUpstreamDetector(upstream *url.URL, client *http.Client, reg prometheus.Registerer) *UpstreamDetector {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	caps := flavorCapabilities[FlavorUnknown]
+	caps.Flavor = FlavorUnknown
+
+	return &UpstreamDetector{
+		upstream: upstream,
+		client:   client,
+		logger:   log.Default(),
+		caps:     caps,
+		info: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "upstream_info",
+			Help: "Flavor and version of the upstream as detected from its build information. The value is always 1.",
+		}, []string{"flavor", "version"}),
+		dropped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_unsupported_params_removed_total",
+			Help: "Total number of request parameters removed because the upstream doesn't support them, partitioned by parameter.",
+		}, []string{"param"}),
+	}
+}
+
+// WithUpstreamDetector adapts the proxy to the capabilities of the upstream:
+// the APIs which aren't supported (e.g. /federate for Thanos and Mimir)
+// return "404 Not Found" and the unsupported Thanos query options are
+// removed from the requests instead of being forwarded.
+func WithUpstreamDetector(d *UpstreamDetector) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamDetector = d
+	})
+}
+
+// Capabilities returns the last detected capabilities of the upstream.
+func (d *UpstreamDetector) Capabilities() UpstreamCapabilities {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+
+	return d.caps
+}
+
+// Run detects the capabilities of the upstream at the given interval until
+// the context is canceled.
+func (d *UpstreamDetector) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := d.Refresh(ctx); err != nil {
+			d.logger.Printf("failed to detect the upstream capabilities: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Refresh detects the capabilities of the upstream. The previous
+// capabilities are kept if the build information can't be fetched.
+func (d *UpstreamDetector) Refresh(ctx context.Context) error {
+	var bi struct {
+		Version     string `json:"version"`
+		Application string `json:"application"`
+	}
+	if err := d.get(ctx, "/api/v1/status/buildinfo", &bi); err != nil {
+		return fmt.Errorf("failed to fetch the build information: %w", err)
+	}
+
+	// Not all the upstreams implement the flags endpoint.
+	var flags map[string]string
+	_ = d.get(ctx, "/api/v1/status/flags", &flags)
+
+	flavor := detectFlavor(bi.Version, bi.Application, flags)
+	caps := flavorCapabilities[flavor]
+	caps.Flavor = flavor
+	caps.Version = bi.Version
+
+	d.mtx.Lock()
+	prev := d.caps
+	d.caps = caps
+	d.mtx.Unlock()
+
+	if prev.Flavor != caps.Flavor || prev.Version != caps.Version {
+		d.logger.Printf("detected upstream %s %s", caps.Flavor, caps.Version)
+		d.info.Reset()
+		d.info.WithLabelValues(string(caps.Flavor), caps.Version).Set(1)
+	}
+
+	return nil
+}
+
+func (d *UpstreamDetector) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.upstream.JoinPath(path).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	apir, err := getAPIResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(apir.Data, v); err != nil {
+		return fmt.Errorf("can't decode %s data: %w", path, err)
+	}
+
+	return nil
+}
+
+func detectFlavor(version, application string, flags map[string]string) UpstreamFlavor {
+	has := func(name string) bool {
+		_, found := flags[name]
+		return found
+	}
+
+	switch {
+	case strings.Contains(strings.ToLower(application), "mimir"):
+		return FlavorMimir
+	case strings.Contains(strings.ToLower(version+" "+application), "victoria"):
+		return FlavorVictoriaMetrics
+	case has("query.replica-label") || strings.HasPrefix(version, "0."):
+		return FlavorThanos
+	case has("storage.tsdb.path") || has("storage.agent.path"):
+		return FlavorPrometheus
+	}
+
+	return FlavorUnknown
+}
+
+// requireCapability returns "404 Not Found" when the upstream doesn't
+// support the API.
+func (r *routes) requireCapability(supported func(UpstreamCapabilities) bool, next http.HandlerFunc) http.HandlerFunc {
+	if r.upstreamDetector == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if caps := r.upstreamDetector.Capabilities(); !supported(caps) {
+			rejectRequest(w, ReasonUnsupportedAPI, fmt.Sprintf("the %s API isn't supported by the upstream (%s)", req.URL.Path, caps.Flavor), http.StatusNotFound)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// removeUnsupportedParams removes the query options not supported by the
+// upstream before calling the next handler.
+func (r *routes) removeUnsupportedParams(next http.HandlerFunc) http.HandlerFunc {
+	if r.upstreamDetector == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.upstreamDetector.Capabilities().ThanosParams {
+			next(w, req)
+			return
+		}
+
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, name := range unsupportedThanosParams {
+			if req.Form.Has(name) {
+				delParam(req, name)
+				r.upstreamDetector.dropped.WithLabelValues(name).Inc()
+			}
+		}
+
+		next(w, req)
+	}
+}
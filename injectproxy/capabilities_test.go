@@ -0,0 +1,203 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDetectFlavor(t *testing.T) {
+	for _, tc := range []struct {
+		version     string
+		application string
+		flags       map[string]string
+
+		exp UpstreamFlavor
+	}{
+		{
+			version: "2.53.0",
+			flags:   map[string]string{"storage.tsdb.path": "data/"},
+			exp:     FlavorPrometheus,
+		},
+		{
+			version: "2.53.0",
+			flags:   map[string]string{"storage.agent.path": "data-agent/"},
+			exp:     FlavorPrometheus,
+		},
+		{
+			version: "0.35.1",
+			exp:     FlavorThanos,
+		},
+		{
+			version: "v0.35.1",
+			flags:   map[string]string{"query.replica-label": "replica"},
+			exp:     FlavorThanos,
+		},
+		{
+			version:     "2.13.0",
+			application: "Grafana Mimir",
+			exp:         FlavorMimir,
+		},
+		{
+			version: "victoria-metrics-20240101-000000-tags-v1.97.0-0-g0000000",
+			exp:     FlavorVictoriaMetrics,
+		},
+		{
+			version: "2.24.0",
+			exp:     FlavorUnknown,
+		},
+	} {
+		t.Run(tc.version+tc.application, func(t *testing.T) {
+			if got := detectFlavor(tc.version, tc.application, tc.flags); got != tc.exp {
+				t.Fatalf("expected flavor %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamDetector(t *testing.T) {
+	var (
+		mtx       sync.Mutex
+		buildinfo = `{"status":"success","data":{"version":"2.53.0"}}`
+		params    url.Values
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		switch req.URL.Path {
+		case "/api/v1/status/buildinfo":
+			w.Write([]byte(buildinfo))
+		case "/api/v1/status/flags":
+			w.Write([]byte(`{"status":"success","data":{"storage.tsdb.path":"data/"}}`))
+		default:
+			_ = req.ParseForm()
+			params = req.Form
+			w.Write(okResponse)
+		}
+	}))
+	defer m.Close()
+
+	d := NewUpstreamDetector(m.url, nil, prometheus.NewRegistry())
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithUpstreamDetector(d),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		buildinfo string
+		path      string
+
+		expFlavor UpstreamFlavor
+		expCode   int
+		expDedup  bool
+	}{
+		{
+			name:     "before the detection",
+			path:     "/api/v1/query",
+			expCode:  http.StatusOK,
+			expDedup: true,
+		},
+		{
+			name:      "prometheus removes the thanos options",
+			buildinfo: `{"status":"success","data":{"version":"2.53.0"}}`,
+			path:      "/api/v1/query",
+			expFlavor: FlavorPrometheus,
+			expCode:   http.StatusOK,
+		},
+		{
+			name:      "prometheus supports the exemplars",
+			buildinfo: `{"status":"success","data":{"version":"2.53.0"}}`,
+			path:      "/api/v1/query_exemplars",
+			expFlavor: FlavorPrometheus,
+			expCode:   http.StatusOK,
+		},
+		{
+			name:      "thanos forwards the thanos options",
+			buildinfo: `{"status":"success","data":{"version":"0.35.1"}}`,
+			path:      "/api/v1/series",
+			expFlavor: FlavorThanos,
+			expCode:   http.StatusOK,
+			expDedup:  true,
+		},
+		{
+			name:      "thanos doesn't support the federation",
+			buildinfo: `{"status":"success","data":{"version":"0.35.1"}}`,
+			path:      "/federate",
+			expFlavor: FlavorThanos,
+			expCode:   http.StatusNotFound,
+		},
+		{
+			name:      "victoriametrics doesn't support the exemplars",
+			buildinfo: `{"status":"success","data":{"version":"victoria-metrics-v1.97.0"}}`,
+			path:      "/api/v1/query_exemplars",
+			expFlavor: FlavorVictoriaMetrics,
+			expCode:   http.StatusNotFound,
+		},
+		{
+			name:      "failed detection keeps the previous flavor",
+			buildinfo: `{"status":"error"}`,
+			path:      "/federate",
+			expFlavor: FlavorVictoriaMetrics,
+			expCode:   http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.buildinfo != "" {
+				mtx.Lock()
+				buildinfo = tc.buildinfo
+				mtx.Unlock()
+
+				_ = d.Refresh(context.Background())
+				if got := d.Capabilities().Flavor; got != tc.expFlavor {
+					t.Fatalf("expected flavor %q, got %q", tc.expFlavor, got)
+				}
+			}
+
+			params = nil
+			q := url.Values{
+				"query":    []string{"up"},
+				"match[]":  []string{"up"},
+				"dedup":    []string{"true"},
+				proxyLabel: []string{"ns1"},
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+q.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := params.Has("dedup"); got != tc.expDedup {
+				t.Fatalf("expected dedup forwarded %v, got %v", tc.expDedup, got)
+			}
+		})
+	}
+}
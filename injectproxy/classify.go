@@ -0,0 +1,191 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// WithQueryClassificationCache keeps the classification of the last
+// maxEntries query expressions in memory: the selectors of the expression
+// (used by the authorizer) and the result of the label enforcement for each
+// label matcher. The entries are keyed by the raw expression so that
+// dashboards and rulers sending the same expression over and over don't pay
+// for parsing and enforcing it every time.
+func WithQueryClassificationCache(maxEntries int) Option {
+	return optionFunc(func(o *options) {
+		o.classificationCacheSize = maxEntries
+	})
+}
+
+// queryClass holds the metadata of a query expression.
+type queryClass struct {
+	// selectors are the formatted selectors of the expression.
+	selectors []string
+	// err is the parse error, if any.
+	err error
+}
+
+// enforcedQuery holds the result of the label enforcement.
+type enforcedQuery struct {
+	query string
+	err   error
+}
+
+type classificationEntry struct {
+	key   string
+	value interface{}
+}
+
+// queryClassifier is an LRU cache of the query classifications. A nil
+// classifier computes the classifications without caching them.
+type queryClassifier struct {
+	maxEntries int
+
+	mtx     sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+
+	requests *prometheus.CounterVec
+}
+
+func newQueryClassifier(maxEntries int, reg prometheus.Registerer) (*queryClassifier, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("the size of the classification cache must be positive, got %d", maxEntries)
+	}
+
+	c := &queryClassifier{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    map[string]*list.Element{},
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_classification_cache_requests_total",
+			Help: "Total number of lookups in the query classification cache, partitioned by kind (classify or enforce) and result (hit or miss).",
+		}, []string{"kind", "result"}),
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "query_classification_cache_entries",
+		Help: "Number of entries in the query classification cache.",
+	}, func() float64 {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		return float64(c.ll.Len())
+	})
+
+	return c, nil
+}
+
+func (c *queryClassifier) get(kind, key string) (interface{}, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, found := c.entries[key]
+	if !found {
+		c.requests.WithLabelValues(kind, "miss").Inc()
+		return nil, false
+	}
+
+	c.requests.WithLabelValues(kind, "hit").Inc()
+	c.ll.MoveToFront(e)
+	return e.Value.(*classificationEntry).value, true
+}
+
+func (c *queryClassifier) set(key string, v interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, found := c.entries[key]; found {
+		e.Value.(*classificationEntry).value = v
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&classificationEntry{key: key, value: v})
+	for c.ll.Len() > c.maxEntries {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.entries, e.Value.(*classificationEntry).key)
+	}
+}
+
+// classify returns the metadata of the query expression.
+func (c *queryClassifier) classify(q string) *queryClass {
+	if c == nil {
+		return classifyQuery(q)
+	}
+
+	key := "classify\x00" + q
+	if v, found := c.get("classify", key); found {
+		return v.(*queryClass)
+	}
+
+	qc := classifyQuery(q)
+	c.set(key, qc)
+	return qc
+}
+
+// enforce returns the query expression with the label matchers enforced.
+func (c *queryClassifier) enforce(e *PromQLEnforcer, q string) (string, error) {
+	if c == nil {
+		return e.Enforce(q)
+	}
+
+	key := "enforce\x00" + e.key() + "\x00" + q
+	if v, found := c.get("enforce", key); found {
+		eq := v.(*enforcedQuery)
+		return eq.query, eq.err
+	}
+
+	enforced, err := e.Enforce(q)
+	c.set(key, &enforcedQuery{query: enforced, err: err})
+	return enforced, err
+}
+
+func classifyQuery(q string) *queryClass {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return &queryClass{err: fmt.Errorf("%w: %w", ErrQueryParse, err)}
+	}
+
+	qc := &queryClass{}
+	for _, ms := range parser.ExtractSelectors(expr) {
+		qc.selectors = append(qc.selectors, matchersToString(ms...))
+	}
+
+	return qc
+}
+
+// key returns a string identifying the label matchers of the enforcer.
+func (ms *PromQLEnforcer) key() string {
+	matchers := make([]string, 0, len(ms.labelMatchers))
+	for _, m := range ms.labelMatchers {
+		matchers = append(matchers, m.String())
+	}
+	sort.Strings(matchers)
+
+	key := fmt.Sprintf("%t\x00%s", ms.errorOnReplace, strings.Join(matchers, "\x00"))
+	if ms.postAggregation != nil {
+		key += "\x00" + ms.postAggregation.key()
+	}
+
+	return key
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestQueryClassifier(t *testing.T) {
+	c, err := newQueryClassifier(2, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	qc := c.classify(`sum(rate(foo{job="a"}[5m])) / sum(bar)`)
+	if qc.err != nil {
+		t.Fatalf("unexpected error: %v", qc.err)
+	}
+	if exp := []string{`{job="a",__name__="foo"}`, `{__name__="bar"}`}; !reflect.DeepEqual(qc.selectors, exp) {
+		t.Fatalf("expected selectors %v, got %v", exp, qc.selectors)
+	}
+	if got := c.classify(`sum(rate(foo{job="a"}[5m])) / sum(bar)`); got != qc {
+		t.Fatal("expected the cached classification")
+	}
+
+	if qc := c.classify("sum("); !errors.Is(qc.err, ErrQueryParse) {
+		t.Fatalf("expected parse error, got %v", qc.err)
+	}
+
+	e1 := NewPromQLEnforcer(false, &labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "ns1"})
+	e2 := NewPromQLEnforcer(false, &labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "ns2"})
+	for i := 0; i < 2; i++ {
+		for e, exp := range map[*PromQLEnforcer]string{e1: `up{namespace="ns1"}`, e2: `up{namespace="ns2"}`} {
+			got, err := c.enforce(e, "up")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != exp {
+				t.Fatalf("expected %q, got %q", exp, got)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		kind, result string
+		exp          float64
+	}{
+		{kind: "classify", result: "hit", exp: 1},
+		{kind: "classify", result: "miss", exp: 2},
+		{kind: "enforce", result: "hit", exp: 2},
+		{kind: "enforce", result: "miss", exp: 2},
+	} {
+		if got := testutil.ToFloat64(c.requests.WithLabelValues(tc.kind, tc.result)); got != tc.exp {
+			t.Fatalf("%s/%s: expected %v, got %v", tc.kind, tc.result, tc.exp, got)
+		}
+	}
+
+	// The least recently used entries are evicted.
+	if n := c.ll.Len(); n != 2 {
+		t.Fatalf("expected 2 entries, got %d", n)
+	}
+	if _, found := c.entries["classify\x00sum("]; found {
+		t.Fatal("expected the entry to be evicted")
+	}
+
+	if _, err := newQueryClassifier(0, prometheus.NewRegistry()); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestQueryClassificationCacheRoutes(t *testing.T) {
+	var got []string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = append(got, req.URL.Query().Get("query"))
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryClassificationCache(10),
+		WithPrometheusRegistry(prometheus.NewRegistry()),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, ns := range []string{"ns1", "ns1", "ns2"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{"query": []string{"up"}, proxyLabel: []string{ns}}.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	if exp := []string{`up{namespace="ns1"}`, `up{namespace="ns1"}`, `up{namespace="ns2"}`}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected queries %v, got %v", exp, got)
+	}
+	if hits := testutil.ToFloat64(r.classifier.requests.WithLabelValues("enforce", "hit")); hits != 1 {
+		t.Fatalf("expected 1 hit, got %v", hits)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{"query": []string{"up{"}, proxyLabel: []string{"ns1"}}.Encode(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func BenchmarkQueryClassifierEnforce(b *testing.B) {
+	const query = `sum by (job) (rate(http_requests_total{code=~"5.."}[5m])) / sum by (job) (rate(http_requests_total[5m]))`
+	e := NewPromQLEnforcer(false, &labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "ns1"})
+
+	b.Run("uncached", func(b *testing.B) {
+		var c *queryClassifier
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.enforce(e, query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		c, err := newQueryClassifier(100, prometheus.NewRegistry())
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.enforce(e, query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
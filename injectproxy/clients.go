@@ -0,0 +1,167 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// defaultMaxClients is the default number of distinct client values
+	// identified from the configured headers.
+	defaultMaxClients = 20
+	// maxClientLength is the maximum length of a client value identified
+	// from the configured headers.
+	maxClientLength = 64
+)
+
+// ClientFingerprint configures how the clients are identified.
+type ClientFingerprint struct {
+	// Headers are looked up in order before the User-Agent header. The first
+	// non-empty value identifies the client (e.g. X-Client-Name).
+	Headers []string
+	// MaxClients bounds the number of distinct values identified from the
+	// headers. The clients beyond the limit are reported as "other". If
+	// zero, defaultMaxClients is used.
+	MaxClients int
+}
+
+// WithClientFingerprint counts the requests per client type. The client is
+// identified from the configured headers or else from the User-Agent header
+// which is normalized to a known family (e.g. grafana, prometheus, curl,
+// python-requests).
+func WithClientFingerprint(c ClientFingerprint) Option {
+	return optionFunc(func(o *options) {
+		o.clientFingerprint = &c
+	})
+}
+
+// userAgents maps the User-Agent prefixes (lower case) to the client
+// families. The first match wins.
+var userAgents = []struct {
+	prefix string
+	client string
+}{
+	{prefix: "grafana", client: "grafana"},
+	{prefix: "prometheus/", client: "prometheus"},
+	{prefix: "thanos", client: "thanos"},
+	{prefix: "curl/", client: "curl"},
+	{prefix: "wget/", client: "wget"},
+	{prefix: "python-requests/", client: "python-requests"},
+	{prefix: "python-urllib", client: "python-urllib"},
+	{prefix: "go-http-client/", client: "go-http-client"},
+	{prefix: "mozilla/", client: "browser"},
+}
+
+// normalizeUserAgent returns the client family of the User-Agent.
+func normalizeUserAgent(ua string) string {
+	ua = strings.ToLower(strings.TrimSpace(ua))
+	if ua == "" {
+		return "unknown"
+	}
+
+	if strings.Contains(ua, "ruler") {
+		return "ruler"
+	}
+
+	for _, a := range userAgents {
+		if strings.HasPrefix(ua, a.prefix) {
+			return a.client
+		}
+	}
+
+	return "other"
+}
+
+// clientIdentifier identifies the clients with a bounded number of values.
+type clientIdentifier struct {
+	headers    []string
+	maxClients int
+
+	mtx   sync.Mutex
+	known map[string]struct{}
+}
+
+func newClientIdentifier(c ClientFingerprint) *clientIdentifier {
+	if c.MaxClients <= 0 {
+		c.MaxClients = defaultMaxClients
+	}
+
+	return &clientIdentifier{
+		headers:    c.Headers,
+		maxClients: c.MaxClients,
+		known:      map[string]struct{}{},
+	}
+}
+
+func (c *clientIdentifier) identify(req *http.Request) string {
+	for _, h := range c.headers {
+		v := strings.ToLower(strings.TrimSpace(req.Header.Get(h)))
+		if v == "" {
+			continue
+		}
+
+		if len(v) > maxClientLength {
+			v = v[:maxClientLength]
+		}
+
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if _, found := c.known[v]; !found {
+			if len(c.known) >= c.maxClients {
+				return "other"
+			}
+			c.known[v] = struct{}{}
+		}
+
+		return v
+	}
+
+	return normalizeUserAgent(req.UserAgent())
+}
+
+// clientMux wraps a mux and counts the requests per client.
+type clientMux struct {
+	mux
+	clients  *clientIdentifier
+	requests *prometheus.CounterVec
+}
+
+func newClientMux(m mux, r prometheus.Registerer, c ClientFingerprint) *clientMux {
+	return &clientMux{
+		mux:     m,
+		clients: newClientIdentifier(c),
+		requests: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Name: "http_client_requests_total",
+			Help: "Total number of requests partitioned by handler, client and status code class (e.g. 2xx, 5xx).",
+		}, []string{"handler", "client", "code"}),
+	}
+}
+
+// Handle implements the mux interface.
+func (c *clientMux) Handle(pattern string, handler http.Handler) {
+	c.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := newStatusRecorder(w)
+
+		handler.ServeHTTP(rec, req)
+
+		c.requests.WithLabelValues(pattern, c.clients.identify(req), strconv.Itoa(rec.status/100)+"xx").Inc()
+	}))
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNormalizeUserAgent(t *testing.T) {
+	for ua, exp := range map[string]string{
+		"":                                  "unknown",
+		"Grafana/10.4.1":                    "grafana",
+		"Prometheus/2.53.0":                 "prometheus",
+		"Thanos/0.35.1 (go1.22.2)":          "thanos",
+		"curl/8.5.0":                        "curl",
+		"python-requests/2.31.0":            "python-requests",
+		"Go-http-client/1.1":                "go-http-client",
+		"Mozilla/5.0 (X11; Linux x86_64)":   "browser",
+		"loki-ruler/2.9":                    "ruler",
+		"my-custom-script/0.1 (+https://x)": "other",
+	} {
+		if got := normalizeUserAgent(ua); got != exp {
+			t.Errorf("%q: expected %q, got %q", ua, exp, got)
+		}
+	}
+}
+
+func TestClientMux(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newClientMux(http.NewServeMux(), reg, ClientFingerprint{Headers: []string{"X-Client-Name"}, MaxClients: 1})
+
+	m.Handle("/api/v1/query", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	for _, tc := range []struct {
+		url     string
+		headers map[string]string
+	}{
+		{url: "/api/v1/query", headers: map[string]string{"User-Agent": "Grafana/10.4.1"}},
+		{url: "/api/v1/query?fail=1", headers: map[string]string{"User-Agent": "Grafana/10.4.1"}},
+		{url: "/api/v1/query", headers: map[string]string{"User-Agent": "curl/8.5.0"}},
+		{url: "/api/v1/query", headers: map[string]string{"User-Agent": "curl/8.5.0", "X-Client-Name": "Billing"}},
+		// The number of clients identified from the headers is bounded.
+		{url: "/api/v1/query", headers: map[string]string{"X-Client-Name": "reporting"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.Header.Del("User-Agent")
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		m.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_client_requests_total Total number of requests partitioned by handler, client and status code class (e.g. 2xx, 5xx).
+# TYPE http_client_requests_total counter
+http_client_requests_total{client="billing",code="2xx",handler="/api/v1/query"} 1
+http_client_requests_total{client="curl",code="2xx",handler="/api/v1/query"} 1
+http_client_requests_total{client="grafana",code="2xx",handler="/api/v1/query"} 1
+http_client_requests_total{client="grafana",code="5xx",handler="/api/v1/query"} 1
+http_client_requests_total{client="other",code="2xx",handler="/api/v1/query"} 1
+`)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WithQueryCoalescing shares a single upstream request among the identical
+// instant and range queries received concurrently (same tenants, expression,
+// time range and step). Dashboards with many identical panels or viewed by
+// many users at once send such queries all the time.
+//
+// Unlike the response cache, the responses aren't kept once the upstream
+// request completes.
+func WithQueryCoalescing() Option {
+	return optionFunc(func(o *options) {
+		o.queryCoalescing = true
+	})
+}
+
+// inflightQuery is a query being executed on behalf of several requests.
+type inflightQuery struct {
+	done chan struct{}
+	// resp is nil when the response can't be shared (e.g. the client of
+	// the first request went away).
+	resp *cachedResponse
+	// followers is the number of requests waiting for the response.
+	followers int
+}
+
+type queryCoalescer struct {
+	mtx      sync.Mutex
+	inflight map[string]*inflightQuery
+
+	requests *prometheus.CounterVec
+}
+
+func newQueryCoalescer(reg prometheus.Registerer) *queryCoalescer {
+	return &queryCoalescer{
+		inflight: map[string]*inflightQuery{},
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_coalescing_requests_total",
+			Help: "Total number of queries eligible to coalescing, partitioned by handler and result (leader when the query is sent upstream, follower when it waits for an identical query).",
+		}, []string{"handler", "result"}),
+	}
+}
+
+// join returns the in-flight query for the key and whether the caller is the
+// leader which must execute it.
+func (c *queryCoalescer) join(key string) (*inflightQuery, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if q, found := c.inflight[key]; found {
+		q.followers++
+		return q, false
+	}
+
+	q := &inflightQuery{done: make(chan struct{})}
+	c.inflight[key] = q
+	return q, true
+}
+
+// finish releases the followers of the in-flight query.
+func (c *queryCoalescer) finish(key string, q *inflightQuery, resp *cachedResponse) {
+	c.mtx.Lock()
+	delete(c.inflight, key)
+	c.mtx.Unlock()
+
+	q.resp = resp
+	close(q.done)
+}
+
+// coalesceQueries executes the identical concurrent queries once and
+// broadcasts the response to all the requests.
+func (r *routes) coalesceQueries(next http.HandlerFunc) http.HandlerFunc {
+	if r.coalescer == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		handler := handlerName(req.Context())
+		switch handler {
+		case "/api/v1/query", "/api/v1/query_range":
+		default:
+			next(w, req)
+			return
+		}
+
+		body, ok := r.bufferRequestBody(w, req)
+		if !ok {
+			return
+		}
+		if body != nil {
+			defer body.Close()
+		}
+
+		key, err := cacheKey(req, body)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		q, leader := r.coalescer.join(key)
+		if !leader {
+			select {
+			case <-q.done:
+			case <-req.Context().Done():
+				return
+			}
+
+			if q.resp == nil {
+				// Execute the query on its own.
+				next(w, req)
+				return
+			}
+
+			r.coalescer.requests.WithLabelValues(handler, "follower").Inc()
+			for k, v := range q.resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(q.resp.Status)
+			_, _ = w.Write(q.resp.Body)
+			return
+		}
+		r.coalescer.requests.WithLabelValues(handler, "leader").Inc()
+
+		var resp *cachedResponse
+		defer func() {
+			r.coalescer.finish(key, q, resp)
+		}()
+
+		rec := &cacheRecorder{statusRecorder: newStatusRecorder(w)}
+		next(rec, req)
+
+		if req.Context().Err() != nil {
+			// The response may be truncated.
+			return
+		}
+
+		resp = &cachedResponse{
+			Status: rec.status,
+			Header: w.Header().Clone(),
+			Body:   rec.buf.Bytes(),
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryCoalescing(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		calls   int
+		release = make(chan struct{})
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		calls++
+		mtx.Unlock()
+
+		<-release
+		w.Header().Set("X-Upstream", "1")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryCoalescing(),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	requests := []func() *http.Request{
+		func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&time=1700000000&namespace=ns1", nil)
+		},
+		// Same query with another formatting.
+		func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up%20&time=2023-11-14T22:13:20Z&namespace=ns1", nil)
+		},
+		func() *http.Request {
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query", strings.NewReader("query=up&time=1700000000&namespace=ns1"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req
+		},
+	}
+
+	var (
+		wg   sync.WaitGroup
+		recs = make([]*httptest.ResponseRecorder, len(requests))
+	)
+	for i, newReq := range requests {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder, req *http.Request) {
+			defer wg.Done()
+			r.ServeHTTP(w, req)
+		}(recs[i], newReq())
+
+		// Wait for the request to be in flight.
+		deadline := time.Now().Add(time.Second)
+		for {
+			r.coalescer.mtx.Lock()
+			var n int
+			for _, q := range r.coalescer.inflight {
+				n += 1 + q.followers
+			}
+			r.coalescer.mtx.Unlock()
+			if n == i+1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d in-flight requests, got %d", i+1, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A query for another tenant isn't coalesced.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&time=1700000000&namespace=ns2", nil))
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		mtx.Lock()
+		n := calls
+		mtx.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 upstream calls, got %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	for i, w := range recs {
+		if w.Code != http.StatusOK {
+			t.Fatalf("%d: expected status code %d, got %d", i, http.StatusOK, w.Code)
+		}
+		if w.Body.String() != string(okResponse) {
+			t.Fatalf("%d: expected body %q, got %q", i, okResponse, w.Body.String())
+		}
+		if got := w.Header().Get("X-Upstream"); got != "1" {
+			t.Fatalf("%d: expected upstream header, got %q", i, got)
+		}
+	}
+
+	if got := testutil.ToFloat64(r.coalescer.requests.WithLabelValues("/api/v1/query", "follower")); got != 2 {
+		t.Fatalf("expected 2 followers, got %v", got)
+	}
+	if len(r.coalescer.inflight) != 0 {
+		t.Fatalf("expected no in-flight query, got %d", len(r.coalescer.inflight))
+	}
+}
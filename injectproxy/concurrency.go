@@ -0,0 +1,134 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ConcurrencyLimit is a static limit of the number of requests served
+// concurrently by the proxy. Contrary to the latency budgets (see
+// WithLatencyBudgets), the limit doesn't adapt to the upstream latency.
+type ConcurrencyLimit struct {
+	// MaxInflight is the maximum number of requests served concurrently.
+	MaxInflight int
+	// MaxWait is how long a request waits for a slot when the limit is
+	// reached. Zero rejects the request immediately.
+	MaxWait time.Duration
+}
+
+// WithConcurrencyLimit limits the number of requests served concurrently.
+// The requests which don't get a slot within the maximum wait are rejected
+// with "503 Service Unavailable".
+func WithConcurrencyLimit(l ConcurrencyLimit) Option {
+	return optionFunc(func(o *options) {
+		o.concurrencyLimit = &l
+	})
+}
+
+type concurrencyLimiter struct {
+	maxWait time.Duration
+	slots   chan struct{}
+
+	inflight prometheus.Gauge
+	waiting  prometheus.Gauge
+	rejected prometheus.Counter
+}
+
+func newConcurrencyLimiter(l ConcurrencyLimit, reg prometheus.Registerer) (*concurrencyLimiter, error) {
+	if l.MaxInflight <= 0 {
+		return nil, fmt.Errorf("the maximum number of in-flight requests must be positive, got %d", l.MaxInflight)
+	}
+
+	if l.MaxWait < 0 {
+		return nil, fmt.Errorf("the maximum wait must not be negative, got %s", l.MaxWait)
+	}
+
+	return &concurrencyLimiter{
+		maxWait: l.MaxWait,
+		slots:   make(chan struct{}, l.MaxInflight),
+		inflight: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "concurrency_limit_inflight_requests",
+			Help: "Current number of requests holding a slot of the concurrency limit.",
+		}),
+		waiting: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "concurrency_limit_waiting_requests",
+			Help: "Current number of requests waiting for a slot of the concurrency limit.",
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "concurrency_limit_rejected_requests_total",
+			Help: "Total number of requests rejected because no slot of the concurrency limit was available within the maximum wait.",
+		}),
+	}, nil
+}
+
+// acquire reserves a slot, waiting up to the maximum wait. It returns false
+// if no slot was available in time or if the context is done.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.inflight.Inc()
+		return true
+	default:
+	}
+
+	if l.maxWait <= 0 {
+		return false
+	}
+
+	l.waiting.Inc()
+	defer l.waiting.Dec()
+
+	t := time.NewTimer(l.maxWait)
+	defer t.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		l.inflight.Inc()
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	l.inflight.Dec()
+	<-l.slots
+}
+
+// limitConcurrency rejects the requests exceeding the concurrency limit.
+func (r *routes) limitConcurrency(next http.Handler) http.Handler {
+	if r.concurrencyLimiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.concurrencyLimiter.acquire(req.Context()) {
+			r.concurrencyLimiter.rejected.Inc()
+			rejectRequest(w, ReasonConcurrencyLimit, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer r.concurrencyLimiter.release()
+
+		next.ServeHTTP(w, req)
+	})
+}
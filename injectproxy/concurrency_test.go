@@ -0,0 +1,151 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConcurrencyLimiterAcquire(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		maxWait time.Duration
+		release bool
+		cancel  bool
+
+		expAcquired bool
+	}{
+		{
+			name: "no wait",
+		},
+		{
+			name:    "wait expired",
+			maxWait: 10 * time.Millisecond,
+		},
+		{
+			name:    "canceled",
+			maxWait: time.Minute,
+			cancel:  true,
+		},
+		{
+			name:        "slot released",
+			maxWait:     time.Minute,
+			release:     true,
+			expAcquired: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := newConcurrencyLimiter(ConcurrencyLimit{MaxInflight: 1, MaxWait: tc.maxWait}, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !l.acquire(context.Background()) {
+				t.Fatal("expected the first slot to be acquired")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if tc.release || tc.cancel {
+				go func() {
+					for testutil.ToFloat64(l.waiting) == 0 {
+						time.Sleep(time.Millisecond)
+					}
+					if tc.release {
+						l.release()
+					}
+					if tc.cancel {
+						cancel()
+					}
+				}()
+			}
+
+			if got := l.acquire(ctx); got != tc.expAcquired {
+				t.Fatalf("expected acquired %v, got %v", tc.expAcquired, got)
+			}
+		})
+	}
+
+	for _, cl := range []ConcurrencyLimit{
+		{},
+		{MaxInflight: 1, MaxWait: -time.Second},
+	} {
+		if _, err := newConcurrencyLimiter(cl, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", cl)
+		}
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		unblock = make(chan struct{})
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("query") == `slow{namespace="ns1"}` {
+			started <- struct{}{}
+			<-unblock
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithConcurrencyLimit(ConcurrencyLimit{MaxInflight: 1}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	do := func(query string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query="+query+"&namespace=ns1", nil))
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- do("slow") }()
+	<-started
+
+	if got := do("up"); got != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, got)
+	}
+
+	close(unblock)
+	if got := <-done; got != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, got)
+	}
+
+	if got := do("up"); got != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, got)
+	}
+
+	if got := testutil.ToFloat64(r.concurrencyLimiter.rejected); got != 1 {
+		t.Fatalf("expected 1 rejected request, got %v", got)
+	}
+	if got := testutil.ToFloat64(r.concurrencyLimiter.inflight); got != 0 {
+		t.Fatalf("expected no in-flight request, got %v", got)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// budgetWindowSize is the number of latency samples used to compute
+	// the rolling p99 latency.
+	budgetWindowSize = 100
+	// budgetEvalEvery is the number of samples between 2 adjustments of
+	// the concurrency limit.
+	budgetEvalEvery = 10
+
+	// gradientLongWindow is the number of adjustments over which the
+	// long-term latency of the gradient algorithm is averaged.
+	gradientLongWindow = 60
+	// gradientTolerance is the ratio between the short-term and long-term
+	// latencies tolerated before the gradient algorithm decreases the
+	// limit.
+	gradientTolerance = 1.5
+	// gradientSmoothing is the weight of a new limit estimate of the
+	// gradient algorithm.
+	gradientSmoothing = 0.2
+)
+
+// CongestionController computes the concurrency limit of a tenant for a
+// handler from the outcome of its requests. The latency budgets call the
+// methods of a controller sequentially, so the implementations don't need to
+// be safe for concurrent use, and they must not block.
+//
+// The limit may also be changed outside of the controller (e.g. by the slow
+// start, the cooldown or the throttled upstream responses): the controllers
+// receive the current limit with every outcome.
+type CongestionController interface {
+	// Acquire is called when a request takes a slot, with the number of
+	// in-flight requests including it.
+	Acquire(inflight int)
+	// Release is called when a request frees its slot, with the number
+	// of remaining in-flight requests, before OnSuccess or OnFailure.
+	Release(inflight int)
+	// OnSuccess is called with the latency of a request for which the
+	// upstream wasn't overloaded and the current limit.
+	OnSuccess(latency time.Duration, limit int) LimitAdjustment
+	// OnFailure is called with the latency of a request for which the
+	// upstream was overloaded (429, 503 and 504 status codes, timeouts
+	// and connection errors) and the current limit.
+	OnFailure(latency time.Duration, limit int) LimitAdjustment
+}
+
+// LimitAdjustment is the result of an evaluation of the concurrency limit by
+// a CongestionController.
+type LimitAdjustment struct {
+	// Adjusted is false if the limit wasn't evaluated (e.g. there aren't
+	// enough samples yet), in which case the other fields are ignored.
+	Adjusted bool
+	// Limit is the new limit. It is clamped to the concurrency bounds.
+	Limit int
+	// Overloaded tells that the upstream was overloaded, which ends the
+	// slow start even if the limit didn't decrease.
+	Overloaded bool
+}
+
+// CongestionControllerFactory creates the controller of a tenant (the label
+// values joined with commas) for a handler (e.g. "/api/v1/query_range").
+type CongestionControllerFactory func(tenant, handler string, bounds ConcurrencyBounds) CongestionController
+
+// controllerWindow holds the rolling window of latency samples of the built-in
+// controllers.
+type controllerWindow struct {
+	samples []time.Duration
+	// failures tells which samples are upstream overload errors.
+	failures []bool
+	next     int
+	count    int
+	// sum is the sum of the latencies since the last adjustment.
+	sum time.Duration
+	// limit is the last limit known by the controller. A lower limit
+	// means that it was decreased outside of the controller.
+	limit int
+}
+
+// record adds the sample to the window. It returns true if the limit must be
+// evaluated.
+func (w *controllerWindow) record(d time.Duration, failed bool, limit int) bool {
+	if limit < w.limit {
+		w.reset()
+	}
+	w.limit = limit
+
+	if len(w.samples) < budgetWindowSize {
+		w.samples = append(w.samples, d)
+		w.failures = append(w.failures, failed)
+	} else {
+		w.samples[w.next] = d
+		w.failures[w.next] = failed
+		w.next = (w.next + 1) % budgetWindowSize
+	}
+	w.count++
+	w.sum += d
+
+	return w.count%budgetEvalEvery == 0
+}
+
+// p99 returns the 99th percentile of the latency samples.
+func (w *controllerWindow) p99() time.Duration {
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[(len(sorted)*99-1)/100]
+}
+
+// errorRatio returns the ratio of upstream overload errors in the window.
+func (w *controllerWindow) errorRatio() float64 {
+	var n int
+	for _, failed := range w.failures {
+		if failed {
+			n++
+		}
+	}
+
+	return float64(n) / float64(len(w.failures))
+}
+
+// reset starts a new window to measure the effect of a new limit.
+func (w *controllerWindow) reset() {
+	w.samples = w.samples[:0]
+	w.failures = w.failures[:0]
+	w.next = 0
+}
+
+// adjusted ends the evaluation with the new limit.
+func (w *controllerWindow) adjusted(limit int, overloaded bool) LimitAdjustment {
+	w.sum = 0
+	w.limit = limit
+	if overloaded {
+		w.reset()
+	}
+
+	return LimitAdjustment{Adjusted: true, Limit: limit, Overloaded: overloaded}
+}
+
+// aimdController decreases the limit multiplicatively when the p99 latency
+// exceeds the budget and increases it additively otherwise.
+type aimdController struct {
+	controllerWindow
+	budget         time.Duration
+	bounds         ConcurrencyBounds
+	increaseStep   int
+	decreaseFactor float64
+	maxErrorRatio  float64
+}
+
+func (c *aimdController) Acquire(int) {}
+func (c *aimdController) Release(int) {}
+
+func (c *aimdController) OnSuccess(d time.Duration, limit int) LimitAdjustment {
+	return c.observe(d, false, limit)
+}
+
+func (c *aimdController) OnFailure(d time.Duration, limit int) LimitAdjustment {
+	return c.observe(d, true, limit)
+}
+
+func (c *aimdController) observe(d time.Duration, failed bool, limit int) LimitAdjustment {
+	if !c.record(d, failed, limit) {
+		return LimitAdjustment{}
+	}
+
+	if (c.maxErrorRatio > 0 && c.errorRatio() > c.maxErrorRatio) || c.p99() > c.budget {
+		return c.adjusted(max(c.bounds.Min, int(float64(limit)*c.decreaseFactor)), true)
+	}
+
+	return c.adjusted(min(c.bounds.Max, limit+c.increaseStep), false)
+}
+
+// gradientController scales the limit by the ratio between the long-term and
+// the short-term average latencies (between 0.5 and 1) and adds a headroom
+// of sqrt(limit) to probe for more capacity. The estimate is smoothed to
+// absorb the latency spikes.
+type gradientController struct {
+	controllerWindow
+	bounds         ConcurrencyBounds
+	decreaseFactor float64
+	maxErrorRatio  float64
+	// longRTT and estimate are the long-term average latency (in
+	// seconds) and the fractional limit.
+	longRTT  float64
+	estimate float64
+}
+
+func (c *gradientController) Acquire(int) {}
+func (c *gradientController) Release(int) {}
+
+func (c *gradientController) OnSuccess(d time.Duration, limit int) LimitAdjustment {
+	return c.observe(d, false, limit)
+}
+
+func (c *gradientController) OnFailure(d time.Duration, limit int) LimitAdjustment {
+	return c.observe(d, true, limit)
+}
+
+func (c *gradientController) observe(d time.Duration, failed bool, limit int) LimitAdjustment {
+	if !c.record(d, failed, limit) {
+		return LimitAdjustment{}
+	}
+
+	// The limit was changed outside of the controller.
+	if int(c.estimate) != limit {
+		c.estimate = float64(limit)
+	}
+
+	if c.maxErrorRatio > 0 && c.errorRatio() > c.maxErrorRatio {
+		limit = max(c.bounds.Min, int(float64(limit)*c.decreaseFactor))
+		c.estimate = float64(limit)
+		return c.adjusted(limit, true)
+	}
+
+	short := c.sum.Seconds() / budgetEvalEvery
+	if c.longRTT == 0 {
+		c.longRTT = short
+	} else {
+		c.longRTT += (short - c.longRTT) / gradientLongWindow
+	}
+
+	gradient := 1.0
+	if short > 0 {
+		// The latency has recovered: converge faster to the new
+		// baseline.
+		if c.longRTT/short > 2 {
+			c.longRTT *= 0.95
+		}
+		gradient = max(0.5, min(1, gradientTolerance*c.longRTT/short))
+	}
+
+	estimate := c.estimate*gradient + math.Sqrt(c.estimate)
+	c.estimate = c.estimate*(1-gradientSmoothing) + estimate*gradientSmoothing
+	c.estimate = max(float64(c.bounds.Min), min(float64(c.bounds.Max), c.estimate))
+
+	return c.adjusted(int(c.estimate), false)
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fixedController sets the limit to the number of failures plus one after
+// every request and records the calls.
+type fixedController struct {
+	tenant, handler string
+	bounds          ConcurrencyBounds
+
+	acquired, released, failures int
+	limits                       []int
+}
+
+func (c *fixedController) Acquire(int) { c.acquired++ }
+func (c *fixedController) Release(int) { c.released++ }
+
+func (c *fixedController) OnSuccess(_ time.Duration, limit int) LimitAdjustment {
+	c.limits = append(c.limits, limit)
+	return LimitAdjustment{Adjusted: true, Limit: c.failures + 1}
+}
+
+func (c *fixedController) OnFailure(_ time.Duration, limit int) LimitAdjustment {
+	c.limits = append(c.limits, limit)
+	c.failures++
+	return LimitAdjustment{Adjusted: true, Limit: c.failures + 1, Overloaded: true}
+}
+
+func TestCustomCongestionController(t *testing.T) {
+	var ctrl *fixedController
+	b, err := newLatencyBudgeter(LatencyBudgets{
+		MinConcurrency: 2,
+		MaxConcurrency: 3,
+		Controller: func(tenant, handler string, bounds ConcurrencyBounds) CongestionController {
+			ctrl = &fixedController{tenant: tenant, handler: handler, bounds: bounds}
+			return ctrl
+		},
+	}, nil, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1,ns2", handler: "/api/v1/query"}
+	for i, tc := range []struct {
+		failed bool
+		// exp is the limit after the request, clamped to the bounds.
+		exp int
+	}{
+		{exp: 2},
+		{failed: true, exp: 2},
+		{failed: true, exp: 3},
+		{failed: true, exp: 3},
+		{exp: 3},
+	} {
+		if !b.acquire(context.Background(), k) {
+			t.Fatalf("%d: unexpected rejection", i)
+		}
+		b.release(k, time.Second, tc.failed)
+
+		if got := b.states[k].limit; got != tc.exp {
+			t.Fatalf("%d: expected limit %d, got %d", i, tc.exp, got)
+		}
+	}
+
+	if ctrl.tenant != "ns1,ns2" || ctrl.handler != "/api/v1/query" || ctrl.bounds != (ConcurrencyBounds{Min: 2, Max: 3}) {
+		t.Fatalf("unexpected controller for %q, %q and %+v", ctrl.tenant, ctrl.handler, ctrl.bounds)
+	}
+	if ctrl.acquired != 5 || ctrl.released != 5 {
+		t.Fatalf("expected 5 acquired and released slots, got %d and %d", ctrl.acquired, ctrl.released)
+	}
+	if exp := []int{3, 2, 2, 3, 3}; !slices.Equal(ctrl.limits, exp) {
+		t.Fatalf("expected the limits %v, got %v", exp, ctrl.limits)
+	}
+}
+
+func TestCongestionControllerExternalDecrease(t *testing.T) {
+	c := &aimdController{
+		budget:         time.Second,
+		bounds:         ConcurrencyBounds{Min: 1, Max: 10},
+		increaseStep:   1,
+		decreaseFactor: 0.5,
+	}
+
+	// Slow requests fill the window without reaching an evaluation.
+	for i := 0; i < budgetEvalEvery-1; i++ {
+		if adj := c.OnSuccess(2*time.Second, 10); adj.Adjusted {
+			t.Fatalf("unexpected adjustment %+v", adj)
+		}
+	}
+
+	// The limit decreased outside of the controller (e.g. the upstream
+	// throttled a request): the slow samples are discarded.
+	adj := c.OnSuccess(100*time.Millisecond, 5)
+	if exp := (LimitAdjustment{Adjusted: true, Limit: 6}); adj != exp {
+		t.Fatalf("expected %+v, got %+v", exp, adj)
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	connectQueryPath      = "/prometheus.v1.QueryService/Query"
+	connectQueryRangePath = "/prometheus.v1.QueryService/QueryRange"
+
+	grpcWebJSONContentType = "application/grpc-web+json"
+	// maxGRPCWebMessageSize is the maximum size of a gRPC-Web request
+	// message, like the default of the gRPC servers.
+	maxGRPCWebMessageSize = 4 << 20
+
+	grpcWebCompressedFlag = 0x01
+	grpcWebTrailersFlag   = 0x80
+)
+
+// WithConnectAPI exposes the query endpoints as unary RPCs following the
+// Connect protocol with the JSON codec:
+//
+//	POST /prometheus.v1.QueryService/Query
+//	POST /prometheus.v1.QueryService/QueryRange
+//
+// The same RPCs are served to the gRPC-Web clients using the JSON codec
+// (application/grpc-web+json content type). The protobuf codec and the
+// base64-encoded gRPC-Web text format aren't supported since the proxy
+// doesn't ship protobuf definitions of the messages, nor are the compressed
+// gRPC-Web messages.
+//
+// The RPCs are translated to the /api/v1/query and /api/v1/query_range
+// endpoints which means that the same label enforcement applies. The URL
+// query string and headers are forwarded as-is (e.g. for the tenant
+// parameter).
+func WithConnectAPI() Option {
+	return optionFunc(func(o *options) {
+		o.enableConnectAPI = true
+	})
+}
+
+// connectQueryRequest is the JSON representation of the Query and QueryRange
+// messages. Start, end and step are only used by QueryRange, time only by
+// Query.
+type connectQueryRequest struct {
+	Query   string `json:"query"`
+	Time    string `json:"time,omitempty"`
+	Start   string `json:"start,omitempty"`
+	End     string `json:"end,omitempty"`
+	Step    string `json:"step,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func (c connectQueryRequest) values() url.Values {
+	v := url.Values{}
+	for k, s := range map[string]string{
+		queryParam: c.Query,
+		timeParam:  c.Time,
+		startParam: c.Start,
+		endParam:   c.End,
+		stepParam:  c.Step,
+		"timeout":  c.Timeout,
+	} {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+
+	return v
+}
+
+type connectQueryResponse struct {
+	Data     json.RawMessage `json:"data"`
+	Warnings []string        `json:"warnings,omitempty"`
+	Infos    []string        `json:"infos,omitempty"`
+}
+
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// connectCodes maps the HTTP status codes to the Connect error codes.
+var connectCodes = map[int]string{
+	http.StatusBadRequest:          "invalid_argument",
+	http.StatusUnauthorized:        "unauthenticated",
+	http.StatusForbidden:           "permission_denied",
+	http.StatusNotFound:            "not_found",
+	http.StatusTooManyRequests:     "resource_exhausted",
+	http.StatusUnprocessableEntity: "invalid_argument",
+	http.StatusServiceUnavailable:  "unavailable",
+	http.StatusBadGateway:          "unavailable",
+	http.StatusGatewayTimeout:      "deadline_exceeded",
+	http.StatusNotImplemented:      "unimplemented",
+	http.StatusInternalServerError: "internal",
+}
+
+// connectStatus maps the Connect error codes to the HTTP status codes
+// defined by the protocol.
+var connectStatus = map[string]int{
+	"invalid_argument":   http.StatusBadRequest,
+	"unauthenticated":    http.StatusUnauthorized,
+	"permission_denied":  http.StatusForbidden,
+	"not_found":          http.StatusNotFound,
+	"resource_exhausted": http.StatusTooManyRequests,
+	"unavailable":        http.StatusServiceUnavailable,
+	"deadline_exceeded":  http.StatusGatewayTimeout,
+	"unimplemented":      http.StatusNotImplemented,
+	"internal":           http.StatusInternalServerError,
+	"unknown":            http.StatusInternalServerError,
+}
+
+// grpcCodes maps the Connect error codes to the gRPC status codes.
+var grpcCodes = map[string]int{
+	"unknown":            2,
+	"invalid_argument":   3,
+	"deadline_exceeded":  4,
+	"not_found":          5,
+	"permission_denied":  7,
+	"resource_exhausted": 8,
+	"unimplemented":      12,
+	"internal":           13,
+	"unavailable":        14,
+	"unauthenticated":    16,
+}
+
+func connectErrorResponse(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(connectStatus[code])
+	_ = json.NewEncoder(w).Encode(connectError{Code: code, Message: message})
+}
+
+// responseBuffer buffers the response of an internal request.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}, status: http.StatusOK}
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) WriteHeader(status int) { b.status = status }
+
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// connectHandler translates the Connect or gRPC-Web RPC into a request to
+// the given Prometheus API path which is served by the proxy itself.
+func (r *routes) connectHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		switch ct {
+		case "application/json":
+			var in connectQueryRequest
+			if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+				connectErrorResponse(w, "invalid_argument", err.Error())
+				return
+			}
+
+			out, cerr := r.connectCall(req, path, in)
+			if cerr != nil {
+				connectErrorResponse(w, cerr.Code, cerr.Message)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(out)
+
+		case grpcWebJSONContentType:
+			var in connectQueryRequest
+			msg, cerr := readGRPCWebMessage(req.Body)
+			if cerr == nil {
+				if err := json.Unmarshal(msg, &in); err != nil {
+					cerr = &connectError{Code: "invalid_argument", Message: err.Error()}
+				}
+			}
+
+			var out *connectQueryResponse
+			if cerr == nil {
+				out, cerr = r.connectCall(req, path, in)
+			}
+			grpcWebResponse(w, out, cerr)
+
+		default:
+			w.Header().Set("Accept-Post", "application/json, "+grpcWebJSONContentType)
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		}
+	}
+}
+
+// connectCall serves the query with the proxy and returns its response or
+// the Connect error.
+func (r *routes) connectCall(req *http.Request, path string, in connectQueryRequest) (*connectQueryResponse, *connectError) {
+	body := in.values().Encode()
+	preq := req.Clone(req.Context())
+	preq.URL.Path = path
+	preq.URL.RawPath = ""
+	preq.RequestURI = ""
+	preq.Body = http.NoBody
+	if body != "" {
+		preq.Body = io.NopCloser(strings.NewReader(body))
+	}
+	preq.ContentLength = int64(len(body))
+	preq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	preq.Header.Del("Accept-Encoding")
+	preq.Header.Del("Connect-Protocol-Version")
+	preq.Header.Del("X-Grpc-Web")
+
+	rec := newResponseBuffer()
+	r.ServeHTTP(rec, preq)
+
+	var apir apiResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &apir); err != nil {
+		code, found := connectCodes[rec.status]
+		if !found || rec.status == http.StatusOK {
+			code = "unknown"
+		}
+		return nil, &connectError{Code: code, Message: strings.TrimSpace(rec.body.String())}
+	}
+
+	if apir.Status != "success" {
+		code, found := connectCodes[rec.status]
+		if !found {
+			code = "unknown"
+		}
+		return nil, &connectError{Code: code, Message: apir.Error}
+	}
+
+	return &connectQueryResponse{
+		Data:     apir.Data,
+		Warnings: apir.Warnings,
+		Infos:    apir.Infos,
+	}, nil
+}
+
+// readGRPCWebMessage reads the length-prefixed message of a unary gRPC-Web
+// request.
+func readGRPCWebMessage(r io.Reader) ([]byte, *connectError) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &connectError{Code: "invalid_argument", Message: fmt.Sprintf("can't read the message prefix: %v", err)}
+	}
+
+	switch {
+	case prefix[0]&grpcWebTrailersFlag != 0:
+		return nil, &connectError{Code: "invalid_argument", Message: "unexpected trailers frame"}
+	case prefix[0]&grpcWebCompressedFlag != 0:
+		return nil, &connectError{Code: "unimplemented", Message: "compressed messages aren't supported"}
+	}
+
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxGRPCWebMessageSize {
+		return nil, &connectError{Code: "resource_exhausted", Message: fmt.Sprintf("the message exceeds the limit of %d bytes", maxGRPCWebMessageSize)}
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &connectError{Code: "invalid_argument", Message: fmt.Sprintf("can't read the message: %v", err)}
+	}
+
+	return msg, nil
+}
+
+// writeGRPCWebFrame writes a length-prefixed gRPC-Web frame.
+func writeGRPCWebFrame(w io.Writer, flags byte, p []byte) {
+	var prefix [5]byte
+	prefix[0] = flags
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(p)))
+	_, _ = w.Write(prefix[:])
+	_, _ = w.Write(p)
+}
+
+// grpcWebResponse writes the message (if any) and the trailers frame with
+// the gRPC status. The HTTP status is always 200 as required by the
+// protocol.
+func grpcWebResponse(w http.ResponseWriter, out *connectQueryResponse, cerr *connectError) {
+	w.Header().Set("Content-Type", grpcWebJSONContentType)
+	w.WriteHeader(http.StatusOK)
+
+	if out != nil {
+		b, err := json.Marshal(out)
+		if err != nil {
+			cerr = &connectError{Code: "internal", Message: err.Error()}
+		} else {
+			writeGRPCWebFrame(w, 0, b)
+		}
+	}
+
+	var trailers strings.Builder
+	if cerr == nil {
+		trailers.WriteString("grpc-status: 0\r\n")
+	} else {
+		fmt.Fprintf(&trailers, "grpc-status: %d\r\n", grpcCodes[cerr.Code])
+		if cerr.Message != "" {
+			fmt.Fprintf(&trailers, "grpc-message: %s\r\n", grpcPercentEncode(cerr.Message))
+		}
+	}
+	writeGRPCWebFrame(w, grpcWebTrailersFlag, []byte(trailers.String()))
+}
+
+// grpcPercentEncode encodes the gRPC status message: the bytes outside of
+// the printable ASCII range and the percent sign are percent-encoded.
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,222 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConnectAPI(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.Form.Get("query") == `up{namespace="ns1"}` {
+			io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["`+req.URL.Path+`"]}`)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"status":"error","errorType":"execution","error":"unexpected query"}`)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithConnectAPI())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "query",
+			url:     "http://prometheus.example.com/prometheus.v1.QueryService/Query?namespace=ns1",
+			body:    `{"query":"up","time":"1"}`,
+			expCode: http.StatusOK,
+			expBody: `{"data":{"resultType":"vector","result":[]},"warnings":["/api/v1/query"]}`,
+		},
+		{
+			name:    "range query",
+			url:     "http://prometheus.example.com/prometheus.v1.QueryService/QueryRange?namespace=ns1",
+			body:    `{"query":"up","start":"0","end":"10","step":"1"}`,
+			expCode: http.StatusOK,
+			expBody: `{"data":{"resultType":"vector","result":[]},"warnings":["/api/v1/query_range"]}`,
+		},
+		{
+			name:    "upstream error",
+			url:     "http://prometheus.example.com/prometheus.v1.QueryService/QueryRange?namespace=ns1",
+			body:    `{"query":"down","start":"0","end":"10","step":"1"}`,
+			expCode: http.StatusBadRequest,
+			expBody: `{"code":"invalid_argument","message":"unexpected query"}`,
+		},
+		{
+			name:    "missing tenant",
+			url:     "http://prometheus.example.com/prometheus.v1.QueryService/Query",
+			body:    `{"query":"up"}`,
+			expCode: http.StatusBadRequest,
+			expBody: `{"code":"invalid_argument","message":"The \"namespace\" query parameter must be provided."}`,
+		},
+		{
+			name:    "invalid message",
+			url:     "http://prometheus.example.com/prometheus.v1.QueryService/Query?namespace=ns1",
+			body:    `{"query":`,
+			expCode: http.StatusBadRequest,
+			expBody: `{"code":"invalid_argument","message":"unexpected EOF"}`,
+		},
+		{
+			name:        "unsupported codec",
+			url:         "http://prometheus.example.com/prometheus.v1.QueryService/Query?namespace=ns1",
+			contentType: "application/proto",
+			expCode:     http.StatusUnsupportedMediaType,
+		},
+		{
+			name:    "GET request",
+			method:  http.MethodGet,
+			url:     "http://prometheus.example.com/prometheus.v1.QueryService/Query?namespace=ns1",
+			expCode: http.StatusMethodNotAllowed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			contentType := tc.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+
+			req := httptest.NewRequest(method, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Connect-Protocol-Version", "1")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody != "" && strings.TrimSpace(w.Body.String()) != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGRPCWebAPI(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.Form.Get("query") == `up{namespace="ns1"}` {
+			io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"status":"error","errorType":"execution","error":"unexpected query: 100%"}`)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithConnectAPI())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	frame := func(flags byte, msg string) string {
+		var b bytes.Buffer
+		writeGRPCWebFrame(&b, flags, []byte(msg))
+		return b.String()
+	}
+
+	for _, tc := range []struct {
+		name string
+		body string
+
+		expBody string
+	}{
+		{
+			name:    "query",
+			body:    frame(0, `{"query":"up","time":"1"}`),
+			expBody: frame(0, `{"data":{"resultType":"vector","result":[]}}`) + frame(0x80, "grpc-status: 0\r\n"),
+		},
+		{
+			name:    "upstream error",
+			body:    frame(0, `{"query":"down","time":"1"}`),
+			expBody: frame(0x80, "grpc-status: 3\r\ngrpc-message: unexpected query: 100%25\r\n"),
+		},
+		{
+			name:    "invalid message",
+			body:    frame(0, `{"query":`),
+			expBody: frame(0x80, "grpc-status: 3\r\ngrpc-message: unexpected end of JSON input\r\n"),
+		},
+		{
+			name:    "truncated frame",
+			body:    frame(0, `{"query":"up"}`)[:8],
+			expBody: frame(0x80, "grpc-status: 3\r\ngrpc-message: can't read the message: unexpected EOF\r\n"),
+		},
+		{
+			name:    "compressed message",
+			body:    frame(0x01, `{"query":"up"}`),
+			expBody: frame(0x80, "grpc-status: 12\r\ngrpc-message: compressed messages aren't supported\r\n"),
+		},
+		{
+			name: "message too large",
+			body: func() string {
+				var prefix [5]byte
+				binary.BigEndian.PutUint32(prefix[1:], maxGRPCWebMessageSize+1)
+				return string(prefix[:])
+			}(),
+			expBody: frame(0x80, "grpc-status: 8\r\ngrpc-message: the message exceeds the limit of 4194304 bytes\r\n"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/prometheus.v1.QueryService/Query?namespace=ns1", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/grpc-web+json")
+			req.Header.Set("X-Grpc-Web", "1")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/grpc-web+json" {
+				t.Fatalf("expected content type %q, got %q", "application/grpc-web+json", ct)
+			}
+			if w.Body.String() != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ConnectionLimits configures the ClientConnectionLimiter.
+type ConnectionLimits struct {
+	// MaxPerIP is the maximum number of simultaneous connections per
+	// client IP address.
+	MaxPerIP int
+	// TrustedProxies are the networks of the proxies (e.g. load balancers)
+	// relaying the requests of several clients. Their connections aren't
+	// limited, the client address is read from the X-Forwarded-For header
+	// instead.
+	TrustedProxies []*net.IPNet
+}
+
+// ClientConnectionLimiter caps the number of simultaneous connections per
+// client IP address. It protects the proxy against the clients opening
+// thousands of parallel connections (e.g. for bulk exports).
+//
+// The connections of the clients are limited by the listener returned by
+// Listener. The requests relayed by trusted proxies share their connections
+// so the limit applies to the concurrent requests of every forwarded client
+// instead, with the handler returned by Handler.
+type ClientConnectionLimiter struct {
+	limits ConnectionLimits
+
+	mtx   sync.Mutex
+	conns map[string]int
+
+	rejected *prometheus.CounterVec
+}
+
+// NewClientConnectionLimiter returns a new ClientConnectionLimiter.
+func NewClientConnectionLimiter(limits ConnectionLimits, reg prometheus.Registerer) *ClientConnectionLimiter {
+	return &ClientConnectionLimiter{
+		limits: limits,
+		conns:  map[string]int{},
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "client_connections_rejected_total",
+			Help: "Total number of client connections rejected because the client IP reached its limit, partitioned by source (connection or forwarded).",
+		}, []string{"source"}),
+	}
+}
+
+func (c *ClientConnectionLimiter) trusted(ip net.IP) bool {
+	for _, n := range c.limits.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *ClientConnectionLimiter) acquire(ip string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.conns[ip] >= c.limits.MaxPerIP {
+		return false
+	}
+	c.conns[ip]++
+
+	return true
+}
+
+func (c *ClientConnectionLimiter) release(ip string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.conns[ip]--
+	if c.conns[ip] <= 0 {
+		delete(c.conns, ip)
+	}
+}
+
+// remoteIP returns the IP address of a "host:port" address.
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return net.ParseIP(host)
+}
+
+// Listener returns a listener closing the connections of the client IPs
+// which already reached the limit.
+func (c *ClientConnectionLimiter) Listener(l net.Listener) net.Listener {
+	return &limitedListener{Listener: l, limiter: c}
+}
+
+type limitedListener struct {
+	net.Listener
+	limiter *ClientConnectionLimiter
+}
+
+// Accept implements the net.Listener interface.
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn.RemoteAddr().String())
+		if ip == nil || l.limiter.trusted(ip) {
+			return conn, nil
+		}
+
+		key := ip.String()
+		if !l.limiter.acquire(key) {
+			l.limiter.rejected.WithLabelValues("connection").Inc()
+			_ = conn.Close()
+			continue
+		}
+
+		return &limitedConn{Conn: conn, release: func() { l.limiter.release(key) }}, nil
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close implements the net.Conn interface.
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// forwardedClientIP returns the address of the client from the
+// X-Forwarded-For header. It is the last address which isn't a trusted
+// proxy.
+func (c *ClientConnectionLimiter) forwardedClientIP(req *http.Request) net.IP {
+	var addrs []string
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		addrs = append(addrs, strings.Split(v, ",")...)
+	}
+
+	var client net.IP
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !c.trusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// Handler returns a handler limiting the concurrent requests of the clients
+// relayed by the trusted proxies. It responds with 429 when the client IP
+// already reached the limit.
+func (c *ClientConnectionLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := remoteIP(req.RemoteAddr)
+		if ip == nil || !c.trusted(ip) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		client := c.forwardedClientIP(req)
+		if client == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		key := client.String()
+		if !c.acquire(key) {
+			c.rejected.WithLabelValues("forwarded").Inc()
+			rejectRequest(w, ReasonConnectionLimit, "too many concurrent connections from the client", http.StatusTooManyRequests)
+			return
+		}
+		defer c.release(key)
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return n
+}
+
+func TestClientConnectionLimiterListener(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted []*net.IPNet
+
+		expAccepted int
+	}{
+		{
+			name:        "limited",
+			expAccepted: 2,
+		},
+		{
+			name:        "trusted proxy",
+			trusted:     []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")},
+			expAccepted: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewClientConnectionLimiter(ConnectionLimits{MaxPerIP: 2, TrustedProxies: tc.trusted}, prometheus.NewRegistry())
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ll := c.Listener(l)
+			defer ll.Close()
+
+			accepted := make(chan net.Conn, 10)
+			go func() {
+				for {
+					conn, err := ll.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}()
+
+			var clients []net.Conn
+			for i := 0; i < 3; i++ {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer conn.Close()
+				clients = append(clients, conn)
+			}
+
+			var conns []net.Conn
+			for len(conns) < tc.expAccepted {
+				select {
+				case conn := <-accepted:
+					conns = append(conns, conn)
+				case <-time.After(time.Second):
+					t.Fatalf("expected %d accepted connections, got %d", tc.expAccepted, len(conns))
+				}
+			}
+			select {
+			case <-accepted:
+				t.Fatalf("expected %d accepted connections, got more", tc.expAccepted)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			if tc.expAccepted == 3 {
+				return
+			}
+
+			// The rejected connection is closed.
+			_ = clients[2].SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := clients[2].Read(make([]byte, 1)); err == nil {
+				t.Fatal("expected the connection to be closed")
+			}
+			if got := testutil.ToFloat64(c.rejected.WithLabelValues("connection")); got != 1 {
+				t.Fatalf("expected 1 rejected connection, got %v", got)
+			}
+
+			// Closing a connection frees a slot.
+			conns[0].Close()
+			conns[0].Close()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer conn.Close()
+			select {
+			case <-accepted:
+			case <-time.After(time.Second):
+				t.Fatal("expected the connection to be accepted")
+			}
+		})
+	}
+}
+
+func TestClientConnectionLimiterHandler(t *testing.T) {
+	c := NewClientConnectionLimiter(ConnectionLimits{
+		MaxPerIP:       1,
+		TrustedProxies: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")},
+	}, prometheus.NewRegistry())
+
+	for _, tc := range []struct {
+		forwarded []string
+		exp       string
+	}{
+		{forwarded: []string{"192.0.2.1"}, exp: "192.0.2.1"},
+		{forwarded: []string{"192.0.2.1, 192.0.2.2"}, exp: "192.0.2.2"},
+		{forwarded: []string{"192.0.2.1, 10.0.0.2", "10.0.0.3"}, exp: "192.0.2.1"},
+		{forwarded: []string{"10.0.0.2"}, exp: "10.0.0.2"},
+		{forwarded: []string{"unknown, 10.0.0.2"}, exp: "10.0.0.2"},
+		{},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/", nil)
+		for _, v := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		ip := c.forwardedClientIP(req)
+		if (ip == nil && tc.exp != "") || (ip != nil && ip.String() != tc.exp) {
+			t.Fatalf("%v: expected client %q, got %v", tc.forwarded, tc.exp, ip)
+		}
+	}
+
+	release := make(chan struct{})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+
+	newRequest := func(remote, forwarded string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return req
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), newRequest("10.0.0.1:1234", "192.0.2.1"))
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mtx.Lock()
+		n := c.conns["192.0.2.1"]
+		c.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected an in-flight request")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("10.0.0.2:1234", "192.0.2.1"))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	// Another client and direct connections aren't limited by the handler.
+	close(release)
+	for _, req := range []*http.Request{
+		newRequest("10.0.0.2:1234", "192.0.2.2"),
+		newRequest("192.0.2.1:1234", ""),
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	<-done
+
+	if len(c.conns) != 0 {
+		t.Fatalf("expected no tracked client, got %v", c.conns)
+	}
+}
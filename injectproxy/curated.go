@@ -0,0 +1,192 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// CuratedMetricsAuthorizer restricts a set of tenants to querying only the
+// metrics produced by the recording rules of the upstream.
+//
+// The catalog of recording rules is fetched from the upstream's
+// /api/v1/rules endpoint by Run(). Until the first successful refresh, the
+// requests of the curated tenants are denied. The series and label requests
+// of the curated tenants must have match[] selectors. The tenants are
+// matched by value, so the authorizer can't be used with WithRegexMatch.
+type CuratedMetricsAuthorizer struct {
+	upstream *url.URL
+	client   *http.Client
+	tenants  map[string]struct{}
+	logger   *log.Logger
+
+	mtx     sync.RWMutex
+	metrics map[string]struct{}
+}
+
+// NewCuratedMetricsAuthorizer returns a new CuratedMetricsAuthorizer for the
+// given tenants.
+func NewCuratedMetricsAuthorizer(upstream *url.URL, client *http.Client, tenants []string) *CuratedMetricsAuthorizer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	c := &CuratedMetricsAuthorizer{
+		upstream: upstream,
+		client:   client,
+		tenants:  make(map[string]struct{}, len(tenants)),
+		logger:   log.Default(),
+	}
+	for _, t := range tenants {
+		c.tenants[t] = struct{}{}
+	}
+
+	return c
+}
+
+// Run refreshes the catalog of recording rules at the given interval until
+// the context is canceled. The interval must be positive.
+func (c *CuratedMetricsAuthorizer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("the refresh interval must be positive, got %s", interval)
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := c.Refresh(ctx); err != nil {
+			c.logger.Printf("failed to refresh the recording rules catalog: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Refresh fetches the recording rules from the upstream and replaces the
+// catalog.
+func (c *CuratedMetricsAuthorizer) Refresh(ctx context.Context) error {
+	u := c.upstream.JoinPath("/api/v1/rules")
+	u.RawQuery = url.Values{"type": []string{"record"}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	apir, err := getAPIResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	var rgs rulesData
+	if err := json.Unmarshal(apir.Data, &rgs); err != nil {
+		return fmt.Errorf("can't decode rules data: %w", err)
+	}
+
+	metrics := map[string]struct{}{}
+	for _, rg := range rgs.RuleGroups {
+		for _, r := range rg.Rules {
+			if r.recordingRule != nil {
+				metrics[r.recordingRule.Name] = struct{}{}
+			}
+		}
+	}
+
+	c.mtx.Lock()
+	c.metrics = metrics
+	c.mtx.Unlock()
+
+	return nil
+}
+
+// listsSeriesMetadata returns true if the path is one of the endpoints
+// listing the series, the label names or the label values.
+func listsSeriesMetadata(p string) bool {
+	if strings.HasSuffix(p, "/api/v1/series") || strings.HasSuffix(p, "/api/v1/labels") {
+		return true
+	}
+
+	_, name, found := strings.Cut(p, "/api/v1/label/")
+	return found && strings.HasSuffix(name, "/values")
+}
+
+// Authorize implements the Authorizer interface.
+func (c *CuratedMetricsAuthorizer) Authorize(_ context.Context, in *AuthorizationInput) (*AuthorizationDecision, error) {
+	var curated bool
+	for _, t := range in.Tenants {
+		if _, found := c.tenants[t]; found {
+			curated = true
+			break
+		}
+	}
+
+	if !curated {
+		return &AuthorizationDecision{Allow: true}, nil
+	}
+
+	// Without match[], the series and label endpoints would expose the
+	// metrics outside of the catalog.
+	if len(in.Selectors) == 0 && listsSeriesMetadata(in.Path) {
+		return &AuthorizationDecision{Reason: "at least one match[] selector of a curated metric is required"}, nil
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	for _, s := range in.Selectors {
+		ms, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return &AuthorizationDecision{Reason: err.Error()}, nil
+		}
+
+		var name string
+		for _, m := range ms {
+			if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+				name = m.Value
+				break
+			}
+		}
+
+		if name == "" {
+			return &AuthorizationDecision{Reason: fmt.Sprintf("selector %s must select a metric name", s)}, nil
+		}
+
+		if _, found := c.metrics[name]; !found {
+			return &AuthorizationDecision{Reason: fmt.Sprintf("metric %q isn't part of the curated metrics", name)}, nil
+		}
+	}
+
+	return &AuthorizationDecision{Allow: true}, nil
+}
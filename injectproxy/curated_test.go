@@ -0,0 +1,161 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCuratedMetricsAuthorizer(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/rules" {
+			if req.URL.Query().Get("type") != "record" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, `{"status":"success","data":{"groups":[{"name":"group1","file":"f","interval":30,"rules":[
+				{"type":"recording","name":"job:up:sum","query":"sum by(job) (up)","health":"ok","lastEvaluation":"2024-01-01T00:00:00Z"},
+				{"type":"alerting","name":"Down","query":"up == 0","health":"ok","state":"inactive","alerts":[],"lastEvaluation":"2024-01-01T00:00:00Z"}
+			]}]}}`)
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	c := NewCuratedMetricsAuthorizer(m.url, nil, []string{"external"})
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithAuthorizer(c), WithEnabledLabelsAPI())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	do := func(rawurl string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, rawurl, nil))
+		return w.Code
+	}
+
+	// The catalog is empty until refreshed.
+	if code := do("http://prometheus.example.com/api/v1/query?query=job:up:sum&namespace=external"); code != http.StatusForbidden {
+		t.Fatalf("expected status code %d before refresh, got %d", http.StatusForbidden, code)
+	}
+
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		query   url.Values
+		path    string
+		expCode int
+	}{
+		{
+			name:    "non-curated tenant",
+			path:    "/api/v1/query",
+			query:   url.Values{"query": []string{"up"}, proxyLabel: []string{"internal"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "recording rule",
+			path:    "/api/v1/query",
+			query:   url.Values{"query": []string{`rate(job:up:sum{job="a"}[5m])`}, proxyLabel: []string{"external"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "raw metric",
+			path:    "/api/v1/query",
+			query:   url.Values{"query": []string{"job:up:sum / up"}, proxyLabel: []string{"external"}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "alerting rule",
+			path:    "/api/v1/query",
+			query:   url.Values{"query": []string{"Down"}, proxyLabel: []string{"external"}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "curated tenant among others",
+			path:    "/api/v1/query",
+			query:   url.Values{"query": []string{"up"}, proxyLabel: []string{"internal", "external"}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "selector without metric name",
+			path:    "/api/v1/series",
+			query:   url.Values{"match[]": []string{`{job="a"}`}, proxyLabel: []string{"external"}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "series without match[]",
+			path:    "/api/v1/series",
+			query:   url.Values{proxyLabel: []string{"external"}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "label names without match[]",
+			path:    "/api/v1/labels",
+			query:   url.Values{proxyLabel: []string{"external"}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "label values without match[]",
+			path:    "/api/v1/label/__name__/values",
+			query:   url.Values{proxyLabel: []string{"external"}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "label values of a recording rule",
+			path:    "/api/v1/label/job/values",
+			query:   url.Values{"match[]": []string{`job:up:sum`}, proxyLabel: []string{"external"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "label names of a non-curated tenant",
+			path:    "/api/v1/labels",
+			query:   url.Values{proxyLabel: []string{"internal"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "series of a recording rule",
+			path:    "/api/v1/series",
+			query:   url.Values{"match[]": []string{`job:up:sum`}, proxyLabel: []string{"external"}},
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := do("http://prometheus.example.com" + tc.path + "?" + tc.query.Encode()); code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, code)
+			}
+		})
+	}
+}
+
+func TestCuratedMetricsAuthorizerInvalidInterval(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+	c := NewCuratedMetricsAuthorizer(u, nil, []string{"external"})
+
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		if err := c.Run(context.Background(), interval); err == nil {
+			t.Fatalf("expected an error for the interval %s", interval)
+		}
+	}
+}
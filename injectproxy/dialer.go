@@ -0,0 +1,306 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultFallbackDelay is the delay before dialing the next address, as
+// recommended by RFC 8305.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// UpstreamResolution configures how the upstream hostname is resolved and
+// dialed.
+type UpstreamResolution struct {
+	// RefreshInterval is the interval after which the upstream hostname is
+	// resolved again.
+	RefreshInterval time.Duration
+	// FailureCooldown is the duration for which an address is tried last
+	// after a failed connection.
+	FailureCooldown time.Duration
+	// FallbackDelay is the delay before racing the connection to the next
+	// address. If zero, 300ms is used.
+	FallbackDelay time.Duration
+}
+
+// WithUpstreamResolution resolves the upstream hostname periodically and
+// dials its addresses with the "happy eyeballs" algorithm (RFC 8305): the
+// IPv6 and IPv4 addresses are interleaved and the next address is dialed
+// concurrently if the previous one didn't connect within the fallback
+// delay. The addresses which failed recently are tried last so that a
+// stale address (e.g. a deleted pod behind a headless service) doesn't
+// blackhole the proxy.
+func WithUpstreamResolution(c UpstreamResolution) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamResolution = &c
+	})
+}
+
+type resolvedHost struct {
+	addrs     []netip.Addr
+	resolved  time.Time
+	unhealthy map[netip.Addr]time.Time
+}
+
+// upstreamDialer dials the upstream addresses.
+type upstreamDialer struct {
+	config UpstreamResolution
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+	dial   func(ctx context.Context, network, address string) (net.Conn, error)
+	now    func() time.Time
+	logger *log.Logger
+
+	mtx   sync.Mutex
+	hosts map[string]*resolvedHost
+
+	resolutions  *prometheus.CounterVec
+	dialFailures prometheus.Counter
+}
+
+func newUpstreamDialer(c UpstreamResolution, reg prometheus.Registerer) *upstreamDialer {
+	if c.FallbackDelay <= 0 {
+		c.FallbackDelay = defaultFallbackDelay
+	}
+
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &upstreamDialer{
+		config: c,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		dial:   d.DialContext,
+		now:    time.Now,
+		logger: log.Default(),
+		hosts:  map[string]*resolvedHost{},
+		resolutions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_dns_resolutions_total",
+			Help: "Total number of resolutions of the upstream hostname, partitioned by result.",
+		}, []string{"result"}),
+		dialFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "upstream_dial_failures_total",
+			Help: "Total number of failed connections to an upstream address.",
+		}),
+	}
+}
+
+// addresses returns the addresses of the host in dialing order.
+func (d *upstreamDialer) addresses(ctx context.Context, host string) ([]netip.Addr, error) {
+	d.mtx.Lock()
+	h, found := d.hosts[host]
+	stale := !found || d.now().Sub(h.resolved) >= d.config.RefreshInterval
+	d.mtx.Unlock()
+
+	if stale {
+		addrs, err := d.lookup(ctx, host)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses found for %s", host)
+		}
+
+		d.mtx.Lock()
+		h = d.hosts[host]
+		switch {
+		case err == nil:
+			d.resolutions.WithLabelValues("success").Inc()
+			if h == nil {
+				h = &resolvedHost{unhealthy: map[netip.Addr]time.Time{}}
+				d.hosts[host] = h
+			}
+			h.addrs = addrs
+			h.resolved = d.now()
+		case h == nil:
+			d.mtx.Unlock()
+			d.resolutions.WithLabelValues("failure").Inc()
+			return nil, err
+		default:
+			// Keep the previous addresses until the next refresh.
+			d.resolutions.WithLabelValues("failure").Inc()
+			d.logger.Printf("failed to resolve %s, using the previous addresses: %v", host, err)
+			h.resolved = d.now()
+		}
+		d.mtx.Unlock()
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := d.now()
+	var healthy, unhealthy []netip.Addr
+	for _, a := range h.addrs {
+		if until, found := h.unhealthy[a]; found && now.Before(until) {
+			unhealthy = append(unhealthy, a)
+			continue
+		}
+		healthy = append(healthy, a)
+	}
+
+	return append(interleaveFamilies(healthy), interleaveFamilies(unhealthy)...), nil
+}
+
+// interleaveFamilies alternates the IPv6 and IPv4 addresses, starting with
+// the family of the first address.
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	var primary, fallback []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == addrs[0].Is4() {
+			primary = append(primary, a)
+			continue
+		}
+		fallback = append(fallback, a)
+	}
+
+	res := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(primary) || i < len(fallback); i++ {
+		if i < len(primary) {
+			res = append(res, primary[i])
+		}
+		if i < len(fallback) {
+			res = append(res, fallback[i])
+		}
+	}
+
+	return res
+}
+
+func (d *upstreamDialer) setHealth(host string, addr netip.Addr, healthy bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	h, found := d.hosts[host]
+	if !found {
+		return
+	}
+
+	if healthy {
+		delete(h.unhealthy, addr)
+		return
+	}
+	h.unhealthy[addr] = d.now().Add(d.config.FailureCooldown)
+}
+
+type dialResult struct {
+	index int
+	conn  net.Conn
+	err   error
+}
+
+// DialContext connects to the address. Hostnames are resolved from the
+// cache and their addresses are raced.
+func (d *upstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.dial(ctx, network, address)
+	}
+
+	addrs, err := d.addresses(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The channel is large enough for the dialing goroutines to never
+	// block.
+	results := make(chan dialResult, len(addrs))
+	var (
+		next, pending int
+		done          = make([]bool, len(addrs))
+		fallback      <-chan time.Time
+		firstErr      error
+	)
+	start := func() {
+		i := next
+		next++
+		pending++
+		go func() {
+			conn, err := d.dial(ctx, network, net.JoinHostPort(addrs[i].String(), port))
+			results <- dialResult{index: i, conn: conn, err: err}
+		}()
+
+		fallback = nil
+		if next < len(addrs) {
+			fallback = time.After(d.config.FallbackDelay)
+		}
+	}
+
+	start()
+	for {
+		select {
+		case res := <-results:
+			pending--
+			done[res.index] = true
+			if res.err == nil {
+				d.setHealth(host, addrs[res.index], true)
+
+				// The addresses dialed before the winner which didn't
+				// connect in time are tried last for the next
+				// connections (e.g. stale addresses dropping packets).
+				for i := 0; i < res.index; i++ {
+					if !done[i] {
+						d.setHealth(host, addrs[i], false)
+					}
+				}
+
+				// Close the connections which were established
+				// concurrently.
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+
+				return res.conn, nil
+			}
+
+			if ctx.Err() == nil {
+				d.dialFailures.Inc()
+				d.setHealth(host, addrs[res.index], false)
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+
+			if next < len(addrs) {
+				start()
+				continue
+			}
+
+			if pending == 0 {
+				return nil, firstErr
+			}
+		case <-fallback:
+			start()
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func addrs(s ...string) []netip.Addr {
+	var res []netip.Addr
+	for _, a := range s {
+		res = append(res, netip.MustParseAddr(a))
+	}
+	return res
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	for _, tc := range []struct {
+		in  []netip.Addr
+		exp []netip.Addr
+	}{
+		{},
+		{
+			in:  addrs("10.0.0.1", "10.0.0.2"),
+			exp: addrs("10.0.0.1", "10.0.0.2"),
+		},
+		{
+			in:  addrs("::1", "::2", "10.0.0.1", "10.0.0.2", "10.0.0.3"),
+			exp: addrs("::1", "10.0.0.1", "::2", "10.0.0.2", "10.0.0.3"),
+		},
+		{
+			in:  addrs("10.0.0.1", "::1", "::2"),
+			exp: addrs("10.0.0.1", "::1", "::2"),
+		},
+	} {
+		got := interleaveFamilies(tc.in)
+		if len(got) != len(tc.exp) {
+			t.Fatalf("expected %v, got %v", tc.exp, got)
+		}
+		for i := range got {
+			if got[i] != tc.exp[i] {
+				t.Fatalf("expected %v, got %v", tc.exp, got)
+			}
+		}
+	}
+}
+
+// fakeNetwork records the dialed addresses. The dials of the addresses in
+// fail return an error and the ones in hang block until cancellation.
+type fakeNetwork struct {
+	mtx    sync.Mutex
+	dialed []string
+	fail   map[string]bool
+	hang   map[string]bool
+}
+
+func (n *fakeNetwork) dial(ctx context.Context, _, address string) (net.Conn, error) {
+	n.mtx.Lock()
+	n.dialed = append(n.dialed, address)
+	fail, hang := n.fail[address], n.hang[address]
+	n.mtx.Unlock()
+
+	switch {
+	case fail:
+		return nil, errors.New("connection refused")
+	case hang:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (n *fakeNetwork) reset() []string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	dialed := n.dialed
+	n.dialed = nil
+	return dialed
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	network := &fakeNetwork{
+		fail: map[string]bool{"10.0.0.1:9090": true},
+		hang: map[string]bool{"10.0.0.3:9090": true},
+	}
+
+	var (
+		resolved  = addrs("10.0.0.1", "10.0.0.2")
+		lookupErr error
+		lookups   int
+	)
+	d := newUpstreamDialer(UpstreamResolution{
+		RefreshInterval: time.Minute,
+		FailureCooldown: 2 * time.Minute,
+		FallbackDelay:   10 * time.Millisecond,
+	}, prometheus.NewRegistry())
+	d.lookup = func(context.Context, string) ([]netip.Addr, error) {
+		lookups++
+		return resolved, lookupErr
+	}
+	d.dial = network.dial
+	now := time.Unix(0, 0)
+	d.now = func() time.Time { return now }
+
+	dial := func(expDialed ...string) {
+		t.Helper()
+		conn, err := d.DialContext(context.Background(), "tcp", "prometheus.example.com:9090")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		conn.Close()
+
+		dialed := network.reset()
+		if len(dialed) != len(expDialed) {
+			t.Fatalf("expected dialed addresses %v, got %v", expDialed, dialed)
+		}
+		for i := range dialed {
+			if dialed[i] != expDialed[i] {
+				t.Fatalf("expected dialed addresses %v, got %v", expDialed, dialed)
+			}
+		}
+	}
+
+	// The failed address is tried last until the cooldown expires.
+	dial("10.0.0.1:9090", "10.0.0.2:9090")
+	dial("10.0.0.2:9090")
+	now = now.Add(30 * time.Second)
+	dial("10.0.0.2:9090")
+	if lookups != 1 {
+		t.Fatalf("expected 1 lookup, got %d", lookups)
+	}
+
+	// The hostname is resolved again after the refresh interval. The
+	// address which didn't connect before the fallback delay is tried last.
+	now = now.Add(30 * time.Second)
+	resolved = addrs("10.0.0.3", "10.0.0.4")
+	dial("10.0.0.3:9090", "10.0.0.4:9090")
+	if lookups != 2 {
+		t.Fatalf("expected 2 lookups, got %d", lookups)
+	}
+
+	// The previous addresses are kept when the resolution fails.
+	now = now.Add(time.Minute)
+	lookupErr = errors.New("server misbehaving")
+	dial("10.0.0.4:9090")
+	if lookups != 3 {
+		t.Fatalf("expected 3 lookups, got %d", lookups)
+	}
+}
+
+func TestUpstreamDialerErrors(t *testing.T) {
+	network := &fakeNetwork{
+		fail: map[string]bool{"10.0.0.1:9090": true, "10.0.0.2:9090": true},
+	}
+
+	d := newUpstreamDialer(UpstreamResolution{RefreshInterval: time.Minute}, prometheus.NewRegistry())
+	d.dial = network.dial
+
+	d.lookup = func(context.Context, string) ([]netip.Addr, error) {
+		return nil, errors.New("no such host")
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "prometheus.example.com:9090"); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	d.lookup = func(context.Context, string) ([]netip.Addr, error) {
+		return addrs("10.0.0.1", "10.0.0.2"), nil
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "prometheus.example.com:9090"); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if dialed := network.reset(); len(dialed) != 2 {
+		t.Fatalf("expected 2 dialed addresses, got %v", dialed)
+	}
+}
+
+func TestUpstreamResolutionRoutes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	// Resolve the upstream through its hostname.
+	u, err := url.Parse(m.url.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Host = net.JoinHostPort("localhost", u.Port())
+
+	r, err := NewRoutes(
+		u,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithUpstreamResolution(UpstreamResolution{RefreshInterval: time.Minute, FailureCooldown: time.Minute}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
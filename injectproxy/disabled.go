@@ -0,0 +1,255 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+// DisabledTenantsPath is the path of the disabled tenants endpoint.
+const DisabledTenantsPath = "/-/disabled-tenants"
+
+// defaultDisabledMessage is the message returned to the disabled tenants
+// when none is configured.
+const defaultDisabledMessage = "tenant disabled"
+
+// DisabledTenantsConfig is the configuration of the disabled tenants.
+type DisabledTenantsConfig struct {
+	// Message is the default message returned to the disabled tenants.
+	Message string `yaml:"message"`
+	// Tenants maps the disabled tenants to their message. An empty
+	// message means the default message.
+	Tenants map[string]string `yaml:"tenants"`
+}
+
+// LoadDisabledTenants reads the disabled tenants from a YAML file. For
+// example:
+//
+//	message: 'tenant disabled, contact the platform team'
+//	tenants:
+//	  team-a: 'contract expired'
+//	  team-b: ''
+func LoadDisabledTenants(path string) (DisabledTenantsConfig, error) {
+	var c DisabledTenantsConfig
+
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return c, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if _, found := c.Tenants[""]; found {
+		return c, fmt.Errorf("invalid disabled tenants in %s: empty tenant", path)
+	}
+
+	return c, nil
+}
+
+// DisabledTenant describes a disabled tenant.
+type DisabledTenant struct {
+	Tenant  string `json:"tenant"`
+	Message string `json:"message"`
+	// DisabledAt is zero for the tenants disabled by the configuration.
+	DisabledAt time.Time `json:"disabledAt"`
+	Source     string    `json:"source"`
+}
+
+// DisabledTenants holds the disabled tenants. All their requests are
+// rejected with a 403 status code and the tenant's message. It implements
+// http.Handler to serve the DisabledTenantsPath endpoint:
+//
+//   - GET returns the disabled tenants as a JSON array sorted by tenant.
+//   - POST with the "tenant" and optional "message" parameters disables the
+//     given tenant.
+//   - DELETE with the "tenant" parameter enables the given tenant again.
+//
+// The changes made with the endpoint are kept in memory only and they are
+// recorded as tenant_disabled and tenant_enabled events. The endpoint isn't
+// protected, it should be exposed to the administrators only (e.g. on the
+// internal listen address).
+type DisabledTenants struct {
+	mtx     sync.RWMutex
+	tenants map[string]DisabledTenant
+
+	defaultMessage string
+	events         EventSink
+	now            func() time.Time
+}
+
+// NewDisabledTenants returns the disabled tenants of the configuration. The
+// changes are recorded to the event sink. If nil, they are logged with the
+// default logger.
+func NewDisabledTenants(c DisabledTenantsConfig, events EventSink) *DisabledTenants {
+	if events == nil {
+		events = NewLogEventSink(log.Default())
+	}
+
+	d := &DisabledTenants{
+		tenants:        make(map[string]DisabledTenant, len(c.Tenants)),
+		defaultMessage: c.Message,
+		events:         events,
+		now:            time.Now,
+	}
+	if d.defaultMessage == "" {
+		d.defaultMessage = defaultDisabledMessage
+	}
+
+	for tenant, msg := range c.Tenants {
+		if msg == "" {
+			msg = d.defaultMessage
+		}
+		d.tenants[tenant] = DisabledTenant{Tenant: tenant, Message: msg, Source: "config"}
+	}
+
+	return d
+}
+
+// WithDisabledTenants rejects the requests of the disabled tenants.
+func WithDisabledTenants(d *DisabledTenants) Option {
+	return optionFunc(func(o *options) {
+		o.disabledTenants = d
+	})
+}
+
+// Disable disables the tenant. The default message is used if msg is empty.
+func (d *DisabledTenants) Disable(tenant, msg, source string) {
+	if msg == "" {
+		msg = d.defaultMessage
+	}
+
+	now := d.now()
+	d.mtx.Lock()
+	d.tenants[tenant] = DisabledTenant{Tenant: tenant, Message: msg, DisabledAt: now, Source: source}
+	d.mtx.Unlock()
+
+	d.events.Emit(Event{Time: now, Type: EventTenantDisabled, Tenant: tenant, Message: msg, Source: source})
+}
+
+// Enable enables the tenant again. It returns false if the tenant isn't
+// disabled.
+func (d *DisabledTenants) Enable(tenant, source string) bool {
+	d.mtx.Lock()
+	_, found := d.tenants[tenant]
+	delete(d.tenants, tenant)
+	d.mtx.Unlock()
+
+	if !found {
+		return false
+	}
+
+	d.events.Emit(Event{Time: d.now(), Type: EventTenantEnabled, Tenant: tenant, Source: source})
+	return true
+}
+
+// Disabled returns the disabled tenants sorted by tenant.
+func (d *DisabledTenants) Disabled() []DisabledTenant {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+
+	tenants := make([]DisabledTenant, 0, len(d.tenants))
+	for _, t := range d.tenants {
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Tenant < tenants[j].Tenant })
+
+	return tenants
+}
+
+func (d *DisabledTenants) lookup(tenant string) (DisabledTenant, bool) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+
+	t, found := d.tenants[tenant]
+	return t, found
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (d *DisabledTenants) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(d.Disabled())
+	case http.MethodPost, http.MethodDelete:
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tenant := req.Form.Get("tenant")
+		if tenant == "" {
+			prometheusAPIError(w, `the "tenant" parameter must be provided`, http.StatusBadRequest)
+			return
+		}
+
+		source := "api:" + req.RemoteAddr
+		if req.Method == http.MethodPost {
+			d.Disable(tenant, req.Form.Get("message"), source)
+		} else if !d.Enable(tenant, source) {
+			prometheusAPIError(w, "tenant not disabled", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		prometheusAPIError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func newDisabledRejections(reg prometheus.Registerer) prometheus.Counter {
+	return promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "disabled_tenant_rejected_requests_total",
+		Help: "Total number of requests rejected because the tenant is disabled.",
+	})
+}
+
+// rejectDisabledTenants rejects the requests of the disabled tenants.
+func (r *routes) rejectDisabledTenants(next http.HandlerFunc) http.HandlerFunc {
+	if r.disabledTenants == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, tenant := range MustLabelValues(req.Context()) {
+			t, found := r.disabledTenants.lookup(tenant)
+			if !found {
+				continue
+			}
+
+			r.disabledRejections.Inc()
+			rejectRequest(w, ReasonTenantDisabled, fmt.Sprintf("tenant %q is disabled: %s", t.Tenant, t.Message), http.StatusForbidden)
+			return
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadDisabledTenants(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		exp    DisabledTenantsConfig
+		expErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "tenants",
+			content: `
+message: 'contact the platform team'
+tenants:
+  team-a: 'contract expired'
+  team-b: ''
+`,
+			exp: DisabledTenantsConfig{
+				Message: "contact the platform team",
+				Tenants: map[string]string{"team-a": "contract expired", "team-b": ""},
+			},
+		},
+		{
+			name:    "empty tenant",
+			content: "tenants: {'': 'expired'}",
+			expErr:  true,
+		},
+		{
+			name:    "unknown field",
+			content: "reason: expired",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disabled.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := LoadDisabledTenants(path)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(tc.exp, c) {
+				t.Fatalf("expected %+v, got %+v", tc.exp, c)
+			}
+		})
+	}
+}
+
+func TestDisabledTenantsHandler(t *testing.T) {
+	sink := &recordingSink{}
+	d := NewDisabledTenants(DisabledTenantsConfig{Tenants: map[string]string{"team-a": "contract expired"}}, sink)
+	now := time.Unix(100, 0).UTC()
+	d.now = func() time.Time { return now }
+
+	do := func(method string, params url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if method == http.MethodPost {
+			req = httptest.NewRequest(method, DisabledTenantsPath, strings.NewReader(params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, DisabledTenantsPath+"?"+params.Encode(), nil)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodPost, url.Values{"tenant": []string{"team-b"}}); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	if w := do(http.MethodPost, url.Values{"message": []string{"expired"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+
+	w := do(http.MethodGet, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var got []DisabledTenant
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []DisabledTenant{
+		{Tenant: "team-a", Message: "contract expired", Source: "config"},
+		{Tenant: "team-b", Message: defaultDisabledMessage, DisabledAt: now, Source: "api:10.0.0.1:1234"},
+	}
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+
+	if w := do(http.MethodDelete, url.Values{"tenant": []string{"team-a"}}); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	if w := do(http.MethodDelete, url.Values{"tenant": []string{"team-c"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusNotFound, w.Code, w.Body.String())
+	}
+
+	if w := do(http.MethodPut, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusMethodNotAllowed, w.Code, w.Body.String())
+	}
+
+	expEvents := []Event{
+		{Time: now, Type: EventTenantDisabled, Tenant: "team-b", Message: defaultDisabledMessage, Source: "api:10.0.0.1:1234"},
+		{Time: now, Type: EventTenantEnabled, Tenant: "team-a", Source: "api:10.0.0.1:1234"},
+	}
+	if !reflect.DeepEqual(expEvents, sink.events) {
+		t.Fatalf("expected events %+v, got %+v", expEvents, sink.events)
+	}
+}
+
+func TestRejectDisabledTenants(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	d := NewDisabledTenants(DisabledTenantsConfig{Tenants: map[string]string{"ns2": "contract expired"}}, &recordingSink{})
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithDisabledTenants(d),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		tenants []string
+
+		expCode  int
+		expError string
+	}{
+		{
+			name:    "enabled tenant",
+			tenants: []string{"ns1"},
+			expCode: http.StatusOK,
+		},
+		{
+			name:     "disabled tenant",
+			tenants:  []string{"ns2"},
+			expCode:  http.StatusForbidden,
+			expError: `tenant \"ns2\" is disabled: contract expired`,
+		},
+		{
+			name:     "one of the tenants is disabled",
+			tenants:  []string{"ns1", "ns2"},
+			expCode:  http.StatusForbidden,
+			expError: "contract expired",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/federate?"+url.Values{"match[]": []string{"up"}, proxyLabel: tc.tenants}.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expError != "" && !strings.Contains(w.Body.String(), tc.expError) {
+				t.Fatalf("expected error %q, got %s", tc.expError, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.disabledRejections); got != 2 {
+		t.Fatalf("expected 2 rejections, got %v", got)
+	}
+
+	// The tenants enabled with the admin API are served again.
+	d.Enable("ns2", "test")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/federate?"+url.Values{"match[]": []string{"up"}, proxyLabel: []string{"ns2"}}.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
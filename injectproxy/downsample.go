@@ -0,0 +1,118 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxSourceResolutionParam is the Thanos parameter selecting the downsampled
+// blocks.
+const maxSourceResolutionParam = "max_source_resolution"
+
+// Downsampling configures the automatic selection of the Thanos downsampling
+// resolution. A zero duration disables the corresponding resolution.
+type Downsampling struct {
+	// FiveMinutesAfter is the range duration from which the 5m resolution
+	// is used.
+	FiveMinutesAfter time.Duration
+	// OneHourAfter is the range duration from which the 1h resolution is
+	// used.
+	OneHourAfter time.Duration
+}
+
+// WithAutoDownsampling sets the max_source_resolution parameter of the range
+// queries which don't specify it, depending on the queried range: the raw
+// data is read for short ranges and the 5m or 1h downsampled data for long
+// ranges. The upstream must be a Thanos querier.
+func WithAutoDownsampling(d Downsampling) Option {
+	return optionFunc(func(o *options) {
+		o.downsampling = &d
+	})
+}
+
+type resolutionSelector struct {
+	Downsampling
+	selections *prometheus.CounterVec
+}
+
+func newResolutionSelector(d Downsampling, reg prometheus.Registerer) (*resolutionSelector, error) {
+	if d.FiveMinutesAfter < 0 || d.OneHourAfter < 0 {
+		return nil, fmt.Errorf("the downsampling thresholds must be positive")
+	}
+
+	if d.FiveMinutesAfter > 0 && d.OneHourAfter > 0 && d.OneHourAfter < d.FiveMinutesAfter {
+		return nil, fmt.Errorf("the 1h downsampling threshold (%s) must be greater than the 5m threshold (%s)", d.OneHourAfter, d.FiveMinutesAfter)
+	}
+
+	return &resolutionSelector{
+		Downsampling: d,
+		selections: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_range_resolution_selections_total",
+			Help: "Total number of range queries for which the max_source_resolution parameter has been set, partitioned by resolution.",
+		}, []string{"resolution"}),
+	}, nil
+}
+
+// resolution returns the max_source_resolution value for the given range or
+// an empty string for the raw data.
+func (s *resolutionSelector) resolution(rng time.Duration) string {
+	switch {
+	case s.OneHourAfter > 0 && rng >= s.OneHourAfter:
+		return "1h"
+	case s.FiveMinutesAfter > 0 && rng >= s.FiveMinutesAfter:
+		return "5m"
+	}
+
+	return ""
+}
+
+// selectResolution sets the max_source_resolution parameter of the range
+// query if the client didn't before calling the next handler.
+func (r *routes) selectResolution(next http.HandlerFunc) http.HandlerFunc {
+	if r.resolutionSelector == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Form.Has(maxSourceResolutionParam) {
+			next(w, req)
+			return
+		}
+
+		qr, err := rangeFromRequest(req)
+		if err != nil {
+			// Let the upstream reject the incomplete requests.
+			next(w, req)
+			return
+		}
+
+		if res := r.resolutionSelector.resolution(qr.end.Sub(qr.start)); res != "" {
+			addParam(req, maxSourceResolutionParam, res)
+			r.resolutionSelector.selections.WithLabelValues(res).Inc()
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectResolution(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		downsampling Downsampling
+		method       string
+		params       url.Values
+
+		expResolution string
+	}{
+		{
+			name:         "short range",
+			downsampling: Downsampling{FiveMinutesAfter: 24 * time.Hour, OneHourAfter: 7 * 24 * time.Hour},
+			params:       url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"60"}},
+		},
+		{
+			name:          "medium range",
+			downsampling:  Downsampling{FiveMinutesAfter: 24 * time.Hour, OneHourAfter: 7 * 24 * time.Hour},
+			params:        url.Values{"start": []string{"2024-01-01T00:00:00Z"}, "end": []string{"2024-01-03T00:00:00Z"}, "step": []string{"5m"}},
+			expResolution: "5m",
+		},
+		{
+			name:          "long range",
+			downsampling:  Downsampling{FiveMinutesAfter: 24 * time.Hour, OneHourAfter: 7 * 24 * time.Hour},
+			method:        http.MethodPost,
+			params:        url.Values{"start": []string{"0"}, "end": []string{"2592000"}, "step": []string{"3600"}},
+			expResolution: "1h",
+		},
+		{
+			name:          "long range without the 1h resolution",
+			downsampling:  Downsampling{FiveMinutesAfter: 24 * time.Hour},
+			params:        url.Values{"start": []string{"0"}, "end": []string{"2592000"}, "step": []string{"3600"}},
+			expResolution: "5m",
+		},
+		{
+			name:          "resolution set by the client",
+			downsampling:  Downsampling{FiveMinutesAfter: 24 * time.Hour},
+			params:        url.Values{"start": []string{"0"}, "end": []string{"2592000"}, "step": []string{"3600"}, "max_source_resolution": []string{"0s"}},
+			expResolution: "0s",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				got = req.Form.Get("max_source_resolution")
+				io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithAutoDownsampling(tc.downsampling))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			params := url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range", strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if got != tc.expResolution {
+				t.Fatalf("expected resolution %q, got %q", tc.expResolution, got)
+			}
+		})
+	}
+
+	if _, err := NewRoutes(&url.URL{}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithAutoDownsampling(Downsampling{FiveMinutesAfter: time.Hour, OneHourAfter: time.Minute})); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WithRangeToInstantConversion converts the range queries returning a single
+// point per series (start equal to end or step greater than end-start) into
+// instant queries evaluated at the start time, which is the only evaluation
+// timestamp of such range queries. The instant vector returned by the
+// upstream is converted back to a range vector.
+func WithRangeToInstantConversion() Option {
+	return optionFunc(func(o *options) {
+		o.rangeToInstant = true
+	})
+}
+
+func newRangeConversions(reg prometheus.Registerer) *prometheus.CounterVec {
+	return promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "query_range_instant_conversions_total",
+		Help: "Total number of single-point range queries converted to instant queries.",
+	}, []string{"tenant"})
+}
+
+// downshiftRange converts the single-point range queries to instant queries
+// before calling the next handler.
+func (r *routes) downshiftRange(next http.HandlerFunc) http.HandlerFunc {
+	if r.rangeConversions == nil {
+		return next
+	}
+
+	return r.rollOut(RuleRangeToInstant, func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		qr, err := rangeFromRequest(req)
+		if err != nil {
+			// Let the upstream reject the incomplete requests.
+			next(w, req)
+			return
+		}
+
+		if !qr.start.Equal(qr.end) && qr.step <= qr.end.Sub(qr.start) {
+			next(w, req)
+			return
+		}
+
+		ts := req.Form.Get(startParam)
+		for _, p := range []string{startParam, endParam, stepParam} {
+			delParam(req, p)
+		}
+		addParam(req, timeParam, ts)
+
+		if rc := RequestContextFrom(req.Context()); rc != nil {
+			rc.rangeToInstant.Store(true)
+			rc.AddDecision("downshift", DecisionRangeToInstant)
+		}
+		req.URL.Path = strings.TrimSuffix(req.URL.Path, "_range")
+		req.URL.RawPath = ""
+		r.rangeConversions.WithLabelValues(strings.Join(MustLabelValues(req.Context()), ",")).Inc()
+
+		next(w, req)
+	}, next)
+}
+
+// instantToRange converts the response of an instant query which replaced a
+// range query into a range query response.
+func instantToRange(resp *http.Response) error {
+	if rc := RequestContextFrom(resp.Request.Context()); rc == nil || !rc.rangeToInstant.Load() || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	apir, err := getAPIResponse(resp)
+	if err != nil {
+		return fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	var data struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(apir.Data, &data); err != nil {
+		return fmt.Errorf("can't decode the query result: %w", err)
+	}
+
+	var series []map[string]json.RawMessage
+	switch data.ResultType {
+	case "vector":
+		if err := json.Unmarshal(data.Result, &series); err != nil {
+			return fmt.Errorf("can't decode the instant vector: %w", err)
+		}
+	case "scalar":
+		series = []map[string]json.RawMessage{{
+			"metric": json.RawMessage(`{}`),
+			"value":  data.Result,
+		}}
+	default:
+		return fmt.Errorf("unexpected result type %q", data.ResultType)
+	}
+
+	for _, s := range series {
+		for from, to := range map[string]string{"value": "values", "histogram": "histograms"} {
+			if v, found := s[from]; found {
+				s[to] = append(append(json.RawMessage(`[`), v...), ']')
+				delete(s, from)
+			}
+		}
+	}
+
+	if series == nil {
+		series = []map[string]json.RawMessage{}
+	}
+	if apir.Data, err = json.Marshal(map[string]any{"resultType": "matrix", "result": series}); err != nil {
+		return fmt.Errorf("can't encode the query result: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(apir); err != nil {
+		return fmt.Errorf("can't encode the response: %w", err)
+	}
+	resp.Body = io.NopCloser(&buf)
+	resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRangeToInstantConversion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		params   url.Values
+		upstream string
+
+		expPath   string
+		expParams string
+		expBody   string
+	}{
+		{
+			name:      "multiple points",
+			params:    url.Values{"start": []string{"0"}, "end": []string{"10"}, "step": []string{"10"}},
+			upstream:  `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			expPath:   "/api/v1/query_range",
+			expParams: "end=10&query=up%7Bnamespace%3D%22ns1%22%7D&start=0&step=10",
+			expBody:   `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+		},
+		{
+			name:      "step greater than the range",
+			params:    url.Values{"start": []string{"0"}, "end": []string{"10"}, "step": []string{"15"}},
+			upstream:  `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[0,"1"]},{"metric":{"job":"b"},"histogram":[0,{"count":"1"}]}]}}`,
+			expPath:   "/api/v1/query",
+			expParams: "query=up%7Bnamespace%3D%22ns1%22%7D&time=0",
+			expBody:   `{"status":"success","data":{"result":[{"metric":{"job":"a"},"values":[[0,"1"]]},{"histograms":[[0,{"count":"1"}]],"metric":{"job":"b"}}],"resultType":"matrix"}}`,
+		},
+		{
+			name:      "start equal to end",
+			method:    http.MethodPost,
+			params:    url.Values{"start": []string{"5"}, "end": []string{"5"}, "step": []string{"1"}},
+			upstream:  `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["w"]}`,
+			expPath:   "/api/v1/query",
+			expParams: "query=up%7Bnamespace%3D%22ns1%22%7D&time=5",
+			expBody:   `{"status":"success","data":{"result":[],"resultType":"matrix"},"warnings":["w"]}`,
+		},
+		{
+			name:      "scalar",
+			params:    url.Values{"start": []string{"5"}, "end": []string{"5"}, "step": []string{"1"}},
+			upstream:  `{"status":"success","data":{"resultType":"scalar","result":[5,"1"]}}`,
+			expPath:   "/api/v1/query",
+			expParams: "query=up%7Bnamespace%3D%22ns1%22%7D&time=5",
+			expBody:   `{"status":"success","data":{"result":[{"metric":{},"values":[[5,"1"]]}],"resultType":"matrix"}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotPath, gotParams string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				gotPath, gotParams = req.URL.Path, req.Form.Encode()
+				io.WriteString(w, tc.upstream)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRangeToInstantConversion())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			params := url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range", strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if gotPath != tc.expPath {
+				t.Fatalf("expected path %q, got %q", tc.expPath, gotPath)
+			}
+
+			if gotParams != tc.expParams {
+				t.Fatalf("expected parameters %q, got %q", tc.expParams, gotParams)
+			}
+
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body %s, got %s", tc.expBody, got)
+			}
+		})
+	}
+}
@@ -25,6 +25,8 @@ import (
 type PromQLEnforcer struct {
 	labelMatchers  map[string]*labels.Matcher
 	errorOnReplace bool
+	// postAggregation, if not nil, wraps the enforced expression.
+	postAggregation *PostAggregation
 }
 
 func NewPromQLEnforcer(errorOnReplace bool, ms ...*labels.Matcher) *PromQLEnforcer {
@@ -66,6 +68,13 @@ func (ms *PromQLEnforcer) Enforce(q string) (string, error) {
 		return "", fmt.Errorf("%w: %w", ErrEnforceLabel, err)
 	}
 
+	if ms.postAggregation != nil {
+		expr, err = ms.postAggregation.wrap(expr)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	return expr.String(), nil
 }
 
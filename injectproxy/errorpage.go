@@ -0,0 +1,112 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrorPageData is the data passed to the error templates.
+type ErrorPageData struct {
+	// Status is the HTTP status code.
+	Status int
+	// StatusText is the text of the HTTP status code.
+	StatusText string
+	// Path is the requested path.
+	Path string
+	// Reason is the machine-readable reason of the error.
+	Reason RejectionReason
+}
+
+// ErrorTemplateFuncs are the functions available to the JSON error
+// templates: json encodes a value as JSON (e.g. {{ json .StatusText }}).
+var ErrorTemplateFuncs = texttemplate.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+var (
+	defaultHTMLErrorTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{ .Status }} {{ .StatusText }}</title></head>
+<body>
+<h1>{{ .Status }} {{ .StatusText }}</h1>
+<p>The server behind the proxy failed to serve {{ .Path }}. Please try again later.</p>
+</body>
+</html>
+`))
+	defaultJSONErrorTemplate = texttemplate.Must(texttemplate.New("json").Funcs(ErrorTemplateFuncs).Parse(
+		`{"status":"error","errorType":"prom-label-proxy","error":{{ json .StatusText }},"reason":{{ json .Reason }}}` + "\n",
+	))
+)
+
+// WithErrorTemplates configures the templates of the responses returned when
+// the proxy fails to reach the upstream or to process its response. The
+// JSON template is used for the API paths (under /api/) and the HTML
+// template for the other paths (e.g. /graph). The templates receive an
+// ErrorPageData. A nil template keeps the default one.
+func WithErrorTemplates(html *htmltemplate.Template, json *texttemplate.Template) Option {
+	return optionFunc(func(o *options) {
+		if html != nil {
+			o.htmlErrorTemplate = html
+		}
+		if json != nil {
+			o.jsonErrorTemplate = json
+		}
+	})
+}
+
+// errorPage writes the error response with the template matching the
+// request path.
+func (r *routes) errorPage(w http.ResponseWriter, req *http.Request, status int, reason RejectionReason) {
+	data := ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Path:       req.URL.Path,
+		Reason:     reason,
+	}
+
+	w.Header().Set(RejectionReasonHeader, string(reason))
+
+	var (
+		buf         bytes.Buffer
+		err         error
+		contentType string
+	)
+	if strings.HasPrefix(req.URL.Path, "/api/") {
+		contentType = "application/json; charset=utf-8"
+		err = r.jsonErrorTemplate.Execute(&buf, data)
+	} else {
+		contentType = "text/html; charset=utf-8"
+		err = r.htmlErrorTemplate.Execute(&buf, data)
+	}
+
+	if err != nil {
+		r.logger.Printf("error: Failed to execute the error template: %v", err)
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+)
+
+func TestErrorPage(t *testing.T) {
+	// The upstream is closed to trigger proxy errors.
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		url  string
+
+		expContentType string
+		expBody        string
+	}{
+		{
+			name:           "default HTML page",
+			url:            "http://prometheus.example.com/graph",
+			expContentType: "text/html; charset=utf-8",
+			expBody:        "<p>The server behind the proxy failed to serve /graph. Please try again later.</p>",
+		},
+		{
+			name:           "default JSON response",
+			url:            "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			expContentType: "application/json; charset=utf-8",
+			expBody:        `{"status":"error","errorType":"prom-label-proxy","error":"Bad Gateway","reason":"upstream_error"}`,
+		},
+		{
+			name: "custom HTML page",
+			opts: []Option{WithErrorTemplates(
+				htmltemplate.Must(htmltemplate.New("").Parse(`<p>{{ .Status }} on {{ .Path }}</p>`)),
+				nil,
+			)},
+			url:            "http://prometheus.example.com/graph?g0.expr=%3Cscript%3E",
+			expContentType: "text/html; charset=utf-8",
+			expBody:        "<p>502 on /graph</p>",
+		},
+		{
+			name: "custom JSON response",
+			opts: []Option{WithErrorTemplates(
+				nil,
+				texttemplate.Must(texttemplate.New("").Parse(`{"code":{{ .Status }}}`)),
+			)},
+			url:            "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			expContentType: "application/json; charset=utf-8",
+			expBody:        `{"code":502}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]Option{WithPassthroughPaths([]string{"/graph"})}, tc.opts...)
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadGateway, w.Code)
+			}
+
+			if got := w.Header().Get("Content-Type"); got != tc.expContentType {
+				t.Fatalf("expected content type %q, got %q", tc.expContentType, got)
+			}
+
+			if !strings.Contains(w.Body.String(), tc.expBody) {
+				t.Fatalf("expected body to contain %q, got %q", tc.expBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDefaultJSONErrorTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := defaultJSONErrorTemplate.Execute(&buf, ErrorPageData{
+		Status:     http.StatusTeapot,
+		StatusText: http.StatusText(http.StatusTeapot),
+		Path:       "/api/v1/query",
+		Reason:     `a "quoted" <reason>`,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if got.Error != "I'm a teapot" || got.Reason != `a "quoted" <reason>` {
+		t.Fatalf("unexpected response %q", buf.String())
+	}
+}
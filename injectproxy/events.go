@@ -0,0 +1,198 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// EventType is the type of a capacity event.
+type EventType string
+
+const (
+	// EventLimitDecreased is emitted when a concurrency limit is lowered.
+	EventLimitDecreased EventType = "limit_decreased"
+	// EventLimitIncreased is emitted when a concurrency limit is raised.
+	EventLimitIncreased EventType = "limit_increased"
+	// EventLimitReached is emitted when requests start being rejected
+	// because a concurrency limit is reached.
+	EventLimitReached EventType = "limit_reached"
+	// EventCircuitOpened is emitted when the upstream circuit breaker
+	// opens.
+	EventCircuitOpened EventType = "circuit_opened"
+	// EventCircuitClosed is emitted when the upstream circuit breaker
+	// closes after successful probes.
+	EventCircuitClosed EventType = "circuit_closed"
+	// EventTenantOnboarded is emitted the first time a tenant is seen.
+	EventTenantOnboarded EventType = "tenant_onboarded"
+	// EventTenantDisabled is emitted when a tenant is disabled with the
+	// admin API.
+	EventTenantDisabled EventType = "tenant_disabled"
+	// EventTenantEnabled is emitted when a disabled tenant is enabled again
+	// with the admin API.
+	EventTenantEnabled EventType = "tenant_enabled"
+	// EventExemptionIssued is emitted when an exemption token is issued
+	// with the admin API.
+	EventExemptionIssued EventType = "exemption_issued"
+)
+
+// Event records a capacity decision taken by the proxy.
+type Event struct {
+	Time          time.Time `json:"time"`
+	Type          EventType `json:"type"`
+	Tenant        string    `json:"tenant,omitempty"`
+	Handler       string    `json:"handler,omitempty"`
+	Limit         int       `json:"limit,omitempty"`
+	PreviousLimit int       `json:"previousLimit,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	// Source identifies who triggered the event (e.g. the remote address
+	// of an admin API request).
+	Source string `json:"source,omitempty"`
+}
+
+// EventSink receives the capacity events. Emit is called synchronously on
+// the request path and must not block.
+type EventSink interface {
+	Emit(Event)
+}
+
+// WithEventSink sends the capacity events to the given sink.
+func WithEventSink(s EventSink) Option {
+	return optionFunc(func(o *options) {
+		o.eventSink = s
+	})
+}
+
+// LogEventSink writes the events as JSON lines to a logger.
+type LogEventSink struct {
+	logger *log.Logger
+}
+
+// NewLogEventSink returns a sink writing the events to the logger.
+func NewLogEventSink(l *log.Logger) *LogEventSink {
+	return &LogEventSink{logger: l}
+}
+
+// Emit implements the EventSink interface.
+func (s *LogEventSink) Emit(e Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.logger.Printf("event: %s", b)
+}
+
+// defaultWebhookQueueSize is the maximum number of events waiting to be
+// sent to the webhook.
+const defaultWebhookQueueSize = 1000
+
+// WebhookEventSink sends the events in batches to a webhook. Events are
+// dropped when the queue is full.
+type WebhookEventSink struct {
+	url    *url.URL
+	client *http.Client
+	logger *log.Logger
+	queue  chan Event
+}
+
+// NewWebhookEventSink returns a sink POSTing the events as a JSON array to
+// the URL. The events are only sent after Run has been called.
+func NewWebhookEventSink(u *url.URL, client *http.Client) *WebhookEventSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &WebhookEventSink{
+		url:    u,
+		client: client,
+		logger: log.Default(),
+		queue:  make(chan Event, defaultWebhookQueueSize),
+	}
+}
+
+// Emit implements the EventSink interface.
+func (s *WebhookEventSink) Emit(e Event) {
+	select {
+	case s.queue <- e:
+	default:
+	}
+}
+
+// Run sends the queued events every interval until the context is
+// cancelled.
+func (s *WebhookEventSink) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := s.Flush(ctx); err != nil {
+				s.logger.Printf("failed to send events: %v", err)
+			}
+		}
+	}
+}
+
+// Flush sends the queued events.
+func (s *WebhookEventSink) Flush(ctx context.Context) error {
+	var events []Event
+	for len(events) < defaultWebhookQueueSize {
+		select {
+		case e := <-s.queue:
+			events = append(events, e)
+			continue
+		default:
+		}
+		break
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type recordingSink struct {
+	events []Event
+}
+
+func (s *recordingSink) Emit(e Event) {
+	s.events = append(s.events, e)
+}
+
+func TestLatencyBudgeterEvents(t *testing.T) {
+	sink := &recordingSink{}
+	b, err := newLatencyBudgeter(LatencyBudgets{Default: time.Second, MaxConcurrency: 2}, sink, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	for i := 0; i < budgetEvalEvery; i++ {
+		b.acquire(context.Background(), k)
+		b.release(k, 2*time.Second, false)
+	}
+
+	// Only the first rejection emits an event.
+	b.acquire(context.Background(), k)
+	b.acquire(context.Background(), k)
+	b.acquire(context.Background(), k)
+	b.release(k, 0, false)
+
+	for i := 0; i < budgetEvalEvery-1; i++ {
+		b.acquire(context.Background(), k)
+		b.release(k, 0, false)
+	}
+
+	exp := []Event{
+		{Time: now, Type: EventLimitDecreased, Tenant: "ns1", Handler: "/api/v1/query", Limit: 1, PreviousLimit: 2},
+		{Time: now, Type: EventLimitReached, Tenant: "ns1", Handler: "/api/v1/query", Limit: 1},
+		{Time: now, Type: EventLimitIncreased, Tenant: "ns1", Handler: "/api/v1/query", Limit: 2, PreviousLimit: 1},
+	}
+	if !reflect.DeepEqual(exp, sink.events) {
+		t.Fatalf("expected events %+v, got %+v", exp, sink.events)
+	}
+}
+
+func TestLogEventSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewLogEventSink(log.New(&buf, "", 0))
+	s.Emit(Event{Time: time.Unix(0, 0).UTC(), Type: EventLimitReached, Tenant: "ns1", Limit: 1})
+
+	exp := `event: {"time":"1970-01-01T00:00:00Z","type":"limit_reached","tenant":"ns1","limit":1}`
+	if got := strings.TrimSpace(buf.String()); got != exp {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestWebhookEventSink(t *testing.T) {
+	var got [][]Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var events []Event
+		if err := json.NewDecoder(req.Body).Decode(&events); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, events)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := NewWebhookEventSink(u, nil)
+
+	// Nothing is sent when the queue is empty.
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no request, got %d", len(got))
+	}
+
+	for i := 0; i < defaultWebhookQueueSize+1; i++ {
+		s.Emit(Event{Type: EventLimitIncreased, Limit: i})
+	}
+
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(got))
+	}
+
+	// The event overflowing the queue has been dropped.
+	if len(got[0]) != defaultWebhookQueueSize {
+		t.Fatalf("expected %d events, got %d", defaultWebhookQueueSize, len(got[0]))
+	}
+}
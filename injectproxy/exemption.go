@@ -0,0 +1,312 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// ExemptionTokensPath is the path of the exemption tokens endpoint.
+	ExemptionTokensPath = "/-/exemption-tokens"
+
+	// ExemptionHeader is the request header holding an exemption token.
+	ExemptionHeader = "X-Prom-Label-Proxy-Exemption"
+)
+
+var (
+	errInvalidExemption         = errors.New("invalid exemption token")
+	errExemptionWithoutSubject  = errors.New("the exemption tokens require the authorization subject header")
+	errExemptionTTLOutOfBounds  = errors.New("the exemption TTL must be positive and not exceed the maximum TTL")
+	errExemptionMissingArgument = errors.New(`the "tenant", "user" and "reason" parameters must be provided`)
+)
+
+// Exemption lets a user bypass the range and cost limits of a tenant (the
+// maximum lookback, the selector limits, the federation limits, the step
+// policy and the maximum number of points) until it expires.
+type Exemption struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	User      string    `json:"user"`
+	Reason    string    `json:"reason"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ExemptionTokens issues and verifies the exemption tokens. The tokens are
+// signed with HMAC-SHA256 so that all the replicas sharing the key accept
+// them without sharing any state. It implements http.Handler to serve the
+// ExemptionTokensPath endpoint: a POST request with the "tenant", "user",
+// "reason" and optional "ttl" parameters returns a new token.
+//
+// The issued tokens are recorded as exemption_issued events and the
+// requests using them are recorded with the exemption ID in the audit log.
+// The endpoint isn't protected, it should be exposed to the administrators
+// only (e.g. on the internal listen address).
+type ExemptionTokens struct {
+	key    []byte
+	maxTTL time.Duration
+	events EventSink
+	now    func() time.Time
+}
+
+// NewExemptionTokens returns the exemption tokens signed with the given key.
+// The TTL of the tokens can't exceed maxTTL. The issued tokens are recorded
+// to the event sink. If nil, they are logged with the default logger.
+func NewExemptionTokens(key []byte, maxTTL time.Duration, events EventSink) (*ExemptionTokens, error) {
+	if len(key) == 0 {
+		return nil, errors.New("the exemption signing key must not be empty")
+	}
+
+	if maxTTL <= 0 {
+		return nil, fmt.Errorf("the maximum exemption TTL must be positive, got %s", maxTTL)
+	}
+
+	if events == nil {
+		events = NewLogEventSink(log.Default())
+	}
+
+	return &ExemptionTokens{
+		key:    key,
+		maxTTL: maxTTL,
+		events: events,
+		now:    time.Now,
+	}, nil
+}
+
+// WithExemptionTokens lets the requests with a valid exemption token in the
+// ExemptionHeader header bypass the range and cost limits. A token is only
+// valid for the tenant and the user (see WithAuthorizationSubjectHeader) it
+// was issued for. The requests with an invalid token are rejected.
+func WithExemptionTokens(t *ExemptionTokens) Option {
+	return optionFunc(func(o *options) {
+		o.exemptionTokens = t
+	})
+}
+
+func (t *ExemptionTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a new token exempting the user's requests for the tenant
+// during the TTL. The source identifies who issued the token.
+func (t *ExemptionTokens) Issue(tenant, user, reason string, ttl time.Duration, source string) (string, Exemption, error) {
+	if tenant == "" || user == "" || reason == "" {
+		return "", Exemption{}, errExemptionMissingArgument
+	}
+
+	if ttl <= 0 || ttl > t.maxTTL {
+		return "", Exemption{}, fmt.Errorf("%w (%s), got %s", errExemptionTTLOutOfBounds, t.maxTTL, ttl)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", Exemption{}, err
+	}
+
+	now := t.now()
+	e := Exemption{
+		ID:        hex.EncodeToString(id),
+		Tenant:    tenant,
+		User:      user,
+		Reason:    reason,
+		IssuedAt:  now.UTC().Truncate(time.Second),
+		ExpiresAt: now.Add(ttl).UTC().Truncate(time.Second),
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", Exemption{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+
+	t.events.Emit(Event{
+		Time:    now,
+		Type:    EventExemptionIssued,
+		Tenant:  tenant,
+		Message: fmt.Sprintf("exemption %s for user %q until %s: %s", e.ID, user, e.ExpiresAt.Format(time.RFC3339), reason),
+		Source:  source,
+	})
+
+	return payload + "." + t.sign(payload), e, nil
+}
+
+// verify returns the exemption of a valid token.
+func (t *ExemptionTokens) verify(token string) (Exemption, error) {
+	var e Exemption
+
+	payload, sig, found := strings.Cut(token, ".")
+	if !found {
+		return e, fmt.Errorf("%w: malformed token", errInvalidExemption)
+	}
+
+	if !hmac.Equal([]byte(t.sign(payload)), []byte(sig)) {
+		return e, fmt.Errorf("%w: signature mismatch", errInvalidExemption)
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return e, fmt.Errorf("%w: malformed token", errInvalidExemption)
+	}
+
+	if err := json.Unmarshal(b, &e); err != nil {
+		return e, fmt.Errorf("%w: malformed token", errInvalidExemption)
+	}
+
+	if !t.now().Before(e.ExpiresAt) {
+		return e, fmt.Errorf("%w: expired at %s", errInvalidExemption, e.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return e, nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (t *ExemptionTokens) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		prometheusAPIError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := t.maxTTL
+	if v := req.Form.Get("ttl"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	token, e, err := t.Issue(req.Form.Get("tenant"), req.Form.Get("user"), req.Form.Get("reason"), ttl, "api:"+req.RemoteAddr)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(struct {
+		Token     string    `json:"token"`
+		Exemption Exemption `json:"exemption"`
+	}{token, e})
+}
+
+type exemptionChecker struct {
+	tokens *ExemptionTokens
+
+	requests *prometheus.CounterVec
+}
+
+func newExemptionChecker(t *ExemptionTokens, reg prometheus.Registerer) *exemptionChecker {
+	return &exemptionChecker{
+		tokens: t,
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "exemption_token_requests_total",
+			Help: "Total number of requests with an exemption token, partitioned by handler and result (exempted or rejected).",
+		}, []string{"handler", "result"}),
+	}
+}
+
+// exempted returns true if the request has a valid exemption token.
+func exempted(ctx context.Context) bool {
+	return RequestContextFrom(ctx).Exemption() != nil
+}
+
+// checkExemptions verifies the exemption tokens and records the exemption
+// in the audit entry before calling the next handler.
+func (r *routes) checkExemptions(next http.HandlerFunc) http.HandlerFunc {
+	if r.exemptions == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := req.Header.Get(ExemptionHeader)
+		if token == "" {
+			next(w, req)
+			return
+		}
+
+		// The token mustn't reach the upstream.
+		req.Header.Del(ExemptionHeader)
+
+		handler := handlerName(req.Context())
+		e, err := r.exemptions.tokens.verify(token)
+		if err == nil {
+			tenants := MustLabelValues(req.Context())
+			switch {
+			case len(tenants) != 1 || tenants[0] != e.Tenant:
+				err = fmt.Errorf("%w: not valid for tenant(s) %q", errInvalidExemption, strings.Join(tenants, ","))
+			case req.Header.Get(r.subjectHeader) != e.User:
+				err = fmt.Errorf("%w: not valid for this user", errInvalidExemption)
+			}
+		}
+		if err != nil {
+			r.exemptions.requests.WithLabelValues(handler, "rejected").Inc()
+			rejectRequest(w, ReasonInvalidExemption, err.Error(), http.StatusForbidden)
+			return
+		}
+		r.exemptions.requests.WithLabelValues(handler, "exempted").Inc()
+
+		rc := RequestContextFrom(req.Context())
+		if ae := rc.auditEntry(); ae != nil {
+			ae.Exemption = e.ID
+		}
+		rc.setExemption(e)
+		rc.AddDecision("exemption", DecisionExempted)
+
+		next(w, req)
+	}
+}
+
+// exemptable lets the requests with a valid exemption token bypass the
+// given limit.
+func (r *routes) exemptable(limit func(http.HandlerFunc) http.HandlerFunc) func(http.HandlerFunc) http.HandlerFunc {
+	if r.exemptions == nil {
+		return limit
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		limited := limit(next)
+		return func(w http.ResponseWriter, req *http.Request) {
+			if exempted(req.Context()) {
+				next(w, req)
+				return
+			}
+
+			limited(w, req)
+		}
+	}
+}
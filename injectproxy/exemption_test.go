@@ -0,0 +1,247 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExemptionTokens(t *testing.T) {
+	sink := &recordingSink{}
+	tokens, err := NewExemptionTokens([]byte("secret"), time.Hour, sink)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	tokens.now = func() time.Time { return now }
+
+	token, e, err := tokens.Issue("ns1", "alice", "incident 42", 10*time.Minute, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sink.events) != 1 || sink.events[0].Type != EventExemptionIssued || sink.events[0].Tenant != "ns1" {
+		t.Fatalf("unexpected events %+v", sink.events)
+	}
+
+	other, err := NewExemptionTokens([]byte("other"), time.Hour, sink)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other.now = tokens.now
+
+	payload, sig, _ := strings.Cut(token, ".")
+	for _, tc := range []struct {
+		name   string
+		tokens *ExemptionTokens
+		token  string
+		at     time.Time
+
+		expErr bool
+	}{
+		{
+			name:  "valid",
+			token: token,
+			at:    now.Add(5 * time.Minute),
+		},
+		{
+			name:   "expired",
+			token:  token,
+			at:     now.Add(10 * time.Minute),
+			expErr: true,
+		},
+		{
+			name:   "other key",
+			tokens: other,
+			token:  token,
+			at:     now,
+			expErr: true,
+		},
+		{
+			name:   "tampered payload",
+			token:  payload + "x." + sig,
+			at:     now,
+			expErr: true,
+		},
+		{
+			name:   "malformed",
+			token:  "garbage",
+			at:     now,
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := tokens
+			if tc.tokens != nil {
+				v = tc.tokens
+			}
+			v.now = func() time.Time { return tc.at }
+
+			got, err := v.verify(tc.token)
+			if tc.expErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expErr, err)
+			}
+			if err != nil {
+				if !errors.Is(err, errInvalidExemption) {
+					t.Fatalf("expected %v, got %v", errInvalidExemption, err)
+				}
+				return
+			}
+
+			if got != e {
+				t.Fatalf("expected exemption %+v, got %+v", e, got)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		tenant, user, reason string
+		ttl                  time.Duration
+	}{
+		{user: "alice", reason: "incident", ttl: time.Minute},
+		{tenant: "ns1", user: "alice", ttl: time.Minute},
+		{tenant: "ns1", user: "alice", reason: "incident", ttl: 2 * time.Hour},
+	} {
+		if _, _, err := tokens.Issue(tc.tenant, tc.user, tc.reason, tc.ttl, "test"); err == nil {
+			t.Fatalf("expected an error for %+v", tc)
+		}
+	}
+}
+
+func TestExemptionRoutes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(ExemptionHeader) != "" {
+			t.Errorf("the exemption token reached the upstream")
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	tokens, err := NewExemptionTokens([]byte("secret"), time.Hour, &recordingSink{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Issue a token with the admin API.
+	req := httptest.NewRequest(http.MethodPost, ExemptionTokensPath, strings.NewReader(url.Values{
+		"tenant": []string{"ns1"},
+		"user":   []string{"alice"},
+		"reason": []string{"incident 42"},
+		"ttl":    []string{"10m"},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	tokens.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var issued struct {
+		Token     string    `json:"token"`
+		Exemption Exemption `json:"exemption"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &issued); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sink := &recordingAuditSink{}
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithMaxLookback(MaxLookback{Duration: 10 * time.Hour, Mode: LookbackReject}),
+		WithAuthorizationSubjectHeader("X-User"),
+		WithExemptionTokens(tokens),
+		WithAuditSink(sink),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tenant string
+		user   string
+		token  string
+
+		expCode      int
+		expExemption string
+	}{
+		{
+			name:    "no token",
+			tenant:  "ns1",
+			user:    "alice",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:         "valid token",
+			tenant:       "ns1",
+			user:         "alice",
+			token:        issued.Token,
+			expCode:      http.StatusOK,
+			expExemption: issued.Exemption.ID,
+		},
+		{
+			name:    "other user",
+			tenant:  "ns1",
+			user:    "bob",
+			token:   issued.Token,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "other tenant",
+			tenant:  "ns2",
+			user:    "alice",
+			token:   issued.Token,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "invalid token",
+			tenant:  "ns1",
+			user:    "alice",
+			token:   "garbage",
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{
+				"query":    []string{"up @ 1000"},
+				proxyLabel: []string{tc.tenant},
+			}.Encode(), nil)
+			req.Header.Set("X-User", tc.user)
+			if tc.token != "" {
+				req.Header.Set(ExemptionHeader, tc.token)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if got := sink.entries[len(sink.entries)-1].Exemption; got != tc.expExemption {
+				t.Fatalf("expected exemption %q in the audit entry, got %q", tc.expExemption, got)
+			}
+		})
+	}
+
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithExemptionTokens(tokens)); !errors.Is(err, errExemptionWithoutSubject) {
+		t.Fatalf("expected %v, got %v", errExemptionWithoutSubject, err)
+	}
+}
@@ -0,0 +1,632 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ExportsPath is the path of the export jobs API.
+const ExportsPath = "/api/v1/exports"
+
+const (
+	defaultExportPageInterval   = time.Hour
+	defaultExportPagesPerSecond = 1
+	defaultExportMaxJobs        = 100
+	defaultExportRetention      = time.Hour
+	defaultExportMaxResultBytes = 64 << 20
+
+	formatParam = "format"
+)
+
+var errTooManyExports = errors.New("too many export jobs")
+
+// ExportFormat is the format of an export result.
+type ExportFormat string
+
+const (
+	// ExportNDJSON writes one JSON object per series and page, with the
+	// same "metric", "values" and "histograms" fields as the range query
+	// API.
+	ExportNDJSON ExportFormat = "ndjson"
+	// ExportCSV writes one "series,timestamp,value" row per sample. The
+	// native histogram samples are skipped.
+	ExportCSV ExportFormat = "csv"
+)
+
+// ExportStatus is the status of an export job.
+type ExportStatus string
+
+const (
+	ExportPending   ExportStatus = "pending"
+	ExportRunning   ExportStatus = "running"
+	ExportCompleted ExportStatus = "completed"
+	ExportFailed    ExportStatus = "failed"
+	ExportCanceled  ExportStatus = "canceled"
+)
+
+// BulkExports configures the export jobs.
+type BulkExports struct {
+	// PageInterval is the time range of the sub-queries executed by the
+	// jobs. If zero, 1h is used.
+	PageInterval time.Duration
+	// PagesPerSecond is the maximum rate of sub-queries, shared by all the
+	// jobs. If zero, 1 is used.
+	PagesPerSecond float64
+	// MaxJobs is the maximum number of jobs, running or retained. If zero,
+	// 100 is used.
+	MaxJobs int
+	// Retention is how long the finished jobs and their result are kept.
+	// If zero, 1h is used.
+	Retention time.Duration
+	// MaxResultBytes fails the jobs whose result grows larger. If zero,
+	// 64MiB is used.
+	MaxResultBytes int64
+}
+
+// WithBulkExports enables the export jobs API at ExportsPath. Instead of
+// running a range query over a long period at once, the clients submit an
+// export job which the proxy executes in the background as sequential
+// sub-queries of PageInterval each, at the configured rate, through the same
+// handlers as the /api/v1/query_range endpoint. The jobs are only visible to
+// the tenants which submitted them:
+//
+//   - POST with the "query", "start", "end", "step" and optional "format"
+//     (ndjson or csv) parameters submits a job.
+//   - GET lists the jobs.
+//   - GET <ExportsPath>/<id> returns the job and its progress.
+//   - GET <ExportsPath>/<id>/result downloads the result of a completed job.
+//   - DELETE <ExportsPath>/<id> cancels the job and deletes its result.
+//
+// The results are kept in memory.
+func WithBulkExports(c BulkExports) Option {
+	return optionFunc(func(o *options) {
+		o.bulkExports = &c
+	})
+}
+
+// ExportJob describes an export job.
+type ExportJob struct {
+	ID         string       `json:"id"`
+	Tenants    []string     `json:"tenants"`
+	Query      string       `json:"query"`
+	Start      time.Time    `json:"start"`
+	End        time.Time    `json:"end"`
+	Step       string       `json:"step"`
+	Format     ExportFormat `json:"format"`
+	Status     ExportStatus `json:"status"`
+	Pages      int          `json:"pages"`
+	PagesDone  int          `json:"pagesDone"`
+	Bytes      int64        `json:"bytes"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+}
+
+type exportJob struct {
+	ExportJob
+	cancel context.CancelFunc
+	// result is only written by the job and read once it is completed.
+	result bytes.Buffer
+}
+
+// exporter runs the export jobs.
+type exporter struct {
+	config BulkExports
+	// query serves the sub-queries.
+	query http.HandlerFunc
+	now   func() time.Time
+
+	mtx  sync.Mutex
+	jobs map[string]*exportJob
+	// nextPage is the earliest time of the next sub-query.
+	nextPage time.Time
+
+	jobsTotal *prometheus.CounterVec
+	running   prometheus.Gauge
+	pages     *prometheus.CounterVec
+}
+
+func newExporter(c BulkExports, reg prometheus.Registerer) (*exporter, error) {
+	if c.PageInterval < 0 || c.PagesPerSecond < 0 || c.MaxJobs < 0 || c.Retention < 0 || c.MaxResultBytes < 0 {
+		return nil, errors.New("the export settings must not be negative")
+	}
+	if c.PageInterval == 0 {
+		c.PageInterval = defaultExportPageInterval
+	}
+	if c.PagesPerSecond == 0 {
+		c.PagesPerSecond = defaultExportPagesPerSecond
+	}
+	if c.MaxJobs == 0 {
+		c.MaxJobs = defaultExportMaxJobs
+	}
+	if c.Retention == 0 {
+		c.Retention = defaultExportRetention
+	}
+	if c.MaxResultBytes == 0 {
+		c.MaxResultBytes = defaultExportMaxResultBytes
+	}
+
+	return &exporter{
+		config: c,
+		now:    time.Now,
+		jobs:   map[string]*exportJob{},
+		jobsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "export_jobs_total",
+			Help: "Total number of finished export jobs, partitioned by status (completed, failed or canceled).",
+		}, []string{"status"}),
+		running: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "export_jobs_running",
+			Help: "Number of export jobs being executed.",
+		}),
+		pages: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "export_pages_total",
+			Help: "Total number of sub-queries executed by the export jobs, partitioned by result.",
+		}, []string{"result"}),
+	}, nil
+}
+
+// split returns the sub-queries of the range.
+func (e *exporter) split(qr queryRange) []queryRange {
+	return (&rangeSplitter{cfg: RangeSplitting{Interval: e.config.PageInterval}}).split(qr)
+}
+
+// gc deletes the finished jobs older than the retention. The mutex must be
+// held.
+func (e *exporter) gc() {
+	now := e.now()
+	for id, j := range e.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > e.config.Retention {
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// job returns the job with the given id if it belongs to the tenants. The
+// mutex must be held.
+func (e *exporter) job(id string, tenants []string) (*exportJob, bool) {
+	j, found := e.jobs[id]
+	if !found || !slices.Equal(j.Tenants, tenants) {
+		return nil, false
+	}
+
+	return j, true
+}
+
+// submit registers the job and starts it.
+func (e *exporter) submit(job ExportJob, form url.Values, qr queryRange) (ExportJob, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ExportJob{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &exportJob{ExportJob: job, cancel: cancel}
+	j.ID = hex.EncodeToString(id)
+	j.Status = ExportPending
+	j.Pages = len(e.split(qr))
+
+	e.mtx.Lock()
+	e.gc()
+	if len(e.jobs) >= e.config.MaxJobs {
+		e.mtx.Unlock()
+		cancel()
+		return ExportJob{}, fmt.Errorf("%w (limit: %d)", errTooManyExports, e.config.MaxJobs)
+	}
+	j.CreatedAt = e.now()
+	e.jobs[j.ID] = j
+	res := j.ExportJob
+	e.mtx.Unlock()
+
+	go e.run(ctx, j, form, qr)
+
+	return res, nil
+}
+
+// wait blocks until the next sub-query may be executed.
+func (e *exporter) wait(ctx context.Context) error {
+	e.mtx.Lock()
+	now := e.now()
+	at := e.nextPage
+	if at.Before(now) {
+		at = now
+	}
+	e.nextPage = at.Add(time.Duration(float64(time.Second) / e.config.PagesPerSecond))
+	e.mtx.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return ctx.Err()
+}
+
+// run executes the sub-queries of the job one after the other.
+func (e *exporter) run(ctx context.Context, j *exportJob, form url.Values, qr queryRange) {
+	defer j.cancel()
+
+	e.running.Inc()
+	defer e.running.Dec()
+
+	e.mtx.Lock()
+	j.Status = ExportRunning
+	e.mtx.Unlock()
+
+	w := newExportWriter(j.Format, &j.result)
+
+	err := func() error {
+		for i, page := range e.split(qr) {
+			if err := e.wait(ctx); err != nil {
+				return err
+			}
+
+			err := e.page(ctx, w, form, j.Tenants, page)
+			if err != nil {
+				e.pages.WithLabelValues("failure").Inc()
+				return err
+			}
+			e.pages.WithLabelValues("success").Inc()
+
+			e.mtx.Lock()
+			j.PagesDone = i + 1
+			j.Bytes = int64(j.result.Len())
+			e.mtx.Unlock()
+
+			if int64(j.result.Len()) > e.config.MaxResultBytes {
+				return fmt.Errorf("the result exceeds the limit of %d bytes", e.config.MaxResultBytes)
+			}
+		}
+
+		return w.Flush()
+	}()
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	now := e.now()
+	j.FinishedAt = &now
+	switch {
+	case err == nil:
+		j.Status = ExportCompleted
+	case ctx.Err() != nil:
+		j.Status = ExportCanceled
+	default:
+		j.Status = ExportFailed
+		j.Error = err.Error()
+	}
+	if j.Status != ExportCompleted {
+		j.result.Reset()
+		j.Bytes = 0
+	}
+	e.jobsTotal.WithLabelValues(string(j.Status)).Inc()
+}
+
+// page executes the sub-query and writes its result.
+func (e *exporter) page(ctx context.Context, w exportWriter, form url.Values, tenants []string, page queryRange) error {
+	params := url.Values{}
+	for k, v := range form {
+		params[k] = slices.Clone(v)
+	}
+	params.Set(startParam, formatTime(page.start))
+	params.Set(endParam, formatTime(page.end))
+
+	// Every page is a request of its own for the middlewares.
+	rc := newRequestContext("/api/v1/query_range")
+	rc.setTenants(tenants)
+
+	req, err := http.NewRequestWithContext(withRequestContext(ctx, rc), http.MethodGet, "/api/v1/query_range?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	rec := &probeRecorder{header: http.Header{}, code: http.StatusOK}
+	e.query(rec, req)
+
+	var apir apiResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &apir); err != nil {
+		return fmt.Errorf("sub-query from %s to %s: unexpected response with status code %d", page.start.UTC().Format(time.RFC3339), page.end.UTC().Format(time.RFC3339), rec.code)
+	}
+	if rec.code != http.StatusOK || apir.Status != "success" {
+		return fmt.Errorf("sub-query from %s to %s: %s", page.start.UTC().Format(time.RFC3339), page.end.UTC().Format(time.RFC3339), apir.Error)
+	}
+
+	var data struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	}
+	if err := json.Unmarshal(apir.Data, &data); err != nil {
+		return fmt.Errorf("can't decode the sub-query result: %w", err)
+	}
+	if data.ResultType != "matrix" {
+		return fmt.Errorf("unexpected result type %q", data.ResultType)
+	}
+
+	return w.Write(data.Result)
+}
+
+// exportWriter writes the pages of an export result.
+type exportWriter interface {
+	Write(model.Matrix) error
+	Flush() error
+}
+
+func newExportWriter(f ExportFormat, w io.Writer) exportWriter {
+	if f == ExportCSV {
+		return &csvExportWriter{w: csv.NewWriter(w)}
+	}
+
+	return &ndjsonExportWriter{enc: json.NewEncoder(w)}
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (w *ndjsonExportWriter) Write(m model.Matrix) error {
+	for _, ss := range m {
+		if err := w.enc.Encode(ss); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *ndjsonExportWriter) Flush() error { return nil }
+
+type csvExportWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (w *csvExportWriter) Write(m model.Matrix) error {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if err := w.w.Write([]string{"series", "timestamp", "value"}); err != nil {
+			return err
+		}
+	}
+
+	for _, ss := range m {
+		series := ss.Metric.String()
+		for _, s := range ss.Values {
+			if err := w.w.Write([]string{series, s.Timestamp.String(), strconv.FormatFloat(float64(s.Value), 'f', -1, 64)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvExportWriter) Flush() error {
+	if !w.wroteHeader {
+		return w.Write(nil)
+	}
+
+	return nil
+}
+
+// exports serves the export jobs API.
+func (r *routes) exports(w http.ResponseWriter, req *http.Request) {
+	tenants := slices.Clone(MustLabelValues(req.Context()))
+	sort.Strings(tenants)
+
+	id, suffix, _ := strings.Cut(strings.Trim(strings.TrimPrefix(req.URL.Path, ExportsPath), "/"), "/")
+	switch {
+	case id == "" && req.Method == http.MethodPost:
+		r.submitExport(w, req, tenants)
+	case id == "" && req.Method == http.MethodGet:
+		r.listExports(w, tenants)
+	case id != "" && suffix == "" && req.Method == http.MethodGet:
+		r.getExport(w, id, tenants)
+	case id != "" && suffix == "" && req.Method == http.MethodDelete:
+		r.cancelExport(w, id, tenants)
+	case id != "" && suffix == "result" && req.Method == http.MethodGet:
+		r.downloadExport(w, id, tenants)
+	case id != "" && suffix != "" && suffix != "result":
+		prometheusAPIError(w, "not found", http.StatusNotFound)
+	default:
+		prometheusAPIError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *routes) submitExport(w http.ResponseWriter, req *http.Request, tenants []string) {
+	if err := req.ParseForm(); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := req.Form.Get(queryParam)
+	if q == "" {
+		badDataError(w, fmt.Sprintf("the %q parameter must be provided", queryParam))
+		return
+	}
+	if _, err := parser.ParseExpr(q); err != nil {
+		badDataError(w, fmt.Sprintf("invalid %q parameter: %v", queryParam, err))
+		return
+	}
+
+	qr, err := rangeFromRequest(req)
+	if err != nil {
+		badDataError(w, err.Error())
+		return
+	}
+
+	format := ExportFormat(req.Form.Get(formatParam))
+	switch format {
+	case "":
+		format = ExportNDJSON
+	case ExportNDJSON, ExportCSV:
+	default:
+		badDataError(w, fmt.Sprintf("invalid %q parameter: unsupported format %q", formatParam, format))
+		return
+	}
+
+	form := url.Values{}
+	for k, v := range req.Form {
+		if k != formatParam {
+			form[k] = v
+		}
+	}
+
+	job, err := r.exporter.submit(ExportJob{
+		Tenants: tenants,
+		Query:   q,
+		Start:   qr.start.UTC(),
+		End:     qr.end.UTC(),
+		Step:    model.Duration(qr.step).String(),
+		Format:  format,
+	}, form, qr)
+	if err != nil {
+		if errors.Is(err, errTooManyExports) {
+			rejectRequest(w, ReasonExportLimit, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", ExportsPath+"/"+job.ID)
+	writeExportResponse(w, http.StatusAccepted, job)
+}
+
+func (r *routes) listExports(w http.ResponseWriter, tenants []string) {
+	e := r.exporter
+	e.mtx.Lock()
+	e.gc()
+	jobs := []ExportJob{}
+	for _, j := range e.jobs {
+		if slices.Equal(j.Tenants, tenants) {
+			jobs = append(jobs, j.ExportJob)
+		}
+	}
+	e.mtx.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+
+	writeExportResponse(w, http.StatusOK, jobs)
+}
+
+func (r *routes) getExport(w http.ResponseWriter, id string, tenants []string) {
+	e := r.exporter
+	e.mtx.Lock()
+	e.gc()
+	j, found := e.job(id, tenants)
+	var job ExportJob
+	if found {
+		job = j.ExportJob
+	}
+	e.mtx.Unlock()
+
+	if !found {
+		prometheusAPIError(w, "export job not found", http.StatusNotFound)
+		return
+	}
+
+	writeExportResponse(w, http.StatusOK, job)
+}
+
+func (r *routes) cancelExport(w http.ResponseWriter, id string, tenants []string) {
+	e := r.exporter
+	e.mtx.Lock()
+	j, found := e.job(id, tenants)
+	if found {
+		delete(e.jobs, id)
+	}
+	e.mtx.Unlock()
+
+	if !found {
+		prometheusAPIError(w, "export job not found", http.StatusNotFound)
+		return
+	}
+
+	j.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *routes) downloadExport(w http.ResponseWriter, id string, tenants []string) {
+	e := r.exporter
+	e.mtx.Lock()
+	e.gc()
+	j, found := e.job(id, tenants)
+	var status ExportStatus
+	if found {
+		status = j.Status
+	}
+	e.mtx.Unlock()
+
+	if !found {
+		prometheusAPIError(w, "export job not found", http.StatusNotFound)
+		return
+	}
+	if status != ExportCompleted {
+		prometheusAPIError(w, fmt.Sprintf("the export job is %s", status), http.StatusConflict)
+		return
+	}
+
+	contentType := "application/x-ndjson"
+	if j.Format == ExportCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "export-"+j.ID+"."+string(j.Format)))
+	w.Header().Set("Content-Length", strconv.Itoa(j.result.Len()))
+	_, _ = w.Write(j.result.Bytes())
+}
+
+func writeExportResponse(w http.ResponseWriter, code int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("can't encode the response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: data})
+}
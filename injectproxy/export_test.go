@@ -0,0 +1,309 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// exportUpstream returns a sample at the start and the end of every range
+// query and records the queries.
+type exportUpstream struct {
+	mtx     sync.Mutex
+	queries []string
+	fail    bool
+}
+
+func (u *exportUpstream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+
+	u.mtx.Lock()
+	u.queries = append(u.queries, fmt.Sprintf("%s %s %s", req.Form.Get("query"), req.Form.Get("start"), req.Form.Get("end")))
+	fail := u.fail
+	u.mtx.Unlock()
+
+	if fail {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"status":"error","errorType":"execution","error":"too many samples"}`)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","namespace":"ns1"},"values":[[%s,"1"],[%s,"2"]]}]}}`, req.Form.Get("start"), req.Form.Get("end"))
+}
+
+func (u *exportUpstream) Queries() []string {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	return append([]string(nil), u.queries...)
+}
+
+func exportRequest(t *testing.T, r http.Handler, method, path string, params url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var req *http.Request
+	if method == http.MethodPost {
+		req = httptest.NewRequest(method, "http://prometheus.example.com"+path, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, "http://prometheus.example.com"+path+"?"+params.Encode(), nil)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func decodeExportJob(t *testing.T, w *httptest.ResponseRecorder) ExportJob {
+	t.Helper()
+
+	var apir apiResponse
+	if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var job ExportJob
+	if err := json.Unmarshal(apir.Data, &job); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return job
+}
+
+// waitExportJob polls the job until it is finished.
+func waitExportJob(t *testing.T, r http.Handler, id, tenant string) ExportJob {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := exportRequest(t, r, http.MethodGet, ExportsPath+"/"+id, url.Values{proxyLabel: {tenant}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if job := decodeExportJob(t, w); job.FinishedAt != nil {
+			return job
+		}
+	}
+
+	t.Fatalf("the export job %s didn't finish", id)
+	return ExportJob{}
+}
+
+func TestBulkExports(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format string
+		fail   bool
+
+		expStatus  ExportStatus
+		expResult  string
+		expQueries []string
+	}{
+		{
+			name:      "ndjson",
+			expStatus: ExportCompleted,
+			expResult: `{"metric":{"__name__":"up","namespace":"ns1"},"values":[[0,"1"],[3590,"2"]]}
+{"metric":{"__name__":"up","namespace":"ns1"},"values":[[3600,"1"],[7190,"2"]]}
+{"metric":{"__name__":"up","namespace":"ns1"},"values":[[7200,"1"],[7200,"2"]]}
+`,
+			expQueries: []string{
+				`up{namespace="ns1"} 0 3590`,
+				`up{namespace="ns1"} 3600 7190`,
+				`up{namespace="ns1"} 7200 7200`,
+			},
+		},
+		{
+			name:      "csv",
+			format:    "csv",
+			expStatus: ExportCompleted,
+			expResult: `series,timestamp,value
+"up{namespace=""ns1""}",0,1
+"up{namespace=""ns1""}",3590,2
+"up{namespace=""ns1""}",3600,1
+"up{namespace=""ns1""}",7190,2
+"up{namespace=""ns1""}",7200,1
+"up{namespace=""ns1""}",7200,2
+`,
+		},
+		{
+			name:      "upstream failure",
+			fail:      true,
+			expStatus: ExportFailed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &exportUpstream{fail: tc.fail}
+			m := newMockUpstream(u)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithBulkExports(BulkExports{PagesPerSecond: 1000}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			params := url.Values{proxyLabel: {"ns1"}, "query": {"up"}, "start": {"0"}, "end": {"7200"}, "step": {"10"}}
+			if tc.format != "" {
+				params.Set("format", tc.format)
+			}
+			w := exportRequest(t, r, http.MethodPost, ExportsPath, params)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("expected status code 202, got %d: %s", w.Code, w.Body.String())
+			}
+			job := decodeExportJob(t, w)
+			if job.Pages != 3 {
+				t.Fatalf("expected 3 pages, got %d", job.Pages)
+			}
+
+			job = waitExportJob(t, r, job.ID, "ns1")
+			if job.Status != tc.expStatus {
+				t.Fatalf("expected status %q, got %q (error: %q)", tc.expStatus, job.Status, job.Error)
+			}
+			if got := testutil.ToFloat64(r.exporter.jobsTotal.WithLabelValues(string(tc.expStatus))); got != 1 {
+				t.Fatalf("expected 1 %s job, got %v", tc.expStatus, got)
+			}
+
+			// Other tenants don't see the job.
+			if w := exportRequest(t, r, http.MethodGet, ExportsPath+"/"+job.ID+"/result", url.Values{proxyLabel: {"ns2"}}); w.Code != http.StatusNotFound {
+				t.Fatalf("expected status code 404, got %d", w.Code)
+			}
+
+			w = exportRequest(t, r, http.MethodGet, ExportsPath+"/"+job.ID+"/result", url.Values{proxyLabel: {"ns1"}})
+			if tc.expStatus != ExportCompleted {
+				if w.Code != http.StatusConflict {
+					t.Fatalf("expected status code 409, got %d", w.Code)
+				}
+				if job.Error == "" {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Body.String(); got != tc.expResult {
+				t.Fatalf("expected result:\n%s\ngot:\n%s", tc.expResult, got)
+			}
+			if job.PagesDone != 3 || job.Bytes != int64(len(tc.expResult)) {
+				t.Fatalf("expected 3 pages and %d bytes, got %d pages and %d bytes", len(tc.expResult), job.PagesDone, job.Bytes)
+			}
+
+			if tc.expQueries != nil {
+				if got := u.Queries(); strings.Join(got, "\n") != strings.Join(tc.expQueries, "\n") {
+					t.Fatalf("expected queries %q, got %q", tc.expQueries, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkExportsAPI(t *testing.T) {
+	m := newMockUpstream(&exportUpstream{})
+	defer m.Close()
+
+	// The slow rate keeps the first job running.
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithBulkExports(BulkExports{PagesPerSecond: 0.01, MaxJobs: 1}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+	}{
+		{
+			name:   "missing query",
+			params: url.Values{proxyLabel: {"ns1"}, "start": {"0"}, "end": {"7200"}, "step": {"10"}},
+		},
+		{
+			name:   "invalid query",
+			params: url.Values{proxyLabel: {"ns1"}, "query": {"up{"}, "start": {"0"}, "end": {"7200"}, "step": {"10"}},
+		},
+		{
+			name:   "missing step",
+			params: url.Values{proxyLabel: {"ns1"}, "query": {"up"}, "start": {"0"}, "end": {"7200"}},
+		},
+		{
+			name:   "invalid format",
+			params: url.Values{proxyLabel: {"ns1"}, "query": {"up"}, "start": {"0"}, "end": {"7200"}, "step": {"10"}, "format": {"parquet"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := exportRequest(t, r, http.MethodPost, ExportsPath, tc.params); w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status code 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	params := url.Values{proxyLabel: {"ns1"}, "query": {"up"}, "start": {"0"}, "end": {"7200"}, "step": {"10"}}
+	w := exportRequest(t, r, http.MethodPost, ExportsPath, params)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status code 202, got %d: %s", w.Code, w.Body.String())
+	}
+	job := decodeExportJob(t, w)
+
+	w = exportRequest(t, r, http.MethodPost, ExportsPath, params)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status code 429, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(RejectionReasonHeader); got != string(ReasonExportLimit) {
+		t.Fatalf("expected reason %q, got %q", ReasonExportLimit, got)
+	}
+
+	w = exportRequest(t, r, http.MethodGet, ExportsPath+"/"+job.ID+"/result", url.Values{proxyLabel: {"ns1"}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status code 409, got %d", w.Code)
+	}
+
+	for tenant, exp := range map[string]int{"ns1": 1, "ns2": 0} {
+		w = exportRequest(t, r, http.MethodGet, ExportsPath, url.Values{proxyLabel: {tenant}})
+		var apir apiResponse
+		if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var jobs []ExportJob
+		if err := json.Unmarshal(apir.Data, &jobs); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(jobs) != exp {
+			t.Fatalf("%s: expected %d jobs, got %d", tenant, exp, len(jobs))
+		}
+	}
+
+	if w := exportRequest(t, r, http.MethodDelete, ExportsPath+"/"+job.ID, url.Values{proxyLabel: {"ns2"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code 404, got %d", w.Code)
+	}
+	if w := exportRequest(t, r, http.MethodDelete, ExportsPath+"/"+job.ID, url.Values{proxyLabel: {"ns1"}}); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status code 204, got %d", w.Code)
+	}
+	if w := exportRequest(t, r, http.MethodGet, ExportsPath+"/"+job.ID, url.Values{proxyLabel: {"ns1"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code 404, got %d", w.Code)
+	}
+
+	// The canceled job frees its slot.
+	if w := exportRequest(t, r, http.MethodPost, ExportsPath, params); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status code 202, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// federationWriteChunk is the maximum number of bytes written at once when
+// the bandwidth is limited.
+const federationWriteChunk = 32 * 1024
+
+// FederationLimits caps the resources used by the /federate endpoint.
+type FederationLimits struct {
+	// MaxConcurrent is the maximum number of concurrent federation
+	// requests. Zero means no limit.
+	MaxConcurrent int
+	// BytesPerSecond is the maximum bandwidth shared by all federation
+	// responses. Zero means no limit.
+	BytesPerSecond int64
+}
+
+// WithFederationLimits caps the number of concurrent /federate requests and
+// the bandwidth of their responses. The limits are independent from the
+// ones of the query endpoints so that scrapers of the federation endpoint
+// can't starve the interactive queries. Requests exceeding the concurrency
+// limit are rejected with "429 Too Many Requests".
+func WithFederationLimits(l FederationLimits) Option {
+	return optionFunc(func(o *options) {
+		o.federationLimits = &l
+	})
+}
+
+// bandwidthLimiter spreads the writes over time to stay within the
+// configured rate.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	now            func() time.Time
+
+	mtx  sync.Mutex
+	next time.Time
+}
+
+// reserve books the transmission of n bytes and returns how long the
+// caller should wait before writing them.
+func (b *bandwidthLimiter) reserve(n int) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+
+	delay := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(int64(n) * int64(time.Second) / b.bytesPerSecond))
+
+	return delay
+}
+
+// throttledWriter writes the response within the bandwidth limit.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), federationWriteChunk)]
+
+		if d := w.limiter.reserve(len(chunk)); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-w.ctx.Done():
+				t.Stop()
+				return written, w.ctx.Err()
+			case <-t.C:
+			}
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type federationLimiter struct {
+	slots     chan struct{}
+	bandwidth *bandwidthLimiter
+
+	inflight prometheus.Gauge
+	rejected prometheus.Counter
+}
+
+func newFederationLimiter(l FederationLimits, reg prometheus.Registerer) *federationLimiter {
+	fl := &federationLimiter{
+		inflight: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "federate_inflight_requests",
+			Help: "Current number of federation requests being served.",
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "federate_rejected_requests_total",
+			Help: "Total number of federation requests rejected because the concurrency limit was reached.",
+		}),
+	}
+
+	if l.MaxConcurrent > 0 {
+		fl.slots = make(chan struct{}, l.MaxConcurrent)
+	}
+
+	if l.BytesPerSecond > 0 {
+		fl.bandwidth = &bandwidthLimiter{bytesPerSecond: l.BytesPerSecond, now: time.Now}
+	}
+
+	return fl
+}
+
+// limitFederation applies the federation limits before calling the next
+// handler.
+func (r *routes) limitFederation(next http.HandlerFunc) http.HandlerFunc {
+	if r.federationLimiter == nil {
+		return next
+	}
+
+	fl := r.federationLimiter
+	return r.rollOut(RuleFederationLimits, func(w http.ResponseWriter, req *http.Request) {
+		if fl.slots != nil {
+			select {
+			case fl.slots <- struct{}{}:
+				defer func() { <-fl.slots }()
+			default:
+				fl.rejected.Inc()
+				rejectRequest(w, ReasonFederationLimit, "too many concurrent federation requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		fl.inflight.Inc()
+		defer fl.inflight.Dec()
+
+		if fl.bandwidth != nil {
+			w = &throttledWriter{ResponseWriter: w, ctx: req.Context(), limiter: fl.bandwidth}
+		}
+
+		next(w, req)
+	}, next)
+}
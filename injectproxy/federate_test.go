@@ -0,0 +1,98 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	now := time.Now()
+	b := &bandwidthLimiter{bytesPerSecond: 1000, now: func() time.Time { return now }}
+
+	for _, tc := range []struct {
+		n        int
+		advance  time.Duration
+		expDelay time.Duration
+	}{
+		{n: 500, expDelay: 0},
+		{n: 500, expDelay: 500 * time.Millisecond},
+		{n: 1000, expDelay: time.Second},
+		{n: 100, advance: 500 * time.Millisecond, expDelay: 1500 * time.Millisecond},
+		// Idle time isn't accumulated.
+		{n: 100, advance: 10 * time.Second, expDelay: 0},
+	} {
+		now = now.Add(tc.advance)
+		if got := b.reserve(tc.n); got != tc.expDelay {
+			t.Fatalf("expected delay %v, got %v", tc.expDelay, got)
+		}
+	}
+}
+
+func TestFederationLimits(t *testing.T) {
+	r, err := NewRoutes(
+		&url.URL{Scheme: "http", Host: "upstream"},
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithFederationLimits(FederationLimits{MaxConcurrent: 1, BytesPerSecond: 1 << 20}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	r.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/federate" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte(strings.Repeat("a", 2*federationWriteChunk+1)))
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/federate?match[]=up&namespace=ns1", nil))
+		done <- w
+	}()
+	<-started
+
+	// The second federation request is rejected.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/federate?match[]=up&namespace=ns2", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	// Queries aren't affected.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	close(release)
+	w = <-done
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Body.Len() != 2*federationWriteChunk+1 {
+		t.Fatalf("expected %d bytes, got %d", 2*federationWriteChunk+1, w.Body.Len())
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// limitHandoffKey is the key of the handed off concurrency limits in
+	// the state store.
+	limitHandoffKey = "handoff:limits"
+	// handoffLoadTimeout bounds the time spent loading the handed off
+	// limits on startup.
+	handoffLoadTimeout = 5 * time.Second
+)
+
+var errHandoffWithoutBudgets = errors.New("the limit handoff requires the latency budgets")
+
+// WithLimitHandoff hands off the concurrency limits learned from the latency
+// budgets (see WithLatencyBudgets) through the given store. When draining
+// (see Drain), the replica publishes its limits and the replicas starting
+// afterwards (e.g. during a rolling restart) inherit them instead of learning
+// them again. The published limits expire after the TTL.
+func WithLimitHandoff(s StateStore, ttl time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.handoffStore = s
+		o.handoffTTL = ttl
+	})
+}
+
+// handedOffLimit is the concurrency limit of a tenant for a handler.
+type handedOffLimit struct {
+	Tenant  string `json:"tenant"`
+	Handler string `json:"handler"`
+	Limit   int    `json:"limit"`
+}
+
+type limitHandoff struct {
+	store  StateStore
+	ttl    time.Duration
+	logger *log.Logger
+}
+
+func newLimitHandoff(s StateStore, ttl time.Duration) (*limitHandoff, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("the TTL of the handed off limits must be positive, got %s", ttl)
+	}
+
+	return &limitHandoff{
+		store:  s,
+		ttl:    ttl,
+		logger: log.Default(),
+	}, nil
+}
+
+// load returns the handed off limits.
+func (h *limitHandoff) load(ctx context.Context) (map[budgetKey]int, error) {
+	b, found, err := h.store.Get(ctx, limitHandoffKey)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var limits []handedOffLimit
+	if err := json.Unmarshal(b, &limits); err != nil {
+		return nil, fmt.Errorf("failed to decode the handed off limits: %w", err)
+	}
+
+	inherited := make(map[budgetKey]int, len(limits))
+	for _, l := range limits {
+		inherited[budgetKey{tenant: l.Tenant, handler: l.Handler}] = l.Limit
+	}
+
+	return inherited, nil
+}
+
+// publish merges the limits with the ones already handed off by other
+// replicas and stores them.
+func (h *limitHandoff) publish(ctx context.Context, limits []handedOffLimit) error {
+	inherited, err := h.load(ctx)
+	if err != nil {
+		h.logger.Printf("failed to read the handed off limits: %v", err)
+	}
+
+	for _, l := range limits {
+		delete(inherited, budgetKey{tenant: l.Tenant, handler: l.Handler})
+	}
+	for k, limit := range inherited {
+		limits = append(limits, handedOffLimit{Tenant: k.tenant, Handler: k.handler, Limit: limit})
+	}
+
+	b, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+
+	return h.store.Set(ctx, limitHandoffKey, b, h.ttl)
+}
+
+// Drain prepares the proxy for a graceful shutdown: the new requests are
+// rejected with "503 Service Unavailable" and the concurrency limits are
+// handed off if configured. The in-flight requests aren't interrupted and
+// the caller is expected to shut down the HTTP server gracefully afterwards.
+func (r *routes) Drain(ctx context.Context) error {
+	r.draining.Store(true)
+
+	if r.handoff == nil {
+		return nil
+	}
+
+	limits := r.budgeter.snapshot()
+	if err := r.handoff.publish(ctx, limits); err != nil {
+		return fmt.Errorf("failed to hand off the concurrency limits: %w", err)
+	}
+	r.logger.Printf("handed off %d concurrency limits", len(limits))
+
+	return nil
+}
+
+// rejectWhileDraining rejects the requests received after Drain was called.
+func (r *routes) rejectWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.draining.Load() {
+			w.Header().Set("Connection", "close")
+			r.errorPage(w, req, http.StatusServiceUnavailable, ReasonDraining)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimitHandoff(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	store := NewMemoryStateStore()
+	b, _ := json.Marshal([]handedOffLimit{
+		{Tenant: "ns1", Handler: "/api/v1/query", Limit: 2},
+		{Tenant: "ns2", Handler: "/api/v1/query", Limit: 20},
+		{Tenant: "ns3", Handler: "/api/v1/query", Limit: 3},
+	})
+	if err := store.Set(context.Background(), limitHandoffKey, b, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithLatencyBudgets(LatencyBudgets{Default: time.Second, MaxConcurrency: 10}),
+		WithLimitHandoff(store, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	query := func(tenant string, expCode int) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace="+tenant, nil))
+		if w.Code != expCode {
+			t.Fatalf("expected status code %d, got %d: %s", expCode, w.Code, w.Body.String())
+		}
+	}
+
+	// The inherited limits are clamped to the maximum concurrency.
+	query("ns1", http.StatusOK)
+	query("ns2", http.StatusOK)
+	for tenant, exp := range map[string]float64{"ns1": 2, "ns2": 10} {
+		if got := testutil.ToFloat64(r.budgeter.limit.WithLabelValues(tenant, "/api/v1/query")); got != exp {
+			t.Fatalf("expected limit %v for %s, got %v", exp, tenant, got)
+		}
+	}
+
+	if err := r.Drain(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	query("ns1", http.StatusServiceUnavailable)
+
+	b, _, err = store.Get(context.Background(), limitHandoffKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []handedOffLimit
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The ns3 limit hasn't been used but it is handed off again.
+	exp := []handedOffLimit{
+		{Tenant: "ns1", Handler: "/api/v1/query", Limit: 2},
+		{Tenant: "ns2", Handler: "/api/v1/query", Limit: 10},
+		{Tenant: "ns3", Handler: "/api/v1/query", Limit: 3},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected handed off limits %v, got %v", exp, got)
+	}
+}
+
+func TestLimitHandoffOptions(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer m.Close()
+
+	_, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithLimitHandoff(NewMemoryStateStore(), time.Minute))
+	if !errors.Is(err, errHandoffWithoutBudgets) {
+		t.Fatalf("expected %v, got %v", errHandoffWithoutBudgets, err)
+	}
+
+	_, err = NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithLatencyBudgets(LatencyBudgets{Default: time.Second, MaxConcurrency: 10}),
+		WithLimitHandoff(NewMemoryStateStore(), 0),
+	)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
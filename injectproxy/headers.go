@@ -0,0 +1,182 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ResponseHeader is a header added to the responses of the proxy.
+type ResponseHeader struct {
+	Name  string
+	Value *texttemplate.Template
+}
+
+// NewResponseHeader returns a response header whose value is a Go
+// text/template receiving a ResponseHeaderData. Static values don't need
+// any template action.
+func NewResponseHeader(name, value string) (ResponseHeader, error) {
+	name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	if name == "" {
+		return ResponseHeader{}, fmt.Errorf("empty header name")
+	}
+
+	t, err := texttemplate.New(name).Parse(value)
+	if err != nil {
+		return ResponseHeader{}, fmt.Errorf("invalid value for header %q: %w", name, err)
+	}
+
+	return ResponseHeader{Name: name, Value: t}, nil
+}
+
+// ResponseHeaderData is the data passed to the response header templates.
+type ResponseHeaderData struct {
+	Method string
+	Host   string
+	Path   string
+
+	header http.Header
+}
+
+// Header returns the value of the request header.
+func (d ResponseHeaderData) Header(name string) string {
+	return d.header.Get(name)
+}
+
+// WithResponseHeaders sets the given headers on all the responses of the
+// proxy (e.g. Strict-Transport-Security or X-Proxy-Cluster). They override
+// the headers of the same name returned by the upstream.
+func WithResponseHeaders(headers ...ResponseHeader) Option {
+	return optionFunc(func(o *options) {
+		o.responseHeaders = append(o.responseHeaders, headers...)
+	})
+}
+
+// headerWriter sets the headers before the response is written.
+type headerWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for k, v := range w.headers {
+			w.ResponseWriter.Header()[k] = v
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for http.ResponseController.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// injectResponseHeaders wraps the response writer to set the configured
+// headers. Headers whose template fails are skipped.
+func (r *routes) injectResponseHeaders(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	if len(r.responseHeaders) == 0 {
+		return w
+	}
+
+	data := ResponseHeaderData{
+		Method: req.Method,
+		Host:   req.Host,
+		Path:   req.URL.Path,
+		header: req.Header,
+	}
+
+	headers := make(http.Header, len(r.responseHeaders))
+	for _, h := range r.responseHeaders {
+		var sb strings.Builder
+		if err := h.Value.Execute(&sb, data); err != nil {
+			r.logger.Printf("failed to render response header %q: %v", h.Name, err)
+			continue
+		}
+		headers.Set(h.Name, sb.String())
+	}
+
+	return &headerWriter{ResponseWriter: w, headers: headers}
+}
+
+// cacheHeader tells whether the response was served from a cache.
+const cacheHeader = "X-Querymw-Cache"
+
+// WithDecisionHeaders adds headers to the responses describing how the proxy
+// handled the request, for debugging data sources and load tests. The
+// "X-Querymw-Cache" header is "hit" when the response is served from the
+// response cache or the query memoization, "miss" otherwise. It is only set
+// for the requests eligible to a cache.
+func WithDecisionHeaders() Option {
+	return optionFunc(func(o *options) {
+		o.decisionHeaders = true
+	})
+}
+
+func (r *routes) annotateCache(w http.ResponseWriter, result string) {
+	if !r.decisionHeaders {
+		return
+	}
+
+	w.Header().Set(cacheHeader, result)
+}
+
+// effectiveQueryHeader holds the query evaluated by the upstream.
+const effectiveQueryHeader = "X-Querymw-Effective-Query"
+
+// EffectiveQueryAnnotation is where the effective query is returned.
+type EffectiveQueryAnnotation string
+
+const (
+	// EffectiveQueryHeader returns the effective query in the
+	// "X-Querymw-Effective-Query" response header.
+	EffectiveQueryHeader EffectiveQueryAnnotation = "header"
+	// EffectiveQueryWarning returns the effective query in the warnings
+	// of the API response.
+	EffectiveQueryWarning EffectiveQueryAnnotation = "warning"
+)
+
+// WithEffectiveQuery returns the query evaluated by the upstream, once the
+// label is enforced, with the responses of the instant and range queries.
+// Users can copy it to debug unexpected results.
+func WithEffectiveQuery(a EffectiveQueryAnnotation) Option {
+	return optionFunc(func(o *options) {
+		o.effectiveQuery = a
+	})
+}
+
+// annotateEffectiveQuery adds the effective query to the response. The
+// returned request must be used to serve the query.
+func (r *routes) annotateEffectiveQuery(w http.ResponseWriter, req *http.Request, q string) *http.Request {
+	switch r.effectiveQuery {
+	case EffectiveQueryHeader:
+		w.Header().Set(effectiveQueryHeader, strings.Join(strings.Fields(q), " "))
+	case EffectiveQueryWarning:
+		req = withWarning(req, "effective query: "+q)
+	}
+
+	return req
+}
@@ -0,0 +1,267 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewResponseHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+		expErr      bool
+	}{
+		{name: "X-Proxy-Cluster", value: "eu-west-1"},
+		{name: "X-Proxy-Path", value: "{{ .Path }}"},
+		{name: " ", value: "foo", expErr: true},
+		{name: "X-Proxy-Path", value: "{{ .Path", expErr: true},
+	} {
+		_, err := NewResponseHeader(tc.name, tc.value)
+		if tc.expErr != (err != nil) {
+			t.Fatalf("%s: %q: expected error %v, got %v", tc.name, tc.value, tc.expErr, err)
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Proxy-Cluster", "upstream")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	var headers []ResponseHeader
+	for _, h := range [][2]string{
+		{"X-Proxy-Cluster", "eu-west-1"},
+		{"strict-transport-security", "max-age=31536000"},
+		{"X-Proxy-Request", "{{ .Method }} {{ .Path }} {{ .Header \"X-Request-Id\" }}"},
+		{"X-Broken", "{{ .Unknown }}"},
+	} {
+		rh, err := NewResponseHeader(h[0], h[1])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		headers = append(headers, rh)
+	}
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithResponseHeaders(headers...),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		url     string
+		expCode int
+		expReq  string
+	}{
+		{
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			expCode: http.StatusOK,
+			expReq:  "GET /api/v1/query 123",
+		},
+		{
+			// Errors of the proxy get the headers too.
+			url:     "http://prometheus.example.com/api/v1/query?query=up",
+			expCode: http.StatusBadRequest,
+			expReq:  "GET /api/v1/query 123",
+		},
+		{
+			url:     "http://prometheus.example.com/healthz",
+			expCode: http.StatusOK,
+			expReq:  "GET /healthz 123",
+		},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.Header.Set("X-Request-Id", "123")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.expCode {
+			t.Fatalf("%s: expected status code %d, got %d", tc.url, tc.expCode, w.Code)
+		}
+
+		for k, v := range map[string]string{
+			"X-Proxy-Cluster":           "eu-west-1",
+			"Strict-Transport-Security": "max-age=31536000",
+			"X-Proxy-Request":           tc.expReq,
+		} {
+			if got := w.Result().Header.Values(k); len(got) != 1 || got[0] != v {
+				t.Fatalf("%s: expected header %s=%q, got %q", tc.url, k, v, got)
+			}
+		}
+
+		if got := w.Header().Get("X-Broken"); got != "" {
+			t.Fatalf("%s: expected no X-Broken header, got %q", tc.url, got)
+		}
+	}
+}
+
+func TestDecisionHeaders(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		url  string
+
+		exp []string
+	}{
+		{
+			name: "cached query",
+			opts: []Option{WithQueryCache(QueryCache{TTL: time.Minute}), WithDecisionHeaders()},
+			url:  "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1&time=0",
+			exp:  []string{"miss", "hit"},
+		},
+		{
+			name: "memoized query",
+			opts: []Option{
+				WithQueryMemoization(QueryMemoization{Pattern: regexp.MustCompile("up"), Window: time.Minute}),
+				WithDecisionHeaders(),
+			},
+			url: "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			exp: []string{"miss", "hit"},
+		},
+		{
+			name: "not cached",
+			opts: []Option{WithQueryCache(QueryCache{TTL: time.Minute}), WithDecisionHeaders()},
+			url:  "http://prometheus.example.com/api/v1/series?match[]=up&namespace=ns1",
+			exp:  []string{"", ""},
+		},
+		{
+			name: "disabled",
+			opts: []Option{WithQueryCache(QueryCache{TTL: time.Minute})},
+			url:  "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1&time=0",
+			exp:  []string{"", ""},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, exp := range tc.exp {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+				}
+
+				if got := w.Header().Get(cacheHeader); got != exp {
+					t.Fatalf("expected %s=%q, got %q", cacheHeader, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestEffectiveQuery(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer m.Close()
+
+	const effective = `sum by (job) (rate(http_requests_total{namespace="ns1"}[5m]))`
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		method string
+
+		expHeader   string
+		expWarnings []string
+		expErr      bool
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:      "header",
+			opts:      []Option{WithEffectiveQuery(EffectiveQueryHeader)},
+			expHeader: effective,
+		},
+		{
+			name:      "header with POST request",
+			opts:      []Option{WithEffectiveQuery(EffectiveQueryHeader)},
+			method:    http.MethodPost,
+			expHeader: effective,
+		},
+		{
+			name:        "warning",
+			opts:        []Option{WithEffectiveQuery(EffectiveQueryWarning)},
+			expWarnings: []string{"effective query: " + effective},
+		},
+		{
+			name:   "invalid",
+			opts:   []Option{WithEffectiveQuery("body")},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			params := url.Values{"query": []string{"sum(rate(http_requests_total[5m])) by (job)"}, proxyLabel: []string{"ns1"}}
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query", strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get(effectiveQueryHeader); got != tc.expHeader {
+				t.Fatalf("expected %s=%q, got %q", effectiveQueryHeader, tc.expHeader, got)
+			}
+
+			var apir apiResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tc.expWarnings, apir.Warnings) {
+				t.Fatalf("expected warnings %q, got %q", tc.expWarnings, apir.Warnings)
+			}
+		})
+	}
+}
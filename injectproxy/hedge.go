@@ -0,0 +1,174 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WithRequestHedging sends a second copy of the instant and range queries to
+// the upstream when the first one didn't return after the given delay (e.g.
+// the p95 latency of the queries). The first response wins and the other
+// request is cancelled. It trades some extra upstream load for lower tail
+// latencies.
+func WithRequestHedging(delay time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.hedgingDelay = delay
+	})
+}
+
+// hedgingTransport sends the hedged requests.
+type hedgingTransport struct {
+	next   http.RoundTripper
+	delay  time.Duration
+	limits BodyBufferLimits
+
+	hedges *prometheus.CounterVec
+}
+
+func newHedgingTransport(next http.RoundTripper, delay time.Duration, limits BodyBufferLimits, reg prometheus.Registerer) *hedgingTransport {
+	return &hedgingTransport{
+		next:   next,
+		delay:  delay,
+		limits: limits,
+		hedges: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_hedged_requests_total",
+			Help: "Total number of hedged upstream requests, partitioned by handler and winner (original or hedge).",
+		}, []string{"handler", "winner"}),
+	}
+}
+
+// cancelBody cancels the context of the request once the response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type hedgeResult struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isQueryPath(req.URL.Path) {
+		return t.next.RoundTrip(req)
+	}
+
+	// Buffer the body to send it twice.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := t.limits.bufferBody(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		defer body.Close()
+
+		req = req.Clone(req.Context())
+		req.GetBody = body.Open
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		results = make(chan hedgeResult, 2)
+		cancels [2]context.CancelFunc
+		pending int
+	)
+	send := func(i int) error {
+		ctx, cancel := context.WithCancel(req.Context())
+		r := req.Clone(ctx)
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return err
+			}
+			r.Body = body
+		}
+
+		cancels[i] = cancel
+		pending++
+		go func() {
+			resp, err := t.next.RoundTrip(r)
+			results <- hedgeResult{index: i, resp: resp, err: err}
+		}()
+
+		return nil
+	}
+
+	_ = send(0)
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			// The original request keeps going if the hedge can't be
+			// sent.
+			_ = send(1)
+		case res := <-results:
+			pending--
+			if res.err != nil && pending > 0 {
+				// Wait for the other request.
+				cancels[res.index]()
+				continue
+			}
+
+			if cancels[1] != nil {
+				winner := "original"
+				if res.index == 1 {
+					winner = "hedge"
+				}
+				t.hedges.WithLabelValues(handlerName(req.Context()), winner).Inc()
+			}
+
+			// Cancel the other request and release its response, if
+			// any.
+			if other := cancels[1-res.index]; other != nil {
+				other()
+			}
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					if r := <-results; r.resp != nil {
+						r.resp.Body.Close()
+					}
+				}
+			}(pending)
+
+			if res.err != nil {
+				cancels[res.index]()
+				return nil, res.err
+			}
+
+			res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.index]}
+			return res.resp, nil
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHedgingTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path string
+		// behaviors of the successive attempts: "ok", "fail", "slow"
+		// (blocks until cancelled) or "slow-fail" (fails after 50ms).
+		attempts []string
+
+		expCalls  int
+		expErr    bool
+		expBody   string
+		expWinner string
+	}{
+		{
+			name:     "fast response",
+			path:     "/api/v1/query",
+			attempts: []string{"ok"},
+			expCalls: 1,
+			expBody:  "0",
+		},
+		{
+			name:      "slow response",
+			path:      "/api/v1/query_range",
+			attempts:  []string{"slow", "ok"},
+			expCalls:  2,
+			expBody:   "1",
+			expWinner: "hedge",
+		},
+		{
+			name:      "original fails after the hedge",
+			path:      "/api/v1/query",
+			attempts:  []string{"slow-fail", "ok"},
+			expCalls:  2,
+			expBody:   "1",
+			expWinner: "hedge",
+		},
+		{
+			name:     "fast failure isn't hedged",
+			path:     "/api/v1/query",
+			attempts: []string{"fail"},
+			expCalls: 1,
+			expErr:   true,
+		},
+		{
+			name:      "both fail",
+			path:      "/api/v1/query",
+			attempts:  []string{"slow-fail", "fail"},
+			expCalls:  2,
+			expErr:    true,
+			expWinner: "original",
+		},
+		{
+			name:     "other endpoint",
+			path:     "/api/v1/series",
+			attempts: []string{"slow-fail"},
+			expCalls: 1,
+			expErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mtx      sync.Mutex
+				calls    int
+				canceled = make(chan struct{}, 2)
+			)
+			next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mtx.Lock()
+				i := calls
+				calls++
+				mtx.Unlock()
+
+				b, err := io.ReadAll(req.Body)
+				if err != nil || string(b) != "query=up" {
+					return nil, errors.New("unexpected body")
+				}
+
+				switch tc.attempts[i] {
+				case "fail":
+					return nil, errors.New("failed")
+				case "slow":
+					<-req.Context().Done()
+					canceled <- struct{}{}
+					return nil, req.Context().Err()
+				case "slow-fail":
+					time.Sleep(50 * time.Millisecond)
+					return nil, errors.New("failed")
+				}
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(string(rune('0' + i)))),
+				}, nil
+			})
+
+			reg := prometheus.NewRegistry()
+			ht := newHedgingTransport(next, 10*time.Millisecond, BodyBufferLimits{}, reg)
+
+			req := httptest.NewRequest(http.MethodPost, "http://upstream"+tc.path, strings.NewReader("query=up"))
+			resp, err := ht.RoundTrip(req)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				b, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(b) != tc.expBody {
+					t.Fatalf("expected body %q, got %q", tc.expBody, b)
+				}
+			}
+
+			// The losing request is cancelled.
+			for _, a := range tc.attempts {
+				if a == "slow" {
+					select {
+					case <-canceled:
+					case <-time.After(time.Second):
+						t.Fatal("expected the slow request to be cancelled")
+					}
+				}
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if calls != tc.expCalls {
+				t.Fatalf("expected %d calls, got %d", tc.expCalls, calls)
+			}
+
+			if got := testutil.CollectAndCount(ht.hedges); (got == 1) != (tc.expWinner != "") {
+				t.Fatalf("expected winner %q, got %d series", tc.expWinner, got)
+			}
+			if tc.expWinner != "" {
+				if got := testutil.ToFloat64(ht.hedges.WithLabelValues("", tc.expWinner)); got != 1 {
+					t.Fatalf("expected winner %q, got %v", tc.expWinner, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestHedgingRoutes(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		calls int
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		calls++
+		first := calls == 1
+		mtx.Unlock()
+
+		if first {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithRequestHedging(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("expected the hedged request to win, took %v", d)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// limitCheckpointVersion must be bumped on incompatible changes of the
+// checkpoint format.
+const limitCheckpointVersion = 1
+
+var errCheckpointWithoutBudgets = errors.New("the limit checkpoint requires the latency budgets")
+
+// WithLimitCheckpoint saves the concurrency limits learned from the latency
+// budgets (see WithLatencyBudgets) to the given file with CheckpointLimits
+// and restores them when the proxy starts, so that a restart during an
+// incident (e.g. after a crash, when the limits can't be handed off) doesn't
+// reset the limits to their maximum and overload the recovering upstream
+// again. The checkpoints older than maxAge are ignored.
+//
+// The limits handed off by other replicas (see WithLimitHandoff) take
+// precedence over the checkpoint.
+func WithLimitCheckpoint(path string, maxAge time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.limitCheckpointPath = path
+		o.limitCheckpointMaxAge = maxAge
+	})
+}
+
+// limitCheckpoint is the file format of the saved limits.
+type limitCheckpoint struct {
+	Version int              `json:"version"`
+	SavedAt time.Time        `json:"savedAt"`
+	Limits  []handedOffLimit `json:"limits"`
+}
+
+// loadLimitCheckpoint returns the saved limits. A missing or outdated
+// checkpoint isn't an error.
+func (r *routes) loadLimitCheckpoint(maxAge time.Duration) (map[budgetKey]int, error) {
+	b, err := os.ReadFile(r.limitCheckpointPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read the limit checkpoint: %w", err)
+	}
+
+	var c limitCheckpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse the limit checkpoint: %w", err)
+	}
+
+	if c.Version != limitCheckpointVersion {
+		return nil, fmt.Errorf("unsupported limit checkpoint version %d", c.Version)
+	}
+
+	if age := r.budgeter.now().Sub(c.SavedAt); age > maxAge {
+		r.logger.Printf("ignoring the limit checkpoint saved %s ago", age.Truncate(time.Second))
+		return nil, nil
+	}
+
+	limits := make(map[budgetKey]int, len(c.Limits))
+	for _, l := range c.Limits {
+		limits[budgetKey{tenant: l.Tenant, handler: l.Handler}] = l.Limit
+	}
+	r.logger.Printf("restored %d concurrency limits from %s", len(limits), r.limitCheckpointPath)
+
+	return limits, nil
+}
+
+// SaveLimitCheckpoint saves the current concurrency limits to the file
+// configured with WithLimitCheckpoint. It does nothing otherwise.
+func (r *routes) SaveLimitCheckpoint() error {
+	if r.limitCheckpointPath == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(limitCheckpoint{
+		Version: limitCheckpointVersion,
+		SavedAt: r.budgeter.now().UTC(),
+		Limits:  r.budgeter.snapshot(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(r.limitCheckpointPath, b); err != nil {
+		return fmt.Errorf("failed to write the limit checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// CheckpointLimits saves the concurrency limits at the given interval and
+// once more when the context is canceled. It does nothing if
+// WithLimitCheckpoint isn't set.
+func (r *routes) CheckpointLimits(ctx context.Context, interval time.Duration) error {
+	if r.limitCheckpointPath == "" {
+		<-ctx.Done()
+		return nil
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return r.SaveLimitCheckpoint()
+		case <-t.C:
+		}
+
+		if err := r.SaveLimitCheckpoint(); err != nil {
+			r.logger.Printf("%v", err)
+		}
+	}
+}
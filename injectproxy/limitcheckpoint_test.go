@@ -0,0 +1,136 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimitCheckpoint(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	newRoutes := func(path string) *routes {
+		t.Helper()
+
+		r, err := NewRoutes(
+			m.url,
+			proxyLabel,
+			HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithLatencyBudgets(LatencyBudgets{Default: time.Second, MaxConcurrency: 8}),
+			WithLimitCheckpoint(path, time.Hour),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return r
+	}
+
+	write := func(path string, c limitCheckpoint) {
+		t.Helper()
+
+		b, _ := json.Marshal(c)
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query"}
+	limits := []handedOffLimit{{Tenant: "ns1", Handler: "/api/v1/query", Limit: 4}}
+
+	for _, tc := range []struct {
+		name  string
+		setup func(path string)
+
+		exp map[budgetKey]int
+	}{
+		{
+			name:  "no checkpoint",
+			setup: func(string) {},
+			exp:   map[budgetKey]int{},
+		},
+		{
+			name: "saved limits",
+			setup: func(path string) {
+				r := newRoutes(path)
+				// Slow requests halve the limit.
+				for i := 0; i < budgetEvalEvery; i++ {
+					if !r.budgeter.acquire(context.Background(), k) {
+						t.Fatalf("unexpected rejection")
+					}
+					r.budgeter.release(k, 2*time.Second, false)
+				}
+
+				// The checkpoint is saved when the context is canceled.
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				if err := r.CheckpointLimits(ctx, time.Hour); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			},
+			exp: map[budgetKey]int{k: 4},
+		},
+		{
+			name: "outdated checkpoint",
+			setup: func(path string) {
+				write(path, limitCheckpoint{Version: limitCheckpointVersion, SavedAt: time.Now().Add(-2 * time.Hour), Limits: limits})
+			},
+			exp: map[budgetKey]int{},
+		},
+		{
+			name: "unsupported version",
+			setup: func(path string) {
+				write(path, limitCheckpoint{Version: 2, SavedAt: time.Now(), Limits: limits})
+			},
+			exp: map[budgetKey]int{},
+		},
+		{
+			name: "invalid checkpoint",
+			setup: func(path string) {
+				if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			},
+			exp: map[budgetKey]int{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "limits.json")
+			tc.setup(path)
+
+			r := newRoutes(path)
+			if !reflect.DeepEqual(r.budgeter.inherited, tc.exp) {
+				t.Fatalf("expected the inherited limits %v, got %v", tc.exp, r.budgeter.inherited)
+			}
+		})
+	}
+}
+
+func TestLimitCheckpointWithoutBudgets(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer m.Close()
+
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithLimitCheckpoint(filepath.Join(t.TempDir(), "limits.json"), time.Hour)); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
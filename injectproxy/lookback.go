@@ -0,0 +1,228 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// LookbackMode defines what happens to the queries selecting samples older
+// than the maximum lookback.
+type LookbackMode string
+
+const (
+	// LookbackReject rejects the queries.
+	LookbackReject LookbackMode = "reject"
+	// LookbackClamp moves the start of the range queries forward. The
+	// instant queries are still rejected since clamping their evaluation
+	// time or offsets would change their meaning.
+	LookbackClamp LookbackMode = "clamp"
+)
+
+// MaxLookback configures how far in the past the queries can select samples.
+type MaxLookback struct {
+	Duration time.Duration
+	Mode     LookbackMode
+}
+
+// WithMaxLookback limits how far in the past the instant and range queries
+// can select samples, taking the offsets, ranges, subqueries and @ modifiers
+// of the expression into account. In clamp mode, the start of the range
+// queries is moved forward by a multiple of the step and a warning is added
+// to the response.
+func WithMaxLookback(l MaxLookback) Option {
+	return optionFunc(func(o *options) {
+		o.maxLookback = &l
+	})
+}
+
+type lookbackLimiter struct {
+	maxLookback time.Duration
+	mode        LookbackMode
+	now         func() time.Time
+
+	limited *prometheus.CounterVec
+}
+
+func newLookbackLimiter(l MaxLookback, reg prometheus.Registerer) (*lookbackLimiter, error) {
+	if l.Duration <= 0 {
+		return nil, fmt.Errorf("the maximum lookback must be positive, got %s", l.Duration)
+	}
+
+	switch l.Mode {
+	case LookbackReject, LookbackClamp:
+	default:
+		return nil, fmt.Errorf("invalid lookback mode %q", l.Mode)
+	}
+
+	return &lookbackLimiter{
+		maxLookback: l.Duration,
+		mode:        l.Mode,
+		now:         time.Now,
+		limited: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_lookback_limited_total",
+			Help: "Total number of queries selecting samples older than the maximum lookback, partitioned by handler and action (clamped or rejected).",
+		}, []string{"handler", "action"}),
+	}, nil
+}
+
+// queryLookback returns how long before the evaluation time the expression
+// selects samples. The selectors with an @ modifier don't depend on the
+// evaluation time: the oldest sample they select is returned instead (zero
+// if there's none). The start and end times resolve the start() and end()
+// modifiers.
+func queryLookback(expr parser.Expr, start, end time.Time) (time.Duration, time.Time) {
+	var (
+		lookback time.Duration
+		oldest   time.Time
+	)
+
+	at := func(ts *int64, startOrEnd parser.ItemType) (time.Time, bool) {
+		switch {
+		case ts != nil:
+			return time.UnixMilli(*ts), true
+		case startOrEnd == parser.START:
+			return start, true
+		case startOrEnd == parser.END:
+			return end, true
+		}
+		return time.Time{}, false
+	}
+
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		d := vs.OriginalOffset
+		base, absolute := at(vs.Timestamp, vs.StartOrEnd)
+		for i := len(path) - 1; i >= 0; i-- {
+			switch n := path[i].(type) {
+			case *parser.MatrixSelector:
+				d += n.Range
+			case *parser.SubqueryExpr:
+				if absolute {
+					continue
+				}
+				d += n.Range + n.OriginalOffset
+				base, absolute = at(n.Timestamp, n.StartOrEnd)
+			}
+		}
+
+		if !absolute {
+			if d > lookback {
+				lookback = d
+			}
+			return nil
+		}
+
+		if t := base.Add(-d); oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+		return nil
+	})
+
+	return lookback, oldest
+}
+
+// limitLookback rejects or clamps the queries selecting samples older than
+// the maximum lookback.
+func (r *routes) limitLookback(next http.HandlerFunc) http.HandlerFunc {
+	if r.lookbackLimiter == nil {
+		return next
+	}
+
+	l := r.lookbackLimiter
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		expr, err := parser.ParseExpr(req.Form.Get(queryParam))
+		if err != nil {
+			// Let the enforcer reject the invalid queries.
+			next(w, req)
+			return
+		}
+
+		now := l.now()
+		limit := now.Add(-l.maxLookback)
+		handler := handlerName(req.Context())
+
+		var qr queryRange
+		if handler == "/api/v1/query_range" {
+			qr, err = rangeFromRequest(req)
+			if err != nil {
+				// Let the upstream reject the incomplete requests.
+				next(w, req)
+				return
+			}
+		} else {
+			qr.start = now
+			if req.Form.Get(timeParam) != "" {
+				if qr.start, err = parseTime(req.Form.Get(timeParam)); err != nil {
+					next(w, req)
+					return
+				}
+			}
+			qr.end = qr.start
+		}
+
+		reject := func(msg string) {
+			l.limited.WithLabelValues(handler, "rejected").Inc()
+			rejectRequest(w, ReasonMaxRangeExceeded, fmt.Sprintf("%s (%s)", msg, model.Duration(l.maxLookback)), http.StatusBadRequest)
+		}
+
+		lookback, oldest := queryLookback(expr, qr.start, qr.end)
+		if !oldest.IsZero() && oldest.Before(limit) {
+			reject("the query selects samples older than the maximum lookback with an @ modifier")
+			return
+		}
+
+		minStart := limit.Add(lookback)
+		if !qr.start.Before(minStart) {
+			next(w, req)
+			return
+		}
+
+		if l.mode != LookbackClamp || handler != "/api/v1/query_range" {
+			reject("the query selects samples older than the maximum lookback")
+			return
+		}
+
+		// Keep the evaluation timestamps aligned on the original ones.
+		steps := (minStart.Sub(qr.start) + qr.step - 1) / qr.step
+		start := qr.start.Add(steps * qr.step)
+		if start.After(qr.end) {
+			reject("the query range is older than the maximum lookback")
+			return
+		}
+
+		setParam(req, startParam, formatTime(start))
+		updateCost(req)
+		req = withWarning(req, fmt.Sprintf("start clamped from %s to %s to stay within the maximum lookback of %s", qr.start.UTC().Format(time.RFC3339Nano), start.UTC().Format(time.RFC3339Nano), model.Duration(l.maxLookback)))
+		l.limited.WithLabelValues(handler, "clamped").Inc()
+
+		next(w, req)
+	}
+}
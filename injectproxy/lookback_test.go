@@ -0,0 +1,176 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestQueryLookback(t *testing.T) {
+	start := time.Unix(10000, 0)
+	end := time.Unix(20000, 0)
+
+	for _, tc := range []struct {
+		query string
+
+		expLookback time.Duration
+		expOldest   time.Time
+	}{
+		{
+			query: "up",
+		},
+		{
+			query:       "rate(up[5m] offset 1h)",
+			expLookback: time.Hour + 5*time.Minute,
+		},
+		{
+			query:       "max_over_time(rate(up[5m])[1h:1m] offset 1d) + up offset 2h",
+			expLookback: 24*time.Hour + time.Hour + 5*time.Minute,
+		},
+		{
+			query:     "up @ 1000 offset 10s",
+			expOldest: time.Unix(990, 0),
+		},
+		{
+			query:       "rate(up[1m] @ start()) + rate(up[1m] @ end()) + up offset 1m",
+			expLookback: time.Minute,
+			expOldest:   start.Add(-time.Minute),
+		},
+		{
+			query:     "max_over_time(up[10m:1m] @ 1000)",
+			expOldest: time.Unix(400, 0),
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			lookback, oldest := queryLookback(expr, start, end)
+			if lookback != tc.expLookback {
+				t.Fatalf("expected lookback %s, got %s", tc.expLookback, lookback)
+			}
+			if !oldest.Equal(tc.expOldest) {
+				t.Fatalf("expected oldest %s, got %s", tc.expOldest, oldest)
+			}
+		})
+	}
+}
+
+func TestLimitLookback(t *testing.T) {
+	now := time.Unix(100000, 0)
+
+	for _, tc := range []struct {
+		name   string
+		mode   LookbackMode
+		path   string
+		params url.Values
+
+		expCode    int
+		expStart   string
+		expWarning string
+	}{
+		{
+			name:    "recent instant query",
+			mode:    LookbackReject,
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"rate(up[1h])"}, "time": []string{"99000"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "instant query with a large offset",
+			mode:    LookbackClamp,
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up offset 1d"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "instant query with an @ modifier",
+			mode:    LookbackReject,
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up @ 1000"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "old range query",
+			mode:    LookbackReject,
+			path:    "/api/v1/query_range",
+			params:  url.Values{"query": []string{"up"}, "start": []string{"10000"}, "end": []string{"100000"}, "step": []string{"60"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:       "clamped range query",
+			mode:       LookbackClamp,
+			path:       "/api/v1/query_range",
+			params:     url.Values{"query": []string{"rate(up[5m])"}, "start": []string{"10000"}, "end": []string{"100000"}, "step": []string{"60"}},
+			expCode:    http.StatusOK,
+			expStart:   "64300",
+			expWarning: "start clamped from 1970-01-01T02:46:40Z to 1970-01-01T17:51:40Z to stay within the maximum lookback of 10h",
+		},
+		{
+			name:    "range query entirely older than the lookback",
+			mode:    LookbackClamp,
+			path:    "/api/v1/query_range",
+			params:  url.Values{"query": []string{"up"}, "start": []string{"10000"}, "end": []string{"20000"}, "step": []string{"60"}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var start string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_ = req.ParseForm()
+				start = req.Form.Get("start")
+				w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithMaxLookback(MaxLookback{Duration: 10 * time.Hour, Mode: tc.mode}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r.lookbackLimiter.now = func() time.Time { return now }
+
+			tc.params.Set(proxyLabel, "ns1")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expStart != "" && start != tc.expStart {
+				t.Fatalf("expected start %q, got %q", tc.expStart, start)
+			}
+			if tc.expWarning != "" && !strings.Contains(w.Body.String(), tc.expWarning) {
+				t.Fatalf("expected warning %q, got %s", tc.expWarning, w.Body.String())
+			}
+		})
+	}
+
+	if _, err := NewRoutes(&url.URL{}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaxLookback(MaxLookback{Duration: time.Hour, Mode: "drop"})); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxMemcachedKeyLength is the maximum length of a memcached key.
+	maxMemcachedKeyLength = 250
+	// maxMemcachedRelativeTTL is the largest expiration time interpreted
+	// as a number of seconds by memcached. Larger values are Unix
+	// timestamps.
+	maxMemcachedRelativeTTL = 30 * 24 * time.Hour
+)
+
+// MemcachedStateStore is a StateStore backed by memcached. It allows
+// several replicas of the proxy to share their state. Memcached may evict
+// the keys before they expire.
+type MemcachedStateStore struct {
+	pool *connPool
+	now  func() time.Time
+}
+
+// NewMemcachedStateStore returns a new MemcachedStateStore connecting to the
+// given address.
+func NewMemcachedStateStore(addr string, c RemoteStoreConfig) *MemcachedStateStore {
+	var dialer net.Dialer
+	return &MemcachedStateStore{
+		pool: newConnPool(c, func(ctx context.Context, _ time.Time) (*poolConn, error) {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return &poolConn{Conn: conn, rd: bufio.NewReader(conn)}, nil
+		}),
+		now: time.Now,
+	}
+}
+
+// memcachedKey returns a valid memcached key. The keys which are too long or
+// contain whitespace or control characters are hashed.
+func memcachedKey(key string) string {
+	valid := len(key) > 0 && len(key) <= maxMemcachedKeyLength
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+
+	h := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+type memcachedError string
+
+func (e memcachedError) Error() string { return string(e) }
+
+func (e memcachedError) serverError() {}
+
+// Get implements the StateStore interface.
+func (s *MemcachedStateStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	key = memcachedKey(key)
+
+	var (
+		value []byte
+		found bool
+	)
+	err := s.pool.do(ctx, func(c *poolConn) error {
+		if _, err := io.WriteString(c, "get "+key+"\r\n"); err != nil {
+			return err
+		}
+
+		for {
+			line, err := readMemcachedLine(c.rd)
+			if err != nil {
+				return err
+			}
+
+			if line == "END" {
+				return nil
+			}
+
+			// VALUE <key> <flags> <bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] != "VALUE" {
+				return fmt.Errorf("unexpected reply %q", line)
+			}
+			n, err := strconv.Atoi(fields[3])
+			if err != nil || n < 0 {
+				return fmt.Errorf("unexpected reply %q", line)
+			}
+
+			b := make([]byte, n+2)
+			if _, err := io.ReadFull(c.rd, b); err != nil {
+				return err
+			}
+			value, found = b[:n], true
+		}
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("memcached: %w", err)
+	}
+
+	return value, found, nil
+}
+
+// Set implements the StateStore interface.
+func (s *MemcachedStateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	key = memcachedKey(key)
+
+	var exptime int64
+	switch {
+	case ttl <= 0:
+	case ttl > maxMemcachedRelativeTTL:
+		exptime = s.now().Add(ttl).Unix()
+	default:
+		// Round up to not expire before the TTL.
+		exptime = int64((ttl + time.Second - 1) / time.Second)
+	}
+
+	err := s.pool.do(ctx, func(c *poolConn) error {
+		b := []byte(fmt.Sprintf("set %s 0 %d %d\r\n", key, exptime, len(value)))
+		b = append(b, value...)
+		b = append(b, "\r\n"...)
+		if _, err := c.Write(b); err != nil {
+			return err
+		}
+
+		line, err := readMemcachedLine(c.rd)
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return fmt.Errorf("unexpected reply %q", line)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("memcached: %w", err)
+	}
+
+	return nil
+}
+
+// readMemcachedLine reads a line of the memcached text protocol. Error
+// replies are returned as errors.
+func readMemcachedLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	switch {
+	case line == "ERROR", strings.HasPrefix(line, "SERVER_ERROR "):
+		return "", memcachedError(line)
+	case strings.HasPrefix(line, "CLIENT_ERROR "):
+		// The connection may be out of sync after a client error.
+		return "", errors.New(line)
+	}
+
+	return line, nil
+}
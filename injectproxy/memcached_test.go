@@ -0,0 +1,177 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached implements the subset of the memcached text protocol used
+// by MemcachedStateStore.
+type fakeMemcached struct {
+	mtx      sync.Mutex
+	entries  map[string]string
+	exptimes map[string]string
+	conns    int
+}
+
+func (f *fakeMemcached) serve(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mtx.Lock()
+		f.conns++
+		f.mtx.Unlock()
+
+		go func() {
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					if err != io.EOF {
+						t.Errorf("unexpected error: %v", err)
+					}
+					return
+				}
+
+				fields := strings.Fields(line)
+				var reply string
+				switch {
+				case len(fields) == 2 && fields[0] == "get":
+					f.mtx.Lock()
+					v, found := f.entries[fields[1]]
+					f.mtx.Unlock()
+					if found {
+						reply = fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\n", fields[1], len(v), v)
+					}
+					reply += "END\r\n"
+				case len(fields) == 5 && fields[0] == "set":
+					n, _ := strconv.Atoi(fields[4])
+					b := make([]byte, n+2)
+					if _, err := io.ReadFull(rd, b); err != nil {
+						return
+					}
+					f.mtx.Lock()
+					f.entries[fields[1]] = string(b[:n])
+					f.exptimes[fields[1]] = fields[3]
+					f.mtx.Unlock()
+					reply = "STORED\r\n"
+				case len(fields) > 0 && fields[0] == "fail":
+					reply = "SERVER_ERROR out of memory\r\n"
+				default:
+					reply = "ERROR\r\n"
+				}
+
+				if _, err := io.WriteString(conn, reply); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestMemcachedStateStore(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	f := &fakeMemcached{entries: map[string]string{}, exptimes: map[string]string{}}
+	go f.serve(t, l)
+
+	s := NewMemcachedStateStore(l.Addr().String(), RemoteStoreConfig{Timeout: time.Second})
+	testStateStore(t, s)
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		key        string
+		ttl        time.Duration
+		expKey     string
+		expExptime string
+	}{
+		{key: "ttl", ttl: 1500 * time.Millisecond, expKey: "ttl", expExptime: "2"},
+		{key: "no ttl", expKey: memcachedKey("no ttl"), expExptime: "0"},
+		{key: strings.Repeat("a", 251), ttl: time.Minute, expKey: memcachedKey(strings.Repeat("a", 251)), expExptime: "60"},
+	} {
+		if err := s.Set(ctx, tc.key, []byte("1"), tc.ttl); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		v, found, err := s.Get(ctx, tc.key)
+		if err != nil || !found || string(v) != "1" {
+			t.Fatalf("%q: expected value 1, got %q (found=%v, err=%v)", tc.key, v, found, err)
+		}
+
+		f.mtx.Lock()
+		exptime, found := f.exptimes[tc.expKey]
+		f.mtx.Unlock()
+		if !found || exptime != tc.expExptime {
+			t.Fatalf("%q: expected exptime %s for key %q, got %q (found=%v)", tc.key, tc.expExptime, tc.expKey, exptime, found)
+		}
+	}
+
+	// The server errors are returned and the connection is reused.
+	err = s.pool.do(ctx, func(c *poolConn) error {
+		if _, err := io.WriteString(c, "fail\r\n"); err != nil {
+			return err
+		}
+		_, err := readMemcachedLine(c.rd)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "SERVER_ERROR") {
+		t.Fatalf("expected server error, got %v", err)
+	}
+
+	f.mtx.Lock()
+	conns := f.conns
+	f.mtx.Unlock()
+	if conns != 1 {
+		t.Fatalf("expected 1 connection, got %d", conns)
+	}
+}
+
+func TestMemcachedKey(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		hashed bool
+	}{
+		{key: "cache:abc"},
+		{key: strings.Repeat("a", 250)},
+		{key: strings.Repeat("a", 251), hashed: true},
+		{key: `spicedb:"user:1" "view"`, hashed: true},
+		{key: "", hashed: true},
+	} {
+		got := memcachedKey(tc.key)
+		if (got != tc.key) != tc.hashed {
+			t.Fatalf("%q: expected hashed=%v, got %q", tc.key, tc.hashed, got)
+		}
+		if len(got) > maxMemcachedKeyLength {
+			t.Fatalf("%q: key too long", tc.key)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultMemoMaxEntries is the maximum number of memoized query results.
+const defaultMemoMaxEntries = 1000
+
+// QueryMemoization defines how long the results of the instant queries
+// matching the pattern are memoized.
+type QueryMemoization struct {
+	// Pattern is matched against the query expression.
+	Pattern *regexp.Regexp
+	// Window is the duration for which the result is reused.
+	Window time.Duration
+}
+
+// WithQueryMemoization reuses the results of the instant queries matching
+// one of the given patterns for a short window. The first matching pattern
+// wins.
+//
+// Rulers evaluating the same expression every few seconds (e.g. several
+// replicas of the same rule group) then share a single upstream
+// evaluation. The evaluation time is ignored when looking up a memoized
+// result which means that the response may be up to one window old.
+func WithQueryMemoization(rules ...QueryMemoization) Option {
+	return optionFunc(func(o *options) {
+		o.memoRules = append(o.memoRules, rules...)
+	})
+}
+
+type queryMemoizer struct {
+	rules    []QueryMemoization
+	cache    *responseCache
+	requests *prometheus.CounterVec
+}
+
+func newQueryMemoizer(rules []QueryMemoization, reg prometheus.Registerer) *queryMemoizer {
+	return &queryMemoizer{
+		rules: rules,
+		cache: newResponseCache(defaultMemoMaxEntries),
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_memoization_requests_total",
+			Help: "Total number of instant queries matching a memoization pattern, partitioned by result (hit or miss).",
+		}, []string{"result"}),
+	}
+}
+
+// window returns the memoization window of the query expression or zero if
+// it doesn't match any pattern.
+func (m *queryMemoizer) window(expr string) time.Duration {
+	for _, rule := range m.rules {
+		if rule.Pattern.MatchString(expr) {
+			return rule.Window
+		}
+	}
+
+	return 0
+}
+
+// memoKey returns the memoization key of the request. The evaluation time
+// is left out on purpose.
+func memoKey(req *http.Request) string {
+	params := url.Values{}
+	for k, v := range req.Form {
+		if k == timeParam {
+			continue
+		}
+		params[k] = v
+	}
+
+	h := sha256.New()
+	for _, s := range []string{
+		req.URL.Path,
+		req.Header.Get("Accept-Encoding"),
+		params.Encode(),
+	} {
+		_, _ = io.WriteString(h, s)
+		_, _ = h.Write([]byte{0})
+	}
+	writeTenants(h, MustLabelValues(req.Context()))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// memoizeQuery serves the results of the instant queries from the
+// memoization cache when the expression matches a pattern.
+func (r *routes) memoizeQuery(next http.HandlerFunc) http.HandlerFunc {
+	if r.memoizer == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		window := r.memoizer.window(req.Form.Get(queryParam))
+		if window <= 0 {
+			next(w, req)
+			return
+		}
+
+		key := memoKey(req)
+		if resp, found := r.memoizer.cache.get(key); found {
+			r.memoizer.requests.WithLabelValues("hit").Inc()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			r.annotateCache(w, "hit")
+			w.WriteHeader(resp.Status)
+			_, _ = w.Write(resp.Body)
+			return
+		}
+		r.memoizer.requests.WithLabelValues("miss").Inc()
+		r.annotateCache(w, "miss")
+
+		rec := &cacheRecorder{statusRecorder: newStatusRecorder(w)}
+		next(rec, req)
+
+		if rec.status != http.StatusOK {
+			return
+		}
+
+		r.memoizer.cache.set(key, &cachedResponse{
+			Status: rec.status,
+			Header: w.Header().Clone(),
+			Body:   rec.buf.Bytes(),
+		}, window)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryMemoization(t *testing.T) {
+	var calls int
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryMemoization(
+			QueryMemoization{Pattern: regexp.MustCompile(`^up$`), Window: 5 * time.Second},
+			QueryMemoization{Pattern: regexp.MustCompile(`^rate`), Window: 0},
+		),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	r.memoizer.cache.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		advance time.Duration
+
+		expCalls int
+	}{
+		{
+			name:     "miss",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1&time=1",
+			expCalls: 1,
+		},
+		{
+			name:     "hit with a different evaluation time",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1&time=2",
+			advance:  time.Second,
+			expCalls: 1,
+		},
+		{
+			name:     "hit with a POST request",
+			method:   http.MethodPost,
+			url:      "http://prometheus.example.com/api/v1/query",
+			body:     "query=up&namespace=ns1&time=3",
+			expCalls: 1,
+		},
+		{
+			name:     "other tenant",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&namespace=ns2&time=3",
+			expCalls: 2,
+		},
+		{
+			name:     "no matching pattern",
+			url:      "http://prometheus.example.com/api/v1/query?query=sum(up)&namespace=ns1",
+			expCalls: 3,
+		},
+		{
+			name:     "no matching pattern",
+			url:      "http://prometheus.example.com/api/v1/query?query=sum(up)&namespace=ns1",
+			expCalls: 4,
+		},
+		{
+			name:     "zero window",
+			url:      "http://prometheus.example.com/api/v1/query?query=rate(foo[5m])&namespace=ns1",
+			expCalls: 5,
+		},
+		{
+			name:     "range queries aren't memoized",
+			url:      "http://prometheus.example.com/api/v1/query_range?query=up&namespace=ns1&start=0&end=1&step=1",
+			expCalls: 6,
+		},
+		{
+			name:     "expired",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1&time=10",
+			advance:  5 * time.Second,
+			expCalls: 7,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tc.url, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if calls != tc.expCalls {
+				t.Fatalf("expected %d upstream calls, got %d", tc.expCalls, calls)
+			}
+		})
+	}
+}
+
+func TestMemoKeyTenants(t *testing.T) {
+	key := func(tenants ...string) string {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req = req.WithContext(WithLabelValues(req.Context(), tenants))
+		_ = req.ParseForm()
+		return memoKey(req)
+	}
+
+	if key("a,b") == key("a", "b") {
+		t.Fatal("expected different keys for the tenant \"a,b\" and the tenants \"a\" and \"b\"")
+	}
+}
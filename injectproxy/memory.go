@@ -0,0 +1,114 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// memoryBallast is a large allocation which is never used. It raises the
+// heap size at which the garbage collector triggers with GOGC so that the
+// collections are less frequent when the live heap is small. Its pages are
+// never touched and don't count in the resident memory.
+var memoryBallast []byte
+
+// MemoryTuning configures the garbage collector of the process, like the
+// GOGC and GOMEMLIMIT environment variables.
+type MemoryTuning struct {
+	// GOGC, if not empty, is the garbage collection target percentage or
+	// "off" to collect only when MemoryLimit is reached.
+	GOGC string
+	// MemoryLimit, if positive, is the soft memory limit of the Go
+	// runtime in bytes. The garbage collector runs more often when the
+	// limit is approached, whatever GOGC.
+	MemoryLimit int64
+	// BallastBytes, if positive, is the size of the memory ballast.
+	BallastBytes int64
+}
+
+// parseGOGC returns the garbage collection percentage of a GOGC value.
+func parseGOGC(s string) (int, error) {
+	if strings.EqualFold(s, "off") {
+		return -1, nil
+	}
+
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 {
+		return 0, fmt.Errorf("invalid GOGC value %q: must be a positive percentage or \"off\"", s)
+	}
+
+	return p, nil
+}
+
+// TuneMemory applies the memory settings to the Go runtime and registers
+// the proxy_heap_in_use_bytes and proxy_memory_limit_bytes gauges, so that
+// the operators can tune the memory behavior of the proxy when large
+// responses are buffered. The settings override the GOGC and GOMEMLIMIT
+// environment variables. It must be called once, on startup.
+func TuneMemory(m MemoryTuning, reg prometheus.Registerer) error {
+	if m.MemoryLimit < 0 {
+		return fmt.Errorf("the memory limit must be positive, got %d", m.MemoryLimit)
+	}
+	if m.BallastBytes < 0 {
+		return fmt.Errorf("the memory ballast size must be positive, got %d", m.BallastBytes)
+	}
+
+	if m.GOGC != "" {
+		p, err := parseGOGC(m.GOGC)
+		if err != nil {
+			return err
+		}
+		debug.SetGCPercent(p)
+	}
+
+	if m.MemoryLimit > 0 {
+		debug.SetMemoryLimit(m.MemoryLimit)
+	}
+
+	memoryBallast = nil
+	if m.BallastBytes > 0 {
+		memoryBallast = make([]byte, m.BallastBytes)
+	}
+	ballast := float64(len(memoryBallast))
+
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_heap_in_use_bytes",
+		Help: "Memory occupied by the live and unswept heap objects of the proxy, excluding the memory ballast.",
+	}, func() float64 {
+		s := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		metrics.Read(s)
+		return max(0, float64(s[0].Value.Uint64())-ballast)
+	})
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_memory_limit_bytes",
+		Help: "Soft memory limit of the Go runtime. 0 means no limit.",
+	}, func() float64 {
+		// A negative value reads the limit without changing it.
+		limit := debug.SetMemoryLimit(-1)
+		if limit == math.MaxInt64 {
+			return 0
+		}
+		return float64(limit)
+	})
+
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTuneMemory(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tuning MemoryTuning
+
+		expErr     bool
+		expPercent int
+		expLimit   float64
+		expBallast int
+	}{
+		{
+			name:       "defaults",
+			expPercent: 100,
+		},
+		{
+			name:       "gogc and memory limit",
+			tuning:     MemoryTuning{GOGC: "200", MemoryLimit: 1 << 30},
+			expPercent: 200,
+			expLimit:   1 << 30,
+		},
+		{
+			name:       "gc off",
+			tuning:     MemoryTuning{GOGC: "off", MemoryLimit: 1 << 30},
+			expPercent: -1,
+			expLimit:   1 << 30,
+		},
+		{
+			name:       "ballast",
+			tuning:     MemoryTuning{BallastBytes: 1 << 20},
+			expPercent: 100,
+			expBallast: 1 << 20,
+		},
+		{
+			name:   "invalid gogc",
+			tuning: MemoryTuning{GOGC: "fast"},
+			expErr: true,
+		},
+		{
+			name:   "negative gogc",
+			tuning: MemoryTuning{GOGC: "-1"},
+			expErr: true,
+		},
+		{
+			name:   "negative memory limit",
+			tuning: MemoryTuning{MemoryLimit: -1},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prevPercent := debug.SetGCPercent(100)
+			prevLimit := debug.SetMemoryLimit(-1)
+			t.Cleanup(func() {
+				debug.SetGCPercent(prevPercent)
+				debug.SetMemoryLimit(prevLimit)
+				memoryBallast = nil
+			})
+
+			reg := prometheus.NewRegistry()
+			err := TuneMemory(tc.tuning, reg)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := debug.SetGCPercent(100); got != tc.expPercent {
+				t.Fatalf("expected GC percent %d, got %d", tc.expPercent, got)
+			}
+			if got := len(memoryBallast); got != tc.expBallast {
+				t.Fatalf("expected a ballast of %d bytes, got %d", tc.expBallast, got)
+			}
+
+			gauges := map[string]float64{}
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, mf := range mfs {
+				gauges[mf.GetName()] = mf.GetMetric()[0].GetGauge().GetValue()
+			}
+
+			if gauges["proxy_heap_in_use_bytes"] <= 0 {
+				t.Fatalf("expected a positive heap in use, got %v", gauges["proxy_heap_in_use_bytes"])
+			}
+			// Without override, the limit depends on GOMEMLIMIT.
+			if tc.expLimit > 0 && gauges["proxy_memory_limit_bytes"] != tc.expLimit {
+				t.Fatalf("expected a memory limit of %v bytes, got %v", tc.expLimit, gauges["proxy_memory_limit_bytes"])
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// defaultShadowTimeout is the default timeout of the shadow requests.
+	defaultShadowTimeout = time.Minute
+	// defaultShadowMaxInflight is the default maximum number of in-flight
+	// shadow requests.
+	defaultShadowMaxInflight = 100
+)
+
+// ShadowUpstream configures the mirroring of the queries to a shadow
+// upstream.
+type ShadowUpstream struct {
+	// URL is the shadow upstream. The path of the primary upstream is
+	// replaced by its path.
+	URL *url.URL
+	// Percentage is the percentage of the instant and range queries
+	// mirrored to the shadow upstream, between 0 and 100.
+	Percentage float64
+	// Timeout is the timeout of the shadow requests. It defaults to 1m.
+	Timeout time.Duration
+	// MaxInflight is the maximum number of in-flight shadow requests. The
+	// queries beyond the limit aren't mirrored. It defaults to 100.
+	MaxInflight int
+}
+
+// WithShadowUpstream duplicates a sample of the instant and range queries to
+// a shadow upstream (e.g. a new version under test). The shadow requests are
+// sent asynchronously, their responses are discarded and compared with the
+// primary responses in the metrics only.
+func WithShadowUpstream(s ShadowUpstream) Option {
+	return optionFunc(func(o *options) {
+		o.shadowUpstream = &s
+	})
+}
+
+// mirroringTransport sends the shadow requests.
+type mirroringTransport struct {
+	next     http.RoundTripper
+	shadow   http.RoundTripper
+	primary  *url.URL
+	cfg      ShadowUpstream
+	limits   BodyBufferLimits
+	inflight chan struct{}
+	sample   func() bool
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newMirroringTransport(next, shadow http.RoundTripper, primary *url.URL, cfg ShadowUpstream, limits BodyBufferLimits, reg prometheus.Registerer) (*mirroringTransport, error) {
+	if cfg.URL == nil {
+		return nil, fmt.Errorf("shadow upstream URL is required")
+	}
+	if cfg.Percentage < 0 || cfg.Percentage > 100 {
+		return nil, fmt.Errorf("shadow percentage must be between 0 and 100, got %v", cfg.Percentage)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultShadowTimeout
+	}
+	if cfg.MaxInflight <= 0 {
+		cfg.MaxInflight = defaultShadowMaxInflight
+	}
+
+	return &mirroringTransport{
+		next:     next,
+		shadow:   shadow,
+		primary:  primary,
+		cfg:      cfg,
+		limits:   limits,
+		inflight: make(chan struct{}, cfg.MaxInflight),
+		sample:   func() bool { return rand.Float64()*100 < cfg.Percentage },
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "shadow_requests_total",
+			Help: "Total number of queries mirrored to the shadow upstream, partitioned by handler and result (match or mismatch of the status codes, error when the shadow request failed, skipped when too many shadow requests were in flight).",
+		}, []string{"handler", "result"}),
+		duration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "shadow_request_duration_seconds",
+			Help:    "Time until the response headers of the mirrored queries, partitioned by handler and upstream (primary or shadow).",
+			Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"handler", "upstream"}),
+	}, nil
+}
+
+// shadowURL returns the URL of the shadow request.
+func (t *mirroringTransport) shadowURL(u *url.URL) *url.URL {
+	su := *u
+	su.Scheme = t.cfg.URL.Scheme
+	su.Host = t.cfg.URL.Host
+	su.Path = strings.TrimSuffix(t.cfg.URL.Path, "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, strings.TrimSuffix(t.primary.Path, "/")), "/")
+	su.RawPath = ""
+
+	return &su
+}
+
+// primaryResult is the outcome of the primary request.
+type primaryResult struct {
+	status int
+	err    error
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *mirroringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isQueryPath(req.URL.Path) || !t.sample() {
+		return t.next.RoundTrip(req)
+	}
+
+	handler := handlerName(req.Context())
+	select {
+	case t.inflight <- struct{}{}:
+	default:
+		t.requests.WithLabelValues(handler, "skipped").Inc()
+		return t.next.RoundTrip(req)
+	}
+
+	// Buffer the body to send it twice.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := t.limits.bufferBody(req.Body)
+		if err != nil {
+			<-t.inflight
+			return nil, err
+		}
+		_ = req.Body.Close()
+		defer body.Close()
+
+		req = req.Clone(req.Context())
+		req.GetBody = body.Open
+		if req.Body, err = req.GetBody(); err != nil {
+			<-t.inflight
+			return nil, err
+		}
+	}
+
+	// The shadow request isn't cancelled with the client request.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), t.cfg.Timeout)
+	sreq := req.Clone(ctx)
+	sreq.URL = t.shadowURL(req.URL)
+	sreq.Host = ""
+	if req.GetBody != nil {
+		// Open the body now since the buffered body is released once the
+		// primary request returns.
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			<-t.inflight
+			return t.next.RoundTrip(req)
+		}
+		sreq.Body = body
+	}
+
+	primary := make(chan primaryResult, 1)
+	go func() {
+		defer func() { <-t.inflight }()
+		defer cancel()
+		t.mirror(sreq, handler, primary)
+	}()
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	t.duration.WithLabelValues(handler, "primary").Observe(time.Since(start).Seconds())
+
+	res := primaryResult{err: err}
+	if resp != nil {
+		res.status = resp.StatusCode
+	}
+	primary <- res
+
+	return resp, err
+}
+
+// mirror sends the shadow request and compares its outcome with the primary
+// request.
+func (t *mirroringTransport) mirror(req *http.Request, handler string, primary <-chan primaryResult) {
+	start := time.Now()
+	resp, err := t.shadow.RoundTrip(req)
+	if err != nil {
+		t.requests.WithLabelValues(handler, "error").Inc()
+		return
+	}
+	t.duration.WithLabelValues(handler, "shadow").Observe(time.Since(start).Seconds())
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var res primaryResult
+	select {
+	case res = <-primary:
+	case <-req.Context().Done():
+		// The primary request didn't complete within the shadow timeout.
+		return
+	}
+
+	result := "match"
+	if res.err != nil || res.status != resp.StatusCode {
+		result = "mismatch"
+	}
+	t.requests.WithLabelValues(handler, result).Inc()
+}
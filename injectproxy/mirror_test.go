@@ -0,0 +1,212 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShadowURL(t *testing.T) {
+	for _, tc := range []struct {
+		primary, shadow, req string
+
+		exp string
+	}{
+		{
+			primary: "http://prometheus:9090",
+			shadow:  "http://thanos:10902",
+			req:     "http://prometheus:9090/api/v1/query?query=up",
+			exp:     "http://thanos:10902/api/v1/query?query=up",
+		},
+		{
+			primary: "http://prometheus:9090/prom/",
+			shadow:  "https://thanos/thanos",
+			req:     "http://prometheus:9090/prom/api/v1/query_range?query=up",
+			exp:     "https://thanos/thanos/api/v1/query_range?query=up",
+		},
+	} {
+		t.Run(tc.exp, func(t *testing.T) {
+			mt, err := newMirroringTransport(nil, nil, mustParseURL(t, tc.primary), ShadowUpstream{URL: mustParseURL(t, tc.shadow)}, BodyBufferLimits{}, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := mt.shadowURL(mustParseURL(t, tc.req)).String(); got != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestNewMirroringTransport(t *testing.T) {
+	for _, tc := range []ShadowUpstream{
+		{Percentage: 10},
+		{URL: &url.URL{Host: "thanos"}, Percentage: 101},
+		{URL: &url.URL{Host: "thanos"}, Percentage: -1},
+	} {
+		if _, err := newMirroringTransport(nil, nil, &url.URL{}, tc, BodyBufferLimits{}, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("%+v: expected error, got nil", tc)
+		}
+	}
+}
+
+func TestMirrorQueries(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	type shadowRequest struct {
+		path  string
+		query string
+	}
+	received := make(chan shadowRequest, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- shadowRequest{path: req.URL.Path, query: req.Form.Get("query")}
+
+		if req.Form.Get("query") == `down{namespace="ns1"}` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer shadow.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithShadowUpstream(ShadowUpstream{URL: mustParseURL(t, shadow.URL), Percentage: 100}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor := func(t *testing.T, handler, result string, exp float64) {
+		t.Helper()
+
+		var got float64
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if got = testutil.ToFloat64(r.mirror.requests.WithLabelValues(handler, result)); got == exp {
+				return
+			}
+		}
+		t.Fatalf("expected %v %s shadow requests for %s, got %v", exp, result, handler, got)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		params url.Values
+
+		expShadow *shadowRequest
+		expResult string
+	}{
+		{
+			name:      "instant query",
+			path:      "/api/v1/query",
+			params:    url.Values{"query": []string{"up"}},
+			expShadow: &shadowRequest{path: "/api/v1/query", query: `up{namespace="ns1"}`},
+			expResult: "match",
+		},
+		{
+			name:      "range query in the body",
+			method:    http.MethodPost,
+			path:      "/api/v1/query_range",
+			params:    url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"60"}, "step": []string{"15"}},
+			expShadow: &shadowRequest{path: "/api/v1/query_range", query: `up{namespace="ns1"}`},
+			expResult: "match",
+		},
+		{
+			name:      "shadow error",
+			path:      "/api/v1/query",
+			params:    url.Values{"query": []string{"down"}},
+			expShadow: &shadowRequest{path: "/api/v1/query", query: `down{namespace="ns1"}`},
+			expResult: "mismatch",
+		},
+		{
+			name:   "series aren't mirrored",
+			path:   "/api/v1/series",
+			params: url.Values{"match[]": []string{"up"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := url.Values{proxyLabel: []string{"ns1"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+tc.path, strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+params.Encode(), nil)
+			}
+
+			var before float64
+			if tc.expResult != "" {
+				before = testutil.ToFloat64(r.mirror.requests.WithLabelValues(tc.path, tc.expResult))
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if tc.expShadow == nil {
+				select {
+				case got := <-received:
+					t.Fatalf("expected no shadow request, got %+v", got)
+				case <-time.After(100 * time.Millisecond):
+				}
+				return
+			}
+
+			select {
+			case got := <-received:
+				if got != *tc.expShadow {
+					t.Fatalf("expected shadow request %+v, got %+v", *tc.expShadow, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the shadow request")
+			}
+
+			waitFor(t, tc.path, tc.expResult, before+1)
+		})
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return u
+}
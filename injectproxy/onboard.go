@@ -0,0 +1,136 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxKnownTenants bounds the number of onboarded tenants remembered in
+// memory. The tenants beyond the limit are looked up in the store.
+const maxKnownTenants = 10000
+
+// WithTenantOnboarding emits a "tenant_onboarded" event to the event sink
+// the first time a tenant is seen, for instance to register the tenant in
+// the platform with a webhook event sink. The onboarded tenants are
+// recorded in the given store so that the event is emitted only once
+// across restarts (persistent store) or replicas (remote store). If nil, an
+// in-memory store is used.
+//
+// The tenants don't need to be declared beforehand: the default limits
+// (e.g. WithTenantRateLimits and WithLatencyBudgets) apply to the tenants
+// without override.
+func WithTenantOnboarding(s StateStore) Option {
+	return optionFunc(func(o *options) {
+		if s == nil {
+			s = NewMemoryStateStore()
+		}
+		o.onboardingStore = s
+	})
+}
+
+type tenantOnboarder struct {
+	store  StateStore
+	events EventSink
+	now    func() time.Time
+	logger *log.Logger
+
+	mtx   sync.Mutex
+	known map[string]struct{}
+
+	onboarded prometheus.Counter
+}
+
+func newTenantOnboarder(s StateStore, events EventSink, reg prometheus.Registerer) *tenantOnboarder {
+	return &tenantOnboarder{
+		store:  s,
+		events: events,
+		now:    time.Now,
+		logger: log.Default(),
+		known:  map[string]struct{}{},
+		onboarded: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "tenants_onboarded_total",
+			Help: "Total number of tenants seen for the first time.",
+		}),
+	}
+}
+
+func (o *tenantOnboarder) isKnown(tenant string) bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	_, found := o.known[tenant]
+	return found
+}
+
+func (o *tenantOnboarder) remember(tenant string) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if len(o.known) < maxKnownTenants {
+		o.known[tenant] = struct{}{}
+	}
+}
+
+// observe onboards the tenant if it hasn't been seen before. Errors of the
+// store are logged and the tenant is tried again on the next request.
+func (o *tenantOnboarder) observe(ctx context.Context, tenant, handler string) {
+	if o.isKnown(tenant) {
+		return
+	}
+
+	key := "tenant:" + tenant
+	_, found, err := o.store.Get(ctx, key)
+	if err != nil {
+		o.logger.Printf("failed to look up tenant %q: %v", tenant, err)
+		return
+	}
+
+	if !found {
+		if err := o.store.Set(ctx, key, []byte("1"), 0); err != nil {
+			o.logger.Printf("failed to record tenant %q: %v", tenant, err)
+			return
+		}
+
+		o.onboarded.Inc()
+		if o.events != nil {
+			o.events.Emit(Event{Time: o.now(), Type: EventTenantOnboarded, Tenant: tenant, Handler: handler})
+		}
+	}
+
+	o.remember(tenant)
+}
+
+// onboardTenants onboards the tenants of the request before calling the
+// next handler.
+func (r *routes) onboardTenants(next http.HandlerFunc) http.HandlerFunc {
+	if r.onboarder == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, tenant := range MustLabelValues(req.Context()) {
+			r.onboarder.observe(req.Context(), tenant, handlerName(req.Context()))
+		}
+
+		next(w, req)
+	}
+}
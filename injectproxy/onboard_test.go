@@ -0,0 +1,86 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantOnboarding(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	newRoutes := func(s StateStore, sink EventSink) *routes {
+		t.Helper()
+		r, err := NewRoutes(
+			m.url,
+			proxyLabel,
+			HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithTenantOnboarding(s),
+			WithEventSink(sink),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return r
+	}
+
+	query := func(r *routes, tenants string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+tenants, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	expTenants := func(sink *recordingSink, exp ...string) {
+		t.Helper()
+		if len(sink.events) != len(exp) {
+			t.Fatalf("expected onboarded tenants %v, got %v", exp, sink.events)
+		}
+		for i, e := range sink.events {
+			if e.Type != EventTenantOnboarded || e.Tenant != exp[i] || e.Handler != "/api/v1/query" {
+				t.Fatalf("expected onboarded tenants %v, got %v", exp, sink.events)
+			}
+		}
+	}
+
+	store := NewMemoryStateStore()
+	sink1, sink2 := &recordingSink{}, &recordingSink{}
+	r1, r2 := newRoutes(store, sink1), newRoutes(store, sink2)
+
+	query(r1, "namespace=ns1")
+	query(r1, "namespace=ns1")
+	query(r1, "namespace=ns1&namespace=ns2")
+	expTenants(sink1, "ns1", "ns2")
+
+	// Another replica sharing the store only onboards the new tenants.
+	query(r2, "namespace=ns2&namespace=ns3")
+	expTenants(sink2, "ns3")
+
+	// Errors of the store don't fail the request and the tenant is tried
+	// again.
+	sink3 := &recordingSink{}
+	r3 := newRoutes(failingStateStore{}, sink3)
+	query(r3, "namespace=ns1")
+	expTenants(sink3)
+	if len(r3.onboarder.known) != 0 {
+		t.Fatalf("expected no known tenant, got %v", r3.onboarder.known)
+	}
+}
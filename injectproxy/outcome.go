@@ -0,0 +1,128 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The outcomes of the requests. Only the upstream and proxy errors should
+// count against the availability of a handler.
+const (
+	// outcomeSuccess is a request served successfully.
+	outcomeSuccess = "success"
+	// outcomeLimited is a request rejected to protect the upstream or the
+	// proxy (429 and 503 status codes returned by the proxy).
+	outcomeLimited = "limited"
+	// outcomeBlocked is a request rejected as invalid or by a policy (4xx
+	// status codes other than 429).
+	outcomeBlocked = "blocked"
+	// outcomeUpstreamError is a request for which the upstream failed or
+	// returned a 5xx status code.
+	outcomeUpstreamError = "upstream_error"
+	// outcomeProxyError is a request which failed in the proxy (other 5xx
+	// status codes and panics).
+	outcomeProxyError = "proxy_error"
+)
+
+// requestOutcome tracks the involvement of the upstream in a request. The
+// fields can be set concurrently by the sub-requests of a request.
+type requestOutcome struct {
+	// upstream is true when the response comes from the upstream.
+	upstream atomic.Bool
+	// upstreamFailed is true when the upstream couldn't be reached.
+	upstreamFailed atomic.Bool
+	// throttled is true when the upstream throttled the request and
+	// retryAfter is how long it asked to wait.
+	throttled  atomic.Bool
+	retryAfter atomic.Int64
+}
+
+// classify returns the outcome of the request given its status code.
+func (o *requestOutcome) classify(status int) string {
+	switch {
+	case status < 400:
+		return outcomeSuccess
+	case o.upstreamFailed.Load():
+		return outcomeUpstreamError
+	case status >= 500 && o.upstream.Load():
+		return outcomeUpstreamError
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		return outcomeLimited
+	case status >= 500:
+		return outcomeProxyError
+	default:
+		return outcomeBlocked
+	}
+}
+
+// markUpstreamResponse records that the response of the request comes from
+// the upstream.
+func markUpstreamResponse(ctx context.Context) {
+	if o := outcomeFrom(ctx); o != nil {
+		o.upstream.Store(true)
+	}
+}
+
+// markProxyResponse records that the response of the request is generated
+// by the proxy, even if the upstream has been queried.
+func markProxyResponse(ctx context.Context) {
+	if o := outcomeFrom(ctx); o != nil {
+		o.upstream.Store(false)
+	}
+}
+
+// markUpstreamFailure records that the upstream couldn't be reached.
+func markUpstreamFailure(ctx context.Context) {
+	if o := outcomeFrom(ctx); o != nil {
+		o.upstreamFailed.Store(true)
+	}
+}
+
+func newOutcomeCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	return promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "http_request_outcomes_total",
+		Help: "Total number of requests, partitioned by handler and outcome (success, limited, blocked, upstream_error or proxy_error). The limited and blocked requests are rejected by the proxy on purpose and shouldn't count against the availability.",
+	}, []string{"handler", "outcome"})
+}
+
+// countOutcomes counts the requests of the handler by outcome. It creates the
+// request context shared by the middlewares.
+func countOutcomes(outcomes *prometheus.CounterVec, pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rc := newRequestContext(pattern)
+		o := &rc.outcome
+		rec := newStatusRecorder(w)
+		defer func() {
+			if err := recover(); err != nil {
+				outcome := outcomeProxyError
+				if err == http.ErrAbortHandler && o.upstream.Load() {
+					// The upstream response was interrupted.
+					outcome = outcomeUpstreamError
+				}
+				outcomes.WithLabelValues(pattern, outcome).Inc()
+				panic(err)
+			}
+
+			outcomes.WithLabelValues(pattern, o.classify(rec.status)).Inc()
+		}()
+
+		next.ServeHTTP(rec, req.WithContext(withRequestContext(req.Context(), rc)))
+	})
+}
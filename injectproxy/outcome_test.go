@@ -0,0 +1,185 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestOutcomeClassify(t *testing.T) {
+	for _, tc := range []struct {
+		status         int
+		upstream       bool
+		upstreamFailed bool
+
+		exp string
+	}{
+		{status: http.StatusOK, exp: outcomeSuccess},
+		{status: http.StatusOK, upstream: true, exp: outcomeSuccess},
+		{status: http.StatusBadRequest, exp: outcomeBlocked},
+		{status: http.StatusForbidden, exp: outcomeBlocked},
+		{status: http.StatusUnprocessableEntity, upstream: true, exp: outcomeBlocked},
+		{status: http.StatusTooManyRequests, exp: outcomeLimited},
+		{status: http.StatusTooManyRequests, upstream: true, exp: outcomeLimited},
+		{status: http.StatusServiceUnavailable, exp: outcomeLimited},
+		{status: http.StatusServiceUnavailable, upstream: true, exp: outcomeUpstreamError},
+		{status: http.StatusInternalServerError, upstream: true, exp: outcomeUpstreamError},
+		{status: http.StatusBadGateway, upstreamFailed: true, exp: outcomeUpstreamError},
+		{status: http.StatusInternalServerError, exp: outcomeProxyError},
+	} {
+		o := &requestOutcome{}
+		o.upstream.Store(tc.upstream)
+		o.upstreamFailed.Store(tc.upstreamFailed)
+
+		if got := o.classify(tc.status); got != tc.exp {
+			t.Fatalf("status %d (upstream: %v, upstream failed: %v): expected %q, got %q", tc.status, tc.upstream, tc.upstreamFailed, tc.exp, got)
+		}
+	}
+}
+
+func TestRequestOutcomes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.FormValue("query") {
+		case `fail{namespace="ns1"}`:
+			w.WriteHeader(http.StatusInternalServerError)
+		case `vector{namespace="ns1"}`:
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			w.Write(okResponse)
+		}
+	}))
+	defer m.Close()
+
+	reg := prometheus.NewRegistry()
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithPrometheusRegistry(reg),
+		WithRangeSplitting(RangeSplitting{Interval: 24 * time.Hour}),
+		WithTenantRateLimits(TenantRateLimits{
+			Header:  "X-Scope-OrgID",
+			Default: RateLimit{RequestsPerSecond: 0.001, Burst: 1},
+			Tenants: map[string]RateLimit{"unlimited": {}},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		params url.Values
+		tenant string
+
+		expCode int
+	}{
+		{
+			name:    "success",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}},
+			tenant:  "unlimited",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "missing label",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up"}},
+			tenant:  "unlimited",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "first request of the limited tenant",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}},
+			tenant:  "limited",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "rate limited",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}},
+			tenant:  "limited",
+			expCode: http.StatusTooManyRequests,
+		},
+		{
+			name:    "upstream error",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"fail"}, proxyLabel: []string{"ns1"}},
+			tenant:  "unlimited",
+			expCode: http.StatusInternalServerError,
+		},
+		{
+			name:    "unexpected result of a split query",
+			path:    "/api/v1/query_range",
+			params:  url.Values{"query": []string{"vector"}, "start": []string{"0"}, "end": []string{"172800"}, "step": []string{"3600"}, proxyLabel: []string{"ns1"}},
+			tenant:  "unlimited",
+			expCode: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil)
+			req.Header.Set("X-Scope-OrgID", tc.tenant)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_request_outcomes_total Total number of requests, partitioned by handler and outcome (success, limited, blocked, upstream_error or proxy_error). The limited and blocked requests are rejected by the proxy on purpose and shouldn't count against the availability.
+# TYPE http_request_outcomes_total counter
+http_request_outcomes_total{handler="/api/v1/query",outcome="blocked"} 1
+http_request_outcomes_total{handler="/api/v1/query",outcome="limited"} 1
+http_request_outcomes_total{handler="/api/v1/query",outcome="success"} 2
+http_request_outcomes_total{handler="/api/v1/query",outcome="upstream_error"} 1
+http_request_outcomes_total{handler="/api/v1/query_range",outcome="proxy_error"} 1
+`), "http_request_outcomes_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unreachable upstream is an upstream error.
+	m.Close()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}}.Encode(), nil)
+	req.Header.Set("X-Scope-OrgID", "unlimited")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusBadGateway, w.Code, w.Body.String())
+	}
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_request_outcomes_total Total number of requests, partitioned by handler and outcome (success, limited, blocked, upstream_error or proxy_error). The limited and blocked requests are rejected by the proxy on purpose and shouldn't count against the availability.
+# TYPE http_request_outcomes_total counter
+http_request_outcomes_total{handler="/api/v1/query",outcome="blocked"} 1
+http_request_outcomes_total{handler="/api/v1/query",outcome="limited"} 1
+http_request_outcomes_total{handler="/api/v1/query",outcome="success"} 2
+http_request_outcomes_total{handler="/api/v1/query",outcome="upstream_error"} 2
+http_request_outcomes_total{handler="/api/v1/query_range",outcome="proxy_error"} 1
+`), "http_request_outcomes_total"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RequestPacing configures the rate at which the requests are released to
+// the upstream.
+type RequestPacing struct {
+	// RequestsPerSecond is the steady rate of the requests sent to the
+	// upstream.
+	RequestsPerSecond float64
+	// Burst is the number of requests released immediately on top of the
+	// steady rate after an idle period.
+	Burst int
+	// MaxDelay is how long a request can be delayed. The requests which
+	// would be delayed longer are rejected.
+	MaxDelay time.Duration
+}
+
+// WithRequestPacing smooths the bursts of requests (e.g. the rule
+// evaluations aligned on the same schedule) with a leaky bucket: the
+// requests are released to the upstream at a steady rate, the burst
+// allowance being released immediately. The requests which would be delayed
+// longer than the maximum delay are rejected with "503 Service Unavailable".
+// The responses served from the cache or shared with coalesced queries
+// aren't delayed.
+func WithRequestPacing(p RequestPacing) Option {
+	return optionFunc(func(o *options) {
+		o.requestPacing = &p
+	})
+}
+
+type requestPacer struct {
+	interval  time.Duration
+	tolerance time.Duration
+	maxDelay  time.Duration
+	now       func() time.Time
+
+	mtx sync.Mutex
+	// tat is the theoretical arrival time of the next request at the
+	// steady rate.
+	tat time.Time
+
+	delay    prometheus.Histogram
+	rejected prometheus.Counter
+}
+
+func newRequestPacer(p RequestPacing, reg prometheus.Registerer) (*requestPacer, error) {
+	if p.RequestsPerSecond <= 0 || math.IsInf(p.RequestsPerSecond, 0) {
+		return nil, fmt.Errorf("the pacing rate must be positive, got %v", p.RequestsPerSecond)
+	}
+
+	if p.Burst < 0 || p.MaxDelay < 0 {
+		return nil, fmt.Errorf("the pacing burst and maximum delay must not be negative")
+	}
+
+	interval := time.Duration(float64(time.Second) / p.RequestsPerSecond)
+	return &requestPacer{
+		interval:  interval,
+		tolerance: time.Duration(p.Burst) * interval,
+		maxDelay:  p.MaxDelay,
+		now:       time.Now,
+		delay: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "request_pacing_delay_seconds",
+			Help:    "Time spent by the requests waiting to be released to the upstream.",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "request_pacing_rejected_requests_total",
+			Help: "Total number of requests rejected because they would have been delayed longer than the maximum pacing delay.",
+		}),
+	}, nil
+}
+
+// reserve returns how long the request must wait before being released. It
+// returns false if the delay exceeds the maximum delay, in which case no
+// slot is reserved.
+func (p *requestPacer) reserve() (time.Duration, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := p.now()
+	tat := p.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	tat = tat.Add(p.interval)
+
+	delay := max(0, tat.Sub(now)-p.interval-p.tolerance)
+	if delay > p.maxDelay {
+		return delay, false
+	}
+	p.tat = tat
+
+	return delay, true
+}
+
+// wait blocks until the request is released. It returns false if the delay
+// exceeds the maximum delay or if the context is done.
+func (p *requestPacer) wait(ctx context.Context) (time.Duration, bool) {
+	delay, ok := p.reserve()
+	if !ok || delay == 0 {
+		return delay, ok
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return delay, true
+	case <-ctx.Done():
+		return delay, false
+	}
+}
+
+// paceRequests delays the requests to release them to the upstream at the
+// configured rate.
+func (r *routes) paceRequests(next http.HandlerFunc) http.HandlerFunc {
+	if r.pacer == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		delay, ok := r.pacer.wait(req.Context())
+		if !ok {
+			if req.Context().Err() != nil {
+				// The client went away while waiting.
+				return
+			}
+
+			r.pacer.rejected.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			rejectRequest(w, ReasonUpstreamPaced, "too many requests to the upstream", http.StatusServiceUnavailable)
+			return
+		}
+		r.pacer.delay.Observe(delay.Seconds())
+
+		next(w, req)
+	}
+}
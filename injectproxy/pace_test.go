@@ -0,0 +1,108 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestPacer(t *testing.T) {
+	p, err := newRequestPacer(RequestPacing{RequestsPerSecond: 10, Burst: 2, MaxDelay: 250 * time.Millisecond}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Unix(0, 0)
+	p.now = func() time.Time { return now }
+
+	for i, tc := range []struct {
+		advance time.Duration
+
+		expDelay time.Duration
+		expOK    bool
+	}{
+		// The burst allowance is released immediately.
+		{expDelay: 0, expOK: true},
+		{expDelay: 0, expOK: true},
+		{expDelay: 0, expOK: true},
+		// Then the requests are spaced at the steady rate.
+		{expDelay: 100 * time.Millisecond, expOK: true},
+		{expDelay: 200 * time.Millisecond, expOK: true},
+		// The maximum delay is exceeded, no slot is reserved.
+		{expDelay: 300 * time.Millisecond, expOK: false},
+		{advance: 100 * time.Millisecond, expDelay: 200 * time.Millisecond, expOK: true},
+		// The bucket drains while idle.
+		{advance: time.Second, expDelay: 0, expOK: true},
+	} {
+		now = now.Add(tc.advance)
+		delay, ok := p.reserve()
+		if delay != tc.expDelay || ok != tc.expOK {
+			t.Fatalf("%d: expected (%s, %v), got (%s, %v)", i, tc.expDelay, tc.expOK, delay, ok)
+		}
+	}
+
+	for _, rp := range []RequestPacing{
+		{},
+		{RequestsPerSecond: 1, Burst: -1},
+		{RequestsPerSecond: 1, MaxDelay: -time.Second},
+	} {
+		if _, err := newRequestPacer(rp, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", rp)
+		}
+	}
+}
+
+func TestPaceRequests(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithRequestPacing(RequestPacing{RequestsPerSecond: 0.1}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		expCode       int
+		expRetryAfter string
+	}{
+		{expCode: http.StatusOK},
+		{expCode: http.StatusServiceUnavailable, expRetryAfter: "10"},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+		if w.Code != tc.expCode {
+			t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Retry-After"); got != tc.expRetryAfter {
+			t.Fatalf("expected Retry-After %q, got %q", tc.expRetryAfter, got)
+		}
+	}
+
+	if got := testutil.ToFloat64(r.pacer.rejected); got != 1 {
+		t.Fatalf("expected 1 rejected request, got %v", got)
+	}
+}
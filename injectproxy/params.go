@@ -0,0 +1,216 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	startParam = "start"
+	endParam   = "end"
+	stepParam  = "step"
+	timeParam  = "time"
+)
+
+// minTime and maxTime are the bounds of the timestamps supported by
+// Prometheus.
+var (
+	minTime = time.Unix(math.MinInt64/1000+62135596801, 0).UTC()
+	maxTime = time.Unix(math.MaxInt64/1000-62135596801, 999999999).UTC()
+)
+
+// parseTime parses a timestamp the same way as the Prometheus API (Unix
+// timestamp or RFC3339). NaN, infinite and overflowing values are rejected.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+		}
+		if t >= float64(math.MaxInt64) || t < float64(math.MinInt64) {
+			return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp. It overflows int64", s)
+		}
+		s, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(s), int64(ns*float64(time.Second))).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses a duration the same way as the Prometheus API
+// (float number of seconds or Prometheus duration). NaN and infinite values
+// are rejected.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(d) || math.IsInf(d, 0) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+		}
+		ts := d * float64(time.Second)
+		if ts >= float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// formatDuration formats a duration as a float number of seconds.
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// formatTime formats a timestamp as a float number of seconds with a
+// millisecond precision.
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
+
+// queryRange holds the time parameters of a range query.
+type queryRange struct {
+	start time.Time
+	end   time.Time
+	step  time.Duration
+}
+
+// rangeFromRequest returns the time parameters of a range query. It fails if
+// a parameter is missing or invalid, if the end is before the start or if the
+// step isn't positive. The request form must have been parsed.
+func rangeFromRequest(req *http.Request) (queryRange, error) {
+	var (
+		qr  queryRange
+		err error
+	)
+
+	if qr.start, err = parseTime(req.Form.Get(startParam)); err != nil {
+		return qr, fmt.Errorf("invalid %q parameter: %w", startParam, err)
+	}
+
+	if qr.end, err = parseTime(req.Form.Get(endParam)); err != nil {
+		return qr, fmt.Errorf("invalid %q parameter: %w", endParam, err)
+	}
+
+	if qr.step, err = parseDuration(req.Form.Get(stepParam)); err != nil {
+		return qr, fmt.Errorf("invalid %q parameter: %w", stepParam, err)
+	}
+
+	if qr.end.Before(qr.start) {
+		return qr, fmt.Errorf("invalid %q parameter: end timestamp must not be before start time", endParam)
+	}
+
+	if qr.step <= 0 {
+		return qr, fmt.Errorf("invalid %q parameter: zero or negative query resolution step widths are not accepted. Try a positive integer", stepParam)
+	}
+
+	return qr, nil
+}
+
+// setParam replaces the value of a parameter wherever it was provided (URL
+// query string and/or POST body). The request form must have been parsed.
+func setParam(req *http.Request, name, value string) {
+	q := req.URL.Query()
+	if q.Has(name) {
+		q.Set(name, value)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	if req.PostForm.Has(name) {
+		req.PostForm.Set(name, value)
+	}
+
+	req.Form.Set(name, value)
+}
+
+// delParam removes a parameter from the URL query string, the POST body and
+// the form. The request form must have been parsed.
+func delParam(req *http.Request, name string) {
+	q := req.URL.Query()
+	if q.Has(name) {
+		q.Del(name)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	req.PostForm.Del(name)
+	req.Form.Del(name)
+}
+
+// addParam sets a parameter next to the query expression (URL query string
+// or POST body). The request form must have been parsed.
+func addParam(req *http.Request, name, value string) {
+	if req.PostForm.Has(queryParam) {
+		req.PostForm.Set(name, value)
+	} else {
+		q := req.URL.Query()
+		q.Set(name, value)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	req.Form.Set(name, value)
+}
+
+// validateRange rejects the range queries with invalid time parameters
+// instead of forwarding them to the upstream. The missing parameters are left
+// for the upstream to report.
+func validateRange(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Form.Has(startParam) && req.Form.Has(endParam) && req.Form.Has(stepParam) {
+			if _, err := rangeFromRequest(req); err != nil {
+				badDataError(w, err.Error())
+				return
+			}
+
+			next(w, req)
+			return
+		}
+
+		for _, name := range []string{startParam, endParam} {
+			if !req.Form.Has(name) {
+				continue
+			}
+			if _, err := parseTime(req.Form.Get(name)); err != nil {
+				badDataError(w, fmt.Sprintf("invalid %q parameter: %v", name, err))
+				return
+			}
+		}
+
+		if req.Form.Has(stepParam) {
+			if _, err := parseDuration(req.Form.Get(stepParam)); err != nil {
+				badDataError(w, fmt.Sprintf("invalid %q parameter: %v", stepParam, err))
+				return
+			}
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRangeFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+
+		exp    queryRange
+		expErr string
+	}{
+		{
+			name:   "unix timestamps",
+			params: url.Values{"start": []string{"0"}, "end": []string{"3600.5"}, "step": []string{"15"}},
+			exp:    queryRange{start: time.Unix(0, 0).UTC(), end: time.Unix(3600, 5e8).UTC(), step: 15 * time.Second},
+		},
+		{
+			name:   "RFC3339 timestamps",
+			params: url.Values{"start": []string{"2024-01-01T00:00:00Z"}, "end": []string{"2024-01-01T01:00:00Z"}, "step": []string{"1m"}},
+			exp:    queryRange{start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), end: time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC), step: time.Minute},
+		},
+		{
+			name:   "start equals end",
+			params: url.Values{"start": []string{"10"}, "end": []string{"10"}, "step": []string{"1"}},
+			exp:    queryRange{start: time.Unix(10, 0).UTC(), end: time.Unix(10, 0).UTC(), step: time.Second},
+		},
+		{
+			name:   "missing start",
+			params: url.Values{"end": []string{"10"}, "step": []string{"1"}},
+			expErr: `invalid "start" parameter`,
+		},
+		{
+			name:   "invalid end",
+			params: url.Values{"start": []string{"0"}, "end": []string{"yesterday"}, "step": []string{"1"}},
+			expErr: `invalid "end" parameter: cannot parse "yesterday" to a valid timestamp`,
+		},
+		{
+			name:   "NaN start",
+			params: url.Values{"start": []string{"NaN"}, "end": []string{"10"}, "step": []string{"1"}},
+			expErr: `invalid "start" parameter`,
+		},
+		{
+			name:   "infinite end",
+			params: url.Values{"start": []string{"0"}, "end": []string{"+Inf"}, "step": []string{"1"}},
+			expErr: `invalid "end" parameter`,
+		},
+		{
+			name:   "NaN step",
+			params: url.Values{"start": []string{"0"}, "end": []string{"10"}, "step": []string{"NaN"}},
+			expErr: `invalid "step" parameter`,
+		},
+		{
+			name:   "end before start",
+			params: url.Values{"start": []string{"10"}, "end": []string{"0"}, "step": []string{"1"}},
+			expErr: "end timestamp must not be before start time",
+		},
+		{
+			name:   "zero step",
+			params: url.Values{"start": []string{"0"}, "end": []string{"10"}, "step": []string{"0"}},
+			expErr: "zero or negative query resolution step widths are not accepted",
+		},
+		{
+			name:   "negative step",
+			params: url.Values{"start": []string{"0"}, "end": []string{"10"}, "step": []string{"-1m"}},
+			expErr: `invalid "step" parameter`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+tc.params.Encode(), nil)
+			if err := req.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+
+			qr, err := rangeFromRequest(req)
+			if tc.expErr != "" {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if !strings.Contains(err.Error(), tc.expErr) {
+					t.Fatalf("expected error %q, got %q", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !qr.start.Equal(tc.exp.start) || !qr.end.Equal(tc.exp.end) || qr.step != tc.exp.step {
+				t.Fatalf("expected %+v, got %+v", tc.exp, qr)
+			}
+		})
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	var upstreamCalls int
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamCalls++
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+
+		expCode int
+	}{
+		{
+			name:    "valid",
+			params:  url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"60"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "end before start",
+			params:  url.Values{"start": []string{"3600"}, "end": []string{"0"}, "step": []string{"60"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "zero step",
+			params:  url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"0"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid step",
+			params:  url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"foo"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing parameters are forwarded",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "invalid start without step",
+			params:  url.Values{"start": []string{"NaN"}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamCalls = 0
+
+			params := url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode == http.StatusOK {
+				if upstreamCalls != 1 {
+					t.Fatalf("expected 1 upstream call, got %d", upstreamCalls)
+				}
+				return
+			}
+
+			if upstreamCalls != 0 {
+				t.Fatalf("expected no upstream call, got %d", upstreamCalls)
+			}
+
+			var res map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res["errorType"] != "bad_data" {
+				t.Fatalf("expected the bad_data error type, got %q", res["errorType"])
+			}
+		})
+	}
+}
+
+func FuzzParseTime(f *testing.F) {
+	for _, s := range []string{"0", "1700000000.123", "-1", "2024-01-01T00:00:00Z", "NaN", "1e300", "-9.3e18", "9223372036854775807", "0x1p62"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		ts, err := parseTime(s)
+		if err != nil {
+			return
+		}
+
+		// A successful parse must be consistent with the float value.
+		if v, err := strconv.ParseFloat(s, 64); err == nil && (v >= 1) != (ts.Unix() >= 1) {
+			t.Fatalf("parsed %q as %v", s, ts)
+		}
+	})
+}
+
+func FuzzParseDuration(f *testing.F) {
+	for _, s := range []string{"0", "15", "0.5", "1m", "1h30m", "-1", "NaN", "1e300", "9223372036.854775807", "1y"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		d, err := parseDuration(s)
+		if err != nil {
+			return
+		}
+
+		// A successful parse must be consistent with the float value.
+		if v, err := strconv.ParseFloat(s, 64); err == nil && (v > 0) != (d > 0) && d != 0 {
+			t.Fatalf("parsed %q as %v", s, d)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ErrPostAggregation is returned when the result of a query can't be
+// aggregated (e.g. a range vector).
+var ErrPostAggregation = errors.New("the query result can't be aggregated")
+
+// postAggregationOps are the aggregation operators which can be forced.
+var postAggregationOps = map[string]parser.ItemType{
+	"sum":   parser.SUM,
+	"avg":   parser.AVG,
+	"min":   parser.MIN,
+	"max":   parser.MAX,
+	"count": parser.COUNT,
+}
+
+// PostAggregation configures the tenants whose query results are always
+// aggregated over sensitive labels.
+type PostAggregation struct {
+	Tenants []string
+	// Op is the aggregation operator: sum, avg, min, max or count. It
+	// defaults to sum.
+	Op string
+	// Without are the labels aggregated away (e.g. instance and pod).
+	Without []string
+}
+
+// WithPostAggregation wraps the instant and range queries of the given
+// tenants into an aggregation without the sensitive labels (e.g. "sum
+// without(instance, pod) (<query>)"), so that the results never expose
+// them. The queries returning a range vector are rejected and the scalar and
+// string results are left untouched. The requests with several label values
+// are aggregated as soon as one of them is restricted.
+//
+// Only the instant and range queries are aggregated: the other endpoints
+// (e.g. /federate and /api/v1/series) still return the sensitive labels.
+func WithPostAggregation(p PostAggregation) Option {
+	return optionFunc(func(o *options) {
+		o.postAggregation = &p
+	})
+}
+
+// wrap returns the expression aggregated without the sensitive labels.
+func (p *PostAggregation) wrap(expr parser.Expr) (parser.Expr, error) {
+	switch expr.Type() {
+	case parser.ValueTypeVector:
+	case parser.ValueTypeMatrix:
+		return nil, fmt.Errorf("%w: range vector", ErrPostAggregation)
+	default:
+		return expr, nil
+	}
+
+	return &parser.AggregateExpr{
+		Op:       postAggregationOps[p.Op],
+		Expr:     expr,
+		Grouping: p.Without,
+		Without:  true,
+	}, nil
+}
+
+// key returns a string identifying the aggregation.
+func (p *PostAggregation) key() string {
+	return p.Op + " without(" + strings.Join(p.Without, ",") + ")"
+}
+
+type postAggregator struct {
+	cfg     PostAggregation
+	tenants map[string]struct{}
+
+	aggregated prometheus.Counter
+}
+
+func newPostAggregator(p PostAggregation, reg prometheus.Registerer) (*postAggregator, error) {
+	if p.Op == "" {
+		p.Op = "sum"
+	}
+
+	if _, found := postAggregationOps[p.Op]; !found {
+		return nil, fmt.Errorf("invalid post-aggregation operator %q", p.Op)
+	}
+
+	if len(p.Without) == 0 {
+		return nil, errors.New("the post-aggregation requires at least one label")
+	}
+
+	for _, l := range p.Without {
+		if !model.LabelName(l).IsValid() {
+			return nil, fmt.Errorf("invalid post-aggregation label %q", l)
+		}
+	}
+
+	pa := &postAggregator{
+		cfg:     p,
+		tenants: make(map[string]struct{}, len(p.Tenants)),
+		aggregated: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "post_aggregated_queries_total",
+			Help: "Total number of queries wrapped into an aggregation over the sensitive labels.",
+		}),
+	}
+	for _, t := range p.Tenants {
+		pa.tenants[t] = struct{}{}
+	}
+
+	return pa, nil
+}
+
+// applies returns true if the query of the request must be aggregated. The
+// exemplar queries aren't aggregated.
+func (pa *postAggregator) applies(ctx context.Context) bool {
+	if handlerName(ctx) == "/api/v1/query_exemplars" {
+		return false
+	}
+
+	for _, t := range MustLabelValues(ctx) {
+		if _, found := pa.tenants[t]; found {
+			return true
+		}
+	}
+
+	return false
+}
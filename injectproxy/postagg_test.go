@@ -0,0 +1,129 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPostAggregation(t *testing.T) {
+	var query string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.FormValue("query")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithPostAggregation(PostAggregation{Tenants: []string{"restricted"}, Without: []string{"instance", "pod"}}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		tenant string
+		query  string
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "unrestricted tenant",
+			tenant:   "ns1",
+			query:    "up",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="ns1"}`,
+		},
+		{
+			name:     "instant vector",
+			tenant:   "restricted",
+			query:    "rate(http_requests_total[5m])",
+			expCode:  http.StatusOK,
+			expQuery: `sum without (instance, pod) (rate(http_requests_total{namespace="restricted"}[5m]))`,
+		},
+		{
+			name:     "range query in the body",
+			method:   http.MethodPost,
+			path:     "/api/v1/query_range",
+			tenant:   "restricted",
+			query:    "max by (pod) (up)",
+			expCode:  http.StatusOK,
+			expQuery: `sum without (instance, pod) (max by (pod) (up{namespace="restricted"}))`,
+		},
+		{
+			name:     "scalar",
+			tenant:   "restricted",
+			query:    "scalar(up)",
+			expCode:  http.StatusOK,
+			expQuery: `scalar(up{namespace="restricted"})`,
+		},
+		{
+			name:    "range vector",
+			tenant:  "restricted",
+			query:   "up[5m]",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query = ""
+			if tc.path == "" {
+				tc.path = "/api/v1/query"
+			}
+
+			params := url.Values{"query": []string{tc.query}, proxyLabel: []string{tc.tenant}}
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+tc.path, strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if query != tc.expQuery {
+				t.Fatalf("expected upstream query %q, got %q", tc.expQuery, query)
+			}
+		})
+	}
+}
+
+func TestPostAggregationOptions(t *testing.T) {
+	for _, p := range []PostAggregation{
+		{Tenants: []string{"ns1"}},
+		{Tenants: []string{"ns1"}, Op: "topk", Without: []string{"pod"}},
+		{Tenants: []string{"ns1"}, Without: []string{"invalid-label"}},
+	} {
+		if _, err := newPostAggregator(p, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", p)
+		}
+	}
+}
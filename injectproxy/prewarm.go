@@ -0,0 +1,194 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultPrewarmTimeout bounds the warm-up of the upstream connections.
+const defaultPrewarmTimeout = 10 * time.Second
+
+// ConnectionPrewarming configures the warm-up of the upstream connections.
+type ConnectionPrewarming struct {
+	// Connections is the number of idle connections established to the
+	// upstream by Prewarm() and after the circuit breaker (if any) closes
+	// again. They are kept in the idle pool of the upstream transport.
+	Connections int
+	// Timeout bounds the warm-up. If zero, 10s is used.
+	Timeout time.Duration
+	// TLSSessionCacheSize, if positive, is the number of TLS sessions
+	// cached to resume the connections to the upstream with an abbreviated
+	// handshake.
+	TLSSessionCacheSize int
+}
+
+// WithConnectionPrewarming establishes idle connections to the upstream
+// ahead of the traffic and caches the TLS sessions, so that the first burst
+// of requests after a deployment or an upstream outage doesn't pay the full
+// connection and handshake latency. The connections are established by
+// sending concurrent requests to the /api/v1/status/buildinfo endpoint of
+// the upstream. With HTTP/2, these requests share a single connection.
+func WithConnectionPrewarming(c ConnectionPrewarming) Option {
+	return optionFunc(func(o *options) {
+		o.connectionPrewarming = &c
+	})
+}
+
+// connectionPrewarmer establishes idle connections to the upstream.
+type connectionPrewarmer struct {
+	config    ConnectionPrewarming
+	upstream  *url.URL
+	transport http.RoundTripper
+	logger    *log.Logger
+
+	// mtx ensures that a single warm-up runs at a time.
+	mtx sync.Mutex
+
+	connections *prometheus.CounterVec
+}
+
+func newConnectionPrewarmer(c ConnectionPrewarming, upstream *url.URL, reg prometheus.Registerer) (*connectionPrewarmer, error) {
+	if c.Connections < 0 {
+		return nil, fmt.Errorf("the number of prewarmed connections must be positive, got %d", c.Connections)
+	}
+	if c.TLSSessionCacheSize < 0 {
+		return nil, fmt.Errorf("the TLS session cache size must be positive, got %d", c.TLSSessionCacheSize)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultPrewarmTimeout
+	}
+
+	return &connectionPrewarmer{
+		config:   c,
+		upstream: upstream,
+		logger:   log.Default(),
+		connections: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_prewarmed_connections_total",
+			Help: "Total number of connections established to the upstream ahead of the traffic, partitioned by result.",
+		}, []string{"result"}),
+	}, nil
+}
+
+// configure adapts the upstream transport so that it keeps the prewarmed
+// connections and resumes the TLS sessions.
+func (p *connectionPrewarmer) configure(t *http.Transport) {
+	maxIdle := t.MaxIdleConnsPerHost
+	if maxIdle == 0 {
+		maxIdle = http.DefaultMaxIdleConnsPerHost
+	}
+	if p.config.Connections > maxIdle {
+		t.MaxIdleConnsPerHost = p.config.Connections
+	}
+	if t.MaxIdleConns > 0 && p.config.Connections > t.MaxIdleConns {
+		t.MaxIdleConns = p.config.Connections
+	}
+
+	if p.config.TLSSessionCacheSize > 0 {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(p.config.TLSSessionCacheSize)
+	}
+
+	p.transport = t
+}
+
+// prewarm establishes the connections concurrently. It returns an error if
+// none of them could be established.
+func (p *connectionPrewarmer) prewarm(ctx context.Context) error {
+	if p.config.Connections == 0 {
+		return nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, p.config.Connections)
+	)
+	for i := 0; i < p.config.Connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := p.connect(ctx); err != nil {
+				p.connections.WithLabelValues("failure").Inc()
+				errs <- err
+				return
+			}
+			p.connections.WithLabelValues("success").Inc()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if len(errs) == p.config.Connections {
+		return fmt.Errorf("failed to prewarm the upstream connections: %w", <-errs)
+	}
+
+	return nil
+}
+
+// prewarmInBackground prewarms the connections without blocking the caller.
+func (p *connectionPrewarmer) prewarmInBackground() {
+	go func() {
+		if err := p.prewarm(context.Background()); err != nil {
+			p.logger.Printf("%v", err)
+		}
+	}()
+}
+
+func (p *connectionPrewarmer) connect(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.upstream.JoinPath("/api/v1/status/buildinfo").String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	// Whatever the status code, the connection goes back to the idle pool
+	// once the body is consumed.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// Prewarm establishes the idle connections to the upstream configured with
+// WithConnectionPrewarming. It does nothing otherwise. It is meant to be
+// called on startup before serving the traffic.
+func (r *routes) Prewarm(ctx context.Context) error {
+	if r.prewarmer == nil {
+		return nil
+	}
+
+	return r.prewarmer.prewarm(ctx)
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectionPrewarming(t *testing.T) {
+	const connections = 3
+
+	var (
+		conns   atomic.Int32
+		arrived sync.WaitGroup
+	)
+	arrived.Add(connections)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/status/buildinfo" {
+			// Hold the prewarming requests until they are all in
+			// flight to force distinct connections.
+			arrived.Done()
+			arrived.Wait()
+		}
+		w.Write(okResponse)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := NewRoutes(
+		u,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithConnectionPrewarming(ConnectionPrewarming{Connections: connections, Timeout: 5 * time.Second}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := r.Prewarm(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := conns.Load(); got != connections {
+		t.Fatalf("expected %d connections, got %d", connections, got)
+	}
+	if got := testutil.ToFloat64(r.prewarmer.connections.WithLabelValues("success")); got != connections {
+		t.Fatalf("expected %d prewarmed connections, got %v", connections, got)
+	}
+
+	// The requests reuse the idle connections.
+	var wg sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+proxyLabel+"=ns1", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status code 200, got %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := conns.Load(); got != connections {
+		t.Fatalf("expected no new connection, got %d", got-connections)
+	}
+}
+
+func TestConnectionPrewarmingFailure(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	u := *m.url
+	m.Close()
+
+	r, err := NewRoutes(
+		&u,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithConnectionPrewarming(ConnectionPrewarming{Connections: 2, Timeout: time.Second}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := r.Prewarm(context.Background()); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if got := testutil.ToFloat64(r.prewarmer.connections.WithLabelValues("failure")); got != 2 {
+		t.Fatalf("expected 2 failed connections, got %v", got)
+	}
+}
+
+func TestConnectionPrewarmerConfigure(t *testing.T) {
+	u, _ := url.Parse("https://prometheus.example.com")
+
+	for _, tc := range []struct {
+		name   string
+		config ConnectionPrewarming
+
+		expErr          bool
+		expMaxIdle      int
+		expSessionCache bool
+	}{
+		{
+			name:       "few connections keep the default",
+			config:     ConnectionPrewarming{Connections: 1},
+			expMaxIdle: http.DefaultMaxIdleConnsPerHost,
+		},
+		{
+			name:       "more connections than the default",
+			config:     ConnectionPrewarming{Connections: 10},
+			expMaxIdle: 10,
+		},
+		{
+			name:            "TLS session cache",
+			config:          ConnectionPrewarming{TLSSessionCacheSize: 32},
+			expMaxIdle:      http.DefaultMaxIdleConnsPerHost,
+			expSessionCache: true,
+		},
+		{
+			name:   "negative connections",
+			config: ConnectionPrewarming{Connections: -1},
+			expErr: true,
+		},
+		{
+			name:   "negative TLS session cache size",
+			config: ConnectionPrewarming{TLSSessionCacheSize: -1},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newConnectionPrewarmer(tc.config, u, prometheus.NewRegistry())
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			tr := http.DefaultTransport.(*http.Transport).Clone()
+			tr.MaxIdleConnsPerHost = 0
+			p.configure(tr)
+
+			maxIdle := tr.MaxIdleConnsPerHost
+			if maxIdle == 0 {
+				maxIdle = http.DefaultMaxIdleConnsPerHost
+			}
+			if maxIdle != tc.expMaxIdle {
+				t.Fatalf("expected %d idle connections per host, got %d", tc.expMaxIdle, maxIdle)
+			}
+
+			if got := tr.TLSClientConfig != nil && tr.TLSClientConfig.ClientSessionCache != nil; got != tc.expSessionCache {
+				t.Fatalf("expected TLS session cache %v, got %v", tc.expSessionCache, got)
+			}
+		})
+	}
+}
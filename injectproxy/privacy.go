@@ -0,0 +1,344 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// AggregateOnlyTenants configures the tenants which can only run aggregation
+// queries, e.g. to share operational metrics with external parties without
+// exposing the exact per-entity data.
+type AggregateOnlyTenants struct {
+	Tenants []string
+	// MinGroupSize is the minimum number of series aggregated in a group.
+	// The smaller groups are removed from the result. Zero disables the
+	// check. The aggregated expressions can't use set operators nor the
+	// functions creating series (e.g. vector and label_replace) then.
+	MinGroupSize int
+	// Epsilon is the privacy budget of a query. Laplace noise of scale
+	// Sensitivity/Epsilon is added to every returned value. Zero disables
+	// the noise.
+	Epsilon float64
+	// Sensitivity is the maximum contribution of a single series to an
+	// aggregated value. It defaults to 1.
+	Sensitivity float64
+}
+
+// WithAggregateOnlyTenants restricts the instant and range queries of the
+// given tenants to sum, avg and count aggregations. The requests with several
+// label values are restricted as soon as one of them is aggregate-only.
+// The native histograms are removed from the results when the noise is
+// enabled.
+func WithAggregateOnlyTenants(a AggregateOnlyTenants) Option {
+	return optionFunc(func(o *options) {
+		o.aggregateOnly = &a
+	})
+}
+
+type privacyFilter struct {
+	tenants      map[string]struct{}
+	minGroupSize int
+	noiseScale   float64
+
+	mtx  sync.Mutex
+	rand *rand.Rand
+
+	rejected prometheus.Counter
+}
+
+func newPrivacyFilter(a AggregateOnlyTenants, reg prometheus.Registerer) (*privacyFilter, error) {
+	if a.MinGroupSize < 0 || a.Epsilon < 0 || a.Sensitivity < 0 {
+		return nil, fmt.Errorf("invalid aggregate-only configuration: negative value")
+	}
+
+	p := &privacyFilter{
+		tenants:      make(map[string]struct{}, len(a.Tenants)),
+		minGroupSize: a.MinGroupSize,
+		rand:         rand.New(rand.NewSource(rand.Int63())),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "aggregate_only_rejected_queries_total",
+			Help: "Total number of queries of aggregate-only tenants rejected because they weren't aggregations.",
+		}),
+	}
+	for _, t := range a.Tenants {
+		p.tenants[t] = struct{}{}
+	}
+	if a.Epsilon > 0 {
+		sensitivity := a.Sensitivity
+		if sensitivity == 0 {
+			sensitivity = 1
+		}
+		p.noiseScale = sensitivity / a.Epsilon
+	}
+
+	return p, nil
+}
+
+func (p *privacyFilter) restricted(tenants []string) bool {
+	for _, t := range tenants {
+		if _, found := p.tenants[t]; found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// laplace returns a sample of the Laplace distribution centered on 0.
+func (p *privacyFilter) laplace() float64 {
+	p.mtx.Lock()
+	u := p.rand.Float64() - 0.5
+	p.mtx.Unlock()
+
+	if u < 0 {
+		return p.noiseScale * math.Log(1+2*u)
+	}
+	return -p.noiseScale * math.Log(1-2*u)
+}
+
+// restrict returns the query enforcing the minimum group size or an error if
+// the query isn't an allowed aggregation.
+func (p *privacyFilter) restrict(q string) (string, error) {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
+	}
+
+	inner := expr
+	for {
+		paren, ok := inner.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		inner = paren.Expr
+	}
+
+	agg, ok := inner.(*parser.AggregateExpr)
+	if !ok {
+		return "", fmt.Errorf("only sum, avg and count aggregations are allowed")
+	}
+	switch agg.Op {
+	case parser.SUM, parser.AVG, parser.COUNT:
+	default:
+		return "", fmt.Errorf("only sum, avg and count aggregations are allowed, got %s", agg.Op)
+	}
+
+	if p.minGroupSize <= 0 {
+		return q, nil
+	}
+
+	// The group size counts the series of the aggregated expression which
+	// must all come from the selectors, otherwise synthetic series (e.g.
+	// "x or vector(0)") would inflate it.
+	if err := parser.Walk(syntheticSeriesVisitor{}, agg.Expr, nil); err != nil {
+		return "", err
+	}
+
+	count := *agg
+	count.Op = parser.COUNT
+	restricted, err := parser.ParseExpr(fmt.Sprintf("%s and %s >= %d", agg.String(), count.String(), p.minGroupSize))
+	if err != nil {
+		return "", err
+	}
+
+	return restricted.String(), nil
+}
+
+// syntheticSeriesFuncs are the functions returning series which don't come
+// from the selectors.
+var syntheticSeriesFuncs = map[string]struct{}{
+	"absent":           {},
+	"absent_over_time": {},
+	"label_join":       {},
+	"label_replace":    {},
+	"vector":           {},
+}
+
+// syntheticSeriesVisitor rejects the expressions which can produce series
+// not coming from the selectors.
+type syntheticSeriesVisitor struct{}
+
+func (v syntheticSeriesVisitor) Visit(node parser.Node, _ []parser.Node) (parser.Visitor, error) {
+	switch n := node.(type) {
+	case *parser.Call:
+		if _, found := syntheticSeriesFuncs[n.Func.Name]; found {
+			return nil, fmt.Errorf("the %s function isn't allowed in the aggregations with a minimum group size", n.Func.Name)
+		}
+	case *parser.BinaryExpr:
+		if n.Op.IsSetOperator() {
+			return nil, fmt.Errorf("the %s operator isn't allowed in the aggregations with a minimum group size", n.Op)
+		}
+	}
+
+	return v, nil
+}
+
+// restrictToAggregates enforces the restrictions of the aggregate-only
+// tenants.
+func (r *routes) restrictToAggregates(next http.HandlerFunc) http.HandlerFunc {
+	if r.privacy == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !r.privacy.restricted(MustLabelValues(req.Context())) {
+			next(w, req)
+			return
+		}
+
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q, err := r.privacy.restrict(req.Form.Get(queryParam))
+		if errors.Is(err, ErrQueryParse) {
+			rejectRequest(w, ReasonInvalidQuery, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			r.privacy.rejected.Inc()
+			rejectRequest(w, ReasonAggregationRequired, err.Error(), http.StatusForbidden)
+			return
+		}
+		setParam(req, queryParam, q)
+
+		if r.privacy.noiseScale > 0 {
+			if rc := RequestContextFrom(req.Context()); rc != nil {
+				rc.noise.Store(true)
+				rc.AddDecision("privacy", DecisionNoise)
+			}
+		}
+
+		next(w, req)
+	}
+}
+
+// addNoise adds Laplace noise to the values of a successful query response.
+func (r *routes) addNoise(resp *http.Response) error {
+	if rc := RequestContextFrom(resp.Request.Context()); rc == nil || !rc.noise.Load() || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	apir, err := getAPIResponse(resp)
+	if err != nil {
+		return fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	var data struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(apir.Data, &data); err != nil {
+		return fmt.Errorf("can't decode the query result: %w", err)
+	}
+
+	// noisy returns the sample with noise added to its value.
+	noisy := func(sample []interface{}) error {
+		if len(sample) != 2 {
+			return fmt.Errorf("unexpected sample %v", sample)
+		}
+		s, ok := sample[1].(string)
+		if !ok {
+			return fmt.Errorf("unexpected sample value %v", sample[1])
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected sample value %q", s)
+		}
+		sample[1] = strconv.FormatFloat(v+r.privacy.laplace(), 'f', -1, 64)
+		return nil
+	}
+
+	var result interface{}
+	switch data.ResultType {
+	case "vector", "matrix":
+		var series []map[string]json.RawMessage
+		if err := json.Unmarshal(data.Result, &series); err != nil {
+			return fmt.Errorf("can't decode the %s: %w", data.ResultType, err)
+		}
+
+		for _, s := range series {
+			delete(s, "histogram")
+			delete(s, "histograms")
+
+			var samples [][]interface{}
+			switch {
+			case s["value"] != nil:
+				var sample []interface{}
+				if err := json.Unmarshal(s["value"], &sample); err != nil {
+					return fmt.Errorf("can't decode the sample: %w", err)
+				}
+				samples = [][]interface{}{sample}
+			case s["values"] != nil:
+				if err := json.Unmarshal(s["values"], &samples); err != nil {
+					return fmt.Errorf("can't decode the samples: %w", err)
+				}
+			}
+
+			for _, sample := range samples {
+				if err := noisy(sample); err != nil {
+					return err
+				}
+			}
+
+			key, v := "values", interface{}(samples)
+			if s["value"] != nil {
+				key, v = "value", samples[0]
+			}
+			if s[key], err = json.Marshal(v); err != nil {
+				return fmt.Errorf("can't encode the samples: %w", err)
+			}
+		}
+		result = series
+	case "scalar":
+		var sample []interface{}
+		if err := json.Unmarshal(data.Result, &sample); err != nil {
+			return fmt.Errorf("can't decode the scalar: %w", err)
+		}
+		if err := noisy(sample); err != nil {
+			return err
+		}
+		result = sample
+	default:
+		return fmt.Errorf("unexpected result type %q", data.ResultType)
+	}
+
+	if apir.Data, err = json.Marshal(map[string]interface{}{"resultType": data.ResultType, "result": result}); err != nil {
+		return fmt.Errorf("can't encode the query result: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(apir); err != nil {
+		return fmt.Errorf("can't encode the response: %w", err)
+	}
+	resp.Body = io.NopCloser(&buf)
+	resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrivacyFilterRestrict(t *testing.T) {
+	for _, tc := range []struct {
+		query        string
+		minGroupSize int
+
+		exp    string
+		expErr bool
+	}{
+		{
+			query: "sum by (job) (up)",
+			exp:   "sum by (job) (up)",
+		},
+		{
+			query:        "(avg(rate(http_requests_total[5m])))",
+			minGroupSize: 5,
+			exp:          "avg(rate(http_requests_total[5m])) and count(rate(http_requests_total[5m])) >= 5",
+		},
+		{
+			query:        "count without (instance) (up)",
+			minGroupSize: 2,
+			exp:          "count without (instance) (up) and count without (instance) (up) >= 2",
+		},
+		{
+			query:  "up",
+			expErr: true,
+		},
+		{
+			query:  "max(up)",
+			expErr: true,
+		},
+		{
+			query:  "sum(up) / 2",
+			expErr: true,
+		},
+		{
+			query:  "sum(",
+			expErr: true,
+		},
+		{
+			query: `sum(up or vector(0))`,
+			exp:   `sum(up or vector(0))`,
+		},
+		{
+			// The synthetic series would inflate the group size.
+			query:        `sum(x{pod="a"} or label_replace(vector(0), "k", "1", "", "") or label_replace(vector(0), "k", "2", "", ""))`,
+			minGroupSize: 3,
+			expErr:       true,
+		},
+		{
+			query:        `count(label_join(up, "k", ",", "job", "instance"))`,
+			minGroupSize: 2,
+			expErr:       true,
+		},
+		{
+			query:        `sum(absent(up))`,
+			minGroupSize: 2,
+			expErr:       true,
+		},
+		{
+			query:        `sum(up unless down)`,
+			minGroupSize: 2,
+			expErr:       true,
+		},
+		{
+			query:        `sum(rate(x[5m]) * on (pod) group_left () y)`,
+			minGroupSize: 2,
+			exp:          `sum(rate(x[5m]) * on (pod) group_left () y) and count(rate(x[5m]) * on (pod) group_left () y) >= 2`,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			p, err := newPrivacyFilter(AggregateOnlyTenants{MinGroupSize: tc.minGroupSize}, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := p.restrict(tc.query)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestPrivacyFilterLaplace(t *testing.T) {
+	p, err := newPrivacyFilter(AggregateOnlyTenants{Epsilon: 0.5, Sensitivity: 2}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const n = 100000
+	var sum, sumAbs float64
+	for i := 0; i < n; i++ {
+		v := p.laplace()
+		sum += v
+		sumAbs += math.Abs(v)
+	}
+
+	// The mean absolute deviation of the Laplace distribution is its scale.
+	if mean := sum / n; math.Abs(mean) > 0.1 {
+		t.Fatalf("expected a mean close to 0, got %v", mean)
+	}
+	if scale := sumAbs / n; math.Abs(scale-4) > 0.1 {
+		t.Fatalf("expected a scale close to 4, got %v", scale)
+	}
+
+	if _, err := newPrivacyFilter(AggregateOnlyTenants{Epsilon: -1}, prometheus.NewRegistry()); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestAggregateOnlyRoutes(t *testing.T) {
+	var got string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		got = req.Form.Get("query")
+		if req.URL.Path == "/api/v1/query_range" {
+			w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"10"],[2,"20"]]}]}}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"10"]},{"metric":{"job":"b"},"histogram":[1,{"count":"1","sum":"1"}]}]}}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithAggregateOnlyTenants(AggregateOnlyTenants{Tenants: []string{"external"}, MinGroupSize: 3, Epsilon: 1}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		tenant string
+		query  string
+
+		expCode  int
+		expQuery string
+		expNoise bool
+	}{
+		{
+			path:     "/api/v1/query",
+			tenant:   "internal",
+			query:    "up",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="internal"}`,
+		},
+		{
+			path:    "/api/v1/query",
+			tenant:  "external",
+			query:   "up",
+			expCode: http.StatusForbidden,
+		},
+		{
+			path:    "/api/v1/query",
+			tenant:  "external",
+			query:   "sum(",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			path:     "/api/v1/query",
+			tenant:   "external",
+			query:    "sum by (job) (up)",
+			expCode:  http.StatusOK,
+			expQuery: `sum by (job) (up{namespace="external"}) and count by (job) (up{namespace="external"}) >= 3`,
+			expNoise: true,
+		},
+		{
+			path:     "/api/v1/query_range",
+			tenant:   "external",
+			query:    "count(up)",
+			expCode:  http.StatusOK,
+			expQuery: `count(up{namespace="external"}) and count(up{namespace="external"}) >= 3`,
+			expNoise: true,
+		},
+	} {
+		t.Run(tc.tenant+" "+tc.query, func(t *testing.T) {
+			got = ""
+			params := url.Values{"query": []string{tc.query}, proxyLabel: []string{tc.tenant}}
+			if tc.path == "/api/v1/query_range" {
+				params.Set("start", "1")
+				params.Set("end", "2")
+				params.Set("step", "1")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+params.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got != tc.expQuery {
+				t.Fatalf("expected query %q, got %q", tc.expQuery, got)
+			}
+
+			var resp struct {
+				Data struct {
+					Result []map[string]json.RawMessage `json:"result"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var values [][]interface{}
+			for _, s := range resp.Data.Result {
+				if s["histogram"] != nil {
+					if tc.expNoise {
+						t.Fatalf("expected the histogram to be removed: %v", s)
+					}
+					continue
+				}
+
+				if v, found := s["value"]; found {
+					var sample []interface{}
+					_ = json.Unmarshal(v, &sample)
+					values = append(values, sample)
+					continue
+				}
+				var samples [][]interface{}
+				_ = json.Unmarshal(s["values"], &samples)
+				values = append(values, samples...)
+			}
+
+			noisy := 0
+			for i, sample := range values {
+				v, err := strconv.ParseFloat(sample[1].(string), 64)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if v != float64(10*(i+1)) {
+					noisy++
+				}
+			}
+			if tc.expNoise != (noisy == len(values)) {
+				t.Fatalf("expected noise %v, got %d noisy values out of %d", tc.expNoise, noisy, len(values))
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultProbeTimeout is the timeout of a probe when none is configured.
+const defaultProbeTimeout = 30 * time.Second
+
+// Probe is a canary request sent through the proxy.
+type Probe struct {
+	// Name identifies the probe in the metrics.
+	Name string `yaml:"name"`
+	// Path is the API path. It defaults to /api/v1/query.
+	Path string `yaml:"path"`
+	// Params are the request parameters, including the tenant parameter
+	// when the label value comes from the query string.
+	Params map[string]string `yaml:"params"`
+	// Headers are the request headers, including the tenant header when
+	// the label value comes from a header.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Probes is the configuration of the prober.
+type Probes struct {
+	// Timeout is the timeout of each probe.
+	Timeout time.Duration `yaml:"timeout"`
+	Probes  []Probe       `yaml:"probes"`
+}
+
+// LoadProbes reads the probes from a YAML file. For example:
+//
+//	timeout: 10s
+//	probes:
+//	  - name: team-a-up
+//	    params:
+//	      query: up
+//	      namespace: team-a
+func LoadProbes(path string) (Probes, error) {
+	var p Probes
+
+	f, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return p, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if err := p.validate(); err != nil {
+		return p, fmt.Errorf("invalid probes in %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+func (p Probes) validate() error {
+	if p.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+
+	names := map[string]struct{}{}
+	for i, pr := range p.Probes {
+		if pr.Name == "" {
+			return fmt.Errorf("probe %d: empty name", i)
+		}
+		if _, found := names[pr.Name]; found {
+			return fmt.Errorf("duplicate probe %q", pr.Name)
+		}
+		names[pr.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// Prober periodically sends the probes through an HTTP handler (typically the
+// proxy's routes) so that the whole request path, from the label enforcement
+// to the upstream, is monitored.
+type Prober struct {
+	handler http.Handler
+	probes  Probes
+	logger  *log.Logger
+
+	success  *prometheus.GaugeVec
+	duration *prometheus.GaugeVec
+	runs     *prometheus.CounterVec
+}
+
+// NewProber returns a prober sending the probes through the given handler.
+func NewProber(h http.Handler, probes Probes, reg prometheus.Registerer) (*Prober, error) {
+	if err := probes.validate(); err != nil {
+		return nil, err
+	}
+
+	if probes.Timeout == 0 {
+		probes.Timeout = defaultProbeTimeout
+	}
+
+	return &Prober{
+		handler: h,
+		probes:  probes,
+		logger:  log.Default(),
+		success: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Whether the last run of the probe succeeded.",
+		}, []string{"probe"}),
+		duration: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "Duration of the last run of the probe.",
+		}, []string{"probe"}),
+		runs: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "probe_runs_total",
+			Help: "Total number of probe runs, partitioned by probe and result (success or failure).",
+		}, []string{"probe", "result"}),
+	}, nil
+}
+
+// Run sends the probes at the given interval until the context is canceled.
+func (p *Prober) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		p.RunOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// RunOnce sends each probe once.
+func (p *Prober) RunOnce(ctx context.Context) {
+	for _, pr := range p.probes.Probes {
+		start := time.Now()
+		err := p.probe(ctx, pr)
+		p.duration.WithLabelValues(pr.Name).Set(time.Since(start).Seconds())
+
+		if err != nil {
+			p.logger.Printf("probe %q failed: %v", pr.Name, err)
+			p.success.WithLabelValues(pr.Name).Set(0)
+			p.runs.WithLabelValues(pr.Name, "failure").Inc()
+			continue
+		}
+
+		p.success.WithLabelValues(pr.Name).Set(1)
+		p.runs.WithLabelValues(pr.Name, "success").Inc()
+	}
+}
+
+func (p *Prober) probe(ctx context.Context, pr Probe) error {
+	ctx, cancel := context.WithTimeout(ctx, p.probes.Timeout)
+	defer cancel()
+
+	path := pr.Path
+	if path == "" {
+		path = "/api/v1/query"
+	}
+
+	params := url.Values{}
+	for k, v := range pr.Params {
+		params.Set(k, v)
+	}
+
+	u := &url.URL{Scheme: "http", Host: "prober", Path: path, RawQuery: params.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	req.RequestURI = u.RequestURI()
+	for k, v := range pr.Headers {
+		req.Header.Set(k, v)
+	}
+
+	w := &probeRecorder{header: http.Header{}, code: http.StatusOK}
+	p.handler.ServeHTTP(w, req)
+
+	var res struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	_ = json.Unmarshal(w.body.Bytes(), &res)
+
+	if w.code != http.StatusOK {
+		if res.Error != "" {
+			return fmt.Errorf("unexpected status code %d: %s", w.code, res.Error)
+		}
+		return fmt.Errorf("unexpected status code %d", w.code)
+	}
+
+	if res.Status != "success" {
+		return fmt.Errorf("unexpected response status %q", res.Status)
+	}
+
+	return nil
+}
+
+// probeRecorder records the response of a probe.
+type probeRecorder struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *probeRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *probeRecorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.code, r.wroteHeader = code, true
+}
+
+func (r *probeRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(b)
+}
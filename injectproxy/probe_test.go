@@ -0,0 +1,145 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadProbes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		exp    Probes
+		expErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "probes",
+			content: `
+timeout: 10s
+probes:
+  - name: up
+    params:
+      query: up
+      namespace: team-a
+  - name: series
+    path: /api/v1/series
+    params:
+      match[]: up
+    headers:
+      X-Tenant: team-a
+`,
+			exp: Probes{
+				Timeout: 10 * time.Second,
+				Probes: []Probe{
+					{Name: "up", Params: map[string]string{"query": "up", "namespace": "team-a"}},
+					{Name: "series", Path: "/api/v1/series", Params: map[string]string{"match[]": "up"}, Headers: map[string]string{"X-Tenant": "team-a"}},
+				},
+			},
+		},
+		{
+			name:    "unknown field",
+			content: "probes: [{name: a, query: up}]",
+			expErr:  true,
+		},
+		{
+			name:    "duplicate name",
+			content: "probes: [{name: a}, {name: a}]",
+			expErr:  true,
+		},
+		{
+			name:    "missing name",
+			content: "probes: [{path: /api/v1/query}]",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "probes.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			probes, err := LoadProbes(path)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(probes, tc.exp) {
+				t.Fatalf("expected %+v, got %+v", tc.exp, probes)
+			}
+		})
+	}
+}
+
+func TestProber(t *testing.T) {
+	var got []string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = append(got, req.URL.Query().Get("query"))
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p, err := NewProber(r, Probes{Probes: []Probe{
+		{Name: "ok", Params: map[string]string{"query": "up", proxyLabel: "ns1"}},
+		{Name: "missing-tenant", Params: map[string]string{"query": "up"}},
+		{Name: "invalid-query", Params: map[string]string{"query": "up{", proxyLabel: "ns1"}},
+	}}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p.RunOnce(context.Background())
+
+	// Only the valid probe reaches the upstream, through the label enforcement.
+	if exp := []string{`up{namespace="ns1"}`}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected upstream queries %v, got %v", exp, got)
+	}
+
+	for probe, exp := range map[string]float64{"ok": 1, "missing-tenant": 0, "invalid-query": 0} {
+		if success := testutil.ToFloat64(p.success.WithLabelValues(probe)); success != exp {
+			t.Fatalf("%s: expected success %v, got %v", probe, exp, success)
+		}
+	}
+	if runs := testutil.ToFloat64(p.runs.WithLabelValues("invalid-query", "failure")); runs != 1 {
+		t.Fatalf("expected 1 failed run, got %v", runs)
+	}
+
+	if _, err := NewProber(r, Probes{Timeout: -time.Second}, prometheus.NewRegistry()); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+)
+
+// WithProfilingLabels attaches the "handler" and "tenant" pprof labels to
+// the goroutines serving the requests. Continuous profilers scraping the
+// pprof endpoints (e.g. Pyroscope or Parca) can then break down the profiles
+// per handler and tenant.
+func WithProfilingLabels() Option {
+	return optionFunc(func(o *options) {
+		o.profilingLabels = true
+	})
+}
+
+// profiledMux wraps a mux and sets the "handler" pprof label.
+type profiledMux struct {
+	mux
+}
+
+// Handle implements the mux interface.
+func (p *profiledMux) Handle(pattern string, handler http.Handler) {
+	p.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pprof.Do(req.Context(), pprof.Labels("handler", pattern), func(ctx context.Context) {
+			handler.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}))
+}
+
+// profileTenant sets the "tenant" pprof label before calling the next handler.
+func (r *routes) profileTenant(next http.HandlerFunc) http.HandlerFunc {
+	if !r.profilingLabels {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		tenant := strings.Join(MustLabelValues(req.Context()), ",")
+		pprof.Do(req.Context(), pprof.Labels("tenant", tenant), func(ctx context.Context) {
+			next(w, req.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime/pprof"
+	"testing"
+)
+
+func TestProfilingLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expHandler string
+		expTenant  string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:       "enabled",
+			opts:       []Option{WithProfilingLabels()},
+			expHandler: "/api/v1/query",
+			expTenant:  "ns1,ns2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(&url.URL{Scheme: "http", Host: "upstream"}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var handler, tenant string
+			r.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				handler, _ = pprof.Label(req.Context(), "handler")
+				tenant, _ = pprof.Label(req.Context(), "tenant")
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns2&namespace=ns1", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+			}
+
+			if handler != tc.expHandler {
+				t.Fatalf("expected handler label %q, got %q", tc.expHandler, handler)
+			}
+
+			if tenant != tc.expTenant {
+				t.Fatalf("expected tenant label %q, got %q", tc.expTenant, tenant)
+			}
+		})
+	}
+}
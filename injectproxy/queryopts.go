@@ -0,0 +1,275 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// QueryOptionAction defines what happens to the requests setting a query
+// option which isn't allowed.
+type QueryOptionAction string
+
+const (
+	// QueryOptionStrip removes the option from the request and adds a
+	// warning to the response.
+	QueryOptionStrip QueryOptionAction = "strip"
+	// QueryOptionReject rejects the request with "403 Forbidden".
+	QueryOptionReject QueryOptionAction = "reject"
+)
+
+// QueryOptionPolicy restricts the values of the Thanos query options (e.g.
+// partial_response or max_source_resolution). The options are named after
+// their request parameter.
+type QueryOptionPolicy struct {
+	// Allow maps the options to the only values accepted.
+	Allow map[string][]string `yaml:"allow"`
+	// Deny maps the options to the values which aren't accepted. An empty
+	// list denies the option whatever its value.
+	Deny map[string][]string `yaml:"deny"`
+}
+
+// QueryOptionPolicies configures the per-tenant query option policies.
+type QueryOptionPolicies struct {
+	// Action defaults to QueryOptionStrip.
+	Action QueryOptionAction `yaml:"action"`
+	// Default applies to the tenants without override.
+	Default QueryOptionPolicy `yaml:"default"`
+	// Tenants overrides the default policy per tenant.
+	Tenants map[string]QueryOptionPolicy `yaml:"tenants"`
+}
+
+// LoadQueryOptionPolicies reads the query option policies from a YAML file.
+// For example:
+//
+//	action: reject
+//	tenants:
+//	  bulk:
+//	    deny:
+//	      partial_response: ["true"]
+//	      max_source_resolution: ["raw"]
+//	  batch:
+//	    allow:
+//	      dedup: ["true"]
+func LoadQueryOptionPolicies(path string) (QueryOptionPolicies, error) {
+	var p QueryOptionPolicies
+
+	f, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return p, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// WithQueryOptionPolicies restricts the Thanos query options that the
+// tenants may set on the query, series and labels APIs. The options which
+// aren't allowed are either removed from the request with a warning added to
+// the response or rejected with "403 Forbidden". The requests with several
+// label values must satisfy the policies of all the tenants.
+//
+// The boolean values (e.g. "1" and "true") and the resolutions (e.g. "raw"
+// and "0s") are compared after normalization.
+func WithQueryOptionPolicies(p QueryOptionPolicies) Option {
+	return optionFunc(func(o *options) {
+		o.queryOptionPolicies = &p
+	})
+}
+
+// queryOptionRule is a normalized QueryOptionPolicy.
+type queryOptionRule struct {
+	allow map[string][]string
+	deny  map[string][]string
+}
+
+// allowed returns whether the normalized value of the option is allowed.
+func (r queryOptionRule) allowed(option, value string) bool {
+	if values, found := r.allow[option]; found && !slices.Contains(values, value) {
+		return false
+	}
+
+	if values, found := r.deny[option]; found && (len(values) == 0 || slices.Contains(values, value)) {
+		return false
+	}
+
+	return true
+}
+
+// normalizeQueryOption returns the canonical form of an option value so that
+// the equivalent values compare equal. The invalid values are returned
+// as-is.
+func normalizeQueryOption(option, value string) string {
+	switch option {
+	case "dedup", "partial_response", "analyze":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return strconv.FormatBool(b)
+		}
+	case maxSourceResolutionParam:
+		if value == "raw" {
+			return "0s"
+		}
+		if d, err := parseDuration(value); err == nil {
+			return model.Duration(d).String()
+		}
+	}
+
+	return value
+}
+
+type queryOptionRestrictor struct {
+	action  QueryOptionAction
+	def     queryOptionRule
+	tenants map[string]queryOptionRule
+
+	restricted *prometheus.CounterVec
+}
+
+func newQueryOptionRestrictor(p QueryOptionPolicies, reg prometheus.Registerer) (*queryOptionRestrictor, error) {
+	switch p.Action {
+	case "":
+		p.Action = QueryOptionStrip
+	case QueryOptionStrip, QueryOptionReject:
+	default:
+		return nil, fmt.Errorf("invalid query option action %q", p.Action)
+	}
+
+	rule := func(name string, qp QueryOptionPolicy) (queryOptionRule, error) {
+		normalize := func(m map[string][]string) (map[string][]string, error) {
+			res := make(map[string][]string, len(m))
+			for option, values := range m {
+				if !slices.Contains(thanosParams, option) {
+					return nil, fmt.Errorf("%s: unknown query option %q", name, option)
+				}
+
+				res[option] = make([]string, 0, len(values))
+				for _, v := range values {
+					res[option] = append(res[option], normalizeQueryOption(option, v))
+				}
+			}
+			return res, nil
+		}
+
+		allow, err := normalize(qp.Allow)
+		if err != nil {
+			return queryOptionRule{}, err
+		}
+		deny, err := normalize(qp.Deny)
+		if err != nil {
+			return queryOptionRule{}, err
+		}
+
+		return queryOptionRule{allow: allow, deny: deny}, nil
+	}
+
+	def, err := rule("default", p.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make(map[string]queryOptionRule, len(p.Tenants))
+	for t, qp := range p.Tenants {
+		if tenants[t], err = rule(strconv.Quote(t), qp); err != nil {
+			return nil, err
+		}
+	}
+
+	return &queryOptionRestrictor{
+		action:  p.Action,
+		def:     def,
+		tenants: tenants,
+		restricted: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_options_restricted_total",
+			Help: "Total number of query options which weren't allowed for the tenant, partitioned by option and action (stripped or rejected).",
+		}, []string{"option", "action"}),
+	}, nil
+}
+
+func (q *queryOptionRestrictor) rule(tenant string) queryOptionRule {
+	if r, found := q.tenants[tenant]; found {
+		return r
+	}
+
+	return q.def
+}
+
+// disallowed returns the first option of the form which isn't allowed for
+// one of the tenants.
+func (q *queryOptionRestrictor) disallowed(form map[string][]string, tenants []string) (string, string, bool) {
+	for _, option := range thanosParams {
+		for _, v := range form[option] {
+			value := normalizeQueryOption(option, v)
+			for _, t := range tenants {
+				if !q.rule(t).allowed(option, value) {
+					return option, v, true
+				}
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// restrictQueryOptions strips or rejects the query options which the tenant
+// isn't allowed to set before calling the next handler.
+func (r *routes) restrictQueryOptions(next http.HandlerFunc) http.HandlerFunc {
+	if r.queryOptions == nil {
+		return next
+	}
+
+	q := r.queryOptions
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tenants := MustLabelValues(req.Context())
+		for {
+			option, value, found := q.disallowed(req.Form, tenants)
+			if !found {
+				break
+			}
+
+			if q.action == QueryOptionReject {
+				q.restricted.WithLabelValues(option, "rejected").Inc()
+				rejectRequest(w, ReasonQueryOptionNotAllowed, fmt.Sprintf("the query option %s=%s isn't allowed", option, value), http.StatusForbidden)
+				return
+			}
+
+			q.restricted.WithLabelValues(option, "stripped").Inc()
+			delParam(req, option)
+			req = withWarning(req, fmt.Sprintf("the query option %s=%s isn't allowed and has been removed", option, value))
+		}
+
+		next(w, req)
+	}
+}
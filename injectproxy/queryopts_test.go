@@ -0,0 +1,263 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoadQueryOptionPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		exp    QueryOptionPolicies
+		expErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "default and overrides",
+			content: `
+action: reject
+default:
+  deny:
+    engine: []
+tenants:
+  bulk:
+    deny:
+      partial_response: ["true"]
+    allow:
+      max_source_resolution: ["5m", "1h"]
+`,
+			exp: QueryOptionPolicies{
+				Action:  QueryOptionReject,
+				Default: QueryOptionPolicy{Deny: map[string][]string{"engine": {}}},
+				Tenants: map[string]QueryOptionPolicy{
+					"bulk": {
+						Allow: map[string][]string{"max_source_resolution": {"5m", "1h"}},
+						Deny:  map[string][]string{"partial_response": {"true"}},
+					},
+				},
+			},
+		},
+		{
+			name:    "unknown field",
+			content: "tenant: {}",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "options.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := LoadQueryOptionPolicies(path)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(p, tc.exp) {
+				t.Fatalf("expected %+v, got %+v", tc.exp, p)
+			}
+		})
+	}
+}
+
+func TestQueryOptionRestrictorErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policies QueryOptionPolicies
+	}{
+		{
+			name:     "invalid action",
+			policies: QueryOptionPolicies{Action: "drop"},
+		},
+		{
+			name:     "unknown option in the default policy",
+			policies: QueryOptionPolicies{Default: QueryOptionPolicy{Deny: map[string][]string{"timeout": {}}}},
+		},
+		{
+			name:     "unknown option in a tenant policy",
+			policies: QueryOptionPolicies{Tenants: map[string]QueryOptionPolicy{"ns1": {Allow: map[string][]string{"storeMatch[]": {}}}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newQueryOptionRestrictor(tc.policies, prometheus.NewRegistry()); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestRestrictQueryOptions(t *testing.T) {
+	policies := QueryOptionPolicies{
+		Default: QueryOptionPolicy{
+			Deny: map[string][]string{"engine": {}},
+		},
+		Tenants: map[string]QueryOptionPolicy{
+			"bulk": {
+				Allow: map[string][]string{maxSourceResolutionParam: {"5m", "1h"}},
+				Deny:  map[string][]string{"partial_response": {"true"}},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		action QueryOptionAction
+		path   string
+		params url.Values
+
+		expCode     int
+		expParams   url.Values
+		expWarnings []string
+	}{
+		{
+			name:      "allowed options",
+			path:      "/api/v1/query",
+			params:    url.Values{proxyLabel: {"bulk"}, "partial_response": {"false"}, maxSourceResolutionParam: {"1h"}},
+			expCode:   http.StatusOK,
+			expParams: url.Values{"partial_response": {"false"}, maxSourceResolutionParam: {"1h"}},
+		},
+		{
+			name:        "denied value",
+			path:        "/api/v1/query",
+			params:      url.Values{proxyLabel: {"bulk"}, "partial_response": {"1"}, "dedup": {"true"}},
+			expCode:     http.StatusOK,
+			expParams:   url.Values{"dedup": {"true"}},
+			expWarnings: []string{"the query option partial_response=1 isn't allowed and has been removed"},
+		},
+		{
+			name:        "value not in the allowed list",
+			path:        "/api/v1/query_range",
+			params:      url.Values{proxyLabel: {"bulk"}, maxSourceResolutionParam: {"raw"}, "start": {"0"}, "end": {"100"}, "step": {"10"}},
+			expCode:     http.StatusOK,
+			expParams:   url.Values{"start": {"0"}, "end": {"100"}, "step": {"10"}},
+			expWarnings: []string{"the query option max_source_resolution=raw isn't allowed and has been removed"},
+		},
+		{
+			name:      "equivalent allowed value",
+			path:      "/api/v1/query",
+			params:    url.Values{proxyLabel: {"bulk"}, maxSourceResolutionParam: {"300s"}},
+			expCode:   http.StatusOK,
+			expParams: url.Values{maxSourceResolutionParam: {"300s"}},
+		},
+		{
+			name:        "default policy denies the option",
+			path:        "/api/v1/series",
+			params:      url.Values{proxyLabel: {"ns1"}, "match[]": {"up"}, "engine": {"thanos"}},
+			expCode:     http.StatusOK,
+			expParams:   url.Values{"match[]": {`{__name__="up",namespace="ns1"}`}},
+			expWarnings: []string{"the query option engine=thanos isn't allowed and has been removed"},
+		},
+		{
+			name:      "default policy allows the option",
+			path:      "/api/v1/query",
+			params:    url.Values{proxyLabel: {"ns1"}, "partial_response": {"true"}},
+			expCode:   http.StatusOK,
+			expParams: url.Values{"partial_response": {"true"}},
+		},
+		{
+			name:        "all the tenants' policies apply",
+			path:        "/api/v1/query",
+			params:      url.Values{proxyLabel: {"ns1", "bulk"}, "partial_response": {"true"}},
+			expCode:     http.StatusOK,
+			expParams:   url.Values{},
+			expWarnings: []string{"the query option partial_response=true isn't allowed and has been removed"},
+		},
+		{
+			name:    "rejected",
+			action:  QueryOptionReject,
+			path:    "/api/v1/query",
+			params:  url.Values{proxyLabel: {"bulk"}, "partial_response": {"true"}},
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var params url.Values
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_ = req.ParseForm()
+				params = req.Form
+				io.WriteString(w, `{"status":"success","data":[],"warnings":["upstream"]}`)
+			}))
+			defer m.Close()
+
+			p := policies
+			p.Action = tc.action
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryOptionPolicies(p), WithEnabledLabelsAPI())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.path != "/api/v1/series" {
+				tc.params.Set("query", "up")
+				if tc.expParams != nil {
+					tc.expParams.Set("query", `up{namespace=~"bulk|ns1"}`)
+					if len(tc.params[proxyLabel]) == 1 {
+						tc.expParams.Set("query", `up{namespace="`+tc.params.Get(proxyLabel)+`"}`)
+					}
+				}
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				if got := w.Header().Get(RejectionReasonHeader); got != string(ReasonQueryOptionNotAllowed) {
+					t.Fatalf("expected reason %q, got %q", ReasonQueryOptionNotAllowed, got)
+				}
+				if params != nil {
+					t.Fatalf("expected no upstream request")
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(params, tc.expParams) {
+				t.Fatalf("expected upstream params %v, got %v", tc.expParams, params)
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expWarnings := append([]string{"upstream"}, tc.expWarnings...)
+			if !reflect.DeepEqual(expWarnings, apir.Warnings) {
+				t.Fatalf("expected warnings %q, got %q", expWarnings, apir.Warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The priority classes of the queued queries.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+var priorityClasses = [...]string{PriorityInteractive, PriorityBatch}
+
+var (
+	errQueueFull    = errors.New("query queue full")
+	errQueueTimeout = errors.New("timed out waiting in the query queue")
+)
+
+// QueryQueue configures the queue of the instant and range queries.
+type QueryQueue struct {
+	// MaxConcurrent is the maximum number of queries sent concurrently to
+	// the upstream. The other queries wait in the queue.
+	MaxConcurrent int
+	// MaxLength is the maximum number of queries waiting in the queue.
+	// The queries are rejected when the queue is full. Zero means no
+	// limit.
+	MaxLength int
+	// MaxWait is the maximum duration a query waits in the queue before
+	// being rejected. Zero means no limit.
+	MaxWait time.Duration
+	// PriorityHeader is the request header holding the priority class of
+	// the query ("interactive" or "batch"). The queries without the header
+	// are interactive.
+	PriorityHeader string
+	// InteractiveWeight and BatchWeight are the shares of the upstream
+	// capacity given to each class when both have queued queries. They
+	// default to 1.
+	InteractiveWeight int
+	BatchWeight       int
+}
+
+// WithQueryQueue queues the instant and range queries when the upstream
+// already serves the maximum number of concurrent queries instead of
+// sending them all. Waiting queries are dequeued by weighted round robin
+// between the priority classes and in arrival order within a class, which
+// keeps the dashboards responsive while rulers and batch jobs run.
+func WithQueryQueue(q QueryQueue) Option {
+	return optionFunc(func(o *options) {
+		o.queryQueue = &q
+	})
+}
+
+type queuedQuery struct {
+	ready   chan struct{}
+	granted bool
+}
+
+type queryScheduler struct {
+	cfg     QueryQueue
+	weights [len(priorityClasses)]int
+
+	mtx     sync.Mutex
+	running int
+	queues  [len(priorityClasses)][]*queuedQuery
+	queued  int
+	// current holds the state of the smooth weighted round robin.
+	current [len(priorityClasses)]int
+
+	length   *prometheus.GaugeVec
+	wait     *prometheus.HistogramVec
+	rejected *prometheus.CounterVec
+}
+
+func newQueryScheduler(cfg QueryQueue, reg prometheus.Registerer) *queryScheduler {
+	s := &queryScheduler{
+		cfg:     cfg,
+		weights: [len(priorityClasses)]int{cfg.InteractiveWeight, cfg.BatchWeight},
+		length: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "query_queue_length",
+			Help: "Number of queries waiting in the queue, partitioned by priority class.",
+		}, []string{"class"}),
+		wait: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "query_queue_wait_duration_seconds",
+			Help:    "Time spent by the queries in the queue, partitioned by priority class.",
+			Buckets: []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30},
+		}, []string{"class"}),
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_queue_rejected_total",
+			Help: "Total number of queries rejected by the queue, partitioned by priority class and reason (full or timeout).",
+		}, []string{"class", "reason"}),
+	}
+	for i := range s.weights {
+		if s.weights[i] <= 0 {
+			s.weights[i] = 1
+		}
+	}
+
+	return s
+}
+
+// class returns the index of the priority class of the request.
+func (s *queryScheduler) class(req *http.Request) int {
+	if s.cfg.PriorityHeader == "" {
+		return 0
+	}
+
+	v := strings.TrimSpace(req.Header.Get(s.cfg.PriorityHeader))
+	for i, c := range priorityClasses {
+		if strings.EqualFold(v, c) {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// acquire waits until the query can be sent to the upstream.
+func (s *queryScheduler) acquire(ctx context.Context, class int) error {
+	s.mtx.Lock()
+	if s.running < s.cfg.MaxConcurrent && s.queued == 0 {
+		s.running++
+		s.mtx.Unlock()
+		return nil
+	}
+
+	if s.cfg.MaxLength > 0 && s.queued >= s.cfg.MaxLength {
+		s.mtx.Unlock()
+		return errQueueFull
+	}
+
+	q := &queuedQuery{ready: make(chan struct{})}
+	s.queues[class] = append(s.queues[class], q)
+	s.queued++
+	s.length.WithLabelValues(priorityClasses[class]).Inc()
+	s.mtx.Unlock()
+
+	var timeout <-chan time.Time
+	if s.cfg.MaxWait > 0 {
+		t := time.NewTimer(s.cfg.MaxWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	var err error
+	select {
+	case <-q.ready:
+		return nil
+	case <-timeout:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if q.granted {
+		// The query got its turn in the meantime.
+		return nil
+	}
+
+	for i, other := range s.queues[class] {
+		if other == q {
+			s.queues[class] = append(s.queues[class][:i], s.queues[class][i+1:]...)
+			break
+		}
+	}
+	s.queued--
+	s.length.WithLabelValues(priorityClasses[class]).Dec()
+
+	return err
+}
+
+// release frees the slot of a query and hands it over to the next queued
+// query, if any.
+func (s *queryScheduler) release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.running--
+	for s.running < s.cfg.MaxConcurrent && s.queued > 0 {
+		class := s.next()
+		q := s.queues[class][0]
+		s.queues[class] = s.queues[class][1:]
+		s.queued--
+		s.length.WithLabelValues(priorityClasses[class]).Dec()
+
+		s.running++
+		q.granted = true
+		close(q.ready)
+	}
+}
+
+// next returns the class of the next query to dequeue using a smooth
+// weighted round robin among the classes with queued queries. It must be
+// called with the lock held and at least one query queued.
+func (s *queryScheduler) next() int {
+	var (
+		best  = -1
+		total int
+	)
+	for i := range s.queues {
+		if len(s.queues[i]) == 0 {
+			continue
+		}
+		s.current[i] += s.weights[i]
+		total += s.weights[i]
+		if best < 0 || s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= total
+
+	return best
+}
+
+// scheduleQueries queues the instant and range queries when the upstream is
+// saturated.
+func (r *routes) scheduleQueries(next http.HandlerFunc) http.HandlerFunc {
+	if r.scheduler == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch handlerName(req.Context()) {
+		case "/api/v1/query", "/api/v1/query_range":
+		default:
+			next(w, req)
+			return
+		}
+
+		class := r.scheduler.class(req)
+		RequestContextFrom(req.Context()).setPriority(priorityClasses[class])
+		start := time.Now()
+		err := r.scheduler.acquire(req.Context(), class)
+		r.scheduler.wait.WithLabelValues(priorityClasses[class]).Observe(time.Since(start).Seconds())
+		switch {
+		case errors.Is(err, errQueueFull):
+			r.scheduler.rejected.WithLabelValues(priorityClasses[class], "full").Inc()
+			rejectRequest(w, ReasonQueueFull, err.Error(), http.StatusTooManyRequests)
+			return
+		case errors.Is(err, errQueueTimeout):
+			r.scheduler.rejected.WithLabelValues(priorityClasses[class], "timeout").Inc()
+			rejectRequest(w, ReasonQueueTimeout, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			// The client went away.
+			return
+		}
+		defer r.scheduler.release()
+
+		next(w, req)
+	}
+}
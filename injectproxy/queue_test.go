@@ -0,0 +1,166 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitQueued waits until the scheduler has n queued queries.
+func waitQueued(t *testing.T, s *queryScheduler, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mtx.Lock()
+		queued := s.queued
+		s.mtx.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued queries, got %d", n, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQuerySchedulerWeightedOrder(t *testing.T) {
+	s := newQueryScheduler(QueryQueue{MaxConcurrent: 1, InteractiveWeight: 3, BatchWeight: 1}, prometheus.NewRegistry())
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	granted := make(chan string)
+	for i, class := range []int{1, 1, 1, 1, 0, 0, 0, 0} {
+		go func(class int) {
+			if err := s.acquire(context.Background(), class); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			granted <- priorityClasses[class]
+		}(class)
+		waitQueued(t, s, i+1)
+	}
+
+	var order []string
+	for i := 0; i < 8; i++ {
+		s.release()
+		order = append(order, <-granted)
+	}
+
+	exp := []string{"interactive", "interactive", "batch", "interactive", "interactive", "batch", "batch", "batch"}
+	if !reflect.DeepEqual(order, exp) {
+		t.Fatalf("expected order %v, got %v", exp, order)
+	}
+}
+
+func TestQuerySchedulerErrors(t *testing.T) {
+	s := newQueryScheduler(QueryQueue{MaxConcurrent: 1, MaxLength: 1, MaxWait: 20 * time.Millisecond}, prometheus.NewRegistry())
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	timedOut := make(chan error)
+	go func() {
+		timedOut <- s.acquire(context.Background(), 1)
+	}()
+	waitQueued(t, s, 1)
+
+	if err := s.acquire(context.Background(), 0); !errors.Is(err, errQueueFull) {
+		t.Fatalf("expected %v, got %v", errQueueFull, err)
+	}
+
+	if err := <-timedOut; !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("expected %v, got %v", errQueueTimeout, err)
+	}
+	waitQueued(t, s, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.acquire(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	waitQueued(t, s, 0)
+
+	// The slot is available again once released.
+	s.release()
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestQueryQueueRoutes(t *testing.T) {
+	release := make(chan struct{})
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryQueue(QueryQueue{MaxConcurrent: 1, MaxWait: 20 * time.Millisecond, PriorityHeader: "X-Query-Priority"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+		done <- w.Code
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.scheduler.mtx.Lock()
+		running := r.scheduler.running
+		r.scheduler.mtx.Unlock()
+		if running == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a running query")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns2", nil)
+	req.Header.Set("X-Query-Priority", "Batch")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if got := testutil.ToFloat64(r.scheduler.rejected.WithLabelValues("batch", "timeout")); got != 1 {
+		t.Fatalf("expected 1 rejected batch query, got %v", got)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, code)
+	}
+}
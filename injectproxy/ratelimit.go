@@ -0,0 +1,238 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+// maxRateLimitBuckets is the maximum number of tenant buckets. The least
+// recently used bucket is evicted beyond: it has most likely refilled and a
+// full bucket behaves like a new one so evicting it doesn't change the
+// limits.
+const maxRateLimitBuckets = 10000
+
+// RateLimit is a token bucket limit.
+type RateLimit struct {
+	// RequestsPerSecond is the rate at which the bucket refills. Zero means
+	// no limit.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is the capacity of the bucket. If zero, it defaults to the
+	// requests per second rounded up.
+	Burst int `yaml:"burst"`
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+
+	return math.Max(1, math.Ceil(l.RequestsPerSecond))
+}
+
+// TenantRateLimits configures the per-tenant rate limits.
+type TenantRateLimits struct {
+	// Header is the HTTP header identifying the tenant (e.g.
+	// X-Scope-OrgID).
+	Header string `yaml:"-"`
+	// Default applies to the tenants without override. The requests
+	// without tenant share a single bucket with the default limit.
+	Default RateLimit `yaml:"default"`
+	// Tenants overrides the default limit per tenant.
+	Tenants map[string]RateLimit `yaml:"tenants"`
+}
+
+// LoadTenantRateLimits reads the rate limits from a YAML file. For example:
+//
+//	default:
+//	  requests_per_second: 10
+//	  burst: 20
+//	tenants:
+//	  team-a:
+//	    requests_per_second: 100
+func LoadTenantRateLimits(path string) (TenantRateLimits, error) {
+	var l TenantRateLimits
+
+	f, err := os.Open(path)
+	if err != nil {
+		return l, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&l); err != nil && !errors.Is(err, io.EOF) {
+		return l, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if err := l.validate(); err != nil {
+		return l, fmt.Errorf("invalid rate limits in %s: %w", path, err)
+	}
+
+	return l, nil
+}
+
+func (l TenantRateLimits) validate() error {
+	check := func(name string, rl RateLimit) error {
+		if rl.RequestsPerSecond < 0 || rl.Burst < 0 {
+			return fmt.Errorf("%s: negative limit", name)
+		}
+		return nil
+	}
+
+	if err := check("default", l.Default); err != nil {
+		return err
+	}
+	for t, rl := range l.Tenants {
+		if err := check(strconv.Quote(t), rl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WithTenantRateLimits limits the rate of requests per tenant, the tenant
+// being read from the configured header. Each tenant has its own token
+// bucket and requests exceeding the limit are rejected with "429 Too Many
+// Requests".
+func WithTenantRateLimits(l TenantRateLimits) Option {
+	return optionFunc(func(o *options) {
+		o.tenantRateLimits = &l
+	})
+}
+
+// tokenBucket is a token bucket refilled continuously.
+type tokenBucket struct {
+	tenant string
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// take consumes a token if available. Otherwise it returns how long the
+// caller should wait for the next token.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	burst := b.limit.burst()
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.RequestsPerSecond)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.limit.RequestsPerSecond * float64(time.Second))
+}
+
+type tenantRateLimiter struct {
+	limits     TenantRateLimits
+	now        func() time.Time
+	maxBuckets int
+
+	// The buckets are ordered from the most to the least recently used.
+	mtx     sync.Mutex
+	ll      *list.List
+	buckets map[string]*list.Element
+
+	// Unlike the metrics labeled by the enforced label values, the tenant
+	// header isn't validated and is set by the clients: it isn't a label to
+	// bound the cardinality.
+	limited prometheus.Counter
+}
+
+func newTenantRateLimiter(l TenantRateLimits, reg prometheus.Registerer) *tenantRateLimiter {
+	return &tenantRateLimiter{
+		limits:     l,
+		now:        time.Now,
+		maxBuckets: maxRateLimitBuckets,
+		ll:         list.New(),
+		buckets:    map[string]*list.Element{},
+		limited: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "tenant_rate_limited_requests_total",
+			Help: "Total number of requests rejected because the tenant's rate limit was reached.",
+		}),
+	}
+}
+
+func (l *tenantRateLimiter) limit(tenant string) RateLimit {
+	if rl, found := l.limits.Tenants[tenant]; found && tenant != "" {
+		return rl
+	}
+
+	return l.limits.Default
+}
+
+// allow consumes a token from the tenant's bucket. When the limit is
+// reached, it returns how long the tenant should wait before retrying.
+func (l *tenantRateLimiter) allow(tenant string) (bool, time.Duration) {
+	rl := l.limit(tenant)
+	if rl.RequestsPerSecond <= 0 {
+		return true, 0
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	e, found := l.buckets[tenant]
+	if found {
+		l.ll.MoveToFront(e)
+	} else {
+		if l.ll.Len() >= l.maxBuckets {
+			oldest := l.ll.Back()
+			l.ll.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).tenant)
+		}
+
+		e = l.ll.PushFront(&tokenBucket{tenant: tenant, limit: rl, tokens: rl.burst(), last: now})
+		l.buckets[tenant] = e
+	}
+
+	return e.Value.(*tokenBucket).take(now)
+}
+
+// rateLimit rejects the requests of the tenants exceeding their rate limit.
+func (r *routes) rateLimit(next http.Handler) http.Handler {
+	if r.rateLimiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tenant := strings.TrimSpace(req.Header.Get(r.rateLimiter.limits.Header))
+
+		if ok, wait := r.rateLimiter.allow(tenant); !ok {
+			r.rateLimiter.limited.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			rejectRequest(w, ReasonTenantQuota, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,219 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoadTenantRateLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		exp    TenantRateLimits
+		expErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "default and overrides",
+			content: `
+default:
+  requests_per_second: 10
+  burst: 20
+tenants:
+  team-a:
+    requests_per_second: 100
+`,
+			exp: TenantRateLimits{
+				Default: RateLimit{RequestsPerSecond: 10, Burst: 20},
+				Tenants: map[string]RateLimit{"team-a": {RequestsPerSecond: 100}},
+			},
+		},
+		{
+			name:    "unknown field",
+			content: "defaults: {}",
+			expErr:  true,
+		},
+		{
+			name:    "negative limit",
+			content: "tenants: {team-a: {burst: -1}}",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "limits.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := LoadTenantRateLimits(path)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if l.Default != tc.exp.Default || len(l.Tenants) != len(tc.exp.Tenants) {
+				t.Fatalf("expected %+v, got %+v", tc.exp, l)
+			}
+			for k, v := range tc.exp.Tenants {
+				if l.Tenants[k] != v {
+					t.Fatalf("expected %+v, got %+v", tc.exp, l)
+				}
+			}
+		})
+	}
+}
+
+func TestTenantRateLimiter(t *testing.T) {
+	l := newTenantRateLimiter(TenantRateLimits{
+		Default: RateLimit{RequestsPerSecond: 1, Burst: 2},
+		Tenants: map[string]RateLimit{
+			"gold":      {RequestsPerSecond: 10},
+			"unlimited": {},
+		},
+	}, prometheus.NewRegistry())
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	allow := func(tenant string, exp bool, expWait time.Duration) {
+		t.Helper()
+		ok, wait := l.allow(tenant)
+		if ok != exp || wait != expWait {
+			t.Fatalf("tenant %q: expected (%v, %v), got (%v, %v)", tenant, exp, expWait, ok, wait)
+		}
+	}
+
+	// Tenants without override have their own bucket with the default limit.
+	allow("team-a", true, 0)
+	allow("team-a", true, 0)
+	allow("team-a", false, time.Second)
+	allow("team-b", true, 0)
+
+	// Requests without tenant share the default bucket.
+	allow("", true, 0)
+	allow("", true, 0)
+	allow("", false, time.Second)
+
+	// Overrides.
+	for i := 0; i < 10; i++ {
+		allow("gold", true, 0)
+	}
+	allow("gold", false, 100*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		allow("unlimited", true, 0)
+	}
+
+	// The buckets refill over time.
+	now = now.Add(500 * time.Millisecond)
+	allow("team-a", false, 500*time.Millisecond)
+	now = now.Add(500 * time.Millisecond)
+	allow("team-a", true, 0)
+}
+
+func TestTenantRateLimiterEviction(t *testing.T) {
+	l := newTenantRateLimiter(TenantRateLimits{
+		Default: RateLimit{RequestsPerSecond: 1, Burst: 1},
+	}, prometheus.NewRegistry())
+	l.maxBuckets = 2
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	for _, tenant := range []string{"team-a", "team-b"} {
+		if ok, _ := l.allow(tenant); !ok {
+			t.Fatalf("tenant %q: unexpected rejection", tenant)
+		}
+	}
+	// team-a becomes the most recently used bucket.
+	if ok, _ := l.allow("team-a"); ok {
+		t.Fatal("tenant \"team-a\": expected rejection")
+	}
+
+	l.allow("team-c")
+	if _, found := l.buckets["team-b"]; found {
+		t.Fatal("expected the least recently used bucket to be evicted")
+	}
+	if _, found := l.buckets["team-a"]; !found {
+		t.Fatal("expected the most recently used bucket to be kept")
+	}
+
+	// Rotating the tenants doesn't grow the buckets beyond the maximum and
+	// evicts the least recently used ones.
+	for i := 0; i < 100; i++ {
+		l.allow(fmt.Sprintf("rotated-%d", i))
+		if n := len(l.buckets); n > 2 || l.ll.Len() != n {
+			t.Fatalf("expected at most 2 buckets, got %d", n)
+		}
+	}
+	if _, found := l.buckets["rotated-99"]; !found {
+		t.Fatal("expected the bucket of the last tenant")
+	}
+}
+
+func TestTenantRateLimitsRoutes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithTenantRateLimits(TenantRateLimits{
+			Header:  "X-Scope-OrgID",
+			Default: RateLimit{RequestsPerSecond: 0.1, Burst: 1},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		tenant    string
+		expCode   int
+		expHeader string
+	}{
+		{tenant: "team-a", expCode: http.StatusOK},
+		{tenant: "team-a", expCode: http.StatusTooManyRequests, expHeader: "10"},
+		{tenant: "team-b", expCode: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil)
+		req.Header.Set("X-Scope-OrgID", tc.tenant)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.expCode {
+			t.Fatalf("expected status code %d, got %d", tc.expCode, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != tc.expHeader {
+			t.Fatalf("expected Retry-After %q, got %q", tc.expHeader, got)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RejectionReasonHeader is the response header holding the reason of the
+// errors generated by the proxy.
+const RejectionReasonHeader = "X-Prom-Label-Proxy-Reason"
+
+// RejectionReason is a stable machine-readable code identifying why the
+// proxy rejected a request. It is returned in the "reason" field of the
+// error responses and in the RejectionReasonHeader header, so that the
+// clients can branch on it instead of parsing the error messages. New
+// reasons may be added but the existing ones are never renamed.
+type RejectionReason string
+
+const (
+	// Generic reasons derived from the status code.
+	ReasonBadRequest       RejectionReason = "bad_request"
+	ReasonUnauthenticated  RejectionReason = "unauthenticated"
+	ReasonForbidden        RejectionReason = "forbidden"
+	ReasonNotFound         RejectionReason = "not_found"
+	ReasonMethodNotAllowed RejectionReason = "method_not_allowed"
+	ReasonTooLarge         RejectionReason = "request_too_large"
+	ReasonUnprocessable    RejectionReason = "unprocessable"
+	ReasonTooManyRequests  RejectionReason = "too_many_requests"
+	ReasonInternalError    RejectionReason = "internal_error"
+	ReasonNotImplemented   RejectionReason = "not_implemented"
+	ReasonUnavailable      RejectionReason = "unavailable"
+
+	// Request validation.
+	ReasonInvalidTenant    RejectionReason = "invalid_tenant"
+	ReasonInvalidQuery     RejectionReason = "invalid_query"
+	ReasonIllegalMatcher   RejectionReason = "illegal_matcher"
+	ReasonStrictValidation RejectionReason = "strict_validation"
+	ReasonUnsupportedAPI   RejectionReason = "unsupported_api"
+
+	// Authentication and authorization.
+	ReasonInvalidSignature RejectionReason = "invalid_signature"
+	ReasonReplayedRequest  RejectionReason = "replayed_request"
+	ReasonAccessDenied     RejectionReason = "access_denied"
+	ReasonTenantDisabled   RejectionReason = "tenant_disabled"
+	ReasonInvalidExemption RejectionReason = "invalid_exemption"
+
+	// Query policies.
+	ReasonBlockedPattern        RejectionReason = "blocked_pattern"
+	ReasonQueryNotAllowed       RejectionReason = "query_not_allowed"
+	ReasonMaxRangeExceeded      RejectionReason = "max_range_exceeded"
+	ReasonAggregationRequired   RejectionReason = "aggregation_required"
+	ReasonSelectorLimit         RejectionReason = "selector_limit"
+	ReasonQueryOptionNotAllowed RejectionReason = "query_option_not_allowed"
+
+	// Quotas and load protection.
+	ReasonTenantQuota             RejectionReason = "tenant_quota"
+	ReasonWindowFull              RejectionReason = "window_full"
+	ReasonQueueFull               RejectionReason = "queue_full"
+	ReasonQueueTimeout            RejectionReason = "queue_timeout"
+	ReasonConcurrencyLimit        RejectionReason = "concurrency_limit"
+	ReasonConnectionLimit         RejectionReason = "connection_limit"
+	ReasonFederationLimit         RejectionReason = "federation_limit"
+	ReasonExportLimit             RejectionReason = "export_limit"
+	ReasonUpstreamPaced           RejectionReason = "upstream_paced"
+	ReasonLoadShed                RejectionReason = "load_shed"
+	ReasonDraining                RejectionReason = "draining"
+	ReasonCircuitOpen             RejectionReason = "circuit_open"
+	ReasonQueryCanceled           RejectionReason = "query_canceled"
+	ReasonUpstreamTimeout         RejectionReason = "upstream_timeout"
+	ReasonUpstreamError           RejectionReason = "upstream_error"
+	ReasonInvalidUpstreamResponse RejectionReason = "invalid_upstream_response"
+)
+
+// statusReason returns the generic reason of a status code.
+func statusReason(code int) RejectionReason {
+	switch code {
+	case http.StatusBadRequest:
+		return ReasonBadRequest
+	case http.StatusUnauthorized:
+		return ReasonUnauthenticated
+	case http.StatusForbidden:
+		return ReasonForbidden
+	case http.StatusNotFound:
+		return ReasonNotFound
+	case http.StatusMethodNotAllowed:
+		return ReasonMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return ReasonTooLarge
+	case http.StatusUnprocessableEntity:
+		return ReasonUnprocessable
+	case http.StatusTooManyRequests:
+		return ReasonTooManyRequests
+	case http.StatusNotImplemented:
+		return ReasonNotImplemented
+	case http.StatusBadGateway:
+		return ReasonUpstreamError
+	case http.StatusServiceUnavailable:
+		return ReasonUnavailable
+	case http.StatusGatewayTimeout:
+		return ReasonUpstreamTimeout
+	}
+
+	return ReasonInternalError
+}
+
+func newRejectionCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	return promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "http_request_rejections_total",
+		Help: "Total number of requests rejected by the proxy, partitioned by handler and reason.",
+	}, []string{"handler", "reason"})
+}
+
+// countRejections counts the requests of the handler rejected by the proxy
+// by reason.
+func countRejections(rejections *prometheus.CounterVec, pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req)
+
+		if reason := w.Header().Get(RejectionReasonHeader); reason != "" {
+			rejections.WithLabelValues(pattern, reason).Inc()
+		}
+	})
+}
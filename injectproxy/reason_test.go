@@ -0,0 +1,122 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRejectionReasons(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	reg := prometheus.NewRegistry()
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithPrometheusRegistry(reg),
+		WithMaxLookback(MaxLookback{Duration: time.Hour, Mode: LookbackReject}),
+		WithQueryBlocklist(QueryBlocklist{Rules: []QueryBlocklistRule{{Name: "expensive", Metric: "expensive_metric"}}}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+
+		expCode   int
+		expReason RejectionReason
+	}{
+		{
+			name:    "success",
+			params:  url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:      "missing tenant",
+			params:    url.Values{"query": []string{"up"}},
+			expCode:   http.StatusBadRequest,
+			expReason: ReasonInvalidTenant,
+		},
+		{
+			name:      "invalid query",
+			params:    url.Values{"query": []string{"up{"}, proxyLabel: []string{"ns1"}},
+			expCode:   http.StatusBadRequest,
+			expReason: ReasonInvalidQuery,
+		},
+		{
+			name:      "blocked query",
+			params:    url.Values{"query": []string{"expensive_metric"}, proxyLabel: []string{"ns1"}},
+			expCode:   http.StatusUnprocessableEntity,
+			expReason: ReasonBlockedPattern,
+		},
+		{
+			name:      "lookback",
+			params:    url.Values{"query": []string{"up[1d]"}, proxyLabel: []string{"ns1"}},
+			expCode:   http.StatusBadRequest,
+			expReason: ReasonMaxRangeExceeded,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+tc.params.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if got := RejectionReason(w.Header().Get(RejectionReasonHeader)); got != tc.expReason {
+				t.Fatalf("expected reason header %q, got %q", tc.expReason, got)
+			}
+
+			if tc.expReason == "" {
+				return
+			}
+
+			var body struct {
+				Reason RejectionReason `json:"reason"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if body.Reason != tc.expReason {
+				t.Fatalf("expected reason %q, got %q", tc.expReason, body.Reason)
+			}
+		})
+	}
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_request_rejections_total Total number of requests rejected by the proxy, partitioned by handler and reason.
+# TYPE http_request_rejections_total counter
+http_request_rejections_total{handler="/api/v1/query",reason="blocked_pattern"} 1
+http_request_rejections_total{handler="/api/v1/query",reason="invalid_query"} 1
+http_request_rejections_total{handler="/api/v1/query",reason="invalid_tenant"} 1
+http_request_rejections_total{handler="/api/v1/query",reason="max_range_exceeded"} 1
+`), "http_request_rejections_total"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// recoveryMux wraps a mux and converts the panics of the handlers into 500
+// responses. The panic and its stack trace are logged.
+type recoveryMux struct {
+	mux
+	panics *prometheus.CounterVec
+	logger *log.Logger
+}
+
+func newRecoveryMux(m mux, r prometheus.Registerer, logger *log.Logger) *recoveryMux {
+	return &recoveryMux{
+		mux: m,
+		panics: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Name: "http_handler_panics_total",
+			Help: "Total number of requests which panicked, partitioned by handler.",
+		}, []string{"handler"}),
+		logger: logger,
+	}
+}
+
+// panicRecorder records whether the response has been started.
+type panicRecorder struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (p *panicRecorder) WriteHeader(code int) {
+	p.written = true
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *panicRecorder) Write(b []byte) (int, error) {
+	p.written = true
+	return p.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for http.ResponseController.
+func (p *panicRecorder) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// Handle implements the mux interface.
+func (m *recoveryMux) Handle(pattern string, handler http.Handler) {
+	panics := m.panics.WithLabelValues(pattern)
+
+	m.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &panicRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// The handler aborted the response on purpose.
+				panic(err)
+			}
+
+			panics.Inc()
+			m.logger.Printf("panic serving %s %s: %v\n%s", req.Method, req.URL.Path, err, debug.Stack())
+
+			if rec.written {
+				// The response can't be replaced, abort it to let the
+				// client know that it is incomplete.
+				panic(http.ErrAbortHandler)
+			}
+			prometheusAPIError(w, "internal error", http.StatusInternalServerError)
+		}()
+
+		handler.ServeHTTP(rec, req)
+	}))
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoveryMux(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+
+		expCode   int
+		expPanic  interface{}
+		expPanics float64
+	}{
+		{
+			name:    "no panic",
+			handler: func(w http.ResponseWriter, _ *http.Request) { w.Write(okResponse) },
+			expCode: http.StatusOK,
+		},
+		{
+			name:      "panic",
+			handler:   func(http.ResponseWriter, *http.Request) { panic("boom") },
+			expCode:   http.StatusInternalServerError,
+			expPanics: 1,
+		},
+		{
+			name: "panic after the response started",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Write(okResponse)
+				panic("boom")
+			},
+			expCode:   http.StatusOK,
+			expPanic:  http.ErrAbortHandler,
+			expPanics: 1,
+		},
+		{
+			name:     "aborted response",
+			handler:  func(http.ResponseWriter, *http.Request) { panic(http.ErrAbortHandler) },
+			expCode:  http.StatusOK,
+			expPanic: http.ErrAbortHandler,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := newRecoveryMux(http.NewServeMux(), prometheus.NewRegistry(), log.New(&buf, "", 0))
+			m.Handle("/test", tc.handler)
+
+			w := httptest.NewRecorder()
+			func() {
+				defer func() {
+					if got := recover(); got != tc.expPanic {
+						t.Fatalf("expected panic %v, got %v", tc.expPanic, got)
+					}
+				}()
+				m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/test", nil))
+			}()
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, w.Code)
+			}
+
+			if got := testutil.ToFloat64(m.panics.WithLabelValues("/test")); got != tc.expPanics {
+				t.Fatalf("expected %v panics, got %v", tc.expPanics, got)
+			}
+			if logged := strings.Contains(buf.String(), "panic serving GET /test: boom"); logged != (tc.expPanics > 0) {
+				t.Fatalf("unexpected log: %q", buf.String())
+			}
+		})
+	}
+}
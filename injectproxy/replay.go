@@ -0,0 +1,132 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// nonceHeader is the request header carrying a unique value per
+	// mutating request.
+	nonceHeader = "X-Querymw-Nonce"
+	// timestampHeader is the request header carrying the time at which the
+	// mutating request was issued (RFC3339 or Unix timestamp).
+	timestampHeader = "X-Querymw-Timestamp"
+)
+
+// WithReplayProtection requires the mutating requests (silence creation and
+// expiration) to carry a unique nonce in the X-Querymw-Nonce header and
+// their issue time in the X-Querymw-Timestamp header. The requests issued
+// more than the window away from the current time and the nonces already
+// seen within the window are rejected with 403.
+//
+// The headers only protect against replays if they are covered by the
+// authentication of the request (e.g. a signature verified upstream of the
+// proxy).
+func WithReplayProtection(window time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.replayWindow = window
+	})
+}
+
+type replayGuard struct {
+	window time.Duration
+	now    func() time.Time
+
+	mtx       sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+
+	rejections *prometheus.CounterVec
+}
+
+func newReplayGuard(window time.Duration, reg prometheus.Registerer) *replayGuard {
+	return &replayGuard{
+		window: window,
+		now:    time.Now,
+		nonces: map[string]time.Time{},
+		rejections: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "replay_protection_rejected_requests_total",
+			Help: "Total number of mutating requests rejected by the replay protection, partitioned by reason (missing, stale or replayed).",
+		}, []string{"reason"}),
+	}
+}
+
+// check records the nonce and returns the reason for rejecting the request
+// if any.
+func (g *replayGuard) check(nonce string, ts time.Time) (string, error) {
+	now := g.now()
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) {
+		return "stale", fmt.Errorf("the %s header must be within %s of the current time", timestampHeader, g.window)
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	// The nonces are kept for twice the window since a timestamp can be
+	// ahead of the current time by up to the window.
+	if now.Sub(g.lastSweep) > g.window {
+		for n, seen := range g.nonces {
+			if now.Sub(seen) > 2*g.window {
+				delete(g.nonces, n)
+			}
+		}
+		g.lastSweep = now
+	}
+
+	if _, found := g.nonces[nonce]; found {
+		return "replayed", fmt.Errorf("the %s header has already been used", nonceHeader)
+	}
+	g.nonces[nonce] = now
+
+	return "", nil
+}
+
+// preventReplays rejects the mutating requests without a fresh timestamp and
+// a unique nonce.
+func (r *routes) preventReplays(next http.HandlerFunc) http.HandlerFunc {
+	if r.replayGuard == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			next(w, req)
+			return
+		}
+
+		nonce := req.Header.Get(nonceHeader)
+		ts, err := parseTime(req.Header.Get(timestampHeader))
+		if nonce == "" || err != nil {
+			r.replayGuard.rejections.WithLabelValues("missing").Inc()
+			prometheusAPIError(w, fmt.Sprintf("the %s and %s headers are required", nonceHeader, timestampHeader), http.StatusBadRequest)
+			return
+		}
+
+		if reason, err := r.replayGuard.check(nonce, ts); err != nil {
+			r.replayGuard.rejections.WithLabelValues(reason).Inc()
+			rejectRequest(w, ReasonReplayedRequest, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReplayGuard(t *testing.T) {
+	g := newReplayGuard(time.Minute, prometheus.NewRegistry())
+	now := time.Unix(1000, 0)
+	g.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		name  string
+		nonce string
+		ts    time.Time
+		after time.Duration
+
+		expReason string
+	}{
+		{
+			name:  "fresh request",
+			nonce: "a",
+			ts:    time.Unix(1000, 0),
+		},
+		{
+			name:      "replayed nonce",
+			nonce:     "a",
+			ts:        time.Unix(1000, 0),
+			expReason: "replayed",
+		},
+		{
+			name:      "too old",
+			nonce:     "b",
+			ts:        time.Unix(900, 0),
+			expReason: "stale",
+		},
+		{
+			name:      "too far in the future",
+			nonce:     "b",
+			ts:        time.Unix(1100, 0),
+			expReason: "stale",
+		},
+		{
+			name:      "replayed nonce with a new timestamp",
+			nonce:     "a",
+			ts:        time.Unix(1090, 0),
+			after:     90 * time.Second,
+			expReason: "replayed",
+		},
+		{
+			name:  "expired nonce",
+			nonce: "a",
+			ts:    time.Unix(1200, 0),
+			after: 110 * time.Second,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.after)
+
+			reason, err := g.check(tc.nonce, tc.ts)
+			if reason != tc.expReason {
+				t.Fatalf("expected reason %q, got %q", tc.expReason, reason)
+			}
+			if (err != nil) != (tc.expReason != "") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPreventReplays(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			getSilenceWithLabel("default").ServeHTTP(w, req)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithReplayProtection(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, tc := range []struct {
+		name      string
+		nonce     string
+		timestamp string
+
+		expCode int
+	}{
+		{
+			name:    "missing headers",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:      "invalid timestamp",
+			nonce:     "n1",
+			timestamp: "yesterday",
+			expCode:   http.StatusBadRequest,
+		},
+		{
+			name:      "stale timestamp",
+			nonce:     "n1",
+			timestamp: "0",
+			expCode:   http.StatusForbidden,
+		},
+		{
+			name:      "fresh request",
+			nonce:     "n1",
+			timestamp: now,
+			expCode:   http.StatusOK,
+		},
+		{
+			name:      "replayed request",
+			nonce:     "n1",
+			timestamp: now,
+			expCode:   http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "http://alertmanager.example.com/api/v2/silence/"+silID+"?"+proxyLabel+"=default", nil)
+			if tc.nonce != "" {
+				req.Header.Set(nonceHeader, tc.nonce)
+			}
+			if tc.timestamp != "" {
+				req.Header.Set(timestampHeader, tc.timestamp)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// The read-only requests don't need the headers.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com/api/v2/silences?"+proxyLabel+"=default", nil))
+	if w.Code == http.StatusBadRequest {
+		t.Fatalf("unexpected status code %d: %s", w.Code, w.Body.String())
+	}
+
+	if got := testutil.ToFloat64(r.replayGuard.rejections.WithLabelValues("missing")); got != 2 {
+		t.Fatalf("expected 2 requests rejected for missing headers, got %v", got)
+	}
+}
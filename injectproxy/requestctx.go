@@ -0,0 +1,373 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The decisions recorded in the request context by the middlewares.
+const (
+	DecisionRangeToInstant = "range_to_instant"
+	DecisionNoise          = "noise"
+	DecisionExempted       = "exempted"
+)
+
+// Decision is a decision taken by a middleware about a request.
+type Decision struct {
+	// Middleware is the name of the middleware (e.g. "downshift").
+	Middleware string
+	// Decision is what the middleware did (e.g. "range_to_instant").
+	Decision string
+}
+
+// RequestContext is the state of a request shared by the middlewares: the
+// handler, the tenants (see WithLabelValues), the priority, the query
+// fingerprint and cost, the deadline, the warnings and the decisions taken so
+// far. The instrumented mux creates one for every request and the
+// sub-requests (e.g. the split or sharded range queries) share the one of
+// their parent, so that the middlewares coordinate through its accessors
+// instead of context values of their own.
+//
+// The methods are safe for concurrent use. The accessors of a nil
+// RequestContext return zero values and its setters do nothing.
+type RequestContext struct {
+	// outcome tracks the involvement of the upstream.
+	outcome requestOutcome
+	// rangeToInstant is true when a range query has been converted into an
+	// instant query.
+	rangeToInstant atomic.Bool
+	// noise is true when noise must be added to the response.
+	noise atomic.Bool
+
+	mtx         sync.Mutex
+	handler     string
+	tenants     []string
+	priority    string
+	fingerprint string
+	cost        float64
+	deadline    time.Time
+	exemption   *Exemption
+	audit       *AuditEntry
+	decisions   []Decision
+	warnings    []string
+}
+
+func newRequestContext(handler string) *RequestContext {
+	return &RequestContext{handler: handler}
+}
+
+// ensureRequestContext returns the request context stored in ctx. If there
+// is none (e.g. the request doesn't come from the router), a new one is
+// stored in the returned context.
+func ensureRequestContext(ctx context.Context) (context.Context, *RequestContext) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return ctx, rc
+	}
+
+	rc := newRequestContext("")
+	return withRequestContext(ctx, rc), rc
+}
+
+// RequestContextFrom returns the request context stored in ctx or nil.
+func RequestContextFrom(ctx context.Context) *RequestContext {
+	rc, _ := ctx.Value(keyRequestContext).(*RequestContext)
+	return rc
+}
+
+// withRequestContext stores the request context in ctx.
+func withRequestContext(ctx context.Context, rc *RequestContext) context.Context {
+	return context.WithValue(ctx, keyRequestContext, rc)
+}
+
+// Handler returns the name of the handler serving the request (e.g. the
+// registered path).
+func (rc *RequestContext) Handler() string {
+	if rc == nil {
+		return ""
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.handler
+}
+
+func (rc *RequestContext) setHandler(handler string) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.handler = handler
+}
+
+// Tenants returns the label values enforced for the request, sorted.
+func (rc *RequestContext) Tenants() []string {
+	if rc == nil {
+		return nil
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return slices.Clone(rc.tenants)
+}
+
+func (rc *RequestContext) setTenants(tenants []string) {
+	if rc == nil {
+		return
+	}
+
+	tenants = slices.Clone(tenants)
+	sort.Strings(tenants)
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.tenants = tenants
+}
+
+// Priority returns the priority class of the request (e.g.
+// PriorityInteractive) or an empty string if unknown.
+func (rc *RequestContext) Priority() string {
+	if rc == nil {
+		return ""
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.priority
+}
+
+func (rc *RequestContext) setPriority(priority string) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.priority = priority
+}
+
+// Fingerprint returns the fingerprint of the query (see ActiveQuery) or an
+// empty string if the active queries aren't tracked.
+func (rc *RequestContext) Fingerprint() string {
+	if rc == nil {
+		return ""
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.fingerprint
+}
+
+func (rc *RequestContext) setFingerprint(fingerprint string) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.fingerprint = fingerprint
+}
+
+// Cost returns the estimated cost of the query as its number of evaluation
+// steps: 1 for an instant query and (end-start)/step+1 for a range query. It
+// returns 0 for the other requests.
+func (rc *RequestContext) Cost() float64 {
+	if rc == nil {
+		return 0
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.cost
+}
+
+func (rc *RequestContext) setCost(cost float64) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.cost = cost
+}
+
+// Deadline returns the time at which the proxy gives up on the request (see
+// WithAdaptiveTimeouts) and false if there is none.
+func (rc *RequestContext) Deadline() (time.Time, bool) {
+	if rc == nil {
+		return time.Time{}, false
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.deadline, !rc.deadline.IsZero()
+}
+
+// Remaining returns the deadline budget of the request, that is the time
+// left before its deadline, and false if there is no deadline.
+func (rc *RequestContext) Remaining(now time.Time) (time.Duration, bool) {
+	deadline, ok := rc.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return max(0, deadline.Sub(now)), true
+}
+
+// setDeadline records the deadline unless an earlier one is already set.
+func (rc *RequestContext) setDeadline(deadline time.Time) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if rc.deadline.IsZero() || deadline.Before(rc.deadline) {
+		rc.deadline = deadline
+	}
+}
+
+// Exemption returns the exemption of the request or nil.
+func (rc *RequestContext) Exemption() *Exemption {
+	if rc == nil {
+		return nil
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.exemption
+}
+
+func (rc *RequestContext) setExemption(e Exemption) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.exemption = &e
+}
+
+// auditEntry returns the audit entry of the request or nil.
+func (rc *RequestContext) auditEntry() *AuditEntry {
+	if rc == nil {
+		return nil
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.audit
+}
+
+func (rc *RequestContext) setAuditEntry(e *AuditEntry) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.audit = e
+}
+
+// Decisions returns the decisions taken so far about the request, in order.
+func (rc *RequestContext) Decisions() []Decision {
+	if rc == nil {
+		return nil
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return slices.Clone(rc.decisions)
+}
+
+// AddDecision records a decision taken by a middleware about the request.
+func (rc *RequestContext) AddDecision(middleware, decision string) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.decisions = append(rc.decisions, Decision{Middleware: middleware, Decision: decision})
+}
+
+// Warnings returns the warnings which will be added to the API response.
+func (rc *RequestContext) Warnings() []string {
+	if rc == nil {
+		return nil
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return slices.Clone(rc.warnings)
+}
+
+// AddWarning adds a warning to the API response unless it is already
+// present (e.g. when a sub-request is retried).
+func (rc *RequestContext) AddWarning(warning string) {
+	if rc == nil {
+		return
+	}
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if !slices.Contains(rc.warnings, warning) {
+		rc.warnings = append(rc.warnings, warning)
+	}
+}
+
+// queryCost returns the cost of the query (see RequestContext.Cost). The
+// form must be parsed.
+func queryCost(req *http.Request) float64 {
+	qr, err := rangeFromRequest(req)
+	if err != nil {
+		// Instant or incomplete range query.
+		return 1
+	}
+
+	return float64(qr.end.Sub(qr.start)/qr.step + 1)
+}
+
+// estimateCost records the cost of the query in the request context before
+// calling the next handler. The middlewares changing the range or the step
+// update it.
+func estimateCost(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err == nil {
+			updateCost(req)
+		}
+
+		next(w, req)
+	}
+}
+
+// updateCost records the cost of the query after its range or step changed.
+func updateCost(req *http.Request) {
+	RequestContextFrom(req.Context()).setCost(queryCost(req))
+}
+
+// outcomeFrom returns the outcome of the request stored in ctx or nil.
+func outcomeFrom(ctx context.Context) *requestOutcome {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return &rc.outcome
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRequestContext(t *testing.T) {
+	var rc *RequestContext
+	h := countOutcomes(newOutcomeCounter(prometheus.NewRegistry()), "/api/v1/query", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := WithLabelValues(req.Context(), []string{"ns1", "ns2"})
+		rc = RequestContextFrom(ctx)
+		if rc == nil {
+			t.Fatal("expected a request context, got nil")
+		}
+
+		rc.setPriority(PriorityBatch)
+		rc.setFingerprint("0123456789abcdef")
+		rc.setExemption(Exemption{ID: "e1", Tenant: "ns1"})
+		rc.AddDecision("downshift", DecisionRangeToInstant)
+		rc.AddDecision("privacy", DecisionNoise)
+		rc.setCost(61)
+		rc.setDeadline(time.Unix(20, 0))
+		rc.setDeadline(time.Unix(10, 0))
+		rc.setDeadline(time.Unix(30, 0))
+		req = withWarning(req.WithContext(ctx), "w1")
+		req = withWarning(req, "w2")
+		req = withWarning(req, "w1")
+
+		markUpstreamResponse(ctx)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query", nil))
+
+	if got := rc.Handler(); got != "/api/v1/query" {
+		t.Fatalf("expected handler %q, got %q", "/api/v1/query", got)
+	}
+	if got := rc.Tenants(); !reflect.DeepEqual(got, []string{"ns1", "ns2"}) {
+		t.Fatalf("expected tenants [ns1 ns2], got %v", got)
+	}
+	if got := rc.Priority(); got != PriorityBatch {
+		t.Fatalf("expected priority %q, got %q", PriorityBatch, got)
+	}
+	if got := rc.Fingerprint(); got != "0123456789abcdef" {
+		t.Fatalf("expected fingerprint %q, got %q", "0123456789abcdef", got)
+	}
+	if e := rc.Exemption(); e == nil || e.ID != "e1" {
+		t.Fatalf("expected exemption e1, got %v", e)
+	}
+	exp := []Decision{
+		{Middleware: "downshift", Decision: DecisionRangeToInstant},
+		{Middleware: "privacy", Decision: DecisionNoise},
+	}
+	if got := rc.Decisions(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected decisions %v, got %v", exp, got)
+	}
+	if got := rc.Cost(); got != 61 {
+		t.Fatalf("expected cost 61, got %v", got)
+	}
+	if got, ok := rc.Deadline(); !ok || !got.Equal(time.Unix(10, 0)) {
+		t.Fatalf("expected the earliest deadline, got %v", got)
+	}
+	if got, ok := rc.Remaining(time.Unix(4, 0)); !ok || got != 6*time.Second {
+		t.Fatalf("expected a remaining budget of 6s, got %v", got)
+	}
+	if got := rc.Warnings(); !reflect.DeepEqual(got, []string{"w1", "w2"}) {
+		t.Fatalf("expected warnings [w1 w2], got %v", got)
+	}
+	if got := rc.outcome.classify(http.StatusBadGateway); got != outcomeUpstreamError {
+		t.Fatalf("expected outcome %q, got %q", outcomeUpstreamError, got)
+	}
+}
+
+func TestNilRequestContext(t *testing.T) {
+	rc := RequestContextFrom(context.Background())
+	if rc != nil {
+		t.Fatalf("expected no request context, got %v", rc)
+	}
+
+	// The setters don't panic and the accessors return zero values.
+	rc.setTenants([]string{"ns1"})
+	rc.setPriority(PriorityBatch)
+	rc.setFingerprint("0123456789abcdef")
+	rc.setExemption(Exemption{ID: "e1"})
+	rc.AddDecision("privacy", DecisionNoise)
+	rc.setCost(1)
+	rc.setDeadline(time.Unix(10, 0))
+	rc.AddWarning("w1")
+	markUpstreamFailure(context.Background())
+
+	if rc.Handler() != "" || rc.Tenants() != nil || rc.Priority() != "" || rc.Fingerprint() != "" || rc.Cost() != 0 || rc.Exemption() != nil || rc.Decisions() != nil || rc.Warnings() != nil {
+		t.Fatal("expected zero values")
+	}
+	if exempted(context.Background()) {
+		t.Fatal("expected no exemption")
+	}
+	if _, ok := rc.Remaining(time.Unix(0, 0)); ok {
+		t.Fatal("expected no deadline")
+	}
+}
+
+func TestQueryCost(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params string
+		exp    float64
+	}{
+		{name: "instant query", params: "query=up&time=10", exp: 1},
+		{name: "range query", params: "query=up&start=0&end=3600&step=60", exp: 61},
+		{name: "incomplete range query", params: "query=up&start=0&end=3600", exp: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+tc.params, nil)
+			req = req.WithContext(withRequestContext(req.Context(), newRequestContext("/api/v1/query_range")))
+
+			var got float64
+			estimateCost(func(_ http.ResponseWriter, req *http.Request) {
+				got = RequestContextFrom(req.Context()).Cost()
+			})(httptest.NewRecorder(), req)
+
+			if got != tc.exp {
+				t.Fatalf("expected cost %v, got %v", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RetryConfig configures the retries of the upstream query requests.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. It doubles after
+	// every attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between 2 attempts.
+	MaxBackoff time.Duration
+	// HonorRetryAfter retries the queries throttled by the upstream (429
+	// or 503 status code with a Retry-After or rate limit reset header)
+	// after the requested delay if it doesn't exceed MaxBackoff. The
+	// throttled queries asking to wait longer aren't retried.
+	HonorRetryAfter bool
+}
+
+// WithUpstreamRetries retries the instant and range queries which failed
+// with a 5xx status code or a timeout, with an exponential backoff between
+// attempts. Other errors (e.g. connection refused) and other endpoints
+// aren't retried.
+func WithUpstreamRetries(c RetryConfig) Option {
+	return optionFunc(func(o *options) {
+		o.retryConfig = &c
+	})
+}
+
+// retryTransport retries the failed upstream query requests.
+type retryTransport struct {
+	next   http.RoundTripper
+	config RetryConfig
+	limits BodyBufferLimits
+
+	retries *prometheus.CounterVec
+}
+
+func newRetryTransport(next http.RoundTripper, c RetryConfig, limits BodyBufferLimits, reg prometheus.Registerer) *retryTransport {
+	return &retryTransport{
+		next:   next,
+		config: c,
+		limits: limits,
+		retries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_retries_total",
+			Help: "Total number of upstream requests retried, partitioned by handler.",
+		}, []string{"handler"}),
+	}
+}
+
+// isQueryPath returns true if the upstream path is an instant or range
+// query endpoint.
+func isQueryPath(p string) bool {
+	return strings.HasSuffix(p, "/api/v1/query") || strings.HasSuffix(p, "/api/v1/query_range")
+}
+
+// isRetryable returns true if the upstream failure is transient.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var nerr net.Error
+		return errors.As(err, &nerr) && nerr.Timeout()
+	}
+
+	return resp.StatusCode >= 500
+}
+
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.config.InitialBackoff << (attempt - 1)
+	if d <= 0 || d > t.config.MaxBackoff {
+		return t.config.MaxBackoff
+	}
+
+	return d
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.config.MaxAttempts <= 1 || !isQueryPath(req.URL.Path) {
+		return t.next.RoundTrip(req)
+	}
+
+	// Buffer the body to replay it on every attempt.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := t.limits.bufferBody(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		defer body.Close()
+
+		req = req.Clone(req.Context())
+		req.GetBody = body.Open
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+
+		retryable, delay := isRetryable(resp, err), t.backoff(attempt)
+		if t.config.HonorRetryAfter && err == nil {
+			if retryAfter, throttled := upstreamThrottling(resp, time.Now()); throttled {
+				retryable = retryAfter <= t.config.MaxBackoff
+				delay = max(delay, retryAfter)
+			}
+		}
+
+		if attempt >= t.config.MaxAttempts || !retryable || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		t.retries.WithLabelValues(handlerName(req.Context())).Inc()
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		failures int
+		status   int
+
+		expCode  int
+		expCalls int
+	}{
+		{
+			name:     "success after retries",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			failures: 2,
+			status:   http.StatusServiceUnavailable,
+			expCode:  http.StatusOK,
+			expCalls: 3,
+		},
+		{
+			name:     "POST body is replayed",
+			method:   http.MethodPost,
+			url:      "http://prometheus.example.com/api/v1/query_range",
+			body:     "query=up&namespace=ns1&start=0&end=1&step=1",
+			failures: 2,
+			status:   http.StatusInternalServerError,
+			expCode:  http.StatusOK,
+			expCalls: 3,
+		},
+		{
+			name:     "too many failures",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			failures: 3,
+			status:   http.StatusBadGateway,
+			expCode:  http.StatusBadGateway,
+			expCalls: 3,
+		},
+		{
+			name:     "client errors aren't retried",
+			url:      "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			failures: 1,
+			status:   http.StatusBadRequest,
+			expCode:  http.StatusBadRequest,
+			expCalls: 1,
+		},
+		{
+			name:     "other endpoints aren't retried",
+			url:      "http://prometheus.example.com/api/v1/series?match[]=up&namespace=ns1",
+			failures: 1,
+			status:   http.StatusServiceUnavailable,
+			expCode:  http.StatusServiceUnavailable,
+			expCalls: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				calls++
+				if err := req.ParseForm(); err != nil || req.Form.Get("query") == "" && req.Form.Get("match[]") == "" {
+					t.Errorf("missing query parameters in %q", req.Form.Encode())
+				}
+
+				if calls <= tc.failures {
+					w.WriteHeader(tc.status)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithUpstreamRetries(RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tc.url, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, w.Code)
+			}
+
+			if calls != tc.expCalls {
+				t.Fatalf("expected %d upstream calls, got %d", tc.expCalls, calls)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetriesRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		honor      bool
+		status     int
+		retryAfter string
+
+		expCode  int
+		expCalls int
+	}{
+		{
+			name:       "throttled query is retried",
+			honor:      true,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "0",
+			expCode:    http.StatusOK,
+			expCalls:   2,
+		},
+		{
+			name:       "throttled query isn't retried by default",
+			status:     http.StatusTooManyRequests,
+			retryAfter: "0",
+			expCode:    http.StatusTooManyRequests,
+			expCalls:   1,
+		},
+		{
+			name:       "delay longer than the maximum backoff",
+			honor:      true,
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "60",
+			expCode:    http.StatusServiceUnavailable,
+			expCalls:   1,
+		},
+		{
+			name:     "no throttling header",
+			honor:    true,
+			status:   http.StatusServiceUnavailable,
+			expCode:  http.StatusOK,
+			expCalls: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				calls++
+				if calls == 1 {
+					if tc.retryAfter != "" {
+						w.Header().Set("Retry-After", tc.retryAfter)
+					}
+					w.WriteHeader(tc.status)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithUpstreamRetries(RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, HonorRetryAfter: tc.honor}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, w.Code)
+			}
+
+			if calls != tc.expCalls {
+				t.Fatalf("expected %d upstream calls, got %d", tc.expCalls, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// QueryRewriteRule replaces the sub-expressions of the queries matching a
+// pattern.
+type QueryRewriteRule struct {
+	// Name identifies the rule in the metrics.
+	Name string `yaml:"name"`
+	// Match is a regular expression matched against the sub-expressions
+	// of the query, as formatted by Prometheus (e.g. "sum by (job)
+	// (rate(http_requests_total[5m]))"). It is anchored.
+	Match string `yaml:"match"`
+	// Replacement is a text/template producing the PromQL expression
+	// replacing the matched sub-expression. The named groups of Match are
+	// available as fields (e.g. {{ .range }}).
+	Replacement string `yaml:"replacement"`
+}
+
+// QueryRewriteRules is the configuration of the query rewriting.
+type QueryRewriteRules struct {
+	Rules []QueryRewriteRule `yaml:"rules"`
+}
+
+// LoadQueryRewriteRules reads the query rewrite rules from a YAML file. For
+// example:
+//
+//	rules:
+//	  - name: http-requests-rate
+//	    match: 'sum by \(job\) \(rate\(http_requests_total\[(?P<range>1m|5m)\]\)\)'
+//	    replacement: 'job:http_requests:rate{{ .range }}'
+func LoadQueryRewriteRules(path string) (QueryRewriteRules, error) {
+	var rules QueryRewriteRules
+
+	f, err := os.Open(path)
+	if err != nil {
+		return rules, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return rules, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if _, err := compileRewriteRules(rules); err != nil {
+		return rules, fmt.Errorf("invalid rewrite rules in %s: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+// WithQueryRewriteRules rewrites the expression of the instant and range
+// queries before enforcing the label, e.g. to replace expensive expressions
+// with the equivalent recording rules. The sub-expressions are matched from
+// the root of the query: the first rule matching a sub-expression replaces
+// it and the replacement isn't rewritten again. The range selectors are
+// matched as a whole.
+func WithQueryRewriteRules(rules QueryRewriteRules) Option {
+	return optionFunc(func(o *options) {
+		o.rewriteRules = &rules
+	})
+}
+
+type rewriteRule struct {
+	name        string
+	match       *regexp.Regexp
+	replacement *texttemplate.Template
+}
+
+func compileRewriteRules(rules QueryRewriteRules) ([]rewriteRule, error) {
+	compiled := make([]rewriteRule, 0, len(rules.Rules))
+	for i, r := range rules.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i)
+		}
+
+		if r.Match == "" {
+			return nil, fmt.Errorf("%s: empty match", name)
+		}
+		re, err := regexp.Compile("^(?:" + r.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid match: %w", name, err)
+		}
+
+		tmpl, err := texttemplate.New(name).Option("missingkey=error").Parse(r.Replacement)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid replacement: %w", name, err)
+		}
+
+		compiled = append(compiled, rewriteRule{name: name, match: re, replacement: tmpl})
+	}
+
+	return compiled, nil
+}
+
+type queryRewriter struct {
+	rules    []rewriteRule
+	rewrites *prometheus.CounterVec
+	failures *prometheus.CounterVec
+}
+
+func newQueryRewriter(rules QueryRewriteRules, reg prometheus.Registerer) (*queryRewriter, error) {
+	compiled, err := compileRewriteRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queryRewriter{
+		rules: compiled,
+		rewrites: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_rewrites_total",
+			Help: "Total number of sub-expressions rewritten, partitioned by rule.",
+		}, []string{"rule"}),
+		failures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_rewrite_failures_total",
+			Help: "Total number of sub-expressions matching a rule whose replacement isn't a valid expression of the same type, partitioned by rule.",
+		}, []string{"rule"}),
+	}, nil
+}
+
+// replace returns the replacement of the expression by the first matching
+// rule or nil.
+func (rw *queryRewriter) replace(e parser.Expr) parser.Expr {
+	s := e.String()
+	for _, rule := range rw.rules {
+		m := rule.match.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+
+		data := map[string]string{}
+		for i, name := range rule.match.SubexpNames() {
+			if name != "" {
+				data[name] = m[i]
+			}
+		}
+
+		var sb strings.Builder
+		if err := rule.replacement.Execute(&sb, data); err != nil {
+			rw.failures.WithLabelValues(rule.name).Inc()
+			continue
+		}
+
+		re, err := parser.ParseExpr(sb.String())
+		if err != nil || re.Type() != e.Type() {
+			rw.failures.WithLabelValues(rule.name).Inc()
+			continue
+		}
+
+		rw.rewrites.WithLabelValues(rule.name).Inc()
+		return re
+	}
+
+	return nil
+}
+
+// rewrite returns the rewritten expression.
+func (rw *queryRewriter) rewrite(e parser.Expr) parser.Expr {
+	if re := rw.replace(e); re != nil {
+		return re
+	}
+
+	switch n := e.(type) {
+	case *parser.AggregateExpr:
+		n.Expr = rw.rewrite(n.Expr)
+		if n.Param != nil {
+			n.Param = rw.rewrite(n.Param)
+		}
+	case *parser.BinaryExpr:
+		n.LHS = rw.rewrite(n.LHS)
+		n.RHS = rw.rewrite(n.RHS)
+	case *parser.Call:
+		for i, arg := range n.Args {
+			n.Args[i] = rw.rewrite(arg)
+		}
+	case *parser.ParenExpr:
+		n.Expr = rw.rewrite(n.Expr)
+	case *parser.SubqueryExpr:
+		n.Expr = rw.rewrite(n.Expr)
+	case *parser.UnaryExpr:
+		n.Expr = rw.rewrite(n.Expr)
+	case *parser.StepInvariantExpr:
+		n.Expr = rw.rewrite(n.Expr)
+	}
+
+	return e
+}
+
+// rewriteQueries applies the rewrite rules to the query expression.
+func (r *routes) rewriteQueries(next http.HandlerFunc) http.HandlerFunc {
+	if r.rewriter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		expr, err := parser.ParseExpr(req.Form.Get(queryParam))
+		if err != nil {
+			// Let the enforcer reject the invalid queries.
+			next(w, req)
+			return
+		}
+
+		orig := expr.String()
+		if rewritten := r.rewriter.rewrite(expr).String(); rewritten != orig {
+			setParam(req, queryParam, rewritten)
+		}
+
+		next(w, req)
+	}
+}
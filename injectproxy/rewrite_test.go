@@ -0,0 +1,206 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestLoadQueryRewriteRules(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		exp    QueryRewriteRules
+		expErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "rules",
+			content: `
+rules:
+  - name: recording-rule
+    match: 'sum\(rate\(foo\[5m\]\)\)'
+    replacement: 'job:foo:rate5m'
+`,
+			exp: QueryRewriteRules{Rules: []QueryRewriteRule{{Name: "recording-rule", Match: `sum\(rate\(foo\[5m\]\)\)`, Replacement: "job:foo:rate5m"}}},
+		},
+		{
+			name:    "unknown field",
+			content: "rules: [{name: a, match: a, replace: b}]",
+			expErr:  true,
+		},
+		{
+			name:    "invalid match",
+			content: "rules: [{name: a, match: '(', replacement: b}]",
+			expErr:  true,
+		},
+		{
+			name:    "invalid replacement",
+			content: "rules: [{name: a, match: a, replacement: '{{ .a'}]",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := LoadQueryRewriteRules(path)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(rules, tc.exp) {
+				t.Fatalf("expected %+v, got %+v", tc.exp, rules)
+			}
+		})
+	}
+}
+
+func TestQueryRewriter(t *testing.T) {
+	rules := QueryRewriteRules{Rules: []QueryRewriteRule{
+		{
+			Name:        "recording-rule",
+			Match:       `sum by \(job\) \(rate\(http_requests_total\[(?P<range>1m|5m)\]\)\)`,
+			Replacement: "job:http_requests:rate{{ .range }}",
+		},
+		{
+			Name:        "rate",
+			Match:       `(?P<counter>[a-z_]+_total)`,
+			Replacement: "rate({{ .counter }}[5m])",
+		},
+		{
+			Name:        "wrong-type",
+			Match:       `up`,
+			Replacement: `"up"`,
+		},
+	}}
+
+	for _, tc := range []struct {
+		query string
+
+		exp         string
+		expRewrites map[string]float64
+	}{
+		{
+			query:       "sum by (job) (rate(http_requests_total[5m])) > 1",
+			exp:         "job:http_requests:rate5m > 1",
+			expRewrites: map[string]float64{"recording-rule": 1},
+		},
+		{
+			query: "sum by (job) (rate(http_requests_total[10m]))",
+			exp:   "sum by (job) (rate(http_requests_total[10m]))",
+		},
+		{
+			query:       "sum(errors_total) / sum(requests_total)",
+			exp:         "sum(rate(errors_total[5m])) / sum(rate(requests_total[5m]))",
+			expRewrites: map[string]float64{"rate": 2},
+		},
+		{
+			query:       "up",
+			exp:         "up",
+			expRewrites: map[string]float64{"wrong-type": 0},
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			rw, err := newQueryRewriter(rules, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expr, err := parser.ParseExpr(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := rw.rewrite(expr).String(); got != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+
+			for rule, exp := range tc.expRewrites {
+				if got := testutil.ToFloat64(rw.rewrites.WithLabelValues(rule)); got != exp {
+					t.Fatalf("%s: expected %v rewrites, got %v", rule, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryRewriteRoutes(t *testing.T) {
+	var got string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		got = req.Form.Get("query")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryRewriteRules(QueryRewriteRules{Rules: []QueryRewriteRule{{Match: `sum\(rate\(foo\[5m\]\)\)`, Replacement: "sum(foo:rate5m)"}}}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		params := url.Values{"query": []string{"sum(rate(foo[5m]))"}, proxyLabel: []string{"ns1"}}
+
+		var req *http.Request
+		if method == http.MethodPost {
+			req = httptest.NewRequest(method, "http://prometheus.example.com/api/v1/query", strings.NewReader(params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, "http://prometheus.example.com/api/v1/query?"+params.Encode(), nil)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code %d, got %d", method, http.StatusOK, w.Code)
+		}
+
+		// The label is enforced on the rewritten query.
+		if exp := `sum(foo:rate5m{namespace="ns1"})`; got != exp {
+			t.Fatalf("%s: expected query %q, got %q", method, exp, got)
+		}
+	}
+
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryRewriteRules(QueryRewriteRules{Rules: []QueryRewriteRule{{Match: "("}}})); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
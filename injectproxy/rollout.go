@@ -0,0 +1,151 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The rules which can be rolled out gradually.
+const (
+	RuleLatencyBudget    = "latency-budget"
+	RuleFederationLimits = "federation-limits"
+	RuleMaxPoints        = "max-points"
+	RuleRangeToInstant   = "range-to-instant"
+	RuleStepPolicy       = "step-policy"
+)
+
+var rolloutRules = []string{RuleLatencyBudget, RuleFederationLimits, RuleMaxPoints, RuleRangeToInstant, RuleStepPolicy}
+
+// Rollout enables rules for a subset of the tenants only.
+type Rollout struct {
+	// Rules are the names of the rules being rolled out. The other rules
+	// apply to all the requests.
+	Rules []string
+	// Percentage is the share of the tenants (between 0 and 100) for which
+	// the rules are enforced. A given tenant is always in the same cohort.
+	Percentage float64
+	// Tenants are pilot tenants for which the rules are always enforced.
+	Tenants []string
+}
+
+// WithEnforcementRollout enables the given rules for a percentage of the
+// tenants and the pilot tenants only. The tenants are assigned to a cohort
+// by hashing their label values. The rules are enforced for the requests
+// with several label values only when all of them are enabled.
+//
+// The rollout_requests_total metric counts the requests by rule, cohort and
+// status code to compare the cohorts.
+func WithEnforcementRollout(ro Rollout) Option {
+	return optionFunc(func(o *options) {
+		o.rollout = &ro
+	})
+}
+
+// rollout decides which rules apply to a request.
+type rollout struct {
+	rules     map[string]struct{}
+	threshold uint32
+	pilots    map[string]struct{}
+
+	requests *prometheus.CounterVec
+}
+
+// rolloutBuckets is the granularity of the percentage.
+const rolloutBuckets = 10000
+
+func newRollout(ro Rollout, reg prometheus.Registerer) (*rollout, error) {
+	if ro.Percentage < 0 || ro.Percentage > 100 {
+		return nil, fmt.Errorf("rollout percentage must be between 0 and 100, got %v", ro.Percentage)
+	}
+
+	rules := make(map[string]struct{}, len(ro.Rules))
+	for _, name := range ro.Rules {
+		known := false
+		for _, r := range rolloutRules {
+			known = known || r == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown rule %q, must be one of %s", name, strings.Join(rolloutRules, ", "))
+		}
+		rules[name] = struct{}{}
+	}
+
+	pilots := make(map[string]struct{}, len(ro.Tenants))
+	for _, t := range ro.Tenants {
+		pilots[t] = struct{}{}
+	}
+
+	return &rollout{
+		rules:     rules,
+		threshold: uint32(ro.Percentage * rolloutBuckets / 100),
+		pilots:    pilots,
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "rollout_requests_total",
+			Help: "Total number of requests subject to a rule being rolled out, partitioned by rule, cohort (enabled or disabled) and status code.",
+		}, []string{"rule", "cohort", "code"}),
+	}, nil
+}
+
+// enabled returns whether the rules being rolled out apply to the given
+// tenants.
+func (ro *rollout) enabled(tenants []string) bool {
+	if len(tenants) == 0 {
+		return false
+	}
+
+	for _, t := range tenants {
+		if _, found := ro.pilots[t]; found {
+			continue
+		}
+
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(t))
+		if h.Sum32()%rolloutBuckets >= ro.threshold {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rollOut returns the enforced handler when the rule isn't being rolled out.
+// Otherwise it dispatches the requests of the enabled tenants to the
+// enforced handler and the others to the skipped handler.
+func (r *routes) rollOut(rule string, enforced, skipped http.HandlerFunc) http.HandlerFunc {
+	if r.rollout == nil {
+		return enforced
+	}
+	if _, found := r.rollout.rules[rule]; !found {
+		return enforced
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		next, cohort := skipped, "disabled"
+		if r.rollout.enabled(MustLabelValues(req.Context())) {
+			next, cohort = enforced, "enabled"
+		}
+
+		rec := newStatusRecorder(w)
+		next(rec, req)
+		r.rollout.requests.WithLabelValues(rule, cohort, strconv.Itoa(rec.status)).Inc()
+	}
+}
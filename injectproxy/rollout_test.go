@@ -0,0 +1,148 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRolloutEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rollout Rollout
+		tenants []string
+
+		exp bool
+	}{
+		{
+			name:    "no rollout",
+			rollout: Rollout{},
+			tenants: []string{"ns1"},
+		},
+		{
+			name:    "full rollout",
+			rollout: Rollout{Percentage: 100},
+			tenants: []string{"ns1", "ns2"},
+			exp:     true,
+		},
+		{
+			name:    "pilot tenant",
+			rollout: Rollout{Tenants: []string{"ns1"}},
+			tenants: []string{"ns1"},
+			exp:     true,
+		},
+		{
+			name:    "pilot and other tenants",
+			rollout: Rollout{Tenants: []string{"ns1"}},
+			tenants: []string{"ns1", "ns2"},
+		},
+		{
+			name:    "no tenant",
+			rollout: Rollout{Percentage: 100},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ro, err := newRollout(tc.rollout, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := ro.enabled(tc.tenants); got != tc.exp {
+				t.Fatalf("expected %v, got %v", tc.exp, got)
+			}
+		})
+	}
+
+	// The cohorts are stable and sized by the percentage.
+	ro, err := newRollout(Rollout{Percentage: 25}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var n int
+	for i := 0; i < 1000; i++ {
+		tenant := []string{fmt.Sprintf("tenant-%d", i)}
+		got := ro.enabled(tenant)
+		if got != ro.enabled(tenant) {
+			t.Fatalf("%s: expected a stable cohort", tenant)
+		}
+		if got {
+			n++
+		}
+	}
+	if n < 200 || n > 300 {
+		t.Fatalf("expected about 250 enabled tenants, got %d", n)
+	}
+}
+
+func TestNewRolloutErrors(t *testing.T) {
+	for _, ro := range []Rollout{
+		{Percentage: -1},
+		{Percentage: 101},
+		{Rules: []string{"unknown"}},
+	} {
+		if _, err := newRollout(ro, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("%+v: expected error, got nil", ro)
+		}
+	}
+}
+
+func TestEnforcementRollout(t *testing.T) {
+	var gotStep string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotStep = req.URL.Query().Get("step")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithMaxPointsPerSeries(101),
+		WithEnforcementRollout(Rollout{Rules: []string{RuleMaxPoints}, Tenants: []string{"pilot"}}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		tenant  string
+		expStep string
+	}{
+		{tenant: "pilot", expStep: "10"},
+		{tenant: "other", expStep: "1"},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?query=up&start=0&end=1000&step=1&namespace="+tc.tenant, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code %d, got %d", tc.tenant, http.StatusOK, w.Code)
+		}
+		if gotStep != tc.expStep {
+			t.Fatalf("%s: expected step %q, got %q", tc.tenant, tc.expStep, gotStep)
+		}
+	}
+
+	for _, cohort := range []string{"enabled", "disabled"} {
+		if got := testutil.ToFloat64(r.rollout.requests.WithLabelValues(RuleMaxPoints, cohort, "200")); got != 1 {
+			t.Fatalf("expected 1 %s request, got %v", cohort, got)
+		}
+	}
+}
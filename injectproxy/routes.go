@@ -18,14 +18,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
-	"sort"
 	"strings"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
 
 	"github.com/efficientgo/core/merrors"
 	"github.com/metalmatze/signal/server/signalhttp"
@@ -50,17 +53,147 @@ type routes struct {
 	errorOnReplace        bool
 	regexMatch            bool
 	rulesWithActiveAlerts bool
+	authorizers           []Authorizer
+	subjectHeader         string
+	profilingLabels       bool
+	budgeter              *latencyBudgeter
+	cache                 *responseCache
+	cacheTTLs             map[string]time.Duration
+	cacheMetrics          *cacheMetrics
+	cacheStore            *storeCache
+	cacheSnapshotPath     string
+	exemptions            *exemptionChecker
+	upstreamDetector      *UpstreamDetector
+	stepRaiser            *stepRaiser
+	stepPolicy            *stepPolicy
+	resolutionSelector    *resolutionSelector
+	blocklist             *queryBlocklist
+	allowlist             *queryAllowlist
+	memoizer              *queryMemoizer
+	federationLimiter     *federationLimiter
+	rangeConversions      *prometheus.CounterVec
+	htmlErrorTemplate     *htmltemplate.Template
+	jsonErrorTemplate     *texttemplate.Template
+	bodyLimits            BodyBufferLimits
+	rateLimiter           *tenantRateLimiter
+	responseHeaders       []ResponseHeader
+	decisionHeaders       bool
+	onboarder             *tenantOnboarder
+	rollout               *rollout
+	coalescer             *queryCoalescer
+	activeQueries         *ActiveQueryTracker
+	scheduler             *queryScheduler
+	shedder               *loadShedder
+	rewriter              *queryRewriter
+	privacy               *privacyFilter
+	postAggregator        *postAggregator
+	classifier            *queryClassifier
+	lookbackLimiter       *lookbackLimiter
+	slowQueries           *slowQueryLog
+	disabledTenants       *DisabledTenants
+	disabledRejections    prometheus.Counter
+	auditSink             AuditSink
+	effectiveQuery        EffectiveQueryAnnotation
+	mirror                *mirroringTransport
+	splitter              *rangeSplitter
+	replayGuard           *replayGuard
+	sharder               *querySharder
+	validator             *responseValidator
+	selectorLimiter       *selectorLimiter
+	concurrencyLimiter    *concurrencyLimiter
+	calendar              *calendarSnapper
+	timeouter             *adaptiveTimeouter
+	handoff               *limitHandoff
+	limitCheckpointPath   string
+	draining              atomic.Bool
+	strict                *strictValidator
+	pacer                 *requestPacer
+	watermark             *watermarker
+	verifier              *requestVerifier
+	prewarmer             *connectionPrewarmer
+	queryOptions          *queryOptionRestrictor
+	exporter              *exporter
 
 	logger *log.Logger
 }
 
 type options struct {
-	enableLabelAPIs       bool
-	passthroughPaths      []string
-	errorOnReplace        bool
-	registerer            prometheus.Registerer
-	regexMatch            bool
-	rulesWithActiveAlerts bool
+	enableLabelAPIs         bool
+	enableConnectAPI        bool
+	htmlErrorTemplate       *htmltemplate.Template
+	jsonErrorTemplate       *texttemplate.Template
+	passthroughPaths        []string
+	errorOnReplace          bool
+	registerer              prometheus.Registerer
+	regexMatch              bool
+	rulesWithActiveAlerts   bool
+	authorizers             []Authorizer
+	subjectHeader           string
+	profilingLabels         bool
+	latencyObjective        time.Duration
+	latencyBudgets          *LatencyBudgets
+	cacheTTLs               map[string]time.Duration
+	cacheMaxBytes           int64
+	cacheStore              StateStore
+	cacheEncoding           CacheEncoding
+	maxPointsPerSeries      int
+	memoRules               []QueryMemoization
+	eventSink               EventSink
+	federationLimits        *FederationLimits
+	retryConfig             *RetryConfig
+	clientFingerprint       *ClientFingerprint
+	rangeToInstant          bool
+	circuitBreaker          *CircuitBreakerConfig
+	bodyLimits              BodyBufferLimits
+	tenantRateLimits        *TenantRateLimits
+	upstreamResolution      *UpstreamResolution
+	responseHeaders         []ResponseHeader
+	decisionHeaders         bool
+	hedgingDelay            time.Duration
+	onboardingStore         StateStore
+	rollout                 *Rollout
+	queryCoalescing         bool
+	activeQueries           *ActiveQueryTracker
+	queryQueue              *QueryQueue
+	loadShedding            *LoadShedding
+	rewriteRules            *QueryRewriteRules
+	aggregateOnly           *AggregateOnlyTenants
+	postAggregation         *PostAggregation
+	classificationCacheSize int
+	maxLookback             *MaxLookback
+	stepPolicy              *StepPolicy
+	downsampling            *Downsampling
+	blocklist               *QueryBlocklist
+	allowlist               *QueryAllowlist
+	slowQueryThreshold      time.Duration
+	slowQueryLogger         *log.Logger
+	disabledTenants         *DisabledTenants
+	auditSink               AuditSink
+	effectiveQuery          EffectiveQueryAnnotation
+	shadowUpstream          *ShadowUpstream
+	rangeSplitting          *RangeSplitting
+	replayWindow            time.Duration
+	querySharding           *QuerySharding
+	responseValidation      bool
+	selectorLimits          *SelectorLimits
+	concurrencyLimit        *ConcurrencyLimit
+	calendarSnapping        *CalendarSnapping
+	adaptiveTimeouts        *AdaptiveTimeouts
+	handoffStore            StateStore
+	handoffTTL              time.Duration
+	limitCheckpointPath     string
+	limitCheckpointMaxAge   time.Duration
+	strictRequests          *StrictRequests
+	requestPacing           *RequestPacing
+	watermark               *Watermark
+	upstreamSigning         *RequestSigning
+	requestVerification     *RequestSigning
+	cacheSnapshotPath       string
+	exemptionTokens         *ExemptionTokens
+	upstreamDetector        *UpstreamDetector
+	connectionPrewarming    *ConnectionPrewarming
+	queryOptionPolicies     *QueryOptionPolicies
+	bulkExports             *BulkExports
 }
 
 type Option interface {
@@ -159,6 +292,7 @@ func (s *strictMux) Handle(pattern string, handler http.Handler) error {
 		}
 	}
 
+	handler = withHandlerName(sanitized, handler)
 	s.mux.Handle(sanitized, handler)
 	s.mux.Handle(sanitized+"/", handler)
 	s.seen[sanitized] = struct{}{}
@@ -169,19 +303,23 @@ func (s *strictMux) Handle(pattern string, handler http.Handler) error {
 // instrumentedMux wraps a mux and instruments it.
 type instrumentedMux struct {
 	mux
-	i signalhttp.HandlerInstrumenter
+	i          signalhttp.HandlerInstrumenter
+	outcomes   *prometheus.CounterVec
+	rejections *prometheus.CounterVec
 }
 
 func newInstrumentedMux(m mux, r prometheus.Registerer) *instrumentedMux {
 	return &instrumentedMux{
 		m,
 		signalhttp.NewHandlerInstrumenter(r, []string{"handler"}),
+		newOutcomeCounter(r),
+		newRejectionCounter(r),
 	}
 }
 
 // Handle implements the mux interface.
 func (i *instrumentedMux) Handle(pattern string, handler http.Handler) {
-	i.mux.Handle(pattern, i.i.NewHandler(prometheus.Labels{"handler": pattern}, handler))
+	i.mux.Handle(pattern, i.i.NewHandler(prometheus.Labels{"handler": pattern}, countOutcomes(i.outcomes, pattern, countRejections(i.rejections, pattern, handler))))
 }
 
 // ExtractLabeler is an HTTP handler that extract the label value to be
@@ -202,7 +340,7 @@ func (hff HTTPFormEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		labelValues, err := hff.getLabelValues(r)
 		if err != nil {
-			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+			rejectRequest(w, ReasonInvalidTenant, humanFriendlyErrorMessage(err), http.StatusBadRequest)
 			return
 		}
 
@@ -256,7 +394,7 @@ func (hhe HTTPHeaderEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		labelValues, err := hhe.getLabelValues(r)
 		if err != nil {
-			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+			rejectRequest(w, ReasonInvalidTenant, humanFriendlyErrorMessage(err), http.StatusBadRequest)
 			return
 		}
 
@@ -291,7 +429,10 @@ func (sle StaticLabelEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler
 }
 
 func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, opts ...Option) (*routes, error) {
-	opt := options{}
+	opt := options{
+		htmlErrorTemplate: defaultHTMLErrorTemplate,
+		jsonErrorTemplate: defaultJSONErrorTemplate,
+	}
 	for _, o := range opts {
 		o.apply(&opt)
 	}
@@ -301,6 +442,54 @@ func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, o
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	var transport http.RoundTripper = http.DefaultTransport
+	var prewarmer *connectionPrewarmer
+	if opt.upstreamResolution != nil || opt.connectionPrewarming != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if opt.upstreamResolution != nil {
+			t.DialContext = newUpstreamDialer(*opt.upstreamResolution, opt.registerer).DialContext
+		}
+		if opt.connectionPrewarming != nil {
+			var err error
+			prewarmer, err = newConnectionPrewarmer(*opt.connectionPrewarming, upstream, opt.registerer)
+			if err != nil {
+				return nil, err
+			}
+			prewarmer.configure(t)
+		}
+		transport = t
+	}
+	if opt.hedgingDelay > 0 {
+		transport = newHedgingTransport(transport, opt.hedgingDelay, opt.bodyLimits, opt.registerer)
+	}
+	if opt.retryConfig != nil {
+		transport = newRetryTransport(transport, *opt.retryConfig, opt.bodyLimits, opt.registerer)
+	}
+	if opt.circuitBreaker != nil {
+		cb := newCircuitBreaker(transport, *opt.circuitBreaker, opt.eventSink, opt.registerer)
+		if prewarmer != nil {
+			// The connections were lost with the upstream outage.
+			cb.onClose = prewarmer.prewarmInBackground
+		}
+		transport = cb
+	}
+	if opt.upstreamSigning != nil {
+		t, err := newSigningTransport(transport, *opt.upstreamSigning)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+	var mirror *mirroringTransport
+	if opt.shadowUpstream != nil {
+		var err error
+		mirror, err = newMirroringTransport(transport, http.DefaultTransport, upstream, *opt.shadowUpstream, opt.bodyLimits, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		transport = mirror
+	}
+	proxy.Transport = transport
 
 	r := &routes{
 		upstream:              upstream,
@@ -310,50 +499,427 @@ func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, o
 		errorOnReplace:        opt.errorOnReplace,
 		regexMatch:            opt.regexMatch,
 		rulesWithActiveAlerts: opt.rulesWithActiveAlerts,
+		authorizers:           opt.authorizers,
+		subjectHeader:         opt.subjectHeader,
+		profilingLabels:       opt.profilingLabels,
+		htmlErrorTemplate:     opt.htmlErrorTemplate,
+		jsonErrorTemplate:     opt.jsonErrorTemplate,
+		bodyLimits:            opt.bodyLimits,
+		responseHeaders:       opt.responseHeaders,
+		decisionHeaders:       opt.decisionHeaders,
+		activeQueries:         opt.activeQueries,
+		auditSink:             opt.auditSink,
+		effectiveQuery:        opt.effectiveQuery,
+		mirror:                mirror,
+		prewarmer:             prewarmer,
 		logger:                log.Default(),
 	}
-	mux := newStrictMux(newInstrumentedMux(http.NewServeMux(), opt.registerer))
+	var m mux = newInstrumentedMux(http.NewServeMux(), opt.registerer)
+	m = newRecoveryMux(m, opt.registerer, r.logger)
+	if opt.clientFingerprint != nil {
+		m = newClientMux(m, opt.registerer, *opt.clientFingerprint)
+	}
+	if opt.latencyObjective > 0 {
+		m = newSLOMux(m, opt.registerer, opt.latencyObjective)
+	}
+	if opt.profilingLabels {
+		m = &profiledMux{m}
+	}
+	mux := newStrictMux(m)
+
+	if len(opt.cacheTTLs) > 0 {
+		r.cache = newResponseCache(defaultCacheMaxEntries)
+		r.cache.maxBytes = opt.cacheMaxBytes
+		r.cacheTTLs = opt.cacheTTLs
+		r.cacheMetrics = newCacheMetrics(opt.registerer)
+		if opt.cacheStore != nil {
+			codec, err := newCacheCodec(opt.cacheEncoding)
+			if err != nil {
+				return nil, err
+			}
+			r.cacheStore = newStoreCache(opt.cacheStore, codec, opt.registerer)
+		}
+	}
+
+	if opt.cacheSnapshotPath != "" {
+		if r.cache == nil || r.cacheStore != nil {
+			return nil, errCacheSnapshotWithoutCache
+		}
+
+		r.cacheSnapshotPath = opt.cacheSnapshotPath
+		if err := r.loadCacheSnapshot(); err != nil {
+			// Not fatal: the cache is filled again.
+			r.logger.Printf("failed to load the cache snapshot: %v", err)
+		}
+	}
+
+	if opt.maxPointsPerSeries != 0 {
+		s, err := newStepRaiser(opt.maxPointsPerSeries, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.stepRaiser = s
+	}
+
+	if opt.downsampling != nil {
+		s, err := newResolutionSelector(*opt.downsampling, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.resolutionSelector = s
+	}
+
+	if opt.stepPolicy != nil {
+		p, err := newStepPolicy(*opt.stepPolicy, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.stepPolicy = p
+	}
+
+	if opt.adaptiveTimeouts != nil {
+		t, err := newAdaptiveTimeouter(*opt.adaptiveTimeouts, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.timeouter = t
+	}
+
+	if opt.strictRequests != nil {
+		s, err := newStrictValidator(*opt.strictRequests, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.strict = s
+	}
+
+	if opt.requestVerification != nil {
+		v, err := newRequestVerifier(*opt.requestVerification, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.verifier = v
+	}
+
+	if opt.watermark != nil {
+		wm, err := newWatermarker(*opt.watermark, label, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.watermark = wm
+	}
+
+	if opt.requestPacing != nil {
+		p, err := newRequestPacer(*opt.requestPacing, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.pacer = p
+	}
+
+	if opt.calendarSnapping != nil {
+		r.calendar = newCalendarSnapper(*opt.calendarSnapping, opt.registerer)
+	}
+
+	if len(opt.memoRules) > 0 {
+		r.memoizer = newQueryMemoizer(opt.memoRules, opt.registerer)
+	}
+
+	if opt.rangeToInstant {
+		r.rangeConversions = newRangeConversions(opt.registerer)
+	}
+
+	if opt.tenantRateLimits != nil {
+		r.rateLimiter = newTenantRateLimiter(*opt.tenantRateLimits, opt.registerer)
+	}
+
+	if opt.federationLimits != nil {
+		r.federationLimiter = newFederationLimiter(*opt.federationLimits, opt.registerer)
+	}
+
+	if opt.onboardingStore != nil {
+		r.onboarder = newTenantOnboarder(opt.onboardingStore, opt.eventSink, opt.registerer)
+	}
+
+	if opt.latencyBudgets != nil {
+		b, err := newLatencyBudgeter(*opt.latencyBudgets, opt.eventSink, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.budgeter = b
+	}
+
+	if opt.limitCheckpointPath != "" {
+		if r.budgeter == nil {
+			return nil, errCheckpointWithoutBudgets
+		}
+		if opt.limitCheckpointMaxAge <= 0 {
+			return nil, fmt.Errorf("the maximum age of the limit checkpoint must be positive, got %s", opt.limitCheckpointMaxAge)
+		}
+
+		r.limitCheckpointPath = opt.limitCheckpointPath
+		limits, err := r.loadLimitCheckpoint(opt.limitCheckpointMaxAge)
+		if err != nil {
+			// Not fatal: the limits are learned again.
+			r.logger.Printf("%v", err)
+		}
+		r.budgeter.inherit(limits)
+	}
+
+	if opt.handoffStore != nil {
+		if r.budgeter == nil {
+			return nil, errHandoffWithoutBudgets
+		}
+
+		h, err := newLimitHandoff(opt.handoffStore, opt.handoffTTL)
+		if err != nil {
+			return nil, err
+		}
+		r.handoff = h
+
+		ctx, cancel := context.WithTimeout(context.Background(), handoffLoadTimeout)
+		limits, err := h.load(ctx)
+		cancel()
+		if err != nil {
+			// Not fatal: the limits are learned again.
+			r.logger.Printf("failed to load the handed off concurrency limits: %v", err)
+		}
+		r.budgeter.inherit(limits)
+	}
+
+	if opt.blocklist != nil {
+		b, err := newQueryBlocklist(*opt.blocklist, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.blocklist = b
+	}
+
+	if opt.allowlist != nil {
+		a, err := newQueryAllowlist(*opt.allowlist, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.allowlist = a
+	}
+
+	if opt.rewriteRules != nil {
+		rw, err := newQueryRewriter(*opt.rewriteRules, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.rewriter = rw
+	}
+
+	if opt.classificationCacheSize != 0 {
+		c, err := newQueryClassifier(opt.classificationCacheSize, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.classifier = c
+	}
+
+	switch opt.effectiveQuery {
+	case "", EffectiveQueryHeader, EffectiveQueryWarning:
+	default:
+		return nil, fmt.Errorf("invalid effective query annotation %q", opt.effectiveQuery)
+	}
+
+	if opt.disabledTenants != nil {
+		r.disabledTenants = opt.disabledTenants
+		r.disabledRejections = newDisabledRejections(opt.registerer)
+	}
+
+	if opt.slowQueryThreshold > 0 {
+		r.slowQueries = newSlowQueryLog(opt.slowQueryThreshold, opt.slowQueryLogger, opt.registerer)
+	}
+
+	if opt.queryOptionPolicies != nil {
+		q, err := newQueryOptionRestrictor(*opt.queryOptionPolicies, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.queryOptions = q
+	}
+
+	if opt.maxLookback != nil {
+		l, err := newLookbackLimiter(*opt.maxLookback, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.lookbackLimiter = l
+	}
+
+	if opt.aggregateOnly != nil {
+		p, err := newPrivacyFilter(*opt.aggregateOnly, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.privacy = p
+	}
+
+	if opt.postAggregation != nil {
+		pa, err := newPostAggregator(*opt.postAggregation, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.postAggregator = pa
+	}
+
+	if opt.loadShedding != nil {
+		r.shedder = newLoadShedder(*opt.loadShedding, opt.registerer)
+	}
+
+	if opt.queryQueue != nil {
+		if opt.queryQueue.MaxConcurrent <= 0 {
+			return nil, fmt.Errorf("the maximum number of concurrent queries must be positive, got %d", opt.queryQueue.MaxConcurrent)
+		}
+		r.scheduler = newQueryScheduler(*opt.queryQueue, opt.registerer)
+	}
+
+	if opt.queryCoalescing {
+		r.coalescer = newQueryCoalescer(opt.registerer)
+	}
+
+	if opt.rangeSplitting != nil {
+		if opt.rangeSplitting.AdaptiveParallelism && r.budgeter == nil {
+			return nil, errAdaptiveSplitWithoutBudgets
+		}
+
+		s, err := newRangeSplitter(*opt.rangeSplitting, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.splitter = s
+	}
+
+	if opt.bulkExports != nil {
+		e, err := newExporter(*opt.bulkExports, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.exporter = e
+	}
+
+	if opt.querySharding != nil {
+		sh, err := newQuerySharder(*opt.querySharding, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.sharder = sh
+	}
+
+	if opt.replayWindow > 0 {
+		r.replayGuard = newReplayGuard(opt.replayWindow, opt.registerer)
+	}
+
+	if opt.responseValidation {
+		r.validator = newResponseValidator(opt.registerer)
+	}
+
+	if opt.concurrencyLimit != nil {
+		l, err := newConcurrencyLimiter(*opt.concurrencyLimit, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.concurrencyLimiter = l
+	}
+
+	if opt.selectorLimits != nil {
+		l, err := newSelectorLimiter(*opt.selectorLimits, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.selectorLimiter = l
+	}
+
+	if opt.exemptionTokens != nil {
+		if opt.subjectHeader == "" {
+			return nil, errExemptionWithoutSubject
+		}
+		r.exemptions = newExemptionChecker(opt.exemptionTokens, opt.registerer)
+	}
+
+	r.upstreamDetector = opt.upstreamDetector
+
+	if opt.rollout != nil {
+		ro, err := newRollout(*opt.rollout, opt.registerer)
+		if err != nil {
+			return nil, err
+		}
+		r.rollout = ro
+	}
+
+	var (
+		limitSelectors    = r.exemptable(r.limitSelectors)
+		limitLookback     = r.exemptable(r.limitLookback)
+		limitFederation   = r.exemptable(r.limitFederation)
+		raiseStep         = r.exemptable(r.raiseStep)
+		enforceStepPolicy = r.exemptable(r.enforceStepPolicy)
+		forwardQuery      = r.removeUnsupportedParams(r.query)
+		forwardMatchers   = r.restrictQueryOptions(r.removeUnsupportedParams(r.matcher))
+		exemplars         = func(u UpstreamCapabilities) bool { return u.Exemplars }
+		federation        = func(u UpstreamCapabilities) bool { return u.Federation }
+	)
+	query := estimateCost(r.restrictQueryOptions(r.adaptTimeout(r.allowQueries(r.blockQueries(limitSelectors(r.rewriteQueries(r.restrictToAggregates(limitLookback(r.memoizeQuery(r.shardQuery(forwardQuery)))))))))))
+	queryRange := validateRange(estimateCost(r.restrictQueryOptions(r.adaptTimeout(r.allowQueries(r.blockQueries(limitSelectors(r.rewriteQueries(r.restrictToAggregates(limitLookback(r.downshiftRange(raiseStep(enforceStepPolicy(r.snapToCalendar(r.selectResolution(r.splitRange(r.shardQuery(forwardQuery)))))))))))))))))
+
+	if r.exporter != nil {
+		r.exporter.query = queryRange
+	}
 
 	errs := merrors.New(
-		mux.Handle("/federate", r.el.ExtractLabel(enforceMethods(r.matcher, "GET"))),
-		mux.Handle("/api/v1/query", r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST"))),
-		mux.Handle("/api/v1/query_range", r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST"))),
-		mux.Handle("/api/v1/alerts", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/rules", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/series", r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST"))),
-		mux.Handle("/api/v1/query_exemplars", r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST"))),
+		mux.Handle("/federate", r.extractLabel(enforceMethods(r.requireCapability(federation, limitFederation(forwardMatchers)), "GET"))),
+		mux.Handle("/api/v1/query", r.extractLabel(enforceMethods(query, "GET", "POST"))),
+		mux.Handle("/api/v1/query_range", r.extractLabel(enforceMethods(queryRange, "GET", "POST"))),
+		mux.Handle("/api/v1/alerts", r.extractLabel(enforceMethods(r.passthrough, "GET"))),
+		mux.Handle("/api/v1/rules", r.extractLabel(enforceMethods(r.passthrough, "GET"))),
+		mux.Handle("/api/v1/series", r.extractLabel(enforceMethods(limitSelectors(forwardMatchers), "GET", "POST"))),
+		mux.Handle("/api/v1/query_exemplars", r.extractLabel(enforceMethods(r.requireCapability(exemplars, forwardQuery), "GET", "POST"))),
 	)
 
+	if opt.enableConnectAPI {
+		errs.Add(
+			mux.Handle(connectQueryPath, r.connectHandler("/api/v1/query")),
+			mux.Handle(connectQueryRangePath, r.connectHandler("/api/v1/query_range")),
+		)
+	}
+
+	if r.exporter != nil {
+		// The mux also routes the /api/v1/exports/<id> paths.
+		errs.Add(mux.Handle(ExportsPath, r.extractLabel(enforceMethods(r.exports, "GET", "POST", "DELETE"))))
+	}
+
 	if opt.enableLabelAPIs {
 		errs.Add(
-			mux.Handle("/api/v1/labels", r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST"))),
+			mux.Handle("/api/v1/labels", r.extractLabel(enforceMethods(forwardMatchers, "GET", "POST"))),
 			// Full path is /api/v1/label/<label_name>/values but http mux does not support patterns.
 			// This is fine though as we don't care about name for matcher injector.
-			mux.Handle("/api/v1/label/", r.el.ExtractLabel(enforceMethods(r.matcher, "GET"))),
+			mux.Handle("/api/v1/label/", r.extractLabel(enforceMethods(forwardMatchers, "GET"))),
 		)
 	}
 
 	errs.Add(
 		// Reject multi label values with assertSingleLabelValue() because the
 		// semantics of the Silences API don't support multi-label matchers.
-		mux.Handle("/api/v2/silences", r.el.ExtractLabel(
+		mux.Handle("/api/v2/silences", r.extractLabel(
 			r.errorIfRegexpMatch(
 				enforceMethods(
-					assertSingleLabelValue(r.silences),
+					r.preventReplays(assertSingleLabelValue(r.silences)),
 					"GET", "POST",
 				),
 			),
 		)),
-		mux.Handle("/api/v2/silence/", r.el.ExtractLabel(
+		mux.Handle("/api/v2/silence/", r.extractLabel(
 			r.errorIfRegexpMatch(
 				enforceMethods(
-					assertSingleLabelValue(r.deleteSilence),
+					r.preventReplays(assertSingleLabelValue(r.deleteSilence)),
 					"DELETE",
 				),
 			),
 		)),
-		mux.Handle("/api/v2/alerts/groups", r.el.ExtractLabel(enforceMethods(r.enforceFilterParameter, "GET"))),
-		mux.Handle("/api/v2/alerts", r.el.ExtractLabel(enforceMethods(r.alerts, "GET"))),
+		mux.Handle("/api/v2/alerts/groups", r.extractLabel(enforceMethods(r.enforceFilterParameter, "GET"))),
+		mux.Handle("/api/v2/alerts", r.extractLabel(enforceMethods(r.alerts, "GET"))),
 	)
 
 	errs.Add(
@@ -392,6 +958,9 @@ func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, o
 		"/api/v1/rules":  modifyAPIResponse(r.filterRules),
 		"/api/v1/alerts": modifyAPIResponse(r.filterAlerts),
 	}
+	if r.watermark != nil && r.watermark.Label != "" {
+		r.modifiers["/federate"] = r.addWatermarkLabel
+	}
 	proxy.ModifyResponse = r.ModifyResponse
 	proxy.ErrorHandler = r.errorHandler
 	proxy.ErrorLog = log.Default()
@@ -400,26 +969,63 @@ func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, o
 }
 
 func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.mux.ServeHTTP(w, req)
+	r.mux.ServeHTTP(r.injectResponseHeaders(w, req), req)
 }
 
 func (r *routes) ModifyResponse(resp *http.Response) error {
-	m, found := r.modifiers[resp.Request.URL.Path]
-	if !found {
-		// Return the server's response unmodified.
-		return nil
+	markUpstreamResponse(resp.Request.Context())
+	if d, throttled := upstreamThrottling(resp, time.Now()); throttled {
+		markUpstreamThrottled(resp.Request.Context(), d)
+	}
+
+	if err := r.validator.validate(resp); err != nil {
+		return err
+	}
+
+	if m, found := r.modifiers[resp.Request.URL.Path]; found {
+		if err := m(resp); err != nil {
+			return err
+		}
 	}
 
-	return m(resp)
+	if err := r.addNoise(resp); err != nil {
+		return err
+	}
+
+	if err := instantToRange(resp); err != nil {
+		return err
+	}
+
+	return addWarnings(resp)
 }
 
-func (r *routes) errorHandler(rw http.ResponseWriter, _ *http.Request, err error) {
+func (r *routes) errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
 	r.logger.Printf("http: proxy error: %v", err)
-	if errors.Is(err, errModifyResponseFailed) {
-		rw.WriteHeader(http.StatusBadRequest)
+	status, reason := http.StatusBadGateway, ReasonUpstreamError
+	switch {
+	case errors.Is(err, errModifyResponseFailed):
+		status, reason = http.StatusBadRequest, ReasonBadRequest
+	case errors.Is(err, errCircuitOpen):
+		status, reason = http.StatusServiceUnavailable, ReasonCircuitOpen
+	case errors.Is(context.Cause(req.Context()), errQueryCanceled):
+		status, reason = http.StatusServiceUnavailable, ReasonQueryCanceled
+	case errors.Is(context.Cause(req.Context()), errAdaptiveTimeout):
+		status, reason = http.StatusGatewayTimeout, ReasonUpstreamTimeout
+		markUpstreamFailure(req.Context())
+	case req.Context().Err() == nil:
+		markUpstreamFailure(req.Context())
+		if errors.Is(err, errInvalidUpstreamResponse) {
+			reason = ReasonInvalidUpstreamResponse
+		}
 	}
 
-	rw.WriteHeader(http.StatusBadGateway)
+	r.errorPage(rw, req, status, reason)
+}
+
+// extractLabel extracts the label value(s) from the request and runs the
+// checks depending on them before calling the next handler.
+func (r *routes) extractLabel(next http.HandlerFunc) http.Handler {
+	return r.rejectWhileDraining(r.auditRequests(r.shedLoad(r.rateLimit(r.limitConcurrency(r.verifyRequests(r.el.ExtractLabel(r.strictRequests(r.watermarkResponses(r.auditTenants(r.checkExemptions(r.rejectDisabledTenants(r.trackQueries(r.logSlowQueries(r.onboardTenants(r.profileTenant(r.authorize(r.cacheResponses(r.coalesceQueries(r.scheduleQueries(r.paceRequests(r.enforceLatencyBudget(next))))))))))))))))))))))
 }
 
 func enforceMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
@@ -447,22 +1053,39 @@ func (r *routes) errorIfRegexpMatch(next http.HandlerFunc) http.HandlerFunc {
 
 type ctxKey int
 
-const keyLabel ctxKey = iota
+const (
+	keyRequestContext ctxKey = iota
+)
+
+// withHandlerName stores the name of the handler (e.g. the registered path)
+// in the request context.
+func withHandlerName(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, rc := ensureRequestContext(req.Context())
+		rc.setHandler(name)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// handlerName returns the name of the handler serving the request.
+func handlerName(ctx context.Context) string {
+	return RequestContextFrom(ctx).Handler()
+}
 
 // MustLabelValues returns labels (previously stored using WithLabelValue())
 // from the given context.
 // It will panic if no label is found or the value is empty.
 func MustLabelValues(ctx context.Context) []string {
-	labels, ok := ctx.Value(keyLabel).([]string)
-	if !ok {
-		panic(fmt.Sprintf("can't find the %q value in the context", keyLabel))
+	rc := RequestContextFrom(ctx)
+	if rc == nil {
+		panic("can't find the label values in the context")
 	}
+
+	labels := rc.Tenants()
 	if len(labels) == 0 {
-		panic(fmt.Sprintf("empty %q value in the context", keyLabel))
+		panic("empty label values in the context")
 	}
 
-	sort.Strings(labels)
-
 	return labels
 }
 
@@ -484,9 +1107,12 @@ func labelValuesToRegexpString(labelValues []string) string {
 	return strings.Join(lvs, "|")
 }
 
-// WithLabelValues stores labels in the given context.
+// WithLabelValues stores labels in the request context (see
+// RequestContext) of the given context.
 func WithLabelValues(ctx context.Context, labels []string) context.Context {
-	return context.WithValue(ctx, keyLabel, labels)
+	ctx, rc := ensureRequestContext(ctx)
+	rc.setTenants(labels)
+	return ctx
 }
 
 func (r *routes) passthrough(w http.ResponseWriter, req *http.Request) {
@@ -531,19 +1157,24 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 	}
 
 	e := NewPromQLEnforcer(r.errorOnReplace, matcher)
+	if r.postAggregator != nil && r.postAggregator.applies(req.Context()) {
+		e.postAggregation = &r.postAggregator.cfg
+		r.postAggregator.aggregated.Inc()
+	}
 
 	// The `query` can come in the URL query string and/or the POST body.
 	// For this reason, we need to try to enforcing in both places.
 	// Note: a POST request may include some values in the URL query string
 	// and others in the body. If both locations include a `query`, then
 	// enforce in both places.
-	q, found1, err := enforceQueryValues(e, req.URL.Query())
+	values := req.URL.Query()
+	q, found1, err := r.enforceQueryValues(e, values)
 	if err != nil {
 		switch {
 		case errors.Is(err, ErrIllegalLabelMatcher):
-			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-		case errors.Is(err, ErrQueryParse):
-			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			rejectRequest(w, ReasonIllegalMatcher, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrQueryParse), errors.Is(err, ErrPostAggregation):
+			rejectRequest(w, ReasonInvalidQuery, err.Error(), http.StatusBadRequest)
 		case errors.Is(err, ErrEnforceLabel):
 			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -551,6 +1182,7 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	req.URL.RawQuery = q
+	effective := values.Get(queryParam)
 
 	var found2 bool
 	// Enforce the query in the POST body if needed.
@@ -558,13 +1190,13 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		if err := req.ParseForm(); err != nil {
 			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
 		}
-		q, found2, err = enforceQueryValues(e, req.PostForm)
+		q, found2, err = r.enforceQueryValues(e, req.PostForm)
 		if err != nil {
 			switch {
 			case errors.Is(err, ErrIllegalLabelMatcher):
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-			case errors.Is(err, ErrQueryParse):
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				rejectRequest(w, ReasonIllegalMatcher, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, ErrQueryParse), errors.Is(err, ErrPostAggregation):
+				rejectRequest(w, ReasonInvalidQuery, err.Error(), http.StatusBadRequest)
 			case errors.Is(err, ErrEnforceLabel):
 				prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
 			}
@@ -576,6 +1208,9 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		_ = req.Body.Close()
 		req.Body = io.NopCloser(strings.NewReader(q))
 		req.ContentLength = int64(len(q))
+		if found2 {
+			effective = req.PostForm.Get(queryParam)
+		}
 	}
 
 	// If no query was found, return early.
@@ -583,10 +1218,11 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	req = r.annotateEffectiveQuery(w, req, effective)
 	r.handler.ServeHTTP(w, req)
 }
 
-func enforceQueryValues(e *PromQLEnforcer, v url.Values) (values string, noQuery bool, err error) {
+func (r *routes) enforceQueryValues(e *PromQLEnforcer, v url.Values) (values string, noQuery bool, err error) {
 	// If no values were given or no query is present,
 	// e.g. because the query came in the POST body
 	// but the URL query string was passed, then finish early.
@@ -594,7 +1230,7 @@ func enforceQueryValues(e *PromQLEnforcer, v url.Values) (values string, noQuery
 		return v.Encode(), false, nil
 	}
 
-	q, err := e.Enforce(v.Get(queryParam))
+	q, err := r.classifier.enforce(e, v.Get(queryParam))
 	if err != nil {
 		return "", true, err
 	}
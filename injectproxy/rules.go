@@ -32,6 +32,7 @@ type apiResponse struct {
 	ErrorType string          `json:"errorType,omitempty"`
 	Error     string          `json:"error,omitempty"`
 	Warnings  []string        `json:"warnings,omitempty"`
+	Infos     []string        `json:"infos,omitempty"`
 }
 
 func getAPIResponse(resp *http.Response) (*apiResponse, error) {
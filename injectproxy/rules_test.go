@@ -547,7 +547,7 @@ func TestRules(t *testing.T) {
 			opts:     []Option{WithRegexMatch()},
 
 			expCode: http.StatusBadRequest,
-			golden:  "rules_invalid_upstream_response.golden",
+			golden:  "rules_regex_multiple_values.golden",
 		},
 		{
 			labelv:   []string{"ns3"},
@@ -702,7 +702,7 @@ func TestAlerts(t *testing.T) {
 			opts:     []Option{WithRegexMatch()},
 
 			expCode: http.StatusBadRequest,
-			golden:  "alerts_invalid_upstream_response.golden",
+			golden:  "alerts_regex_multiple_values.golden",
 		},
 	} {
 		t.Run(fmt.Sprintf("%s=%#v", proxyLabel, tc.labelv), func(t *testing.T) {
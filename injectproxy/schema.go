@@ -0,0 +1,177 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigSchemaPath is the path of the configuration schema endpoint on the
+// internal listen address.
+const ConfigSchemaPath = "/-/config-schema"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ConfigSchema returns a JSON schema (draft 2020-12) describing the
+// command-line flags: a flag is a property of the configuration object with
+// its type, default value and usage. The files map the flags referencing a
+// YAML file to the Go type of the file's content. The schema of the file is
+// generated from the yaml tags of the type and referenced by the
+// x-file-schema keyword of the flag.
+func ConfigSchema(fs *flag.FlagSet, files map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	defs := map[string]interface{}{}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		s := flagSchema(f)
+		if v, found := files[f.Name]; found {
+			defs[f.Name] = typeSchema(reflect.TypeOf(v))
+			s["x-file-schema"] = map[string]interface{}{"$ref": "#/$defs/" + f.Name}
+		}
+		properties[f.Name] = s
+	})
+
+	schema := map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "prom-label-proxy configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(defs) > 0 {
+		schema["$defs"] = defs
+	}
+
+	return schema
+}
+
+// NewConfigSchemaHandler returns an HTTP handler serving the configuration
+// schema returned by ConfigSchema.
+func NewConfigSchemaHandler(fs *flag.FlagSet, files map[string]interface{}) (http.Handler, error) {
+	b, err := json.Marshal(ConfigSchema(fs, files))
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			prometheusAPIError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(b)
+	}), nil
+}
+
+func flagSchema(f *flag.Flag) map[string]interface{} {
+	s := map[string]interface{}{"description": f.Usage}
+
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		// The custom flags (e.g. repeatable flags) are strings or lists of
+		// strings.
+		if v := reflect.ValueOf(f.Value); v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Slice {
+			s["type"] = "array"
+			s["items"] = map[string]interface{}{"type": "string"}
+			return s
+		}
+
+		s["type"] = "string"
+		if f.DefValue != "" {
+			s["default"] = f.DefValue
+		}
+		return s
+	}
+
+	for k, v := range typeSchema(reflect.TypeOf(g.Get())) {
+		s[k] = v
+	}
+
+	switch s["type"] {
+	case "boolean":
+		if d, err := strconv.ParseBool(f.DefValue); err == nil {
+			s["default"] = d
+		}
+	case "integer":
+		if d, err := strconv.ParseInt(f.DefValue, 10, 64); err == nil {
+			s["default"] = d
+		} else if d, err := strconv.ParseUint(f.DefValue, 10, 64); err == nil {
+			s["default"] = d
+		}
+	case "number":
+		if d, err := strconv.ParseFloat(f.DefValue, 64); err == nil {
+			s["default"] = d
+		}
+	default:
+		s["default"] = f.DefValue
+	}
+
+	return s
+}
+
+// typeSchema returns the JSON schema of a Go type decoded from YAML.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == durationType {
+		return map[string]interface{}{"type": "string", "format": "duration"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			// Same naming rules as gopkg.in/yaml.v3.
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			switch name {
+			case "-":
+				continue
+			case "":
+				name = strings.ToLower(f.Name)
+			}
+
+			properties[name] = typeSchema(f.Type)
+		}
+
+		// The configuration files are decoded with known fields only.
+		return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+	}
+
+	return map[string]interface{}{}
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return "" }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+func TestConfigSchema(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("label", "", "The label to enforce.")
+	fs.Bool("enable-label-apis", false, "Enable the label APIs.")
+	fs.Int("max-points-per-series", 11000, "The maximum number of points.")
+	fs.Uint64("cache-max-bytes", 1<<20, "The cache size.")
+	fs.Float64("rollout-percentage", 0.5, "The rollout percentage.")
+	fs.Duration("probe-interval", time.Minute, "The probe interval.")
+	fs.Var(&stringsFlag{}, "label-value", "A label value.")
+	fs.String("tenant-rate-limits-file", "", "The rate limits file.")
+
+	schema := ConfigSchema(fs, map[string]interface{}{"tenant-rate-limits-file": TenantRateLimits{}})
+
+	// Round-trip through JSON to compare with the expected document.
+	b, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var exp map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "prom-label-proxy configuration",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "label": {"type": "string", "default": "", "description": "The label to enforce."},
+    "enable-label-apis": {"type": "boolean", "default": false, "description": "Enable the label APIs."},
+    "max-points-per-series": {"type": "integer", "default": 11000, "description": "The maximum number of points."},
+    "cache-max-bytes": {"type": "integer", "default": 1048576, "description": "The cache size."},
+    "rollout-percentage": {"type": "number", "default": 0.5, "description": "The rollout percentage."},
+    "probe-interval": {"type": "string", "format": "duration", "default": "1m0s", "description": "The probe interval."},
+    "label-value": {"type": "array", "items": {"type": "string"}, "description": "A label value."},
+    "tenant-rate-limits-file": {"type": "string", "default": "", "description": "The rate limits file.", "x-file-schema": {"$ref": "#/$defs/tenant-rate-limits-file"}}
+  },
+  "$defs": {
+    "tenant-rate-limits-file": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "default": {
+          "type": "object",
+          "additionalProperties": false,
+          "properties": {"requests_per_second": {"type": "number"}, "burst": {"type": "integer"}}
+        },
+        "tenants": {
+          "type": "object",
+          "additionalProperties": {
+            "type": "object",
+            "additionalProperties": false,
+            "properties": {"requests_per_second": {"type": "number"}, "burst": {"type": "integer"}}
+          }
+        }
+      }
+    }
+  }
+}`), &exp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected schema:\n%s\ngot:\n%s", mustMarshal(t, exp), b)
+	}
+}
+
+func TestConfigSchemaHandler(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("label", "", "The label to enforce.")
+
+	h, err := NewConfigSchemaHandler(fs, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, ConfigSchemaPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/schema+json" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found := schema["properties"].(map[string]interface{})["label"]; !found {
+		t.Fatalf("expected the label flag in %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, ConfigSchemaPath, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status code %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b
+}
@@ -0,0 +1,209 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SelectorLimits limits the number of distinct series selectors that each
+// tenant can query within a sliding window. It throttles the clients
+// scanning an abnormal breadth of the metric space (e.g. runaway discovery
+// scripts) while the dashboards refreshing the same queries aren't affected.
+type SelectorLimits struct {
+	// MaxSelectors is the maximum number of distinct selectors per tenant
+	// within the window.
+	MaxSelectors int
+	// Window is the duration of the sliding window.
+	Window time.Duration
+}
+
+// WithSelectorLimits limits the number of distinct series selectors queried
+// by each tenant (the enforced label values) with the instant queries, the
+// range queries and the series API. The requests adding selectors beyond
+// the limit are rejected with "429 Too Many Requests" while the selectors
+// already seen within the window are still allowed.
+func WithSelectorLimits(l SelectorLimits) Option {
+	return optionFunc(func(o *options) {
+		o.selectorLimits = &l
+	})
+}
+
+// tenantSelectors holds the selectors queried by a tenant, the least
+// recently queried first.
+type tenantSelectors struct {
+	ll        *list.List
+	selectors map[string]*list.Element
+}
+
+type selectorEntry struct {
+	selector string
+	lastSeen time.Time
+}
+
+// expire removes the selectors not queried since the given time.
+func (ts *tenantSelectors) expire(since time.Time) {
+	for e := ts.ll.Front(); e != nil; e = ts.ll.Front() {
+		se := e.Value.(*selectorEntry)
+		if !se.lastSeen.Before(since) {
+			return
+		}
+		ts.ll.Remove(e)
+		delete(ts.selectors, se.selector)
+	}
+}
+
+type selectorLimiter struct {
+	limits SelectorLimits
+	now    func() time.Time
+
+	mtx       sync.Mutex
+	tenants   map[string]*tenantSelectors
+	lastSweep time.Time
+
+	// The tenant isn't a label to bound the cardinality.
+	limited *prometheus.CounterVec
+}
+
+func newSelectorLimiter(l SelectorLimits, reg prometheus.Registerer) (*selectorLimiter, error) {
+	if l.MaxSelectors <= 0 {
+		return nil, fmt.Errorf("the maximum number of selectors must be positive, got %d", l.MaxSelectors)
+	}
+
+	if l.Window <= 0 {
+		return nil, fmt.Errorf("the selectors window must be positive, got %s", l.Window)
+	}
+
+	return &selectorLimiter{
+		limits:  l,
+		now:     time.Now,
+		tenants: map[string]*tenantSelectors{},
+		limited: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "tenant_selector_limited_requests_total",
+			Help: "Total number of requests rejected because the tenant queried too many distinct selectors within the window, partitioned by handler.",
+		}, []string{"handler"}),
+	}, nil
+}
+
+// allow records the selectors queried by the tenant. When the selectors
+// exceed the limit, none of them is recorded and it returns how long the
+// tenant should wait before the oldest selector expires.
+func (l *selectorLimiter) allow(tenant string, selectors []string) (bool, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	since := now.Add(-l.limits.Window)
+
+	if now.Sub(l.lastSweep) >= l.limits.Window {
+		for t, ts := range l.tenants {
+			ts.expire(since)
+			if ts.ll.Len() == 0 {
+				delete(l.tenants, t)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	ts, found := l.tenants[tenant]
+	if !found {
+		ts = &tenantSelectors{ll: list.New(), selectors: map[string]*list.Element{}}
+		l.tenants[tenant] = ts
+	}
+	ts.expire(since)
+
+	added := map[string]struct{}{}
+	for _, s := range selectors {
+		if _, found := ts.selectors[s]; !found {
+			added[s] = struct{}{}
+		}
+	}
+
+	if len(added) > 0 && ts.ll.Len()+len(added) > l.limits.MaxSelectors {
+		var wait time.Duration
+		if e := ts.ll.Front(); e != nil {
+			wait = e.Value.(*selectorEntry).lastSeen.Add(l.limits.Window).Sub(now)
+		} else {
+			// The query alone has more selectors than allowed.
+			wait = l.limits.Window
+		}
+		return false, wait
+	}
+
+	for _, s := range selectors {
+		if e, found := ts.selectors[s]; found {
+			e.Value.(*selectorEntry).lastSeen = now
+			ts.ll.MoveToBack(e)
+			continue
+		}
+		ts.selectors[s] = ts.ll.PushBack(&selectorEntry{selector: s, lastSeen: now})
+	}
+
+	return true, 0
+}
+
+// limitSelectors rejects the requests of the tenants exceeding their
+// selector limit.
+func (r *routes) limitSelectors(next http.HandlerFunc) http.HandlerFunc {
+	if r.selectorLimiter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var selectors []string
+		if q := req.Form.Get(queryParam); q != "" {
+			qc := r.classifier.classify(q)
+			if qc.err != nil {
+				// Let the enforcer reject the invalid queries.
+				next(w, req)
+				return
+			}
+			selectors = append(selectors, qc.selectors...)
+		}
+
+		for _, m := range req.Form[matchersParam] {
+			qc := r.classifier.classify(m)
+			if qc.err != nil {
+				next(w, req)
+				return
+			}
+			selectors = append(selectors, qc.selectors...)
+		}
+
+		tenant := strings.Join(MustLabelValues(req.Context()), ",")
+		if ok, wait := r.selectorLimiter.allow(tenant, selectors); !ok {
+			r.selectorLimiter.limited.WithLabelValues(handlerName(req.Context())).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			rejectRequest(w, ReasonSelectorLimit, fmt.Sprintf("too many distinct selectors queried within %s (limit: %d)", r.selectorLimiter.limits.Window, r.selectorLimiter.limits.MaxSelectors), http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, req)
+	}
+}
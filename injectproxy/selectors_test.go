@@ -0,0 +1,222 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSelectorLimiterAllow(t *testing.T) {
+	l, err := newSelectorLimiter(SelectorLimits{MaxSelectors: 3, Window: time.Minute}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		name      string
+		elapsed   time.Duration
+		tenant    string
+		selectors []string
+
+		expAllowed bool
+		expWait    time.Duration
+	}{
+		{
+			name:       "first selectors",
+			tenant:     "a",
+			selectors:  []string{"s1", "s2"},
+			expAllowed: true,
+		},
+		{
+			name:       "known selector",
+			elapsed:    10 * time.Second,
+			tenant:     "a",
+			selectors:  []string{"s1"},
+			expAllowed: true,
+		},
+		{
+			name:      "too many new selectors",
+			elapsed:   10 * time.Second,
+			tenant:    "a",
+			selectors: []string{"s3", "s4"},
+			expWait:   40 * time.Second,
+		},
+		{
+			name:       "other tenant",
+			tenant:     "b",
+			selectors:  []string{"s3", "s4"},
+			expAllowed: true,
+		},
+		{
+			name:       "last allowed selector",
+			tenant:     "a",
+			selectors:  []string{"s3"},
+			expAllowed: true,
+		},
+		{
+			name:      "limit reached",
+			tenant:    "a",
+			selectors: []string{"s4"},
+			expWait:   40 * time.Second,
+		},
+		{
+			name:       "known selectors at the limit",
+			tenant:     "a",
+			selectors:  []string{"s1", "s2", "s3"},
+			expAllowed: true,
+		},
+		{
+			name:      "selector refreshed",
+			elapsed:   45 * time.Second,
+			tenant:    "a",
+			selectors: []string{"s4"},
+			expWait:   15 * time.Second,
+		},
+		{
+			name:       "expired selectors",
+			elapsed:    time.Minute,
+			tenant:     "a",
+			selectors:  []string{"s4", "s5", "s6"},
+			expAllowed: true,
+		},
+		{
+			name:      "query exceeding the limit",
+			tenant:    "c",
+			selectors: []string{"s1", "s2", "s3", "s4"},
+			expWait:   time.Minute,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.elapsed)
+
+			allowed, wait := l.allow(tc.tenant, tc.selectors)
+			if allowed != tc.expAllowed {
+				t.Fatalf("expected allowed %v, got %v", tc.expAllowed, allowed)
+			}
+			if wait != tc.expWait {
+				t.Fatalf("expected wait %s, got %s", tc.expWait, wait)
+			}
+		})
+	}
+
+	// The idle tenants are removed.
+	now = now.Add(2 * time.Minute)
+	l.allow("a", nil)
+	if len(l.tenants) != 1 {
+		t.Fatalf("expected 1 tenant, got %d", len(l.tenants))
+	}
+
+	for _, sl := range []SelectorLimits{
+		{Window: time.Minute},
+		{MaxSelectors: 1},
+	} {
+		if _, err := newSelectorLimiter(sl, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", sl)
+		}
+	}
+}
+
+func TestLimitSelectors(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithSelectorLimits(SelectorLimits{MaxSelectors: 2, Window: time.Hour}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		params url.Values
+
+		expCode int
+	}{
+		{
+			name:    "query",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{`sum(rate(http_requests_total{job="api"}[5m]))`}, proxyLabel: []string{"ns1"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "same selector with a range query",
+			path:    "/api/v1/query_range",
+			params:  url.Values{"query": []string{`http_requests_total{job="api"}`}, "start": []string{"0"}, "end": []string{"60"}, "step": []string{"15"}, proxyLabel: []string{"ns1"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "series",
+			path:    "/api/v1/series",
+			params:  url.Values{"match[]": []string{`up`}, proxyLabel: []string{"ns1"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "limit reached",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{`node_cpu_seconds_total`}, proxyLabel: []string{"ns1"}},
+			expCode: http.StatusTooManyRequests,
+		},
+		{
+			name:    "series limit reached",
+			path:    "/api/v1/series",
+			params:  url.Values{"match[]": []string{`up`, `node_cpu_seconds_total`}, proxyLabel: []string{"ns1"}},
+			expCode: http.StatusTooManyRequests,
+		},
+		{
+			name:    "other tenant",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{`node_cpu_seconds_total`}, proxyLabel: []string{"ns2"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "invalid query",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{`sum(`}, proxyLabel: []string{"ns1"}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Fatal("expected a Retry-After header")
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.selectorLimiter.limited.WithLabelValues("/api/v1/query")); got != 1 {
+		t.Fatalf("expected 1 limited query, got %v", got)
+	}
+}
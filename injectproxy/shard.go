@@ -0,0 +1,407 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// defaultShardLabel is the label selecting a shard of the series in the
+// upstreams supporting query sharding.
+const defaultShardLabel = "__query_shard__"
+
+// QuerySharding configures the sharding of the aggregations.
+type QuerySharding struct {
+	// Shards is the number of shard queries per aggregation.
+	Shards int
+	// Label is the label matcher injected in the selectors of the shard
+	// queries with the "<shard>_of_<shards>" value (1-based). It defaults
+	// to __query_shard__.
+	Label string
+}
+
+// WithQuerySharding executes the sum, count, min and max aggregations of the
+// instant and range queries as parallel shard queries, each one selecting a
+// shard of the series with the shard label, and merges the partial results.
+// The upstream must support the shard label (e.g. Mimir or a Thanos querier
+// with a sharding-aware store), otherwise every shard selects no series.
+//
+// The queries whose aggregated expression mixes series (vector matching,
+// nested aggregations, subqueries, histogram_quantile, ...) aren't sharded,
+// nor the queries of the tenants subject to WithPostAggregation or to the
+// noise of WithAggregateOnlyTenants.
+func WithQuerySharding(s QuerySharding) Option {
+	return optionFunc(func(o *options) {
+		o.querySharding = &s
+	})
+}
+
+type querySharder struct {
+	cfg QuerySharding
+
+	queries *prometheus.CounterVec
+}
+
+func newQuerySharder(cfg QuerySharding, reg prometheus.Registerer) (*querySharder, error) {
+	if cfg.Shards < 2 {
+		return nil, fmt.Errorf("the number of query shards must be at least 2, got %d", cfg.Shards)
+	}
+	if cfg.Label == "" {
+		cfg.Label = defaultShardLabel
+	}
+
+	return &querySharder{
+		cfg: cfg,
+		queries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_sharding_queries_total",
+			Help: "Total number of queries eligible to sharding, partitioned by handler and result (sharded, or fallback when the partial results couldn't be merged and the query was executed without sharding).",
+		}, []string{"handler", "result"}),
+	}, nil
+}
+
+// nonShardableFunctions are the functions whose result depends on several
+// series or which don't select series.
+var nonShardableFunctions = map[string]struct{}{
+	"absent":             {},
+	"absent_over_time":   {},
+	"histogram_fraction": {},
+	"histogram_quantile": {},
+	"info":               {},
+	"scalar":             {},
+	"sort":               {},
+	"sort_by_label":      {},
+	"sort_by_label_desc": {},
+	"sort_desc":          {},
+	"time":               {},
+	"vector":             {},
+}
+
+var errNotShardable = errors.New("not shardable")
+
+// shard returns the shard queries of the query and the aggregation operator,
+// or errNotShardable.
+func (s *querySharder) shard(q string) ([]string, parser.ItemType, error) {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrQueryParse, err)
+	}
+
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = paren.Expr
+	}
+
+	agg, ok := expr.(*parser.AggregateExpr)
+	if !ok {
+		return nil, 0, errNotShardable
+	}
+	switch agg.Op {
+	case parser.SUM, parser.COUNT, parser.MIN, parser.MAX:
+	default:
+		return nil, 0, errNotShardable
+	}
+
+	shardable := true
+	parser.Inspect(agg.Expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.AggregateExpr, *parser.SubqueryExpr:
+			shardable = false
+		case *parser.BinaryExpr:
+			if n.LHS.Type() != parser.ValueTypeScalar && n.RHS.Type() != parser.ValueTypeScalar {
+				shardable = false
+			}
+		case *parser.Call:
+			if _, found := nonShardableFunctions[n.Func.Name]; found {
+				shardable = false
+			}
+		case *parser.VectorSelector:
+			for _, m := range n.LabelMatchers {
+				if m.Name == s.cfg.Label {
+					shardable = false
+				}
+			}
+		}
+
+		if !shardable {
+			return errNotShardable
+		}
+		return nil
+	})
+	if !shardable {
+		return nil, 0, errNotShardable
+	}
+
+	shards := make([]string, s.cfg.Shards)
+	for i := range shards {
+		// Parse the aggregation again to get a copy of the selectors.
+		e, err := parser.ParseExpr(agg.String())
+		if err != nil {
+			return nil, 0, err
+		}
+
+		m := labels.MustNewMatcher(labels.MatchEqual, s.cfg.Label, fmt.Sprintf("%d_of_%d", i+1, s.cfg.Shards))
+		parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+			if vs, ok := node.(*parser.VectorSelector); ok {
+				vs.LabelMatchers = append(vs.LabelMatchers, m)
+			}
+			return nil
+		})
+		shards[i] = e.String()
+	}
+
+	return shards, agg.Op, nil
+}
+
+// shardQuery executes the shardable aggregations as parallel shard queries
+// and merges their results. The queries which are post-aggregated or get
+// noise added aren't sharded since the post-aggregation and the noise would
+// be applied to each shard instead of the merged result.
+func (r *routes) shardQuery(next http.HandlerFunc) http.HandlerFunc {
+	if r.sharder == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.postAggregator != nil && r.postAggregator.applies(req.Context()) {
+			next(w, req)
+			return
+		}
+
+		if rc := RequestContextFrom(req.Context()); rc != nil && rc.noise.Load() {
+			next(w, req)
+			return
+		}
+
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		shards, op, err := r.sharder.shard(req.Form.Get(queryParam))
+		if err != nil {
+			// Let the next handlers reject the invalid queries.
+			next(w, req)
+			return
+		}
+
+		reqs := make([]*http.Request, len(shards))
+		for i, q := range shards {
+			reqs[i] = subRequest(req)
+			setParam(reqs[i], queryParam, q)
+		}
+		recs := serveSubrequests(next, reqs, len(reqs))
+
+		if req.Context().Err() != nil {
+			return
+		}
+
+		handler := handlerName(req.Context())
+		b, failed, err := mergeShards(recs, op)
+		if failed != nil {
+			// Return the first failed shard as is.
+			writeRecorded(w, failed)
+			return
+		}
+		if err != nil {
+			r.logger.Printf("Failed to merge the shards of the query, executing it without sharding: %v", err)
+			r.sharder.queries.WithLabelValues(handler, "fallback").Inc()
+			next(w, req)
+			return
+		}
+		r.sharder.queries.WithLabelValues(handler, "sharded").Inc()
+
+		writeMerged(w, recs[0], b)
+	}
+}
+
+// shardedSeries is a series of the merged shards.
+type shardedSeries struct {
+	metric json.RawMessage
+	lset   labels.Labels
+	// samples are the values indexed by timestamp.
+	samples map[string]*shardedSample
+}
+
+type shardedSample struct {
+	ts    float64
+	rawTS json.RawMessage
+	v     float64
+}
+
+// mergeShards combines the values of the series returned by the shards with
+// the aggregation operator. It returns the first shard which didn't succeed
+// if any.
+func mergeShards(recs []*probeRecorder, op parser.ItemType) ([]byte, *probeRecorder, error) {
+	combine := func(a, b float64) float64 { return a + b }
+	switch op {
+	case parser.MIN:
+		combine = math.Min
+	case parser.MAX:
+		combine = math.Max
+	}
+
+	var (
+		merged     apiResponse
+		resultType string
+		series     = map[string]*shardedSeries{}
+		warnings   = map[string]struct{}{}
+		infos      = map[string]struct{}{}
+	)
+	for _, rec := range recs {
+		if rec.code != http.StatusOK {
+			return nil, rec, nil
+		}
+
+		var apir apiResponse
+		if err := json.Unmarshal(rec.body.Bytes(), &apir); err != nil || apir.Status != "success" {
+			return nil, rec, nil
+		}
+		merged.Warnings = appendUnique(merged.Warnings, warnings, apir.Warnings)
+		merged.Infos = appendUnique(merged.Infos, infos, apir.Infos)
+
+		var data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric     json.RawMessage   `json:"metric"`
+				Value      json.RawMessage   `json:"value"`
+				Values     []json.RawMessage `json:"values"`
+				Histogram  json.RawMessage   `json:"histogram"`
+				Histograms []json.RawMessage `json:"histograms"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(apir.Data, &data); err != nil {
+			return nil, nil, fmt.Errorf("can't decode the query result: %w", err)
+		}
+		switch data.ResultType {
+		case "vector", "matrix":
+		default:
+			return nil, nil, fmt.Errorf("unexpected result type %q", data.ResultType)
+		}
+		if resultType != "" && data.ResultType != resultType {
+			return nil, nil, fmt.Errorf("inconsistent result types %q and %q", resultType, data.ResultType)
+		}
+		resultType = data.ResultType
+
+		for _, s := range data.Result {
+			if s.Histogram != nil || len(s.Histograms) > 0 {
+				return nil, nil, fmt.Errorf("native histograms can't be merged")
+			}
+
+			var metric map[string]string
+			if err := json.Unmarshal(s.Metric, &metric); err != nil {
+				return nil, nil, fmt.Errorf("can't decode the series labels: %w", err)
+			}
+			lset := labels.FromMap(metric)
+			key := lset.String()
+
+			ss, found := series[key]
+			if !found {
+				ss = &shardedSeries{metric: s.Metric, lset: lset, samples: map[string]*shardedSample{}}
+				series[key] = ss
+			}
+
+			samples := s.Values
+			if s.Value != nil {
+				samples = []json.RawMessage{s.Value}
+			}
+			for _, raw := range samples {
+				var (
+					sample []json.RawMessage
+					v      string
+				)
+				if err := json.Unmarshal(raw, &sample); err != nil || len(sample) != 2 {
+					return nil, nil, fmt.Errorf("can't decode the sample %s", raw)
+				}
+				if err := json.Unmarshal(sample[1], &v); err != nil {
+					return nil, nil, fmt.Errorf("can't decode the sample value %s: %w", sample[1], err)
+				}
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid sample value %q: %w", v, err)
+				}
+				ts, err := strconv.ParseFloat(string(sample[0]), 64)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid sample timestamp %s: %w", sample[0], err)
+				}
+
+				if prev, found := ss.samples[string(sample[0])]; found {
+					prev.v = combine(prev.v, f)
+					continue
+				}
+				ss.samples[string(sample[0])] = &shardedSample{ts: ts, rawTS: sample[0], v: f}
+			}
+		}
+	}
+
+	sorted := make([]*shardedSeries, 0, len(series))
+	for _, ss := range series {
+		sorted = append(sorted, ss)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return labels.Compare(sorted[i].lset, sorted[j].lset) < 0
+	})
+
+	result := make([]map[string]any, 0, len(sorted))
+	for _, ss := range sorted {
+		samples := make([]*shardedSample, 0, len(ss.samples))
+		for _, s := range ss.samples {
+			samples = append(samples, s)
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].ts < samples[j].ts })
+
+		values := make([][]any, 0, len(samples))
+		for _, s := range samples {
+			values = append(values, []any{s.rawTS, strconv.FormatFloat(s.v, 'f', -1, 64)})
+		}
+
+		if resultType == "vector" {
+			if len(values) > 0 {
+				result = append(result, map[string]any{"metric": ss.metric, "value": values[0]})
+			}
+			continue
+		}
+		result = append(result, map[string]any{"metric": ss.metric, "values": values})
+	}
+
+	if resultType == "" {
+		resultType = "vector"
+	}
+
+	var err error
+	merged.Status = "success"
+	if merged.Data, err = json.Marshal(map[string]any{"resultType": resultType, "result": result}); err != nil {
+		return nil, nil, fmt.Errorf("can't encode the query result: %w", err)
+	}
+
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't encode the response: %w", err)
+	}
+
+	return b, nil, nil
+}
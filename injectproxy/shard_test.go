@@ -0,0 +1,307 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQuerySharderShard(t *testing.T) {
+	s, err := newQuerySharder(QuerySharding{Shards: 2}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+
+		exp []string
+	}{
+		{
+			query: `sum by (job) (rate(http_requests_total[5m]))`,
+			exp: []string{
+				`sum by (job) (rate(http_requests_total{__query_shard__="1_of_2"}[5m]))`,
+				`sum by (job) (rate(http_requests_total{__query_shard__="2_of_2"}[5m]))`,
+			},
+		},
+		{
+			query: `(count(up{job="api"} == 1))`,
+			exp: []string{
+				`count(up{__query_shard__="1_of_2",job="api"} == 1)`,
+				`count(up{__query_shard__="2_of_2",job="api"} == 1)`,
+			},
+		},
+		{
+			query: `max without (instance) (label_replace(up, "a", "$1", "job", "(.*)") * 2)`,
+			exp: []string{
+				`max without (instance) (label_replace(up{__query_shard__="1_of_2"}, "a", "$1", "job", "(.*)") * 2)`,
+				`max without (instance) (label_replace(up{__query_shard__="2_of_2"}, "a", "$1", "job", "(.*)") * 2)`,
+			},
+		},
+		{query: `up`},
+		{query: `avg(up)`},
+		{query: `topk(5, up)`},
+		{query: `sum(sum by (job) (up))`},
+		{query: `sum(up / on(job) group_left kube_pod_info)`},
+		{query: `sum(max_over_time(rate(up[5m])[1h:]))`},
+		{query: `sum(histogram_quantile(0.9, rate(http_request_duration_seconds_bucket[5m])))`},
+		{query: `sum(up{__query_shard__="1_of_4"})`},
+		{query: `sum(up) / count(up)`},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			got, _, err := s.shard(tc.query)
+			if tc.exp == nil {
+				if err != errNotShardable {
+					t.Fatalf("expected errNotShardable, got %v (%v)", err, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(tc.exp, got) {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestShardQuery(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		queries []string
+		shardRe = regexp.MustCompile(`__query_shard__="(\d)_of_2"`)
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q := req.Form.Get("query")
+
+		mtx.Lock()
+		queries = append(queries, q)
+		mtx.Unlock()
+
+		match := shardRe.FindStringSubmatch(q)
+		if match == nil {
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"42"]}]}}`))
+			return
+		}
+		shard := match[1]
+
+		if shard == "2" && regexp.MustCompile(`^sum\(fail`).MatchString(q) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status":"error","errorType":"execution","error":"too many samples"}`))
+			return
+		}
+
+		if req.URL.Path == "/api/v1/query_range" {
+			fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[0,"%s"],[60,"%s"]]}]},"warnings":["partial"]}`, shard, shard)
+			return
+		}
+
+		result := fmt.Sprintf(`{"metric":{"job":"a"},"value":[1,"%s"]}`, shard)
+		if shard == "2" {
+			result = `{"metric":{"job":"b"},"value":[1,"5"]},` + result
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, result)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQuerySharding(QuerySharding{Shards: 2}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		params url.Values
+
+		expCode    int
+		expQueries int
+		expBody    string
+	}{
+		{
+			name:       "sum",
+			path:       "/api/v1/query",
+			params:     url.Values{"query": []string{"sum by (job) (up)"}},
+			expCode:    http.StatusOK,
+			expQueries: 2,
+			expBody:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"3"]},{"metric":{"job":"b"},"value":[1,"5"]}]}}`,
+		},
+		{
+			name:       "max",
+			path:       "/api/v1/query",
+			params:     url.Values{"query": []string{"max by (job) (up)"}},
+			expCode:    http.StatusOK,
+			expQueries: 2,
+			expBody:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"2"]},{"metric":{"job":"b"},"value":[1,"5"]}]}}`,
+		},
+		{
+			name:       "range query",
+			path:       "/api/v1/query_range",
+			params:     url.Values{"query": []string{"count by (job) (up)"}, "start": []string{"0"}, "end": []string{"60"}, "step": []string{"60"}},
+			expCode:    http.StatusOK,
+			expQueries: 2,
+			expBody:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[0,"3"],[60,"3"]]}]},"warnings":["partial"]}`,
+		},
+		{
+			name:       "failed shard",
+			path:       "/api/v1/query",
+			params:     url.Values{"query": []string{"sum(fail)"}},
+			expCode:    http.StatusUnprocessableEntity,
+			expQueries: 2,
+			expBody:    `{"status":"error","errorType":"execution","error":"too many samples"}`,
+		},
+		{
+			name:       "not shardable",
+			path:       "/api/v1/query",
+			params:     url.Values{"query": []string{"avg by (job) (up)"}},
+			expCode:    http.StatusOK,
+			expQueries: 1,
+			expBody:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"42"]}]}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			queries = nil
+
+			tc.params.Set(proxyLabel, "ns1")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if len(queries) != tc.expQueries {
+				t.Fatalf("expected %d upstream queries, got %q", tc.expQueries, queries)
+			}
+
+			var exp, got any
+			if err := json.Unmarshal([]byte(tc.expBody), &exp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("unexpected error: %v: %s", err, w.Body.String())
+			}
+			if !reflect.DeepEqual(exp, got) {
+				t.Fatalf("expected %s, got %s", tc.expBody, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.sharder.queries.WithLabelValues("/api/v1/query", "sharded")); got != 2 {
+		t.Fatalf("expected 2 sharded instant queries, got %v", got)
+	}
+}
+
+func TestShardPostAggregatedQuery(t *testing.T) {
+	var queries []string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		queries = append(queries, req.Form.Get("query"))
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"3"]}]}}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQuerySharding(QuerySharding{Shards: 2}),
+		WithPostAggregation(PostAggregation{Tenants: []string{"ns1"}, Without: []string{"pod"}}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=max+by+(job)+(up)&namespace=ns1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// The post-aggregated query is forwarded once without sharding.
+	exp := []string{`sum without (pod) (max by (job) (up{namespace="ns1"}))`}
+	if !reflect.DeepEqual(queries, exp) {
+		t.Fatalf("expected upstream queries %q, got %q", exp, queries)
+	}
+
+	if got := testutil.ToFloat64(r.postAggregator.aggregated); got != 1 {
+		t.Fatalf("expected 1 post-aggregated query, got %v", got)
+	}
+	if got := testutil.ToFloat64(r.sharder.queries.WithLabelValues("/api/v1/query", "sharded")); got != 0 {
+		t.Fatalf("expected no sharded query, got %v", got)
+	}
+}
+
+func TestShardNoisyQuery(t *testing.T) {
+	var queries []string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		queries = append(queries, req.Form.Get("query"))
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"3"]}]}}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQuerySharding(QuerySharding{Shards: 2}),
+		WithAggregateOnlyTenants(AggregateOnlyTenants{Tenants: []string{"ns1"}, Epsilon: 1}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=sum+by+(job)+(up)&namespace=ns1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// The noise is added once to the result of the query forwarded without
+	// sharding.
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 upstream query, got %q", queries)
+	}
+	if got := testutil.ToFloat64(r.sharder.queries.WithLabelValues("/api/v1/query", "sharded")); got != 0 {
+		t.Fatalf("expected no sharded query, got %v", got)
+	}
+}
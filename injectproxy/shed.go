@@ -0,0 +1,273 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultLoadSheddingInterval is the default interval between 2 samples of
+// the resource usage.
+const defaultLoadSheddingInterval = time.Second
+
+// LoadShedding configures the shedding of the low-priority requests when the
+// proxy itself is under pressure. The zero thresholds are ignored.
+type LoadShedding struct {
+	// MaxCPU is the CPU utilization of the process, between 0 and 1 (all
+	// the GOMAXPROCS CPUs busy).
+	MaxCPU float64
+	// MaxMemoryBytes is the memory obtained from the OS by the Go runtime
+	// and not released.
+	MaxMemoryBytes uint64
+	// MaxGoroutines is the number of goroutines.
+	MaxGoroutines int
+	// MaxHeapBytes is the memory occupied by the live and not yet swept
+	// heap objects.
+	MaxHeapBytes uint64
+	// MaxGCPauseRatio is the fraction of the time the process was paused
+	// by the garbage collector, between 0 and 1.
+	MaxGCPauseRatio float64
+	// MaxCPUThrottlingRatio is the fraction of the CFS periods during which
+	// the cgroup of the process was throttled, between 0 and 1. It is
+	// ignored when the cgroup CPU statistics aren't available.
+	MaxCPUThrottlingRatio float64
+	// Interval is the interval between 2 samples of the resource usage.
+	// It defaults to 1s.
+	Interval time.Duration
+	// PriorityHeader is the request header holding the priority class of
+	// the request. The "batch" requests are shed, the other requests are
+	// always served.
+	PriorityHeader string
+}
+
+// WithLoadShedding rejects the low-priority requests with 503 while the
+// resource usage of the proxy is above one of the thresholds. It protects
+// the proxy process itself rather than the upstream.
+func WithLoadShedding(s LoadShedding) Option {
+	return optionFunc(func(o *options) {
+		o.loadShedding = &s
+	})
+}
+
+// resourceUsage is a sample of the resource usage of the process.
+type resourceUsage struct {
+	cpuSeconds float64
+	memory     uint64
+	goroutines int
+	heap       uint64
+	// gcPauseCPUSeconds is the pause time multiplied by GOMAXPROCS.
+	gcPauseCPUSeconds float64
+	// cpuPeriods and cpuThrottled are the cumulative numbers of CFS
+	// periods and throttled periods of the cgroup, zero if unknown.
+	cpuPeriods   uint64
+	cpuThrottled uint64
+}
+
+// cgroupCPUStatPaths are the locations of the cgroup CPU statistics (cgroup
+// v2 then v1).
+var cgroupCPUStatPaths = []string{
+	"/sys/fs/cgroup/cpu.stat",
+	"/sys/fs/cgroup/cpu/cpu.stat",
+	"/sys/fs/cgroup/cpu,cpuacct/cpu.stat",
+}
+
+// parseCPUStat returns the numbers of CFS periods and throttled periods of a
+// cgroup cpu.stat file.
+func parseCPUStat(r io.Reader) (periods, throttled uint64, err error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		var v *uint64
+		switch fields[0] {
+		case "nr_periods":
+			v = &periods
+		case "nr_throttled":
+			v = &throttled
+		default:
+			continue
+		}
+
+		if *v, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return periods, throttled, sc.Err()
+}
+
+func readCPUThrottling() (periods, throttled uint64) {
+	for _, path := range cgroupCPUStatPaths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		periods, throttled, err = parseCPUStat(f)
+		f.Close()
+		if err == nil {
+			return periods, throttled
+		}
+	}
+
+	return 0, 0
+}
+
+func readResourceUsage() resourceUsage {
+	samples := []metrics.Sample{
+		{Name: "/cpu/classes/total:cpu-seconds"},
+		{Name: "/cpu/classes/idle:cpu-seconds"},
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+		{Name: "/memory/classes/heap/objects:bytes"},
+		{Name: "/cpu/classes/gc/pause:cpu-seconds"},
+	}
+	metrics.Read(samples)
+
+	value := func(s metrics.Sample) float64 {
+		switch s.Value.Kind() {
+		case metrics.KindFloat64:
+			return s.Value.Float64()
+		case metrics.KindUint64:
+			return float64(s.Value.Uint64())
+		}
+		return 0
+	}
+
+	u := resourceUsage{
+		cpuSeconds:        value(samples[0]) - value(samples[1]),
+		memory:            uint64(value(samples[2]) - value(samples[3])),
+		goroutines:        runtime.NumGoroutine(),
+		heap:              uint64(value(samples[4])),
+		gcPauseCPUSeconds: value(samples[5]),
+	}
+	u.cpuPeriods, u.cpuThrottled = readCPUThrottling()
+
+	return u
+}
+
+type loadShedder struct {
+	cfg   LoadShedding
+	procs int
+	now   func() time.Time
+	read  func() resourceUsage
+
+	mtx     sync.Mutex
+	sampled time.Time
+	last    resourceUsage
+	// reason is the resource above its threshold or empty.
+	reason string
+
+	shed *prometheus.CounterVec
+}
+
+func newLoadShedder(cfg LoadShedding, reg prometheus.Registerer) *loadShedder {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultLoadSheddingInterval
+	}
+
+	return &loadShedder{
+		cfg:   cfg,
+		procs: runtime.GOMAXPROCS(0),
+		now:   time.Now,
+		read:  readResourceUsage,
+		shed: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "load_shed_requests_total",
+			Help: "Total number of low-priority requests rejected because the proxy was under pressure, partitioned by resource (cpu, memory, goroutines, heap, gc_pause or cpu_throttling).",
+		}, []string{"resource"}),
+	}
+}
+
+// pressure returns the resource above its threshold or an empty string. The
+// resource usage is sampled at most once per interval.
+func (s *loadShedder) pressure() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	if now.Sub(s.sampled) < s.cfg.Interval {
+		return s.reason
+	}
+
+	usage := s.read()
+	var cpu, gcPause, throttling float64
+	if !s.sampled.IsZero() {
+		cpuCapacity := now.Sub(s.sampled).Seconds() * float64(s.procs)
+		cpu = (usage.cpuSeconds - s.last.cpuSeconds) / cpuCapacity
+		gcPause = (usage.gcPauseCPUSeconds - s.last.gcPauseCPUSeconds) / cpuCapacity
+		if usage.cpuPeriods > s.last.cpuPeriods && usage.cpuThrottled >= s.last.cpuThrottled {
+			throttling = float64(usage.cpuThrottled-s.last.cpuThrottled) / float64(usage.cpuPeriods-s.last.cpuPeriods)
+		}
+	}
+	s.sampled, s.last = now, usage
+
+	switch {
+	case s.cfg.MaxCPU > 0 && cpu > s.cfg.MaxCPU:
+		s.reason = "cpu"
+	case s.cfg.MaxMemoryBytes > 0 && usage.memory > s.cfg.MaxMemoryBytes:
+		s.reason = "memory"
+	case s.cfg.MaxGoroutines > 0 && usage.goroutines > s.cfg.MaxGoroutines:
+		s.reason = "goroutines"
+	case s.cfg.MaxHeapBytes > 0 && usage.heap > s.cfg.MaxHeapBytes:
+		s.reason = "heap"
+	case s.cfg.MaxGCPauseRatio > 0 && gcPause > s.cfg.MaxGCPauseRatio:
+		s.reason = "gc_pause"
+	case s.cfg.MaxCPUThrottlingRatio > 0 && throttling > s.cfg.MaxCPUThrottlingRatio:
+		s.reason = "cpu_throttling"
+	default:
+		s.reason = ""
+	}
+
+	return s.reason
+}
+
+// shedLoad rejects the low-priority requests while the proxy is under
+// pressure.
+func (r *routes) shedLoad(next http.Handler) http.Handler {
+	if r.shedder == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.shedder.cfg.PriorityHeader == "" || !strings.EqualFold(strings.TrimSpace(req.Header.Get(r.shedder.cfg.PriorityHeader)), PriorityBatch) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		RequestContextFrom(req.Context()).setPriority(PriorityBatch)
+
+		if reason := r.shedder.pressure(); reason != "" {
+			r.shedder.shed.WithLabelValues(reason).Inc()
+			w.Header().Set("Retry-After", "1")
+			rejectRequest(w, ReasonLoadShed, "the proxy is overloaded, retry later", http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
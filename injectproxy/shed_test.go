@@ -0,0 +1,223 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadShedderPressure(t *testing.T) {
+	cfg := LoadShedding{
+		MaxCPU:                0.8,
+		MaxMemoryBytes:        1 << 30,
+		MaxGoroutines:         1000,
+		MaxHeapBytes:          512 << 20,
+		MaxGCPauseRatio:       0.05,
+		MaxCPUThrottlingRatio: 0.25,
+		Interval:              time.Second,
+	}
+
+	for _, tc := range []struct {
+		name string
+		// usage is sampled at 0s and 1s.
+		usage [2]resourceUsage
+
+		exp string
+	}{
+		{
+			name:  "idle",
+			usage: [2]resourceUsage{{cpuSeconds: 10}, {cpuSeconds: 11}},
+		},
+		{
+			name:  "cpu",
+			usage: [2]resourceUsage{{cpuSeconds: 10}, {cpuSeconds: 11.8}},
+			exp:   "cpu",
+		},
+		{
+			name:  "memory",
+			usage: [2]resourceUsage{{}, {memory: 2 << 30}},
+			exp:   "memory",
+		},
+		{
+			name:  "goroutines",
+			usage: [2]resourceUsage{{}, {goroutines: 1001}},
+			exp:   "goroutines",
+		},
+		{
+			name:  "heap",
+			usage: [2]resourceUsage{{}, {heap: 1 << 30}},
+			exp:   "heap",
+		},
+		{
+			name:  "gc pause",
+			usage: [2]resourceUsage{{gcPauseCPUSeconds: 1}, {gcPauseCPUSeconds: 1.2}},
+			exp:   "gc_pause",
+		},
+		{
+			name:  "short gc pauses",
+			usage: [2]resourceUsage{{gcPauseCPUSeconds: 1}, {gcPauseCPUSeconds: 1.05}},
+		},
+		{
+			name:  "cpu throttling",
+			usage: [2]resourceUsage{{cpuPeriods: 100, cpuThrottled: 10}, {cpuPeriods: 110, cpuThrottled: 15}},
+			exp:   "cpu_throttling",
+		},
+		{
+			name:  "cpu throttling counters reset",
+			usage: [2]resourceUsage{{cpuPeriods: 100, cpuThrottled: 10}, {cpuPeriods: 110, cpuThrottled: 5}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newLoadShedder(cfg, prometheus.NewRegistry())
+			s.procs = 2
+
+			var (
+				now   = time.Unix(0, 0)
+				reads int
+			)
+			s.now = func() time.Time { return now }
+			s.read = func() resourceUsage {
+				u := tc.usage[reads]
+				reads++
+				return u
+			}
+
+			if got := s.pressure(); got != "" {
+				t.Fatalf("expected no pressure on the first sample, got %q", got)
+			}
+
+			now = now.Add(time.Second)
+			if got := s.pressure(); got != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+
+			// The usage isn't sampled again within the interval.
+			now = now.Add(500 * time.Millisecond)
+			if got := s.pressure(); got != tc.exp || reads != 2 {
+				t.Fatalf("expected %q without sampling, got %q after %d samples", tc.exp, got, reads)
+			}
+		})
+	}
+}
+
+func TestParseCPUStat(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+
+		expPeriods, expThrottled uint64
+		expErr                   bool
+	}{
+		{
+			name: "cgroup v2",
+			content: `usage_usec 1000
+user_usec 600
+system_usec 400
+nr_periods 120
+nr_throttled 30
+throttled_usec 50000
+`,
+			expPeriods:   120,
+			expThrottled: 30,
+		},
+		{
+			name:         "cgroup v1",
+			content:      "nr_periods 10\nnr_throttled 1\nthrottled_time 1000000\n",
+			expPeriods:   10,
+			expThrottled: 1,
+		},
+		{
+			name:    "no quota",
+			content: "usage_usec 1000\n",
+		},
+		{
+			name:    "invalid",
+			content: "nr_periods ten\n",
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			periods, throttled, err := parseCPUStat(strings.NewReader(tc.content))
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if periods != tc.expPeriods || throttled != tc.expThrottled {
+				t.Fatalf("expected %d/%d, got %d/%d", tc.expThrottled, tc.expPeriods, throttled, periods)
+			}
+		})
+	}
+}
+
+func TestReadResourceUsage(t *testing.T) {
+	u := readResourceUsage()
+	if u.memory == 0 || u.goroutines == 0 || u.heap == 0 || u.cpuSeconds < 0 || u.gcPauseCPUSeconds < 0 {
+		t.Fatalf("unexpected resource usage: %+v", u)
+	}
+}
+
+func TestLoadSheddingRoutes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithLoadShedding(LoadShedding{MaxGoroutines: 10, PriorityHeader: "X-Query-Priority"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.shedder.read = func() resourceUsage { return resourceUsage{goroutines: 11} }
+
+	for _, tc := range []struct {
+		priority string
+		expCode  int
+	}{
+		{expCode: http.StatusOK},
+		{priority: "interactive", expCode: http.StatusOK},
+		{priority: "batch", expCode: http.StatusServiceUnavailable},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil)
+		if tc.priority != "" {
+			req.Header.Set("X-Query-Priority", tc.priority)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.expCode {
+			t.Fatalf("%q: expected status code %d, got %d", tc.priority, tc.expCode, w.Code)
+		}
+	}
+
+	if got := testutil.ToFloat64(r.shedder.shed.WithLabelValues("goroutines")); got != 1 {
+		t.Fatalf("expected 1 shed request, got %v", got)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// SignatureHeader is the request header holding the signature of the
+	// requests sent by an outer proxy tier.
+	SignatureHeader = "X-Prom-Label-Proxy-Signature"
+
+	// defaultSignatureMaxSkew is the default maximum difference between
+	// the signature time and the verification time.
+	defaultSignatureMaxSkew = 5 * time.Minute
+)
+
+var errInvalidSignature = errors.New("invalid request signature")
+
+// RequestSigning configures the HMAC signatures of the requests between 2
+// proxy tiers. Both tiers must share the same key and signed headers.
+type RequestSigning struct {
+	// Key is the HMAC-SHA256 secret key.
+	Key []byte
+	// Headers are the request headers covered by the signature (e.g. the
+	// tenant and priority headers).
+	Headers []string
+	// TenantHeader, if not empty, is set by the signing tier to the
+	// enforced label values separated by commas and it is covered by the
+	// signature. It lets the inner tier extract the tenant from a header
+	// even when the outer tier reads it from another source.
+	TenantHeader string
+	// MaxSkew is the maximum age of a signature (and the tolerated clock
+	// skew) for the verifying tier. It defaults to 5m.
+	MaxSkew time.Duration
+}
+
+// WithUpstreamSigning signs the requests sent to the upstream, which is
+// expected to be another proxy tier verifying the signatures (see
+// WithRequestVerification). The signature covers the method, the path, the
+// time and the configured headers but not the query parameters, which the
+// inner tier enforces again anyway.
+func WithUpstreamSigning(s RequestSigning) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamSigning = &s
+	})
+}
+
+// WithRequestVerification rejects with "401 Unauthorized" the requests
+// without a valid signature from a trusted outer tier (see
+// WithUpstreamSigning) before the label value is extracted. It prevents the
+// clients bypassing the outer tier from forging the enforcement headers.
+func WithRequestVerification(s RequestSigning) Option {
+	return optionFunc(func(o *options) {
+		o.requestVerification = &s
+	})
+}
+
+func (s RequestSigning) validate() error {
+	if len(s.Key) == 0 {
+		return errors.New("the signing key must not be empty")
+	}
+
+	if s.MaxSkew < 0 {
+		return fmt.Errorf("the maximum signature skew must not be negative, got %s", s.MaxSkew)
+	}
+
+	return nil
+}
+
+// mac returns the HMAC of the request signed at the given Unix time.
+func (s RequestSigning) mac(req *http.Request, ts int64) []byte {
+	headers := s.Headers
+	if s.TenantHeader != "" && !containsFold(headers, s.TenantHeader) {
+		headers = append(headers[:len(headers):len(headers)], s.TenantHeader)
+	}
+
+	mac := hmac.New(sha256.New, s.Key)
+	fmt.Fprintf(mac, "v1\n%d\n%s\n%s\n", ts, req.Method, req.URL.Path)
+	for _, h := range headers {
+		fmt.Fprintf(mac, "%s:%s\n", strings.ToLower(h), strings.Join(req.Header.Values(h), ","))
+	}
+
+	return mac.Sum(nil)
+}
+
+// sign returns the signature of the request at the given time.
+func (s RequestSigning) sign(req *http.Request, t time.Time) string {
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(s.mac(req, t.Unix())))
+}
+
+// verify checks the signature of the request.
+func (s RequestSigning) verify(req *http.Request, now time.Time) error {
+	var (
+		ts  int64
+		sig []byte
+		err error
+	)
+	for _, kv := range strings.Split(req.Header.Get(SignatureHeader), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		switch k {
+		case "t":
+			if ts, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return fmt.Errorf("%w: invalid time", errInvalidSignature)
+			}
+		case "v1":
+			if sig, err = hex.DecodeString(v); err != nil {
+				return fmt.Errorf("%w: invalid signature", errInvalidSignature)
+			}
+		}
+	}
+
+	if ts == 0 || len(sig) == 0 {
+		return fmt.Errorf("%w: missing signature", errInvalidSignature)
+	}
+
+	t := time.Unix(ts, 0)
+	if d := now.Sub(t); d > s.MaxSkew || d < -s.MaxSkew {
+		return fmt.Errorf("%w: expired signature", errInvalidSignature)
+	}
+
+	if !hmac.Equal(s.mac(req, ts), sig) {
+		return fmt.Errorf("%w: signature mismatch", errInvalidSignature)
+	}
+
+	return nil
+}
+
+// signingTransport signs the upstream requests.
+type signingTransport struct {
+	next    http.RoundTripper
+	signing RequestSigning
+	now     func() time.Time
+}
+
+func newSigningTransport(next http.RoundTripper, s RequestSigning) (*signingTransport, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	return &signingTransport{
+		next:    next,
+		signing: s,
+		now:     time.Now,
+	}, nil
+}
+
+// containsFold returns true if the values contain s, ignoring the case.
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request must not be modified by the transport.
+	req = req.Clone(req.Context())
+
+	if t.signing.TenantHeader != "" {
+		req.Header.Del(t.signing.TenantHeader)
+		if tenants := RequestContextFrom(req.Context()).Tenants(); len(tenants) > 0 {
+			req.Header.Set(t.signing.TenantHeader, strings.Join(tenants, ","))
+		}
+	}
+
+	req.Header.Set(SignatureHeader, t.signing.sign(req, t.now()))
+
+	return t.next.RoundTrip(req)
+}
+
+type requestVerifier struct {
+	signing RequestSigning
+	now     func() time.Time
+
+	verifications *prometheus.CounterVec
+}
+
+func newRequestVerifier(s RequestSigning, reg prometheus.Registerer) (*requestVerifier, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	if s.MaxSkew == 0 {
+		s.MaxSkew = defaultSignatureMaxSkew
+	}
+
+	return &requestVerifier{
+		signing: s,
+		now:     time.Now,
+		verifications: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "request_signature_verifications_total",
+			Help: "Total number of request signatures verified, partitioned by result (valid or invalid).",
+		}, []string{"result"}),
+	}, nil
+}
+
+// verifyRequests rejects the requests without a valid signature.
+func (r *routes) verifyRequests(next http.Handler) http.Handler {
+	if r.verifier == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := r.verifier.signing.verify(req, r.verifier.now()); err != nil {
+			r.verifier.verifications.WithLabelValues("invalid").Inc()
+			rejectRequest(w, ReasonInvalidSignature, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.verifier.verifications.WithLabelValues("valid").Inc()
+
+		next.ServeHTTP(w, req)
+	})
+}
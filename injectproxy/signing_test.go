@@ -0,0 +1,158 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestSignature(t *testing.T) {
+	s := RequestSigning{Key: []byte("secret"), Headers: []string{"X-Priority"}, TenantHeader: "X-Tenant", MaxSkew: time.Minute}
+	now := time.Unix(1700000000, 0)
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://inner.example.com/api/v1/query?query=up", nil)
+		req.Header.Set("X-Priority", "batch")
+		req.Header.Set("X-Tenant", "ns1")
+		req.Header.Set(SignatureHeader, s.sign(req, now))
+		return req
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*http.Request)
+		at     time.Time
+		key    string
+
+		expErr bool
+	}{
+		{
+			name: "valid",
+			at:   now.Add(30 * time.Second),
+		},
+		{
+			name:   "forged tenant",
+			modify: func(req *http.Request) { req.Header.Set("X-Tenant", "ns2") },
+			at:     now,
+			expErr: true,
+		},
+		{
+			name:   "forged priority",
+			modify: func(req *http.Request) { req.Header.Del("X-Priority") },
+			at:     now,
+			expErr: true,
+		},
+		{
+			name:   "other path",
+			modify: func(req *http.Request) { req.URL.Path = "/api/v1/series" },
+			at:     now,
+			expErr: true,
+		},
+		{
+			name:   "missing signature",
+			modify: func(req *http.Request) { req.Header.Del(SignatureHeader) },
+			at:     now,
+			expErr: true,
+		},
+		{
+			name:   "expired signature",
+			at:     now.Add(2 * time.Minute),
+			expErr: true,
+		},
+		{
+			name:   "other key",
+			at:     now,
+			key:    "other",
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newRequest()
+			if tc.modify != nil {
+				tc.modify(req)
+			}
+
+			v := s
+			if tc.key != "" {
+				v.Key = []byte(tc.key)
+			}
+
+			err := v.verify(req, tc.at)
+			if tc.expErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expErr, err)
+			}
+			if err != nil && !errors.Is(err, errInvalidSignature) {
+				t.Fatalf("expected %v, got %v", errInvalidSignature, err)
+			}
+		})
+	}
+}
+
+func TestProxyTiers(t *testing.T) {
+	var query string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.FormValue("query")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	s := RequestSigning{Key: []byte("secret"), TenantHeader: "X-Tenant"}
+
+	inner, err := NewRoutes(m.url, proxyLabel, HTTPHeaderEnforcer{Name: "X-Tenant"}, WithRequestVerification(s))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv := httptest.NewServer(inner)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	outer, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamSigning(s))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The client's tenant header is replaced by the outer tier.
+	req := httptest.NewRequest(http.MethodGet, "http://outer.example.com/api/v1/query?query=up&namespace=ns1", nil)
+	req.Header.Set("X-Tenant", "ns2")
+	w := httptest.NewRecorder()
+	outer.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if exp := `up{namespace="ns1"}`; query != exp {
+		t.Fatalf("expected upstream query %q, got %q", exp, query)
+	}
+
+	// The clients bypassing the outer tier are rejected.
+	req = httptest.NewRequest(http.MethodGet, "http://inner.example.com/api/v1/query?query=up", nil)
+	req.Header.Set("X-Tenant", "ns2")
+	w = httptest.NewRecorder()
+	inner.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+
+	for result, exp := range map[string]float64{"valid": 1, "invalid": 1} {
+		if got := testutil.ToFloat64(inner.verifier.verifications.WithLabelValues(result)); got != exp {
+			t.Fatalf("expected %v %s signatures, got %v", exp, result, got)
+		}
+	}
+}
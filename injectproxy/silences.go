@@ -51,7 +51,7 @@ func assertSingleLabelValue(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		labelValues := MustLabelValues(req.Context())
 		if len(labelValues) > 1 {
-			http.Error(w, "Multiple label matchers not supported", http.StatusUnprocessableEntity)
+			prometheusAPIError(w, "Multiple label matchers not supported", http.StatusUnprocessableEntity)
 			return
 		}
 
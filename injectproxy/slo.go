@@ -0,0 +1,77 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WithLatencyObjective enables the SLO instrumentation: the requests served
+// faster than the given objective without a server error are counted as
+// good, the others as bad. The ratio of bad requests can be used directly
+// in multiwindow burn-rate alerts.
+func WithLatencyObjective(objective time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.latencyObjective = objective
+	})
+}
+
+// sloMux wraps a mux and counts the good and bad requests against the
+// latency objective.
+type sloMux struct {
+	mux
+	objective time.Duration
+	requests  *prometheus.CounterVec
+	now       func() time.Time
+}
+
+func newSLOMux(m mux, r prometheus.Registerer, objective time.Duration) *sloMux {
+	promauto.With(r).NewGauge(prometheus.GaugeOpts{
+		Name: "http_slo_latency_objective_seconds",
+		Help: "The latency objective of the requests.",
+	}).Set(objective.Seconds())
+
+	return &sloMux{
+		mux:       m,
+		objective: objective,
+		requests: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Name: "http_slo_requests_total",
+			Help: "Total number of requests evaluated against the latency objective, partitioned by handler and result (good or bad).",
+		}, []string{"handler", "result"}),
+		now: time.Now,
+	}
+}
+
+// Handle implements the mux interface.
+func (s *sloMux) Handle(pattern string, handler http.Handler) {
+	good := s.requests.WithLabelValues(pattern, "good")
+	bad := s.requests.WithLabelValues(pattern, "bad")
+
+	s.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := s.now()
+		rec := newStatusRecorder(w)
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.status >= http.StatusInternalServerError || s.now().Sub(start) > s.objective {
+			bad.Inc()
+			return
+		}
+		good.Inc()
+	}))
+}
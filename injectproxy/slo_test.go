@@ -0,0 +1,69 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSLOMux(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newSLOMux(http.NewServeMux(), reg, 2*time.Second)
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	m.Handle("/api/v1/query", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		d, err := time.ParseDuration(req.URL.Query().Get("duration"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		now = now.Add(d)
+
+		if req.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	for _, u := range []string{
+		"/api/v1/query?duration=1s",
+		"/api/v1/query?duration=2s",
+		"/api/v1/query?duration=3s",
+		"/api/v1/query?duration=1s&fail=1",
+		// Client errors are good requests.
+		"/api/v1/query?duration=foo",
+	} {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil))
+	}
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP http_slo_latency_objective_seconds The latency objective of the requests.
+# TYPE http_slo_latency_objective_seconds gauge
+http_slo_latency_objective_seconds 2
+# HELP http_slo_requests_total Total number of requests evaluated against the latency objective, partitioned by handler and result (good or bad).
+# TYPE http_slo_requests_total counter
+http_slo_requests_total{handler="/api/v1/query",result="bad"} 2
+http_slo_requests_total{handler="/api/v1/query",result="good"} 3
+`)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SlowQuery is the entry logged for a query exceeding the slow query
+// threshold. The time parameters are logged as sent by the client.
+type SlowQuery struct {
+	Time            time.Time `json:"time"`
+	Handler         string    `json:"handler"`
+	Tenants         []string  `json:"tenants"`
+	Query           string    `json:"query"`
+	Start           string    `json:"start,omitempty"`
+	End             string    `json:"end,omitempty"`
+	Step            string    `json:"step,omitempty"`
+	EvaluationTime  string    `json:"evaluationTime,omitempty"`
+	Status          int       `json:"status"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	ResponseBytes   int       `json:"responseBytes"`
+}
+
+// WithSlowQueryLog logs the instant and range queries taking longer than the
+// threshold as JSON lines to the logger. The default logger is used if l is
+// nil.
+func WithSlowQueryLog(threshold time.Duration, l *log.Logger) Option {
+	return optionFunc(func(o *options) {
+		o.slowQueryThreshold = threshold
+		o.slowQueryLogger = l
+	})
+}
+
+type slowQueryLog struct {
+	threshold time.Duration
+	logger    *log.Logger
+	queries   *prometheus.CounterVec
+
+	now func() time.Time
+}
+
+func newSlowQueryLog(threshold time.Duration, l *log.Logger, reg prometheus.Registerer) *slowQueryLog {
+	if l == nil {
+		l = log.Default()
+	}
+
+	return &slowQueryLog{
+		threshold: threshold,
+		logger:    l,
+		queries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "slow_queries_total",
+			Help: "Total number of queries exceeding the slow query threshold, partitioned by handler.",
+		}, []string{"handler"}),
+		now: time.Now,
+	}
+}
+
+func (l *slowQueryLog) log(q SlowQuery) {
+	l.queries.WithLabelValues(q.Handler).Inc()
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		return
+	}
+	l.logger.Printf("slow query: %s", b)
+}
+
+// logSlowQueries logs the instant and range queries exceeding the slow query
+// threshold.
+func (r *routes) logSlowQueries(next http.HandlerFunc) http.HandlerFunc {
+	if r.slowQueries == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		handler := handlerName(req.Context())
+		switch handler {
+		case "/api/v1/query", "/api/v1/query_range":
+		default:
+			next(w, req)
+			return
+		}
+
+		body, ok := r.bufferRequestBody(w, req)
+		if !ok {
+			return
+		}
+		if body != nil {
+			defer body.Close()
+		}
+
+		// The downstream handlers may modify the query string.
+		rawQuery := req.URL.RawQuery
+		start := r.slowQueries.now()
+		rec := newStatusRecorder(w)
+
+		next(rec, req)
+
+		elapsed := r.slowQueries.now().Sub(start)
+		if elapsed < r.slowQueries.threshold {
+			return
+		}
+
+		q := SlowQuery{
+			Time:            start,
+			Handler:         handler,
+			Tenants:         MustLabelValues(req.Context()),
+			Status:          rec.status,
+			DurationSeconds: elapsed.Seconds(),
+			ResponseBytes:   rec.size,
+		}
+		if form, ok := originalForm(req, rawQuery, body); ok {
+			q.Query = form.Get(queryParam)
+			q.Start = form.Get(startParam)
+			q.End = form.Get(endParam)
+			q.Step = form.Get(stepParam)
+			q.EvaluationTime = form.Get(timeParam)
+		}
+
+		r.slowQueries.log(q)
+	}
+}
+
+// originalForm returns the parameters of the request as sent by the client
+// given its original query string and buffered body.
+func originalForm(req *http.Request, rawQuery string, body *bufferedBody) (url.Values, bool) {
+	preq := req.Clone(req.Context())
+	preq.URL.RawQuery = rawQuery
+	preq.Form = nil
+	preq.PostForm = nil
+	preq.Body = http.NoBody
+	if body != nil {
+		rc, err := body.Open()
+		if err != nil {
+			return nil, false
+		}
+		defer rc.Close()
+		preq.Body = rc
+	}
+
+	if err := preq.ParseForm(); err != nil {
+		return nil, false
+	}
+
+	return preq.Form, true
+}
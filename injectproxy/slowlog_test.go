@@ -0,0 +1,169 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLogSlowQueries(t *testing.T) {
+	const body = `{"status":"success","data":{"resultType":"matrix","result":[]}}`
+
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer m.Close()
+
+	var buf bytes.Buffer
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithSlowQueryLog(time.Second, log.New(&buf, "", 0)),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every request takes the configured elapsed time.
+	var (
+		now     = time.Unix(0, 0).UTC()
+		elapsed time.Duration
+		calls   int
+	)
+	r.slowQueries.now = func() time.Time {
+		calls++
+		if calls%2 == 0 {
+			return now.Add(elapsed)
+		}
+		return now
+	}
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		path    string
+		params  url.Values
+		elapsed time.Duration
+
+		exp *SlowQuery
+	}{
+		{
+			name:    "fast query",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up"}, "time": []string{"10"}},
+			elapsed: 500 * time.Millisecond,
+		},
+		{
+			name:    "slow instant query",
+			path:    "/api/v1/query",
+			params:  url.Values{"query": []string{"up"}, "time": []string{"10"}},
+			elapsed: 2 * time.Second,
+			exp: &SlowQuery{
+				Time:            now,
+				Handler:         "/api/v1/query",
+				Tenants:         []string{"ns1"},
+				Query:           "up",
+				EvaluationTime:  "10",
+				Status:          http.StatusOK,
+				DurationSeconds: 2,
+				ResponseBytes:   len(body),
+			},
+		},
+		{
+			name:    "slow range query",
+			method:  http.MethodPost,
+			path:    "/api/v1/query_range",
+			params:  url.Values{"query": []string{`sum(rate(http_requests_total[5m]))`}, "start": []string{"0"}, "end": []string{"3600"}, "step": []string{"60"}},
+			elapsed: time.Second,
+			exp: &SlowQuery{
+				Time:            now,
+				Handler:         "/api/v1/query_range",
+				Tenants:         []string{"ns1"},
+				Query:           `sum(rate(http_requests_total[5m]))`,
+				Start:           "0",
+				End:             "3600",
+				Step:            "60",
+				Status:          http.StatusOK,
+				DurationSeconds: 1,
+				ResponseBytes:   len(body),
+			},
+		},
+		{
+			name:    "other endpoint",
+			path:    "/api/v1/series",
+			params:  url.Values{"match[]": []string{"up"}},
+			elapsed: 2 * time.Second,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+			elapsed = tc.elapsed
+
+			params := url.Values{proxyLabel: []string{"ns1"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+tc.path, strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if tc.exp == nil {
+				if buf.Len() != 0 {
+					t.Fatalf("expected no log, got %q", buf.String())
+				}
+				return
+			}
+
+			line := strings.TrimSpace(buf.String())
+			if !strings.HasPrefix(line, "slow query: ") {
+				t.Fatalf("expected a slow query log, got %q", line)
+			}
+
+			var got SlowQuery
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "slow query: ")), &got); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(*tc.exp, got) {
+				t.Fatalf("expected %+v, got %+v", *tc.exp, got)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.slowQueries.queries.WithLabelValues("/api/v1/query_range")); got != 1 {
+		t.Fatalf("expected 1 slow range query, got %v", got)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const spiceDBHasPermission = "PERMISSIONSHIP_HAS_PERMISSION"
+
+// SpiceDBConfig configures the SpiceDBAuthorizer.
+type SpiceDBConfig struct {
+	// URL is the address of the SpiceDB HTTP API.
+	URL *url.URL
+	// Token is the pre-shared key used to authenticate against SpiceDB.
+	Token string
+	// SubjectType is the object type of the requester (e.g. "user").
+	SubjectType string
+	// ResourceType is the object type of the tenant (e.g. "team").
+	ResourceType string
+	// Permission is the permission that the subject should have on the
+	// tenant resource (e.g. "read_metrics").
+	Permission string
+	// CacheTTL is the duration for which the decisions are cached. Caching
+	// is disabled if zero.
+	CacheTTL time.Duration
+	// Client is the HTTP client used to reach SpiceDB. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// Store holds the cached decisions. If nil, the decisions are cached
+	// in memory.
+	Store StateStore
+}
+
+type spiceDBKey struct {
+	subject  string
+	resource string
+}
+
+func (k spiceDBKey) String() string {
+	return fmt.Sprintf("spicedb:%q:%q", k.subject, k.resource)
+}
+
+// SpiceDBAuthorizer checks against a relationship-based access control
+// service (SpiceDB) that the requester has the permission to read the
+// metrics of every tenant.
+//
+// The decisions are cached per (subject, tenant) pair for the configured TTL.
+type SpiceDBAuthorizer struct {
+	cfg SpiceDBConfig
+}
+
+// NewSpiceDBAuthorizer returns a new SpiceDBAuthorizer.
+func NewSpiceDBAuthorizer(cfg SpiceDBConfig) *SpiceDBAuthorizer {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryStateStore()
+	}
+
+	return &SpiceDBAuthorizer{cfg: cfg}
+}
+
+// Authorize implements the Authorizer interface.
+func (s *SpiceDBAuthorizer) Authorize(ctx context.Context, in *AuthorizationInput) (*AuthorizationDecision, error) {
+	if in.Subject == "" {
+		return &AuthorizationDecision{Reason: "missing subject"}, nil
+	}
+
+	for _, tenant := range in.Tenants {
+		allowed, err := s.check(ctx, spiceDBKey{subject: in.Subject, resource: tenant})
+		if err != nil {
+			return nil, err
+		}
+
+		if !allowed {
+			return &AuthorizationDecision{
+				Reason: fmt.Sprintf("%s %q lacks permission %q on %s %q", s.cfg.SubjectType, in.Subject, s.cfg.Permission, s.cfg.ResourceType, tenant),
+			}, nil
+		}
+	}
+
+	return &AuthorizationDecision{Allow: true}, nil
+}
+
+func (s *SpiceDBAuthorizer) check(ctx context.Context, k spiceDBKey) (bool, error) {
+	if s.cfg.CacheTTL > 0 {
+		v, found, err := s.cfg.Store.Get(ctx, k.String())
+		if err != nil {
+			return false, fmt.Errorf("failed to get cached decision: %w", err)
+		}
+		if found {
+			return string(v) == "1", nil
+		}
+	}
+
+	allowed, err := s.checkPermission(ctx, k)
+	if err != nil {
+		return false, err
+	}
+
+	if s.cfg.CacheTTL > 0 {
+		v := []byte("0")
+		if allowed {
+			v = []byte("1")
+		}
+		if err := s.cfg.Store.Set(ctx, k.String(), v, s.cfg.CacheTTL); err != nil {
+			return false, fmt.Errorf("failed to cache decision: %w", err)
+		}
+	}
+
+	return allowed, nil
+}
+
+type spiceDBObject struct {
+	ObjectType string `json:"objectType"`
+	ObjectID   string `json:"objectId"`
+}
+
+func (s *SpiceDBAuthorizer) checkPermission(ctx context.Context, k spiceDBKey) (bool, error) {
+	var body struct {
+		Resource   spiceDBObject `json:"resource"`
+		Permission string        `json:"permission"`
+		Subject    struct {
+			Object spiceDBObject `json:"object"`
+		} `json:"subject"`
+	}
+	body.Resource = spiceDBObject{ObjectType: s.cfg.ResourceType, ObjectID: k.resource}
+	body.Permission = s.cfg.Permission
+	body.Subject.Object = spiceDBObject{ObjectType: s.cfg.SubjectType, ObjectID: k.subject}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return false, fmt.Errorf("can't encode the SpiceDB request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL.JoinPath("/v1/permissions/check").String(), bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("SpiceDB request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code from SpiceDB: %d", resp.StatusCode)
+	}
+
+	var res struct {
+		Permissionship string `json:"permissionship"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, fmt.Errorf("can't decode the SpiceDB response: %w", err)
+	}
+
+	return res.Permissionship == spiceDBHasPermission, nil
+}
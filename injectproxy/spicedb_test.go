@@ -0,0 +1,168 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSpiceDBAuthorizer(t *testing.T) {
+	var calls int
+	spicedb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+
+		if req.URL.Path != "/v1/permissions/check" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body struct {
+			Resource   spiceDBObject `json:"resource"`
+			Permission string        `json:"permission"`
+			Subject    struct {
+				Object spiceDBObject `json:"object"`
+			} `json:"subject"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		permissionship := "PERMISSIONSHIP_NO_PERMISSION"
+		if body.Resource == (spiceDBObject{ObjectType: "team", ObjectID: "ns1"}) &&
+			body.Permission == "read_metrics" &&
+			body.Subject.Object == (spiceDBObject{ObjectType: "user", ObjectID: "alice"}) {
+			permissionship = spiceDBHasPermission
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"permissionship": permissionship})
+	}))
+	defer spicedb.Close()
+
+	u, err := url.Parse(spicedb.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	store := NewMemoryStateStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	authz := NewSpiceDBAuthorizer(SpiceDBConfig{
+		URL:          u,
+		Token:        "secret",
+		SubjectType:  "user",
+		ResourceType: "team",
+		Permission:   "read_metrics",
+		CacheTTL:     time.Minute,
+		Store:        store,
+	})
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithAuthorizer(authz),
+		WithAuthorizationSubjectHeader("x-forwarded-user"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		subject string
+		tenants string
+		advance time.Duration
+
+		expCode  int
+		expCalls int
+	}{
+		{
+			name:     "missing subject",
+			tenants:  "namespace=ns1",
+			expCode:  http.StatusForbidden,
+			expCalls: 0,
+		},
+		{
+			name:     "allowed",
+			subject:  "alice",
+			tenants:  "namespace=ns1",
+			expCode:  http.StatusOK,
+			expCalls: 1,
+		},
+		{
+			name:     "allowed from cache",
+			subject:  "alice",
+			tenants:  "namespace=ns1",
+			expCode:  http.StatusOK,
+			expCalls: 1,
+		},
+		{
+			name:     "denied for one of the tenants",
+			subject:  "alice",
+			tenants:  "namespace=ns1&namespace=ns2",
+			expCode:  http.StatusForbidden,
+			expCalls: 2,
+		},
+		{
+			name:     "denied for another subject",
+			subject:  "bob",
+			tenants:  "namespace=ns1",
+			expCode:  http.StatusForbidden,
+			expCalls: 3,
+		},
+		{
+			name:     "allowed after cache expiration",
+			subject:  "alice",
+			tenants:  "namespace=ns1",
+			advance:  2 * time.Minute,
+			expCode:  http.StatusOK,
+			expCalls: 4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+tc.tenants, nil)
+			if tc.subject != "" {
+				req.Header.Set("X-Forwarded-User", tc.subject)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if calls != tc.expCalls {
+				t.Fatalf("expected %d calls to SpiceDB, got %d", tc.expCalls, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// defaultSplitParallelism is the default maximum number of sub-queries of a
+// range query executed concurrently.
+const defaultSplitParallelism = 8
+
+var errAdaptiveSplitWithoutBudgets = errors.New("the adaptive parallelism of the split range queries requires the latency budgets")
+
+// RangeSplitting configures the splitting of the range queries.
+type RangeSplitting struct {
+	// Interval is the time range of the sub-queries. The sub-queries are
+	// aligned on multiples of the interval (e.g. 24h for UTC days).
+	Interval time.Duration
+	// MaxParallelism is the maximum number of sub-queries of a range query
+	// executed concurrently. It defaults to 8.
+	MaxParallelism int
+	// AdaptiveParallelism executes concurrently as many sub-queries as the
+	// tenant's concurrency limit allows besides the query itself (see
+	// WithLatencyBudgets), between 1 and MaxParallelism. The split queries
+	// are then accelerated when the upstream is idle and serialized when
+	// it is congested.
+	AdaptiveParallelism bool
+}
+
+// WithRangeSplitting splits the range queries spanning several intervals
+// into one sub-query per interval. The sub-queries are sent to the upstream
+// in parallel and their matrices are merged into a single response. The
+// evaluation timestamps are the same as with the original query.
+func WithRangeSplitting(s RangeSplitting) Option {
+	return optionFunc(func(o *options) {
+		o.rangeSplitting = &s
+	})
+}
+
+type rangeSplitter struct {
+	cfg RangeSplitting
+
+	queries     prometheus.Counter
+	subqueries  prometheus.Counter
+	parallelism prometheus.Histogram
+}
+
+func newRangeSplitter(cfg RangeSplitting, reg prometheus.Registerer) (*rangeSplitter, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("the range splitting interval must be positive, got %v", cfg.Interval)
+	}
+	if cfg.MaxParallelism <= 0 {
+		cfg.MaxParallelism = defaultSplitParallelism
+	}
+
+	return &rangeSplitter{
+		cfg: cfg,
+		queries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "query_range_splits_total",
+			Help: "Total number of range queries split into sub-queries.",
+		}),
+		subqueries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "query_range_split_subqueries_total",
+			Help: "Total number of sub-queries sent for the split range queries.",
+		}),
+		parallelism: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "query_range_split_parallelism",
+			Help:    "Number of sub-queries of the split range queries executed concurrently.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 7),
+		}),
+	}, nil
+}
+
+// splitParallelism returns the number of sub-queries of the request executed
+// concurrently.
+func (r *routes) splitParallelism(req *http.Request, parts int) int {
+	parallelism := min(parts, r.splitter.cfg.MaxParallelism)
+	if !r.splitter.cfg.AdaptiveParallelism {
+		return parallelism
+	}
+
+	headroom, ok := r.budgeter.headroom(budgetKey{
+		tenant:  strings.Join(MustLabelValues(req.Context()), ","),
+		handler: handlerName(req.Context()),
+	})
+	if !ok {
+		return parallelism
+	}
+
+	// The request holds a slot already.
+	return max(1, min(parallelism, headroom+1))
+}
+
+// split returns the time ranges of the sub-queries. Every sub-query starts
+// on an evaluation timestamp of the original query so that the merged
+// result has the same timestamps.
+func (s *rangeSplitter) split(qr queryRange) []queryRange {
+	var parts []queryRange
+	for start := qr.start; !start.After(qr.end); {
+		boundary := start.Truncate(s.cfg.Interval).Add(s.cfg.Interval)
+		end := start.Add((boundary.Sub(start) - 1) / qr.step * qr.step)
+		if end.After(qr.end) {
+			end = qr.end
+		}
+
+		parts = append(parts, queryRange{start: start, end: end, step: qr.step})
+		start = end.Add(qr.step)
+	}
+
+	return parts
+}
+
+// splitRange executes the range queries spanning several intervals as
+// parallel sub-queries and merges their results.
+func (r *routes) splitRange(next http.HandlerFunc) http.HandlerFunc {
+	if r.splitter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		qr, err := rangeFromRequest(req)
+		if err != nil {
+			// Let the upstream reject the incomplete requests.
+			next(w, req)
+			return
+		}
+
+		parts := r.splitter.split(qr)
+		if len(parts) <= 1 {
+			next(w, req)
+			return
+		}
+		r.splitter.queries.Inc()
+		r.splitter.subqueries.Add(float64(len(parts)))
+
+		reqs := make([]*http.Request, len(parts))
+		for i, p := range parts {
+			reqs[i] = subRequest(req)
+			setParam(reqs[i], startParam, formatTime(p.start))
+			setParam(reqs[i], endParam, formatTime(p.end))
+		}
+		parallelism := r.splitParallelism(req, len(parts))
+		r.splitter.parallelism.Observe(float64(parallelism))
+		recs := serveSubrequests(next, reqs, parallelism)
+
+		if req.Context().Err() != nil {
+			return
+		}
+
+		b, failed, err := mergeMatrices(recs)
+		if failed != nil {
+			// Return the first failed sub-query as is.
+			writeRecorded(w, failed)
+			return
+		}
+		if err != nil {
+			markProxyResponse(req.Context())
+			prometheusAPIError(w, fmt.Sprintf("can't merge the split range query: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		writeMerged(w, recs[0], b)
+	}
+}
+
+// subRequest returns a copy of the request whose form has been parsed. The
+// copies can be served concurrently by the next handlers.
+func subRequest(req *http.Request) *http.Request {
+	sub := req.Clone(req.Context())
+	// The body is encoded again from the form.
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+	// Let the transport decompress the responses before merging.
+	sub.Header.Del("Accept-Encoding")
+
+	return sub
+}
+
+// serveSubrequests serves the sub-requests with the next handler, at most
+// parallelism of them concurrently, and returns their responses in order.
+func serveSubrequests(next http.HandlerFunc, reqs []*http.Request, parallelism int) []*probeRecorder {
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, parallelism)
+		recs = make([]*probeRecorder, len(reqs))
+	)
+	for i, sub := range reqs {
+		recs[i] = &probeRecorder{header: http.Header{}, code: http.StatusOK}
+		wg.Add(1)
+		go func(rec *probeRecorder, sub *http.Request) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			next(rec, sub)
+		}(recs[i], sub)
+	}
+	wg.Wait()
+
+	return recs
+}
+
+// writeRecorded writes the recorded response of a sub-request.
+func writeRecorded(w http.ResponseWriter, rec *probeRecorder) {
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.code)
+	_, _ = w.Write(rec.body.Bytes())
+}
+
+// writeMerged writes the merged response of the sub-requests with the headers
+// of the first one.
+func writeMerged(w http.ResponseWriter, first *probeRecorder, b []byte) {
+	for k, v := range first.header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// appendUnique appends the strings not seen yet.
+func appendUnique(dst []string, seen map[string]struct{}, src []string) []string {
+	for _, s := range src {
+		if _, found := seen[s]; !found {
+			seen[s] = struct{}{}
+			dst = append(dst, s)
+		}
+	}
+
+	return dst
+}
+
+// mergedSeries is a series of the merged matrix.
+type mergedSeries struct {
+	metric     json.RawMessage
+	lset       labels.Labels
+	values     []json.RawMessage
+	histograms []json.RawMessage
+}
+
+// mergeMatrices concatenates the samples of the series returned by the
+// sub-queries. It returns the first sub-query which didn't succeed if any.
+func mergeMatrices(recs []*probeRecorder) ([]byte, *probeRecorder, error) {
+	var (
+		merged   apiResponse
+		series   = map[string]*mergedSeries{}
+		warnings = map[string]struct{}{}
+		infos    = map[string]struct{}{}
+	)
+	for _, rec := range recs {
+		if rec.code != http.StatusOK {
+			return nil, rec, nil
+		}
+
+		var apir apiResponse
+		if err := json.Unmarshal(rec.body.Bytes(), &apir); err != nil || apir.Status != "success" {
+			return nil, rec, nil
+		}
+
+		merged.Warnings = appendUnique(merged.Warnings, warnings, apir.Warnings)
+		merged.Infos = appendUnique(merged.Infos, infos, apir.Infos)
+
+		var data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric     json.RawMessage   `json:"metric"`
+				Values     []json.RawMessage `json:"values"`
+				Histograms []json.RawMessage `json:"histograms"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(apir.Data, &data); err != nil {
+			return nil, nil, fmt.Errorf("can't decode the query result: %w", err)
+		}
+		if data.ResultType != "matrix" {
+			return nil, nil, fmt.Errorf("unexpected result type %q", data.ResultType)
+		}
+
+		for _, s := range data.Result {
+			var metric map[string]string
+			if err := json.Unmarshal(s.Metric, &metric); err != nil {
+				return nil, nil, fmt.Errorf("can't decode the series labels: %w", err)
+			}
+			lset := labels.FromMap(metric)
+			key := lset.String()
+
+			ms, found := series[key]
+			if !found {
+				ms = &mergedSeries{metric: s.Metric, lset: lset}
+				series[key] = ms
+			}
+			ms.values = append(ms.values, s.Values...)
+			ms.histograms = append(ms.histograms, s.Histograms...)
+		}
+	}
+
+	sorted := make([]*mergedSeries, 0, len(series))
+	for _, ms := range series {
+		sorted = append(sorted, ms)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return labels.Compare(sorted[i].lset, sorted[j].lset) < 0
+	})
+
+	result := make([]map[string]any, 0, len(sorted))
+	for _, ms := range sorted {
+		s := map[string]any{"metric": ms.metric}
+		if len(ms.values) > 0 {
+			s["values"] = ms.values
+		}
+		if len(ms.histograms) > 0 {
+			s["histograms"] = ms.histograms
+		}
+		result = append(result, s)
+	}
+
+	var err error
+	merged.Status = "success"
+	if merged.Data, err = json.Marshal(map[string]any{"resultType": "matrix", "result": result}); err != nil {
+		return nil, nil, fmt.Errorf("can't encode the query result: %w", err)
+	}
+
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't encode the response: %w", err)
+	}
+
+	return b, nil, nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRangeSplitterSplit(t *testing.T) {
+	day := 24 * time.Hour
+	for _, tc := range []struct {
+		name  string
+		start int64
+		end   int64
+		step  time.Duration
+
+		exp [][2]int64
+	}{
+		{
+			name:  "within a day",
+			start: 3600,
+			end:   7200,
+			step:  time.Minute,
+			exp:   [][2]int64{{3600, 7200}},
+		},
+		{
+			name:  "aligned on the boundaries",
+			start: 0,
+			end:   2 * 86400,
+			step:  time.Hour,
+			exp:   [][2]int64{{0, 82800}, {86400, 169200}, {172800, 172800}},
+		},
+		{
+			name:  "unaligned step",
+			start: 80000,
+			end:   200000,
+			step:  7 * time.Hour,
+			exp:   [][2]int64{{80000, 80000}, {105200, 155600}, {180800, 200000}},
+		},
+		{
+			name:  "end before the last boundary",
+			start: 86400 - 60,
+			end:   86400 + 60,
+			step:  30 * time.Second,
+			exp:   [][2]int64{{86340, 86370}, {86400, 86460}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := newRangeSplitter(RangeSplitting{Interval: day}, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got [][2]int64
+			for _, p := range s.split(queryRange{start: time.Unix(tc.start, 0), end: time.Unix(tc.end, 0), step: tc.step}) {
+				if p.step != tc.step {
+					t.Fatalf("expected step %v, got %v", tc.step, p.step)
+				}
+				got = append(got, [2]int64{p.start.Unix(), p.end.Unix()})
+			}
+
+			if !reflect.DeepEqual(tc.exp, got) {
+				t.Fatalf("expected %v, got %v", tc.exp, got)
+			}
+		})
+	}
+}
+
+// matrixResponse returns a range query response with one "up" series per
+// evaluation timestamp and a "late" series starting at the second day.
+func matrixResponse(start, end, step float64) []byte {
+	var up, late []string
+	for ts := start; ts <= end; ts += step {
+		up = append(up, fmt.Sprintf(`[%v,"1"]`, ts))
+		if ts >= 86400 {
+			late = append(late, fmt.Sprintf(`[%v,"2"]`, ts))
+		}
+	}
+
+	result := []string{fmt.Sprintf(`{"metric":{"__name__":"up","namespace":"ns1"},"values":[%s]}`, strings.Join(up, ","))}
+	if len(late) > 0 {
+		result = append([]string{fmt.Sprintf(`{"metric":{"__name__":"late","namespace":"ns1"},"values":[%s]}`, strings.Join(late, ","))}, result...)
+	}
+
+	return []byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, strings.Join(result, ",")))
+}
+
+func TestSplitRange(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		calls []string
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mtx.Lock()
+		calls = append(calls, req.Form.Get("start")+"-"+req.Form.Get("end"))
+		mtx.Unlock()
+
+		var p [3]float64
+		for i, k := range []string{"start", "end", "step"} {
+			v, err := strconv.ParseFloat(req.Form.Get(k), 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			p[i] = v
+		}
+
+		if req.Form.Get("query") == `fail{namespace="ns1"}` && p[0] >= 86400 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status":"error","errorType":"execution","error":"too many samples"}`))
+			return
+		}
+
+		w.Write(matrixResponse(p[0], p[1], p[2]))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithRangeSplitting(RangeSplitting{Interval: 24 * time.Hour, MaxParallelism: 2}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		params url.Values
+
+		expCode  int
+		expCalls int
+		expBody  []byte
+	}{
+		{
+			name:     "single day",
+			params:   url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"3600"}, "step": []string{"600"}},
+			expCode:  http.StatusOK,
+			expCalls: 1,
+			expBody:  matrixResponse(0, 3600, 600),
+		},
+		{
+			name:     "three days",
+			params:   url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"172800"}, "step": []string{"3600"}},
+			expCode:  http.StatusOK,
+			expCalls: 3,
+			expBody:  matrixResponse(0, 172800, 3600),
+		},
+		{
+			name:     "three days in the body",
+			method:   http.MethodPost,
+			params:   url.Values{"query": []string{"up"}, "start": []string{"43200"}, "end": []string{"216000"}, "step": []string{"7000"}},
+			expCode:  http.StatusOK,
+			expCalls: 3,
+			expBody:  matrixResponse(43200, 216000, 7000),
+		},
+		{
+			name:     "failed sub-query",
+			params:   url.Values{"query": []string{"fail"}, "start": []string{"0"}, "end": []string{"172800"}, "step": []string{"3600"}},
+			expCode:  http.StatusUnprocessableEntity,
+			expCalls: 3,
+			expBody:  []byte(`{"status":"error","errorType":"execution","error":"too many samples"}`),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls = nil
+
+			tc.params.Set(proxyLabel, "ns1")
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range", strings.NewReader(tc.params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+tc.params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if len(calls) != tc.expCalls {
+				t.Fatalf("expected %d upstream calls, got %v", tc.expCalls, calls)
+			}
+
+			var exp, got any
+			if err := json.Unmarshal(tc.expBody, &exp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("unexpected error: %v: %s", err, w.Body.String())
+			}
+			if !reflect.DeepEqual(exp, got) {
+				t.Fatalf("expected %s, got %s", tc.expBody, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.splitter.queries); got != 3 {
+		t.Fatalf("expected 3 split queries, got %v", got)
+	}
+}
+
+func TestSplitRangeAdaptiveParallelism(t *testing.T) {
+	var (
+		mtx            sync.Mutex
+		inflight, peak int
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		inflight++
+		peak = max(peak, inflight)
+		mtx.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mtx.Lock()
+		inflight--
+		mtx.Unlock()
+
+		_ = req.ParseForm()
+		start, _ := strconv.ParseFloat(req.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(req.Form.Get("end"), 64)
+		w.Write(matrixResponse(start, end, 3600))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithLatencyBudgets(LatencyBudgets{Default: time.Hour, MaxConcurrency: 3}),
+		WithRangeSplitting(RangeSplitting{Interval: 24 * time.Hour, MaxParallelism: 8, AdaptiveParallelism: true}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	k := budgetKey{tenant: "ns1", handler: "/api/v1/query_range"}
+	for _, tc := range []struct {
+		limit int
+
+		expPeak int
+	}{
+		// The query uses the whole concurrency limit of the tenant.
+		{limit: 3, expPeak: 3},
+		// The sub-queries are serialized when the limit is reduced.
+		{limit: 1, expPeak: 1},
+	} {
+		r.budgeter.mtx.Lock()
+		if s, found := r.budgeter.states[k]; found {
+			s.limit = tc.limit
+		}
+		r.budgeter.mtx.Unlock()
+		peak = 0
+
+		params := url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"518400"}, "step": []string{"3600"}, proxyLabel: []string{"ns1"}}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		if peak != tc.expPeak {
+			t.Fatalf("limit %d: expected %d concurrent sub-queries, got %d", tc.limit, tc.expPeak, peak)
+		}
+	}
+
+	_, err = NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRangeSplitting(RangeSplitting{Interval: time.Hour, AdaptiveParallelism: true}))
+	if !errors.Is(err, errAdaptiveSplitWithoutBudgets) {
+		t.Fatalf("expected %v, got %v", errAdaptiveSplitWithoutBudgets, err)
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StateStore stores the state of the proxy which needs to outlive a request
+// (e.g. cached authorization decisions). Depending on the implementation,
+// the state may survive restarts or be shared between replicas.
+type StateStore interface {
+	// Get returns the value of the key. The boolean is false if the key
+	// doesn't exist or has expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores the value of the key. The key never expires if the TTL is
+	// zero.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+type stateEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (e stateEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// minStateSweep is the number of entries below which the expired entries of
+// a MemoryStateStore aren't swept.
+const minStateSweep = 1024
+
+// MemoryStateStore is an in-memory StateStore. The expired entries are
+// deleted when read and swept when the number of entries doubles, so that
+// the store stays bounded by twice the number of live keys while the writes
+// remain amortized O(1).
+type MemoryStateStore struct {
+	now func() time.Time
+
+	mtx     sync.Mutex
+	entries map[string]stateEntry
+	// sweepAt is the number of entries at which the next sweep happens.
+	sweepAt int
+}
+
+// NewMemoryStateStore returns a new MemoryStateStore.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		now:     time.Now,
+		entries: map[string]stateEntry{},
+	}
+}
+
+// Get implements the StateStore interface.
+func (s *MemoryStateStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	e, found := s.entries[key]
+	if !found {
+		return nil, false, nil
+	}
+	if e.expired(s.now()) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+
+	return e.Value, true, nil
+}
+
+// Set implements the StateStore interface.
+func (s *MemoryStateStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.set(key, value, ttl)
+	return nil
+}
+
+func (s *MemoryStateStore) set(key string, value []byte, ttl time.Duration) {
+	now := s.now()
+
+	if len(s.entries) >= s.sweepAt {
+		for k, e := range s.entries {
+			if e.expired(now) {
+				delete(s.entries, k)
+			}
+		}
+		s.sweepAt = max(minStateSweep, 2*len(s.entries))
+	}
+
+	e := stateEntry{Value: value}
+	if ttl > 0 {
+		e.Expires = now.Add(ttl)
+	}
+	s.entries[key] = e
+}
+
+// FileStateStore is a StateStore persisted to a local file. The file is
+// rewritten on every update so it is meant for small and rarely updated
+// states.
+type FileStateStore struct {
+	*MemoryStateStore
+	path string
+}
+
+// NewFileStateStore returns a new FileStateStore loading the existing state
+// from the file, if any.
+func NewFileStateStore(path string) (*FileStateStore, error) {
+	s := &FileStateStore{
+		MemoryStateStore: NewMemoryStateStore(),
+		path:             path,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &s.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+
+	return s, nil
+}
+
+// Set implements the StateStore interface.
+func (s *FileStateStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.set(key, value, ttl)
+
+	b, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first to never leave a partial state.
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return nil
+}
+
+const (
+	// defaultRemoteStoreTimeout is the timeout of the remote store commands
+	// when the context has no deadline.
+	defaultRemoteStoreTimeout = 5 * time.Second
+	// defaultMaxIdleConns is the default number of idle connections kept
+	// open to a remote store.
+	defaultMaxIdleConns = 8
+)
+
+// RemoteStoreConfig configures the connections to a remote state store.
+type RemoteStoreConfig struct {
+	// MaxIdleConns is the maximum number of idle connections kept open. If
+	// zero, 8 connections are kept.
+	MaxIdleConns int
+	// Timeout is the timeout of a command when the context has no
+	// deadline. If zero, 5s is used.
+	Timeout time.Duration
+}
+
+// poolConn is a connection of a connPool.
+type poolConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// connPool reuses the connections to a remote store.
+type connPool struct {
+	dial    func(ctx context.Context, deadline time.Time) (*poolConn, error)
+	maxIdle int
+	timeout time.Duration
+
+	mtx  sync.Mutex
+	idle []*poolConn
+}
+
+func newConnPool(c RemoteStoreConfig, dial func(context.Context, time.Time) (*poolConn, error)) *connPool {
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = defaultMaxIdleConns
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultRemoteStoreTimeout
+	}
+
+	return &connPool{dial: dial, maxIdle: c.MaxIdleConns, timeout: c.Timeout}
+}
+
+// do calls fn with an idle or new connection. The connection is closed
+// when fn returns an error which may have left it in an unknown state
+// (anything but a server error).
+func (p *connPool) do(ctx context.Context, fn func(*poolConn) error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(p.timeout)
+	}
+
+	p.mtx.Lock()
+	var c *poolConn
+	if n := len(p.idle); n > 0 {
+		c, p.idle = p.idle[n-1], p.idle[:n-1]
+	}
+	p.mtx.Unlock()
+
+	if c == nil {
+		var err error
+		if c, err = p.dial(ctx, deadline); err != nil {
+			return err
+		}
+	}
+
+	err := c.SetDeadline(deadline)
+	if err == nil {
+		err = fn(c)
+	}
+
+	var serr storeServerError
+	if err != nil && !errors.As(err, &serr) {
+		c.Close()
+		return err
+	}
+
+	p.mtx.Lock()
+	if len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mtx.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+
+	return err
+}
+
+// storeServerError is implemented by the errors returned by a remote store
+// server. The connection remains usable after such errors.
+type storeServerError interface {
+	error
+	serverError()
+}
+
+// RedisStateStore is a StateStore backed by Redis. It allows several
+// replicas of the proxy to share their state.
+type RedisStateStore struct {
+	pool *connPool
+}
+
+// NewRedisStateStore returns a new RedisStateStore connecting to the given
+// address. The password is optional.
+func NewRedisStateStore(addr, password string, c RemoteStoreConfig) *RedisStateStore {
+	var dialer net.Dialer
+	return &RedisStateStore{
+		pool: newConnPool(c, func(ctx context.Context, deadline time.Time) (*poolConn, error) {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			c := &poolConn{Conn: conn, rd: bufio.NewReader(conn)}
+
+			if password != "" {
+				if err := c.SetDeadline(deadline); err != nil {
+					c.Close()
+					return nil, err
+				}
+				if _, err := redisCommand(c, "AUTH", password); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+
+			return c, nil
+		}),
+	}
+}
+
+// Get implements the StateStore interface.
+func (s *RedisStateStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := s.do(ctx, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if v == nil {
+		return nil, false, nil
+	}
+
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected Redis reply %v", v)
+	}
+
+	return b, true, nil
+}
+
+// Set implements the StateStore interface.
+func (s *RedisStateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(1, ttl.Milliseconds()), 10))
+	}
+
+	_, err := s.do(ctx, args...)
+	return err
+}
+
+// do sends the command and returns the reply.
+func (s *RedisStateStore) do(ctx context.Context, args ...string) (any, error) {
+	var v any
+	err := s.pool.do(ctx, func(c *poolConn) error {
+		var err error
+		v, err = redisCommand(c, args...)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	return v, nil
+}
+
+// redisCommand writes the command using the Redis serialization protocol
+// (RESP) and reads the reply.
+func redisCommand(c *poolConn, args ...string) (any, error) {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b = append(b, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		b = append(b, a...)
+		b = append(b, "\r\n"...)
+	}
+
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.rd)
+}
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (e redisError) serverError() {}
+
+// readRedisReply reads a RESP reply. Bulk strings are returned as []byte
+// (nil for the null bulk string), simple strings as string and integers as
+// int64.
+func readRedisReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	typ, payload := line[0], line[1:len(line)-2]
+
+	switch typ {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk string length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	default:
+		return nil, fmt.Errorf("unsupported reply type %q", typ)
+	}
+}
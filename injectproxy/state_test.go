@@ -0,0 +1,265 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testStateStore(t *testing.T, s StateStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, found, err := s.Get(ctx, "foo"); err != nil || found {
+		t.Fatalf("expected missing key, got found=%v err=%v", found, err)
+	}
+
+	if err := s.Set(ctx, "foo", []byte("bar"), 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	v, found, err := s.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || string(v) != "bar" {
+		t.Fatalf("expected %q, got %q (found=%v)", "bar", v, found)
+	}
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	s := NewMemoryStateStore()
+	testStateStore(t, s)
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	if err := s.Set(ctx, "ttl", []byte("1"), time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found, _ := s.Get(ctx, "ttl"); !found {
+		t.Fatal("expected key to be found")
+	}
+
+	now = now.Add(time.Minute)
+	if _, found, _ := s.Get(ctx, "ttl"); found {
+		t.Fatal("expected key to be expired")
+	}
+
+	// Keys without TTL never expire.
+	if _, found, _ := s.Get(ctx, "foo"); !found {
+		t.Fatal("expected key to be found")
+	}
+	// The expired keys are deleted when read.
+	if _, found := s.entries["ttl"]; found {
+		t.Fatal("expected the expired key to be deleted")
+	}
+}
+
+func TestMemoryStateStoreSweep(t *testing.T) {
+	s := NewMemoryStateStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	// Short-lived keys which are never read again don't accumulate.
+	ctx := context.Background()
+	for i := 0; i < 10*minStateSweep; i++ {
+		if err := s.Set(ctx, strconv.Itoa(i), []byte("v"), time.Second); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		now = now.Add(time.Millisecond)
+
+		// At most 1000 keys are live.
+		if n := len(s.entries); n > 2*minStateSweep {
+			t.Fatalf("%d: expected at most %d entries, got %d", i, 2*minStateSweep, n)
+		}
+	}
+}
+
+func TestFileStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := NewFileStateStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testStateStore(t, s)
+
+	if err := s.Set(context.Background(), "expired", []byte("1"), time.Nanosecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// The state survives a restart.
+	s, err = NewFileStateStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	v, found, err := s.Get(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || string(v) != "bar" {
+		t.Fatalf("expected %q, got %q (found=%v)", "bar", v, found)
+	}
+
+	if _, found, _ := s.Get(context.Background(), "expired"); found {
+		t.Fatal("expected key to be expired")
+	}
+}
+
+// fakeRedis implements the subset of the Redis protocol used by
+// RedisStateStore.
+type fakeRedis struct {
+	password string
+
+	mtx     sync.Mutex
+	entries map[string]string
+	ttls    map[string]string
+	conns   int
+}
+
+func (f *fakeRedis) serve(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mtx.Lock()
+		f.conns++
+		f.mtx.Unlock()
+
+		go func() {
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			authenticated := f.password == ""
+			for {
+				args, err := readRedisCommand(rd)
+				if err != nil {
+					if err != io.EOF {
+						t.Errorf("unexpected error: %v", err)
+					}
+					return
+				}
+
+				f.mtx.Lock()
+				var reply string
+				switch {
+				case strings.ToUpper(args[0]) == "AUTH":
+					authenticated = len(args) == 2 && args[1] == f.password
+					reply = "+OK\r\n"
+					if !authenticated {
+						reply = "-WRONGPASS invalid password\r\n"
+					}
+				case !authenticated:
+					reply = "-NOAUTH Authentication required\r\n"
+				case strings.ToUpper(args[0]) == "GET":
+					v, found := f.entries[args[1]]
+					reply = "$-1\r\n"
+					if found {
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+					}
+				case strings.ToUpper(args[0]) == "SET":
+					f.entries[args[1]] = args[2]
+					if len(args) == 5 && args[3] == "PX" {
+						f.ttls[args[1]] = args[4]
+					}
+					reply = "+OK\r\n"
+				default:
+					reply = "-ERR unknown command\r\n"
+				}
+				f.mtx.Unlock()
+
+				if _, err := io.WriteString(conn, reply); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readRedisCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		v, err := readRedisReply(rd)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(v.([]byte))
+	}
+
+	return args, nil
+}
+
+func TestRedisStateStore(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	f := &fakeRedis{password: "secret", entries: map[string]string{}, ttls: map[string]string{}}
+	go f.serve(t, l)
+
+	s := NewRedisStateStore(l.Addr().String(), "secret", RemoteStoreConfig{})
+	testStateStore(t, s)
+
+	if err := s.Set(context.Background(), "ttl", []byte("1"), time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.mtx.Lock()
+	ttl := f.ttls["ttl"]
+	f.mtx.Unlock()
+	if ttl != "60000" {
+		t.Fatalf("expected TTL of 60000ms, got %q", ttl)
+	}
+
+	// The sequential commands reuse the same connection.
+	f.mtx.Lock()
+	conns := f.conns
+	f.mtx.Unlock()
+	if conns != 1 {
+		t.Fatalf("expected 1 connection, got %d", conns)
+	}
+
+	// Server errors are returned.
+	s = NewRedisStateStore(l.Addr().String(), "", RemoteStoreConfig{})
+	if _, _, err := s.Get(context.Background(), "foo"); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Fatalf("expected NOAUTH error, got %v", err)
+	}
+}
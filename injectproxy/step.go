@@ -0,0 +1,213 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WithMaxPointsPerSeries raises the step of the range queries which would
+// return more than the given number of points per series. The step is set
+// to the smallest value (in milliseconds) which fits and a warning is added
+// to the response. The maximum must be at least 2.
+func WithMaxPointsPerSeries(n int) Option {
+	return optionFunc(func(o *options) {
+		o.maxPointsPerSeries = n
+	})
+}
+
+type stepRaiser struct {
+	maxPoints   int
+	adjustments *prometheus.CounterVec
+}
+
+func newStepRaiser(maxPoints int, reg prometheus.Registerer) (*stepRaiser, error) {
+	if maxPoints < 2 {
+		return nil, fmt.Errorf("the maximum number of points per series must be at least 2, got %d", maxPoints)
+	}
+
+	return &stepRaiser{
+		maxPoints: maxPoints,
+		adjustments: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_range_step_adjustments_total",
+			Help: "Total number of range queries for which the step has been raised to stay within the maximum number of points per series.",
+		}, []string{"tenant"}),
+	}, nil
+}
+
+// raiseStep raises the step of the range query if needed before calling the
+// next handler.
+func (r *routes) raiseStep(next http.HandlerFunc) http.HandlerFunc {
+	if r.stepRaiser == nil {
+		return next
+	}
+
+	return r.rollOut(RuleMaxPoints, func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		qr, err := rangeFromRequest(req)
+		if err != nil {
+			// Let the upstream reject the incomplete requests.
+			next(w, req)
+			return
+		}
+
+		rng := qr.end.Sub(qr.start)
+		if int64(rng/qr.step)+1 <= int64(r.stepRaiser.maxPoints) {
+			next(w, req)
+			return
+		}
+
+		step := rng / time.Duration(r.stepRaiser.maxPoints-1)
+		// The step is a whole number of milliseconds.
+		step = max(step.Truncate(time.Millisecond), time.Millisecond)
+		for int64(rng/step)+1 > int64(r.stepRaiser.maxPoints) {
+			step += time.Millisecond
+		}
+
+		setParam(req, stepParam, formatDuration(step))
+		updateCost(req)
+		req = withWarning(req, fmt.Sprintf("step raised from %s to %s to return at most %d points per series", formatDuration(qr.step), formatDuration(step), r.stepRaiser.maxPoints))
+		r.stepRaiser.adjustments.WithLabelValues(strings.Join(MustLabelValues(req.Context()), ",")).Inc()
+
+		next(w, req)
+	}, next)
+}
+
+// StepPolicy constrains the step of the range queries.
+type StepPolicy struct {
+	// MinStep is the smallest step allowed. The step of the range queries
+	// with a smaller step is raised and a warning is added to the response.
+	MinStep time.Duration
+	// MaxDataPoints, if positive, makes the minimum step proportional to
+	// the range duration like the maxDataPoints option of Grafana: the step
+	// is at least (end-start)/MaxDataPoints, rounded up to the millisecond.
+	// The largest of MinStep and the proportional step applies.
+	MaxDataPoints int
+	// Align moves the start and end of the range queries back to a
+	// multiple of the step so that the same panel refreshed at different
+	// times produces the same (cacheable) queries.
+	Align bool
+}
+
+// WithStepPolicy enforces the given step policy on the range queries. It
+// applies after the step has been raised by WithMaxPointsPerSeries.
+func WithStepPolicy(p StepPolicy) Option {
+	return optionFunc(func(o *options) {
+		o.stepPolicy = &p
+	})
+}
+
+type stepPolicy struct {
+	StepPolicy
+	adjustments *prometheus.CounterVec
+}
+
+func newStepPolicy(p StepPolicy, reg prometheus.Registerer) (*stepPolicy, error) {
+	if p.MinStep < 0 {
+		return nil, fmt.Errorf("the minimum step must be positive, got %s", p.MinStep)
+	}
+	if p.MaxDataPoints < 0 {
+		return nil, fmt.Errorf("the maximum number of data points must be positive, got %d", p.MaxDataPoints)
+	}
+
+	return &stepPolicy{
+		StepPolicy: p,
+		adjustments: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "query_range_step_policy_adjustments_total",
+			Help: "Total number of range queries adjusted by the step policy, partitioned by adjustment (min-step or alignment).",
+		}, []string{"adjustment"}),
+	}, nil
+}
+
+// minStep returns the minimum step of a range query of the given duration.
+func (p *stepPolicy) minStep(rng time.Duration) time.Duration {
+	step := p.MinStep
+	if p.MaxDataPoints > 0 {
+		proportional := rng / time.Duration(p.MaxDataPoints)
+		if truncated := proportional.Truncate(time.Millisecond); truncated != proportional {
+			proportional = truncated + time.Millisecond
+		}
+		step = max(step, proportional)
+	}
+
+	return step
+}
+
+// alignTime returns the latest multiple of the step (in milliseconds since
+// the Unix epoch) which isn't after t.
+func alignTime(t time.Time, step time.Duration) time.Time {
+	ms, stepMs := t.UnixMilli(), step.Milliseconds()
+	if stepMs <= 0 {
+		return t
+	}
+
+	aligned := ms - ms%stepMs
+	if aligned > ms {
+		aligned -= stepMs
+	}
+	return time.UnixMilli(aligned).UTC()
+}
+
+// enforceStepPolicy enforces the (proportional) minimum step and aligns the range query
+// before calling the next handler.
+func (r *routes) enforceStepPolicy(next http.HandlerFunc) http.HandlerFunc {
+	if r.stepPolicy == nil {
+		return next
+	}
+
+	return r.rollOut(RuleStepPolicy, func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		qr, err := rangeFromRequest(req)
+		if err != nil {
+			// Let the upstream reject the incomplete requests.
+			next(w, req)
+			return
+		}
+
+		step := qr.step
+		if minStep := r.stepPolicy.minStep(qr.end.Sub(qr.start)); step < minStep {
+			step = minStep
+			setParam(req, stepParam, formatDuration(step))
+			updateCost(req)
+			req = withWarning(req, fmt.Sprintf("step raised from %s to %s to match the minimum step", formatDuration(qr.step), formatDuration(step)))
+			r.stepPolicy.adjustments.WithLabelValues("min-step").Inc()
+		}
+
+		if r.stepPolicy.Align {
+			start, end := alignTime(qr.start, step), alignTime(qr.end, step)
+			if !start.Equal(qr.start) || !end.Equal(qr.end) {
+				setParam(req, startParam, formatTime(start))
+				setParam(req, endParam, formatTime(end))
+				updateCost(req)
+				r.stepPolicy.adjustments.WithLabelValues("alignment").Inc()
+			}
+		}
+
+		next(w, req)
+	}, next)
+}
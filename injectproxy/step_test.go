@@ -0,0 +1,271 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRaiseStep(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		method    string
+		maxPoints int
+		params    url.Values
+
+		expStep     string
+		expWarnings []string
+	}{
+		{
+			name:    "within the limit",
+			params:  url.Values{"start": []string{"0"}, "end": []string{"100"}, "step": []string{"1"}},
+			expStep: "1",
+		},
+		{
+			name:        "above the limit",
+			params:      url.Values{"start": []string{"0"}, "end": []string{"1000"}, "step": []string{"1"}},
+			expStep:     "10",
+			expWarnings: []string{"step raised from 1 to 10 to return at most 101 points per series"},
+		},
+		{
+			name:        "above the limit with RFC3339 timestamps and duration step",
+			params:      url.Values{"start": []string{"2024-01-01T00:00:00Z"}, "end": []string{"2024-01-01T01:00:00Z"}, "step": []string{"15s"}},
+			expStep:     "36",
+			expWarnings: []string{"step raised from 15 to 36 to return at most 101 points per series"},
+		},
+		{
+			name:        "sub-second step",
+			params:      url.Values{"start": []string{"0"}, "end": []string{"1"}, "step": []string{"0.001"}},
+			expStep:     "0.01",
+			expWarnings: []string{"step raised from 0.001 to 0.01 to return at most 101 points per series"},
+		},
+		{
+			name:        "sub-millisecond step",
+			maxPoints:   11000,
+			params:      url.Values{"start": []string{"0"}, "end": []string{"5"}, "step": []string{"0.0001"}},
+			expStep:     "0.001",
+			expWarnings: []string{"step raised from 0.0001 to 0.001 to return at most 11000 points per series"},
+		},
+		{
+			name:        "two points",
+			maxPoints:   2,
+			params:      url.Values{"start": []string{"0"}, "end": []string{"1000"}, "step": []string{"1"}},
+			expStep:     "1000",
+			expWarnings: []string{"step raised from 1 to 1000 to return at most 2 points per series"},
+		},
+		{
+			name:        "POST request",
+			method:      http.MethodPost,
+			params:      url.Values{"start": []string{"0"}, "end": []string{"1000"}, "step": []string{"1"}},
+			expStep:     "10",
+			expWarnings: []string{"step raised from 1 to 10 to return at most 101 points per series"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotStep string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				gotStep = req.Form.Get("step")
+				io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[]},"warnings":["upstream"]}`)
+			}))
+			defer m.Close()
+
+			maxPoints := 101
+			if tc.maxPoints > 0 {
+				maxPoints = tc.maxPoints
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaxPointsPerSeries(maxPoints))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			params := url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range", strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if gotStep != tc.expStep {
+				t.Fatalf("expected step %q, got %q", tc.expStep, gotStep)
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expWarnings := append([]string{"upstream"}, tc.expWarnings...)
+			if !reflect.DeepEqual(expWarnings, apir.Warnings) {
+				t.Fatalf("expected warnings %q, got %q", expWarnings, apir.Warnings)
+			}
+		})
+	}
+}
+
+func TestInvalidMaxPointsPerSeries(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer m.Close()
+
+	for _, n := range []int{-1, 1} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaxPointsPerSeries(n)); err == nil {
+			t.Fatalf("%d: expected error, got nil", n)
+		}
+	}
+}
+
+func TestStepPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy StepPolicy
+		params url.Values
+
+		expParams   url.Values
+		expWarnings []string
+	}{
+		{
+			name:      "above the minimum step",
+			policy:    StepPolicy{MinStep: 15 * time.Second},
+			params:    url.Values{"start": []string{"10"}, "end": []string{"1000"}, "step": []string{"30"}},
+			expParams: url.Values{"start": []string{"10"}, "end": []string{"1000"}, "step": []string{"30"}},
+		},
+		{
+			name:        "below the minimum step",
+			policy:      StepPolicy{MinStep: 15 * time.Second},
+			params:      url.Values{"start": []string{"10"}, "end": []string{"1000"}, "step": []string{"1"}},
+			expParams:   url.Values{"start": []string{"10"}, "end": []string{"1000"}, "step": []string{"15"}},
+			expWarnings: []string{"step raised from 1 to 15 to match the minimum step"},
+		},
+		{
+			name:        "below the proportional minimum step",
+			policy:      StepPolicy{MaxDataPoints: 100},
+			params:      url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"15"}},
+			expParams:   url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"36"}},
+			expWarnings: []string{"step raised from 15 to 36 to match the minimum step"},
+		},
+		{
+			name:        "proportional minimum step rounded up to the millisecond",
+			policy:      StepPolicy{MaxDataPoints: 3},
+			params:      url.Values{"start": []string{"0"}, "end": []string{"1"}, "step": []string{"0.001"}},
+			expParams:   url.Values{"start": []string{"0"}, "end": []string{"1"}, "step": []string{"0.334"}},
+			expWarnings: []string{"step raised from 0.001 to 0.334 to match the minimum step"},
+		},
+		{
+			name:      "above the proportional minimum step",
+			policy:    StepPolicy{MaxDataPoints: 100},
+			params:    url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"60"}},
+			expParams: url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"60"}},
+		},
+		{
+			name:        "fixed minimum step above the proportional one",
+			policy:      StepPolicy{MinStep: time.Minute, MaxDataPoints: 100},
+			params:      url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"15"}},
+			expParams:   url.Values{"start": []string{"0"}, "end": []string{"3600"}, "step": []string{"60"}},
+			expWarnings: []string{"step raised from 15 to 60 to match the minimum step"},
+		},
+		{
+			name:      "aligned",
+			policy:    StepPolicy{Align: true},
+			params:    url.Values{"start": []string{"2024-01-01T00:00:10Z"}, "end": []string{"2024-01-01T01:00:20.5Z"}, "step": []string{"1m"}},
+			expParams: url.Values{"start": []string{"1704067200"}, "end": []string{"1704070800"}, "step": []string{"1m"}},
+		},
+		{
+			name:        "aligned on the minimum step",
+			policy:      StepPolicy{MinStep: time.Minute, Align: true},
+			params:      url.Values{"start": []string{"10"}, "end": []string{"1000"}, "step": []string{"15"}},
+			expParams:   url.Values{"start": []string{"0"}, "end": []string{"960"}, "step": []string{"60"}},
+			expWarnings: []string{"step raised from 15 to 60 to match the minimum step"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got url.Values
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				got = url.Values{}
+				for _, k := range []string{"start", "end", "step"} {
+					got[k] = req.Form[k]
+				}
+				io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithStepPolicy(tc.policy))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			params := url.Values{"query": []string{"up"}, proxyLabel: []string{"ns1"}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if !reflect.DeepEqual(got, tc.expParams) {
+				t.Fatalf("expected parameters %v, got %v", tc.expParams, got)
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(tc.expWarnings, apir.Warnings) {
+				t.Fatalf("expected warnings %q, got %q", tc.expWarnings, apir.Warnings)
+			}
+		})
+	}
+}
+
+func TestInvalidStepPolicy(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer m.Close()
+
+	for _, p := range []StepPolicy{{MinStep: -time.Second}, {MaxDataPoints: -1}} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithStepPolicy(p)); err == nil {
+			t.Fatalf("%+v: expected error, got nil", p)
+		}
+	}
+}
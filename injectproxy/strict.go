@@ -0,0 +1,249 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// defaultMaxLabelValueLength is the default maximum length of the label
+// values in strict mode.
+const defaultMaxLabelValueLength = 1024
+
+// singleValueParams are the parameters which can't be repeated in strict
+// mode. The upstream would only consider the first value while the proxy
+// may have checked another one.
+var singleValueParams = []string{
+	queryParam,
+	timeParam,
+	startParam,
+	endParam,
+	stepParam,
+	"timeout",
+	"limit",
+	"stats",
+	"lookback_delta",
+	"dedup",
+	"partial_response",
+	maxSourceResolutionParam,
+	"engine",
+	"analyze",
+}
+
+// thanosParams are the Thanos query options accepted in strict mode. Other
+// options (e.g. storeMatch[] which selects the store APIs) are rejected.
+var thanosParams = []string{
+	"dedup",
+	"partial_response",
+	maxSourceResolutionParam,
+	"replicaLabels[]",
+	"engine",
+	"analyze",
+}
+
+// knownParams lists the parameters accepted in strict mode per handler. The
+// parameters of the other handlers aren't restricted.
+var knownParams = func() map[string]map[string]struct{} {
+	endpoints := map[string][]string{
+		"/api/v1/query":           {queryParam, timeParam, "timeout", "limit", "stats", "lookback_delta"},
+		"/api/v1/query_range":     {queryParam, startParam, endParam, stepParam, "timeout", "limit", "stats", "lookback_delta"},
+		"/api/v1/query_exemplars": {queryParam, startParam, endParam},
+		"/api/v1/series":          {matchersParam, startParam, endParam, "limit"},
+		"/api/v1/labels":          {matchersParam, startParam, endParam, "limit"},
+		"/api/v1/label":           {matchersParam, startParam, endParam, "limit"},
+		"/federate":               {matchersParam},
+	}
+
+	known := make(map[string]map[string]struct{}, len(endpoints))
+	for handler, params := range endpoints {
+		known[handler] = map[string]struct{}{}
+		for _, p := range append(params, thanosParams...) {
+			known[handler][p] = struct{}{}
+		}
+	}
+
+	return known
+}()
+
+// StrictRequests configures the strict validation of the requests.
+type StrictRequests struct {
+	// MaxLabelValueLength is the maximum length of the enforced label
+	// values and of the label values in the matchers. It defaults to
+	// 1024.
+	MaxLabelValueLength int
+}
+
+// WithStrictRequests rejects with "400 Bad Request" the ambiguous or
+// unexpected requests which are otherwise forwarded to the upstream:
+//   - the parameters provided more than once (in the URL and/or the body)
+//     which accept a single value.
+//   - the parameters unknown to the query, series, labels, exemplars and
+//     federation APIs, including the Thanos options not explicitly supported.
+//   - the label values longer than the maximum length.
+//   - the timestamps outside of the range supported by Prometheus.
+//
+// It is meant for security-sensitive deployments where the proxy must see
+// the requests exactly as the upstream does.
+func WithStrictRequests(s StrictRequests) Option {
+	return optionFunc(func(o *options) {
+		o.strictRequests = &s
+	})
+}
+
+type strictValidator struct {
+	StrictRequests
+	rejected *prometheus.CounterVec
+}
+
+func newStrictValidator(s StrictRequests, reg prometheus.Registerer) (*strictValidator, error) {
+	if s.MaxLabelValueLength == 0 {
+		s.MaxLabelValueLength = defaultMaxLabelValueLength
+	}
+
+	if s.MaxLabelValueLength < 0 {
+		return nil, fmt.Errorf("the maximum label value length must be positive, got %d", s.MaxLabelValueLength)
+	}
+
+	return &strictValidator{
+		StrictRequests: s,
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "strict_rejected_requests_total",
+			Help: "Total number of requests rejected by the strict validation, partitioned by handler and reason (duplicate_param, unknown_param, label_value_length or timestamp).",
+		}, []string{"handler", "reason"}),
+	}, nil
+}
+
+// requestParams returns the parameters of the request from both the URL
+// query string and the body. Unlike the request form, the values provided in
+// both places are kept. The request form must have been parsed.
+func requestParams(req *http.Request) url.Values {
+	v := req.URL.Query()
+	for name, values := range req.PostForm {
+		v[name] = append(v[name], values...)
+	}
+
+	return v
+}
+
+// check returns the reason and the error when the request is rejected.
+func (s *strictValidator) check(handler string, labelValues []string, params url.Values) (string, error) {
+	for _, name := range singleValueParams {
+		if len(params[name]) > 1 {
+			return "duplicate_param", fmt.Errorf("the %q parameter must be provided once", name)
+		}
+	}
+
+	if known, found := knownParams[handler]; found {
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if _, found := known[name]; !found {
+				return "unknown_param", fmt.Errorf("unknown parameter %q", name)
+			}
+		}
+	}
+
+	for _, name := range []string{timeParam, startParam, endParam} {
+		if !params.Has(name) {
+			continue
+		}
+
+		t, err := parseTime(params.Get(name))
+		if err != nil {
+			return "timestamp", fmt.Errorf("invalid %q parameter: %w", name, err)
+		}
+		if t.Before(minTime) || t.After(maxTime) {
+			return "timestamp", fmt.Errorf("invalid %q parameter: timestamp out of range", name)
+		}
+	}
+
+	for _, v := range labelValues {
+		if len(v) > s.MaxLabelValueLength {
+			return "label_value_length", fmt.Errorf("the label value exceeds %d bytes", s.MaxLabelValueLength)
+		}
+	}
+
+	for _, ms := range paramMatchers(params) {
+		for _, m := range ms {
+			if len(m.Value) > s.MaxLabelValueLength {
+				return "label_value_length", fmt.Errorf("the value of the %q matcher exceeds %d bytes", m.Name, s.MaxLabelValueLength)
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// paramMatchers returns the label matchers of the query expression and of
+// the series selectors. The expressions which can't be parsed are ignored,
+// the error being reported later on.
+func paramMatchers(params url.Values) [][]*labels.Matcher {
+	var ms [][]*labels.Matcher
+
+	if params.Has(queryParam) {
+		if expr, err := parser.ParseExpr(params.Get(queryParam)); err == nil {
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					ms = append(ms, vs.LabelMatchers)
+				}
+				return nil
+			})
+		}
+	}
+
+	for _, s := range params[matchersParam] {
+		if m, err := parser.ParseMetricSelector(s); err == nil {
+			ms = append(ms, m)
+		}
+	}
+
+	return ms
+}
+
+// strictRequests rejects the requests failing the strict validation. It
+// runs after the label extraction which removes the label parameter.
+func (r *routes) strictRequests(next http.HandlerFunc) http.HandlerFunc {
+	if r.strict == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		handler := handlerName(req.Context())
+		reason, err := r.strict.check(handler, MustLabelValues(req.Context()), requestParams(req))
+		if err != nil {
+			r.strict.rejected.WithLabelValues(handler, reason).Inc()
+			rejectRequest(w, ReasonStrictValidation, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStrictRequests(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/rules" {
+			w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithStrictRequests(StrictRequests{MaxLabelValueLength: 8}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		query  string
+		body   string
+		tenant string
+
+		expCode   int
+		expReason string
+	}{
+		{
+			name:    "valid query",
+			path:    "/api/v1/query",
+			query:   "query=up&time=1700000000&dedup=true",
+			tenant:  "ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "valid series",
+			path:    "/api/v1/series",
+			query:   "match[]=up&match[]=go_info",
+			tenant:  "ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:      "duplicate query",
+			path:      "/api/v1/query",
+			query:     "query=up&query=down",
+			tenant:    "ns1",
+			expCode:   http.StatusBadRequest,
+			expReason: "duplicate_param",
+		},
+		{
+			name:      "duplicate query in the URL and the body",
+			path:      "/api/v1/query",
+			query:     "query=up",
+			body:      "query=down",
+			tenant:    "ns1",
+			expCode:   http.StatusBadRequest,
+			expReason: "duplicate_param",
+		},
+		{
+			name:      "unknown Thanos option",
+			path:      "/api/v1/query",
+			query:     "query=up&storeMatch[]=" + url.QueryEscape(`{__address__="store"}`),
+			tenant:    "ns1",
+			expCode:   http.StatusBadRequest,
+			expReason: "unknown_param",
+		},
+		{
+			name:    "unrestricted handler",
+			path:    "/api/v1/rules",
+			query:   "type=alert",
+			tenant:  "ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:      "over-long enforced label value",
+			path:      "/api/v1/query",
+			query:     "query=up",
+			tenant:    strings.Repeat("a", 9),
+			expCode:   http.StatusBadRequest,
+			expReason: "label_value_length",
+		},
+		{
+			name:      "over-long matcher value",
+			path:      "/api/v1/query",
+			query:     "query=" + url.QueryEscape(`rate(up{job="`+strings.Repeat("a", 9)+`"}[5m])`),
+			tenant:    "ns1",
+			expCode:   http.StatusBadRequest,
+			expReason: "label_value_length",
+		},
+		{
+			name:      "overflowing timestamp",
+			path:      "/api/v1/query_range",
+			query:     "query=up&start=1e300&end=0&step=1",
+			tenant:    "ns1",
+			expCode:   http.StatusBadRequest,
+			expReason: "timestamp",
+		},
+		{
+			name:      "timestamp out of range",
+			path:      "/api/v1/query",
+			query:     "query=up&time=9e18",
+			tenant:    "ns1",
+			expCode:   http.StatusBadRequest,
+			expReason: "timestamp",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := "http://prometheus.example.com" + tc.path + "?" + tc.query + "&" + proxyLabel + "=" + tc.tenant
+
+			req := httptest.NewRequest(http.MethodGet, u, nil)
+			if tc.body != "" {
+				req = httptest.NewRequest(http.MethodPost, u, strings.NewReader(tc.body))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expReason == "" {
+				return
+			}
+
+			if got := testutil.ToFloat64(r.strict.rejected.WithLabelValues(tc.path, tc.expReason)); got == 0 {
+				t.Fatalf("expected a rejection with reason %q", tc.expReason)
+			}
+		})
+	}
+}
+
+func FuzzStrictCheck(f *testing.F) {
+	for _, s := range []string{
+		"query=up&time=0",
+		"query=up&query=up",
+		"match[]=" + url.QueryEscape(`{job="a"}`) + "&start=1e300",
+		"query=" + url.QueryEscape(`sum(rate(x{a=~"b|c"}[5m])) by (d)`),
+		"storeMatch[]=x",
+	} {
+		f.Add("/api/v1/query", s)
+	}
+
+	s, err := newStrictValidator(StrictRequests{}, prometheus.NewRegistry())
+	if err != nil {
+		f.Fatalf("unexpected error: %v", err)
+	}
+
+	f.Fuzz(func(t *testing.T, handler, query string) {
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return
+		}
+
+		reason, err := s.check(handler, []string{"ns1"}, params)
+		if (reason == "") != (err == nil) {
+			t.Fatalf("inconsistent result for %q: reason %q, error %v", query, reason, err)
+		}
+	})
+}
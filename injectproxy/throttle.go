@@ -0,0 +1,85 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throttlingHeaders are the response headers telling when a throttled
+// client may send requests again, in order of precedence. Retry-After is
+// returned by Prometheus and Thanos (e.g. when the query gate is full) and
+// the rate limit headers by Mimir and the API gateways in front of it.
+var throttlingHeaders = []string{
+	"Retry-After",
+	"RateLimit-Reset",
+	"X-RateLimit-Reset",
+}
+
+// minUnixReset is the value above which a rate limit reset header holds a
+// Unix timestamp instead of a number of seconds.
+const minUnixReset = 1_000_000_000
+
+// upstreamThrottling returns how long the upstream asks the clients to wait
+// when the response is a 429 or 503 status code with a throttling header.
+func upstreamThrottling(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	for _, h := range throttlingHeaders {
+		v := strings.TrimSpace(resp.Header.Get(h))
+		if v == "" {
+			continue
+		}
+
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil && secs >= 0 {
+			if secs >= minUnixReset {
+				return max(0, time.Unix(secs, 0).Sub(now)), true
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+
+		// Retry-After also accepts an HTTP date.
+		if t, err := http.ParseTime(v); err == nil {
+			return max(0, t.Sub(now)), true
+		}
+	}
+
+	return 0, false
+}
+
+// markUpstreamThrottled records that the upstream throttled the request and
+// asked to wait for the given duration.
+func markUpstreamThrottled(ctx context.Context, retryAfter time.Duration) {
+	if o := outcomeFrom(ctx); o != nil {
+		o.retryAfter.Store(int64(retryAfter))
+		o.throttled.Store(true)
+	}
+}
+
+// upstreamThrottled returns whether the upstream throttled the request and
+// how long it asked to wait.
+func upstreamThrottled(ctx context.Context) (time.Duration, bool) {
+	o := outcomeFrom(ctx)
+	if o == nil || !o.throttled.Load() {
+		return 0, false
+	}
+
+	return time.Duration(o.retryAfter.Load()), true
+}
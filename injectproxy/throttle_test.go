@@ -0,0 +1,105 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUpstreamThrottling(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name    string
+		status  int
+		headers map[string]string
+
+		exp          time.Duration
+		expThrottled bool
+	}{
+		{
+			name:         "retry-after seconds",
+			status:       http.StatusTooManyRequests,
+			headers:      map[string]string{"Retry-After": "5"},
+			exp:          5 * time.Second,
+			expThrottled: true,
+		},
+		{
+			name:         "retry-after date",
+			status:       http.StatusServiceUnavailable,
+			headers:      map[string]string{"Retry-After": now.Add(time.Minute).Format(http.TimeFormat)},
+			exp:          time.Minute,
+			expThrottled: true,
+		},
+		{
+			name:         "retry-after date in the past",
+			status:       http.StatusServiceUnavailable,
+			headers:      map[string]string{"Retry-After": now.Add(-time.Minute).Format(http.TimeFormat)},
+			expThrottled: true,
+		},
+		{
+			name:         "rate limit reset",
+			status:       http.StatusTooManyRequests,
+			headers:      map[string]string{"RateLimit-Reset": "10"},
+			exp:          10 * time.Second,
+			expThrottled: true,
+		},
+		{
+			name:         "rate limit reset timestamp",
+			status:       http.StatusTooManyRequests,
+			headers:      map[string]string{"X-RateLimit-Reset": strconv.FormatInt(now.Add(30*time.Second).Unix(), 10)},
+			exp:          30 * time.Second,
+			expThrottled: true,
+		},
+		{
+			name:         "retry-after takes precedence",
+			status:       http.StatusTooManyRequests,
+			headers:      map[string]string{"Retry-After": "1", "X-RateLimit-Reset": "10"},
+			exp:          time.Second,
+			expThrottled: true,
+		},
+		{
+			name:   "no throttling header",
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:    "invalid header",
+			status:  http.StatusTooManyRequests,
+			headers: map[string]string{"Retry-After": "soon"},
+		},
+		{
+			name:    "other status code",
+			status:  http.StatusInternalServerError,
+			headers: map[string]string{"Retry-After": "5"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+			for k, v := range tc.headers {
+				resp.Header.Set(k, v)
+			}
+
+			d, throttled := upstreamThrottling(resp, now)
+			if throttled != tc.expThrottled {
+				t.Fatalf("expected throttled %v, got %v", tc.expThrottled, throttled)
+			}
+			if d != tc.exp {
+				t.Fatalf("expected delay %s, got %s", tc.exp, d)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// timeoutWindowSize is the number of latency samples per handler used
+	// to compute the rolling p99 latency.
+	timeoutWindowSize = 1000
+	// timeoutEvalEvery is the number of samples between 2 updates of the
+	// timeout. It is also the number of samples required before the
+	// timeout is derived from the latency.
+	timeoutEvalEvery = 100
+)
+
+var errAdaptiveTimeout = errors.New("adaptive timeout exceeded")
+
+// AdaptiveTimeouts configures the timeouts derived from the latency of the
+// instant and range queries.
+type AdaptiveTimeouts struct {
+	// Multiplier is applied to the rolling p99 latency to get the
+	// timeout. It defaults to 3.
+	Multiplier float64
+	// MinTimeout is the lower bound of the timeout.
+	MinTimeout time.Duration
+	// MaxTimeout is the upper bound of the timeout. It applies until
+	// enough latency samples have been observed.
+	MaxTimeout time.Duration
+}
+
+// WithAdaptiveTimeouts sets the timeout of the instant and range queries to
+// a multiple of the rolling p99 latency of the handler, within the given
+// bounds. The timeouts shrink when the upstream is fast and relax when the
+// latency increases since the timed out queries count as samples. The
+// queries exceeding their timeout are answered with "504 Gateway Timeout".
+func WithAdaptiveTimeouts(t AdaptiveTimeouts) Option {
+	return optionFunc(func(o *options) {
+		o.adaptiveTimeouts = &t
+	})
+}
+
+// latencyWindow holds the latest latency samples of a handler.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	count   int
+	timeout time.Duration
+}
+
+func (w *latencyWindow) observe(d time.Duration) {
+	if len(w.samples) < timeoutWindowSize {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+		w.next = (w.next + 1) % timeoutWindowSize
+	}
+	w.count++
+}
+
+// p99 returns the 99th percentile of the latency samples.
+func (w *latencyWindow) p99() time.Duration {
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[(len(sorted)*99-1)/100]
+}
+
+type adaptiveTimeouter struct {
+	AdaptiveTimeouts
+	now func() time.Time
+
+	mtx     sync.Mutex
+	windows map[string]*latencyWindow
+
+	timeout  *prometheus.GaugeVec
+	timedOut *prometheus.CounterVec
+}
+
+func newAdaptiveTimeouter(t AdaptiveTimeouts, reg prometheus.Registerer) (*adaptiveTimeouter, error) {
+	if t.Multiplier == 0 {
+		t.Multiplier = 3
+	}
+
+	if t.Multiplier < 1 {
+		return nil, fmt.Errorf("the timeout multiplier must be at least 1, got %v", t.Multiplier)
+	}
+
+	if t.MinTimeout <= 0 || t.MaxTimeout < t.MinTimeout {
+		return nil, fmt.Errorf("invalid timeout bounds [%s, %s]", t.MinTimeout, t.MaxTimeout)
+	}
+
+	return &adaptiveTimeouter{
+		AdaptiveTimeouts: t,
+		now:              time.Now,
+		windows:          map[string]*latencyWindow{},
+		timeout: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "adaptive_timeout_seconds",
+			Help: "Current timeout of the queries derived from the rolling p99 latency, partitioned by handler.",
+		}, []string{"handler"}),
+		timedOut: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "adaptive_timeout_exceeded_requests_total",
+			Help: "Total number of queries which exceeded their adaptive timeout, partitioned by handler.",
+		}, []string{"handler"}),
+	}, nil
+}
+
+// get returns the current timeout of the handler.
+func (a *adaptiveTimeouter) get(handler string) time.Duration {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	w, found := a.windows[handler]
+	if !found {
+		w = &latencyWindow{timeout: a.MaxTimeout}
+		a.windows[handler] = w
+		a.timeout.WithLabelValues(handler).Set(w.timeout.Seconds())
+	}
+
+	return w.timeout
+}
+
+// observe records the latency of a query and updates the timeout of the
+// handler periodically.
+func (a *adaptiveTimeouter) observe(handler string, d time.Duration) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	w := a.windows[handler]
+	w.observe(d)
+	if w.count%timeoutEvalEvery != 0 {
+		return
+	}
+
+	w.timeout = time.Duration(float64(w.p99()) * a.Multiplier)
+	w.timeout = max(a.MinTimeout, min(a.MaxTimeout, w.timeout))
+	a.timeout.WithLabelValues(handler).Set(w.timeout.Seconds())
+}
+
+// adaptTimeout applies the adaptive timeout to the query before calling the
+// next handler.
+func (r *routes) adaptTimeout(next http.HandlerFunc) http.HandlerFunc {
+	if r.timeouter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		handler := handlerName(req.Context())
+		ctx, cancel := context.WithTimeoutCause(req.Context(), r.timeouter.get(handler), errAdaptiveTimeout)
+		defer cancel()
+		if deadline, ok := ctx.Deadline(); ok {
+			RequestContextFrom(ctx).setDeadline(deadline)
+		}
+
+		start := r.timeouter.now()
+		next(w, req.WithContext(ctx))
+
+		if req.Context().Err() != nil {
+			// The latency of the queries canceled by the client is
+			// meaningless.
+			return
+		}
+		r.timeouter.observe(handler, r.timeouter.now().Sub(start))
+
+		if errors.Is(context.Cause(ctx), errAdaptiveTimeout) {
+			r.timeouter.timedOut.WithLabelValues(handler).Inc()
+		}
+	}
+}
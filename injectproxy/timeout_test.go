@@ -0,0 +1,142 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAdaptiveTimeouter(t *testing.T) {
+	a, err := newAdaptiveTimeouter(AdaptiveTimeouts{
+		MinTimeout: time.Second,
+		MaxTimeout: time.Minute,
+	}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const handler = "/api/v1/query"
+	run := func(d time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			a.get(handler)
+			a.observe(handler, d)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		latency time.Duration
+		samples int
+
+		exp time.Duration
+	}{
+		{
+			name:    "not enough samples",
+			latency: time.Second,
+			samples: timeoutEvalEvery - 1,
+			exp:     time.Minute,
+		},
+		{
+			name:    "derived from the latency",
+			latency: time.Second,
+			samples: 1,
+			exp:     3 * time.Second,
+		},
+		{
+			name:    "higher latency",
+			latency: 5 * time.Second,
+			samples: timeoutEvalEvery,
+			exp:     15 * time.Second,
+		},
+		{
+			name:    "maximum timeout",
+			latency: time.Hour,
+			samples: timeoutEvalEvery,
+			exp:     time.Minute,
+		},
+		{
+			name:    "minimum timeout",
+			latency: time.Millisecond,
+			samples: timeoutWindowSize,
+			exp:     time.Second,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			run(tc.latency, tc.samples)
+			if got := a.get(handler); got != tc.exp {
+				t.Fatalf("expected timeout %s, got %s", tc.exp, got)
+			}
+		})
+	}
+
+	for _, at := range []AdaptiveTimeouts{
+		{MaxTimeout: time.Minute},
+		{MinTimeout: time.Minute, MaxTimeout: time.Second},
+		{Multiplier: 0.5, MinTimeout: time.Second, MaxTimeout: time.Minute},
+	} {
+		if _, err := newAdaptiveTimeouter(at, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", at)
+		}
+	}
+}
+
+func TestAdaptTimeout(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("query") == `slow{namespace="ns1"}` {
+			select {
+			case <-time.After(time.Second):
+			case <-req.Context().Done():
+			}
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithAdaptiveTimeouts(AdaptiveTimeouts{MinTimeout: 50 * time.Millisecond, MaxTimeout: 50 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+
+		expCode int
+	}{
+		{query: "up", expCode: http.StatusOK},
+		{query: "slow", expCode: http.StatusGatewayTimeout},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query="+tc.query+"&namespace=ns1", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.timeouter.timedOut.WithLabelValues("/api/v1/query")); got != 1 {
+		t.Fatalf("expected 1 timed out query, got %v", got)
+	}
+}
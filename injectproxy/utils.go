@@ -20,13 +20,58 @@ import (
 )
 
 func prometheusAPIError(w http.ResponseWriter, errorMessage string, code int) {
+	rejectRequest(w, statusReason(code), errorMessage, code)
+}
+
+// rejectRequest replies with the error and the machine-readable reason of
+// the rejection.
+func rejectRequest(w http.ResponseWriter, reason RejectionReason, errorMessage string, code int) {
+	writeAPIError(w, "prom-label-proxy", reason, errorMessage, code)
+}
+
+// badDataError replies with a 400 status code and the "bad_data" error type,
+// like the Prometheus API does for invalid parameters.
+func badDataError(w http.ResponseWriter, errorMessage string) {
+	writeAPIError(w, "bad_data", ReasonBadRequest, errorMessage, http.StatusBadRequest)
+}
+
+func writeAPIError(w http.ResponseWriter, errorType string, reason RejectionReason, errorMessage string, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set(RejectionReasonHeader, string(reason))
 	w.WriteHeader(code)
 
-	res := map[string]string{"status": "error", "errorType": "prom-label-proxy", "error": errorMessage}
+	res := map[string]string{"status": "error", "errorType": errorType, "error": errorMessage, "reason": string(reason)}
 
 	if err := json.NewEncoder(w).Encode(res); err != nil {
 		log.Printf("error: Failed to encode json: %v", err)
 	}
 }
+
+// statusRecorder records the status code and the number of bytes written
+// by the wrapped http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.size += n
+	return n, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
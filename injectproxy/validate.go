@@ -0,0 +1,144 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WithResponseValidation enables the validation of the upstream responses of
+// the Prometheus API (/api/v1/ endpoints). The responses which aren't
+// well-formed Prometheus API documents (e.g. truncated bodies or HTML pages
+// returned by an intermediate load-balancer) are replaced by 502 errors.
+func WithResponseValidation() Option {
+	return optionFunc(func(o *options) {
+		o.responseValidation = true
+	})
+}
+
+var errInvalidUpstreamResponse = errors.New("invalid upstream response")
+
+// responseValidator validates the upstream responses of the Prometheus API.
+type responseValidator struct {
+	invalid *prometheus.CounterVec
+}
+
+func newResponseValidator(reg prometheus.Registerer) *responseValidator {
+	return &responseValidator{
+		invalid: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_invalid_responses_total",
+			Help: "Total number of upstream responses which aren't well-formed Prometheus API documents, partitioned by handler.",
+		}, []string{"handler"}),
+	}
+}
+
+// validate returns an error if the response isn't a well-formed Prometheus
+// API document. The body of the response is preserved.
+func (v *responseValidator) validate(resp *http.Response) error {
+	if v == nil || !strings.HasPrefix(resp.Request.URL.Path, "/api/v1/") {
+		return nil
+	}
+
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return v.invalidResponse(resp, fmt.Errorf("can't read the response: %w", err))
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return v.invalidResponse(resp, fmt.Errorf("gzip decoding error: %w", err))
+		}
+
+		b, err = io.ReadAll(zr)
+		if err != nil {
+			return v.invalidResponse(resp, fmt.Errorf("gzip decoding error: %w", err))
+		}
+	}
+
+	if err := validateAPIResponse(resp.Request.URL.Path, b); err != nil {
+		return v.invalidResponse(resp, err)
+	}
+
+	return nil
+}
+
+func (v *responseValidator) invalidResponse(resp *http.Response, err error) error {
+	v.invalid.WithLabelValues(handlerName(resp.Request.Context())).Inc()
+	return fmt.Errorf("%w: %w", errInvalidUpstreamResponse, err)
+}
+
+// validateAPIResponse returns an error if the body isn't a well-formed
+// Prometheus API document.
+func validateAPIResponse(path string, b []byte) error {
+	var apir apiResponse
+	if err := json.Unmarshal(b, &apir); err != nil {
+		return fmt.Errorf("JSON decoding error: %w", err)
+	}
+
+	switch apir.Status {
+	case "success":
+	case "error":
+		if apir.ErrorType == "" || apir.Error == "" {
+			return errors.New("error response without error type or message")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected response status: %q", apir.Status)
+	}
+
+	if len(apir.Data) == 0 || string(apir.Data) == "null" {
+		return errors.New("success response without data")
+	}
+
+	if path != "/api/v1/query" && path != "/api/v1/query_range" {
+		return nil
+	}
+
+	var data struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(apir.Data, &data); err != nil {
+		return fmt.Errorf("can't decode the query result: %w", err)
+	}
+
+	switch data.ResultType {
+	case "vector", "matrix", "scalar", "string":
+	default:
+		return fmt.Errorf("unexpected result type %q", data.ResultType)
+	}
+
+	if len(data.Result) == 0 {
+		return errors.New("query result without result")
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidateAPIResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path string
+		body string
+
+		valid bool
+	}{
+		{
+			name:  "vector",
+			path:  "/api/v1/query",
+			body:  `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			valid: true,
+		},
+		{
+			name:  "matrix",
+			path:  "/api/v1/query_range",
+			body:  `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"]]}]},"warnings":["partial"]}`,
+			valid: true,
+		},
+		{
+			name:  "series",
+			path:  "/api/v1/series",
+			body:  `{"status":"success","data":[{"__name__":"up"}]}`,
+			valid: true,
+		},
+		{
+			name:  "error",
+			path:  "/api/v1/query",
+			body:  `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+			valid: true,
+		},
+		{
+			name: "truncated",
+			path: "/api/v1/query",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{}`,
+		},
+		{
+			name: "trailing data",
+			path: "/api/v1/query",
+			body: `{"status":"success","data":{"resultType":"vector","result":[]}}{}`,
+		},
+		{
+			name: "HTML",
+			path: "/api/v1/labels",
+			body: `<html><body>Bad Gateway</body></html>`,
+		},
+		{
+			name: "missing status",
+			path: "/api/v1/labels",
+			body: `{"data":["job"]}`,
+		},
+		{
+			name: "missing data",
+			path: "/api/v1/labels",
+			body: `{"status":"success"}`,
+		},
+		{
+			name: "error without message",
+			path: "/api/v1/query",
+			body: `{"status":"error"}`,
+		},
+		{
+			name: "missing result type",
+			path: "/api/v1/query",
+			body: `{"status":"success","data":{"result":[]}}`,
+		},
+		{
+			name: "missing result",
+			path: "/api/v1/query_range",
+			body: `{"status":"success","data":{"resultType":"matrix"}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateAPIResponse(tc.path, []byte(tc.body))
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.FormValue("query") {
+		case `truncated{namespace="ns1"}`:
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[`))
+		case `html{namespace="ns1"}`:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><body>upstream unavailable</body></html>`))
+		case `gzip{namespace="ns1"}`:
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			zw.Close()
+		case `invalid{namespace="ns1"}`:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+		default:
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithResponseValidation(),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query          string
+		acceptEncoding string
+
+		expCode int
+		expBody string
+	}{
+		{
+			query:   "up",
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+		},
+		{
+			query:          "gzip",
+			acceptEncoding: "gzip",
+			expCode:        http.StatusOK,
+		},
+		{
+			query:   "invalid",
+			expCode: http.StatusBadRequest,
+			expBody: `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+		},
+		{
+			query:   "truncated",
+			expCode: http.StatusBadGateway,
+			expBody: `{"status":"error","errorType":"prom-label-proxy","error":"Bad Gateway","reason":"invalid_upstream_response"}` + "\n",
+		},
+		{
+			query:   "html",
+			expCode: http.StatusBadGateway,
+			expBody: `{"status":"error","errorType":"prom-label-proxy","error":"Bad Gateway","reason":"invalid_upstream_response"}` + "\n",
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{"query": []string{tc.query}, proxyLabel: []string{"ns1"}}.Encode(), nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody != "" && w.Body.String() != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.validator.invalid.WithLabelValues("/api/v1/query")); got != 2 {
+		t.Fatalf("expected 2 invalid responses, got %v", got)
+	}
+}
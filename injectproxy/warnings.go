@@ -0,0 +1,60 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// withWarning records a warning in the request context which will be added
+// to the API response. The returned request must be used to serve the query.
+func withWarning(req *http.Request, warning string) *http.Request {
+	ctx, rc := ensureRequestContext(req.Context())
+	rc.AddWarning(warning)
+	return req.WithContext(ctx)
+}
+
+func warnings(ctx context.Context) []string {
+	return RequestContextFrom(ctx).Warnings()
+}
+
+// addWarnings appends the warnings of the request to the "warnings" field of
+// a successful API response.
+func addWarnings(resp *http.Response) error {
+	ws := warnings(resp.Request.Context())
+	if len(ws) == 0 || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	apir, err := getAPIResponse(resp)
+	if err != nil {
+		return fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	apir.Warnings = append(apir.Warnings, ws...)
+
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(apir); err != nil {
+		return fmt.Errorf("can't encode the response: %w", err)
+	}
+	resp.Body = io.NopCloser(&buf)
+	resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+
+	return nil
+}
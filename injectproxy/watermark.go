@@ -0,0 +1,217 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// Watermark configures the tracing information added to the data exported
+// through the proxy.
+type Watermark struct {
+	// Header is the response header holding the tenant, the proxy instance
+	// and the time of the request. Empty disables the header.
+	Header string
+	// Label is added to the series returned by the /federate endpoint
+	// with the tenant and the proxy instance. Empty disables the label.
+	Label string
+	// Instance identifies the proxy instance (e.g. the host name).
+	Instance string
+}
+
+// WithWatermark watermarks the responses so that leaked datasets can be
+// traced back to the tenant, the proxy instance and the time of extraction.
+// The header is set on all the responses to the tenants' requests. The
+// label doesn't include the time, which would create new series at each
+// federation scrape, and its value is "<tenants>@<instance>" with the
+// tenants separated by commas.
+func WithWatermark(w Watermark) Option {
+	return optionFunc(func(o *options) {
+		o.watermark = &w
+	})
+}
+
+type watermarker struct {
+	Watermark
+	now func() time.Time
+
+	labelled prometheus.Counter
+}
+
+func newWatermarker(w Watermark, enforcedLabel string, reg prometheus.Registerer) (*watermarker, error) {
+	if w.Header == "" && w.Label == "" {
+		return nil, errors.New("the watermark requires a header and/or a label")
+	}
+
+	if w.Label != "" {
+		if !model.LabelName(w.Label).IsValid() || strings.HasPrefix(w.Label, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("invalid watermark label %q", w.Label)
+		}
+
+		if w.Label == enforcedLabel {
+			return nil, fmt.Errorf("the watermark label can't be the enforced label %q", w.Label)
+		}
+	}
+
+	return &watermarker{
+		Watermark: w,
+		now:       time.Now,
+		labelled: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "watermarked_federation_responses_total",
+			Help: "Total number of federation responses with the watermark label added to the series.",
+		}),
+	}, nil
+}
+
+// header returns the value of the watermark header.
+func (wm *watermarker) header(tenants []string) string {
+	return url.Values{
+		"tenant":   []string{strings.Join(tenants, ",")},
+		"instance": []string{wm.Instance},
+		"time":     []string{strconv.FormatInt(wm.now().Unix(), 10)},
+	}.Encode()
+}
+
+// label returns the value of the watermark label.
+func (wm *watermarker) label(tenants []string) string {
+	return strings.Join(tenants, ",") + "@" + wm.Instance
+}
+
+// watermarkResponses sets the watermark header when the response is
+// written. Setting it when the headers are sent rather than before calling
+// the next handler ensures that the responses served from the caches (whose
+// stored headers include the watermark of the original response) carry the
+// time of the current request. When the label is enabled, the federation
+// requests ask for the text format which the proxy can rewrite.
+func (r *routes) watermarkResponses(next http.HandlerFunc) http.HandlerFunc {
+	if r.watermark == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		tenants := MustLabelValues(req.Context())
+		if r.watermark.Header != "" {
+			w = &watermarkWriter{ResponseWriter: w, header: r.watermark.Header, value: func() string { return r.watermark.header(tenants) }}
+		}
+
+		if r.watermark.Label != "" && handlerName(req.Context()) == "/federate" {
+			req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+		}
+
+		next(w, req)
+	}
+}
+
+// watermarkWriter sets the watermark header just before the headers are
+// sent.
+type watermarkWriter struct {
+	http.ResponseWriter
+	header string
+	value  func() string
+
+	wroteHeader bool
+}
+
+func (ww *watermarkWriter) WriteHeader(code int) {
+	if !ww.wroteHeader {
+		ww.wroteHeader = true
+		ww.ResponseWriter.Header().Set(ww.header, ww.value())
+	}
+	ww.ResponseWriter.WriteHeader(code)
+}
+
+func (ww *watermarkWriter) Write(b []byte) (int, error) {
+	if !ww.wroteHeader {
+		ww.WriteHeader(http.StatusOK)
+	}
+	return ww.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for http.ResponseController.
+func (ww *watermarkWriter) Unwrap() http.ResponseWriter {
+	return ww.ResponseWriter
+}
+
+// addWatermarkLabel adds the watermark label to the federated series.
+func (r *routes) addWatermarkLabel(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	defer resp.Body.Close()
+	reader := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("gzip decoding error: %w", err)
+		}
+		defer zr.Close()
+
+		reader = zr
+		resp.Header.Del("Content-Encoding")
+	}
+
+	var (
+		buf   bytes.Buffer
+		value = r.watermark.label(MustLabelValues(resp.Request.Context()))
+		dec   = expfmt.NewDecoder(reader, expfmt.ResponseFormat(resp.Header))
+		enc   = expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+	)
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("can't decode the federated metrics: %w", err)
+		}
+
+		for _, m := range mf.Metric {
+			// The watermark overrides the label exposed by the upstream.
+			lps := m.Label[:0]
+			for _, lp := range m.Label {
+				if lp.GetName() != r.watermark.Label {
+					lps = append(lps, lp)
+				}
+			}
+			m.Label = append(lps, &dto.LabelPair{Name: &r.watermark.Label, Value: &value})
+		}
+
+		if err := enc.Encode(&mf); err != nil {
+			return fmt.Errorf("can't encode the federated metrics: %w", err)
+		}
+	}
+	r.watermark.labelled.Inc()
+
+	resp.Body = io.NopCloser(&buf)
+	resp.Header.Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+
+	return nil
+}
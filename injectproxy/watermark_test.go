@@ -0,0 +1,144 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWatermark(t *testing.T) {
+	var accept string
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/federate" {
+			accept = req.Header.Get("Accept")
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			io.WriteString(w, `# TYPE up untyped
+up{job="a",namespace="ns1",origin="upstream"} 1 1700000000000
+up{job="b",namespace="ns1"} 0 1700000000000
+`)
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithWatermark(Watermark{Header: "X-Watermark", Label: "origin", Instance: "proxy-0"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.watermark.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	for _, tc := range []struct {
+		url string
+
+		expBody string
+	}{
+		{
+			url:     "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			expBody: string(okResponse),
+		},
+		{
+			url: "http://prometheus.example.com/federate?match[]=up&namespace=ns1",
+			expBody: `# TYPE up untyped
+up{job="a",namespace="ns1",origin="ns1@proxy-0"} 1 1700000000000
+up{job="b",namespace="ns1",origin="ns1@proxy-0"} 0 1700000000000
+`,
+		},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("X-Watermark"); got != "instance=proxy-0&tenant=ns1&time=1700000000" {
+				t.Fatalf("unexpected watermark header %q", got)
+			}
+
+			if got := w.Body.String(); got != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, got)
+			}
+		})
+	}
+
+	if accept != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Fatalf("unexpected Accept header %q", accept)
+	}
+}
+
+func TestWatermarkOptions(t *testing.T) {
+	for _, w := range []Watermark{
+		{},
+		{Label: "__origin"},
+		{Label: proxyLabel},
+	} {
+		if _, err := newWatermarker(w, proxyLabel, prometheus.NewRegistry()); err == nil {
+			t.Fatalf("expected an error for %+v", w)
+		}
+	}
+}
+
+func TestWatermarkCachedResponse(t *testing.T) {
+	var calls int
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":["up"]}`)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithEnabledLabelsAPI(),
+		WithLabelsCache(time.Minute, 0),
+		WithWatermark(Watermark{Header: "X-Watermark", Instance: "proxy-0"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, now := range []int64{1700000000, 1700000030} {
+		r.watermark.now = func() time.Time { return time.Unix(now, 0) }
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/labels?namespace=ns1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		exp := "instance=proxy-0&tenant=ns1&time=" + strconv.FormatInt(now, 10)
+		if got := w.Header().Get("X-Watermark"); got != exp {
+			t.Fatalf("request %d: expected watermark header %q, got %q", i, exp, got)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected the second response to be served from the cache, got %d upstream calls", calls)
+	}
+}
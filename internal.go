@@ -0,0 +1,166 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/oklog/run"
+)
+
+// internalServerConfig holds the settings shared by the internal listeners
+// (metrics and pprof).
+type internalServerConfig struct {
+	username     string
+	passwordFile string
+	tokenFile    string
+	certFile     string
+	keyFile      string
+	clientCAFile string
+}
+
+// authHandler returns a handler which requires the configured basic auth
+// credentials or bearer token (if any) before calling next.
+func (c internalServerConfig) authHandler(next http.Handler) (http.Handler, error) {
+	var password, token string
+	if c.username != "" {
+		if c.passwordFile == "" {
+			return nil, errors.New("a password file is required with the basic auth username")
+		}
+
+		b, err := os.ReadFile(c.passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the password file: %w", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+
+	if c.tokenFile != "" {
+		b, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the bearer token file: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	if c.username == "" && token == "" {
+		return next, nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			if auth, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found && secureCompare(auth, token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if c.username != "" {
+			if u, p, ok := r.BasicAuth(); ok && secureCompare(u, c.username) && secureCompare(p, password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="prom-label-proxy"`)
+		}
+
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}), nil
+}
+
+// tlsConfig returns the TLS configuration of the internal listeners or nil if
+// TLS isn't enabled. Client certificates are required when a client CA file
+// is configured.
+func (c internalServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.certFile == "" && c.keyFile == "" {
+		if c.clientCAFile != "" {
+			return nil, errors.New("a certificate and a key are required with the client CA file")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.clientCAFile != "" {
+		b, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no valid certificate found in the client CA file")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// addServer runs an internal HTTP server exposing the given handler in the
+// run group.
+func (c internalServerConfig) addServer(g *run.Group, addr, description string, h http.Handler) {
+	h, err := c.authHandler(h)
+	if err != nil {
+		log.Fatalf("Failed to configure the internal server authentication: %v", err)
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		log.Fatalf("Failed to configure the internal server TLS: %v", err)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on internal address: %v", err)
+	}
+
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	srv := &http.Server{Handler: h}
+
+	g.Add(func() error {
+		log.Printf("Listening on %v for %s", l.Addr(), description)
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("Internal server stopped with %v", err)
+			return err
+		}
+		return nil
+	}, func(error) {
+		srv.Close()
+	})
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
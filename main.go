@@ -14,27 +14,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	htmltemplate "html/template"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	texttemplate "text/template"
+	"time"
+	// The busybox image doesn't ship the time zone database used by
+	// -calendar-time-zone.
+	_ "time/tzdata"
 
 	"github.com/metalmatze/signal/internalserver"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/prometheus-community/prom-label-proxy/injectproxy"
 )
 
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 type arrayFlags []string
 
 // String is the method to format the flag's value, part of the flag.Value interface.
@@ -68,6 +81,185 @@ func main() {
 		regexMatch             bool
 		headerUsesListSyntax   bool
 		rulesWithActiveAlerts  bool
+		opaURL                 string
+		opaTimeout             time.Duration
+		subjectHeader          string
+		spiceDBURL             string
+		spiceDBTokenFile       string
+		spiceDBSubjectType     string
+		spiceDBResourceType    string
+		spiceDBPermission      string
+		spiceDBCacheTTL        time.Duration
+		curatedTenants         arrayFlags
+		curatedRefreshInterval time.Duration
+		detectUpstream         bool
+		detectUpstreamInterval time.Duration
+		metricsNamespace       string
+		metricsConstLabels     arrayFlags
+		profilingLabels        bool
+		latencyObjective       time.Duration
+		latencyBudget          time.Duration
+		latencyBudgetOverrides arrayFlags
+		tenantMaxConcurrency   int
+		tenantMinConcurrency   int
+		endpointConcurrency    arrayFlags
+		tenantQueueLength      int
+		tenantQueueWait        time.Duration
+		budgetIncreaseStep     int
+		budgetDecreaseFactor   float64
+		backpressureAlgorithm  string
+		backpressureErrorRatio float64
+		backpressureSlowStart  bool
+		slowStartIdle          time.Duration
+		decreaseCooldown       time.Duration
+		labelsCacheTTL         time.Duration
+		labelValuesCacheTTL    time.Duration
+		queryCacheTTL          time.Duration
+		cacheSnapshotFile      string
+		queryCoalescing        bool
+		activeQueries          bool
+		disabledTenantsFile    string
+		disabledTenantsAPI     bool
+		exemptionKeyFile       string
+		exemptionMaxTTL        time.Duration
+		queueMaxConcurrent     int
+		queueMaxLength         int
+		queueMaxWait           time.Duration
+		queuePriorityHeader    string
+		queueInteractiveWeight int
+		queueBatchWeight       int
+		maxConnsPerIP          int
+		shedMaxCPU             float64
+		shedMaxMemoryBytes     uint64
+		shedMaxGoroutines      int
+		shedMaxHeapBytes       uint64
+		shedMaxGCPause         float64
+		shedMaxCPUThrottling   float64
+		gogc                   string
+		memoryLimitBytes       int64
+		memoryBallastBytes     int64
+		rewriteRulesFile       string
+		blocklistFile          string
+		queryOptionsFile       string
+		allowlistFile          string
+		probesFile             string
+		probeInterval          time.Duration
+		slowQueryThreshold     time.Duration
+		aggregateOnlyTenants   arrayFlags
+		classificationCache    int
+		maxLookback            time.Duration
+		maxLookbackMode        string
+		aggregateMinGroupSize  int
+		aggregateNoiseEpsilon  float64
+		aggregateSensitivity   float64
+		postAggTenants         arrayFlags
+		postAggWithout         string
+		postAggOp              string
+		trustedProxies         arrayFlags
+		cacheMaxBytes          int64
+		maxPointsPerSeries     int
+		minStep                time.Duration
+		downsampling5mAfter    time.Duration
+		downsampling1hAfter    time.Duration
+		alignStep              bool
+		maxDataPoints          int
+		queryMemoizations      arrayFlags
+		eventsLog              bool
+		eventsWebhookURL       string
+		eventsWebhookInterval  time.Duration
+		auditLogFile           string
+		auditWebhookURL        string
+		auditWebhookInterval   time.Duration
+		tenantOnboarding       bool
+		stateStore             string
+		stateFile              string
+		redisAddress           string
+		redisPasswordFile      string
+		memcachedAddress       string
+		storeMaxIdleConns      int
+		storeTimeout           time.Duration
+		cacheStore             string
+		cacheEncoding          string
+		hedgingDelay           time.Duration
+		rolloutRules           arrayFlags
+		rolloutPercentage      float64
+		rolloutTenants         arrayFlags
+		enableConnectAPI       bool
+		htmlErrorTemplateFile  string
+		jsonErrorTemplateFile  string
+		federateMaxConcurrent  int
+		federateBytesPerSecond int64
+		retryMaxAttempts       int
+		retryInitialBackoff    time.Duration
+		retryMaxBackoff        time.Duration
+		retryHonorRetryAfter   bool
+		upstreamThrottling     bool
+		clientMetrics          bool
+		clientHeaders          arrayFlags
+		rangeToInstant         bool
+		breakerErrorRatio      float64
+		breakerMinRequests     int
+		breakerWindow          time.Duration
+		breakerOpenDuration    time.Duration
+		breakerProbes          int
+		bodyMemoryLimit        int64
+		bodyMaxSize            int64
+		bodyTempDir            string
+		rateLimitHeader        string
+		rateLimitFile          string
+		dnsRefreshInterval     time.Duration
+		dialFailureCooldown    time.Duration
+		prewarmConnections     int
+		tlsSessionCacheSize    int
+		enableExports          bool
+		exportPageInterval     time.Duration
+		exportPagesPerSecond   float64
+		exportRetention        time.Duration
+		responseHeaders        arrayFlags
+		decisionHeaders        bool
+		effectiveQuery         string
+		shadowUpstream         string
+		shadowPercentage       float64
+		shadowTimeout          time.Duration
+		splitInterval          time.Duration
+		splitParallelism       int
+		splitAdaptive          bool
+		replayWindow           time.Duration
+		shardingShards         int
+		shardingLabel          string
+		responseValidation     bool
+		maxTenantSelectors     int
+		tenantSelectorsWindow  time.Duration
+		maxInflight            int
+		maxInflightWait        time.Duration
+		calendarTimeZone       string
+		calendarTimeZones      arrayFlags
+		calendarWeekStart      string
+		timeoutMultiplier      float64
+		limitHandoff           bool
+		limitHandoffTTL        time.Duration
+		limitCheckpointFile    string
+		limitCheckpointEvery   time.Duration
+		limitCheckpointMaxAge  time.Duration
+		shutdownGracePeriod    time.Duration
+		strictRequests         bool
+		maxLabelValueLength    int
+		pacingRate             float64
+		pacingBurst            int
+		pacingMaxDelay         time.Duration
+		watermarkHeader        string
+		watermarkLabel         string
+		watermarkInstance      string
+		signingKeyFile         string
+		verificationKeyFile    string
+		signedHeaders          string
+		signingTenantHeader    string
+		signatureMaxSkew       time.Duration
+		minTimeout             time.Duration
+		maxTimeout             time.Duration
+
+		internalPprofListenAddress string
+		internalCfg                internalServerConfig
 	)
 
 	flagset := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
@@ -89,6 +281,192 @@ func main() {
 	flagset.BoolVar(&headerUsesListSyntax, "header-uses-list-syntax", false, "When specified, the header line value will be parsed as a comma-separated list. This allows a single tenant header line to specify multiple tenant names.")
 	flagset.BoolVar(&rulesWithActiveAlerts, "rules-with-active-alerts", false, "When true, the proxy will return alerting rules with active alerts matching the tenant label even when the tenant label isn't present in the rule's labels.")
 
+	flagset.StringVar(&opaURL, "opa-url", "", "The URL of an Open Policy Agent Data API document (e.g. http://localhost:8181/v1/data/prometheus/authz) which authorizes the requests. "+
+		"The policy receives the tenant values, the method, the path, the query, the selectors and the time range as input and should return either a boolean or an object with the \"allow\", \"reason\" and \"annotations\" fields.")
+	flagset.DurationVar(&opaTimeout, "opa-timeout", 5*time.Second, "The timeout of the requests sent to the -opa-url. The requests are rejected when the OPA server doesn't answer in time.")
+	flagset.StringVar(&subjectHeader, "authorization-subject-header", "", "Name of the HTTP header identifying the requester which is passed to the authorization services (e.g. X-Forwarded-User).")
+	flagset.StringVar(&spiceDBURL, "spicedb-url", "", "The URL of a SpiceDB HTTP API which checks that the requester has the -spicedb-permission permission on every tenant. It requires -authorization-subject-header.")
+	flagset.StringVar(&spiceDBTokenFile, "spicedb-token-file", "", "Path to a file containing the pre-shared key used to authenticate against SpiceDB.")
+	flagset.StringVar(&spiceDBSubjectType, "spicedb-subject-type", "user", "The SpiceDB object type of the requester.")
+	flagset.StringVar(&spiceDBResourceType, "spicedb-resource-type", "tenant", "The SpiceDB object type of the tenant label values.")
+	flagset.StringVar(&spiceDBPermission, "spicedb-permission", "read_metrics", "The SpiceDB permission checked on the tenant resources.")
+	flagset.DurationVar(&spiceDBCacheTTL, "spicedb-cache-ttl", time.Minute, "The duration for which the SpiceDB decisions are cached. 0 disables the cache.")
+	flagset.Var(&curatedTenants, "curated-tenant", "A tenant value which can only query the metrics produced by the upstream's recording rules. It can be repeated and can't be used with -regex-match.")
+	flagset.DurationVar(&curatedRefreshInterval, "curated-metrics-refresh-interval", time.Minute, "The interval at which the recording rules of the upstream are refreshed for the curated tenants.")
+	flagset.BoolVar(&detectUpstream, "detect-upstream", false, "When enabled, the flavor of the upstream (Prometheus, Thanos, Mimir or VictoriaMetrics) is detected from its build information and flags. The APIs it doesn't support return 404 and the unsupported Thanos query options are removed from the requests.")
+	flagset.DurationVar(&detectUpstreamInterval, "detect-upstream-interval", 5*time.Minute, "The interval at which the flavor of the upstream is detected again with -detect-upstream.")
+	flagset.StringVar(&metricsNamespace, "metrics-namespace", "", "A prefix added to the names of the metrics exposed by the proxy (e.g. \"prom_label_proxy\"), useful when several instances feed the same Prometheus.")
+	flagset.Var(&metricsConstLabels, "metrics-const-label", "A constant label added to the metrics exposed by the proxy, in the form <name>=<value> (e.g. cluster=eu-west-1). It can be repeated.")
+	flagset.StringVar(&internalPprofListenAddress, "internal-pprof-listen-address", "", "The address the internal prom-label-proxy HTTP server should listen on to expose pprof. If empty, pprof is exposed on -internal-listen-address.")
+	flagset.StringVar(&internalCfg.username, "internal-auth-username", "", "The username required to access the internal servers with basic authentication.")
+	flagset.StringVar(&internalCfg.passwordFile, "internal-auth-password-file", "", "Path to a file containing the password required to access the internal servers with basic authentication.")
+	flagset.StringVar(&internalCfg.tokenFile, "internal-auth-token-file", "", "Path to a file containing the bearer token required to access the internal servers.")
+	flagset.StringVar(&internalCfg.certFile, "internal-tls-cert-file", "", "Path to the TLS certificate of the internal servers.")
+	flagset.StringVar(&internalCfg.keyFile, "internal-tls-key-file", "", "Path to the TLS key of the internal servers.")
+	flagset.StringVar(&internalCfg.clientCAFile, "internal-tls-client-ca-file", "", "Path to the CA certificates used to verify the client certificates of the internal servers (mTLS).")
+	flagset.BoolVar(&profilingLabels, "enable-profiling-labels", false, "When specified, the proxy attaches the \"handler\" and \"tenant\" pprof labels to the goroutines serving the requests so that continuous profilers can attribute the CPU usage.")
+	flagset.DurationVar(&latencyObjective, "slo-latency-objective", 0, "When specified, the proxy exposes the http_slo_requests_total metric counting the requests served faster than the given latency without server error (good) and the others (bad), for use in burn-rate alerts.")
+	flagset.DurationVar(&latencyBudget, "tenant-latency-budget", 0, "When specified, the concurrency limit of a tenant for a given endpoint is halved when the p99 latency of its requests exceeds this budget and raised again while the latency stays within the budget.")
+	flagset.Var(&latencyBudgetOverrides, "tenant-latency-budget-override", "A latency budget for a specific tenant in the form <tenant>=<duration> (e.g. batch=30s). It can be repeated.")
+	flagset.IntVar(&tenantMaxConcurrency, "tenant-max-concurrency", 10, "The maximum number of concurrent requests per tenant and endpoint when -tenant-latency-budget is set.")
+	flagset.IntVar(&tenantMinConcurrency, "tenant-min-concurrency", 1, "The minimum number of concurrent requests per tenant and endpoint when -tenant-latency-budget is set.")
+	flagset.Var(&endpointConcurrency, "tenant-endpoint-concurrency", "The bounds of the concurrency limit for a specific endpoint in the form <endpoint>=<min>:<max> (e.g. /api/v1/query_range=1:4), so that the range queries don't starve the instant queries. It can be repeated.")
+	flagset.IntVar(&tenantQueueLength, "tenant-queue-length", 0, "The maximum number of requests per tenant and endpoint waiting for a slot when the concurrency limit of -tenant-latency-budget is reached. 0 rejects the requests immediately.")
+	flagset.DurationVar(&tenantQueueWait, "tenant-queue-max-wait", 5*time.Second, "How long a queued request waits for a slot before being rejected with 429 when -tenant-queue-length is set.")
+	flagset.IntVar(&budgetIncreaseStep, "backpressure-increase-step", 1, "The number of slots added to the concurrency limit of a tenant while its latency stays within -tenant-latency-budget (additive increase).")
+	flagset.Float64Var(&budgetDecreaseFactor, "backpressure-decrease-factor", 0.5, "The factor applied to the concurrency limit of a tenant when its latency exceeds -tenant-latency-budget (multiplicative decrease). It must be between 0 and 1 (exclusive).")
+	flagset.StringVar(&backpressureAlgorithm, "backpressure-algorithm", string(injectproxy.BackpressureAIMD), "The algorithm adjusting the concurrency limits per tenant and endpoint: 'aimd' compares the p99 latency with -tenant-latency-budget, 'gradient' compares the recent average latency with the long-term average and requires no latency budget.")
+	flagset.Float64Var(&backpressureErrorRatio, "backpressure-max-error-ratio", 0, "When specified, the concurrency limit of a tenant for a given endpoint is also decreased when the ratio of its requests for which the upstream was overloaded (429, 503 or 504 status codes, timeouts and connection errors) exceeds this value (between 0 and 1). 0 disables the error signal.")
+	flagset.BoolVar(&backpressureSlowStart, "backpressure-slow-start", false, "When enabled, the concurrency limit of a tenant for a given endpoint starts at -tenant-min-concurrency and doubles at each adjustment until the first backpressure signal instead of starting at -tenant-max-concurrency.")
+	flagset.DurationVar(&slowStartIdle, "backpressure-slow-start-idle", 0, "When specified with -backpressure-slow-start, the slow start restarts for the tenants and endpoints without requests during this period. 0 applies the slow start on startup only.")
+	flagset.BoolVar(&upstreamThrottling, "backpressure-upstream-throttling", false, "When enabled, the concurrency limit of a tenant for a given endpoint is decreased as soon as the upstream throttles one of its requests (429 or 503 status code with a Retry-After or rate limit reset header) instead of waiting for the next adjustment.")
+	flagset.DurationVar(&decreaseCooldown, "backpressure-decrease-cooldown", 0, "When specified, the concurrency limit of a tenant for a given endpoint isn't decreased again during this period after a decrease, so that a sustained backpressure signal doesn't collapse the limit to -tenant-min-concurrency in a few requests. 0 disables the cooldown.")
+	flagset.DurationVar(&labelsCacheTTL, "labels-cache-ttl", 0, "When specified with -enable-label-apis, the successful responses of the /api/v1/labels endpoint are cached for the given duration.")
+	flagset.DurationVar(&labelValuesCacheTTL, "label-values-cache-ttl", 0, "When specified with -enable-label-apis, the successful responses of the /api/v1/label/<name>/values endpoint are cached for the given duration.")
+	flagset.DurationVar(&queryCacheTTL, "query-cache-ttl", 0, "When specified, the successful responses of the instant and range queries are cached for the given duration, keyed by the normalized expression and time parameters.")
+	flagset.StringVar(&cacheSnapshotFile, "cache-snapshot-file", "", "When specified, the in-memory response cache is saved to this file on shutdown and loaded from it on startup. The expired entries are dropped on startup.")
+	flagset.BoolVar(&queryCoalescing, "enable-query-coalescing", false, "When enabled, the identical instant and range queries received concurrently share a single upstream request.")
+	flagset.StringVar(&disabledTenantsFile, "disabled-tenants-file", "", "Path to a YAML file with the disabled tenants and their messages. All the requests of the disabled tenants are rejected with 403 and their message.")
+	flagset.BoolVar(&disabledTenantsAPI, "enable-disabled-tenants-api", false, "When enabled, the disabled tenants are listed at /-/disabled-tenants on the internal listen address. A tenant can be disabled with a POST request and enabled again with a DELETE request, with the tenant as the \"tenant\" parameter and an optional \"message\" parameter. The changes are kept in memory and recorded as events.")
+	flagset.StringVar(&exemptionKeyFile, "exemption-token-key-file", "", "Path to a file with the secret key signing the limits exemption tokens. When specified, the tokens are issued with a POST request to /-/exemption-tokens on the internal listen address (\"tenant\", \"user\", \"reason\" and optional \"ttl\" parameters) and the requests of the user with the token in the X-Prom-Label-Proxy-Exemption header bypass the range and cost limits of the tenant. It requires -authorization-subject-header.")
+	flagset.DurationVar(&exemptionMaxTTL, "exemption-token-max-ttl", time.Hour, "The maximum (and default) lifetime of the limits exemption tokens.")
+	flagset.BoolVar(&activeQueries, "enable-active-queries", false, "When enabled, the in-flight instant and range queries are listed at /-/active-queries on the internal listen address. A query can be cancelled with a DELETE request and its id as the \"id\" parameter.")
+	flagset.IntVar(&queueMaxConcurrent, "query-queue-max-concurrent", 0, "When specified, at most this number of instant and range queries are sent concurrently to the upstream. The other queries wait in a queue.")
+	flagset.IntVar(&queueMaxLength, "query-queue-max-length", 0, "The maximum number of queries waiting in the queue. The queries are rejected with 429 when the queue is full. 0 means no limit.")
+	flagset.DurationVar(&queueMaxWait, "query-queue-max-wait", 0, "The maximum duration a query waits in the queue before being rejected with 429. 0 means no limit.")
+	flagset.StringVar(&queuePriorityHeader, "query-priority-header", "", "The request header holding the priority class of the queries (interactive or batch), used by the query queue and the load shedding. The queries without the header are interactive.")
+	flagset.IntVar(&queueInteractiveWeight, "query-queue-interactive-weight", 3, "The share of the upstream capacity given to the interactive queries when queries of both classes are queued.")
+	flagset.IntVar(&queueBatchWeight, "query-queue-batch-weight", 1, "The share of the upstream capacity given to the batch queries when queries of both classes are queued.")
+	flagset.Float64Var(&shedMaxCPU, "load-shedding-max-cpu", 0, "When specified, the batch queries (see -query-priority-header) are rejected with 503 while the CPU utilization of the proxy is above this ratio (between 0 and 1).")
+	flagset.Uint64Var(&shedMaxMemoryBytes, "load-shedding-max-memory-bytes", 0, "When specified, the batch queries (see -query-priority-header) are rejected with 503 while the memory used by the proxy is above this number of bytes.")
+	flagset.IntVar(&shedMaxGoroutines, "load-shedding-max-goroutines", 0, "When specified, the batch queries (see -query-priority-header) are rejected with 503 while the proxy runs more goroutines than this number.")
+	flagset.Uint64Var(&shedMaxHeapBytes, "load-shedding-max-heap-bytes", 0, "When specified, the batch queries (see -query-priority-header) are rejected with 503 while the heap objects of the proxy occupy more than this number of bytes.")
+	flagset.Float64Var(&shedMaxGCPause, "load-shedding-max-gc-pause-ratio", 0, "When specified, the batch queries (see -query-priority-header) are rejected with 503 while the proxy spends more than this fraction of the time (between 0 and 1) paused by the garbage collector.")
+	flagset.StringVar(&gogc, "gogc", "", "When specified, the garbage collection target percentage of the proxy or 'off' to collect only when -memory-limit-bytes is reached. It overrides the GOGC environment variable.")
+	flagset.Int64Var(&memoryLimitBytes, "memory-limit-bytes", 0, "When specified, the soft memory limit of the proxy in bytes: the garbage collector runs more often as the limit is approached. It overrides the GOMEMLIMIT environment variable. 0 keeps the default.")
+	flagset.Int64Var(&memoryBallastBytes, "memory-ballast-bytes", 0, "When specified, a memory ballast of this size is allocated on startup to reduce the frequency of the garbage collections when the live heap is small. The ballast doesn't count in the resident memory. 0 disables the ballast.")
+	flagset.Float64Var(&shedMaxCPUThrottling, "load-shedding-max-cpu-throttling-ratio", 0, "When specified, the batch queries (see -query-priority-header) are rejected with 503 while the cgroup of the proxy is throttled during more than this fraction of the CPU periods (between 0 and 1).")
+	flagset.IntVar(&maxConnsPerIP, "max-connections-per-ip", 0, "When specified, the maximum number of simultaneous connections per client IP address. For the requests relayed by a -trusted-proxy, it limits the concurrent requests per client address found in the X-Forwarded-For header instead.")
+	flagset.Var(&trustedProxies, "trusted-proxy", "The network (in CIDR notation) of a proxy relaying the requests of several clients, e.g. a load balancer. It can be repeated.")
+	flagset.Int64Var(&cacheMaxBytes, "cache-max-bytes", 0, "The maximum total size in bytes of the responses cached by -query-cache-ttl and the labels caches. 0 means no limit.")
+
+	flagset.DurationVar(&downsampling5mAfter, "auto-downsampling-5m-after", 0, "When specified, the max_source_resolution=5m parameter is added to the range queries covering at least this duration unless they set it already. The upstream must be a Thanos querier.")
+	flagset.DurationVar(&downsampling1hAfter, "auto-downsampling-1h-after", 0, "When specified, the max_source_resolution=1h parameter is added to the range queries covering at least this duration unless they set it already. The upstream must be a Thanos querier.")
+	flagset.DurationVar(&minStep, "min-step", 0, "When specified, the step of range queries is raised to at least this duration. A warning is added to the response when the step is raised.")
+	flagset.IntVar(&maxDataPoints, "max-data-points", 0, "When specified, the step of range queries is raised to at least (end-start)/max-data-points, like the maxDataPoints option of Grafana, so that the resolution doesn't grow with the width of the panels. The largest of -min-step and this step applies. A warning is added to the response when the step is raised.")
+	flagset.BoolVar(&alignStep, "align-step", false, "When enabled, the start and end of range queries are moved back to a multiple of the step so that the queries are cacheable.")
+	flagset.StringVar(&calendarTimeZone, "calendar-time-zone", "", "When specified, the start of the range queries with a step multiple of 1d (resp. 1w) is moved back to the midnight of the day (resp. the first day of the week) in this time zone (e.g. Europe/Paris) or the tenant's one, and the end is moved back to the last evaluation timestamp.")
+	flagset.Var(&calendarTimeZones, "calendar-tenant-time-zone", "A time zone for a specific tenant in the form <tenant>=<time zone> (e.g. team-a=America/New_York) used with -calendar-time-zone. It can be repeated.")
+	flagset.StringVar(&calendarWeekStart, "calendar-week-start", "sunday", "The first day of the weeks when -calendar-time-zone is set: sunday or monday.")
+	flagset.IntVar(&maxPointsPerSeries, "max-points-per-series", 0, "When specified, the step of range queries is raised so that at most this number of points is returned per series. A warning is added to the response when the step is raised.")
+	flagset.Var(&queryMemoizations, "query-memoization", "Reuse the results of the instant queries matching a regular expression for a short window, in the form <duration>:<regexp> (e.g. 2s:ALERTS.*). The regular expression is anchored and matched against the query expression. It can be repeated, the first match wins.")
+	flagset.BoolVar(&eventsLog, "events-log", false, "When enabled, the capacity events (concurrency limit decreased, increased or reached) are logged as JSON lines.")
+	flagset.StringVar(&eventsWebhookURL, "events-webhook-url", "", "When specified, the capacity events are sent in batches as JSON arrays to this URL.")
+	flagset.DurationVar(&eventsWebhookInterval, "events-webhook-interval", 10*time.Second, "The interval at which the capacity events are sent to the webhook.")
+	flagset.StringVar(&auditLogFile, "audit-log-file", "", "When specified, every request of the enforced endpoints is appended as a JSON line to this file with its source IP, tenants, expression or matchers and decision (allowed, blocked, shed or failed).")
+	flagset.StringVar(&auditWebhookURL, "audit-webhook-url", "", "When specified, every request of the enforced endpoints is sent to this URL in batches of JSON arrays with its source IP, tenants, expression or matchers and decision (allowed, blocked, shed or failed).")
+	flagset.DurationVar(&auditWebhookInterval, "audit-webhook-interval", 10*time.Second, "The interval at which the audit entries are sent to the webhook.")
+	flagset.BoolVar(&tenantOnboarding, "enable-tenant-onboarding-events", false, "When enabled, a tenant_onboarded event is emitted the first time a tenant is seen. The known tenants are recorded in the state store.")
+	flagset.StringVar(&stateStore, "state-store", "memory", "The backend storing the state of the proxy (e.g. cached authorization decisions). One of: memory, file, redis, memcached.")
+	flagset.StringVar(&stateFile, "state-file", "", "Path to the file storing the state when -state-store=file.")
+	flagset.StringVar(&redisAddress, "redis-address", "", "Address (host:port) of the Redis server storing the state when -state-store=redis.")
+	flagset.StringVar(&redisPasswordFile, "redis-password-file", "", "Path to a file containing the password of the Redis server.")
+	flagset.StringVar(&memcachedAddress, "memcached-address", "", "Address (host:port) of the memcached server when -state-store=memcached or -cache-store=memcached.")
+	flagset.IntVar(&storeMaxIdleConns, "store-max-idle-connections", 8, "The maximum number of idle connections kept open to the Redis or memcached server.")
+	flagset.DurationVar(&storeTimeout, "store-timeout", 5*time.Second, "The timeout of the commands sent to the Redis or memcached server.")
+	flagset.StringVar(&cacheStore, "cache-store", "", "The backend storing the responses of the labels and query caches. One of: memory, redis, memcached. Redis and memcached allow several replicas to share the cache. Defaults to an in-memory LRU cache.")
+	flagset.StringVar(&cacheEncoding, "cache-encoding", "json", "The serialization of the responses in the cache store when -cache-store is set. One of: json, protobuf, snappy (snappy-compressed protobuf). Changing the encoding starts from an empty cache.")
+	flagset.BoolVar(&enableConnectAPI, "enable-connect-api", false, "When specified, the query endpoints are also exposed as Connect and gRPC-Web RPCs (JSON codec only) under /prometheus.v1.QueryService/ and the insecure listener accepts cleartext HTTP/2 (h2c).")
+	flagset.StringVar(&htmlErrorTemplateFile, "html-error-template-file", "", "Path to a Go html/template file rendered when the proxy fails to serve a non-API path (e.g. /graph). The template receives .Status, .StatusText and .Path.")
+	flagset.StringVar(&jsonErrorTemplateFile, "json-error-template-file", "", "Path to a Go text/template file rendered when the proxy fails to serve an API path (under /api/). The template receives .Status, .StatusText, .Path and .Reason, and the json function encodes a value as JSON (e.g. {{ json .StatusText }}).")
+	flagset.IntVar(&federateMaxConcurrent, "federate-max-concurrent", 0, "The maximum number of concurrent requests to the /federate endpoint. Requests exceeding the limit are rejected with 429. 0 means no limit.")
+	flagset.Int64Var(&federateBytesPerSecond, "federate-max-bytes-per-second", 0, "The maximum bandwidth in bytes per second shared by all the /federate responses. 0 means no limit.")
+	flagset.DurationVar(&hedgingDelay, "upstream-hedging-delay", 0, "When specified, a second copy of the instant and range queries is sent to the upstream if the first one didn't return after this delay (e.g. the p95 latency). The first response wins and the other request is cancelled.")
+	flagset.Var(&rolloutRules, "rollout-rule", "A rule enforced only for the tenants of the rollout (see -rollout-percentage and -rollout-tenant). One of: latency-budget, federation-limits, max-points, range-to-instant, step-policy. It can be repeated.")
+	flagset.Float64Var(&rolloutPercentage, "rollout-percentage", 0, "The percentage of the tenants for which the -rollout-rule rules are enforced. The tenants are assigned by hashing their label value.")
+	flagset.Var(&rolloutTenants, "rollout-tenant", "A pilot tenant for which the -rollout-rule rules are always enforced. It can be repeated.")
+	flagset.StringVar(&shadowUpstream, "shadow-upstream", "", "When specified, a sample of the instant and range queries (see -shadow-percentage) is mirrored asynchronously to this upstream URL. The shadow responses are discarded, their status codes and latencies are compared with the primary upstream in the metrics.")
+	flagset.Float64Var(&shadowPercentage, "shadow-percentage", 100, "The percentage of the instant and range queries mirrored to the -shadow-upstream.")
+	flagset.DurationVar(&shadowTimeout, "shadow-timeout", time.Minute, "The timeout of the requests mirrored to the -shadow-upstream.")
+	flagset.IntVar(&retryMaxAttempts, "upstream-retry-max-attempts", 1, "The maximum number of attempts for the instant and range queries failing with a 5xx status code or a timeout. 1 disables the retries.")
+	flagset.DurationVar(&retryInitialBackoff, "upstream-retry-initial-backoff", 100*time.Millisecond, "The delay before the first retry of a failed query. It doubles after every attempt.")
+	flagset.DurationVar(&retryMaxBackoff, "upstream-retry-max-backoff", 2*time.Second, "The maximum delay between 2 attempts of a failed query.")
+	flagset.BoolVar(&retryHonorRetryAfter, "upstream-retry-honor-retry-after", false, "When enabled, the queries throttled by the upstream (429 or 503 status code with a Retry-After or rate limit reset header) are retried after the requested delay, unless it exceeds -upstream-retry-max-backoff.")
+	flagset.BoolVar(&clientMetrics, "enable-client-metrics", false, "When enabled, the requests are counted per client type, derived from the User-Agent header (e.g. grafana, prometheus, curl) or from -client-header.")
+	flagset.Var(&clientHeaders, "client-header", "An HTTP header identifying the client (e.g. X-Client-Name), looked up before the User-Agent header when -enable-client-metrics is set. It can be repeated.")
+	flagset.DurationVar(&splitInterval, "query-range-split-interval", 0, "When specified, the range queries spanning several intervals (e.g. 24h for days) are split into one sub-query per interval. The sub-queries are sent in parallel to the upstream and their results are merged. 0 disables the splitting.")
+	flagset.IntVar(&splitParallelism, "query-range-split-max-parallelism", 8, "The maximum number of sub-queries of a split range query sent concurrently to the upstream.")
+	flagset.BoolVar(&splitAdaptive, "query-range-split-adaptive-parallelism", false, "When enabled, the number of sub-queries of a split range query sent concurrently depends on the free slots of the tenant's concurrency limit, up to -query-range-split-max-parallelism. It requires -tenant-latency-budget or -backpressure-algorithm=gradient.")
+	flagset.DurationVar(&replayWindow, "replay-protection-window", 0, "When specified, the requests creating or expiring silences must carry a unique X-Querymw-Nonce header and an X-Querymw-Timestamp header within this duration of the current time. Requests replaying a nonce are rejected with 403. 0 disables the replay protection.")
+	flagset.IntVar(&shardingShards, "query-sharding-shards", 0, "When greater than 1, the sum, count, min and max aggregations of the instant and range queries are executed as this number of parallel shard queries and their results are merged. The upstream must support the -query-sharding-label label (e.g. Mimir). 0 disables the sharding.")
+	flagset.StringVar(&shardingLabel, "query-sharding-label", "__query_shard__", "The label matcher selecting a shard of the series, injected with the \"<shard>_of_<shards>\" value when -query-sharding-shards is set.")
+	flagset.BoolVar(&responseValidation, "enable-response-validation", false, "When enabled, the upstream responses of the /api/v1/ endpoints are checked to be well-formed Prometheus API documents. Malformed or truncated responses are replaced by 502 errors.")
+	flagset.IntVar(&maxTenantSelectors, "tenant-max-unique-selectors", 0, "When specified, the maximum number of distinct series selectors that a tenant can query with the instant queries, the range queries and the series API within -tenant-unique-selectors-window. Requests adding selectors beyond the limit are rejected with 429. 0 means no limit.")
+	flagset.DurationVar(&tenantSelectorsWindow, "tenant-unique-selectors-window", time.Hour, "The sliding window over which the distinct selectors are counted when -tenant-max-unique-selectors is set.")
+	flagset.DurationVar(&maxTimeout, "adaptive-timeout-max", 0, "When specified, the timeout of the instant and range queries is a multiple (-adaptive-timeout-multiplier) of the rolling p99 latency of the endpoint, bounded by -adaptive-timeout-min and this value. The queries exceeding their timeout are answered with 504. 0 disables the adaptive timeouts.")
+	flagset.DurationVar(&minTimeout, "adaptive-timeout-min", 5*time.Second, "The lower bound of the adaptive timeouts.")
+	flagset.Float64Var(&timeoutMultiplier, "adaptive-timeout-multiplier", 3, "The multiple of the rolling p99 latency used as the adaptive timeout.")
+	flagset.BoolVar(&limitHandoff, "enable-tenant-limit-handoff", false, "When enabled, the concurrency limits learned from the latency budgets (-tenant-latency-budget) are published to the state store on shutdown and inherited by the replicas starting afterwards. It requires -shutdown-grace-period.")
+	flagset.DurationVar(&limitHandoffTTL, "tenant-limit-handoff-ttl", 10*time.Minute, "How long the concurrency limits handed off on shutdown are kept in the state store.")
+	flagset.StringVar(&limitCheckpointFile, "tenant-limit-checkpoint-file", "", "When specified, the concurrency limits learned from the latency budgets (-tenant-latency-budget) are saved periodically and on shutdown to this file and restored from it on startup, so that a restart during an incident doesn't reset the limits to their maximum.")
+	flagset.DurationVar(&limitCheckpointEvery, "tenant-limit-checkpoint-interval", 30*time.Second, "The interval at which the concurrency limits are saved to -tenant-limit-checkpoint-file.")
+	flagset.DurationVar(&limitCheckpointMaxAge, "tenant-limit-checkpoint-max-age", 15*time.Minute, "The maximum age of the -tenant-limit-checkpoint-file checkpoint restored on startup. Older checkpoints are ignored.")
+	flagset.BoolVar(&strictRequests, "strict-requests", false, "When enabled, the requests with repeated single-value parameters, parameters unknown to the query APIs (including unsupported Thanos options), over-long label values or out-of-range timestamps are rejected with 400. Recommended for security-sensitive deployments.")
+	flagset.IntVar(&maxLabelValueLength, "strict-requests-max-label-value-length", 1024, "The maximum length of the enforced label values and of the label values in the matchers when -strict-requests is enabled.")
+	flagset.Float64Var(&pacingRate, "pacing-requests-per-second", 0, "When specified, the requests are released to the upstream at this steady rate to smooth the bursts (e.g. rule evaluations aligned on the same schedule). The requests served from the cache or coalesced aren't delayed. 0 disables the pacing.")
+	flagset.IntVar(&pacingBurst, "pacing-burst", 0, "The number of requests released immediately on top of -pacing-requests-per-second after an idle period.")
+	flagset.DurationVar(&pacingMaxDelay, "pacing-max-delay", 10*time.Second, "How long a request can be delayed by -pacing-requests-per-second. The requests which would be delayed longer are rejected with 503.")
+	flagset.StringVar(&watermarkHeader, "watermark-header", "", "When specified, the responses to the tenants' requests carry this header with the tenant, the proxy instance and the time of the request so that leaked data can be traced back.")
+	flagset.StringVar(&watermarkLabel, "watermark-label", "", "When specified, this label is added to the series returned by the /federate endpoint with the \"<tenants>@<instance>\" value so that leaked data can be traced back.")
+	flagset.StringVar(&watermarkInstance, "watermark-instance", "", "The proxy instance identifier used by -watermark-header and -watermark-label. It defaults to the host name.")
+	flagset.StringVar(&signingKeyFile, "upstream-signing-key-file", "", "Path to a file containing the HMAC key used to sign the upstream requests when the upstream is another prom-label-proxy tier (see -request-verification-key-file).")
+	flagset.StringVar(&verificationKeyFile, "request-verification-key-file", "", "Path to a file containing the HMAC key used to verify that the requests were signed by a trusted outer prom-label-proxy tier (see -upstream-signing-key-file). The requests without a valid signature are rejected with 401.")
+	flagset.StringVar(&signedHeaders, "signed-headers", "", "Comma-separated list of request headers covered by the signature between the proxy tiers (e.g. the priority header). Both tiers must use the same list.")
+	flagset.StringVar(&signingTenantHeader, "signing-tenant-header", "", "When specified, the signing tier sets this header to the enforced label values and covers it by the signature, so that the verifying tier can extract the label values from it with -header-name. Both tiers must use the same header.")
+	flagset.DurationVar(&signatureMaxSkew, "signature-max-skew", 5*time.Minute, "The maximum age of the request signatures, which also bounds the tolerated clock skew between the proxy tiers.")
+	flagset.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", 0, "When specified, the proxy rejects the new requests with 503 on shutdown and waits up to this duration for the in-flight requests to complete. 0 closes the connections immediately.")
+	flagset.IntVar(&maxInflight, "max-inflight-requests", 0, "When specified, the maximum number of requests served concurrently by the proxy. The requests exceeding the limit wait for -max-inflight-requests-wait and are then rejected with 503. 0 means no limit.")
+	flagset.DurationVar(&maxInflightWait, "max-inflight-requests-wait", 0, "How long a request waits for a slot when -max-inflight-requests is reached. 0 rejects the request immediately.")
+	flagset.BoolVar(&rangeToInstant, "convert-single-point-range-queries", false, "When enabled, the range queries returning a single point per series (step greater than end-start) are sent as instant queries to the upstream.")
+	flagset.Float64Var(&breakerErrorRatio, "circuit-breaker-error-ratio", 0, "The ratio of failed upstream requests (between 0 and 1) which opens the circuit breaker. While open, the requests are rejected with 503. 0 disables the circuit breaker.")
+	flagset.IntVar(&breakerMinRequests, "circuit-breaker-min-requests", 20, "The minimum number of upstream requests in the window before the circuit breaker can open.")
+	flagset.DurationVar(&breakerWindow, "circuit-breaker-window", 30*time.Second, "The window over which the failed upstream requests are counted.")
+	flagset.DurationVar(&breakerOpenDuration, "circuit-breaker-open-duration", 30*time.Second, "The duration for which the circuit breaker stays open before probing the upstream.")
+	flagset.IntVar(&breakerProbes, "circuit-breaker-probes", 3, "The number of successful probe requests required to close the circuit breaker.")
+	flagset.Int64Var(&bodyMemoryLimit, "request-body-memory-limit", 1<<20, "The size in bytes above which the request bodies buffered by the cache and the retries are written to a temporary file.")
+	flagset.Int64Var(&bodyMaxSize, "request-body-max-size", 0, "The maximum size in bytes of the request bodies buffered by the cache and the retries. Larger requests are rejected with 413. 0 means no limit.")
+	flagset.Var(&responseHeaders, "response-header", "A header set on all the responses of the proxy, formatted as \"Name: value\" (e.g. \"Strict-Transport-Security: max-age=31536000\"). The value is a Go text/template receiving .Method, .Host, .Path and the .Header function returning a request header. It can be repeated.")
+	flagset.StringVar(&effectiveQuery, "effective-query", "", "When specified, the query evaluated by the upstream (with the enforced label) is returned with the instant and range query responses: 'header' for the X-Querymw-Effective-Query response header, 'warning' for an entry in the warnings of the response.")
+	flagset.BoolVar(&decisionHeaders, "enable-decision-headers", false, "When enabled, the X-Querymw-Cache response header tells whether the response was served from a cache (hit or miss).")
+	flagset.DurationVar(&dnsRefreshInterval, "upstream-dns-refresh-interval", 0, "When specified, the upstream hostname is resolved again at the given interval and its addresses are dialed concurrently (happy eyeballs), the addresses which failed recently being tried last. 0 uses the default Go dialer.")
+	flagset.DurationVar(&dialFailureCooldown, "upstream-dial-failure-cooldown", 30*time.Second, "The duration for which an upstream address is tried last after a failed connection when -upstream-dns-refresh-interval is set.")
+	flagset.IntVar(&prewarmConnections, "upstream-prewarm-connections", 0, "When specified, this number of idle connections to the upstream is established on startup and after the circuit breaker closes again, so that the first requests don't pay the connection and TLS handshake latency. 0 disables the prewarming.")
+	flagset.IntVar(&tlsSessionCacheSize, "upstream-tls-session-cache-size", 0, "When specified, the TLS sessions of the upstream connections are cached (up to this number) and resumed with an abbreviated handshake on the new connections. 0 disables the cache.")
+	flagset.BoolVar(&enableExports, "enable-export-api", false, "When enabled, the tenants can submit export jobs at /api/v1/exports. The proxy executes them in the background as sequential range sub-queries at a controlled rate and the result can be downloaded as NDJSON or CSV once the job is completed.")
+	flagset.DurationVar(&exportPageInterval, "export-page-interval", time.Hour, "The time range of the sub-queries executed by the export jobs when -enable-export-api is set.")
+	flagset.Float64Var(&exportPagesPerSecond, "export-pages-per-second", 1, "The maximum number of sub-queries per second executed by all the export jobs when -enable-export-api is set.")
+	flagset.DurationVar(&exportRetention, "export-retention", time.Hour, "How long the finished export jobs and their result are kept in memory when -enable-export-api is set.")
+	flagset.StringVar(&rateLimitFile, "tenant-rate-limits-file", "", "Path to a YAML file with the per-tenant rate limits (default limit and per-tenant overrides). Requests exceeding the limit are rejected with 429.")
+	flagset.StringVar(&rateLimitHeader, "tenant-rate-limits-header", "X-Scope-OrgID", "The HTTP header identifying the tenant for -tenant-rate-limits-file. Requests without the header share the default bucket.")
+	flagset.StringVar(&rewriteRulesFile, "query-rewrite-rules-file", "", "Path to a YAML file with rules rewriting the expression of the instant and range queries before enforcing the label (e.g. replacing expensive expressions with recording rules).")
+	flagset.DurationVar(&maxLookback, "max-query-lookback", 0, "When specified, the instant and range queries selecting samples older than the given duration (taking the offsets, ranges and subqueries into account) are rejected or clamped depending on -max-query-lookback-mode.")
+	flagset.StringVar(&maxLookbackMode, "max-query-lookback-mode", string(injectproxy.LookbackReject), "What to do with the queries exceeding -max-query-lookback: 'reject' or 'clamp'. In clamp mode, the start of the range queries is moved forward and a warning is added to the response. The instant queries are always rejected.")
+	flagset.IntVar(&classificationCache, "query-classification-cache-size", 0, "When specified, the selectors and the label enforcement results of the last N query expressions are cached in memory to avoid parsing the same expressions repeatedly. 0 disables the cache.")
+	flagset.Var(&aggregateOnlyTenants, "aggregate-only-tenant", "A tenant which can only run sum, avg and count aggregations with the instant and range queries. It can be repeated.")
+	flagset.IntVar(&aggregateMinGroupSize, "aggregate-min-group-size", 0, "The minimum number of series in the aggregation groups returned to the -aggregate-only-tenant tenants. The smaller groups are removed. 0 disables the check.")
+	flagset.Float64Var(&aggregateNoiseEpsilon, "aggregate-noise-epsilon", 0, "When specified, Laplace noise of scale -aggregate-noise-sensitivity/epsilon is added to the values returned to the -aggregate-only-tenant tenants. 0 disables the noise.")
+	flagset.Float64Var(&aggregateSensitivity, "aggregate-noise-sensitivity", 1, "The maximum contribution of a single series to the aggregated values for -aggregate-noise-epsilon.")
+	flagset.Var(&postAggTenants, "post-aggregation-tenant", "A tenant whose instant and range query results are always aggregated without the -post-aggregation-without labels. It can be repeated.")
+	flagset.StringVar(&postAggWithout, "post-aggregation-without", "", "Comma separated list of the sensitive labels aggregated away for the -post-aggregation-tenant tenants (e.g. 'instance,pod').")
+	flagset.StringVar(&postAggOp, "post-aggregation-op", "sum", "The aggregation operator applied for the -post-aggregation-tenant tenants. One of sum, avg, min, max or count.")
+	flagset.StringVar(&blocklistFile, "query-blocklist-file", "", "Path to a YAML file with rules matching the expression or the metric names of the instant and range queries. The matching queries are rejected with 422.")
+	flagset.StringVar(&queryOptionsFile, "query-options-policy-file", "", "Path to a YAML file restricting the Thanos query options (e.g. partial_response or max_source_resolution) per tenant. The disallowed options are removed with a warning or rejected with 403 depending on the configured action.")
+	flagset.StringVar(&allowlistFile, "query-allowlist-file", "", "Path to a YAML file with the allowed expressions, metric names and expression fingerprints. The instant and range queries which don't match are rejected with 403.")
+	flagset.StringVar(&probesFile, "probes-file", "", "Path to a YAML file with canary requests sent periodically through the proxy to the upstream. The results are exposed by the probe_success and probe_duration_seconds metrics.")
+	flagset.DurationVar(&probeInterval, "probe-interval", time.Minute, "The interval between the runs of the -probes-file probes.")
+	flagset.DurationVar(&slowQueryThreshold, "slow-query-threshold", 0, "When specified, the instant and range queries taking longer than the given duration are logged as JSON lines with their expression, time range, tenants, duration and response size. 0 disables the slow query log.")
+	flagset.StringVar(&bodyTempDir, "request-body-temp-dir", "", "The directory of the temporary files holding the large request bodies. Defaults to the system temporary directory.")
+
 	//nolint: errcheck // Parse() will exit on error.
 	flagset.Parse(os.Args[1:])
 	if label == "" {
@@ -122,15 +500,483 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
-	opts := []injectproxy.Option{injectproxy.WithPrometheusRegistry(reg)}
+	var proxyReg prometheus.Registerer = reg
+	if len(metricsConstLabels) > 0 {
+		constLabels := prometheus.Labels{}
+		for _, l := range metricsConstLabels {
+			name, value, found := strings.Cut(l, "=")
+			if !found || !labelNameRe.MatchString(name) {
+				log.Fatalf("Invalid constant label %q, expected <name>=<value>", l)
+			}
+			constLabels[name] = value
+		}
+		proxyReg = prometheus.WrapRegistererWith(constLabels, proxyReg)
+	}
+
+	if metricsNamespace != "" {
+		proxyReg = prometheus.WrapRegistererWithPrefix(metricsNamespace+"_", proxyReg)
+	}
+
+	if err := injectproxy.TuneMemory(injectproxy.MemoryTuning{
+		GOGC:         gogc,
+		MemoryLimit:  memoryLimitBytes,
+		BallastBytes: memoryBallastBytes,
+	}, proxyReg); err != nil {
+		log.Fatalf("Invalid memory settings: %v", err)
+	}
+
+	opts := []injectproxy.Option{injectproxy.WithPrometheusRegistry(proxyReg)}
 	if enableLabelAPIs {
 		opts = append(opts, injectproxy.WithEnabledLabelsAPI())
 	}
 
+	if labelsCacheTTL > 0 || labelValuesCacheTTL > 0 {
+		opts = append(opts, injectproxy.WithLabelsCache(labelsCacheTTL, labelValuesCacheTTL))
+	}
+
+	if queryCacheTTL > 0 || cacheMaxBytes > 0 {
+		opts = append(opts, injectproxy.WithQueryCache(injectproxy.QueryCache{TTL: queryCacheTTL, MaxBytes: cacheMaxBytes}))
+	}
+
+	if cacheSnapshotFile != "" {
+		opts = append(opts, injectproxy.WithCacheSnapshot(cacheSnapshotFile))
+	}
+
+	if queryCoalescing {
+		opts = append(opts, injectproxy.WithQueryCoalescing())
+	}
+
+	if queueMaxConcurrent > 0 {
+		opts = append(opts, injectproxy.WithQueryQueue(injectproxy.QueryQueue{
+			MaxConcurrent:     queueMaxConcurrent,
+			MaxLength:         queueMaxLength,
+			MaxWait:           queueMaxWait,
+			PriorityHeader:    queuePriorityHeader,
+			InteractiveWeight: queueInteractiveWeight,
+			BatchWeight:       queueBatchWeight,
+		}))
+	}
+
+	if shedMaxCPU > 0 || shedMaxMemoryBytes > 0 || shedMaxGoroutines > 0 || shedMaxHeapBytes > 0 || shedMaxGCPause > 0 || shedMaxCPUThrottling > 0 {
+		if queuePriorityHeader == "" {
+			log.Fatalf("-query-priority-header must be set when load shedding is enabled")
+		}
+		opts = append(opts, injectproxy.WithLoadShedding(injectproxy.LoadShedding{
+			MaxCPU:                shedMaxCPU,
+			MaxMemoryBytes:        shedMaxMemoryBytes,
+			MaxGoroutines:         shedMaxGoroutines,
+			MaxHeapBytes:          shedMaxHeapBytes,
+			MaxGCPauseRatio:       shedMaxGCPause,
+			MaxCPUThrottlingRatio: shedMaxCPUThrottling,
+			PriorityHeader:        queuePriorityHeader,
+		}))
+	}
+
+	var tracker *injectproxy.ActiveQueryTracker
+	if activeQueries {
+		if internalListenAddress == "" {
+			log.Fatalf("-internal-listen-address must be set when -enable-active-queries is set")
+		}
+		tracker = injectproxy.NewActiveQueryTracker()
+		opts = append(opts, injectproxy.WithActiveQueryTracker(tracker))
+	}
+
+	if rangeToInstant {
+		opts = append(opts, injectproxy.WithRangeToInstantConversion())
+	}
+
+	if downsampling5mAfter > 0 || downsampling1hAfter > 0 {
+		opts = append(opts, injectproxy.WithAutoDownsampling(injectproxy.Downsampling{
+			FiveMinutesAfter: downsampling5mAfter,
+			OneHourAfter:     downsampling1hAfter,
+		}))
+	}
+
+	if minStep > 0 || maxDataPoints > 0 || alignStep {
+		opts = append(opts, injectproxy.WithStepPolicy(injectproxy.StepPolicy{
+			MinStep:       minStep,
+			MaxDataPoints: maxDataPoints,
+			Align:         alignStep,
+		}))
+	}
+
+	if calendarTimeZone != "" {
+		loc, err := time.LoadLocation(calendarTimeZone)
+		if err != nil {
+			log.Fatalf("Failed to load the time zone %q: %v", calendarTimeZone, err)
+		}
+
+		c := injectproxy.CalendarSnapping{
+			Default: loc,
+			Tenants: map[string]*time.Location{},
+		}
+		for _, o := range calendarTimeZones {
+			tenant, v, _ := strings.Cut(o, "=")
+			loc, err := time.LoadLocation(v)
+			if err != nil || tenant == "" {
+				log.Fatalf("Invalid tenant time zone %q, expected <tenant>=<time zone>", o)
+			}
+			c.Tenants[tenant] = loc
+		}
+
+		switch calendarWeekStart {
+		case "sunday":
+			c.WeekStart = time.Sunday
+		case "monday":
+			c.WeekStart = time.Monday
+		default:
+			log.Fatalf("Invalid -calendar-week-start %q, expected sunday or monday", calendarWeekStart)
+		}
+
+		opts = append(opts, injectproxy.WithCalendarSnapping(c))
+	}
+
+	if maxPointsPerSeries != 0 {
+		if maxPointsPerSeries < 2 {
+			log.Fatalf("-max-points-per-series must be at least 2, got %d", maxPointsPerSeries)
+		}
+		opts = append(opts, injectproxy.WithMaxPointsPerSeries(maxPointsPerSeries))
+	}
+
+	if len(queryMemoizations) > 0 {
+		var rules []injectproxy.QueryMemoization
+		for _, m := range queryMemoizations {
+			v, expr, _ := strings.Cut(m, ":")
+			d, err := time.ParseDuration(v)
+			if err != nil || expr == "" {
+				log.Fatalf("Invalid query memoization %q, expected <duration>:<regexp>", m)
+			}
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				log.Fatalf("Invalid query memoization regexp %q: %v", expr, err)
+			}
+			rules = append(rules, injectproxy.QueryMemoization{Pattern: re, Window: d})
+		}
+		opts = append(opts, injectproxy.WithQueryMemoization(rules...))
+	}
+
+	if enableConnectAPI {
+		opts = append(opts, injectproxy.WithConnectAPI())
+	}
+
+	if clientMetrics {
+		opts = append(opts, injectproxy.WithClientFingerprint(injectproxy.ClientFingerprint{Headers: clientHeaders}))
+	}
+
+	if breakerErrorRatio > 0 {
+		if breakerErrorRatio > 1 || breakerProbes <= 0 {
+			log.Fatalf("-circuit-breaker-error-ratio must be between 0 and 1 and -circuit-breaker-probes must be positive")
+		}
+		opts = append(opts, injectproxy.WithCircuitBreaker(injectproxy.CircuitBreakerConfig{
+			ErrorRatio:   breakerErrorRatio,
+			MinRequests:  breakerMinRequests,
+			Window:       breakerWindow,
+			OpenDuration: breakerOpenDuration,
+			Probes:       breakerProbes,
+		}))
+	}
+
+	if len(responseHeaders) > 0 {
+		var headers []injectproxy.ResponseHeader
+		for _, rh := range responseHeaders {
+			name, value, found := strings.Cut(rh, ":")
+			if !found {
+				log.Fatalf("Invalid -response-header %q: expected \"Name: value\"", rh)
+			}
+			h, err := injectproxy.NewResponseHeader(name, strings.TrimSpace(value))
+			if err != nil {
+				log.Fatalf("Invalid -response-header %q: %v", rh, err)
+			}
+			headers = append(headers, h)
+		}
+		opts = append(opts, injectproxy.WithResponseHeaders(headers...))
+	}
+
+	if effectiveQuery != "" {
+		opts = append(opts, injectproxy.WithEffectiveQuery(injectproxy.EffectiveQueryAnnotation(effectiveQuery)))
+	}
+
+	if decisionHeaders {
+		opts = append(opts, injectproxy.WithDecisionHeaders())
+	}
+
+	if dnsRefreshInterval > 0 {
+		opts = append(opts, injectproxy.WithUpstreamResolution(injectproxy.UpstreamResolution{
+			RefreshInterval: dnsRefreshInterval,
+			FailureCooldown: dialFailureCooldown,
+		}))
+	}
+
+	if prewarmConnections > 0 || tlsSessionCacheSize > 0 {
+		opts = append(opts, injectproxy.WithConnectionPrewarming(injectproxy.ConnectionPrewarming{
+			Connections:         prewarmConnections,
+			TLSSessionCacheSize: tlsSessionCacheSize,
+		}))
+	}
+
+	if enableExports {
+		opts = append(opts, injectproxy.WithBulkExports(injectproxy.BulkExports{
+			PageInterval:   exportPageInterval,
+			PagesPerSecond: exportPagesPerSecond,
+			Retention:      exportRetention,
+		}))
+	}
+
+	if rateLimitFile != "" {
+		limits, err := injectproxy.LoadTenantRateLimits(rateLimitFile)
+		if err != nil {
+			log.Fatalf("Failed to load the tenant rate limits: %v", err)
+		}
+		limits.Header = rateLimitHeader
+		opts = append(opts, injectproxy.WithTenantRateLimits(limits))
+	}
+
+	if blocklistFile != "" {
+		b, err := injectproxy.LoadQueryBlocklist(blocklistFile)
+		if err != nil {
+			log.Fatalf("Failed to load the query blocklist: %v", err)
+		}
+		opts = append(opts, injectproxy.WithQueryBlocklist(b))
+	}
+
+	if queryOptionsFile != "" {
+		p, err := injectproxy.LoadQueryOptionPolicies(queryOptionsFile)
+		if err != nil {
+			log.Fatalf("Failed to load the query option policies: %v", err)
+		}
+		opts = append(opts, injectproxy.WithQueryOptionPolicies(p))
+	}
+
+	if allowlistFile != "" {
+		a, err := injectproxy.LoadQueryAllowlist(allowlistFile)
+		if err != nil {
+			log.Fatalf("Failed to load the query allowlist: %v", err)
+		}
+		opts = append(opts, injectproxy.WithQueryAllowlist(a))
+	}
+
+	if rewriteRulesFile != "" {
+		rules, err := injectproxy.LoadQueryRewriteRules(rewriteRulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load the query rewrite rules: %v", err)
+		}
+		opts = append(opts, injectproxy.WithQueryRewriteRules(rules))
+	}
+
+	var probes *injectproxy.Probes
+	if probesFile != "" {
+		p, err := injectproxy.LoadProbes(probesFile)
+		if err != nil {
+			log.Fatalf("Failed to load the probes: %v", err)
+		}
+		probes = &p
+	}
+
+	if slowQueryThreshold > 0 {
+		opts = append(opts, injectproxy.WithSlowQueryLog(slowQueryThreshold, log.Default()))
+	}
+
+	if maxLookback > 0 {
+		opts = append(opts, injectproxy.WithMaxLookback(injectproxy.MaxLookback{
+			Duration: maxLookback,
+			Mode:     injectproxy.LookbackMode(maxLookbackMode),
+		}))
+	}
+
+	if classificationCache > 0 {
+		opts = append(opts, injectproxy.WithQueryClassificationCache(classificationCache))
+	}
+
+	if len(aggregateOnlyTenants) > 0 {
+		opts = append(opts, injectproxy.WithAggregateOnlyTenants(injectproxy.AggregateOnlyTenants{
+			Tenants:      aggregateOnlyTenants,
+			MinGroupSize: aggregateMinGroupSize,
+			Epsilon:      aggregateNoiseEpsilon,
+			Sensitivity:  aggregateSensitivity,
+		}))
+	}
+
+	if len(postAggTenants) > 0 {
+		opts = append(opts, injectproxy.WithPostAggregation(injectproxy.PostAggregation{
+			Tenants: postAggTenants,
+			Op:      postAggOp,
+			Without: strings.Split(postAggWithout, ","),
+		}))
+	}
+
+	opts = append(opts, injectproxy.WithBodyBufferLimits(injectproxy.BodyBufferLimits{
+		Memory: bodyMemoryLimit,
+		Max:    bodyMaxSize,
+		Dir:    bodyTempDir,
+	}))
+
+	if hedgingDelay > 0 {
+		opts = append(opts, injectproxy.WithRequestHedging(hedgingDelay))
+	}
+
+	if shadowUpstream != "" {
+		u, err := url.Parse(shadowUpstream)
+		if err != nil {
+			log.Fatalf("Failed to parse shadow upstream URL: %v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			log.Fatalf("Invalid scheme for shadow upstream URL %q, only 'http' and 'https' are supported", shadowUpstream)
+		}
+		opts = append(opts, injectproxy.WithShadowUpstream(injectproxy.ShadowUpstream{
+			URL:        u,
+			Percentage: shadowPercentage,
+			Timeout:    shadowTimeout,
+		}))
+	}
+
+	if splitInterval > 0 {
+		opts = append(opts, injectproxy.WithRangeSplitting(injectproxy.RangeSplitting{
+			Interval:            splitInterval,
+			MaxParallelism:      splitParallelism,
+			AdaptiveParallelism: splitAdaptive,
+		}))
+	}
+
+	if shardingShards > 0 {
+		opts = append(opts, injectproxy.WithQuerySharding(injectproxy.QuerySharding{
+			Shards: shardingShards,
+			Label:  shardingLabel,
+		}))
+	}
+
+	if replayWindow > 0 {
+		opts = append(opts, injectproxy.WithReplayProtection(replayWindow))
+	}
+
+	if responseValidation {
+		opts = append(opts, injectproxy.WithResponseValidation())
+	}
+
+	if maxTimeout > 0 {
+		opts = append(opts, injectproxy.WithAdaptiveTimeouts(injectproxy.AdaptiveTimeouts{
+			Multiplier: timeoutMultiplier,
+			MinTimeout: minTimeout,
+			MaxTimeout: maxTimeout,
+		}))
+	}
+
+	if maxInflight > 0 {
+		opts = append(opts, injectproxy.WithConcurrencyLimit(injectproxy.ConcurrencyLimit{
+			MaxInflight: maxInflight,
+			MaxWait:     maxInflightWait,
+		}))
+	}
+
+	if maxTenantSelectors > 0 {
+		opts = append(opts, injectproxy.WithSelectorLimits(injectproxy.SelectorLimits{
+			MaxSelectors: maxTenantSelectors,
+			Window:       tenantSelectorsWindow,
+		}))
+	}
+
+	if len(rolloutRules) > 0 {
+		opts = append(opts, injectproxy.WithEnforcementRollout(injectproxy.Rollout{
+			Rules:      rolloutRules,
+			Percentage: rolloutPercentage,
+			Tenants:    rolloutTenants,
+		}))
+	}
+
+	if retryMaxAttempts > 1 {
+		opts = append(opts, injectproxy.WithUpstreamRetries(injectproxy.RetryConfig{
+			MaxAttempts:     retryMaxAttempts,
+			InitialBackoff:  retryInitialBackoff,
+			MaxBackoff:      retryMaxBackoff,
+			HonorRetryAfter: retryHonorRetryAfter,
+		}))
+	}
+
+	if federateMaxConcurrent > 0 || federateBytesPerSecond > 0 {
+		opts = append(opts, injectproxy.WithFederationLimits(injectproxy.FederationLimits{
+			MaxConcurrent:  federateMaxConcurrent,
+			BytesPerSecond: federateBytesPerSecond,
+		}))
+	}
+
+	if htmlErrorTemplateFile != "" || jsonErrorTemplateFile != "" {
+		var (
+			htmlTmpl *htmltemplate.Template
+			jsonTmpl *texttemplate.Template
+		)
+		if htmlErrorTemplateFile != "" {
+			htmlTmpl, err = htmltemplate.ParseFiles(htmlErrorTemplateFile)
+			if err != nil {
+				log.Fatalf("Failed to parse the HTML error template: %v", err)
+			}
+		}
+		if jsonErrorTemplateFile != "" {
+			jsonTmpl, err = texttemplate.New(filepath.Base(jsonErrorTemplateFile)).Funcs(injectproxy.ErrorTemplateFuncs).ParseFiles(jsonErrorTemplateFile)
+			if err != nil {
+				log.Fatalf("Failed to parse the JSON error template: %v", err)
+			}
+		}
+		opts = append(opts, injectproxy.WithErrorTemplates(htmlTmpl, jsonTmpl))
+	}
+
 	if len(unsafePassthroughPaths) > 0 {
 		opts = append(opts, injectproxy.WithPassthroughPaths(strings.Split(unsafePassthroughPaths, ",")))
 	}
 
+	if latencyObjective > 0 {
+		opts = append(opts, injectproxy.WithLatencyObjective(latencyObjective))
+	}
+
+	if latencyBudget > 0 || backpressureAlgorithm == string(injectproxy.BackpressureGradient) {
+		if tenantMaxConcurrency <= 0 {
+			log.Fatalf("-tenant-max-concurrency must be positive")
+		}
+
+		budgets := injectproxy.LatencyBudgets{
+			Default:            latencyBudget,
+			Tenants:            map[string]time.Duration{},
+			MaxConcurrency:     tenantMaxConcurrency,
+			MinConcurrency:     tenantMinConcurrency,
+			Handlers:           map[string]injectproxy.ConcurrencyBounds{},
+			MaxQueueLength:     tenantQueueLength,
+			MaxQueueWait:       tenantQueueWait,
+			IncreaseStep:       budgetIncreaseStep,
+			DecreaseFactor:     budgetDecreaseFactor,
+			Algorithm:          injectproxy.BackpressureAlgorithm(backpressureAlgorithm),
+			MaxErrorRatio:      backpressureErrorRatio,
+			SlowStart:          backpressureSlowStart,
+			SlowStartIdle:      slowStartIdle,
+			DecreaseCooldown:   decreaseCooldown,
+			UpstreamThrottling: upstreamThrottling,
+		}
+		for _, o := range latencyBudgetOverrides {
+			tenant, v, _ := strings.Cut(o, "=")
+			d, err := time.ParseDuration(v)
+			if err != nil || tenant == "" {
+				log.Fatalf("Invalid latency budget override %q, expected <tenant>=<duration>", o)
+			}
+			budgets.Tenants[tenant] = d
+		}
+		for _, o := range endpointConcurrency {
+			endpoint, v, _ := strings.Cut(o, "=")
+			minV, maxV, _ := strings.Cut(v, ":")
+			lo, err := strconv.Atoi(minV)
+			if err != nil || endpoint == "" {
+				log.Fatalf("Invalid endpoint concurrency %q, expected <endpoint>=<min>:<max>", o)
+			}
+			hi, err := strconv.Atoi(maxV)
+			if err != nil {
+				log.Fatalf("Invalid endpoint concurrency %q, expected <endpoint>=<min>:<max>", o)
+			}
+			budgets.Handlers[endpoint] = injectproxy.ConcurrencyBounds{Min: lo, Max: hi}
+		}
+
+		opts = append(opts, injectproxy.WithLatencyBudgets(budgets))
+	}
+
+	if profilingLabels {
+		opts = append(opts, injectproxy.WithProfilingLabels())
+	}
+
 	if errorOnReplace {
 		opts = append(opts, injectproxy.WithErrorOnReplace())
 	}
@@ -139,6 +985,240 @@ func main() {
 		opts = append(opts, injectproxy.WithActiveAlerts())
 	}
 
+	if opaURL != "" {
+		u, err := url.Parse(opaURL)
+		if err != nil {
+			log.Fatalf("Failed to parse OPA URL: %v", err)
+		}
+		if opaTimeout <= 0 {
+			log.Fatalf("-opa-timeout must be positive, got %v", opaTimeout)
+		}
+		opts = append(opts, injectproxy.WithAuthorizer(injectproxy.NewOPAAuthorizer(u, &http.Client{Timeout: opaTimeout})))
+	}
+
+	remoteStore := injectproxy.RemoteStoreConfig{MaxIdleConns: storeMaxIdleConns, Timeout: storeTimeout}
+	store, err := newStateStore(stateStore, stateFile, redisAddress, redisPasswordFile, memcachedAddress, remoteStore)
+	if err != nil {
+		log.Fatalf("Failed to create the state store: %v", err)
+	}
+
+	if cacheStore != "" {
+		if cacheStore == "file" {
+			log.Fatalf("-cache-store=file isn't supported")
+		}
+		s, err := newStateStore(cacheStore, "", redisAddress, redisPasswordFile, memcachedAddress, remoteStore)
+		if err != nil {
+			log.Fatalf("Failed to create the cache store: %v", err)
+		}
+		opts = append(opts, injectproxy.WithCacheStore(s), injectproxy.WithCacheEncoding(injectproxy.CacheEncoding(cacheEncoding)))
+	}
+
+	if spiceDBURL != "" {
+		if subjectHeader == "" {
+			log.Fatalf("-authorization-subject-header must be set when -spicedb-url is set")
+		}
+
+		u, err := url.Parse(spiceDBURL)
+		if err != nil {
+			log.Fatalf("Failed to parse SpiceDB URL: %v", err)
+		}
+
+		var token string
+		if spiceDBTokenFile != "" {
+			b, err := os.ReadFile(spiceDBTokenFile)
+			if err != nil {
+				log.Fatalf("Failed to read SpiceDB token file: %v", err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+
+		opts = append(opts, injectproxy.WithAuthorizer(injectproxy.NewSpiceDBAuthorizer(injectproxy.SpiceDBConfig{
+			URL:          u,
+			Token:        token,
+			SubjectType:  spiceDBSubjectType,
+			ResourceType: spiceDBResourceType,
+			Permission:   spiceDBPermission,
+			CacheTTL:     spiceDBCacheTTL,
+			Store:        store,
+		})))
+	}
+
+	if eventsLog && eventsWebhookURL != "" {
+		log.Fatalf("-events-log and -events-webhook-url can't be used at the same time")
+	}
+
+	var eventSink injectproxy.EventSink
+	if eventsLog {
+		eventSink = injectproxy.NewLogEventSink(log.Default())
+		opts = append(opts, injectproxy.WithEventSink(eventSink))
+	}
+
+	var webhook *injectproxy.WebhookEventSink
+	if eventsWebhookURL != "" {
+		u, err := url.Parse(eventsWebhookURL)
+		if err != nil {
+			log.Fatalf("Failed to parse events webhook URL: %v", err)
+		}
+		webhook = injectproxy.NewWebhookEventSink(u, nil)
+		eventSink = webhook
+		opts = append(opts, injectproxy.WithEventSink(webhook))
+	}
+
+	if auditLogFile != "" && auditWebhookURL != "" {
+		log.Fatalf("-audit-log-file and -audit-webhook-url can't be used at the same time")
+	}
+
+	if auditLogFile != "" {
+		s, err := injectproxy.NewFileAuditSink(auditLogFile)
+		if err != nil {
+			log.Fatalf("Failed to open the audit log: %v", err)
+		}
+		opts = append(opts, injectproxy.WithAuditSink(s))
+	}
+
+	var auditWebhook *injectproxy.WebhookAuditSink
+	if auditWebhookURL != "" {
+		u, err := url.Parse(auditWebhookURL)
+		if err != nil {
+			log.Fatalf("Failed to parse audit webhook URL: %v", err)
+		}
+		auditWebhook = injectproxy.NewWebhookAuditSink(u, nil)
+		opts = append(opts, injectproxy.WithAuditSink(auditWebhook))
+	}
+
+	var disabledTenants *injectproxy.DisabledTenants
+	if disabledTenantsFile != "" || disabledTenantsAPI {
+		if disabledTenantsAPI && internalListenAddress == "" {
+			log.Fatalf("-internal-listen-address must be set when -enable-disabled-tenants-api is set")
+		}
+
+		var c injectproxy.DisabledTenantsConfig
+		if disabledTenantsFile != "" {
+			var err error
+			c, err = injectproxy.LoadDisabledTenants(disabledTenantsFile)
+			if err != nil {
+				log.Fatalf("Failed to load the disabled tenants: %v", err)
+			}
+		}
+
+		// The changes made with the API are logged when no event sink is
+		// configured.
+		disabledTenants = injectproxy.NewDisabledTenants(c, eventSink)
+		opts = append(opts, injectproxy.WithDisabledTenants(disabledTenants))
+	}
+
+	var exemptions *injectproxy.ExemptionTokens
+	if exemptionKeyFile != "" {
+		if internalListenAddress == "" {
+			log.Fatalf("-internal-listen-address must be set when -exemption-token-key-file is set")
+		}
+
+		key, err := os.ReadFile(exemptionKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read the exemption token key: %v", err)
+		}
+
+		// The issued tokens are logged when no event sink is configured.
+		exemptions, err = injectproxy.NewExemptionTokens(bytes.TrimSpace(key), exemptionMaxTTL, eventSink)
+		if err != nil {
+			log.Fatalf("Failed to configure the exemption tokens: %v", err)
+		}
+		opts = append(opts, injectproxy.WithExemptionTokens(exemptions))
+	}
+
+	if tenantOnboarding {
+		opts = append(opts, injectproxy.WithTenantOnboarding(store))
+	}
+
+	for _, s := range []struct {
+		file   string
+		option func(injectproxy.RequestSigning) injectproxy.Option
+	}{
+		{file: signingKeyFile, option: injectproxy.WithUpstreamSigning},
+		{file: verificationKeyFile, option: injectproxy.WithRequestVerification},
+	} {
+		if s.file == "" {
+			continue
+		}
+
+		key, err := os.ReadFile(s.file)
+		if err != nil {
+			log.Fatalf("Failed to read the signing key: %v", err)
+		}
+
+		rs := injectproxy.RequestSigning{
+			Key:          bytes.TrimSpace(key),
+			TenantHeader: signingTenantHeader,
+			MaxSkew:      signatureMaxSkew,
+		}
+		if signedHeaders != "" {
+			rs.Headers = strings.Split(signedHeaders, ",")
+		}
+		opts = append(opts, s.option(rs))
+	}
+
+	if watermarkHeader != "" || watermarkLabel != "" {
+		if watermarkInstance == "" {
+			if watermarkInstance, err = os.Hostname(); err != nil {
+				log.Fatalf("Failed to get the host name: %v", err)
+			}
+		}
+
+		opts = append(opts, injectproxy.WithWatermark(injectproxy.Watermark{
+			Header:   watermarkHeader,
+			Label:    watermarkLabel,
+			Instance: watermarkInstance,
+		}))
+	}
+
+	if pacingRate > 0 {
+		opts = append(opts, injectproxy.WithRequestPacing(injectproxy.RequestPacing{
+			RequestsPerSecond: pacingRate,
+			Burst:             pacingBurst,
+			MaxDelay:          pacingMaxDelay,
+		}))
+	}
+
+	if strictRequests {
+		opts = append(opts, injectproxy.WithStrictRequests(injectproxy.StrictRequests{MaxLabelValueLength: maxLabelValueLength}))
+	}
+
+	if limitHandoff {
+		if shutdownGracePeriod <= 0 {
+			log.Fatalf("-enable-tenant-limit-handoff requires -shutdown-grace-period")
+		}
+		opts = append(opts, injectproxy.WithLimitHandoff(store, limitHandoffTTL))
+	}
+
+	if limitCheckpointFile != "" {
+		opts = append(opts, injectproxy.WithLimitCheckpoint(limitCheckpointFile, limitCheckpointMaxAge))
+	}
+
+	var curated *injectproxy.CuratedMetricsAuthorizer
+	if len(curatedTenants) > 0 {
+		if regexMatch {
+			// The curated tenants are matched by value while the
+			// label value would be a regular expression.
+			log.Fatalf("-curated-tenant can't be used with -regex-match")
+		}
+		if curatedRefreshInterval <= 0 {
+			log.Fatalf("-curated-metrics-refresh-interval must be positive, got %v", curatedRefreshInterval)
+		}
+
+		curated = injectproxy.NewCuratedMetricsAuthorizer(upstreamURL, nil, curatedTenants)
+		opts = append(opts, injectproxy.WithAuthorizer(curated))
+	}
+
+	var detector *injectproxy.UpstreamDetector
+	if detectUpstream {
+		detector = injectproxy.NewUpstreamDetector(upstreamURL, nil, reg)
+		opts = append(opts, injectproxy.WithUpstreamDetector(detector))
+	}
+
+	if subjectHeader != "" {
+		opts = append(opts, injectproxy.WithAuthorizationSubjectHeader(subjectHeader))
+	}
+
 	if regexMatch {
 		if len(labelValues) > 0 {
 			if len(labelValues) > 1 {
@@ -170,6 +1250,19 @@ func main() {
 		extractLabeler = injectproxy.HTTPHeaderEnforcer{Name: http.CanonicalHeaderKey(headerName), ParseListSyntax: headerUsesListSyntax}
 	}
 
+	var connLimiter *injectproxy.ClientConnectionLimiter
+	if maxConnsPerIP > 0 {
+		limits := injectproxy.ConnectionLimits{MaxPerIP: maxConnsPerIP}
+		for _, p := range trustedProxies {
+			_, n, err := net.ParseCIDR(p)
+			if err != nil {
+				log.Fatalf("Invalid trusted proxy %q: %v", p, err)
+			}
+			limits.TrustedProxies = append(limits.TrustedProxies, n)
+		}
+		connLimiter = injectproxy.NewClientConnectionLimiter(limits, reg)
+	}
+
 	var g run.Group
 
 	{
@@ -179,15 +1272,57 @@ func main() {
 			log.Fatalf("Failed to create injectproxy Routes: %v", err)
 		}
 
+		if err := routes.Prewarm(context.Background()); err != nil {
+			// Not fatal: the connections are established on demand.
+			log.Printf("Failed to prewarm the upstream connections: %v", err)
+		}
+
+		if limitCheckpointFile != "" {
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				return routes.CheckpointLimits(ctx, limitCheckpointEvery)
+			}, func(error) {
+				cancel()
+			})
+		}
+
+		if probes != nil {
+			prober, err := injectproxy.NewProber(routes, *probes, reg)
+			if err != nil {
+				log.Fatalf("Failed to create the prober: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				return prober.Run(ctx, probeInterval)
+			}, func(error) {
+				cancel()
+			})
+		}
+
+		var h http.Handler = routes
+		if connLimiter != nil {
+			h = connLimiter.Handler(h)
+		}
+
 		mux := http.NewServeMux()
-		mux.Handle("/", routes)
+		mux.Handle("/", h)
 
 		l, err := net.Listen("tcp", insecureListenAddress)
 		if err != nil {
 			log.Fatalf("Failed to listen on insecure address: %v", err)
 		}
+		if connLimiter != nil {
+			l = connLimiter.Listener(l)
+		}
 
-		srv := &http.Server{Handler: mux}
+		h = mux
+		if enableConnectAPI {
+			// Let the RPC clients use HTTP/2 without TLS on the same port.
+			h = h2c.NewHandler(mux, &http2.Server{})
+		}
+
+		srv := &http.Server{Handler: h}
 
 		g.Add(func() error {
 			log.Printf("Listening insecurely on %v", l.Addr())
@@ -197,35 +1332,115 @@ func main() {
 			}
 			return nil
 		}, func(error) {
-			srv.Close()
+			// The cache is saved once no request can fill it anymore.
+			defer func() {
+				if err := routes.SaveCacheSnapshot(); err != nil {
+					log.Printf("Failed to save the cache snapshot: %v", err)
+				}
+			}()
+
+			if shutdownGracePeriod <= 0 {
+				srv.Close()
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+			defer cancel()
+
+			if err := routes.Drain(ctx); err != nil {
+				log.Printf("Failed to drain the proxy: %v", err)
+			}
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Failed to shut down the server gracefully: %v", err)
+				srv.Close()
+			}
+		})
+	}
+
+	if curated != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return curated.Run(ctx, curatedRefreshInterval)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	if detector != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return detector.Run(ctx, detectUpstreamInterval)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	if webhook != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return webhook.Run(ctx, eventsWebhookInterval)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	if auditWebhook != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return auditWebhook.Run(ctx, auditWebhookInterval)
+		}, func(error) {
+			cancel()
 		})
 	}
 
 	if internalListenAddress != "" {
 		// Run the internal HTTP server.
-		h := internalserver.NewHandler(
+		hopts := []internalserver.Option{
 			internalserver.WithName("Internal prom-label-proxy API"),
 			internalserver.WithPrometheusRegistry(reg),
-			internalserver.WithPProf(),
-		)
-		// Run the HTTP server.
-		l, err := net.Listen("tcp", internalListenAddress)
-		if err != nil {
-			log.Fatalf("Failed to listen on internal address: %v", err)
+		}
+		description := "metrics"
+		if internalPprofListenAddress == "" {
+			hopts = append(hopts, internalserver.WithPProf())
+			description = "metrics and pprof"
 		}
 
-		srv := &http.Server{Handler: h}
+		h := internalserver.NewHandler(hopts...)
 
-		g.Add(func() error {
-			log.Printf("Listening on %v for metrics and pprof", l.Addr())
-			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
-				log.Printf("Internal server stopped with %v", err)
-				return err
-			}
-			return nil
-		}, func(error) {
-			srv.Close()
+		schema, err := injectproxy.NewConfigSchemaHandler(flagset, map[string]interface{}{
+			"tenant-rate-limits-file":  injectproxy.TenantRateLimits{},
+			"query-rewrite-rules-file": injectproxy.QueryRewriteRules{},
+			"query-blocklist-file":     injectproxy.QueryBlocklist{},
+			"query-allowlist-file":     injectproxy.QueryAllowlist{},
+			"probes-file":              injectproxy.Probes{},
+			"disabled-tenants-file":    injectproxy.DisabledTenantsConfig{},
 		})
+		if err != nil {
+			log.Fatalf("Failed to generate the configuration schema: %v", err)
+		}
+		h.AddEndpoint(injectproxy.ConfigSchemaPath, "JSON schema of the configuration", schema.ServeHTTP)
+
+		if tracker != nil {
+			h.AddEndpoint(injectproxy.ActiveQueriesPath, "Lists and cancels the in-flight queries", tracker.ServeHTTP)
+		}
+
+		if disabledTenantsAPI {
+			h.AddEndpoint(injectproxy.DisabledTenantsPath, "Lists, disables and enables the tenants", disabledTenants.ServeHTTP)
+		}
+
+		if exemptions != nil {
+			h.AddEndpoint(injectproxy.ExemptionTokensPath, "Issues the limits exemption tokens", exemptions.ServeHTTP)
+		}
+
+		internalCfg.addServer(&g, internalListenAddress, description, h)
+	}
+
+	if internalPprofListenAddress != "" {
+		// Run the internal HTTP server for pprof.
+		internalCfg.addServer(&g, internalPprofListenAddress, "pprof", internalserver.NewHandler(
+			internalserver.WithName("Internal prom-label-proxy pprof"),
+			internalserver.WithPProf(),
+		))
 	}
 
 	g.Add(run.SignalHandler(context.Background(), syscall.SIGINT, syscall.SIGTERM))
@@ -238,3 +1453,36 @@ func main() {
 		log.Print("Caught signal; exiting gracefully...")
 	}
 }
+
+func newStateStore(kind, file, redisAddress, redisPasswordFile, memcachedAddress string, remote injectproxy.RemoteStoreConfig) (injectproxy.StateStore, error) {
+	switch kind {
+	case "memory":
+		return injectproxy.NewMemoryStateStore(), nil
+	case "file":
+		if file == "" {
+			return nil, errors.New("-state-file must be set when -state-store=file")
+		}
+		return injectproxy.NewFileStateStore(file)
+	case "redis":
+		if redisAddress == "" {
+			return nil, errors.New("-redis-address must be set when using the Redis store")
+		}
+
+		var password string
+		if redisPasswordFile != "" {
+			b, err := os.ReadFile(redisPasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read Redis password file: %w", err)
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		return injectproxy.NewRedisStateStore(redisAddress, password, remote), nil
+	case "memcached":
+		if memcachedAddress == "" {
+			return nil, errors.New("-memcached-address must be set when using the memcached store")
+		}
+		return injectproxy.NewMemcachedStateStore(memcachedAddress, remote), nil
+	default:
+		return nil, fmt.Errorf("unknown state store %q", kind)
+	}
+}